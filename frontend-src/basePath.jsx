@@ -0,0 +1,6 @@
+/*
+The path that the site is mounted under, like "/bobbin", or "" if it's at the
+root. The server tells us when there is one.
+*/
+
+export default window.bobbinBasePath || ""
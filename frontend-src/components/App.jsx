@@ -3,44 +3,102 @@ import { BrowserRouter as Router, Route, Link } from 'react-router-dom'
 
 import HomePage from 'components/HomePage.jsx'
 import ThreadPage from 'components/ThreadPage.jsx'
+import ThreadTreePage from 'components/ThreadTreePage.jsx'
 import FAQPage from 'components/FAQPage.jsx'
+import SettingsPage from 'components/SettingsPage.jsx'
+import SearchPage from 'components/SearchPage.jsx'
+import AuthorPage from 'components/AuthorPage.jsx'
+import MePage from 'components/MePage.jsx'
+import basePath from 'basePath.jsx'
+import { t } from 'i18n.jsx'
 
 export default class App extends React.PureComponent {
 	render() {
-		return <Router>
+		return <Router basename={basePath}>
 			<div id="page-wrapper">
-				<nav className="navbar navbar-light navbar-expand-sm">
+				<a className="skip-link" href="#content">{t("skipToContent")}</a>
+				<nav className="navbar navbar-light navbar-expand-sm" aria-label={t("mainNavigation")}>
 					<div className="container">
-						<Link className="navbar-brand" to="/">Bobbin <span className="beta-label">Beta</span></Link>
-						<button className="navbar-toggler" type="button" data-toggle="collapse" data-target="#navbar-links">
+						<Link className="navbar-brand" to="/">Bobbin <span className="beta-label">{t("beta")}</span></Link>
+						<button
+							className="navbar-toggler"
+							type="button"
+							data-toggle="collapse"
+							data-target="#navbar-links"
+							aria-controls="navbar-links"
+							aria-label={t("toggleNavigation")}
+						>
 							<span className="navbar-toggler-icon"></span>
 						</button>
 						<div className="collapse navbar-collapse" id="navbar-links">
 							{/*<Link className="nav-item nav-link disabled" to="#">About</Link>*/}
-							<Link className="nav-item nav-link" to="/faq">FAQ</Link>
+							<Link className="nav-item nav-link" to="/search">{t("navSearch")}</Link>
+							<Link className="nav-item nav-link" to="/faq">{t("navFaq")}</Link>
+							<Link className="nav-item nav-link" to="/settings">{t("navSettings")}</Link>
+							<Link className="nav-item nav-link" to="/me">{t("navMe")}</Link>
 						</div>
 					</div>
 				</nav>
-				<main>
+				<main id="content" tabIndex="-1">
 					<Route exact path="/" render={({ history }) =>
 						<HomePage navigate={path => history.push(path)}/>
 					}/>
-					<Route exact path="/thread/:id" render={({ match }) =>
-						<ThreadPage tail={match.params.id} />
+					<Route exact path="/thread/:id" render={({ match, location }) =>
+						<ThreadPage
+							tail={match.params.id}
+							page={Number(new URLSearchParams(location.search).get("page")) || 1}
+							audit={new URLSearchParams(location.search).get("audit") === "1"}
+						/>
+					}/>
+					<Route exact path="/t/:handle/:slug" render={({ match, location }) =>
+						// Only the tail id at the end of the slug matters
+						<ThreadPage
+							tail={match.params.slug.replace(/^.*-/, "")}
+							page={Number(new URLSearchParams(location.search).get("page")) || 1}
+							audit={new URLSearchParams(location.search).get("audit") === "1"}
+						/>
+					}/>
+					<Route exact path="/thread/:id/tree" render={({ match }) =>
+						<ThreadTreePage tail={match.params.id} />
 					}/>
 					<Route exact path="/faq" render={props =>
 						<FAQPage />
 					}/>
+					<Route exact path="/settings" render={() =>
+						<SettingsPage />
+					}/>
+					<Route exact path="/me" render={() =>
+						<MePage />
+					}/>
+					<Route exact path="/author/:handle" render={({ match, location }) =>
+						<AuthorPage
+							handle={match.params.handle}
+							page={Number(new URLSearchParams(location.search).get("page")) || 1}
+						/>
+					}/>
+					<Route exact path="/search" render={({ location, history }) => {
+						const query = new URLSearchParams(location.search)
+						return <SearchPage
+							params={{
+								q: query.get("q") || "",
+								author: query.get("author") || "",
+								since: query.get("since") || "",
+								until: query.get("until") || "",
+								page: Number(query.get("page")) || 1,
+							}}
+							navigate={path => history.push(path)}
+						/>
+					}}/>
 				</main>
 				<footer>
 					<div className="container">
 						<div className="row">
 							<div className="col d-flex justify-content-end">
 								<span className="footer-item">
-									<a href="https://github.com/Lucretiel/bobbin">Github</a>
+									<a href="https://github.com/Lucretiel/bobbin">{t("footerGithub")}</a>
 								</span>
 								<span className="footer-item">
-									<a href="https://github.com/Lucretiel/bobbin/issues">Issues & Feedback</a>
+									<a href="https://github.com/Lucretiel/bobbin/issues">{t("footerIssues")}</a>
 								</span>
 							</div>
 						</div>
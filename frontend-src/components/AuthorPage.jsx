@@ -0,0 +1,104 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+import { Link } from 'react-router-dom'
+
+import ThreadSummaryList from 'components/ThreadSummaryList.jsx'
+import Title from 'components/Title.jsx'
+import basePath from 'basePath.jsx'
+import { t } from 'i18n.jsx'
+
+// The threads by an author that bobbin has stored
+export default class AuthorPage extends React.PureComponent {
+	static propTypes = {
+		handle: PropTypes.string.isRequired,
+		page: PropTypes.number,
+	}
+
+	static defaultProps = {
+		page: 1,
+	}
+
+	constructor(props) {
+		super(props)
+
+		this.state = {
+			content: null,
+			error: null,
+		}
+	}
+
+	componentDidMount() {
+		this.load()
+	}
+
+	componentDidUpdate(prevProps) {
+		if(prevProps.handle !== this.props.handle || prevProps.page !== this.props.page) {
+			this.load()
+		}
+	}
+
+	load() {
+		const {handle, page} = this.props
+
+		this.setState({error: null})
+		fetch(`${basePath}/api/author?handle=${encodeURIComponent(handle)}&page=${page}`)
+		.then(response => response.json().then(content => ({response, content})))
+		.then(({response, content}) => response.ok ?
+			this.setState({content}) :
+			this.setState({
+				content: null,
+				error: content.reason === "opted_out" ? t("errorOptedOut") :
+					response.status === 404 ? t("authorNoThreads") :
+					t("authorError"),
+			})
+		)
+		.catch(() => this.setState({content: null, error: t("authorError")}))
+	}
+
+	render() {
+		const {handle} = this.props
+		const {content, error} = this.state
+
+		const pageLink = (target, label) => <Link to={`/author/${handle}?page=${target}`}>{label}</Link>
+
+		return <div className="container">
+			<Title>{t("authorTitle", handle)}</Title>
+			<div className="row">
+				<div className="col">
+					<h1>{t("authorTitle", handle)}</h1>
+					{content && content.author ?
+						<p>
+							<a href={`https://twitter.com/${content.author.handle}`} target="_blank" rel="noopener">
+								{content.author.name}
+							</a>
+							{' · '}
+							<a href={content.feed}>{t("authorFeed")}</a>
+						</p> :
+						null
+					}
+				</div>
+			</div>
+			<div className="row">
+				<div className="col">
+					{error ?
+						<p className="thread-error">{error}</p> :
+					content ?
+						<div>
+							<p>{t("authorThreadCount", content.total)}</p>
+							<ThreadSummaryList threads={content.threads}/>
+							{content.pages > 1 ?
+								<nav className="d-flex justify-content-between page-nav" aria-label={t("authorPages")}>
+									<span>{content.page > 1 ? pageLink(content.page - 1, t("newerThreads")) : null}</span>
+									<span>{t("pageOf", content.page, content.pages)}</span>
+									<span>{content.page < content.pages ? pageLink(content.page + 1, t("olderThreads")) : null}</span>
+								</nav> :
+								null
+							}
+						</div> :
+						null
+					}
+				</div>
+			</div>
+		</div>
+	}
+}
@@ -2,16 +2,24 @@ import React from 'react'
 import PropTypes from 'prop-types'
 import classNames from 'classnames'
 
-import TweetList from 'components/TweetList.jsx'
+import ThreadSummaryList from 'components/ThreadSummaryList.jsx'
 import Title from 'components/Title.jsx'
+import basePath from 'basePath.jsx'
+import { t } from 'i18n.jsx'
 
-const tweetRegex = /^\s*(?:(?:https?:\/\/)?(?:(?:www|mobile)\.)?twitter\.com\/[a-zA-Z0-9_]{1,15}\/status\/)?([0-9]{1,24})(?:[?#]\S*)?\s*$/
+const tweetRegex = /^\s*(?:(?:https?:\/\/)?(?:(?:www|mobile)\.)?(?:twitter|x)\.com\/(?:[a-zA-Z0-9_]{1,15}|i\/web)\/status(?:es)?\/)?([0-9]{1,24})\/?(?:[?#]\S*)?\s*$/
 
 const getTweetId = tweetLink => {
 	const match = tweetRegex.exec(tweetLink)
 	return match === null ? null : match[1]
 }
 
+// Links to posts on other sources, which the server unrolls (see source.py)
+const mastodonRegex = /^\s*https?:\/\/[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}\/(?:@[\w.-]+(?:@[a-zA-Z0-9.-]+)?|web\/@[\w.-]+(?:@[a-zA-Z0-9.-]+)?|web\/statuses|users\/[\w.-]+\/statuses)\/[0-9]{1,20}\/?(?:[?#]\S*)?\s*$/
+const blueskyRegex = /^\s*(?:(?:https?:\/\/)?(?:www\.)?bsky\.app\/profile\/[a-zA-Z0-9.:-]{1,253}\/post|at:\/\/[a-zA-Z0-9.:-]{1,253}\/app\.bsky\.feed\.post)\/[a-zA-Z0-9]{1,20}\/?(?:[?#]\S*)?\s*$/
+
+const isOtherSourceLink = link => mastodonRegex.test(link) || blueskyRegex.test(link)
+
 class TweetEntryForm extends React.PureComponent {
 	static propTypes = {
 		submit: PropTypes.func.isRequired,
@@ -23,6 +31,7 @@ class TweetEntryForm extends React.PureComponent {
 		this.state = {
 			tweetLink: "",
 			tweetId: null,
+			isOtherSource: false,
 		}
 	}
 
@@ -31,11 +40,13 @@ class TweetEntryForm extends React.PureComponent {
 	setLink = event => this.setState({
 		tweetLink: event.target.value,
 		tweetId: getTweetId(event.target.value),
+		isOtherSource: isOtherSourceLink(event.target.value),
 	})
 
-	submitId = () => {
+	submitId = event => {
 		const { tweetId } = this.state
 		if(tweetId) {
+			event.preventDefault()
 			this.props.submit(tweetId)
 		}
 	}
@@ -45,7 +56,7 @@ class TweetEntryForm extends React.PureComponent {
 		const tweetId = this.state.tweetId
 
 		const isEmpty = formText === ""
-		const isValid = tweetId !== null
+		const isValid = tweetId !== null || this.state.isOtherSource
 
 		const submitClass = classNames(
 			"btn", {
@@ -61,14 +72,17 @@ class TweetEntryForm extends React.PureComponent {
 				"is-invalid": !isEmpty && !isValid
 		})
 
-		return <form id="tweet-entry-form">
+		// If submitId doesn't handle the submission, the server will, by
+		// redirecting to the thread
+		return <form id="tweet-entry-form" method="post" action={`${basePath}/unroll`}>
 			<div className="form-row">
 				<div className="col">
 					<div className="form-group">
 						<input
 							type="text"
+							name="url"
 							className={textInputClass}
-							placeholder="Link to last tweet in thread"
+							placeholder={t("tweetLinkPlaceholder")}
 							value={formText}
 							onChange={this.setLink}
 						/>
@@ -78,13 +92,7 @@ class TweetEntryForm extends React.PureComponent {
 			<div className="form-row justify-content-center">
 				<div className="col col-md-7 col-sm-9">
 					<div className="collapse" id="submit-help-block">
-						<p><small>
-							To view a twitter thread, find the last tweet in the thread you
-							want to view, and copy-paste a link to the tweet above. Bobbin
-							will automatically follow the reply-chain backwards to the
-							beginning of the thread, and display the whole thread. The thread
-							view link can be shared with other people.
-						</small></p>
+						<p><small>{t("submitHelp")}</small></p>
 					</div>
 				</div>
 			</div>
@@ -97,7 +105,7 @@ class TweetEntryForm extends React.PureComponent {
 							data-toggle="collapse"
 							data-target="#submit-help-block"
 						>
-							Help
+							{t("help")}
 						</button>
 					</div>
 				</div>
@@ -109,7 +117,7 @@ class TweetEntryForm extends React.PureComponent {
 							onClick={this.submitId}
 							disabled={!isValid}
 						>
-							Submit
+							{t("submit")}
 						</button>
 					</div>
 				</div>
@@ -124,17 +132,36 @@ export default class MainPage extends React.PureComponent {
 		navigate: PropTypes.func.isRequired,
 	}
 
+	constructor(props) {
+		super(props)
+
+		this.state = {
+			threads: null,
+		}
+	}
+
+	// The server may keep the homepage static, in which case there are no
+	// threads to show
+	componentDidMount() {
+		fetch(`${basePath}/api/home`)
+		.then(response => response.ok ? response.json() : null)
+		.then(threads => this.setState({threads}))
+		.catch(() => null)
+	}
+
 	// TODO: load BEFORE redirecting
 	redirectToThread = tweetId => {
 		this.props.navigate(`/thread/${tweetId}`)
 	}
 
 	render() {
+		const {threads} = this.state
+
 		return <div className="container" id="homepage">
-			<Title>Bobbin</Title>
+			<Title>{t("homeTitle")}</Title>
 			<div className="row">
 				<div className="col text-center">
-					<h2>Share threads with <strong>Bobbin</strong></h2>
+					<h2>{t("homeHeading")}</h2>
 				</div>
 			</div>
 			<div className="row">
@@ -142,6 +169,25 @@ export default class MainPage extends React.PureComponent {
 					<TweetEntryForm submit={this.redirectToThread}/>
 				</div>
 			</div>
+			{threads ?
+				<div className="row home-threads">
+					{threads.recent.length ?
+						<section className="col-md">
+							<h3>{t("recentThreads")}</h3>
+							<ThreadSummaryList threads={threads.recent} showAuthor/>
+						</section> :
+						null
+					}
+					{threads.popular.length ?
+						<section className="col-md">
+							<h3>{t("popularThreads")}</h3>
+							<ThreadSummaryList threads={threads.popular} showAuthor/>
+						</section> :
+						null
+					}
+				</div> :
+				null
+			}
 		</div>
 	}
 }
@@ -0,0 +1,31 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+
+import { loadPreferences } from 'preferences.jsx'
+
+// A preview of the first link in a tweet, from the page's own metadata.
+// Like twitter's cards, it's hidden along with media.
+const LinkCard = ({ card }) => !loadPreferences().showMedia ? null :
+	<a className="tweet-card tweet-like" href={card.url} target="_blank" rel="noopener nofollow">
+		{card.image_url ?
+			<img src={card.image_url} alt="" loading="lazy" referrerPolicy="no-referrer"/> :
+			null
+		}
+		<span className="tweet-card-body">
+			{card.site_name ? <span className="tweet-card-site">{card.site_name}</span> : null}
+			<span className="tweet-card-title">{card.title}</span>
+			{card.description ? <span className="tweet-card-description">{card.description}</span> : null}
+		</span>
+	</a>
+
+LinkCard.propTypes = {
+	card: PropTypes.shape({
+		url: PropTypes.string.isRequired,
+		title: PropTypes.string.isRequired,
+		description: PropTypes.string,
+		image_url: PropTypes.string,
+		site_name: PropTypes.string,
+	}).isRequired,
+}
+
+export default LinkCard
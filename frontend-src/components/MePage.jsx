@@ -0,0 +1,72 @@
+import React from 'react'
+
+import ReadLaterSettings from 'components/ReadLaterSettings.jsx'
+import ThreadSummaryList from 'components/ThreadSummaryList.jsx'
+import Title from 'components/Title.jsx'
+import basePath from 'basePath.jsx'
+import { t } from 'i18n.jsx'
+
+// The signed in user's bookmarks and reading history, or a way to sign in
+export default class MePage extends React.PureComponent {
+	constructor(props) {
+		super(props)
+
+		this.state = {
+			content: null,
+			signedOut: false,
+			error: null,
+		}
+	}
+
+	componentDidMount() {
+		fetch(`${basePath}/api/me`, {credentials: "same-origin"})
+		.then(response => response.json().then(content => ({response, content})))
+		.then(({response, content}) => response.ok ?
+			this.setState({content}) :
+			response.status === 401 ?
+				this.setState({signedOut: true}) :
+				this.setState({error: response.status === 404 ? t("accountsDisabled") : t("meError")})
+		)
+		.catch(() => this.setState({error: t("meError")}))
+	}
+
+	render() {
+		const {content, signedOut, error} = this.state
+
+		return <div className="container">
+			<Title>{t("meTitle")}</Title>
+			<div className="row">
+				<div className="col">
+					<h1>{t("meTitle")}</h1>
+					{error ?
+						<p className="thread-error">{error}</p> :
+					signedOut ?
+						<div>
+							<p>{t("signInNote")}</p>
+							<a className="btn btn-primary" href={`${basePath}/login`}>{t("signIn")}</a>
+						</div> :
+					content ?
+						<div>
+							<form className="form-inline" method="post" action={`${basePath}/logout`}>
+								<span className="mr-2">{t("signedInAs", content.account.handle)}</span>
+								<button type="submit" className="btn btn-link">{t("signOut")}</button>
+							</form>
+							<h2>{t("bookmarks")}</h2>
+							{content.bookmarks.length ?
+								<ThreadSummaryList threads={content.bookmarks} showAuthor/> :
+								<p>{t("noBookmarks")}</p>
+							}
+							<h2>{t("readingHistory")}</h2>
+							{content.history.length ?
+								<ThreadSummaryList threads={content.history} showAuthor/> :
+								<p>{t("noReadingHistory")}</p>
+							}
+							<ReadLaterSettings/>
+						</div> :
+						null
+					}
+				</div>
+			</div>
+		</div>
+	}
+}
@@ -0,0 +1,54 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+
+import _ from 'lodash'
+
+import { language, t } from 'i18n.jsx'
+
+const formatTime = time => new Date(time).toLocaleString(language, {
+	year: "numeric",
+	month: "short",
+	day: "numeric",
+	hour: "numeric",
+	minute: "2-digit",
+})
+
+// The results of a poll in a tweet, as of when the thread was fetched.
+// Twitter's widget shows polls too, but only if the tweet can still be
+// embedded, and without the final results.
+const Poll = ({ poll }) => <div className="tweet-poll tweet-like">
+	<ol className="list-unstyled">{
+		_.map(poll.options, option =>
+			<li key={option.position}>
+				<span className="poll-bar" style={{width: `${option.percentage}%`}}></span>
+				<span className="poll-label">{option.label}</span>
+				<span className="poll-percentage">{option.percentage}%</span>
+			</li>
+		)
+	}</ol>
+	<p className="poll-status">
+		{t("pollVotes", poll.total_votes)}
+		{poll.voting_status === "closed" ?
+			` · ${t("pollFinal")}` :
+		poll.end_datetime ?
+			<span> · <time dateTime={poll.end_datetime}>{t("pollEnds", formatTime(poll.end_datetime))}</time></span> :
+			null
+		}
+	</p>
+</div>
+
+Poll.propTypes = {
+	poll: PropTypes.shape({
+		options: PropTypes.arrayOf(PropTypes.shape({
+			position: PropTypes.number.isRequired,
+			label: PropTypes.string.isRequired,
+			votes: PropTypes.number.isRequired,
+			percentage: PropTypes.number.isRequired,
+		})).isRequired,
+		total_votes: PropTypes.number.isRequired,
+		end_datetime: PropTypes.string,
+		voting_status: PropTypes.string,
+	}).isRequired,
+}
+
+export default Poll
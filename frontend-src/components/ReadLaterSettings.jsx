@@ -0,0 +1,138 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+
+import basePath from 'basePath.jsx'
+import { t } from 'i18n.jsx'
+
+// The form for connecting a service with credentials: a username and
+// password for Instapaper, or an access token for Readwise
+class ConnectForm extends React.PureComponent {
+	static propTypes = {
+		service: PropTypes.object.isRequired,
+		onConnected: PropTypes.func.isRequired,
+	}
+
+	state = {
+		username: "",
+		password: "",
+		token: "",
+		connecting: false,
+		error: null,
+	}
+
+	submit = event => {
+		event.preventDefault()
+
+		const {service} = this.props
+		const {username, password, token} = this.state
+		const body = new URLSearchParams(service.connect_with === "password" ? {username, password} : {token})
+		this.setState({connecting: true, error: null})
+
+		fetch(`${basePath}/api/read-later/${service.name}/connection`, {method: "POST", credentials: "same-origin", body})
+		.then(response => response.json().then(content => ({response, content})))
+		.then(({response, content}) => {
+			if(response.ok) {
+				this.props.onConnected(content.services)
+			} else {
+				this.setState({connecting: false, error: content.error || t("readLaterError")})
+			}
+		})
+		.catch(() => this.setState({connecting: false, error: t("readLaterError")}))
+	}
+
+	render() {
+		const {service} = this.props
+		const {username, password, token, connecting, error} = this.state
+		const id = `read-later-${service.name}`
+
+		return <form className="form-inline" onSubmit={this.submit}>
+			{service.connect_with === "password" ? [
+				<label key="username-label" htmlFor={`${id}-username`} className="sr-only">{t("readLaterUsername")}</label>,
+				<input
+					key="username"
+					id={`${id}-username`}
+					required
+					className="form-control mr-2"
+					placeholder={t("readLaterUsername")}
+					value={username}
+					onChange={event => this.setState({username: event.target.value})}
+				/>,
+				<label key="password-label" htmlFor={`${id}-password`} className="sr-only">{t("readLaterPassword")}</label>,
+				<input
+					key="password"
+					id={`${id}-password`}
+					type="password"
+					className="form-control mr-2"
+					placeholder={t("readLaterPassword")}
+					value={password}
+					onChange={event => this.setState({password: event.target.value})}
+				/>,
+			] : [
+				<label key="token-label" htmlFor={`${id}-token`} className="sr-only">{t("readLaterToken")}</label>,
+				<input
+					key="token"
+					id={`${id}-token`}
+					required
+					className="form-control mr-2"
+					placeholder={t("readLaterToken")}
+					title={t("readLaterTokenNote")}
+					value={token}
+					onChange={event => this.setState({token: event.target.value})}
+				/>,
+			]}
+			<button type="submit" className="btn btn-primary" disabled={connecting}>
+				{t("readLaterConnect", service.title)}
+			</button>
+			{error ? <span className="thread-error ml-2">{error}</span> : null}
+		</form>
+	}
+}
+
+// Connecting and disconnecting the signed in user's read later services.
+// Renders nothing if the server doesn't have any.
+export default class ReadLaterSettings extends React.PureComponent {
+	state = {
+		services: null,
+	}
+
+	componentDidMount() {
+		fetch(`${basePath}/api/read-later`, {credentials: "same-origin"})
+		.then(response => response.ok ? response.json() : {services: null})
+		.then(content => this.setState({services: content.services}))
+		.catch(() => null)
+	}
+
+	disconnect(service) {
+		fetch(`${basePath}/api/read-later/${service.name}/connection`, {method: "DELETE", credentials: "same-origin"})
+		.then(response => response.ok ? response.json() : Promise.reject(response))
+		.then(content => this.setState({services: content.services}))
+		.catch(() => null)
+	}
+
+	render() {
+		const {services} = this.state
+		if(!services || !services.length) {
+			return null
+		}
+
+		return <div className="read-later-settings">
+			<h2>{t("readLater")}</h2>
+			<p>{t("readLaterNote")}</p>
+			{services.map(service => <div key={service.name} className="mb-2">
+				{service.connected ?
+					<div className="form-inline">
+						<span className="mr-2">{t("readLaterConnected", service.title)}</span>
+						<button type="button" className="btn btn-link" onClick={() => this.disconnect(service)}>
+							{t("readLaterDisconnect")}
+						</button>
+					</div> :
+				service.connect_with === "redirect" ?
+					<a className="btn btn-primary" href={`${basePath}/read-later/${service.name}/connect`}>
+						{t("readLaterConnect", service.title)}
+					</a> :
+					<ConnectForm service={service} onConnected={services => this.setState({services})}/>
+				}
+			</div>)}
+		</div>
+	}
+}
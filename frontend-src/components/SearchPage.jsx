@@ -0,0 +1,175 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+import { Link } from 'react-router-dom'
+
+import _ from 'lodash'
+
+import Title from 'components/Title.jsx'
+import basePath from 'basePath.jsx'
+import { t, language } from 'i18n.jsx'
+
+const FIELDS = ["q", "author", "since", "until"]
+
+const searchQuery = params => new URLSearchParams(
+	_.pickBy(params, value => value)
+).toString()
+
+const formatDate = date => new Date(date).toLocaleDateString(language, {
+	year: "numeric",
+	month: "short",
+	day: "numeric",
+})
+
+const SearchResult = ({ result }) => <li className="search-result tweet-like">
+	<Link to={`/thread/${result.tail}`}>
+		{result.author ?
+			t("threadTitle", result.author.handle) :
+			t("conversation")
+		}
+	</Link>
+	<p className="search-snippet">{result.snippet}</p>
+	<p className="search-details">
+		{formatDate(result.created_at)} · {t("statsTweets", result.tweet_count)}
+	</p>
+</li>
+
+SearchResult.propTypes = {
+	result: PropTypes.shape({
+		tail: PropTypes.string.isRequired,
+		author: PropTypes.shape({
+			handle: PropTypes.string.isRequired,
+		}),
+		tweet_count: PropTypes.number.isRequired,
+		created_at: PropTypes.string.isRequired,
+		snippet: PropTypes.string.isRequired,
+	}).isRequired,
+}
+
+export default class SearchPage extends React.PureComponent {
+	static propTypes = {
+		// The search, from the url's query string
+		params: PropTypes.shape({
+			q: PropTypes.string,
+			author: PropTypes.string,
+			since: PropTypes.string,
+			until: PropTypes.string,
+			page: PropTypes.number,
+		}).isRequired,
+		navigate: PropTypes.func.isRequired,
+	}
+
+	constructor(props) {
+		super(props)
+
+		this.state = {
+			fields: _.mapValues(_.pick(props.params, FIELDS), value => value || ""),
+			results: null,
+			error: null,
+		}
+	}
+
+	componentDidMount() {
+		this.search()
+	}
+
+	componentDidUpdate(prevProps) {
+		if(!_.isEqual(prevProps.params, this.props.params)) {
+			this.search()
+		}
+	}
+
+	search() {
+		const {params} = this.props
+		if(!params.q) {
+			this.setState({results: null, error: null})
+			return
+		}
+
+		this.setState({error: null})
+		fetch(`${basePath}/api/search?${searchQuery(params)}`)
+		.then(response => response.json().then(content => ({response, content})))
+		.then(({response, content}) => response.ok ?
+			this.setState({results: content}) :
+			this.setState({results: null, error: content.error || t("searchError")})
+		)
+		.catch(() => this.setState({results: null, error: t("searchError")}))
+	}
+
+	setField = event => this.setState({
+		fields: Object.assign({}, this.state.fields, {[event.target.name]: event.target.value}),
+	})
+
+	submit = event => {
+		event.preventDefault()
+		this.props.navigate(`/search?${searchQuery(this.state.fields)}`)
+	}
+
+	pageLink(page, label) {
+		return <Link to={`/search?${searchQuery(Object.assign({}, this.props.params, {page}))}`}>{label}</Link>
+	}
+
+	render() {
+		const {fields, results, error} = this.state
+
+		return <div className="container">
+			<Title>{this.props.params.q ? t("searchResultsTitle", this.props.params.q) : t("searchTitle")}</Title>
+			<div className="row">
+				<div className="col">
+					<h1>{t("searchTitle")}</h1>
+					<form id="search-form" role="search" method="get" action={`${basePath}/search`} onSubmit={this.submit}>
+						<div className="form-group">
+							<label htmlFor="search-q" className="sr-only">{t("searchLabel")}</label>
+							<input
+								id="search-q"
+								type="search"
+								name="q"
+								className="form-control form-control-lg"
+								placeholder={t("searchPlaceholder")}
+								value={fields.q}
+								onChange={this.setField}
+							/>
+						</div>
+						<div className="form-row">
+							<div className="form-group col-sm">
+								<label htmlFor="search-author">{t("searchAuthor")}</label>
+								<input id="search-author" type="text" name="author" className="form-control" placeholder="@handle" value={fields.author} onChange={this.setField}/>
+							</div>
+							<div className="form-group col-sm">
+								<label htmlFor="search-since">{t("searchSince")}</label>
+								<input id="search-since" type="date" name="since" className="form-control" value={fields.since} onChange={this.setField}/>
+							</div>
+							<div className="form-group col-sm">
+								<label htmlFor="search-until">{t("searchUntil")}</label>
+								<input id="search-until" type="date" name="until" className="form-control" value={fields.until} onChange={this.setField}/>
+							</div>
+						</div>
+						<button type="submit" className="btn btn-primary" disabled={!fields.q.trim()}>{t("search")}</button>
+					</form>
+				</div>
+			</div>
+			<div className="row">
+				<div className="col" aria-live="polite">
+					{error ?
+						<p className="thread-error">{error}</p> :
+					results ?
+						<div className="search-results">
+							<p>{t("searchCount", results.total)}</p>
+							<ol className="list-unstyled">
+								{_.map(results.results, result => <SearchResult key={result.tail} result={result}/>)}
+							</ol>
+							{results.pages > 1 ?
+								<nav className="page-nav" aria-label={t("searchPages")}>
+									{results.page > 1 ? this.pageLink(results.page - 1, t("searchPrevious")) : null}{' '}
+									{t("pageOf", results.page, results.pages)}{' '}
+									{results.page < results.pages ? this.pageLink(results.page + 1, t("searchNext")) : null}
+								</nav> :
+								null
+							}
+						</div> :
+						null
+					}
+				</div>
+			</div>
+		</div>
+	}
+}
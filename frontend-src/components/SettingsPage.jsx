@@ -0,0 +1,84 @@
+import React from 'react'
+
+import Title from 'components/Title.jsx'
+import {
+	THEMES,
+	FONT_SIZES,
+	loadPreferences,
+	savePreferences,
+} from 'preferences.jsx'
+import { t } from 'i18n.jsx'
+
+export default class SettingsPage extends React.PureComponent {
+	constructor(props) {
+		super(props)
+
+		this.state = {
+			prefs: loadPreferences(),
+		}
+	}
+
+	update(changes) {
+		const prefs = Object.assign({}, this.state.prefs, changes)
+		savePreferences(prefs)
+		this.setState({prefs})
+	}
+
+	render() {
+		const {prefs} = this.state
+
+		return <div className="container">
+			<Title>{t("settingsTitle")}</Title>
+			<div className="row">
+				<div className="col">
+					<h1>{t("settingsTitle")}</h1>
+					<form id="settings-form" onSubmit={event => event.preventDefault()}>
+						<div className="form-group">
+							<label htmlFor="theme">{t("theme")}</label>
+							<select
+								id="theme"
+								className="form-control"
+								value={prefs.theme}
+								onChange={event => this.update({theme: event.target.value})}
+							>
+								{THEMES.map(theme => <option key={theme} value={theme}>{t("themeNames")[theme]}</option>)}
+							</select>
+						</div>
+						<div className="form-group">
+							<label htmlFor="font-size">{t("fontSize")}</label>
+							<select
+								id="font-size"
+								className="form-control"
+								value={prefs.fontSize}
+								onChange={event => this.update({fontSize: event.target.value})}
+							>
+								{FONT_SIZES.map(size => <option key={size} value={size}>{t("fontSizeNames")[size]}</option>)}
+							</select>
+						</div>
+						<div className="form-check">
+							<input
+								id="show-media"
+								type="checkbox"
+								className="form-check-input"
+								checked={prefs.showMedia}
+								onChange={event => this.update({showMedia: event.target.checked})}
+							/>
+							<label className="form-check-label" htmlFor="show-media">{t("showMedia")}</label>
+						</div>
+						<div className="form-check">
+							<input
+								id="show-timestamps"
+								type="checkbox"
+								className="form-check-input"
+								checked={prefs.showTimestamps}
+								onChange={event => this.update({showTimestamps: event.target.checked})}
+							/>
+							<label className="form-check-label" htmlFor="show-timestamps">{t("showTimestamps")}</label>
+						</div>
+					</form>
+					<p className="settings-note">{t("settingsNote")}</p>
+				</div>
+			</div>
+		</div>
+	}
+}
@@ -1,13 +1,300 @@
 import React from 'react'
 import PropTypes from 'prop-types'
+import { Link } from 'react-router-dom'
+
+import _ from 'lodash'
 
 import TweetList from 'components/TweetList.jsx'
 import Title from 'components/Title.jsx'
+import basePath from 'basePath.jsx'
+import { t, language } from 'i18n.jsx'
+import { lastViewed, markViewed } from 'lastViewed.jsx'
+
+const errorMessage = (status, content) =>
+	status === 403 && content.reason === "opted_out" ?
+		t("errorOptedOut") :
+	status === 404 ?
+		content.reason === "protected" ?
+			t("errorProtected") :
+		content.reason ?
+			t("errorLastTweet", content.reason) :
+			t("errorNotFound") :
+	status === 502 ?
+		t("errorTwitter") :
+	status === 503 ?
+		t("errorBusy") :
+	status === 429 ?
+		t("errorTooManyRequests") :
+		t("errorGeneric")
+
+// In audit mode, list the images in the thread that have no alt text. audit
+// is null until the audit has loaded.
+const AuditReport = ({ audit }) =>
+	<div className="row">
+		<div className="col">
+			<div className="tweet-unavailable tweet-like thread-audit" role="status">{
+				audit === null ?
+					t("auditLoading") :
+				audit.ok ?
+					t("auditOk", audit.media_count) :
+					<div>
+						{t("auditMissing", audit.missing_alt_text.length, audit.media_count)}
+						<ul>{audit.missing_alt_text.map((issue, index) =>
+							<li key={index}>
+								<a href={`https://twitter.com/i/web/status/${issue.tweet_id}`} target="_blank">
+									{issue.quoted ? t("auditQuoted", issue.tweet_id) : t("auditTweet", issue.tweet_id)}
+								</a>
+							</li>
+						)}</ul>
+					</div>
+			}</div>
+		</div>
+	</div>
+
+AuditReport.propTypes = {
+	audit: PropTypes.shape({
+		ok: PropTypes.bool.isRequired,
+		media_count: PropTypes.number.isRequired,
+		missing_alt_text: PropTypes.arrayOf(PropTypes.shape({
+			tweet_id: PropTypes.string.isRequired,
+			quoted: PropTypes.bool.isRequired,
+		})).isRequired,
+	}),
+}
+
+const formatDate = date => new Date(date).toLocaleDateString(language, {
+	year: "numeric",
+	month: "short",
+	day: "numeric",
+})
+
+// A summary of the whole thread, for the header
+const ThreadStats = ({ stats }) => {
+	const firstDate = stats.first_tweet_at ? formatDate(stats.first_tweet_at) : null
+	const lastDate = stats.last_tweet_at ? formatDate(stats.last_tweet_at) : null
+
+	const items = [
+		t("statsTweets", stats.tweets),
+		t("statsWords", stats.words),
+		stats.reading_minutes > 0 ? t("statsReadingTime", stats.reading_minutes) : null,
+		firstDate === lastDate ? firstDate : `${firstDate} – ${lastDate}`,
+		stats.media > 0 ? t("statsMedia", stats.media) : null,
+		stats.links > 0 ? t("statsLinks", stats.links) : null,
+	].filter(Boolean)
+
+	// Engagement is left out when the server hides metrics
+	const engagement = stats.engagement ? [
+		t("statsLikes", stats.engagement.likes),
+		t("statsRetweets", stats.engagement.retweets),
+		stats.engagement.replies !== null ? t("statsReplies", stats.engagement.replies) : null,
+	].filter(Boolean) : []
+
+	return <div className="thread-stats">
+		<p>{items.join(" · ")}</p>
+		{engagement.length ? <p>{engagement.join(" · ")}</p> : null}
+	</div>
+}
+
+ThreadStats.propTypes = {
+	stats: PropTypes.shape({
+		tweets: PropTypes.number.isRequired,
+		words: PropTypes.number.isRequired,
+		reading_minutes: PropTypes.number.isRequired,
+		first_tweet_at: PropTypes.string,
+		last_tweet_at: PropTypes.string,
+		media: PropTypes.number.isRequired,
+		links: PropTypes.number.isRequired,
+		engagement: PropTypes.shape({
+			likes: PropTypes.number.isRequired,
+			retweets: PropTypes.number.isRequired,
+			replies: PropTypes.number,
+		}),
+	}).isRequired,
+}
+
+// The changes to a thread since the reader last viewed it, added up from its
+// revisions
+const UpdatedBanner = ({ revisions }) => {
+	const count = field => _.sumBy(revisions, revision => revision[field].length)
+	const items = [
+		count("added") ? t("updatedAdded", count("added")) : null,
+		count("edited") ? t("updatedEdited", count("edited")) : null,
+		count("deleted") ? t("updatedDeleted", count("deleted")) : null,
+	].filter(Boolean)
+
+	return <div className="row">
+		<div className="col">
+			<div className="tweet-unavailable tweet-like thread-updated" role="status">
+				{t("threadUpdated")} {items.join(", ")}
+			</div>
+		</div>
+	</div>
+}
+
+UpdatedBanner.propTypes = {
+	revisions: PropTypes.arrayOf(PropTypes.shape({
+		added: PropTypes.arrayOf(PropTypes.string).isRequired,
+		edited: PropTypes.arrayOf(PropTypes.object).isRequired,
+		deleted: PropTypes.arrayOf(PropTypes.string).isRequired,
+	})).isRequired,
+}
+
+// Kindles only take books, and get them without a confirmation email
+const isKindle = address => /@(free\.)?kindle\.com\s*$/i.test(address)
+
+class EmailForm extends React.PureComponent {
+	static propTypes = {
+		tail: PropTypes.string.isRequired,
+	}
+
+	state = {
+		open: false,
+		address: "",
+		format: "html",
+		status: null,
+	}
+
+	submit = event => {
+		event.preventDefault()
+
+		const {address} = this.state
+		const format = isKindle(address) ? "epub" : this.state.format
+		const query = `address=${encodeURIComponent(address)}&format=${format}`
+		this.setState({status: "sending"})
+
+		fetch(`${basePath}/api/thread/${this.props.tail}/email?${query}`, {method: "POST"})
+		.then(response => response.ok ? response.json() : Promise.reject(response))
+		.then(content => this.setState({status: content.status}))
+		.catch(response => this.setState({
+			status: response && response.status === 429 ? "tooMany" :
+				response && response.status === 404 ? "disabled" :
+				"failed",
+		}))
+	}
+
+	render() {
+		const {open, address, format, status} = this.state
+
+		if(!open) {
+			return <div>
+				<button type="button" className="btn btn-link email-button" onClick={() => this.setState({open: true})}>
+					{t("emailThread")}
+				</button>
+			</div>
+		}
+
+		if(status === "confirm" || status === "sent") {
+			return <div className="email-status">{t(status === "sent" ? "emailSent" : "emailConfirm", address)}</div>
+		}
+
+		return <form className="email-form form-inline justify-content-center" onSubmit={this.submit}>
+			<label htmlFor="email-address" className="sr-only">{t("emailAddress")}</label>
+			<input
+				id="email-address"
+				type="email"
+				required
+				className="form-control mr-2"
+				placeholder={t("emailAddress")}
+				value={address}
+				onChange={event => this.setState({address: event.target.value})}
+			/>
+			<label htmlFor="email-format" className="sr-only">{t("emailFormat")}</label>
+			<select
+				id="email-format"
+				className="form-control mr-2"
+				value={isKindle(address) ? "epub" : format}
+				disabled={isKindle(address)}
+				onChange={event => this.setState({format: event.target.value})}
+			>
+				<option value="html">{t("emailFormatNames").html}</option>
+				<option value="epub">{t("emailFormatNames").epub}</option>
+			</select>
+			<button type="submit" className="btn btn-primary" disabled={status === "sending"}>
+				{t("emailSend")}
+			</button>
+			{status === "tooMany" || status === "disabled" || status === "failed" ?
+				<span className="thread-error ml-2">{t("emailErrors")[status]}</span> :
+				null
+			}
+		</form>
+	}
+}
+
+// Buttons for saving the thread to the signed in user's connected read
+// later services
+class ReadLaterButtons extends React.PureComponent {
+	static propTypes = {
+		tail: PropTypes.string.isRequired,
+	}
+
+	state = {
+		services: [],
+		// service name -> "saving", "saved", "reconnect", or "failed"
+		statuses: {},
+	}
+
+	componentDidMount() {
+		fetch(`${basePath}/api/read-later`, {credentials: "same-origin"})
+		.then(response => response.ok ? response.json() : {services: []})
+		.then(content => this.setState({services: content.services.filter(service => service.connected)}))
+		.catch(() => null)
+	}
+
+	setStatus(service, status) {
+		this.setState(({statuses}) => ({statuses: {...statuses, [service.name]: status}}))
+	}
+
+	save(service) {
+		this.setStatus(service, "saving")
+
+		fetch(`${basePath}/api/thread/${this.props.tail}/read-later?service=${service.name}`, {
+			method: "POST",
+			credentials: "same-origin",
+		})
+		.then(response => this.setStatus(service, response.ok ? "saved" : response.status === 409 ? "reconnect" : "failed"))
+		.catch(() => this.setStatus(service, "failed"))
+	}
+
+	render() {
+		const {services, statuses} = this.state
+
+		return <span className="read-later-buttons">
+			{services.map(service => {
+				const status = statuses[service.name]
+				return <button
+					key={service.name}
+					type="button"
+					className="btn btn-link read-later-button"
+					title={status === "reconnect" ? t("readLaterReconnect", service.title) : status === "failed" ? t("readLaterFailed", service.title) : null}
+					disabled={status === "saving" || status === "saved"}
+					onClick={() => this.save(service)}
+				>
+					{status === "saved" ? t("readLaterSaved", service.title) : t("readLaterSave", service.title)}
+				</button>
+			})}
+		</span>
+	}
+}
+
+const PAGE_SIZE = 50
+
+// How long to wait before checking on a thread that's still being resolved
+const POLL_INTERVAL = 2000
+
+// How long scrolling has to stop before the reading position is saved
+const POSITION_SAVE_DELAY = 2000
 
 export default class ThreadPage extends React.PureComponent {
 	static propTypes = {
 		head: PropTypes.string,
 		tail: PropTypes.string.isRequired,
+		page: PropTypes.number,
+		audit: PropTypes.bool,
+	}
+
+	static defaultProps = {
+		page: 1,
+		audit: false,
 	}
 
 	constructor(props) {
@@ -15,24 +302,297 @@ export default class ThreadPage extends React.PureComponent {
 
 		this.state = {
 			threadTweetIds: null,
+			unavailable: {},
+			tweets: {},
+			truncated: null,
+			pages: 1,
+			found: null,
+			processing: false,
 			author: null,
+			stats: null,
+			error: null,
 			fullyRendered: false,
+			audit: null,
+			revisions: [],
+			bookmarked: null,
+			resumePage: null,
+			live: false,
+			liveFailed: false,
 		}
 	}
 
 	componentDidMount() {
-		const {head, tail} = this.props
+		// Remembered before this view is recorded, to compare the thread's
+		// revisions to
+		this.lastViewed = lastViewed(this.props.tail)
 
-		const query = head ?
-			`head=${head}&tail=${tail}` :
-			`tail=${tail}`
+		if(this.props.audit) {
+			this.loadAudit()
+		}
 
-		fetch(`/api/thread?${query}`)
-		.then(response => response.json())
-		.then(content => this.setState({
-				threadTweetIds: content.thread,
-				author: content.author,
-		}))
+		window.addEventListener("scroll", this.scheduleSavePosition)
+
+		// Stream the first page's tweets in as they're found, so that long
+		// threads don't show a blank page while they're resolved
+		if(window.EventSource && this.props.page === 1 && !this.props.head) {
+			this.streamThread()
+		} else {
+			this.loadPage()
+		}
+	}
+
+	componentWillUnmount() {
+		this.closeStream()
+		this.stopLive()
+		clearTimeout(this.pollTimer)
+		window.removeEventListener("scroll", this.scheduleSavePosition)
+		this.scheduleSavePosition.cancel()
+	}
+
+	closeStream() {
+		if(this.events) {
+			this.events.close()
+			this.events = null
+		}
+	}
+
+	// Once the stream is over, load the thread as usual, which is now cheap,
+	// for the author, pagination, and any errors
+	finishStream = () => {
+		this.closeStream()
+		this.setState({found: null})
+		this.loadPage()
+	}
+
+	streamThread() {
+		this.events = new EventSource(`${basePath}/thread/${this.props.tail}/events`)
+		this.setState({found: 0})
+
+		this.events.addEventListener("tweet", event => {
+			const tweet = JSON.parse(event.data)
+			this.setState(({threadTweetIds, found}) => ({
+				found: found + 1,
+				threadTweetIds: found < PAGE_SIZE ?
+					[tweet.id, ...(threadTweetIds || [])] :
+					threadTweetIds,
+			}))
+		})
+
+		this.events.addEventListener("done", this.finishStream)
+		this.events.addEventListener("failed", this.finishStream)
+		this.events.onerror = this.finishStream
+	}
+
+	// Add tweets to the end of the thread, skipping any that are already
+	// there
+	appendTweets(newTweets) {
+		this.setState(({threadTweetIds, tweets}) => {
+			const shown = new Set(threadTweetIds)
+			const added = newTweets.filter(tweet => !shown.has(tweet.id))
+			return added.length ? {
+				threadTweetIds: [...threadTweetIds, ...added.map(tweet => tweet.id)],
+				tweets: {...tweets, ..._.keyBy(added, "id")},
+			} : null
+		})
+	}
+
+	// Keep a socket open to the server, which sends the tweets the author
+	// adds to the thread as they're found. The first message is the whole
+	// thread, which may already have grown since it was loaded.
+	followLive = () => {
+		const protocol = window.location.protocol === "https:" ? "wss:" : "ws:"
+		this.liveSocket = new WebSocket(`${protocol}//${window.location.host}${basePath}/thread/${this.props.tail}/live`)
+		this.setState({live: true, liveFailed: false})
+
+		this.liveSocket.onmessage = event => {
+			const message = JSON.parse(event.data)
+			if(message.type === "thread" || message.type === "tweets") {
+				this.appendTweets(message.tweets)
+			} else if(message.type === "failed") {
+				this.setState({liveFailed: true})
+			}
+		}
+
+		this.liveSocket.onerror = () => this.setState({liveFailed: true})
+		this.liveSocket.onclose = () => {
+			this.liveSocket = null
+			this.setState({live: false})
+		}
+	}
+
+	stopLive = () => {
+		if(this.liveSocket) {
+			this.liveSocket.onclose = null
+			this.liveSocket.close()
+			this.liveSocket = null
+			this.setState({live: false})
+		}
+	}
+
+	componentDidUpdate(prevProps, prevState) {
+		if(prevProps.page !== this.props.page) {
+			this.closeStream()
+			this.stopLive()
+			clearTimeout(this.pollTimer)
+			this.restorePosition = null
+			this.setState({threadTweetIds: null, fullyRendered: false, resumePage: null})
+			this.loadPage()
+		} else if(this.state.fullyRendered && !prevState.fullyRendered) {
+			this.scrollToPosition()
+		}
+	}
+
+	loadPage() {
+		const {head, tail, page} = this.props
+
+		const query = (head ? `head=${head}&` : "") + `page=${page}&page_size=${PAGE_SIZE}`
+
+		fetch(`${basePath}/api/thread/${tail}?${query}`, {credentials: "same-origin"})
+		.then(response => response.json().then(content => ({response, content})))
+		.then(({response, content}) => {
+			if(response.status === 202) {
+				// The server is still working on the thread; check back later
+				this.setState({processing: true})
+				this.pollTimer = setTimeout(() => this.loadPage(), POLL_INTERVAL)
+			} else if(response.ok) {
+				this.setState({
+					processing: false,
+					threadTweetIds: content.thread,
+					unavailable: content.unavailable || {},
+					truncated: content.truncated || null,
+					pages: content.pages || 1,
+					author: content.author,
+					stats: content.stats || null,
+					tweets: _.keyBy(content.tweets, "id"),
+				})
+				this.threadLoaded()
+			} else {
+				this.setState({processing: false, error: errorMessage(response.status, content)})
+			}
+		})
+		.catch(() => this.setState({error: t("errorGeneric")}))
+	}
+
+	// Point out changes since the last view, and record this one
+	threadLoaded() {
+		const {tail} = this.props
+
+		if(this.lastViewed) {
+			const since = this.lastViewed
+			this.lastViewed = null
+
+			fetch(`${basePath}/api/revisions?tail=${tail}`)
+			.then(response => response.ok ? response.json() : {revisions: []})
+			.then(content => this.setState({
+				revisions: content.revisions.filter(revision => new Date(revision.recorded_at) > new Date(since)),
+			}))
+			.catch(() => {})
+		}
+
+		markViewed(tail)
+		this.loadAccountState()
+	}
+
+	// For signed in users, find out if the thread is bookmarked, and add it
+	// to their reading history. Anyone else gets a 401, and no bookmark
+	// button.
+	loadAccountState() {
+		const {tail} = this.props
+
+		fetch(`${basePath}/api/bookmarks?tail=${tail}`, {credentials: "same-origin"})
+		.then(response => response.ok ? response.json() : {bookmarked: null})
+		.then(content => {
+			this.setState({bookmarked: content.bookmarked})
+			if(content.bookmarked !== null) {
+				this.signedIn = true
+				fetch(`${basePath}/api/history?tail=${tail}`, {method: "POST", credentials: "same-origin"})
+				this.loadPosition()
+			}
+		})
+		.catch(() => {})
+	}
+
+	// Reopen the thread at the last tweet read, on whatever device. If it's
+	// on this page, scroll to it once the tweets are rendered; otherwise,
+	// offer a link to its page.
+	loadPosition() {
+		const {tail, page} = this.props
+
+		fetch(`${basePath}/api/thread/${tail}/position`, {credentials: "same-origin"})
+		.then(response => response.ok ? response.json() : {position: null})
+		.then(({position, index}) => {
+			this.savedPosition = position
+			if(position === null || index === null) {
+				return
+			}
+
+			const positionPage = Math.floor(index / PAGE_SIZE) + 1
+			if(positionPage === page) {
+				this.restorePosition = position
+				if(this.state.fullyRendered) {
+					this.scrollToPosition()
+				}
+			} else {
+				this.setState({resumePage: positionPage})
+			}
+		})
+		.catch(() => {})
+	}
+
+	scrollToPosition() {
+		const position = this.restorePosition
+		this.restorePosition = null
+
+		const element = position ? document.querySelector(`[data-tweet-id="${position}"]`) : null
+		if(element) {
+			element.scrollIntoView()
+		}
+	}
+
+	// The last tweet that's scrolled into view is the reading position
+	savePosition = () => {
+		if(!this.signedIn) {
+			return
+		}
+
+		const visible = _.filter(
+			document.querySelectorAll("[data-tweet-id]"),
+			element => element.getBoundingClientRect().top < window.innerHeight
+		)
+		const position = visible.length ? visible[visible.length - 1].getAttribute("data-tweet-id") : null
+
+		if(position && position !== this.savedPosition) {
+			this.savedPosition = position
+			fetch(`${basePath}/api/thread/${this.props.tail}/position?position=${position}`, {
+				method: "PUT",
+				credentials: "same-origin",
+			})
+			.catch(() => {})
+		}
+	}
+
+	scheduleSavePosition = _.debounce(this.savePosition, POSITION_SAVE_DELAY)
+
+	toggleBookmark = () => {
+		const {tail} = this.props
+
+		fetch(`${basePath}/api/bookmarks?tail=${tail}`, {
+			method: this.state.bookmarked ? "DELETE" : "POST",
+			credentials: "same-origin",
+		})
+		.then(response => response.ok ? response.json() : Promise.reject(response))
+		.then(content => this.setState({bookmarked: content.bookmarked}))
+		.catch(() => {})
+	}
+
+	loadAudit() {
+		const {head, tail} = this.props
+		const query = head ? `head=${head}&tail=${tail}` : `tail=${tail}`
+
+		fetch(`${basePath}/api/audit?${query}`)
+		.then(response => response.ok ? response.json() : false)
+		.then(audit => this.setState({audit}))
+		.catch(() => this.setState({audit: false}))
 	}
 
 	fullyRenderedCb = rendered => this.setState({
@@ -40,49 +600,139 @@ export default class ThreadPage extends React.PureComponent {
 	})
 
 	render() {
-		const {threadTweetIds, author, fullyRendered} = this.state
+		const {threadTweetIds, unavailable, tweets, truncated, pages, found, processing, author, stats, error, fullyRendered, bookmarked, live, liveFailed} = this.state
+		const {head, tail, page} = this.props
+
+		// Only the end of a thread can grow
+		const liveControls = window.WebSocket && !head && page === pages ?
+			<div>
+				{live ?
+					<span>
+						{t("followingLive")}{' '}
+						<button type="button" className="btn btn-link live-button" onClick={this.stopLive}>
+							{t("stopFollowingLive")}
+						</button>
+					</span> :
+					<button type="button" className="btn btn-link live-button" onClick={this.followLive}>
+						{t("followLive")}
+					</button>
+				}
+				{liveFailed ? <span className="thread-error">{t("liveFailed")}</span> : null}
+			</div> :
+			null
+
+		const pageLink = target => <Link to={`/thread/${tail}?page=${target}`}>
+			{target < page ? t("earlierTweets") : t("laterTweets")}
+		</Link>
+
+		const pageNav = pages > 1 ?
+			<div className="row">
+				<div className="col d-flex justify-content-between page-nav">
+					<span>{page > 1 ? pageLink(page - 1) : null}</span>
+					<span>{t("pageOf", page, pages)}</span>
+					<span>{page < pages ? pageLink(page + 1) : null}</span>
+				</div>
+			</div> :
+			null
 
 		const header = author ?
-			<h3 className="author-header">Thread by <a
+			<h3 className="author-header">{t("threadHeader", <a
 				href={`https://twitter.com/${author.handle}`}
 				target="_blank">
 				<span className="author">
+					{author.avatar_url ?
+						<img className="author-avatar" src={author.avatar_url} alt=""/> :
+						null
+					}
 					<span className="author-name">{author.name}</span>{' '}
 					<span className="author-handle">@{author.handle}</span>
 				</span>
-			</a></h3>:
-			<h3>Conversation</h3>
+			</a>)}</h3>:
+			<h3>{t("conversation")}</h3>
 
 		return <div className="container">
 			<Title>{
-				author ? `Thread by @${author.handle}` :
-				threadTweetIds ? "Conversation" :
-				"Thread"
+				author ? t("threadTitle", author.handle) :
+				threadTweetIds ? t("conversation") :
+				t("thread")
 			}</Title>
 			<div className="row">
 				<div className="col text-center">
 					{header}
+					{stats ? <ThreadStats stats={stats}/> : null}
+					{bookmarked !== null ?
+						<button
+							type="button"
+							className="btn btn-link bookmark-button"
+							aria-pressed={bookmarked}
+							onClick={this.toggleBookmark}
+						>
+							{bookmarked ? t("removeBookmark") : t("addBookmark")}
+						</button> :
+						null
+					}
+					{bookmarked !== null ? <ReadLaterButtons tail={tail}/> : null}
 				</div>
 			</div>
+			{this.props.audit && this.state.audit !== false ? <AuditReport audit={this.state.audit}/> : null}
+			{this.state.revisions.length ? <UpdatedBanner revisions={this.state.revisions}/> : null}
+			{this.state.resumePage !== null ?
+				<div className="row">
+					<div className="col">
+						<div className="tweet-unavailable tweet-like">
+							<Link to={`/thread/${tail}?page=${this.state.resumePage}`}>{t("resumeReading")}</Link>
+						</div>
+					</div>
+				</div> :
+				null
+			}
+			{truncated && page === 1 ?
+				<div className="row">
+					<div className="col">
+						<div className="tweet-unavailable tweet-like">
+							{t("truncated")}{' '}
+							<Link to={`/thread/${truncated}`}>{t("readEarlierTweets")}</Link>
+						</div>
+					</div>
+				</div> :
+				null
+			}
 			<div className="row justify-content-center">
 				<div className="col">
 					{threadTweetIds === null ?
 						null :
 						<TweetList
+							key={page}
 							tweetIds={threadTweetIds}
+							unavailable={unavailable}
+							tweets={tweets}
 							fullyRendered={this.fullyRenderedCb}
 						/>
 					}
 				</div>
 			</div>
+			{pageNav}
 			<div className="row">
 				<div className="col">
 					<div className="text-center thread-end tweet-like">
-						{fullyRendered ?
-							<span className="strike">
-								<span>End of Thread</span>
+						{error ?
+							<span className="thread-error">{error}</span> :
+						found !== null ?
+							t("foundSoFar", found) :
+						processing ?
+							t("stillWorking") :
+						fullyRendered && page < pages ?
+							<span>{t("continuedOnNextPage")}</span> :
+						fullyRendered ?
+							<span>
+								<span className="strike">
+									<span>{t("endOfThread")}</span>
+								</span>
+								<Link to={`/thread/${tail}/tree`}>{t("showAllBranches")}</Link>
+								{liveControls}
+								{page === pages ? <EmailForm tail={tail}/> : null}
 							</span> :
-							"Loading Tweets..."
+							t("loadingTweets")
 						}
 					</div>
 				</div>
@@ -0,0 +1,47 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+import { Link } from 'react-router-dom'
+
+import _ from 'lodash'
+
+import { t, language } from 'i18n.jsx'
+
+const formatDate = date => new Date(date).toLocaleDateString(language, {
+	year: "numeric",
+	month: "short",
+	day: "numeric",
+})
+
+// A list of stored threads, as summarized by the API: each one's title, and
+// optionally its author, with when it started and how long it is
+const ThreadSummaryList = ({ threads, showAuthor }) => <ol className="list-unstyled thread-summaries">{
+	_.map(threads, thread => <li key={thread.tail} className="thread-summary tweet-like">
+		<Link to={thread.permalink || `/thread/${thread.tail}`}>{thread.title || t("untitledThread")}</Link>
+		<p className="search-details">
+			{showAuthor ?
+				<span><Link to={`/author/${thread.author.handle}`}>@{thread.author.handle}</Link> · </span> :
+				null
+			}
+			{formatDate(thread.created_at)} · {t("statsTweets", thread.tweet_count)}
+		</p>
+	</li>)
+}</ol>
+
+ThreadSummaryList.propTypes = {
+	threads: PropTypes.arrayOf(PropTypes.shape({
+		tail: PropTypes.string.isRequired,
+		author: PropTypes.shape({
+			handle: PropTypes.string.isRequired,
+		}).isRequired,
+		title: PropTypes.string.isRequired,
+		created_at: PropTypes.string.isRequired,
+		tweet_count: PropTypes.number.isRequired,
+	})).isRequired,
+	showAuthor: PropTypes.bool,
+}
+
+ThreadSummaryList.defaultProps = {
+	showAuthor: false,
+}
+
+export default ThreadSummaryList
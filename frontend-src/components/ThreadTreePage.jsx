@@ -0,0 +1,99 @@
+import React from 'react'
+import PropTypes from 'prop-types'
+
+import Tweet from 'components/Tweet.jsx'
+import Title from 'components/Title.jsx'
+import promiseRunner from 'promiseChain.jsx'
+import basePath from 'basePath.jsx'
+import { t } from 'i18n.jsx'
+
+// Render the branch starting at tweetId. The first reply to each tweet
+// continues the branch; any other replies are rendered as nested branches
+// directly after the tweet they reply to.
+const Branch = ({ tweetId, replies, runner }) => {
+	const items = []
+	let currentId = tweetId
+
+	while(currentId) {
+		const currentReplies = replies[currentId] || []
+
+		items.push(<li key={currentId}>
+			<Tweet tweetId={currentId} runner={runner}/>
+		</li>)
+
+		currentReplies.slice(1).forEach(branchId => items.push(
+			<li key={`branch-${branchId}`} className="thread-branch">
+				<Branch tweetId={branchId} replies={replies} runner={runner}/>
+			</li>
+		))
+
+		currentId = currentReplies[0]
+	}
+
+	return <ul className="list-unstyled">{items}</ul>
+}
+
+Branch.propTypes = {
+	tweetId: PropTypes.string.isRequired,
+	replies: PropTypes.objectOf(PropTypes.arrayOf(PropTypes.string)).isRequired,
+	runner: PropTypes.func.isRequired,
+}
+
+export default class ThreadTreePage extends React.PureComponent {
+	static propTypes = {
+		tail: PropTypes.string.isRequired,
+	}
+
+	constructor(props) {
+		super(props)
+
+		this.runner = promiseRunner(4)
+
+		this.state = {
+			root: null,
+			replies: {},
+			author: null,
+		}
+	}
+
+	componentDidMount() {
+		fetch(`${basePath}/api/tree?tail=${this.props.tail}`)
+		.then(response => response.json())
+		.then(content => this.setState({
+			root: content.root,
+			replies: content.replies,
+			author: content.author,
+		}))
+	}
+
+	render() {
+		const {root, replies, author} = this.state
+
+		return <div className="container">
+			<Title>{author ? t("treeTitle", author.handle) : t("treeTitleLoading")}</Title>
+			<div className="row">
+				<div className="col text-center">
+					{author ?
+						<h3 className="author-header">{t("treeHeader", <a
+							href={`https://twitter.com/${author.handle}`}
+							target="_blank">
+							<span className="author">
+								<span className="author-name">{author.name}</span>{' '}
+								<span className="author-handle">@{author.handle}</span>
+							</span>
+						</a>)}</h3> :
+						<h3>{t("loadingThread")}</h3>
+					}
+				</div>
+			</div>
+			<div className="row justify-content-center">
+				<div className="col">
+					{root === null ?
+						null :
+						<Branch tweetId={root} replies={replies} runner={this.runner}/>
+					}
+				</div>
+			</div>
+		</div>
+	}
+}
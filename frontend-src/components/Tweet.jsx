@@ -1,6 +1,9 @@
 import React from 'react'
 import PropTypes from 'prop-types'
 
+import { loadPreferences, isDark } from 'preferences.jsx'
+import { language } from 'i18n.jsx'
+
 const twitterPromise = new Promise(resolve => {
 	window.twttr.ready(twttr => resolve(twttr))
 })
@@ -9,6 +12,12 @@ export default class EmbeddedTweet extends React.PureComponent {
 	static propTypes = {
 		tweetId: PropTypes.string.isRequired,
 		runner: PropTypes.func.isRequired,
+		// Hide twitter's own link preview, when bobbin has one of its own
+		hideCard: PropTypes.bool,
+	}
+
+	static defaultProps = {
+		hideCard: false,
 	}
 
 	constructor(props) {
@@ -23,10 +32,15 @@ export default class EmbeddedTweet extends React.PureComponent {
 	}
 
 	componentDidMount() {
+		const prefs = loadPreferences()
+
 		this.props.runner(() => this.cancel ? null : (twitterPromise
 			.then(twttr => twttr.widgets.createTweet(this.props.tweetId, this.node, {
 				conversation: "none",
 				align: "center",
+				lang: language,
+				theme: isDark(prefs) ? "dark" : "light",
+				cards: prefs.showMedia && !this.props.hideCard ? undefined : "hidden",
 			}))
 			.catch(error => {
 				this.setState({error: error});
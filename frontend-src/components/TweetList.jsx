@@ -3,8 +3,11 @@ import PropTypes from 'prop-types'
 
 import _ from 'lodash'
 
+import LinkCard from 'components/LinkCard.jsx'
+import Poll from 'components/Poll.jsx'
 import Tweet from 'components/Tweet.jsx'
 import promiseRunner from 'promiseChain.jsx'
+import { t } from 'i18n.jsx'
 
 const xor = (a, b) => (a && !b) || (b && !a)
 
@@ -13,9 +16,18 @@ export default class TweetList extends React.PureComponent {
 		tweetIds: PropTypes.arrayOf(
 			PropTypes.string.isRequired
 		).isRequired,
+		unavailable: PropTypes.objectOf(PropTypes.string),
+		// The tweets' JSON from the API, by id, for details that twitter's
+		// widget doesn't show (or that bobbin shows its own way)
+		tweets: PropTypes.objectOf(PropTypes.object),
 		fullyRendered: PropTypes.func.isRequired,
 	}
 
+	static defaultProps = {
+		unavailable: {},
+		tweets: {},
+	}
+
 	constructor(props) {
 		super(props)
 
@@ -42,11 +54,20 @@ export default class TweetList extends React.PureComponent {
 
 	render() {
 		return <ul className="list-unstyled">{
-			_.map(this.props.tweetIds, tweetId =>
-				<li key={tweetId}>
-					<Tweet tweetId={tweetId} runner={this.scheduleLoad}/>
-				</li>
-			)
+			_.map(this.props.tweetIds, tweetId => {
+				const tweet = this.props.tweets[tweetId] || {}
+				return <li key={tweetId} data-tweet-id={tweetId}>{
+					this.props.unavailable[tweetId] ?
+						<div className="tweet-unavailable tweet-like">
+							{t("tweetUnavailable", this.props.unavailable[tweetId])}
+						</div> :
+						<Tweet tweetId={tweetId} runner={this.scheduleLoad} hideCard={Boolean(tweet.card)}/>
+				}{
+					tweet.poll ? <Poll poll={tweet.poll}/> : null
+				}{
+					tweet.card ? <LinkCard card={tweet.card}/> : null
+				}</li>
+			})
 		}</ul>
 	}
 }
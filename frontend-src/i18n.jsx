@@ -0,0 +1,46 @@
+/*
+Localization of the UI. The language is the ?lang query parameter, or else
+the one the server picked from Accept-Language (see i18n.py), or else the
+browser's, whichever first has a catalog. To add a language, add a catalog
+in messages/ and to catalogs below, and add the same language to the
+server's catalogs.
+*/
+
+import en from 'messages/en.jsx'
+
+const DEFAULT_LANGUAGE = "en"
+
+export const catalogs = {
+	en,
+}
+
+export const negotiateLanguage = candidates => {
+	for(const candidate of candidates) {
+		const tag = candidate.toLowerCase()
+		if(catalogs[tag]) {
+			return tag
+		}
+
+		const primary = tag.split("-")[0]
+		if(catalogs[primary]) {
+			return primary
+		}
+	}
+
+	return DEFAULT_LANGUAGE
+}
+
+export const language = negotiateLanguage([
+	new URLSearchParams(window.location.search).get("lang"),
+	window.bobbinLanguage,
+	...(navigator.languages || [navigator.language]),
+].filter(Boolean))
+
+const catalog = catalogs[language]
+
+// Get a message from the catalog. Messages with something inserted into them
+// are functions, which are called with args.
+export const t = (key, ...args) => {
+	const message = key in catalog ? catalog[key] : catalogs[DEFAULT_LANGUAGE][key]
+	return typeof message === "function" ? message(...args) : message
+}
@@ -0,0 +1,35 @@
+/*
+When each thread was last viewed in this browser, kept in localStorage, so
+that the thread page can point out threads that have changed since. Only the
+most recently viewed threads are remembered.
+*/
+
+const KEY = "bobbin_last_viewed"
+const MAX_THREADS = 200
+
+const load = () => {
+	try {
+		return JSON.parse(window.localStorage.getItem(KEY)) || {}
+	} catch(e) {
+		return {}
+	}
+}
+
+export const lastViewed = tail => load()[tail] || null
+
+export const markViewed = tail => {
+	const views = load()
+	views[tail] = new Date().toISOString()
+
+	const recent = Object.keys(views)
+		.sort((a, b) => views[b].localeCompare(views[a]))
+		.slice(0, MAX_THREADS)
+
+	try {
+		window.localStorage.setItem(KEY, JSON.stringify(
+			Object.assign({}, ...recent.map(key => ({[key]: views[key]})))
+		))
+	} catch(e) {
+		// Storage can be full or disabled; this is only a nicety
+	}
+}
@@ -2,6 +2,10 @@ import ReactDOM from "react-dom"
 import React from "react"
 
 import App from "components/App.jsx"
+import { applyPreferences, loadPreferences } from "preferences.jsx"
+import { language } from "i18n.jsx"
 
 console.log('Note: "sandbox not initialized" is a well-known bug in the twitter api')
+applyPreferences(loadPreferences())
+document.documentElement.lang = language
 ReactDOM.render(<App />, document.getElementById("react-container"))
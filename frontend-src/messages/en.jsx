@@ -0,0 +1,229 @@
+/*
+The English catalog, which is also the fallback for messages missing from any
+other catalog. Messages are strings, or functions (of strings or elements)
+for messages with something inserted into them, so that each language can
+put it wherever its grammar wants.
+*/
+
+import React from 'react'
+
+export default {
+	// Navigation and footer
+	skipToContent: "Skip to content",
+	mainNavigation: "Main",
+	toggleNavigation: "Toggle navigation",
+	beta: "Beta",
+	navFaq: "FAQ",
+	navSettings: "Settings",
+	navSearch: "Search",
+	navMe: "My threads",
+	footerGithub: "Github",
+	footerIssues: "Issues & Feedback",
+
+	// Home page
+	homeTitle: "Bobbin",
+	homeHeading: <span>Share threads with <strong>Bobbin</strong></span>,
+	tweetLinkPlaceholder: "Link to last tweet in thread",
+	submitHelp: `To view a twitter thread, find the last tweet in the thread you
+		want to view, and copy-paste a link to the tweet above. Bobbin will
+		automatically follow the reply-chain backwards to the beginning of the
+		thread, and display the whole thread. The thread view link can be shared
+		with other people.`,
+	help: "Help",
+	submit: "Submit",
+
+	// FAQ
+	faqTitle: "Bobbin FAQ",
+	faqHeading: "Frequently Asked Questions",
+	faqEntries: [{
+		question: "What is this?",
+		answer: <span>
+			Bobbin is a way to easily share Twitter threads with your friends.
+		</span>
+	}, {
+		question: "How does it work?",
+		answer: <span>
+			Bobbin threads are definied by the final tweet in the thread. When given
+			the final tweet in a thread, Bobbin follows the reply chain backwards,
+			towards the beginning of the thread, and displays the thread from the
+			beginning. It ignores tweets <em>after</em> the final tweet, even if they
+			were posted by the author of the thread.</span>
+	}, {
+		question: "Why does it take a while for my thread to load?",
+		answer: <span>
+			The first time a user shares a thread, Bobbin must look up each individual
+			tweet one-by-one, because Twitter doesn't currently provide a way to look
+			up whole threads. Internally, Bobbin stores the reply chain, so subsequent
+			loads of the thread should be faster.
+		</span>
+	}, {
+		question: "Why is it called Bobbin?",
+		answer: <span>
+			Because a <a href="https://en.wikipedia.org/wiki/Bobbin">bobbin</a> is how
+			you share thread.
+		</span>
+	}],
+
+	// Thread pages
+	threadTitle: handle => `Thread by @${handle}`,
+	threadHeader: author => <span>Thread by {author}</span>,
+	conversation: "Conversation",
+	thread: "Thread",
+	earlierTweets: "Earlier tweets",
+	laterTweets: "Later tweets",
+	pageOf: (page, pages) => `Page ${page} of ${pages}`,
+	truncated: "This thread is too long to load all at once.",
+	readEarlierTweets: "Read the earlier tweets",
+	foundSoFar: found => `Found ${found} tweets so far...`,
+	stillWorking: "Still working on this thread...",
+	continuedOnNextPage: "Continued on the next page",
+	endOfThread: "End of Thread",
+	showAllBranches: "Show all branches",
+	followLive: "Follow live",
+	stopFollowingLive: "Stop following",
+	followingLive: "Watching for new tweets...",
+	liveFailed: "Couldn't follow this thread live.",
+	emailThread: "Email this thread",
+	emailAddress: "Email or Send to Kindle address",
+	emailFormat: "Format",
+	emailFormatNames: {
+		html: "Email",
+		epub: "EPUB attachment",
+	},
+	emailSend: "Send",
+	emailConfirm: address => `Check ${address} for a link to confirm, and the thread will be sent.`,
+	emailSent: address => `The thread is on its way to ${address}. Make sure this site's address is on your approved senders list.`,
+	emailErrors: {
+		tooMany: "Too many emails; try again later.",
+		disabled: "This server can't email threads.",
+		failed: "Couldn't send the email.",
+	},
+	loadingTweets: "Loading Tweets...",
+	threadUpdated: "This thread has changed since you last viewed it:",
+	updatedAdded: count => count === 1 ? "1 new tweet" : `${count} new tweets`,
+	updatedEdited: count => count === 1 ? "1 edited tweet" : `${count} edited tweets`,
+	updatedDeleted: count => count === 1 ? "1 deleted tweet" : `${count} deleted tweets`,
+	tweetUnavailable: reason => `This tweet is unavailable (${reason})`,
+
+	// Thread statistics
+	statsTweets: count => count === 1 ? "1 tweet" : `${count} tweets`,
+	statsWords: count => count === 1 ? "1 word" : `${count.toLocaleString("en")} words`,
+	statsReadingTime: minutes => `${minutes} min read`,
+	statsMedia: count => count === 1 ? "1 image or video" : `${count} images and videos`,
+	statsLinks: count => count === 1 ? "1 link" : `${count} links`,
+	statsLikes: count => count === 1 ? "1 like" : `${count.toLocaleString("en")} likes`,
+	statsRetweets: count => count === 1 ? "1 retweet" : `${count.toLocaleString("en")} retweets`,
+	statsReplies: count => count === 1 ? "1 reply" : `${count.toLocaleString("en")} replies`,
+
+	pollVotes: count => count === 1 ? "1 vote" : `${count.toLocaleString("en")} votes`,
+	pollFinal: "Final results",
+	pollEnds: time => `Ends ${time}`,
+
+	// Accessibility audits (?audit=1)
+	auditLoading: "Checking this thread for images without alt text...",
+	auditOk: total => total === 0 ?
+		"This thread has no images." :
+		`All ${total} images in this thread have alt text.`,
+	auditMissing: (count, total) => `${count} of ${total} images in this thread have no alt text:`,
+	auditTweet: id => `Tweet ${id}`,
+	auditQuoted: id => `A tweet quoted by tweet ${id}`,
+
+	// Thread trees
+	treeTitle: handle => `Thread tree by @${handle}`,
+	treeTitleLoading: "Thread tree",
+	treeHeader: author => <span>All branches of a thread by {author}</span>,
+	loadingThread: "Loading Thread...",
+
+	// Errors loading threads
+	errorOptedOut: "The author of this thread has asked for their threads not to be shown on Bobbin.",
+	errorLastTweet: reason => `This thread's last tweet is ${reason}.`,
+	errorProtected: "This thread is protected. If you follow its author, sign in to see it.",
+	errorNotFound: "This thread doesn't exist.",
+	errorTwitter: "Twitter isn't responding right now. Try again in a bit.",
+	errorBusy: "Bobbin is busy right now. Try again in a bit.",
+	errorTooManyRequests: "You're loading threads too quickly. Try again in a minute.",
+	errorGeneric: "Couldn't load this thread.",
+
+	// Search
+	searchTitle: "Search threads",
+	searchResultsTitle: query => `Search: ${query}`,
+	searchLabel: "Search for",
+	searchPlaceholder: "Words from a thread",
+	searchAuthor: "By",
+	searchSince: "From",
+	searchUntil: "To",
+	search: "Search",
+	searchCount: count => count === 0 ? "No threads found." : count === 1 ? "1 thread found" : `${count.toLocaleString("en")} threads found`,
+	searchPages: "Search result pages",
+	searchPrevious: "Previous",
+	searchNext: "Next",
+	searchError: "Couldn't search right now.",
+
+	// Homepage thread lists
+	recentThreads: "Recently unrolled",
+	popularThreads: "Popular",
+
+	// Author pages
+	authorTitle: handle => `Threads by @${handle}`,
+	authorFeed: "Atom feed",
+	authorThreadCount: count => count === 1 ? "1 thread" : `${count.toLocaleString("en")} threads`,
+	authorPages: "Pages of threads",
+	newerThreads: "Newer threads",
+	olderThreads: "Older threads",
+	untitledThread: "(No text)",
+	authorNoThreads: "Bobbin hasn't stored any threads by this author.",
+	authorError: "Couldn't load this author's threads.",
+
+	// Accounts
+	meTitle: "My threads",
+	signedInAs: handle => `Signed in as @${handle}`,
+	signIn: "Sign in with Twitter",
+	signInNote: `Sign in to bookmark threads and keep track of the ones you've
+		read. Bobbin only learns your Twitter handle, and can't tweet or see
+		anything private.`,
+	signOut: "Sign out",
+	bookmarks: "Bookmarks",
+	noBookmarks: "You haven't bookmarked any threads.",
+	readingHistory: "Recently read",
+	noReadingHistory: "You haven't read any threads while signed in.",
+	meError: "Couldn't load your threads.",
+	accountsDisabled: "This server doesn't have accounts.",
+	addBookmark: "Bookmark",
+	removeBookmark: "Remove bookmark",
+	resumeReading: "Continue where you left off",
+
+	// Read later services
+	readLater: "Read later",
+	readLaterNote: "Connect a read later service to save threads to it from their pages.",
+	readLaterSave: service => `Save to ${service}`,
+	readLaterSaved: service => `Saved to ${service}`,
+	readLaterReconnect: service => `Reconnect ${service} on your account page to save threads to it.`,
+	readLaterFailed: service => `Couldn't save to ${service}.`,
+	readLaterConnect: service => `Connect ${service}`,
+	readLaterConnected: service => `${service} is connected.`,
+	readLaterDisconnect: "Disconnect",
+	readLaterUsername: "Email or username",
+	readLaterPassword: "Password",
+	readLaterToken: "Access token",
+	readLaterTokenNote: "Get an access token from readwise.io/access_token.",
+	readLaterError: "Couldn't connect.",
+
+	// Settings
+	settingsTitle: "Settings",
+	theme: "Theme",
+	themeNames: {
+		system: "System",
+		light: "Light",
+		dark: "Dark",
+	},
+	fontSize: "Font size",
+	fontSizeNames: {
+		small: "Small",
+		medium: "Medium",
+		large: "Large",
+	},
+	showMedia: "Show images and videos",
+	showTimestamps: "Show timestamps (in embedded threads; Twitter always shows them on its own tweets)",
+	settingsNote: `Settings are saved in a cookie in this browser. Tweets that are
+		already loaded pick up new settings when the page is reloaded.`,
+}
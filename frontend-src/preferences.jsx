@@ -0,0 +1,73 @@
+/*
+Display preferences, kept in the bobbin_prefs cookie, which the server also
+reads when rendering pages (see preferences.py). The cookie is a query string,
+like "theme=dark&font_size=large&media=0".
+*/
+
+import basePath from 'basePath.jsx'
+
+const COOKIE = "bobbin_prefs"
+const ONE_YEAR = 365 * 24 * 60 * 60
+
+export const THEMES = ["system", "light", "dark"]
+export const FONT_SIZES = ["small", "medium", "large"]
+
+export const defaultPreferences = {
+	theme: "system",
+	fontSize: "medium",
+	showMedia: true,
+	showTimestamps: true,
+}
+
+const readCookie = () => {
+	const entry = document.cookie
+		.split("; ")
+		.find(entry => entry.startsWith(`${COOKIE}=`))
+
+	return entry ? entry.slice(COOKIE.length + 1) : ""
+}
+
+export const loadPreferences = () => {
+	const fields = new URLSearchParams(readCookie())
+	const theme = fields.get("theme")
+	const fontSize = fields.get("font_size")
+
+	return {
+		theme: THEMES.includes(theme) ? theme : defaultPreferences.theme,
+		fontSize: FONT_SIZES.includes(fontSize) ? fontSize : defaultPreferences.fontSize,
+		showMedia: fields.get("media") !== "0",
+		showTimestamps: fields.get("timestamps") !== "0",
+	}
+}
+
+export const htmlClasses = prefs => [
+	`theme-${prefs.theme}`,
+	`font-${prefs.fontSize}`,
+	prefs.showMedia ? null : "hide-media",
+	prefs.showTimestamps ? null : "hide-timestamps",
+].filter(Boolean).join(" ")
+
+export const applyPreferences = prefs => {
+	document.documentElement.className = htmlClasses(prefs)
+}
+
+export const savePreferences = prefs => {
+	const value = new URLSearchParams({
+		theme: prefs.theme,
+		font_size: prefs.fontSize,
+		media: prefs.showMedia ? "1" : "0",
+		timestamps: prefs.showTimestamps ? "1" : "0",
+	}).toString()
+
+	document.cookie = `${COOKIE}=${value}; path=${basePath || "/"}; max-age=${ONE_YEAR}; samesite=lax`
+	applyPreferences(prefs)
+}
+
+// Whether to use dark styles, for things like the tweet widgets that can't
+// follow the stylesheet
+export const isDark = prefs =>
+	prefs.theme === "dark" || (
+		prefs.theme === "system" &&
+		window.matchMedia !== undefined &&
+		window.matchMedia("(prefers-color-scheme: dark)").matches
+	)
@@ -7,6 +7,24 @@ setup(
 		'bobbin'
 	],
 	package_dir={'': 'src'},
+	extras_require={
+		'share-images': ['Pillow>=8,<10'],
+		'archive-zstd': ['zstandard'],
+		'image-proxy': ['Pillow>=8,<10'],
+		'graphql': ['graphql-core>=3.1,<3.3'],
+		'grpc': ['grpcio>=1.32', 'grpcio-tools>=1.32', 'protobuf>=3.12'],
+		'discord': ['PyNaCl>=1.4'],
+		'proxy': ['aiohttp-socks>=0.5,<0.8'],
+		'pdf': ['reportlab>=3.5,<4'],
+		'highlight': ['Pygments>=2.7'],
+		'toml': ['tomli>=1.1; python_version < "3.11"'],
+		'tracing': ['opentelemetry-api>=1.12', 'opentelemetry-sdk>=1.12', 'opentelemetry-exporter-otlp-proto-http>=1.12'],
+	},
+	entry_points={
+		'console_scripts': [
+			'bobbin=bobbin.__main__:run',
+		],
+	},
 	platforms='any',
 	author='Nathan West',
 	url='https://github.com/Lucretiel/bobbin',
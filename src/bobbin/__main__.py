@@ -0,0 +1,31 @@
+# Entry point for `python -m bobbin` (and the bobbin script), which dispatches
+# to the subcommands:
+#
+#     bobbin serve [options]            run the web server
+#     bobbin unroll <tweet> [options]   print a single thread
+#     bobbin export --output <archive>  write the thread store to an archive
+#     bobbin import <archive>           restore the thread store from one
+
+import sys
+
+from bobbin import archive, main as serve, unroll
+
+commands = {
+	"serve": serve.main,
+	"unroll": unroll.main,
+	"export": archive.export_main,
+	"import": archive.import_main,
+}
+
+
+def run(argv=None):
+	argv = sys.argv[1:] if argv is None else argv
+
+	if not argv or argv[0] not in commands:
+		return "usage: bobbin {{{}}} [options]".format(",".join(commands))
+
+	return commands[argv[0]](argv[1:])
+
+
+if __name__ == "__main__":
+	sys.exit(run())
@@ -0,0 +1,55 @@
+# An accessibility audit of threads. For now, it checks the one thing that
+# authors control, and that most often goes wrong: whether the images in a
+# thread (including quoted tweets) have alt text describing them for people
+# using screen readers.
+
+from collections import namedtuple
+
+
+class MissingAltText(namedtuple("MissingAltText", "tweet_id media_url type quoted")):
+	'''
+	An image or video in tweet_id without alt text. If quoted is true, it's
+	in the tweet quoted by tweet_id, rather than in tweet_id itself.
+	'''
+	__slots__ = ()
+
+
+class Audit(namedtuple("Audit", "media_count missing_alt_text")):
+	__slots__ = ()
+
+	@property
+	def ok(self):
+		return not self.missing_alt_text
+
+	def json(self):
+		return {
+			"ok": self.ok,
+			"media_count": self.media_count,
+			"missing_alt_text": [issue._asdict() for issue in self.missing_alt_text],
+		}
+
+
+def tweet_media(tweet):
+	'''
+	Iterate over (media, quoted) pairs of all the media in a tweet, and in
+	the tweet it quotes
+	'''
+	for media in tweet.entities.media:
+		yield media, False
+
+	if tweet.quoted is not None:
+		for media in tweet.quoted.entities.media:
+			yield media, True
+
+
+def audit_thread(thread):
+	media_count = 0
+	missing = []
+
+	for tweet in thread:
+		for media, quoted in tweet_media(tweet):
+			media_count += 1
+			if not (media.alt_text and media.alt_text.strip()):
+				missing.append(MissingAltText(tweet.id, media.media_url, media.type, quoted))
+
+	return Audit(media_count, tuple(missing))
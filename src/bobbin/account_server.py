@@ -0,0 +1,118 @@
+# Signing in and out (see accounts), and connecting read later services that
+# are authorized the same way (see read_later). These are plain pages rather
+# than API endpoints, since signing in is a series of browser redirects.
+
+from aiohttp import web
+
+from bobbin import accounts as bobbin_accounts, read_later as bobbin_read_later, web_util
+
+
+def require_accounts(accounts):
+	if accounts is None:
+		raise web.HTTPNotFound(text="Accounts aren't enabled on this server")
+
+
+@web_util.method_handler('GET')
+async def login_handler(request, *, accounts):
+	'''
+	Send the browser to twitter to sign in
+	'''
+	require_accounts(accounts)
+
+	try:
+		url = await accounts.sign_in.start(
+			callback_url=web_util.site_url(request) + "/login/callback",
+		)
+	except bobbin_accounts.SignInError as e:
+		raise web.HTTPBadGateway(text=str(e)) from e
+
+	raise web.HTTPFound(url)
+
+
+@web_util.method_handler('GET')
+async def login_callback_handler(request, *, accounts):
+	'''
+	Finish signing in, when twitter sends the browser back, and go to the
+	account page. If the user declined, they're just sent there signed out.
+	'''
+	require_accounts(accounts)
+	base_path = request.get("base_path", "")
+
+	try:
+		session_token = await accounts.sign_in_account(request.query)
+	except bobbin_accounts.SignInError as e:
+		raise web.HTTPBadRequest(text=str(e)) from e
+
+	if session_token is None:
+		raise web.HTTPFound(f"{base_path}/me")
+
+	response = web.HTTPFound(f"{base_path}/me")
+	bobbin_accounts.set_session_cookie(response, session_token, path=base_path or "/")
+	raise response
+
+
+@web_util.method_handler('POST')
+async def logout_handler(request, *, accounts):
+	require_accounts(accounts)
+	base_path = request.get("base_path", "")
+
+	await accounts.sign_out(request)
+
+	response = web.HTTPSeeOther(f"{base_path}/")
+	response.del_cookie(bobbin_accounts.SESSION_COOKIE, path=base_path or "/")
+	raise response
+
+
+async def require_redirect_service(request, *, accounts, read_later, service):
+	'''
+	Get the signed in Account and the read later service to connect by
+	redirecting to it
+	'''
+	require_accounts(accounts)
+	if read_later is None:
+		raise web.HTTPNotFound(text="Read later services aren't enabled on this server")
+
+	service = read_later.services.get(service)
+	if service is None or service.connect_with != bobbin_read_later.REDIRECT:
+		raise web.HTTPNotFound(text="Unknown read later service")
+
+	account = await accounts.request_account(request)
+	if account is None:
+		raise web.HTTPFound(f"{request.get('base_path', '')}/me")
+
+	return account, service
+
+
+@web_util.method_handler('GET')
+async def read_later_connect_handler(request, *, accounts, read_later, service):
+	'''
+	Send the browser to a read later service to connect it
+	'''
+	account, service = await require_redirect_service(request, accounts=accounts, read_later=read_later, service=service)
+
+	try:
+		url = await service.start(
+			account_id=account.id,
+			callback_url=f"{web_util.site_url(request)}/read-later/{service.name}/callback",
+		)
+	except bobbin_read_later.ServiceError as e:
+		raise web.HTTPBadGateway(text=str(e)) from e
+
+	raise web.HTTPFound(url)
+
+
+@web_util.method_handler('GET')
+async def read_later_callback_handler(request, *, accounts, read_later, service):
+	'''
+	Finish connecting a read later service, when it sends the browser back,
+	and go to the account page
+	'''
+	account, service = await require_redirect_service(request, accounts=accounts, read_later=read_later, service=service)
+
+	try:
+		credentials = await service.finish(account_id=account.id, state=request.query.get("state", ""))
+	except bobbin_read_later.ServiceError as e:
+		raise web.HTTPBadRequest(text=str(e)) from e
+
+	await read_later.save_credentials(account, service, credentials)
+	raise web.HTTPFound(f"{request.get('base_path', '')}/me")
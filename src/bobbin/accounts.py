@@ -0,0 +1,416 @@
+# Minimal user accounts, so that people can bookmark threads and keep a
+# reading history. Accounts are made by signing in with Twitter, so there
+# are no passwords or emails to look after, and the only thing we keep is
+# the user's twitter id and handle. Accounts are kept in a
+# user_store.UserStore.
+#
+# Signing in is done with OAuth 1.0a, with the app's own key and secret
+# (TwitterSignIn), or, if the app has an OAuth 2.0 client id, with an
+# authorization code and PKCE (TwitterOAuth2SignIn). The latter also gets an
+# access token for the user, which can read the protected tweets they can
+# see (see tweetbox.make_private_thread_getter). User tokens are only ever
+# kept in memory, next to the session, never in the database or a cookie,
+# so they're gone after a restart, or after two hours, when twitter expires
+# them; the user just signs in again to see protected threads.
+#
+# A signed in browser has a session cookie holding a random token; only a
+# hash of the token is stored. The cookie is SameSite=Lax, so other sites
+# can't make requests with it except for top level navigation, which is
+# only ever a GET, so everything that changes anything is a POST, PUT, or
+# DELETE.
+
+from collections import namedtuple
+from datetime import datetime, timedelta, timezone
+from urllib.parse import parse_qsl, quote, urlencode
+import base64
+import hashlib
+import hmac
+import secrets
+import time
+
+from aiohttp import web
+import aiohttp
+import cachetools
+
+from bobbin import web_util
+
+REQUEST_TOKEN_URL = "https://api.twitter.com/oauth/request_token"
+AUTHENTICATE_URL = "https://api.twitter.com/oauth/authenticate"
+ACCESS_TOKEN_URL = "https://api.twitter.com/oauth/access_token"
+
+AUTHORIZE_URL = "https://twitter.com/i/oauth2/authorize"
+OAUTH2_TOKEN_URL = "https://api.twitter.com/2/oauth2/token"
+ME_URL = "https://api.twitter.com/2/users/me"
+
+# Enough to read tweets as the user, and find out who they are
+OAUTH2_SCOPES = ("tweet.read", "users.read")
+
+# How long twitter's OAuth 2.0 user access tokens last
+USER_TOKEN_TTL = 2 * 60 * 60
+
+SESSION_COOKIE = "bobbin_session"
+SESSION_TTL = timedelta(days=30)
+
+# How long someone has to finish signing in on twitter
+SIGN_IN_TTL = 15 * 60
+
+
+class SignInError(Exception):
+	pass
+
+
+class SignedIn(namedtuple("SignedIn", "twitter_id handle user_token")):
+	'''
+	Who signed in, and their access token, if the sign in gave us one
+	'''
+	__slots__ = ()
+
+
+def percent_encode(value):
+	# OAuth wants RFC 3986 encoding, where only letters, digits, and -._~
+	# are left alone
+	return quote(str(value), safe="~")
+
+
+def oauth_signature(method, url, params, *, consumer_secret, token_secret=""):
+	'''
+	The HMAC-SHA1 signature of a request, for the oauth_signature parameter.
+	params are all the oauth_ parameters and the request's own parameters.
+	'''
+	normalized = "&".join(
+		f"{key}={value}"
+		for key, value in sorted((percent_encode(key), percent_encode(value)) for key, value in params.items())
+	)
+	base = "&".join((method.upper(), percent_encode(url), percent_encode(normalized)))
+	key = f"{percent_encode(consumer_secret)}&{percent_encode(token_secret)}"
+	return base64.b64encode(hmac.new(key.encode(), base.encode(), hashlib.sha1).digest()).decode()
+
+
+def oauth_header(
+	method,
+	url,
+	*,
+	consumer_key,
+	consumer_secret,
+	token=None,
+	token_secret="",
+	oauth_params=None,
+	params=None,
+):
+	'''
+	Build the Authorization header for an OAuth 1.0a request. oauth_params
+	are extra oauth_ parameters, like oauth_callback; params are the
+	request's own query or form parameters, which are signed but not
+	included in the header.
+	'''
+	oauth = {
+		"oauth_consumer_key": consumer_key,
+		"oauth_nonce": secrets.token_hex(16),
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp": str(int(time.time())),
+		"oauth_version": "1.0",
+	}
+	if token is not None:
+		oauth["oauth_token"] = token
+	oauth.update(oauth_params or {})
+
+	oauth["oauth_signature"] = oauth_signature(
+		method,
+		url,
+		dict(oauth, **(params or {})),
+		consumer_secret=consumer_secret,
+		token_secret=token_secret,
+	)
+
+	return "OAuth " + ", ".join(
+		f'{percent_encode(key)}="{percent_encode(value)}"'
+		for key, value in sorted(oauth.items())
+	)
+
+
+class TwitterSignIn:
+	'''
+	The three legged "Sign in with Twitter" flow. start gets a request token
+	and the url to send the user to; once they've agreed, twitter sends them
+	back to the callback url with the token and a verifier, which finish
+	exchanges for their id and handle. Request tokens are only remembered
+	for SIGN_IN_TTL seconds.
+	'''
+	def __init__(self, session, *, consumer_key, consumer_secret, timeout=10):
+		self.session = session
+		self.consumer_key = consumer_key
+		self.consumer_secret = consumer_secret
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+
+		# Request token -> its secret
+		self.pending = cachetools.TTLCache(10000, SIGN_IN_TTL, timer=time.monotonic)
+
+	async def post(self, url, *, token=None, token_secret="", oauth_params=None):
+		headers = {"Authorization": oauth_header(
+			"POST",
+			url,
+			consumer_key=self.consumer_key,
+			consumer_secret=self.consumer_secret,
+			token=token,
+			token_secret=token_secret,
+			oauth_params=oauth_params,
+		)}
+
+		try:
+			async with self.session.post(url, headers=headers, timeout=self.timeout) as response:
+				body = await response.text()
+				if response.status != 200:
+					raise SignInError(f"Twitter refused the sign in ({response.status})")
+		except aiohttp.ClientError as e:
+			raise SignInError("Couldn't reach twitter") from e
+
+		return dict(parse_qsl(body))
+
+	async def start(self, *, callback_url):
+		'''
+		Begin signing in. Returns the url to redirect the user to.
+		'''
+		result = await self.post(REQUEST_TOKEN_URL, oauth_params={"oauth_callback": callback_url})
+		if result.get("oauth_callback_confirmed") != "true" or "oauth_token" not in result:
+			raise SignInError("Twitter didn't confirm the callback")
+
+		self.pending[result["oauth_token"]] = result.get("oauth_token_secret", "")
+		return f"{AUTHENTICATE_URL}?{urlencode({'oauth_token': result['oauth_token']})}"
+
+	async def finish(self, *, token, verifier):
+		'''
+		Finish signing in, with the oauth_token and oauth_verifier twitter
+		sent the user back with. Returns their (twitter id, handle).
+		'''
+		token_secret = self.pending.pop(token, None)
+		if token_secret is None:
+			raise SignInError("Unknown or expired sign in")
+
+		result = await self.post(
+			ACCESS_TOKEN_URL,
+			token=token,
+			token_secret=token_secret,
+			oauth_params={"oauth_verifier": verifier},
+		)
+
+		try:
+			return result["user_id"], result["screen_name"]
+		except KeyError as e:
+			raise SignInError("Twitter didn't say who signed in") from e
+
+	async def finish_callback(self, query):
+		'''
+		Finish signing in, with the query parameters twitter sent the user
+		back with. Returns a SignedIn, or None if the user declined.
+		'''
+		token = query.get("oauth_token")
+		verifier = query.get("oauth_verifier")
+		if not token or not verifier:
+			return None
+
+		twitter_id, handle = await self.finish(token=token, verifier=verifier)
+		return SignedIn(twitter_id, handle, None)
+
+
+def pkce_challenge(verifier):
+	'''
+	The S256 code challenge for a PKCE code verifier
+	'''
+	digest = hashlib.sha256(verifier.encode()).digest()
+	return base64.urlsafe_b64encode(digest).decode().rstrip("=")
+
+
+class TwitterOAuth2SignIn:
+	'''
+	Signing in with OAuth 2.0, with an authorization code and PKCE. start
+	gets the url to send the user to; once they've agreed, twitter sends
+	them back to the callback url with a code, which finish_callback
+	exchanges for an access token, and then their id and handle.
+	client_secret is only needed for confidential clients. Pending sign ins
+	are only remembered for SIGN_IN_TTL seconds.
+	'''
+	def __init__(self, session, *, client_id, client_secret=None, timeout=10):
+		self.session = session
+		self.client_id = client_id
+		self.client_secret = client_secret
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+
+		# State -> (code verifier, callback url)
+		self.pending = cachetools.TTLCache(10000, SIGN_IN_TTL, timer=time.monotonic)
+
+	async def start(self, *, callback_url):
+		'''
+		Begin signing in. Returns the url to redirect the user to.
+		'''
+		state = secrets.token_urlsafe(16)
+		verifier = secrets.token_urlsafe(64)
+		self.pending[state] = (verifier, callback_url)
+
+		return f"{AUTHORIZE_URL}?" + urlencode({
+			"response_type": "code",
+			"client_id": self.client_id,
+			"redirect_uri": callback_url,
+			"scope": " ".join(OAUTH2_SCOPES),
+			"state": state,
+			"code_challenge": pkce_challenge(verifier),
+			"code_challenge_method": "S256",
+		})
+
+	async def request_json(self, method, url, **kwargs):
+		try:
+			async with self.session.request(method, url, timeout=self.timeout, **kwargs) as response:
+				if response.status != 200:
+					raise SignInError(f"Twitter refused the sign in ({response.status})")
+				return await response.json()
+		except aiohttp.ClientError as e:
+			raise SignInError("Couldn't reach twitter") from e
+		except ValueError as e:
+			raise SignInError("Twitter's response wasn't json") from e
+
+	async def finish_callback(self, query):
+		'''
+		Finish signing in, with the query parameters twitter sent the user
+		back with. Returns a SignedIn, or None if the user declined.
+		'''
+		state = query.get("state")
+		code = query.get("code")
+		if not state or not code:
+			return None
+
+		verifier, callback_url = self.pending.pop(state, (None, None))
+		if verifier is None:
+			raise SignInError("Unknown or expired sign in")
+
+		# Confidential clients authenticate with their secret; public ones
+		# just say who they are
+		headers = {}
+		if self.client_secret is not None:
+			credentials = f"{self.client_id}:{self.client_secret}".encode()
+			headers["Authorization"] = "Basic " + base64.b64encode(credentials).decode()
+
+		result = await self.request_json("POST", OAUTH2_TOKEN_URL, headers=headers, data={
+			"grant_type": "authorization_code",
+			"code": code,
+			"redirect_uri": callback_url,
+			"code_verifier": verifier,
+			"client_id": self.client_id,
+		})
+
+		user_token = result.get("access_token")
+		if not user_token:
+			raise SignInError("Twitter didn't give us a token")
+
+		me = await self.request_json("GET", ME_URL, headers={"Authorization": f"Bearer {user_token}"})
+
+		try:
+			return SignedIn(me["data"]["id"], me["data"]["username"], user_token)
+		except (KeyError, TypeError) as e:
+			raise SignInError("Twitter didn't say who signed in") from e
+
+
+def hash_session_token(token):
+	return hashlib.sha256(token.encode()).hexdigest()
+
+
+class Accounts:
+	'''
+	Accounts kept in store (a user_store.UserStore), signed in to with
+	sign_in (a TwitterSignIn or TwitterOAuth2SignIn)
+	'''
+	def __init__(self, store, sign_in):
+		self.store = store
+		self.sign_in = sign_in
+
+		# Session token hash -> the user's access token
+		self.user_tokens = cachetools.TTLCache(100000, USER_TOKEN_TTL, timer=time.monotonic)
+
+	async def sign_in_account(self, query):
+		'''
+		Finish signing in, with the query parameters of the callback, and
+		start a session. Returns the session token, or None if the user
+		declined.
+		'''
+		signed_in = await self.sign_in.finish_callback(query)
+		if signed_in is None:
+			return None
+
+		now = datetime.now(timezone.utc)
+		account = await self.store.save_account(twitter_id=signed_in.twitter_id, handle=signed_in.handle, now=now)
+
+		session_token = secrets.token_urlsafe(32)
+		token_hash = hash_session_token(session_token)
+		await self.store.create_session(
+			token_hash=token_hash,
+			account_id=account.id,
+			expires_at=now + SESSION_TTL,
+		)
+
+		if signed_in.user_token is not None:
+			self.user_tokens[token_hash] = signed_in.user_token
+
+		return session_token
+
+	async def request_account(self, request):
+		'''
+		Get the Account signed in to by request's session cookie, or None
+		'''
+		token = request.cookies.get(SESSION_COOKIE)
+		if not token:
+			return None
+
+		return await self.store.get_session_account(
+			token_hash=hash_session_token(token),
+			now=datetime.now(timezone.utc),
+		)
+
+	async def request_user_token(self, request):
+		'''
+		Get the access token of the user signed in by request's session
+		cookie, or None if there isn't one, or it's expired
+		'''
+		token = request.cookies.get(SESSION_COOKIE)
+		if not token:
+			return None
+
+		user_token = self.user_tokens.get(hash_session_token(token))
+		if user_token is None:
+			return None
+
+		# The session may have expired, or been signed out elsewhere
+		if await self.request_account(request) is None:
+			return None
+
+		return user_token
+
+	async def sign_out(self, request):
+		token = request.cookies.get(SESSION_COOKIE)
+		if token:
+			token_hash = hash_session_token(token)
+			self.user_tokens.pop(token_hash, None)
+			await self.store.delete_session(token_hash=token_hash)
+
+
+def set_session_cookie(response, token, *, path="/"):
+	response.set_cookie(
+		SESSION_COOKIE,
+		token,
+		max_age=int(SESSION_TTL.total_seconds()),
+		path=path,
+		httponly=True,
+		samesite="Lax",
+	)
+
+
+async def require_account(request, accounts):
+	'''
+	Get the Account signed in to by request, raising a JSON error if
+	accounts aren't enabled or nobody is signed in
+	'''
+	if accounts is None:
+		raise web_util.not_found_json("Accounts aren't enabled on this server")
+
+	account = await accounts.request_account(request)
+	if account is None:
+		raise web_util.error_json(web.HTTPUnauthorized, "Not signed in")
+
+	return account
@@ -0,0 +1,465 @@
+# Administrative endpoints, under /admin/. These are only enabled if the
+# operator configures an admin_token, and every request must carry it as a
+# bearer token:
+#
+#     Authorization: Bearer <admin_token>
+#
+# The dashboard page at /admin/ itself has no data in it, so it's served
+# without the token; it asks for the token and uses it to call the API.
+
+import functools
+import hmac
+
+from aiohttp import web
+
+from bobbin import web_util
+from bobbin.middleware import RequestMetrics
+from bobbin.api_keys import key_json
+from bobbin.config import parse_bool
+from bobbin.tweetbox import cached_thread_ids
+
+
+def with_admin_auth(handler):
+	'''
+	Require the admin token. Without an admin_token configured, the admin
+	endpoints don't exist at all.
+	'''
+	@functools.wraps(handler)
+	async def admin_auth_wrapper(request, *, admin_token, **kwargs):
+		if admin_token is None:
+			raise web.HTTPNotFound()
+
+		expected = f"Bearer {admin_token}"
+		given = request.headers.get("Authorization", "")
+		if not hmac.compare_digest(given.encode(), expected.encode()):
+			raise web.HTTPUnauthorized(
+				text=web_util.dump_json(error="Admin token required"),
+				content_type="application/json",
+				headers={"WWW-Authenticate": 'Bearer realm="bobbin admin"'},
+			)
+
+		return await handler(request, **kwargs)
+
+	return admin_auth_wrapper
+
+
+def opt_outs_json(opt_outs):
+	return web.Response(
+		text=web_util.dump_json(opt_outs=opt_outs.entries()),
+		content_type="application/json",
+	)
+
+
+async def get_opt_outs_handler(request, *, opt_outs, response_cache):
+	return opt_outs_json(opt_outs)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def add_opt_out_handler(request, *, opt_outs, response_cache, author: web_util.QueryParam):
+	'''
+	Opt out an author, given as a handle or user id. Cached responses might
+	include their threads, so they're all dropped.
+	'''
+	try:
+		await opt_outs.add(author)
+	except ValueError as e:
+		raise web_util.bad_request_json(str(e), param="author")
+
+	if response_cache is not None:
+		response_cache.clear()
+
+	return opt_outs_json(opt_outs)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def remove_opt_out_handler(request, *, opt_outs, response_cache, author: web_util.QueryParam):
+	try:
+		removed = await opt_outs.remove(author)
+	except ValueError as e:
+		raise web_util.bad_request_json(str(e), param="author")
+
+	if not removed:
+		raise web_util.not_found_json("Author isn't opted out, or was opted out by the opt-out file", author=author)
+
+	return opt_outs_json(opt_outs)
+
+
+opt_outs_handler = with_admin_auth(web_util.methods(
+	('GET', get_opt_outs_handler),
+	('POST', add_opt_out_handler),
+	('DELETE', remove_opt_out_handler),
+))
+
+
+def api_keys_json(api_keys, **extra):
+	return web.Response(
+		text=web_util.dump_json(
+			api_keys=[key_json(key, api_keys) for key in api_keys.all_keys()],
+			**extra,
+		),
+		content_type="application/json",
+	)
+
+
+def require_api_keys(api_keys):
+	if api_keys is None:
+		raise web_util.not_found_json("API keys aren't enabled")
+
+
+async def get_api_keys_handler(request, *, api_keys):
+	require_api_keys(api_keys)
+	return api_keys_json(api_keys)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def issue_api_key_handler(
+	request, *,
+	api_keys,
+	name: web_util.QueryParam,
+	daily_quota: web_util.QueryParam =None,
+):
+	'''
+	Issue a new key. The response includes the key itself, which can't be
+	retrieved again later.
+	'''
+	require_api_keys(api_keys)
+
+	if daily_quota is not None:
+		if not daily_quota.isdigit():
+			raise web_util.bad_request_json("Invalid quota", param="daily_quota", daily_quota=daily_quota)
+		daily_quota = int(daily_quota)
+
+	key, secret = await api_keys.issue(name=name, daily_quota=daily_quota)
+	return api_keys_json(api_keys, issued=dict(key_json(key, api_keys), key=secret))
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def revoke_api_key_handler(request, *, api_keys, id: web_util.QueryParam):
+	require_api_keys(api_keys)
+
+	if not await api_keys.revoke(id):
+		raise web_util.not_found_json("No such active key", id=id)
+
+	return api_keys_json(api_keys)
+
+
+api_keys_handler = with_admin_auth(web_util.methods(
+	('GET', get_api_keys_handler),
+	('POST', issue_api_key_handler),
+	('DELETE', revoke_api_key_handler),
+))
+
+
+def token_json(index, token, pool):
+	return {
+		"index": index,
+		"active": token not in pool.revoked,
+		"rate_limits": {
+			endpoint: {"remaining": remaining, "reset": reset}
+			for endpoint, (remaining, reset) in token.rate_limiter.snapshot().items()
+		},
+	}
+
+
+def request_stats(pool):
+	'''
+	Get the twitter request counts, from the pool's RequestMetrics
+	middleware, if it has one
+	'''
+	for layer in pool.middleware:
+		if isinstance(layer, RequestMetrics):
+			return layer.stats()
+	return None
+
+
+@with_admin_auth
+@web_util.method_handler('GET')
+async def stats_handler(
+	request, *,
+	tweet_cache,
+	response_cache,
+	thread_store,
+	job_queue,
+	token_pool,
+	flags,
+	opt_outs,
+	resolution_limiter,
+):
+	'''
+	Everything an operator might want to know at a glance: cache
+	effectiveness, queue depth, the rate limits of each token, and how many
+	requests have been made to each twitter endpoint
+	'''
+	return web.Response(
+		text=web_util.dump_json(
+			tweet_cache=tweet_cache.stats() if hasattr(tweet_cache, "stats") else None,
+			response_cache=response_cache.stats() if response_cache is not None else None,
+			jobs=job_queue.stats() if job_queue is not None else None,
+			resolutions=resolution_limiter.stats() if resolution_limiter is not None else None,
+			stored_threads=await thread_store.count_threads() if thread_store is not None else None,
+			tokens=[
+				token_json(index, token, token_pool)
+				for index, token in enumerate(token_pool.tokens)
+			] if token_pool is not None else [],
+			requests=request_stats(token_pool) if token_pool is not None else None,
+			flags=flags.snapshot() if flags is not None else {},
+			opt_outs=len(opt_outs.entries()) if opt_outs is not None else 0,
+		),
+		content_type="application/json",
+	)
+
+
+async def purge_tweets(tweet_cache, tail, stored_ids):
+	'''
+	Remove a thread's tweets from the tweet cache, so that they're fetched
+	fresh from twitter next time. Returns the number of tweets purged.
+	'''
+	ids = set(stored_ids) | set(await cached_thread_ids(tweet_cache, tail))
+
+	try:
+		for tweet_id in ids:
+			await tweet_cache.delete(tweet_id)
+	except NotImplementedError:
+		return 0
+
+	return len(ids)
+
+
+@with_admin_auth
+@web_util.method_handler('POST')
+@web_util.with_query(web_util.query_error_handler_json)
+async def purge_handler(
+	request, *,
+	tweet_cache,
+	response_cache,
+	thread_store,
+	tail: web_util.QueryParam =None,
+	author: web_util.QueryParam =None,
+):
+	'''
+	Purge a thread (by tail id) or all of an author's threads (by handle) from
+	the thread store, the tweet cache, and the response cache, for instance
+	after the tweets have been deleted. Purging by author only purges
+	tweets from stored threads, but drops every cached response.
+	'''
+	if (tail is None) == (author is None):
+		raise web_util.bad_request_json("Give exactly one of tail or author")
+
+	if tail is not None:
+		if not tail.isdigit():
+			raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+
+		stored = {tail: await thread_store.delete_thread(tail=tail) if thread_store is not None else []}
+	else:
+		stored = await thread_store.delete_author_threads(handle=author) if thread_store is not None else {}
+
+	tweets = 0
+	for thread_tail, stored_ids in stored.items():
+		tweets += await purge_tweets(tweet_cache, thread_tail, stored_ids)
+
+	responses = 0
+	if response_cache is not None:
+		if tail is not None:
+			# Thread responses are keyed by a tuple starting with the tail id
+			responses = response_cache.purge(lambda key: key[0] == tail)
+		else:
+			responses = len(response_cache.cache)
+			response_cache.clear()
+
+	return web.Response(
+		text=web_util.dump_json(
+			threads=sum(1 for stored_ids in stored.values() if stored_ids),
+			tweets=tweets,
+			responses=responses,
+		),
+		content_type="application/json",
+	)
+
+
+def flags_json(flags):
+	return web.Response(
+		text=web_util.dump_json(flags=flags.snapshot() if flags is not None else {}),
+		content_type="application/json",
+	)
+
+
+async def get_flags_handler(request, *, flags):
+	return flags_json(flags)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def set_flag_handler(request, *, flags, name: web_util.QueryParam, value: web_util.QueryParam):
+	'''
+	Turn a feature flag on or off, until the server restarts
+	'''
+	if flags is None or name not in flags:
+		raise web_util.not_found_json("No such flag", name=name)
+
+	try:
+		flags.set(name, parse_bool(value))
+	except ValueError:
+		raise web_util.bad_request_json("Invalid flag value", param="value", value=value)
+
+	return flags_json(flags)
+
+
+flags_handler = with_admin_auth(web_util.methods(
+	('GET', get_flags_handler),
+	('POST', set_flag_handler),
+))
+
+
+DASHBOARD_HTML = """<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Bobbin admin</title>
+<style>
+body { font: 14px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; max-width: 900px; margin: 2em auto; padding: 0 1em; }
+section { margin-bottom: 2em; }
+pre { background: #f5f8fa; padding: 1em; overflow: auto; }
+#result { color: #697882; }
+</style>
+</head>
+<body>
+<h1>Bobbin admin</h1>
+<section>
+	<label>Admin token <input id="token" type="password"></label>
+	<button id="refresh">Refresh</button>
+	<span id="result"></span>
+</section>
+<section>
+	<h2>Flags</h2>
+	<div id="flags"></div>
+</section>
+<section>
+	<h2>Purge</h2>
+	<form id="purge-tail"><input name="tail" placeholder="Tail tweet id"> <button>Purge thread</button></form>
+	<form id="purge-author"><input name="author" placeholder="Author handle"> <button>Purge author</button></form>
+</section>
+<section>
+	<h2>Opt-outs</h2>
+	<form id="opt-out"><input name="author" placeholder="Handle or id:1234"> <button>Opt out</button></form>
+	<pre id="opt-outs"></pre>
+</section>
+<section>
+	<h2>API keys</h2>
+	<form id="issue-key"><input name="name" placeholder="Name"> <input name="daily_quota" placeholder="Daily quota"> <button>Issue key</button></form>
+	<form id="revoke-key"><input name="id" placeholder="Key id"> <button>Revoke key</button></form>
+	<pre id="api-keys"></pre>
+</section>
+<section>
+	<h2>Stats</h2>
+	<pre id="stats"></pre>
+</section>
+<script>
+(function() {
+	var tokenInput = document.getElementById("token");
+	tokenInput.value = sessionStorage.getItem("bobbinAdminToken") || "";
+
+	function call(method, path, params) {
+		sessionStorage.setItem("bobbinAdminToken", tokenInput.value);
+		var query = params ? "?" + new URLSearchParams(params).toString() : "";
+		return fetch("/admin/" + path + query, {
+			method: method,
+			headers: {"Authorization": "Bearer " + tokenInput.value},
+		}).then(function(response) {
+			return response.json().then(function(body) {
+				if(!response.ok) throw new Error(body.error || response.statusText);
+				return body;
+			});
+		});
+	}
+
+	function report(promise) {
+		var result = document.getElementById("result");
+		return promise.then(function(body) {
+			result.textContent = "OK";
+			return body;
+		}, function(error) {
+			result.textContent = error.message;
+		});
+	}
+
+	function refresh() {
+		report(call("GET", "stats")).then(function(stats) {
+			if(!stats) return;
+			document.getElementById("stats").textContent = JSON.stringify(stats, null, 2);
+
+			var flags = document.getElementById("flags");
+			flags.innerHTML = "";
+			Object.keys(stats.flags).forEach(function(name) {
+				var label = document.createElement("label");
+				var box = document.createElement("input");
+				box.type = "checkbox";
+				box.checked = stats.flags[name];
+				box.addEventListener("change", function() {
+					report(call("POST", "flags", {name: name, value: box.checked ? "1" : "0"})).then(refresh);
+				});
+				label.appendChild(box);
+				label.appendChild(document.createTextNode(" " + name));
+				flags.appendChild(label);
+				flags.appendChild(document.createElement("br"));
+			});
+		});
+
+		call("GET", "opt-outs").then(function(body) {
+			document.getElementById("opt-outs").textContent = body.opt_outs.join("\\n");
+		}, function() {});
+
+		call("GET", "api-keys").then(function(body) {
+			document.getElementById("api-keys").textContent = JSON.stringify(body.api_keys, null, 2);
+		}, function() {
+			document.getElementById("api-keys").textContent = "API keys aren't enabled";
+		});
+	}
+
+	function onSubmit(id, method, path) {
+		document.getElementById(id).addEventListener("submit", function(event) {
+			event.preventDefault();
+			var params = {};
+			new FormData(event.target).forEach(function(value, key) {
+				if(value) params[key] = value;
+			});
+			report(call(method, path, params)).then(function(body) {
+				// New keys are only ever shown once
+				if(body && body.issued) window.prompt("New API key (it won't be shown again)", body.issued.key);
+				refresh();
+			});
+		});
+	}
+
+	onSubmit("purge-tail", "POST", "purge");
+	onSubmit("purge-author", "POST", "purge");
+	onSubmit("opt-out", "POST", "opt-outs");
+	onSubmit("issue-key", "POST", "api-keys");
+	onSubmit("revoke-key", "DELETE", "api-keys");
+	document.getElementById("refresh").addEventListener("click", refresh);
+
+	if(tokenInput.value) refresh();
+})();
+</script>
+</body>
+</html>
+"""
+
+
+@web_util.method_handler('GET')
+async def dashboard_handler(request, *, admin_token):
+	if admin_token is None:
+		raise web.HTTPNotFound()
+
+	return web.Response(text=DASHBOARD_HTML, content_type="text/html", charset="utf-8")
+
+
+handler = web_util.routes(
+	(r"$", dashboard_handler, 'admin_token'),
+	(r"stats/?$", stats_handler, [
+		'admin_token', 'tweet_cache', 'response_cache', 'thread_store',
+		'job_queue', 'token_pool', 'flags', 'opt_outs', 'resolution_limiter',
+	]),
+	(r"purge/?$", purge_handler, ['admin_token', 'tweet_cache', 'response_cache', 'thread_store']),
+	(r"flags/?$", flags_handler, ['admin_token', 'flags']),
+	(r"opt-outs/?$", opt_outs_handler, ['admin_token', 'opt_outs', 'response_cache']),
+	(r"api-keys/?$", api_keys_handler, ['admin_token', 'api_keys']),
+)
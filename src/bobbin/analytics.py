@@ -0,0 +1,124 @@
+# First party analytics: counting views of thread pages, and working out
+# which threads are trending. Nothing is sent anywhere, and viewers'
+# addresses are never stored. Repeat views are recognized by a hash of the
+# viewer's address and the thread, salted with a random value that changes
+# every restart, and kept only in memory, for dedup_window seconds.
+#
+# A thread's trending score is its views over the last TRENDING_WINDOW,
+# with each hour's views worth half as much every TRENDING_HALF_LIFE, so
+# that threads drop off as interest in them fades.
+
+from datetime import datetime, timedelta, timezone
+import asyncio
+import hashlib
+import logging
+import secrets
+import time
+
+import cachetools
+
+logger = logging.getLogger(__name__)
+
+TRENDING_WINDOW = timedelta(hours=48)
+TRENDING_HALF_LIFE = timedelta(hours=12)
+
+
+class ViewCounter:
+	'''
+	Counts views of threads in store, ignoring views of a thread from the
+	same address within dedup_window seconds of the last one. At most
+	max_viewers recent (address, thread) pairs are remembered.
+	'''
+	def __init__(self, store, *, dedup_window=30 * 60, max_viewers=100000):
+		self.store = store
+		self.salt = secrets.token_bytes(16)
+		self.recent = cachetools.TTLCache(max_viewers, dedup_window, timer=time.monotonic)
+
+	def viewer_key(self, remote, tail):
+		return hashlib.sha256(self.salt + f"{remote}\n{tail}".encode()).digest()
+
+	async def record(self, *, remote, tail):
+		'''
+		Count a view of the thread ending at tail by the client at remote,
+		unless they've viewed it recently. Returns whether it was counted.
+		'''
+		key = self.viewer_key(remote, tail)
+		if key in self.recent:
+			return False
+
+		self.recent[key] = True
+		await self.store.record_view(tail=tail)
+		return True
+
+
+def trending_scores(view_counts, *, now, half_life=TRENDING_HALF_LIFE):
+	'''
+	Score threads from (tail id, hour, views) counts. Returns a dict of tail
+	ids to scores.
+	'''
+	scores = {}
+
+	for tail, hour, views in view_counts:
+		age = max(now - hour, timedelta(0))
+		scores[tail] = scores.get(tail, 0) + views * 0.5 ** (age / half_life)
+
+	return scores
+
+
+class TrendingTracker:
+	'''
+	Keeps the limit top trending threads in store, recomputed every interval
+	seconds by a background task (see start and close). trending is a list
+	of (ThreadSummary, score) pairs, best first; it's empty until the first
+	computation finishes.
+	'''
+	def __init__(self, store, *, interval=300, limit=20, window=TRENDING_WINDOW, half_life=TRENDING_HALF_LIFE):
+		self.store = store
+		self.interval = interval
+		self.limit = limit
+		self.window = window
+		self.half_life = half_life
+		self.trending = []
+		self.updated_at = None
+		self.task = None
+
+	async def refresh(self):
+		now = datetime.now(timezone.utc)
+		since = now - self.window
+
+		# Hourly counts older than the window will never be used again
+		await self.store.prune_view_counts(before=since)
+
+		scores = trending_scores(
+			await self.store.get_view_counts(since=since),
+			now=now,
+			half_life=self.half_life,
+		)
+
+		# Twice as many are fetched as needed, so that the API can leave out
+		# opted out authors and still have enough
+		top = sorted(scores, key=scores.get, reverse=True)[:self.limit * 2]
+		summaries = await self.store.get_thread_summaries(tails=top)
+
+		self.trending = [(summary, scores[summary.tail_id]) for summary in summaries]
+		self.updated_at = now
+
+	async def run(self):
+		while True:
+			try:
+				await self.refresh()
+			except asyncio.CancelledError:
+				raise
+			except Exception:
+				logger.exception("Couldn't compute trending threads")
+
+			await asyncio.sleep(self.interval)
+
+	def start(self):
+		self.task = asyncio.ensure_future(self.run())
+
+	async def close(self):
+		if self.task is not None:
+			self.task.cancel()
+			await asyncio.gather(self.task, return_exceptions=True)
+			self.task = None
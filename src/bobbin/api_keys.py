@@ -0,0 +1,257 @@
+# API keys for the JSON API. When they're required, every request to /api/
+# must carry a key in the X-Api-Key header, so that operators can offer the
+# API to partners without offering it (and their twitter quota) to everyone.
+# Keys are issued and revoked through the admin API, and stored in the thread
+# store; only a hash of each key is kept. Each key can have a daily quota of
+# requests. Usage is counted in memory, per UTC day, so it resets if the
+# server restarts.
+#
+# Bobbin's own frontend uses the API too, so pages served by the frontend set
+# a short lived, signed site cookie, and API requests carrying it don't need
+# a key. They're still subject to the per client rate limit, if there is one.
+#
+# Anyone can get a site cookie by loading a page, so cookies are bound to the
+# client that loaded it (by address, the same way client_limits identifies
+# clients), and are no good from anywhere else; a cookie can't be handed out
+# to a fleet of scrapers. That still leaves each client able to use the API
+# without a key from its own address, a page load at a time, at whatever the
+# per client rate limit allows. Operators who need more than that should set
+# a tight client limit, since it's the only thing metering keyless use.
+
+from collections import namedtuple
+from datetime import datetime, timedelta, timezone
+import functools
+import hashlib
+import hmac
+import secrets
+import time
+
+from aiohttp import web
+
+from bobbin import web_util
+from bobbin.client_limits import client_key
+
+KEY_HEADER = "X-Api-Key"
+KEY_PREFIX = "bbn_"
+
+SITE_COOKIE = "bobbin_site"
+SITE_COOKIE_TTL = 24 * 60 * 60
+
+
+class ApiKey(namedtuple("ApiKey", "id key_hash name daily_quota created_at revoked_at")):
+	'''
+	A stored API key. daily_quota is the number of requests allowed per UTC
+	day, or None for no limit.
+	'''
+	__slots__ = ()
+
+	@property
+	def active(self):
+		return self.revoked_at is None
+
+
+class InvalidApiKey(Exception):
+	pass
+
+
+class QuotaExceeded(Exception):
+	def __init__(self, key, retry_after):
+		super().__init__(key.id)
+		self.key = key
+		self.retry_after = retry_after
+
+
+def hash_key(secret):
+	return hashlib.sha256(secret.encode()).hexdigest()
+
+
+def generate_key():
+	'''
+	Make a new key. Returns (id, secret); the id is public, and is part of
+	the secret, so that keys can be recognized in logs without revealing
+	them.
+	'''
+	key_id = secrets.token_hex(4)
+	return key_id, f"{KEY_PREFIX}{key_id}_{secrets.token_urlsafe(24)}"
+
+
+def seconds_until_tomorrow(now):
+	now = datetime.fromtimestamp(now, timezone.utc)
+	tomorrow = (now + timedelta(days=1)).replace(hour=0, minute=0, second=0, microsecond=0)
+	return (tomorrow - now).total_seconds()
+
+
+class ApiKeys:
+	'''
+	The set of API keys, loaded from store (a ThreadStore) by load().
+	'''
+	def __init__(self, store, *, clock=time.time):
+		self.store = store
+		self.clock = clock
+		self.keys = {}
+
+		# key id -> (day, request count)
+		self.counts = {}
+
+		# Site cookies are only good until the server restarts, at which point
+		# reloading the page gets a new one
+		self.site_secret = secrets.token_bytes(32)
+
+	async def load(self):
+		self.keys = {key.key_hash: key for key in await self.store.get_api_keys()}
+
+	def all_keys(self):
+		return sorted(self.keys.values(), key=lambda key: key.created_at)
+
+	def get(self, key_id):
+		for key in self.keys.values():
+			if key.id == key_id:
+				return key
+
+		return None
+
+	def today(self):
+		return datetime.fromtimestamp(self.clock(), timezone.utc).date()
+
+	def usage(self, key):
+		'''
+		The number of requests made with key today
+		'''
+		day, count = self.counts.get(key.id, (None, 0))
+		return count if day == self.today() else 0
+
+	def authenticate(self, secret):
+		'''
+		Find the active key with the given secret, or raise InvalidApiKey
+		'''
+		key = self.keys.get(hash_key(secret)) if secret else None
+		if key is None or not key.active:
+			raise InvalidApiKey()
+
+		return key
+
+	def spend(self, key):
+		'''
+		Count a request against key's quota, raising QuotaExceeded if it's
+		already used up for the day
+		'''
+		used = self.usage(key)
+		if key.daily_quota is not None and used >= key.daily_quota:
+			raise QuotaExceeded(key, seconds_until_tomorrow(self.clock()))
+
+		self.counts[key.id] = (self.today(), used + 1)
+
+	async def issue(self, *, name, daily_quota=None):
+		'''
+		Create and store a new key. Returns (ApiKey, secret); this is the only
+		time the secret is available.
+		'''
+		key_id, secret = generate_key()
+		key = ApiKey(
+			id=key_id,
+			key_hash=hash_key(secret),
+			name=name,
+			daily_quota=daily_quota,
+			created_at=datetime.now(timezone.utc),
+			revoked_at=None,
+		)
+
+		await self.store.add_api_key(key)
+		self.keys[key.key_hash] = key
+		return key, secret
+
+	async def revoke(self, key_id):
+		'''
+		Revoke a key. Returns False if there's no such active key.
+		'''
+		key = self.get(key_id)
+		if key is None or not key.active:
+			return False
+
+		revoked = key._replace(revoked_at=datetime.now(timezone.utc))
+		await self.store.revoke_api_key(key.id, revoked_at=revoked.revoked_at)
+		self.keys[key.key_hash] = revoked
+		return True
+
+	def _sign(self, message):
+		return hmac.new(self.site_secret, message.encode(), hashlib.sha256).hexdigest()
+
+	def site_cookie(self, client):
+		'''
+		Make a site cookie, only good for requests from client
+		'''
+		issued = str(int(self.clock()))
+		return f"{issued}.{self._sign(f'{issued} {client}')}"
+
+	def valid_site_cookie(self, cookie, client):
+		issued, _, signature = cookie.partition(".")
+		if not (issued.isascii() and issued.isdigit()):
+			return False
+		if not hmac.compare_digest(signature.encode(), self._sign(f"{issued} {client}").encode()):
+			return False
+
+		return self.clock() - int(issued) < SITE_COOKIE_TTL
+
+
+def key_json(key, api_keys):
+	return {
+		"id": key.id,
+		"name": key.name,
+		"daily_quota": key.daily_quota,
+		"used_today": api_keys.usage(key),
+		"created_at": key.created_at.isoformat(),
+		"revoked_at": key.revoked_at.isoformat() if key.revoked_at is not None else None,
+	}
+
+
+def with_api_key(handler):
+	'''
+	Require an API key (or the site cookie) if there's an api_keys (an
+	ApiKeys) in the context
+	'''
+	@functools.wraps(handler)
+	async def api_key_wrapper(request, *, api_keys, **kwargs):
+		if api_keys is None or api_keys.valid_site_cookie(request.cookies.get(SITE_COOKIE, ""), client_key(request)):
+			return await handler(request, **kwargs)
+
+		try:
+			key = api_keys.authenticate(request.headers.get(KEY_HEADER))
+			api_keys.spend(key)
+		except InvalidApiKey:
+			raise web.HTTPUnauthorized(
+				text=web_util.dump_json(error="A valid API key is required", header=KEY_HEADER),
+				content_type="application/json",
+			)
+		except QuotaExceeded as e:
+			raise web.HTTPTooManyRequests(
+				text=web_util.dump_json(error="Daily quota exceeded", quota=e.key.daily_quota),
+				content_type="application/json",
+				headers={"Retry-After": str(int(e.retry_after) + 1)},
+			)
+
+		return await handler(request, **kwargs)
+
+	return api_key_wrapper
+
+
+def with_site_cookie(handler):
+	'''
+	Give the browser a site cookie, if API keys are required, so that the
+	frontend can use the API
+	'''
+	@functools.wraps(handler)
+	async def site_cookie_wrapper(request, *, api_keys, **kwargs):
+		response = await handler(request, **kwargs)
+
+		if api_keys is not None:
+			response.set_cookie(
+				SITE_COOKIE,
+				api_keys.site_cookie(client_key(request)),
+				max_age=SITE_COOKIE_TTL,
+				httponly=True,
+				samesite="Strict",
+			)
+
+		return response
+
+	return site_cookie_wrapper
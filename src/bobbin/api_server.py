@@ -1,8 +1,24 @@
-from collections import Counter
+from datetime import date, datetime, timezone
+import asyncio
+import functools
+import logging
+import math
+import smtplib
 
 from aiohttp import web
+import aiohttp
 
-from bobbin import web_util
+from bobbin import accessibility, accounts as bobbin_accounts, callbacks, client_limits, follows, jobs, live, mailer, permalinks, read_later as bobbin_read_later, render, source, web_util
+from bobbin.load_shedding import Overloaded
+from bobbin.optout import HANDLE_PATTERN, OptedOutError
+from bobbin.response_cache import CachedResponse, make_etag, make_response
+from bobbin.storage import SearchUnavailableError
+from bobbin.thread_stats import metrics_json, thread_stats
+from bobbin.tweet_url import parse_tweet_id
+from bobbin.tweetbox import InvalidThreadError, ThreadGap, ThreadTruncated
+from bobbin.twitter import ProtectedTweetError, TwitterError, UnavailableTweetError
+
+logger = logging.getLogger(__name__)
 
 
 def is_valid_tweet_id(tweet_id):
@@ -13,51 +29,1257 @@ def is_valid_tweet_id(tweet_id):
 	return (1 <= len(tweet_id) <= 20) and tweet_id.isdecimal()
 
 
-def get_thread_author(thread):
-	user_counts = Counter(tweet.user for tweet in thread)
+def with_thread_errors(handler):
+	'''
+	Convert errors from resolving a thread into JSON error responses: 404 if
+	the thread doesn't exist or can't be seen, 403 if its author has opted
+	out, 503 if we're too busy, and 502 if twitter failed us.
+	'''
+	@functools.wraps(handler)
+	async def thread_errors_wrapper(request, **kwargs):
+		try:
+			return await handler(request, **kwargs)
+		except UnavailableTweetError as e:
+			raise web_util.not_found_json(
+				"Tweet unavailable", reason=e.reason, tweet_id=e.tweet_id,
+			) from e
+		except InvalidThreadError as e:
+			raise web_util.not_found_json("Head isn't in the thread", tweet_id=e.args[0]) from e
+		except OptedOutError as e:
+			raise web_util.error_json(
+				web.HTTPForbidden, "Author has opted out", reason="opted_out", handle=e.user.handle,
+			) from e
+		except jobs.JobPending as e:
+			raise job_accepted(e.job) from e
+		except jobs.JobQueueFull as e:
+			raise web_util.error_json(web.HTTPServiceUnavailable, "Too many threads being resolved") from e
+		except Overloaded as e:
+			raise web.HTTPServiceUnavailable(
+				text=web_util.dump_json(error="Too many threads being resolved", retry_after=e.retry_after),
+				content_type="application/json",
+				headers={"Retry-After": str(e.retry_after)},
+			) from e
+		except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError) as e:
+			logger.exception("Error resolving thread")
+			raise web_util.bad_gateway_json("Error from twitter") from e
 
-	if len(user_counts) == 0:
-		return None
-	elif len(user_counts) == 1:
-		return user_counts.popitem()[0]
+	return thread_errors_wrapper
 
-	top_users = user_counts.most_common(2)
 
-	if top_users[0][1] > top_users[1][1] and top_users[0][1] * 2 >= len(user_counts):
-		return top_users[0][0]
-	else:
-		return None
+# How often clients should poll for pending jobs, in seconds
+JOB_POLL_INTERVAL = 2
+
+
+def job_accepted(job):
+	return web.HTTPAccepted(
+		text=web_util.dump_json(status=job.state, job=job.id),
+		content_type="application/json",
+		headers={"Retry-After": str(JOB_POLL_INTERVAL)},
+	)
+
+
+def user_json(user):
+	return {
+		"id": user.id,
+		"handle": user.handle,
+		"name": user.name,
+		"avatar_url": user.avatar_url,
+		"bio": user.bio,
+		"verified": user.verified,
+		"followers": user.followers,
+		"url": user.url,
+	}
+
+
+def media_json(media):
+	best_variant = media.best_variant()
+	return {
+		**media._asdict(),
+		"variants": [variant._asdict() for variant in media.variants],
+		"video_url": best_variant.url if best_variant is not None else None,
+	}
+
+
+def entities_json(entities):
+	return {
+		"urls": [url._asdict() for url in entities.urls],
+		"mentions": [mention._asdict() for mention in entities.mentions],
+		"hashtags": [hashtag._asdict() for hashtag in entities.hashtags],
+		"media": [media_json(media) for media in entities.media],
+	}
+
+
+def poll_json(poll):
+	return {
+		"id": poll.id,
+		"options": [
+			{**option._asdict(), "percentage": percentage}
+			for option, percentage in zip(poll.options, poll.percentages())
+		],
+		"total_votes": poll.total_votes,
+		"end_datetime": poll.end_datetime.isoformat() if poll.end_datetime is not None else None,
+		"duration_minutes": poll.duration_minutes,
+		"voting_status": poll.voting_status,
+	}
+
+
+def tweet_json(tweet, *, show_metrics=True):
+	return {
+		"id": tweet.id,
+		"user": user_json(tweet.user),
+		"parent_id": tweet.parent_id,
+		"text": tweet.text,
+		"created_at": tweet.created_at.isoformat(),
+		"entities": entities_json(tweet.entities),
+		"quoted_id": tweet.quoted_id,
+		"quoted": tweet_json(tweet.quoted, show_metrics=show_metrics) if tweet.quoted is not None else None,
+		"metrics": metrics_json(tweet.metrics) if show_metrics else None,
+		"poll": poll_json(tweet.poll) if tweet.poll is not None else None,
+		"card": tweet.card.json() if tweet.card is not None else None,
+		"url": tweet.url,
+	}
+
+
+def thread_json(thread, *, stats=None, permalink=None, show_metrics=True, **extra):
+	'''
+	Render a thread as JSON. stats are the thread's ThreadStats, and
+	permalink its permalink path; they're given separately for pages, which
+	should have the whole thread's.
+	If show_metrics is false, likes, retweets, and replies are left out.
+	'''
+	author = thread.author
+	if stats is None:
+		stats = thread_stats(thread)
+	if permalink is None:
+		permalink = permalinks.thread_permalink(thread)
+	if not show_metrics:
+		stats = stats._replace(engagement=None)
+
+	return web_util.dump_json(
+		thread=thread.ids,
+		tweets=[tweet_json(tweet, show_metrics=show_metrics) for tweet in thread],
+		replies={
+			tweet_id: [tweet_json(reply, show_metrics=show_metrics) for reply in tweet_replies]
+			for tweet_id, tweet_replies in thread.replies.items()
+		},
+		unavailable={gap.id: gap.reason for gap in thread.gaps},
+		truncated=thread.truncated,
+		fetched_at=thread.fetched_at.isoformat(),
+		author=user_json(author) if author is not None else None,
+		permalink=permalink,
+		stats=stats.json(),
+		**extra
+	)
+
+
+DEFAULT_PAGE_SIZE = 50
+MAX_PAGE_SIZE = 200
+
+
+def parse_page_param(value, *, param, default, maximum=None):
+	if value is None:
+		return default
+
+	if not value.isdigit() or int(value) < 1 or (maximum is not None and int(value) > maximum):
+		raise web_util.bad_request_json("Invalid page", param=param, page=value)
+
+	return int(value)
 
 
 @web_util.method_handler('GET')
 @web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
 async def thread_handler(
 	request, *,
 	get_thread,
+	get_thread_replies=None,
+	get_private_thread=None,
+	accounts=None,
+	response_cache=None,
+	job_queue=None,
+	callback_sender=None,
+	show_metrics=True,
 	tail: web_util.QueryParam,
-	head: web_util.QueryParam =None
+	head: web_util.QueryParam =None,
+	replies: web_util.QueryParam =None,
+	refresh: web_util.QueryParam =None,
+	page: web_util.QueryParam =None,
+	page_size: web_util.QueryParam =None,
+	callback_url: web_util.QueryParam =None,
 ):
-	if not is_valid_tweet_id(tail):
-		raise web_util.bad_request("Invalid tweet id", param="tail", tweet_id=tail)
+	'''
+	Get a thread as JSON, at /api/thread?tail=<id>, or /api/thread/<id> (see
+	thread_path_handler). Long threads can be fetched a page at a time, by
+	giving a page number (starting from 1, at the head); the response then
+	includes the page number, page count, and total number of tweets. If
+	there's a job_queue, threads that take too long to resolve get a 202
+	response, with the id of the job that's resolving them. Clients can also
+	give a callback_url, in which case they always get a 202, and the whole
+	thread is POSTed to the url once it's resolved.
+
+	If the thread's tail is protected, and the user is signed in with an
+	access token (see accounts), the thread is resolved again with their
+	token, through get_private_thread. That response is private: it's never
+	cached, and doesn't include replies.
+	'''
+	# Users often paste whole tweet urls, rather than ids
+	tail_id = parse_tweet_id(tail)
+	if tail_id is None or not is_valid_tweet_id(tail_id):
+		raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+
+	head_id = parse_tweet_id(head) if head is not None else None
+	if head is not None and (head_id is None or not is_valid_tweet_id(head_id)):
+		raise web_util.bad_request_json("Invalid tweet id", param="head", tweet_id=head)
+
+	if replies is not None and not replies.isdigit():
+		raise web_util.bad_request_json("Invalid reply count", param="replies", count=replies)
+
+	# Replies are only fetched on request, and only if the server has them
+	# enabled
+	reply_count = int(replies) if replies is not None and get_thread_replies is not None else None
+
+	if callback_url is not None:
+		if job_queue is None or callback_sender is None:
+			raise web_util.bad_request_json("Callbacks aren't enabled", param="callback_url")
+
+		try:
+			callback_sender.validate(callback_url)
+		except callbacks.InvalidCallbackError as e:
+			raise web_util.bad_request_json(str(e), param="callback_url", url=callback_url)
+
+		job = job_queue.submit(tail=tail_id, head=head_id)
+		job.result.add_done_callback(functools.partial(
+			send_job_callback, job, callback_url, callback_sender, show_metrics,
+		))
+		raise job_accepted(job)
+
+	page_number = parse_page_param(page, param="page", default=None)
+	page_size = parse_page_param(
+		page_size,
+		param="page_size",
+		default=DEFAULT_PAGE_SIZE,
+		maximum=MAX_PAGE_SIZE,
+	)
+
+	async def render_thread(thread, *, reply_count):
+		extra = {"stats": thread_stats(thread), "permalink": permalinks.thread_permalink(thread)}
+
+		if page_number is not None:
+			total = len(thread)
+			page_count = max(1, -(-total // page_size))
+			if page_number > page_count:
+				raise web_util.not_found_json("No such page", page=page_number, pages=page_count)
+
+			start = (page_number - 1) * page_size
+			thread = thread.slice(start, start + page_size)
+			extra.update(page=page_number, pages=page_count, page_size=page_size, total=total)
+
+		# Replies are only fetched for the tweets actually being returned
+		if reply_count is not None:
+			thread = thread.with_replies(await get_thread_replies(thread=thread, count=reply_count))
+
+		return thread_json(thread, show_metrics=show_metrics, **extra), thread.fetched_at
+
+	async def render():
+		if job_queue is None:
+			thread = await get_thread(tail=tail_id, head=head_id)
+		else:
+			thread = await job_queue.get_thread(tail=tail_id, head=head_id)
 
-	if head is not None and not is_valid_tweet_id(head):
-		raise web_util.bad_request("Invalid tweet id", param="head", tweet_id=head)
+		return await render_thread(thread, reply_count=reply_count)
 
-	thread = await get_thread(tail=tail, head=head)
-	thread_tweet_ids = [tweet.id for tweet in thread]
-	author = get_thread_author(thread)
+	try:
+		if response_cache is None:
+			body, last_modified = await render()
+			response = CachedResponse(body, make_etag(body), last_modified, 0)
+		else:
+			response = await response_cache.get(
+				(tail_id, head_id, reply_count, page_number, page_size if page_number is not None else None),
+				render,
+				refresh=refresh is not None and refresh != "0",
+			)
+	except ProtectedTweetError:
+		user_token = await accounts.request_user_token(request) if accounts is not None and get_private_thread is not None else None
+		if user_token is None:
+			raise
+
+		thread = await get_private_thread(user_token=user_token, tail=tail_id, head=head_id)
+		body, last_modified = await render_thread(thread, reply_count=None)
+
+		response = make_response(request, CachedResponse(body, make_etag(body), last_modified, 0))
+		response.headers["Cache-Control"] = "private, no-store"
+		return response
+
+	return make_response(request, response)
+
+
+def thread_path_handler(request, *, tail, **context):
+	'''
+	Get a thread as JSON, with its tail in the path, as /api/thread/<id>,
+	rather than the query; everything else is the same as thread_handler,
+	including the query parameters.
+	'''
+	if "tail" in request.query:
+		raise web_util.bad_request_json("tail is already given in the path", param="tail")
+
+	url = request.rel_url
+	request = request.clone(rel_url=url.with_query([*url.query.items(), ("tail", tail)]))
+	return thread_handler(request, **context)
+
+
+def event_message(event, **data):
+	return f"event: {event}\ndata: {web_util.dump_json(**data)}\n\n".encode()
+
+
+@web_util.method_handler('GET')
+async def thread_events_handler(request, *, stream_thread, show_metrics=True, tail):
+	'''
+	Stream a thread's tweets as server-sent events, as they're resolved, so
+	that clients can show progress on long threads. Tweets are sent from the
+	tail backwards, each as a "tweet" event. Unavailable tweets are sent as
+	"gap" events, and a "truncated" event marks the thread running out of
+	resolution budget. The stream ends with a "done" event, or a "failed"
+	event if the thread couldn't be resolved. If show_metrics is false,
+	likes, retweets, and replies are left out.
+	'''
+	if stream_thread is None:
+		raise web.HTTPNotFound()
+
+	response = web.StreamResponse(headers={
+		"Content-Type": "text/event-stream",
+		"Cache-Control": "no-cache",
+		# Stop nginx from buffering the stream
+		"X-Accel-Buffering": "no",
+	})
+	await response.prepare(request)
+
+	items = stream_thread(tail=tail)
+	try:
+		async for item in items:
+			if isinstance(item, ThreadGap):
+				await response.write(event_message("gap", id=item.id, reason=item.reason))
+			elif isinstance(item, ThreadTruncated):
+				await response.write(event_message("truncated", id=item.id))
+			else:
+				await response.write(event_message("tweet", **tweet_json(item, show_metrics=show_metrics)))
+
+		await response.write(event_message("done"))
+	except UnavailableTweetError as e:
+		await response.write(event_message(
+			"failed", error="Tweet unavailable", status=404, reason=e.reason, tweet_id=e.tweet_id,
+		))
+	except Overloaded as e:
+		await response.write(event_message(
+			"failed", error="Too many threads being resolved", status=503, retry_after=e.retry_after,
+		))
+	except OptedOutError as e:
+		await response.write(event_message(
+			"failed", error="Author has opted out", status=403, reason="opted_out", handle=e.user.handle,
+		))
+	except (TwitterError, aiohttp.ClientResponseError, asyncio.TimeoutError):
+		logger.exception("Error streaming thread")
+		await response.write(event_message("failed", error="Error from twitter", status=502))
+	except ConnectionResetError:
+		# The client went away
+		pass
+	finally:
+		await items.aclose()
+
+	return response
+
+
+# How often to ping live thread viewers, to notice when they've gone
+LIVE_HEARTBEAT = 30
+
+
+def live_message(message_type, **data):
+	return web_util.dump_json(type=message_type, **data)
+
+
+async def send_live_updates(ws, queue, *, show_metrics):
+	while True:
+		tweets = await queue.get()
+		await ws.send_str(live_message(
+			"tweets",
+			tweets=[tweet_json(tweet, show_metrics=show_metrics) for tweet in tweets],
+			tail=tweets[-1].id,
+		))
+
+
+@web_util.method_handler('GET')
+async def thread_live_handler(request, *, live_threads, show_metrics=True, tail):
+	'''
+	Follow a thread live, over a WebSocket. The first message is the whole
+	thread, as a "thread" message with the same fields as /api/thread; then,
+	whenever the author adds to it, the new tweets are sent as a "tweets"
+	message, with the thread's new tail. If the thread can't be resolved, a
+	"failed" message is sent instead, and the socket is closed. Viewers
+	don't need to send anything.
+	'''
+	if live_threads is None:
+		raise web.HTTPNotFound()
+
+	ws = web.WebSocketResponse(heartbeat=LIVE_HEARTBEAT)
+	if not ws.can_prepare(request).ok:
+		raise web_util.bad_request_json("Expected a WebSocket")
+	await ws.prepare(request)
+
+	try:
+		async with live_threads.watch(tail) as (thread, queue):
+			await ws.send_str(thread_json(thread, show_metrics=show_metrics, type="thread"))
+
+			# The socket has to be read for pings and closes to be handled
+			sender = asyncio.ensure_future(send_live_updates(ws, queue, show_metrics=show_metrics))
+			try:
+				async for _ in ws:
+					pass
+			finally:
+				sender.cancel()
+				await asyncio.gather(sender, return_exceptions=True)
+	except live.TooManyLiveThreads:
+		await ws.send_str(live_message("failed", error="Too many threads being followed live", status=503))
+	except UnavailableTweetError as e:
+		await ws.send_str(live_message(
+			"failed", error="Tweet unavailable", status=404, reason=e.reason, tweet_id=e.tweet_id,
+		))
+	except Overloaded as e:
+		await ws.send_str(live_message(
+			"failed", error="Too many threads being resolved", status=503, retry_after=e.retry_after,
+		))
+	except OptedOutError as e:
+		await ws.send_str(live_message(
+			"failed", error="Author has opted out", status=403, reason="opted_out", handle=e.user.handle,
+		))
+	except (TwitterError, aiohttp.ClientResponseError, asyncio.TimeoutError):
+		logger.exception("Error following live thread")
+		await ws.send_str(live_message("failed", error="Error from twitter", status=502))
+	except ConnectionResetError:
+		# The client went away
+		pass
+	finally:
+		await ws.close()
+
+	return ws
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def tree_handler(
+	request, *,
+	get_thread_tree,
+	show_metrics=True,
+	tail: web_util.QueryParam,
+):
+	tail_id = parse_tweet_id(tail)
+	if tail_id is None or not is_valid_tweet_id(tail_id):
+		raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+
+	tree = await get_thread_tree(tail=tail_id)
+	tweets = [tweet for tweet, depth in tree.walk()]
+	author = tree.root.user
 
 	return web.Response(
 		text=web_util.dump_json(
-			thread=thread_tweet_ids,
-			author={
-				"handle": author.handle,
-				"name": author.name,
-			} if author is not None else None),
+			root=tree.root.id,
+			replies={
+				tweet_id: [reply.id for reply in replies]
+				for tweet_id, replies in tree.replies.items()
+			},
+			tweets=[tweet_json(tweet, show_metrics=show_metrics) for tweet in tweets],
+			fetched_at=tree.fetched_at.isoformat(),
+			author=user_json(author)),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def audit_handler(
+	request, *,
+	get_thread,
+	tail: web_util.QueryParam,
+	head: web_util.QueryParam =None,
+):
+	'''
+	Audit a thread for accessibility problems, like images without alt text
+	'''
+	tail_id = parse_tweet_id(tail)
+	if tail_id is None or not is_valid_tweet_id(tail_id):
+		raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+
+	head_id = parse_tweet_id(head) if head is not None else None
+	if head is not None and (head_id is None or not is_valid_tweet_id(head_id)):
+		raise web_util.bad_request_json("Invalid tweet id", param="head", tweet_id=head)
+
+	thread = await get_thread(tail=tail_id, head=head_id)
+	audit = accessibility.audit_thread(thread)
+
+	return web.Response(
+		text=web_util.dump_json(tail=thread.tail_id, head=thread.head_id, **audit.json()),
+		content_type="application/json",
+	)
+
+
+AUTHOR_PAGE_SIZE = 20
+
+# How many threads of each kind are listed on the homepage
+HOME_THREAD_COUNT = 10
+
+
+def thread_summary_json(summary):
+	first_tweet = summary.first_tweet
+	return {
+		"tail": summary.tail_id,
+		"head": summary.head_id,
+		"author": user_json(first_tweet.user),
+		"title": render.tweet_title(first_tweet),
+		"created_at": first_tweet.created_at.isoformat(),
+		"tweet_count": summary.tweet_count,
+		"resolved_at": summary.resolved_at.isoformat(),
+		"views": summary.views,
+		"permalink": permalinks.permalink(
+			author=first_tweet.user,
+			first_tweet=first_tweet,
+			tail_id=summary.tail_id,
+		),
+	}
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+async def author_handler(
+	request, *,
+	thread_store,
+	opt_outs,
+	handle: web_util.QueryParam,
+	page: web_util.QueryParam =None,
+):
+	'''
+	List the stored threads by an author, a page at a time, most recently
+	started first. Each thread's title is the first line of its first tweet.
+	'''
+	if thread_store is None:
+		raise web_util.not_found_json("Threads aren't stored on this server")
+
+	handle = handle.strip().lstrip("@")
+	if not HANDLE_PATTERN.match(handle):
+		raise web_util.bad_request_json("Invalid handle", param="handle", handle=handle)
+
+	page_number = parse_page_param(page, param="page", default=1)
+
+	total, threads = await thread_store.list_author_threads(
+		handle=handle,
+		offset=(page_number - 1) * AUTHOR_PAGE_SIZE,
+		limit=AUTHOR_PAGE_SIZE,
+	)
+
+	if total == 0:
+		raise web_util.not_found_json("No threads by this author", handle=handle)
+
+	author = threads[0].first_tweet.user if threads else None
+	if opt_outs is not None and (
+		f"@{handle.lower()}" in opt_outs or
+		(author is not None and opt_outs.is_opted_out(author))
+	):
+		raise web_util.error_json(
+			web.HTTPForbidden, "Author has opted out", reason="opted_out", handle=handle,
+		)
+
+	return web.Response(
+		text=web_util.dump_json(
+			handle=handle,
+			author=user_json(author) if author is not None else None,
+			feed=f"{web_util.site_url(request)}/feed/{handle}.atom",
+			total=total,
+			page=page_number,
+			pages=max(1, -(-total // AUTHOR_PAGE_SIZE)),
+			threads=[thread_summary_json(summary) for summary in threads],
+		),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET')
+async def home_handler(request, *, thread_store, opt_outs, homepage_threads):
+	'''
+	Get the threads for the homepage: the most recently resolved, and the most
+	viewed. This is a 404 if the server keeps its homepage static.
+	'''
+	if thread_store is None or not homepage_threads:
+		raise web_util.not_found_json("The homepage doesn't list threads on this server")
+
+	exclusions = dict(
+		exclude_ids=opt_outs.user_ids() if opt_outs is not None else (),
+		exclude_handles=opt_outs.handles() if opt_outs is not None else (),
+	)
+
+	recent, popular = await asyncio.gather(
+		thread_store.list_recent_threads(limit=HOME_THREAD_COUNT, **exclusions),
+		thread_store.list_popular_threads(limit=HOME_THREAD_COUNT, **exclusions),
+	)
+
+	return web.Response(
+		text=web_util.dump_json(
+			recent=[thread_summary_json(summary) for summary in recent],
+			popular=[thread_summary_json(summary) for summary in popular],
+		),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET')
+async def trending_handler(request, *, trending, opt_outs):
+	'''
+	Get the threads that are trending: the ones with the most views recently,
+	with recent views counting for more. The list is recomputed
+	periodically, rather than for each request.
+	'''
+	if trending is None:
+		raise web_util.not_found_json("Trending threads aren't enabled on this server")
+
+	threads = [
+		(summary, score) for summary, score in trending.trending
+		if opt_outs is None or not opt_outs.is_opted_out(summary.first_tweet.user)
+	][:trending.limit]
+
+	return web.Response(
+		text=web_util.dump_json(
+			updated_at=trending.updated_at.isoformat() if trending.updated_at is not None else None,
+			threads=[dict(thread_summary_json(summary), score=round(score, 2)) for summary, score in threads],
+		),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+async def revisions_handler(request, *, thread_store, tail: web_util.QueryParam):
+	'''
+	List the recorded changes to a stored thread (see revisions), newest
+	first, so that clients can tell whether it's changed since they last
+	saw it
+	'''
+	if thread_store is None:
+		raise web_util.not_found_json("Threads aren't stored on this server")
+
+	tail_id = parse_tweet_id(tail)
+	if tail_id is None or not is_valid_tweet_id(tail_id):
+		raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+
+	revisions = await thread_store.get_revisions(tail=tail_id)
+
+	return web.Response(
+		text=web_util.dump_json(
+			tail=tail_id,
+			revisions=[revision.json() for revision in revisions],
+		),
+		content_type="application/json",
+	)
+
+
+def require_follows(recrawler):
+	if recrawler is None:
+		raise web_util.not_found_json("Following threads isn't enabled on this server")
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def add_follow_handler(
+	request, *,
+	get_thread,
+	thread_store,
+	callback_sender,
+	recrawler,
+	tail: web_util.QueryParam,
+	callback_url: web_util.QueryParam =None,
+):
+	'''
+	Follow a thread, so that it's checked for new tweets from time to time
+	(see follows). The response includes the follow id, which is needed to
+	unfollow it, and can't be retrieved again later. If there's a
+	callback_url, it's sent a callback whenever the thread grows.
+	'''
+	require_follows(recrawler)
+
+	tail_id = parse_tweet_id(tail)
+	if tail_id is None or not is_valid_tweet_id(tail_id):
+		raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+
+	if callback_url is not None:
+		if callback_sender is None:
+			raise web_util.bad_request_json("Callbacks aren't enabled", param="callback_url")
+
+		try:
+			callback_sender.validate(callback_url)
+		except callbacks.InvalidCallbackError as e:
+			raise web_util.bad_request_json(str(e), param="callback_url", url=callback_url)
+
+	thread = await get_thread(tail=tail_id, head=None)
+
+	follow_id = follows.generate_follow_id()
+	await thread_store.add_follow(follows.Follow(
+		follows.hash_follow_id(follow_id),
+		thread.head_id,
+		thread.tail_id,
+		callback_url,
+		datetime.now(timezone.utc),
+	))
+
+	return web.Response(
+		text=web_util.dump_json(follow=follow_id, head=thread.head_id, tail=thread.tail_id),
+		status=201,
+		content_type="application/json",
+	)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def remove_follow_handler(
+	request, *,
+	get_thread,
+	thread_store,
+	callback_sender,
+	recrawler,
+	id: web_util.QueryParam,
+):
+	require_follows(recrawler)
+
+	if not await thread_store.remove_follow(follows.hash_follow_id(id)):
+		raise web_util.not_found_json("No such follow", id=id)
+
+	return web.Response(status=204)
+
+
+follow_handler = web_util.methods(
+	('POST', add_follow_handler),
+	('DELETE', remove_follow_handler),
+)
+
+
+async def stored_summaries(thread_store, opt_outs, entries):
+	'''
+	Get (entry, ThreadSummary) pairs for bookmarks or reading history
+	entries, leaving out threads that aren't stored (anymore) and ones by
+	opted out authors
+	'''
+	summaries = {
+		summary.tail_id: summary
+		for summary in await thread_store.get_thread_summaries(tails=[entry.tail_id for entry in entries])
+	}
+
+	return [
+		(entry, summaries[entry.tail_id])
+		for entry in entries
+		if entry.tail_id in summaries and (
+			opt_outs is None or not opt_outs.is_opted_out(summaries[entry.tail_id].first_tweet.user)
+		)
+	]
+
+
+@web_util.method_handler('GET')
+async def me_handler(request, *, accounts, thread_store, opt_outs):
+	'''
+	Get the signed in account, with its bookmarks and reading history
+	'''
+	account = await bobbin_accounts.require_account(request, accounts)
+
+	bookmarks = await accounts.store.get_bookmarks(account_id=account.id)
+	history = await accounts.store.get_reading_history(account_id=account.id)
+
+	return web.Response(
+		text=web_util.dump_json(
+			account={
+				"handle": account.handle,
+				"created_at": account.created_at.isoformat(),
+			},
+			bookmarks=[
+				dict(thread_summary_json(summary), bookmarked_at=bookmark.created_at.isoformat())
+				for bookmark, summary in await stored_summaries(thread_store, opt_outs, bookmarks)
+			],
+			history=[
+				dict(thread_summary_json(summary), read_at=entry.read_at.isoformat(), position=entry.position)
+				for entry, summary in await stored_summaries(thread_store, opt_outs, history)
+			],
+		),
+		content_type="application/json",
+		headers={"Cache-Control": "private, no-store"},
+	)
+
+
+def parse_tail_param(tail):
+	tail_id = parse_tweet_id(tail)
+	if tail_id is None or not is_valid_tweet_id(tail_id):
+		raise web_util.bad_request_json("Invalid tweet id", param="tail", tweet_id=tail)
+	return tail_id
+
+
+def bookmark_json(tail_id, bookmarked):
+	return web.Response(
+		text=web_util.dump_json(tail=tail_id, bookmarked=bookmarked),
+		content_type="application/json",
+		headers={"Cache-Control": "private, no-store"},
+	)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def get_bookmark_handler(request, *, accounts, tail: web_util.QueryParam):
+	account = await bobbin_accounts.require_account(request, accounts)
+	tail_id = parse_tail_param(tail)
+	return bookmark_json(tail_id, await accounts.store.is_bookmarked(account_id=account.id, tail=tail_id))
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def add_bookmark_handler(request, *, accounts, tail: web_util.QueryParam):
+	account = await bobbin_accounts.require_account(request, accounts)
+	tail_id = parse_tail_param(tail)
+	await accounts.store.add_bookmark(account_id=account.id, tail=tail_id, created_at=datetime.now(timezone.utc))
+	return bookmark_json(tail_id, True)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def remove_bookmark_handler(request, *, accounts, tail: web_util.QueryParam):
+	account = await bobbin_accounts.require_account(request, accounts)
+	tail_id = parse_tail_param(tail)
+	await accounts.store.remove_bookmark(account_id=account.id, tail=tail_id)
+	return bookmark_json(tail_id, False)
+
+
+bookmarks_handler = web_util.methods(
+	('GET', get_bookmark_handler),
+	('POST', add_bookmark_handler),
+	('DELETE', remove_bookmark_handler),
+)
+
+
+@web_util.method_handler('POST')
+@web_util.with_query(web_util.query_error_handler_json)
+async def history_handler(
+	request, *,
+	accounts,
+	tail: web_util.QueryParam,
+	position: web_util.QueryParam =None,
+):
+	'''
+	Add a thread to the signed in account's reading history. position, if
+	given, is the id of the last tweet they've read.
+	'''
+	account = await bobbin_accounts.require_account(request, accounts)
+	tail_id = parse_tail_param(tail)
+
+	if position is not None and not is_valid_tweet_id(position):
+		raise web_util.bad_request_json("Invalid tweet id", param="position", tweet_id=position)
+
+	await accounts.store.record_reading(
+		account_id=account.id,
+		tail=tail_id,
+		read_at=datetime.now(timezone.utc),
+		position=position,
+	)
+
+	return web.Response(status=204)
+
+
+async def position_json(tail_id, position, thread_store):
+	'''
+	The reading position response. index is the position tweet's index in
+	the stored thread, so that clients can tell which page it's on, or None
+	if the thread isn't stored or doesn't contain it.
+	'''
+	index = None
+	if position is not None and thread_store is not None:
+		thread = await thread_store.get_thread(tail=tail_id)
+		if thread is not None and position in thread.ids:
+			index = thread.index(position)
+
+	return web.Response(
+		text=web_util.dump_json(tail=tail_id, position=position, index=index),
+		content_type="application/json",
+		headers={"Cache-Control": "private, no-store"},
+	)
+
+
+async def get_position_handler(request, *, accounts, thread_store, tail):
+	'''
+	Get the last tweet of a thread that the signed in account has read
+	'''
+	account = await bobbin_accounts.require_account(request, accounts)
+	position = await accounts.store.get_reading_position(account_id=account.id, tail=tail)
+	return await position_json(tail, position, thread_store)
+
+
+@web_util.with_query(web_util.query_error_handler_json)
+async def put_position_handler(request, *, accounts, thread_store, tail, position: web_util.QueryParam):
+	'''
+	Save the last tweet of a thread that the signed in account has read, so
+	that it reopens there, on any device. This also moves the thread to the
+	top of their reading history.
+	'''
+	account = await bobbin_accounts.require_account(request, accounts)
+
+	if not is_valid_tweet_id(position):
+		raise web_util.bad_request_json("Invalid tweet id", param="position", tweet_id=position)
+
+	await accounts.store.record_reading(
+		account_id=account.id,
+		tail=tail,
+		read_at=datetime.now(timezone.utc),
+		position=position,
+	)
+	return await position_json(tail, position, thread_store)
+
+
+position_handler = web_util.methods(
+	('GET', get_position_handler),
+	('PUT', put_position_handler),
+)
+
+
+@web_util.method_handler('POST')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def email_handler(
+	request, *,
+	get_thread,
+	thread_mailer,
+	tail,
+	address: web_util.QueryParam,
+	format: web_util.QueryParam ="html",
+):
+	'''
+	Email a thread to address, as html or epub. Most addresses get a
+	confirmation email first, and the response's status is "confirm"; Kindle
+	addresses are sent the thread right away, and it's "sent". See mailer.
+	'''
+	if thread_mailer is None:
+		raise web_util.not_found_json("Emailing threads isn't enabled on this server")
+
+	if format not in mailer.FORMATS:
+		raise web_util.bad_request_json("Invalid format", param="format", formats=mailer.FORMATS)
+
+	try:
+		address = mailer.check_address(address)
+	except mailer.InvalidAddressError:
+		raise web_util.bad_request_json("Invalid email address", param="address") from None
+
+	email_request = mailer.EmailRequest(tail, address, format)
+	if not thread_mailer.needs_confirmation(email_request) and format != "epub":
+		raise web_util.bad_request_json("Kindle addresses only take epub", param="format")
+
+	retry_after = thread_mailer.acquire(client=client_limits.client_key(request), address=address)
+	if retry_after is not None:
+		retry_after = math.ceil(retry_after)
+		raise web.HTTPTooManyRequests(
+			text=web_util.dump_json(error="Too many emails", retry_after=retry_after),
+			content_type="application/json",
+			headers={"Retry-After": str(retry_after)},
+		)
+
+	thread = await get_thread(tail=tail, head=None)
+
+	try:
+		if thread_mailer.needs_confirmation(email_request):
+			status = "confirm"
+			token = thread_mailer.make_token(email_request)
+			await thread_mailer.send_confirmation(
+				thread,
+				email_request,
+				confirm_url=f"{web_util.site_url(request)}/email/confirm?token={token}",
+			)
+		else:
+			status = "sent"
+			await thread_mailer.send_thread(thread, email_request, site_url=web_util.site_url(request))
+	except (smtplib.SMTPException, OSError):
+		logger.exception("Error sending email")
+		raise web_util.bad_gateway_json("Couldn't send email") from None
+
+	return web.Response(
+		text=web_util.dump_json(status=status, address=address, format=format),
+		status=202,
+		content_type="application/json",
+	)
+
+
+def require_read_later(read_later):
+	if read_later is None:
+		raise web_util.not_found_json("Read later services aren't enabled on this server")
+	return read_later
+
+
+def get_read_later_service(read_later, name):
+	service = require_read_later(read_later).services.get(name)
+	if service is None:
+		raise web_util.not_found_json("Unknown read later service", service=name)
+	return service
+
+
+def read_later_error_json(error):
+	'''
+	The response for a read_later.ServiceError: 409 if the service needs to be
+	connected (again), since that's up to the user, and 502 otherwise
+	'''
+	if isinstance(error, bobbin_read_later.RejectedTokenError):
+		return web_util.error_json(web.HTTPConflict, str(error), reconnect=True)
+	return web_util.bad_gateway_json(str(error))
+
+
+async def read_later_json(account, read_later):
+	return web.Response(
+		text=web_util.dump_json(services=[
+			dict(name=service.name, title=service.title, connect_with=service.connect_with, connected=connected)
+			for service, connected in await read_later.connections(account)
+		]),
+		content_type="application/json",
+		headers={"Cache-Control": "private, no-store"},
+	)
+
+
+@web_util.method_handler('GET')
+async def read_later_handler(request, *, accounts, read_later):
+	'''
+	Get the read later services on this server, and which of them the signed
+	in account has connected
+	'''
+	require_read_later(read_later)
+	account = await bobbin_accounts.require_account(request, accounts)
+	return await read_later_json(account, read_later)
+
+
+async def connect_read_later_handler(request, *, accounts, read_later, service):
+	'''
+	Connect a read later service to the signed in account, with the
+	credentials in the form body: username and password for Instapaper, or
+	token for Readwise. Pocket is connected with a redirect instead; see
+	account_server.
+	'''
+	service = get_read_later_service(read_later, service)
+	account = await bobbin_accounts.require_account(request, accounts)
+	form = await request.post()
+
+	if service.connect_with == bobbin_read_later.PASSWORD:
+		if not form.get("username"):
+			raise web_util.bad_request_json("Missing username", param="username")
+		connecting = service.connect(username=form["username"], password=form.get("password", ""))
+	elif service.connect_with == bobbin_read_later.TOKEN:
+		if not form.get("token", "").strip():
+			raise web_util.bad_request_json("Missing token", param="token")
+		connecting = service.connect(token=form["token"])
+	else:
+		raise web_util.bad_request_json(f"{service.title} is connected by signing in to it", connect_with=service.connect_with)
+
+	try:
+		credentials = await connecting
+	except bobbin_read_later.ServiceError as e:
+		raise read_later_error_json(e) from e
+
+	await read_later.save_credentials(account, service, credentials)
+	return await read_later_json(account, read_later)
+
+
+async def disconnect_read_later_handler(request, *, accounts, read_later, service):
+	service = get_read_later_service(read_later, service)
+	account = await bobbin_accounts.require_account(request, accounts)
+	await read_later.disconnect(account, service)
+	return await read_later_json(account, read_later)
+
+
+read_later_connection_handler = web_util.methods(
+	('POST', connect_read_later_handler),
+	('DELETE', disconnect_read_later_handler),
+)
+
+
+@web_util.method_handler('POST')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def save_read_later_handler(request, *, accounts, get_thread, read_later, tail, service: web_util.QueryParam):
+	'''
+	Save a thread to one of the signed in account's read later services
+	'''
+	service = get_read_later_service(read_later, service)
+	account = await bobbin_accounts.require_account(request, accounts)
+	thread = await get_thread(tail=tail, head=None)
+
+	try:
+		url = await read_later.save_thread(account, service, thread, site_url=web_util.site_url(request))
+	except bobbin_read_later.ServiceError as e:
+		logger.info("Couldn't save thread %s to %s: %s", tail, service.name, e)
+		raise read_later_error_json(e) from e
+
+	return web.Response(
+		text=web_util.dump_json(service=service.name, url=url),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def unroll_handler(request, *, providers, show_metrics=True, url: web_util.QueryParam):
+	'''
+	Get the thread ending at a link to a post on any of the sources we know
+	(see source), like a tweet or a Mastodon status
+	'''
+	found = source.find_provider(providers, url)
+	if found is None:
+		raise web_util.bad_request_json("Not a link to a post we can unroll", param="url", url=url)
+
+	provider, ref = found
+	thread = await provider.get_thread(ref=ref)
+
+	return web.Response(
+		text=thread_json(
+			thread,
+			permalink=source.thread_path(provider, ref, thread),
+			show_metrics=show_metrics,
+			source=provider.name,
+			ref=ref,
+		),
+		content_type="application/json",
+	)
+
+
+SEARCH_PAGE_SIZE = 20
+
+# Searches longer than this are almost certainly not typed by a person
+MAX_SEARCH_LENGTH = 200
+
+
+def parse_date_param(value, *, param):
+	if value is None:
+		return None
+
+	try:
+		return date.fromisoformat(value)
+	except ValueError:
+		raise web_util.bad_request_json("Invalid date; use YYYY-MM-DD", param=param, date=value) from None
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+async def search_handler(
+	request, *,
+	thread_store,
+	opt_outs,
+	q: web_util.QueryParam,
+	author: web_util.QueryParam =None,
+	since: web_util.QueryParam =None,
+	until: web_util.QueryParam =None,
+	page: web_util.QueryParam =None,
+):
+	'''
+	Search the text of stored threads. author limits the results to threads
+	by one handle, and since and until (YYYY-MM-DD, inclusive) to threads
+	started in that range. Results come a page at a time, best matches first.
+	Threads by authors who have opted out are never included.
+	'''
+	if thread_store is None:
+		raise web_util.not_found_json("Search isn't enabled on this server")
+
+	query = q.strip()
+	if not query or len(query) > MAX_SEARCH_LENGTH:
+		raise web_util.bad_request_json("Invalid search", param="q")
+
+	if author is not None:
+		author = author.strip().lstrip("@") or None
+
+	since_date = parse_date_param(since, param="since")
+	until_date = parse_date_param(until, param="until")
+	page_number = parse_page_param(page, param="page", default=1)
+
+	try:
+		total, results = await thread_store.search_threads(
+			query=query,
+			author=author,
+			since=since_date,
+			until=until_date,
+			exclude_ids=opt_outs.user_ids() if opt_outs is not None else (),
+			exclude_handles=opt_outs.handles() if opt_outs is not None else (),
+			offset=(page_number - 1) * SEARCH_PAGE_SIZE,
+			limit=SEARCH_PAGE_SIZE,
+		)
+	except SearchUnavailableError:
+		raise web_util.not_found_json("Search isn't enabled on this server") from None
+
+	return web.Response(
+		text=web_util.dump_json(
+			query=query,
+			author=author,
+			since=since_date.isoformat() if since_date is not None else None,
+			until=until_date.isoformat() if until_date is not None else None,
+			total=total,
+			page=page_number,
+			pages=max(1, -(-total // SEARCH_PAGE_SIZE)),
+			results=[result.json() for result in results],
+		),
+		content_type="application/json",
+	)
+
+
+def send_job_callback(job, url, callback_sender, show_metrics, result):
+	if result.cancelled():
+		return
+
+	if result.exception() is not None:
+		body = web_util.dump_json(job=job.id, status=jobs.FAILED, error=type(result.exception()).__name__)
+	else:
+		body = thread_json(result.result(), show_metrics=show_metrics, job=job.id, status=jobs.DONE)
+
+	callback_sender.send(url, body)
+
+
+@web_util.method_handler('GET')
+async def job_handler(request, *, job_queue, job_id):
+	'''
+	Get the status of a thread resolution job. Once it's done, the thread
+	itself can be fetched from /api/thread as usual.
+	'''
+	job = job_queue.get_job(job_id) if job_queue is not None else None
+	if job is None:
+		raise web_util.not_found_json("No such job", job=job_id)
+
+	error = job.error
+	return web.Response(
+		text=web_util.dump_json(
+			job=job.id,
+			status=job.state,
+			tail=job.key.tail,
+			head=job.key.head,
+			error=type(error).__name__ if error is not None else None,
+		),
+		content_type="application/json",
+		headers={"Retry-After": str(JOB_POLL_INTERVAL)} if job.state in (jobs.PENDING, jobs.RUNNING) else {},
+	)
+
+
+@web_util.method_handler('GET')
+async def stats_handler(request, *, tweet_cache):
+	return web.Response(
+		text=web_util.dump_json(cache=tweet_cache.stats()),
 		content_type="application/json",
 	)
 
 
 handler = web_util.routes(
-	(r"/thread/?$", thread_handler)
+	(r"/thread/?$", thread_handler, ['get_thread', 'get_thread_replies', 'get_private_thread', 'accounts', 'response_cache', 'job_queue', 'callback_sender', 'show_metrics']),
+	(r"/thread/(?P<tail>[0-9]{1,20})/?$", thread_path_handler, ['get_thread', 'get_thread_replies', 'get_private_thread', 'accounts', 'response_cache', 'job_queue', 'callback_sender', 'show_metrics', 'tail']),
+	(r"/jobs/(?P<job_id>[0-9]{1,20}(-[0-9]{1,20})?)/?$", job_handler, ['job_queue', 'job_id']),
+	(r"/tree/?$", tree_handler, ['get_thread_tree', 'show_metrics']),
+	(r"/audit/?$", audit_handler, 'get_thread'),
+	(r"/search/?$", search_handler, ['thread_store', 'opt_outs']),
+	(r"/author/?$", author_handler, ['thread_store', 'opt_outs']),
+	(r"/home/?$", home_handler, ['thread_store', 'opt_outs', 'homepage_threads']),
+	(r"/trending/?$", trending_handler, ['trending', 'opt_outs']),
+	(r"/revisions/?$", revisions_handler, 'thread_store'),
+	(r"/follow/?$", follow_handler, ['get_thread', 'thread_store', 'callback_sender', 'recrawler']),
+	(r"/me/?$", me_handler, ['accounts', 'thread_store', 'opt_outs']),
+	(r"/bookmarks/?$", bookmarks_handler, 'accounts'),
+	(r"/history/?$", history_handler, 'accounts'),
+	(r"/thread/(?P<tail>[0-9]{1,20})/position/?$", position_handler, ['accounts', 'thread_store', 'tail']),
+	(r"/thread/(?P<tail>[0-9]{1,20})/email/?$", email_handler, ['get_thread', 'thread_mailer', 'tail']),
+	(r"/thread/(?P<tail>[0-9]{1,20})/read-later/?$", save_read_later_handler, ['accounts', 'get_thread', 'read_later', 'tail']),
+	(r"/read-later/?$", read_later_handler, ['accounts', 'read_later']),
+	(r"/read-later/(?P<service>[a-z]{1,20})/connection/?$", read_later_connection_handler, ['accounts', 'read_later', 'service']),
+	(r"/unroll/?$", unroll_handler, ['providers', 'show_metrics']),
+	(r"/stats/?$", stats_handler, 'tweet_cache'),
 )
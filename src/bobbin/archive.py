@@ -0,0 +1,289 @@
+# Export and import of the whole thread store, for backups and for moving
+# between storage backends:
+#
+#     bobbin export --output archive.tar.gz [--database bobbin.db]
+#     bobbin import archive.tar.gz [--database bobbin.db]
+#
+# An archive is a tar file, compressed according to its extension: .tar,
+# .tar.gz (or .tgz), .tar.bz2, .tar.xz, or .tar.zst, which needs the
+# zstandard package (pip install bobbin[archive-zstd]). It has three files,
+# in this order:
+#
+# - manifest.json: {"format": "bobbin-archive", "version": 1,
+#   "exported_at": <time>, "threads": <count>}
+# - threads.jsonl: one stored thread per line, as {"tail_id": <id>,
+#   "resolved_at": <time>, "tweets": [<tweet>, ...]}, with the tweets in
+#   order from head to tail
+# - views.jsonl: the view counts of each thread that has been viewed, as
+#   {"tail_id": <id>, "views": <total>, "hours": [[<hour>, <views>], ...]}
+#
+# Times are ISO 8601 strings, and tweets are in the JSON format described in
+# tweet_json, which the thread store keeps them in too. Media urls point at
+# wherever the media is hosted; media itself isn't archived.
+#
+# Importing replaces any stored threads (and view counts) with the same
+# tails, and leaves everything else alone.
+
+from datetime import datetime, timezone
+import io
+import json
+import os
+import pathlib
+import sys
+import tarfile
+import tempfile
+
+from autocommand import autocommand
+
+from bobbin import config as bobbin_config, storage
+from bobbin.tweet_json import format_time, parse_time, tweet_from_json, tweet_to_json
+from bobbin.tweetbox import Thread
+
+try:
+	import zstandard
+except ImportError:
+	zstandard = None
+
+FORMAT = "bobbin-archive"
+VERSION = 1
+
+# Extension -> tarfile compression, or "zst" for zstandard
+COMPRESSIONS = {
+	".tar": "",
+	".tar.gz": "gz",
+	".tgz": "gz",
+	".tar.bz2": "bz2",
+	".tar.xz": "xz",
+	".tar.zst": "zst",
+}
+
+PAGE_SIZE = 1000
+
+EPOCH = datetime(1970, 1, 1, tzinfo=timezone.utc)
+
+
+class ArchiveError(Exception):
+	pass
+
+
+def compression(path):
+	name = pathlib.Path(path).name.lower()
+
+	for extension, method in COMPRESSIONS.items():
+		if name.endswith(extension):
+			if method == "zst" and zstandard is None:
+				raise ArchiveError(".tar.zst archives need zstandard (pip install bobbin[archive-zstd])")
+			return method
+
+	raise ArchiveError("Archives must be one of: {}".format(", ".join(COMPRESSIONS)))
+
+
+def write_line(file, blob):
+	file.write(json.dumps(blob, separators=(",", ":")).encode())
+	file.write(b"\n")
+
+
+def add_file(tar, name, file):
+	info = tarfile.TarInfo(name)
+	info.size = file.seek(0, io.SEEK_END)
+	info.mtime = int(datetime.now(timezone.utc).timestamp())
+	file.seek(0)
+	tar.addfile(info, file)
+
+
+async def export_store(store, output):
+	'''
+	Write every thread in store, and their view counts, to the archive at
+	output. Returns the number of threads written.
+	'''
+	method = compression(output)
+
+	hours = {}
+	for tail, hour, views in await store.get_view_counts(since=EPOCH):
+		hours.setdefault(tail, []).append([format_time(hour), views])
+
+	count = 0
+
+	with tempfile.TemporaryFile() as threads_file, tempfile.TemporaryFile() as views_file:
+		offset = 0
+		while True:
+			page = await store.list_threads(offset=offset, limit=PAGE_SIZE)
+			if not page:
+				break
+			offset += len(page)
+
+			for tail, resolved_at in page:
+				thread = await store.get_thread(tail=tail)
+				if thread is None:
+					continue
+
+				write_line(threads_file, {
+					"tail_id": tail,
+					"resolved_at": format_time(resolved_at),
+					"tweets": [tweet_to_json(tweet) for tweet in thread],
+				})
+				count += 1
+
+			for summary in await store.get_thread_summaries(tails=[tail for tail, _ in page]):
+				if summary.views or summary.tail_id in hours:
+					write_line(views_file, {
+						"tail_id": summary.tail_id,
+						"views": summary.views,
+						"hours": hours.get(summary.tail_id, []),
+					})
+
+		manifest = io.BytesIO(json.dumps({
+			"format": FORMAT,
+			"version": VERSION,
+			"exported_at": format_time(datetime.now(timezone.utc)),
+			"threads": count,
+		}, indent="\t").encode())
+
+		with open(output, "wb") as file:
+			if method == "zst":
+				with zstandard.ZstdCompressor().stream_writer(file) as compressed:
+					with tarfile.open(fileobj=compressed, mode="w|") as tar:
+						write_archive(tar, manifest, threads_file, views_file)
+			else:
+				with tarfile.open(fileobj=file, mode=f"w:{method}") as tar:
+					write_archive(tar, manifest, threads_file, views_file)
+
+	return count
+
+
+def write_archive(tar, manifest, threads_file, views_file):
+	add_file(tar, "manifest.json", manifest)
+	add_file(tar, "threads.jsonl", threads_file)
+	add_file(tar, "views.jsonl", views_file)
+
+
+def read_lines(file):
+	for line in file:
+		if line.strip():
+			yield json.loads(line.decode())
+
+
+async def import_store(store, path):
+	'''
+	Save every thread in the archive at path to store, along with their
+	view counts. Returns the number of threads saved.
+	'''
+	method = compression(path)
+
+	with open(path, "rb") as file:
+		if method == "zst":
+			with zstandard.ZstdDecompressor().stream_reader(file) as decompressed:
+				with tarfile.open(fileobj=decompressed, mode="r|") as tar:
+					return await read_archive(store, tar)
+		else:
+			with tarfile.open(fileobj=file, mode=f"r:{method}") as tar:
+				return await read_archive(store, tar)
+
+
+async def read_archive(store, tar):
+	# Members are read in order, so that compressed archives can be streamed
+	manifest = None
+	count = 0
+
+	for member in tar:
+		file = tar.extractfile(member)
+		if file is None:
+			continue
+
+		if member.name == "manifest.json":
+			manifest = json.loads(file.read().decode())
+			if manifest.get("format") != FORMAT:
+				raise ArchiveError("Not a bobbin archive")
+			if manifest.get("version") != VERSION:
+				raise ArchiveError(f"Unsupported archive version: {manifest.get('version')}")
+		elif manifest is None:
+			raise ArchiveError("Archive is missing its manifest")
+		elif member.name == "threads.jsonl":
+			for blob in read_lines(file):
+				resolved_at = parse_time(blob["resolved_at"])
+				thread = Thread(map(tweet_from_json, blob["tweets"]), fetched_at=resolved_at)
+				await store.save_thread(thread, resolved_at=resolved_at)
+				count += 1
+		elif member.name == "views.jsonl":
+			for blob in read_lines(file):
+				await store.set_thread_views(
+					tail=blob["tail_id"],
+					views=blob["views"],
+					hours=[(parse_time(hour), views) for hour, views in blob["hours"]],
+				)
+
+	if manifest is None:
+		raise ArchiveError("Archive is missing its manifest")
+
+	return count
+
+
+def load_database(database, config_file):
+	'''
+	Get the database path from --database, or else the config. Credentials
+	and the rest of the server's settings aren't needed.
+	'''
+	try:
+		config = bobbin_config.load(path=config_file, overrides=dict(database=database), check=False)
+	except bobbin_config.ConfigError as e:
+		raise ArchiveError(str(e)) from e
+
+	if config.database is None:
+		raise ArchiveError("Missing database (--database or DATABASE_PATH)")
+
+	return config.database
+
+
+@autocommand(__name__, loop=True, pass_loop=True)
+async def export_main(
+	output: str =None,
+	database: str =None,
+	config_file: str =os.environ.get("BOBBIN_CONFIG", None),
+	loop=None,
+):
+	'''
+	Write every stored thread to the archive at output
+	'''
+	if output is None:
+		return "Missing --output"
+
+	try:
+		store = storage.SqliteThreadStore(load_database(database, config_file), loop=loop)
+	except ArchiveError as e:
+		return str(e)
+
+	try:
+		count = await export_store(store, output)
+	except (ArchiveError, OSError, tarfile.TarError) as e:
+		return f"Couldn't export: {e}"
+	finally:
+		store.close()
+
+	print(f"Exported {count} threads to {output}", file=sys.stderr)
+
+
+@autocommand(__name__, loop=True, pass_loop=True)
+async def import_main(
+	archive,
+	database: str =None,
+	config_file: str =os.environ.get("BOBBIN_CONFIG", None),
+	loop=None,
+):
+	'''
+	Save every thread in archive (from bobbin export) to the store
+	'''
+	try:
+		store = storage.SqliteThreadStore(load_database(database, config_file), loop=loop)
+	except ArchiveError as e:
+		return str(e)
+
+	try:
+		count = await import_store(store, archive)
+	except (ArchiveError, OSError, tarfile.TarError) as e:
+		return f"Couldn't import: {e}"
+	except (ValueError, KeyError, TypeError) as e:
+		return f"Couldn't import: invalid archive ({e!r})"
+	finally:
+		store.close()
+
+	print(f"Imported {count} threads from {archive}", file=sys.stderr)
@@ -43,6 +43,14 @@ class Cache(abc.ABC):
 	async def write(self, key, value):
 		raise NotImplementedError()
 
+	async def delete(self, key):
+		'''
+		Remove a key from the cache, if it's there. This is for administrative
+		purges (for instance, of tweets that have since been deleted), not
+		for normal operation, so not every cache supports it.
+		'''
+		raise NotImplementedError()
+
 
 class BaseMultiCache(Cache):
 	def __init__(self, caches):
@@ -117,6 +125,60 @@ class SyncStackedCache(BaseUpdaterStackedCache):
 		return result
 
 
+# DictCache is an unbounded cache backed by a plain dict. It's only suitable
+# for short lived processes, like the command line tools, or for a single
+# resolution (see tweetbox.make_private_thread_getter).
+class DictCache(Cache):
+	def __init__(self):
+		self.cache = {}
+
+	async def get(self, key):
+		with self.convert_keyerror():
+			return self.cache[key]
+
+	async def write(self, key, value):
+		self.cache[key] = value
+
+	async def delete(self, key):
+		self.cache.pop(key, None)
+
+
+# MeteredCache wraps another cache, counting hits, misses, and writes, so that
+# the effectiveness of the cache can be monitored.
+class MeteredCache(Cache):
+	def __init__(self, cache):
+		self.cache = cache
+		self.hits = 0
+		self.misses = 0
+		self.writes = 0
+
+	async def get(self, key):
+		try:
+			result = await self.cache.get(key)
+		except KeyNotFound:
+			self.misses += 1
+			raise
+
+		self.hits += 1
+		return result
+
+	async def write(self, key, value):
+		await self.cache.write(key, value)
+		self.writes += 1
+
+	async def delete(self, key):
+		await self.cache.delete(key)
+
+	def stats(self):
+		lookups = self.hits + self.misses
+		return {
+			"hits": self.hits,
+			"misses": self.misses,
+			"writes": self.writes,
+			"hit_rate": self.hits / lookups if lookups else None,
+		}
+
+
 size_handlers = {
 	list: iter,
 	tuple: iter,
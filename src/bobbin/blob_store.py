@@ -0,0 +1,209 @@
+# Storage for blobs: files we make or copy, like mirrored media (see
+# media_mirror) and share images, that are too big for the database. A
+# BlobStore is either a local directory or a bucket on S3 (or anything with
+# S3's API, like MinIO); see make_blob_store.
+#
+# Keys are relative paths, like media/<hash>.jpg, made of letters, digits,
+# dots, dashes and underscores. Each user of the store keeps its blobs under
+# its own prefix.
+
+from datetime import datetime, timezone
+from urllib.parse import urlsplit
+import abc
+import asyncio
+import hashlib
+import hmac
+import mimetypes
+import os
+import pathlib
+import re
+
+import aiohttp
+
+DEFAULT_S3_ENDPOINT = "https://s3.amazonaws.com"
+
+KEY_PATTERN = re.compile(r"^[a-zA-Z0-9_-][a-zA-Z0-9._-]*(?:/[a-zA-Z0-9_-][a-zA-Z0-9._-]*)*$")
+
+
+def check_key(key):
+	'''
+	Raise a ValueError if key isn't a valid key. Segments can't start with a
+	dot, so keys can't escape a LocalBlobStore's directory, or hide in it.
+	'''
+	if not KEY_PATTERN.match(key):
+		raise ValueError(f"Invalid blob key: {key!r}")
+
+
+class BlobStore(abc.ABC):
+	@abc.abstractmethod
+	async def get(self, key):
+		'''
+		Get the (body, content type) stored under key, or None
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def put(self, key, body, content_type):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def exists(self, key):
+		raise NotImplementedError()
+
+
+class LocalBlobStore(BlobStore):
+	'''
+	BlobStore backed by a directory, with a file for each key. Files are
+	read and written in the loop's default executor.
+	'''
+	def __init__(self, directory, *, loop=None):
+		self.directory = pathlib.Path(directory)
+		self.directory.mkdir(parents=True, exist_ok=True)
+		self.loop = loop
+
+	def _run(self, func, *args):
+		loop = self.loop if self.loop is not None else asyncio.get_event_loop()
+		return loop.run_in_executor(None, func, *args)
+
+	def path(self, key):
+		check_key(key)
+		return self.directory / key
+
+	def _get(self, key):
+		try:
+			return self.path(key).read_bytes()
+		except FileNotFoundError:
+			return None
+
+	async def get(self, key):
+		body = await self._run(self._get, key)
+		if body is None:
+			return None
+
+		content_type, _ = mimetypes.guess_type(key)
+		return body, content_type or "application/octet-stream"
+
+	def _put(self, key, body):
+		path = self.path(key)
+		path.parent.mkdir(parents=True, exist_ok=True)
+
+		# Written to a temporary file first, so that a half written blob is
+		# never served
+		tmp_path = path.with_name(f".{path.name}.tmp")
+		tmp_path.write_bytes(body)
+		os.replace(str(tmp_path), str(path))
+
+	async def put(self, key, body, content_type):
+		await self._run(self._put, key, body)
+
+	async def exists(self, key):
+		return await self._run(self.path(key).is_file)
+
+
+def sign_request(method, url, headers, payload_hash, *, access_key, secret_key, region, now):
+	'''
+	Get the headers for an S3 request, signed with AWS Signature Version 4.
+	url shouldn't have a query string; none of our requests need one.
+	'''
+	parsed = urlsplit(url)
+	amz_date = now.strftime("%Y%m%dT%H%M%SZ")
+	scope = f"{amz_date[:8]}/{region}/s3/aws4_request"
+
+	headers = {
+		**{name.lower(): value for name, value in headers.items()},
+		"host": parsed.netloc,
+		"x-amz-content-sha256": payload_hash,
+		"x-amz-date": amz_date,
+	}
+	signed_headers = ";".join(sorted(headers))
+
+	canonical_request = "\n".join([
+		method,
+		parsed.path or "/",
+		"",
+		*(f"{name}:{headers[name].strip()}" for name in sorted(headers)),
+		"",
+		signed_headers,
+		payload_hash,
+	])
+
+	string_to_sign = "\n".join([
+		"AWS4-HMAC-SHA256",
+		amz_date,
+		scope,
+		hashlib.sha256(canonical_request.encode()).hexdigest(),
+	])
+
+	key = f"AWS4{secret_key}".encode()
+	for part in (amz_date[:8], region, "s3", "aws4_request"):
+		key = hmac.new(key, part.encode(), hashlib.sha256).digest()
+	signature = hmac.new(key, string_to_sign.encode(), hashlib.sha256).hexdigest()
+
+	headers["authorization"] = (
+		f"AWS4-HMAC-SHA256 Credential={access_key}/{scope}, "
+		f"SignedHeaders={signed_headers}, Signature={signature}"
+	)
+	del headers["host"]
+	return headers
+
+
+class S3BlobStore(BlobStore):
+	'''
+	BlobStore backed by a bucket on S3, or another service with S3's API at
+	endpoint. Buckets are addressed by path, which every S3-compatible
+	service supports.
+	'''
+	def __init__(self, session, *, bucket, access_key, secret_key, endpoint=DEFAULT_S3_ENDPOINT, region="us-east-1", timeout=60):
+		self.session = session
+		self.bucket = bucket
+		self.access_key = access_key
+		self.secret_key = secret_key
+		self.endpoint = endpoint.rstrip("/")
+		self.region = region
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+
+	def request(self, method, key, *, body=b"", headers=None):
+		check_key(key)
+		url = f"{self.endpoint}/{self.bucket}/{key}"
+		headers = sign_request(
+			method,
+			url,
+			headers or {},
+			hashlib.sha256(body).hexdigest(),
+			access_key=self.access_key,
+			secret_key=self.secret_key,
+			region=self.region,
+			now=datetime.now(timezone.utc),
+		)
+
+		return self.session.request(method, url, data=body or None, headers=headers, timeout=self.timeout)
+
+	async def get(self, key):
+		async with self.request("GET", key) as response:
+			if response.status == 404:
+				return None
+			response.raise_for_status()
+
+			return await response.read(), response.content_type
+
+	async def put(self, key, body, content_type):
+		async with self.request("PUT", key, body=body, headers={"Content-Type": content_type}) as response:
+			response.raise_for_status()
+
+	async def exists(self, key):
+		async with self.request("HEAD", key) as response:
+			if response.status == 404:
+				return False
+			response.raise_for_status()
+			return True
+
+
+def make_blob_store(location, *, session, loop=None, **s3_options):
+	'''
+	Make the BlobStore for location: s3://<bucket> for an S3BlobStore (using
+	session, with s3_options), or else a directory for a LocalBlobStore
+	'''
+	if location.startswith("s3://"):
+		return S3BlobStore(session, bucket=location[len("s3://"):].strip("/"), **s3_options)
+
+	return LocalBlobStore(location, loop=loop)
@@ -0,0 +1,370 @@
+# Low level async interface for Bluesky (the AT Protocol's app.bsky
+# lexicon). Like mastodon, posts are made into the same Tweet and
+# TwitterUser types that bobbin.twitter returns, so that Bluesky threads are
+# rendered by the same code as twitter threads (see source).
+#
+# Everything is read from a public AppView, which needs no credentials.
+# Posts are identified by their at:// uri, which is used as the Tweet id;
+# links on bsky.app name the author by handle or DID and the post by its
+# record key, so handles are resolved to DIDs to make the uri.
+
+from datetime import datetime
+from urllib.parse import quote as url_quote
+import html
+import re
+
+import aiohttp
+
+from bobbin.link_cards import Card
+from bobbin.tweet_text import safe_url
+from bobbin.tweetbox import Thread, ThreadGap
+from bobbin.twitter import (
+	Entities,
+	Media,
+	NoSuchTweetError,
+	PublicMetrics,
+	Tweet,
+	TwitterError,
+	TwitterUser,
+	UrlEntity,
+	VideoVariant,
+)
+
+DEFAULT_APPVIEW = "https://public.api.bsky.app"
+POST_THREAD_PATH = "/xrpc/app.bsky.feed.getPostThread"
+RESOLVE_HANDLE_PATH = "/xrpc/com.atproto.identity.resolveHandle"
+
+WEB_URL = "https://bsky.app"
+
+# Links to posts on bsky.app, like https://bsky.app/profile/alice.bsky.social/post/3k2yihcrp6f2c,
+# and at:// uris, like at://did:plc:abc/app.bsky.feed.post/3k2yihcrp6f2c
+POST_URL_PATTERN = re.compile(
+	r"^\s*(?:"
+	r"(?:https?://)?(?:www\.)?bsky\.app/profile/(?P<actor>[a-zA-Z0-9.:-]{1,253})/post/(?P<rkey>[a-zA-Z0-9]{1,20})"
+	r"|at://(?P<uri_actor>[a-zA-Z0-9.:-]{1,253})/app\.bsky\.feed\.post/(?P<uri_rkey>[a-zA-Z0-9]{1,20})"
+	r")/?(?:[?#]\S*)?\s*$"
+)
+
+# The most ancestors the AppView will return at once
+MAX_PARENT_HEIGHT = 1000
+
+POST_COLLECTION = "app.bsky.feed.post"
+
+
+class BlueskyError(TwitterError):
+	'''
+	An error from the AppView. This is a TwitterError, so that it's handled
+	the same way as errors from twitter.
+	'''
+
+
+def parse_post_url(text):
+	'''
+	Get the (actor, record key) from a link to a Bluesky post, or None if
+	text isn't one. actor is a handle or a DID.
+	'''
+	match = POST_URL_PATTERN.match(text)
+	if match is None:
+		return None
+
+	actor = match.group("actor") or match.group("uri_actor")
+	return actor.lower() if not actor.startswith("did:") else actor, match.group("rkey") or match.group("uri_rkey")
+
+
+def post_uri(did, rkey):
+	return f"at://{did}/{POST_COLLECTION}/{rkey}"
+
+
+def uri_rkey(uri):
+	return uri.rsplit("/", 1)[-1]
+
+
+def post_text(record):
+	'''
+	Get the text and UrlEntities of a post record. Links are shortened in
+	the text itself, with the full url in a facet, so they're replaced with
+	their full urls. Like tweet text, the text is HTML escaped.
+	'''
+	text = record.get("text", "")
+	encoded = text.encode("utf-8")
+
+	links = []
+	for facet in record.get("facets") or ():
+		index = facet.get("index") or {}
+		for feature in facet.get("features") or ():
+			if feature.get("$type") == "app.bsky.richtext.facet#link" and feature.get("uri"):
+				links.append((index.get("byteStart", 0), index.get("byteEnd", 0), feature["uri"]))
+
+	parts = []
+	urls = []
+	position = 0
+
+	for start, end, uri in sorted(links):
+		# Facets pointing outside the text, or overlapping an earlier one,
+		# are ignored
+		if start < position or end > len(encoded) or start >= end:
+			continue
+
+		parts.append(encoded[position:start].decode("utf-8", errors="replace"))
+		parts.append(uri)
+		urls.append(UrlEntity(
+			None,
+			html.escape(uri, quote=False),
+			uri,
+			encoded[start:end].decode("utf-8", errors="replace"),
+		))
+		position = end
+
+	parts.append(encoded[position:].decode("utf-8", errors="replace"))
+	return html.escape("".join(parts), quote=False), tuple(urls)
+
+
+def parse_created_at(created_at):
+	# Like 2023-08-07T05:31:12.156Z, with any precision, or none
+	created_at = created_at.replace("Z", "+00:00")
+	match = re.match(r"^(.*T\d\d:\d\d:\d\d)(?:\.(\d+))?(.*)$", created_at)
+	if match is None:
+		raise ValueError(created_at)
+
+	seconds, fraction, offset = match.groups()
+	fraction = f".{(fraction or '0')[:6].ljust(6, '0')}"
+	return datetime.strptime(f"{seconds}{fraction}{offset}", "%Y-%m-%dT%H:%M:%S.%f%z")
+
+
+def user_from_json(blob):
+	'''
+	Create a TwitterUser from a Bluesky profile. The id is the DID, which
+	never changes, unlike the handle.
+	'''
+	return TwitterUser(
+		blob["did"],
+		blob["handle"],
+		blob.get("displayName") or blob["handle"],
+		blob.get("avatar"),
+		None,
+		False,
+		blob.get("followersCount"),
+		f"{WEB_URL}/profile/{url_quote(blob['handle'])}",
+	)
+
+
+def aspect_ratio(blob):
+	ratio = blob.get("aspectRatio") or {}
+	return ratio.get("width"), ratio.get("height")
+
+
+def media_from_embed(embed):
+	'''
+	Get the Media in a post's embed view. Videos are HLS streams, which
+	aren't mp4 variants, so they're only shown as their thumbnails.
+	'''
+	if embed is None:
+		return ()
+
+	embed_type = embed.get("$type", "")
+
+	if embed_type.startswith("app.bsky.embed.images"):
+		return tuple(
+			Media(None, None, image["fullsize"], "photo", *aspect_ratio(image), image.get("alt") or None, ())
+			for image in embed.get("images", ())
+		)
+	elif embed_type.startswith("app.bsky.embed.video"):
+		return (Media(
+			None,
+			None,
+			embed.get("thumbnail"),
+			"video",
+			*aspect_ratio(embed),
+			embed.get("alt") or None,
+			(VideoVariant("application/x-mpegURL", None, embed["playlist"]),) if embed.get("playlist") else (),
+		),)
+	elif embed_type.startswith("app.bsky.embed.recordWithMedia"):
+		return media_from_embed(embed.get("media"))
+	else:
+		return ()
+
+
+def card_from_embed(embed):
+	if embed is None or not embed.get("$type", "").startswith("app.bsky.embed.external"):
+		return None
+
+	# The link is whatever the post's author wrote
+	external = embed.get("external") or {}
+	uri = external.get("uri")
+	if not isinstance(uri, str) or not safe_url(uri):
+		return None
+
+	thumb = external.get("thumb")
+	return Card(
+		uri,
+		external.get("title") or uri,
+		external.get("description") or None,
+		thumb if isinstance(thumb, str) and safe_url(thumb) else None,
+		None,
+	)
+
+
+def quoted_record(embed):
+	'''
+	Get the view of the post quoted by an embed, if it quotes one that can
+	be seen
+	'''
+	if embed is None:
+		return None
+
+	embed_type = embed.get("$type", "")
+	if embed_type.startswith("app.bsky.embed.recordWithMedia"):
+		embed = embed.get("record")
+	elif not embed_type.startswith("app.bsky.embed.record"):
+		return None
+
+	record = (embed or {}).get("record") or {}
+	if record.get("$type", "").endswith("#viewRecord") and "value" in record:
+		return record
+
+	return None
+
+
+def tweet_from_json(blob, *, record_key="record", embed=None):
+	'''
+	Create a Tweet from a post view. Quoted posts are views of a different
+	shape, with the record under "value" and their embeds in a list, so
+	those are given by record_key and embed.
+	'''
+	record = blob[record_key]
+	if embed is None:
+		embed = blob.get("embed")
+
+	text, urls = post_text(record)
+	author = user_from_json(blob["author"])
+	parent = (record.get("reply") or {}).get("parent") or {}
+
+	quoted_view = quoted_record(embed)
+	quoted = None
+	if quoted_view is not None:
+		quoted_embeds = quoted_view.get("embeds") or ()
+		quoted = tweet_from_json(
+			quoted_view,
+			record_key="value",
+			embed=quoted_embeds[0] if quoted_embeds else {},
+		)
+
+	return Tweet(
+		blob["uri"],
+		author,
+		parent.get("uri"),
+		None,
+		text,
+		parse_created_at(record.get("createdAt") or blob["indexedAt"]),
+		Entities(urls, (), (), media_from_embed(embed)),
+		quoted.id if quoted is not None else None,
+		quoted,
+		None,
+		PublicMetrics(
+			blob.get("likeCount", 0),
+			blob.get("repostCount", 0),
+			blob.get("replyCount", 0),
+			blob.get("quoteCount"),
+		) if "likeCount" in blob else None,
+		None,
+		card_from_embed(embed),
+		url=f"{WEB_URL}/profile/{url_quote(author.handle)}/post/{uri_rkey(blob['uri'])}",
+	)
+
+
+async def request_json(*, session, appview, path, params, timeout, tweet_id=None):
+	try:
+		async with session.get(
+			appview + path,
+			params=params,
+			headers={"Accept": "application/json"},
+			timeout=aiohttp.ClientTimeout(total=timeout),
+		) as response:
+			if response.status == 400 and tweet_id is not None:
+				# XRPC reports missing posts and handles as bad requests, with
+				# an error name
+				body = await response.json(content_type=None)
+				if isinstance(body, dict) and body.get("error") in ("NotFound", "InvalidRequest"):
+					raise NoSuchTweetError(tweet_id)
+			if response.status != 200:
+				raise BlueskyError(f"AppView responded with {response.status}")
+
+			return await response.json(content_type=None)
+	except (aiohttp.ClientError, ValueError) as e:
+		raise BlueskyError(f"Couldn't reach the AppView: {e}") from e
+
+
+async def resolve_handle(*, session, handle, appview=DEFAULT_APPVIEW, timeout=10):
+	'''
+	Get the DID of a handle
+	'''
+	blob = await request_json(
+		session=session,
+		appview=appview,
+		path=RESOLVE_HANDLE_PATH,
+		params={"handle": handle},
+		timeout=timeout,
+		tweet_id=handle,
+	)
+
+	try:
+		return blob["did"]
+	except (KeyError, TypeError) as e:
+		raise BlueskyError("Invalid handle resolution from the AppView") from e
+
+
+async def get_thread(*, session, actor, rkey, appview=DEFAULT_APPVIEW, timeout=10):
+	'''
+	Get the Thread ending at the post rkey by actor (a handle or a DID),
+	with all of its ancestors. Deleted or blocked ancestors become a
+	ThreadGap at the start of the thread. Threads longer than the AppView
+	will return are cut short, and marked as truncated.
+	'''
+	did = actor if actor.startswith("did:") else await resolve_handle(
+		session=session,
+		handle=actor,
+		appview=appview,
+		timeout=timeout,
+	)
+	uri = post_uri(did, rkey)
+
+	blob = await request_json(
+		session=session,
+		appview=appview,
+		path=POST_THREAD_PATH,
+		params={"uri": uri, "depth": "0", "parentHeight": str(MAX_PARENT_HEIGHT)},
+		timeout=timeout,
+		tweet_id=uri,
+	)
+
+	view = blob.get("thread") or {}
+	if view.get("notFound"):
+		raise NoSuchTweetError(uri)
+	elif "post" not in view:
+		raise BlueskyError("Unexpected thread from the AppView")
+
+	tweets = []
+	gaps = []
+	truncated = None
+
+	try:
+		while view is not None:
+			if view.get("notFound"):
+				gaps.append(ThreadGap(view.get("uri"), "deleted"))
+				break
+			elif "post" not in view:
+				# Blocked posts, and any kind we don't know
+				gaps.append(ThreadGap(view.get("uri"), "unavailable"))
+				break
+
+			tweet = tweet_from_json(view["post"])
+			tweets.append(tweet)
+			view = view.get("parent")
+
+			if view is None and tweet.parent_id is not None:
+				truncated = tweet.parent_id
+	except (KeyError, TypeError, ValueError) as e:
+		raise BlueskyError("Invalid post from the AppView") from e
+
+	tweets.reverse()
+	return Thread(tweets, gaps=gaps, truncated=truncated)
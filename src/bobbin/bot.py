@@ -0,0 +1,273 @@
+# A bot that unrolls threads on request. Someone replies to a thread with a
+# mention of the bot's account and the word "unroll", like
+#
+#     @bobbin unroll
+#
+# and the bot resolves the thread they replied to and replies with its
+# permalink on the site. Mentions are polled from the bot account's mentions
+# timeline every interval seconds, and replies are posted as that account,
+# so both need its user access token and secret (see posting.UserAuth).
+#
+# With direct_messages, it also answers direct messages with a link to a
+# tweet (or its id): it resolves the thread ending there and messages back its
+# permalink. That needs the app to have twitter's direct message permission.
+# Messages are polled too, rather than delivered by an Account Activity
+# webhook, which would need a registered environment and a public callback;
+# the message list only allows 15 requests every 15 minutes, so they're
+# checked at most once a minute, whatever the interval.
+#
+# Mentions and messages from before the bot started are ignored, so that a
+# restart doesn't answer the same requests twice; ones made while it was down
+# are missed.
+
+import asyncio
+import logging
+import re
+
+import aiohttp
+
+from bobbin import permalinks, posting
+from bobbin.optout import OptedOutError
+from bobbin.tweet_url import parse_tweet_id
+from bobbin.twitter import API_URL, Tweet, TwitterError
+
+logger = logging.getLogger(__name__)
+
+MENTIONS_URL = f"{API_URL}/statuses/mentions_timeline.json"
+DIRECT_MESSAGES_URL = f"{API_URL}/direct_messages/events/list.json"
+
+MAX_MENTIONS = 200
+MAX_DIRECT_MESSAGES = 50
+
+# The shortest time between checks of the direct message list, to stay
+# within its rate limit
+MIN_DIRECT_MESSAGE_INTERVAL = 60
+
+REQUEST_PATTERN = re.compile(r"\bunroll\b", re.IGNORECASE)
+
+
+def is_unroll_request(tweet, *, bot_id):
+	'''
+	Check if tweet is a reply asking the bot to unroll what it replies to
+	'''
+	return (
+		tweet.parent_id is not None and
+		tweet.user.id != bot_id and
+		REQUEST_PATTERN.search(tweet.text) is not None
+	)
+
+
+def find_tweet_id(message_data):
+	'''
+	Find the id of the first tweet linked in a direct message's
+	message_data, or a bare tweet id making up its whole text. Returns None if
+	there isn't one.
+	'''
+	for url in message_data.get("entities", {}).get("urls", ()):
+		tweet_id = parse_tweet_id(url.get("expanded_url") or "")
+		if tweet_id is not None:
+			return tweet_id
+
+	return parse_tweet_id(message_data.get("text", ""))
+
+
+class DirectMessage:
+	'''
+	An incoming direct message: its id, the sender's user id, and the id of
+	the tweet it links to, if any
+	'''
+	def __init__(self, id, sender_id, tweet_id):
+		self.id = id
+		self.sender_id = sender_id
+		self.tweet_id = tweet_id
+
+	@classmethod
+	def from_event_json(cls, event):
+		message = event["message_create"]
+		return cls(event["id"], message["sender_id"], find_tweet_id(message["message_data"]))
+
+
+class UnrollBot:
+	'''
+	Answers unroll requests (see is_unroll_request) from the mentions of
+	auth's account (a posting.UserAuth), using session, and, if
+	direct_messages, requests sent to it as direct messages. Threads are
+	resolved with get_thread, and their permalinks are under site_url.
+	'''
+	def __init__(self, session, get_thread, auth, *, site_url, interval=60, direct_messages=False):
+		self.session = session
+		self.get_thread = get_thread
+		self.auth = auth
+		self.site_url = site_url.rstrip("/")
+		self.interval = interval
+		self.direct_messages = direct_messages
+		self.task = None
+
+		# Like since_id and polled, for direct messages, which have no since
+		# parameter of their own
+		self.last_message_id = None
+		self.messages_polled = False
+		self.messages_checked_at = None
+
+		# The newest mention seen. Until the first poll, there's nothing to
+		# compare to, so nothing is answered.
+		self.since_id = None
+		self.polled = False
+
+	async def get_mentions(self):
+		params = {"count": str(MAX_MENTIONS), "tweet_mode": "extended"}
+		if self.since_id is not None:
+			params["since_id"] = self.since_id
+
+		result = await posting.request_json(
+			session=self.session,
+			auth=self.auth,
+			method="GET",
+			url=MENTIONS_URL,
+			params=params,
+		)
+		return [Tweet.from_tweet_json(blob) for blob in result]
+
+	async def answer(self, tweet):
+		try:
+			thread = await self.get_thread(tail=tweet.parent_id, head=None)
+		except asyncio.CancelledError:
+			raise
+		except OptedOutError:
+			# Opted out authors don't want their threads unrolled, or to
+			# hear about it
+			logger.info("Not unrolling %s for %s: opted out", tweet.parent_id, tweet.id)
+			return
+		except Exception:
+			logger.info("Couldn't unroll %s for %s", tweet.parent_id, tweet.id, exc_info=True)
+			return
+
+		url = self.site_url + permalinks.thread_permalink(thread)
+		try:
+			await posting.reply_to(
+				session=self.session,
+				auth=self.auth,
+				tweet_id=tweet.id,
+				text=f"Here's the thread: {url}",
+			)
+		except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError):
+			logger.warning("Couldn't reply to %s", tweet.id, exc_info=True)
+			return
+
+		logger.info("Unrolled %s for %s", thread.tail_id, tweet.id)
+
+	async def get_direct_messages(self):
+		result = await posting.request_json(
+			session=self.session,
+			auth=self.auth,
+			method="GET",
+			url=DIRECT_MESSAGES_URL,
+			params={"count": str(MAX_DIRECT_MESSAGES)},
+		)
+		return [
+			DirectMessage.from_event_json(event)
+			for event in result.get("events", ())
+			if event.get("type") == "message_create"
+		]
+
+	async def answer_message(self, message):
+		try:
+			thread = await self.get_thread(tail=message.tweet_id, head=None)
+		except asyncio.CancelledError:
+			raise
+		except OptedOutError:
+			logger.info("Not unrolling %s for message %s: opted out", message.tweet_id, message.id)
+			text = "Sorry, that thread's author has opted out of being unrolled."
+		except Exception:
+			logger.info("Couldn't unroll %s for message %s", message.tweet_id, message.id, exc_info=True)
+			text = "Sorry, I couldn't unroll that thread."
+		else:
+			text = f"Here's the thread: {self.site_url}{permalinks.thread_permalink(thread)}"
+
+		try:
+			await posting.send_direct_message(
+				session=self.session,
+				auth=self.auth,
+				recipient_id=message.sender_id,
+				text=text,
+			)
+		except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError):
+			logger.warning("Couldn't answer message %s", message.id, exc_info=True)
+			return
+
+		logger.info("Answered message %s about %s", message.id, message.tweet_id)
+
+	async def poll_direct_messages(self):
+		loop = asyncio.get_event_loop()
+		if (
+			self.messages_checked_at is not None and
+			loop.time() - self.messages_checked_at < MIN_DIRECT_MESSAGE_INTERVAL
+		):
+			return
+		self.messages_checked_at = loop.time()
+
+		messages = await self.get_direct_messages()
+		last_message_id = self.last_message_id
+		if messages:
+			self.last_message_id = max(messages, key=lambda message: int(message.id)).id
+
+		first_poll = not self.messages_polled
+		self.messages_polled = True
+		if first_poll:
+			return
+
+		requests = [
+			message for message in messages
+			if (last_message_id is None or int(message.id) > int(last_message_id)) and
+			message.sender_id != self.auth.user_id and
+			message.tweet_id is not None
+		]
+
+		requests.sort(key=lambda message: int(message.id))
+		for message in requests:
+			await self.answer_message(message)
+
+	async def poll(self):
+		mentions = await self.get_mentions()
+		if mentions:
+			self.since_id = max(mentions, key=lambda tweet: int(tweet.id)).id
+
+		first_poll = not self.polled
+		self.polled = True
+		if first_poll:
+			return
+
+		requests = [tweet for tweet in mentions if is_unroll_request(tweet, bot_id=self.auth.user_id)]
+
+		# Oldest first, so replies come in the order they were asked for
+		requests.sort(key=lambda tweet: int(tweet.id))
+		for tweet in requests:
+			await self.answer(tweet)
+
+	async def run(self):
+		while True:
+			try:
+				await self.poll()
+			except asyncio.CancelledError:
+				raise
+			except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError, ValueError, KeyError):
+				logger.exception("Couldn't check the bot's mentions")
+
+			if self.direct_messages:
+				try:
+					await self.poll_direct_messages()
+				except asyncio.CancelledError:
+					raise
+				except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError, ValueError, KeyError):
+					logger.exception("Couldn't check the bot's direct messages")
+
+			await asyncio.sleep(self.interval)
+
+	def start(self):
+		self.task = asyncio.ensure_future(self.run())
+
+	async def close(self):
+		if self.task is not None:
+			self.task.cancel()
+			await asyncio.gather(self.task, return_exceptions=True)
+			self.task = None
@@ -0,0 +1,133 @@
+# Callback notifications for API clients using the job queue. Rather than
+# polling a job until it finishes, clients can give a callback_url, and the
+# thread is POSTed there once it's resolved. Each callback is signed with an
+# HMAC of the body, in the X-Bobbin-Signature header, so that receivers can
+# check that it really came from us:
+#
+#     X-Bobbin-Signature: sha256=<hex digest of HMAC-SHA256(secret, body)>
+
+import asyncio
+import hashlib
+import hmac
+import ipaddress
+import logging
+import urllib.parse
+
+import aiohttp
+
+from bobbin.twitter import RetryPolicy
+
+logger = logging.getLogger(__name__)
+
+SIGNATURE_HEADER = "X-Bobbin-Signature"
+
+DEFAULT_CALLBACK_RETRY_POLICY = RetryPolicy(max_attempts=4, base_delay=1, max_delay=60)
+
+
+class InvalidCallbackError(ValueError):
+	pass
+
+
+def sign(secret, body):
+	digest = hmac.new(secret.encode(), body, hashlib.sha256).hexdigest()
+	return f"sha256={digest}"
+
+
+def validate_callback_url(url, *, allow_http=False):
+	'''
+	Check that url is reasonable to send a callback to, raising an
+	InvalidCallbackError if it isn't. Callbacks must use https (unless
+	allow_http is set), and can't be sent to IP addresses in private or
+	loopback ranges, so that clients can't use us to poke at our own network.
+	Hostnames aren't resolved, so this is a sanity check rather than a
+	guarantee; deployments that care should also restrict outbound traffic.
+	'''
+	try:
+		parsed = urllib.parse.urlsplit(url)
+	except ValueError as e:
+		raise InvalidCallbackError("Malformed url") from e
+
+	allowed_schemes = ("https", "http") if allow_http else ("https",)
+	if parsed.scheme not in allowed_schemes:
+		raise InvalidCallbackError("Callback url must use " + " or ".join(allowed_schemes))
+
+	host = parsed.hostname
+	if not host:
+		raise InvalidCallbackError("Callback url has no host")
+
+	if host == "localhost" or host.endswith(".localhost"):
+		raise InvalidCallbackError("Callback url can't be local")
+
+	try:
+		address = ipaddress.ip_address(host)
+	except ValueError:
+		return
+
+	if not address.is_global:
+		raise InvalidCallbackError("Callback url can't be a private address")
+
+
+class CallbackSender:
+	'''
+	Sends signed callbacks in the background. Failed deliveries (errors and
+	non-2xx responses) are retried according to retry_policy, then dropped.
+	'''
+	def __init__(
+		self,
+		session,
+		secret,
+		*,
+		timeout=10,
+		retry_policy=DEFAULT_CALLBACK_RETRY_POLICY,
+		allow_http=False,
+	):
+		self.session = session
+		self.secret = secret
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+		self.retry_policy = retry_policy
+		self.allow_http = allow_http
+		self.pending = set()
+
+	def validate(self, url):
+		validate_callback_url(url, allow_http=self.allow_http)
+
+	def send(self, url, body):
+		'''
+		Schedule body (a string of JSON) to be POSTed to url
+		'''
+		task = asyncio.ensure_future(self.deliver(url, body.encode()))
+		self.pending.add(task)
+		task.add_done_callback(self.pending.discard)
+		return task
+
+	async def deliver(self, url, body):
+		headers = {
+			"Content-Type": "application/json",
+			SIGNATURE_HEADER: sign(self.secret, body),
+		}
+
+		for attempt in range(self.retry_policy.max_attempts):
+			if attempt > 0:
+				await asyncio.sleep(self.retry_policy.backoff(attempt))
+
+			try:
+				async with self.session.post(
+					url,
+					data=body,
+					headers=headers,
+					timeout=self.timeout,
+					allow_redirects=False,
+				) as response:
+					if 200 <= response.status < 300:
+						return
+					logger.warning("Callback to %s got status %s", url, response.status)
+			except (aiohttp.ClientError, asyncio.TimeoutError) as e:
+				logger.warning("Callback to %s failed: %r", url, e)
+
+		logger.error("Giving up on callback to %s", url)
+
+	async def close(self):
+		for task in self.pending:
+			task.cancel()
+
+		await asyncio.gather(*self.pending, return_exceptions=True)
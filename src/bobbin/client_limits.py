@@ -0,0 +1,102 @@
+# Rate limiting of our own clients, by IP address, so that a scraper hitting
+# /thread or /api can't spend all of our twitter API budget. Each client gets
+# a token bucket: it holds at most burst tokens, refills at a steady rate, and
+# every request takes one. Requests when the bucket is empty get a 429.
+#
+# Clients are identified by request.remote, which, behind reverse proxies,
+# comes from X-Forwarded-For (see bobbin.proxy). IPv6 clients are identified
+# by their /64, since a single host is usually handed a whole /64 and can
+# pick a new address from it for every request.
+
+import functools
+import ipaddress
+import math
+import time
+
+from aiohttp import web
+import cachetools
+
+from bobbin import web_util
+
+
+class TokenBucket:
+	__slots__ = ('tokens', 'updated')
+
+	def __init__(self, tokens, updated):
+		self.tokens = tokens
+		self.updated = updated
+
+	def __repr__(self):
+		return f"TokenBucket(tokens={self.tokens}, updated={self.updated})"
+
+
+class ClientRateLimiter:
+	'''
+	Per client token buckets. rate is in requests per second. Only the
+	max_clients most recently seen clients are tracked; a client that's
+	forgotten starts again with a full bucket, which is what they'd have by
+	then anyway.
+	'''
+	def __init__(self, *, rate, burst, max_clients=100000, clock=time.monotonic):
+		self.rate = rate
+		self.burst = burst
+		self.clock = clock
+		self.buckets = cachetools.LRUCache(max_clients)
+
+	def acquire(self, client):
+		'''
+		Take a token from client's bucket. Returns None if there was one, or
+		else the number of seconds until there will be.
+		'''
+		now = self.clock()
+		bucket = self.buckets.get(client)
+
+		if bucket is None:
+			bucket = self.buckets[client] = TokenBucket(self.burst, now)
+		else:
+			bucket.tokens = min(self.burst, bucket.tokens + (now - bucket.updated) * self.rate)
+			bucket.updated = now
+
+		if bucket.tokens < 1:
+			return (1 - bucket.tokens) / self.rate
+
+		bucket.tokens -= 1
+		return None
+
+
+def client_key(request):
+	'''
+	Get what identifies the client making request, for rate limiting
+	'''
+	try:
+		address = ipaddress.ip_address(request.remote)
+	except ValueError:
+		return request.remote
+
+	if address.version == 6:
+		if address.ipv4_mapped is not None:
+			return str(address.ipv4_mapped)
+		return str(ipaddress.ip_network((address, 64), strict=False))
+	return str(address)
+
+
+def rate_limited(handler):
+	'''
+	Apply the client_limiter from the context (a ClientRateLimiter, or None
+	for no limit) to handler
+	'''
+	@functools.wraps(handler)
+	async def rate_limited_wrapper(request, *, client_limiter, **kwargs):
+		if client_limiter is not None:
+			retry_after = client_limiter.acquire(client_key(request))
+			if retry_after is not None:
+				retry_after = math.ceil(retry_after)
+				raise web.HTTPTooManyRequests(
+					text=web_util.dump_json(error="Too many requests", retry_after=retry_after),
+					content_type="application/json",
+					headers={"Retry-After": str(retry_after)},
+				)
+
+		return await handler(request, **kwargs)
+
+	return rate_limited_wrapper
@@ -0,0 +1,595 @@
+# Configuration for bobbin. Settings come from, in increasing order of
+# precedence: the defaults here, a config file, environment variables, and
+# command line flags. The config file is INI style, with all the settings in
+# a [bobbin] section:
+#
+#     [bobbin]
+#     key = ...
+#     secret = ...
+#     cache_size = 512MB
+#
+# or, if its name ends with .toml, TOML, with the same section and names:
+#
+#     [bobbin]
+#     key = "..."
+#     secret = "..."
+#     cache_size = "512MB"
+#     cache_ttl = 3600
+#     accounts = true
+#     opt_out_handles = ["someone", "someone_else"]
+#
+# TOML values are read as if they'd been written in the INI file, so lists
+# are the same as comma separated values. Reading TOML before python 3.11
+# needs tomli, which is optional:
+#
+#     pip install bobbin[toml]
+#
+# Every setting can also be set with a BOBBIN_<NAME> environment variable,
+# like BOBBIN_CACHE_SIZE. A few have older names that are still accepted.
+
+from collections import namedtuple
+import configparser
+import os
+from urllib.parse import urlsplit
+import pathlib
+import re
+
+from bobbin.optout import HANDLE_PATTERN
+from bobbin.transport import PROXY_SCHEMES
+
+try:
+	import tomllib
+except ImportError:
+	try:
+		import tomli as tomllib
+	except ImportError:
+		tomllib = None
+
+# The value of a per-backend proxy setting that means no proxy
+DIRECT = "direct"
+
+
+class ConfigError(Exception):
+	pass
+
+
+def parse_bool(value):
+	if isinstance(value, bool):
+		return value
+
+	lowered = value.strip().lower()
+	if lowered in ("1", "true", "yes", "on"):
+		return True
+	elif lowered in ("0", "false", "no", "off"):
+		return False
+	else:
+		raise ValueError(value)
+
+
+def parse_optional_str(value):
+	return value if value else None
+
+
+def parse_list(value):
+	if isinstance(value, tuple):
+		return value
+	return tuple(item.strip() for item in value.split(",") if item.strip())
+
+
+def parse_size(size):
+	if isinstance(size, int):
+		return size
+	elif size.endswith("KB"):
+		return int(size[:-2]) * 1024
+	elif size.endswith("MB"):
+		return int(size[:-2]) * 1024 * 1024
+	elif size.endswith("GB"):
+		return int(size[:-2]) * 1024 * 1024 * 1024
+	elif size.endswith("B"):
+		return int(size[:-1])
+	else:
+		return int(size)
+
+
+def check_proxy(config, name):
+	'''
+	Check a proxy url setting. The per-backend ones can also be "direct", to
+	not use the proxy setting.
+	'''
+	value = getattr(config, name)
+	if value is None or (value == DIRECT and name != "proxy"):
+		return
+
+	try:
+		parsed = urlsplit(value)
+		parsed.port
+	except ValueError:
+		raise ConfigError(f"{name} isn't a valid url") from None
+
+	if parsed.scheme not in PROXY_SCHEMES or not parsed.hostname:
+		raise ConfigError("{} must be a {} url".format(name, ", ".join(f"{scheme}://" for scheme in PROXY_SCHEMES)))
+
+
+class Setting(namedtuple("Setting", "name parse default legacy_env")):
+	__slots__ = ()
+
+	@property
+	def env(self):
+		return ("BOBBIN_" + self.name.upper(),) + self.legacy_env
+
+
+SETTINGS = (
+	Setting("key", parse_optional_str, None, ("CONSUMER_KEY",)),
+	Setting("secret", parse_optional_str, None, ("CONSUMER_SECRET",)),
+	Setting("host", str, "0.0.0.0", ()),
+	Setting("port", int, 8080, ()),
+	Setting("tls_cert", parse_optional_str, None, ()),
+	Setting("tls_key", parse_optional_str, None, ()),
+	Setting("tls_port", int, 8443, ()),
+	Setting("acme_dir", parse_optional_str, None, ()),
+	Setting("grpc_port", int, 0, ()),
+	Setting("static_dir", pathlib.Path, pathlib.Path("./static"), ()),
+	Setting("theme_dir", parse_optional_str, None, ()),
+	Setting("reload_theme", parse_bool, False, ()),
+	Setting("cache_size", parse_size, parse_size("256MB"), ()),
+	Setting("cache_ttl", float, 0, ()),
+	Setting("user_cache_ttl", float, 3600, ()),
+	Setting("response_cache_size", parse_size, parse_size("32MB"), ()),
+	Setting("response_cache_ttl", float, 0, ()),
+	Setting("http_cache_size", parse_size, 0, ()),
+	Setting("revalidate", parse_bool, False, ()),
+	Setting("api_version", int, 1, ()),
+	Setting("max_attempts", int, 3, ()),
+	Setting("api_max_connections", int, 100, ()),
+	Setting("api_max_connections_per_host", int, 32, ()),
+	Setting("api_keepalive", float, 30, ()),
+	Setting("api_connect_timeout", float, 10, ()),
+	Setting("api_read_timeout", float, 30, ()),
+	Setting("proxy", parse_optional_str, None, ()),
+	Setting("resolve_quotes", parse_bool, False, ()),
+	Setting("forward", parse_bool, False, ()),
+	Setting("conversation_search", parse_bool, False, ()),
+	Setting("stream_authors", parse_list, (), ()),
+	Setting("stream_conversations", parse_list, (), ()),
+	Setting("bot_token", parse_optional_str, None, ()),
+	Setting("bot_token_secret", parse_optional_str, None, ()),
+	Setting("bot_site_url", parse_optional_str, None, ()),
+	Setting("bot_interval", float, 60, ()),
+	Setting("bot_direct_messages", parse_bool, False, ()),
+	Setting("batch_window", float, 0.005, ()),
+	Setting("max_resolve_time", float, 0, ()),
+	Setting("max_api_calls", int, 0, ()),
+	Setting("job_workers", int, 0, ()),
+	Setting("job_wait", float, 5, ()),
+	Setting("max_queued_jobs", int, 1000, ()),
+	Setting("max_resolutions", int, 0, ()),
+	Setting("max_waiting_resolutions", int, 10, ()),
+	Setting("callback_secret", parse_optional_str, None, ()),
+	Setting("allow_indexing", parse_bool, True, ()),
+	Setting("show_metrics", parse_bool, True, ()),
+	Setting("static_homepage", parse_bool, False, ()),
+	Setting("view_dedup_window", float, 30 * 60, ()),
+	Setting("trending_interval", float, 300, ()),
+	Setting("recrawl_interval", float, 0, ()),
+	Setting("live_interval", float, 0, ()),
+	Setting("live_max_threads", int, 100, ()),
+	Setting("opt_out_file", parse_optional_str, None, ()),
+	Setting("admin_token", parse_optional_str, None, ()),
+	Setting("client_rate_limit", float, 0, ()),
+	Setting("client_burst", int, 30, ()),
+	Setting("trusted_proxies", int, 0, ()),
+	Setting("base_path", str, "", ()),
+	Setting("require_api_keys", parse_bool, False, ()),
+	Setting("accounts", parse_bool, False, ()),
+	Setting("twitter_client_id", parse_optional_str, None, ()),
+	Setting("twitter_client_secret", parse_optional_str, None, ()),
+	Setting("max_replies", int, 0, ()),
+	Setting("expand_links", parse_bool, False, ()),
+	Setting("shortener_hosts", parse_list, parse_list("bit.ly,buff.ly,ow.ly,tinyurl.com,dlvr.it,ift.tt,trib.al,lnkd.in,fb.me"), ()),
+	Setting("link_timeout", float, 5, ()),
+	Setting("link_cards", parse_bool, False, ()),
+	Setting("card_timeout", float, 5, ()),
+	Setting("card_max_bytes", parse_size, parse_size("512KB"), ()),
+	Setting("share_images", parse_bool, False, ()),
+	Setting("graphql", parse_bool, False, ()),
+	Setting("tracing", parse_bool, False, ()),
+	Setting("discord_public_key", parse_optional_str, None, ()),
+	Setting("slack_signing_secret", parse_optional_str, None, ()),
+	Setting("slack_bot_token", parse_optional_str, None, ()),
+	Setting("smtp_host", parse_optional_str, None, ()),
+	Setting("smtp_port", int, 587, ()),
+	Setting("smtp_username", parse_optional_str, None, ()),
+	Setting("smtp_password", parse_optional_str, None, ()),
+	Setting("smtp_ssl", parse_bool, False, ()),
+	Setting("email_from", parse_optional_str, None, ()),
+	Setting("email_secret", parse_optional_str, None, ()),
+	Setting("pocket_consumer_key", parse_optional_str, None, ()),
+	Setting("instapaper_key", parse_optional_str, None, ()),
+	Setting("instapaper_secret", parse_optional_str, None, ()),
+	Setting("readwise", parse_bool, False, ()),
+	Setting("mirror_media", parse_bool, False, ()),
+	Setting("media_url", parse_optional_str, None, ()),
+	Setting("media_max_bytes", parse_size, parse_size("50MB"), ()),
+	Setting("media_timeout", float, 60, ()),
+	Setting("image_proxy_secret", parse_optional_str, None, ()),
+	Setting("image_url", parse_optional_str, None, ()),
+	Setting("image_max_bytes", parse_size, parse_size("20MB"), ()),
+	Setting("image_timeout", float, 10, ()),
+	Setting("mastodon", parse_bool, False, ()),
+	Setting("mastodon_timeout", float, 10, ()),
+	Setting("bluesky", parse_bool, False, ()),
+	Setting("bluesky_appview", str, "https://public.api.bsky.app", ()),
+	Setting("bluesky_timeout", float, 10, ()),
+	Setting("mastodon_proxy", parse_optional_str, None, ()),
+	Setting("bluesky_proxy", parse_optional_str, None, ()),
+	Setting("nitter_url", parse_optional_str, None, ()),
+	Setting("nitter_timeout", float, 10, ()),
+	Setting("share_image_font", str, "DejaVuSans.ttf", ()),
+	Setting("pdf_export", parse_bool, False, ()),
+	Setting("pdf_font", str, "DejaVuSans.ttf", ()),
+	Setting("database", parse_optional_str, None, ("DATABASE_PATH",)),
+	Setting("blob_store", parse_optional_str, None, ()),
+	Setting("s3_endpoint", str, "https://s3.amazonaws.com", ()),
+	Setting("s3_region", str, "us-east-1", ()),
+	Setting("s3_access_key", parse_optional_str, None, ("AWS_ACCESS_KEY_ID",)),
+	Setting("s3_secret_key", parse_optional_str, None, ("AWS_SECRET_ACCESS_KEY",)),
+	Setting("token_file", parse_optional_str, None, ("TOKEN_FILE",)),
+	Setting("invalidate_tokens", parse_bool, False, ()),
+	Setting("request_timeout", float, 60, ()),
+	Setting("grace_period", float, 10, ()),
+	Setting("record_dir", parse_optional_str, None, ()),
+	Setting("replay_dir", parse_optional_str, None, ()),
+)
+
+
+class Config(namedtuple("Config", [setting.name for setting in SETTINGS])):
+	__slots__ = ()
+
+	@property
+	def credentials(self):
+		'''
+		The (key, secret) pairs for all the configured apps. Several apps'
+		credentials can be given as comma separated lists. Without any, tweets
+		are scraped from nitter_url instead.
+		'''
+		if self.key is None or self.secret is None:
+			return []
+
+		return list(zip(self.key.split(","), self.secret.split(",")))
+
+
+def parse_setting(setting, value, source):
+	try:
+		return setting.parse(value)
+	except (ValueError, TypeError) as e:
+		raise ConfigError(f"Invalid value for {setting.name} from {source}: {value!r}") from e
+
+
+def toml_available():
+	return tomllib is not None
+
+
+def is_toml(path):
+	return pathlib.Path(path).suffix.lower() == ".toml"
+
+
+def toml_value(value):
+	'''
+	Get a TOML value as the string it would be in the INI file, so that
+	settings are parsed the same way from either
+	'''
+	if isinstance(value, bool):
+		return "true" if value else "false"
+	elif isinstance(value, (int, float, str)):
+		return str(value)
+	elif isinstance(value, list):
+		return ",".join(map(toml_value, value))
+	else:
+		raise ValueError(value)
+
+
+def read_toml_file(path):
+	if tomllib is None:
+		raise ConfigError(f"Reading {path} requires tomli (pip install bobbin[toml]), or python 3.11")
+
+	try:
+		with open(path, "rb") as f:
+			document = tomllib.load(f)
+	except OSError as e:
+		raise ConfigError(f"Couldn't read config file {path}: {e}") from e
+	except tomllib.TOMLDecodeError as e:
+		raise ConfigError(f"Invalid config file {path}: {e}") from e
+
+	section = document.get("bobbin", {})
+	if not isinstance(section, dict):
+		raise ConfigError(f"Invalid config file {path}: bobbin should be a table")
+
+	values = {}
+	for name, value in section.items():
+		try:
+			values[name] = toml_value(value)
+		except ValueError as e:
+			raise ConfigError(f"Invalid value for {name} from {path}: {value!r}") from e
+
+	return values
+
+
+def read_ini_file(path):
+	parser = configparser.ConfigParser(interpolation=None)
+
+	try:
+		with open(path) as f:
+			parser.read_file(f)
+	except OSError as e:
+		raise ConfigError(f"Couldn't read config file {path}: {e}") from e
+	except configparser.Error as e:
+		raise ConfigError(f"Invalid config file {path}: {e}") from e
+
+	if not parser.has_section("bobbin"):
+		return {}
+
+	return dict(parser.items("bobbin"))
+
+
+def read_file(path):
+	values = read_toml_file(path) if is_toml(path) else read_ini_file(path)
+
+	known = {setting.name for setting in SETTINGS}
+	for name in values:
+		if name not in known:
+			raise ConfigError(f"Unknown setting in {path}: {name}")
+
+	return values
+
+
+def is_http_url(url):
+	return url is not None and url.startswith(("http://", "https://"))
+
+
+def validate(config):
+	'''
+	Check the settings for problems that aren't just unparsable values,
+	raising a ConfigError describing the first one found.
+	'''
+	if config.key is None and config.secret is None:
+		if config.nitter_url is None:
+			raise ConfigError("Missing key and secret (--key and --secret, or CONSUMER_KEY and CONSUMER_SECRET), or a nitter_url to use without them")
+	elif config.key is None:
+		raise ConfigError("Missing key (--key or CONSUMER_KEY)")
+	elif config.secret is None:
+		raise ConfigError("Missing secret (--secret or CONSUMER_SECRET)")
+	elif len(config.key.split(",")) != len(config.secret.split(",")):
+		raise ConfigError("key and secret must have the same number of credentials")
+
+	if config.nitter_url is not None and not config.nitter_url.startswith(("http://", "https://")):
+		raise ConfigError("nitter_url must be an http or https url")
+
+	if config.nitter_url is not None and config.nitter_timeout <= 0:
+		raise ConfigError("nitter_timeout must be positive")
+
+	# These all need the official API
+	if not config.credentials:
+		if config.conversation_search or config.max_replies > 0:
+			raise ConfigError("conversation_search and max_replies require a key and secret")
+
+		if config.accounts and config.twitter_client_id is None:
+			raise ConfigError("accounts requires a key and secret, or twitter_client_id, to sign in with")
+
+		if config.stream_authors or config.stream_conversations:
+			raise ConfigError("stream_authors and stream_conversations require a key and secret")
+
+		if config.bot_token is not None:
+			raise ConfigError("bot_token requires a key and secret")
+
+		if config.record_dir is not None or config.replay_dir is not None:
+			raise ConfigError("record_dir and replay_dir require a key and secret")
+
+	if config.api_version not in (1, 2):
+		raise ConfigError("api_version must be 1 or 2")
+
+	if config.conversation_search and config.api_version != 2:
+		raise ConfigError("conversation_search requires api_version 2")
+
+	if config.max_replies > 0 and config.api_version != 2:
+		raise ConfigError("max_replies requires api_version 2")
+
+	if config.stream_authors or config.stream_conversations:
+		if config.api_version != 2:
+			raise ConfigError("stream_authors and stream_conversations require api_version 2")
+
+		if config.database is None:
+			raise ConfigError("stream_authors and stream_conversations require a database")
+
+		if not all(HANDLE_PATTERN.match(author) or author.isdigit() for author in config.stream_authors):
+			raise ConfigError("stream_authors must be handles or user ids")
+
+		if not all(conversation.isdigit() for conversation in config.stream_conversations):
+			raise ConfigError("stream_conversations must be tweet ids")
+
+	if config.max_attempts < 1:
+		raise ConfigError("max_attempts must be at least 1")
+
+	if config.api_max_connections < 1:
+		raise ConfigError("api_max_connections must be at least 1")
+
+	if config.api_max_connections_per_host < 0:
+		raise ConfigError("api_max_connections_per_host can't be negative")
+
+	if config.api_keepalive < 0:
+		raise ConfigError("api_keepalive can't be negative")
+
+	if config.api_connect_timeout <= 0 or config.api_read_timeout <= 0:
+		raise ConfigError("api_connect_timeout and api_read_timeout must be positive")
+
+	for name in ("proxy", "mastodon_proxy", "bluesky_proxy"):
+		check_proxy(config, name)
+
+	if config.max_resolutions < 0 or config.max_waiting_resolutions < 0:
+		raise ConfigError("max_resolutions and max_waiting_resolutions can't be negative")
+
+	if config.job_workers < 0:
+		raise ConfigError("job_workers can't be negative")
+
+	if config.callback_secret is not None and config.job_workers == 0 and config.recrawl_interval == 0:
+		raise ConfigError("callback_secret requires job_workers or recrawl_interval")
+
+	if config.client_rate_limit < 0:
+		raise ConfigError("client_rate_limit can't be negative")
+
+	if config.client_rate_limit > 0 and config.client_burst < 1:
+		raise ConfigError("client_burst must be at least 1")
+
+	if config.expand_links and config.link_timeout <= 0:
+		raise ConfigError("link_timeout must be positive")
+
+	if config.link_cards and (config.card_timeout <= 0 or config.card_max_bytes <= 0):
+		raise ConfigError("card_timeout and card_max_bytes must be positive")
+
+	if config.view_dedup_window < 0:
+		raise ConfigError("view_dedup_window can't be negative")
+
+	if config.trending_interval <= 0:
+		raise ConfigError("trending_interval must be positive")
+
+	if config.recrawl_interval < 0:
+		raise ConfigError("recrawl_interval can't be negative")
+
+	if (config.bot_token is None) != (config.bot_token_secret is None):
+		raise ConfigError("bot_token and bot_token_secret must be given together")
+
+	if config.bot_token is not None:
+		if config.bot_site_url is None or not config.bot_site_url.startswith(("http://", "https://")):
+			raise ConfigError("bot_token requires bot_site_url, the site's public http or https url")
+
+		if config.bot_interval <= 0:
+			raise ConfigError("bot_interval must be positive")
+	elif config.bot_direct_messages:
+		raise ConfigError("bot_direct_messages requires bot_token and bot_token_secret")
+
+	if config.live_interval < 0:
+		raise ConfigError("live_interval can't be negative")
+
+	if config.live_interval > 0 and config.live_max_threads <= 0:
+		raise ConfigError("live_max_threads must be positive")
+
+	if config.recrawl_interval > 0 and config.database is None:
+		raise ConfigError("recrawl_interval requires a database")
+
+	if config.trusted_proxies < 0:
+		raise ConfigError("trusted_proxies can't be negative")
+
+	if (config.tls_cert is None) != (config.tls_key is None):
+		raise ConfigError("tls_cert and tls_key must be given together")
+
+	if config.tls_cert is not None and config.tls_port == config.port:
+		raise ConfigError("tls_port must be different from port")
+
+	if config.grpc_port and (config.grpc_port == config.port or (config.tls_cert is not None and config.grpc_port == config.tls_port)):
+		raise ConfigError("grpc_port must be different from port and tls_port")
+
+	if config.require_api_keys and config.database is None:
+		raise ConfigError("require_api_keys requires a database")
+
+	if config.blob_store is not None and config.blob_store.startswith("s3://"):
+		if not config.blob_store[len("s3://"):].strip("/"):
+			raise ConfigError("blob_store needs a bucket, like s3://bucket")
+
+		if config.s3_access_key is None or config.s3_secret_key is None:
+			raise ConfigError("An s3:// blob_store requires s3_access_key and s3_secret_key")
+
+	if config.mirror_media and config.blob_store is None:
+		raise ConfigError("mirror_media requires a blob_store")
+
+	if config.mirror_media and (config.media_timeout <= 0 or config.media_max_bytes <= 0):
+		raise ConfigError("media_timeout and media_max_bytes must be positive")
+
+	if config.media_url is not None and not config.mirror_media:
+		raise ConfigError("media_url requires mirror_media")
+
+	# Thread media urls end up in share cards, chat embeds, exports and PDFs,
+	# none of which are on the site, so they have to be absolute
+	if config.mirror_media and not is_http_url(config.media_url):
+		raise ConfigError("mirror_media requires media_url, the public http or https url of the site's /media")
+
+	if config.image_proxy_secret is not None and (config.image_timeout <= 0 or config.image_max_bytes <= 0):
+		raise ConfigError("image_timeout and image_max_bytes must be positive")
+
+	if config.image_url is not None and config.image_proxy_secret is None:
+		raise ConfigError("image_url requires image_proxy_secret")
+
+	if config.image_proxy_secret is not None and not is_http_url(config.image_url):
+		raise ConfigError("image_proxy_secret requires image_url, the public http or https url of the site's /img")
+
+	if config.discord_public_key is not None and not re.fullmatch(r"[0-9a-fA-F]{64}", config.discord_public_key):
+		raise ConfigError("discord_public_key must be the application's public key, in hex")
+
+	if (config.slack_signing_secret is None) != (config.slack_bot_token is None):
+		raise ConfigError("slack_signing_secret and slack_bot_token must be given together")
+
+	if config.smtp_host is not None:
+		if config.email_from is None or "@" not in config.email_from:
+			raise ConfigError("smtp_host requires email_from, the address threads are sent from")
+
+		if config.email_secret is None:
+			raise ConfigError("smtp_host requires email_secret, for signing confirmation links")
+
+		if (config.smtp_username is None) != (config.smtp_password is None):
+			raise ConfigError("smtp_username and smtp_password must be given together")
+	elif config.email_from is not None or config.email_secret is not None:
+		raise ConfigError("email_from and email_secret require smtp_host")
+
+	if config.mastodon and config.mastodon_timeout <= 0:
+		raise ConfigError("mastodon_timeout must be positive")
+
+	if config.bluesky and config.bluesky_timeout <= 0:
+		raise ConfigError("bluesky_timeout must be positive")
+
+	if config.accounts and config.database is None:
+		raise ConfigError("accounts requires a database")
+
+	if config.twitter_client_id is not None and not config.accounts:
+		raise ConfigError("twitter_client_id requires accounts, to sign in with")
+
+	if config.twitter_client_secret is not None and config.twitter_client_id is None:
+		raise ConfigError("twitter_client_secret requires twitter_client_id")
+
+	if (config.instapaper_key is None) != (config.instapaper_secret is None):
+		raise ConfigError("instapaper_key and instapaper_secret must be given together")
+
+	if not config.accounts and (config.pocket_consumer_key is not None or config.instapaper_key is not None or config.readwise):
+		raise ConfigError("pocket_consumer_key, instapaper_key, and readwise require accounts, to keep users' credentials")
+
+	if config.require_api_keys and config.admin_token is None:
+		raise ConfigError("require_api_keys requires an admin_token, to issue keys")
+
+	if config.record_dir is not None and config.replay_dir is not None:
+		raise ConfigError("record_dir and replay_dir can't both be set")
+
+
+def load(*, path=None, environ=os.environ, overrides=None, check=True):
+	'''
+	Load and validate the Config. path is an optional config file, and
+	overrides is a dict of settings (usually from command line flags) that
+	take precedence over everything else; None values in it are ignored.
+	Tools that only need a few of the settings can skip validation with
+	check=False.
+	'''
+	values = {setting.name: setting.default for setting in SETTINGS}
+	file_values = read_file(path) if path is not None else {}
+	overrides = overrides or {}
+
+	for setting in SETTINGS:
+		if setting.name in file_values:
+			values[setting.name] = parse_setting(setting, file_values[setting.name], path)
+
+		for env in reversed(setting.env):
+			if env in environ:
+				values[setting.name] = parse_setting(setting, environ[env], env)
+
+		if overrides.get(setting.name) is not None:
+			values[setting.name] = parse_setting(setting, overrides[setting.name], "flags")
+
+	config = Config(**values)
+	if check:
+		validate(config)
+	return config
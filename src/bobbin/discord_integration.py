@@ -0,0 +1,226 @@
+# A Discord integration: an /unroll slash command that takes a tweet link and
+# answers with an embed summarizing the thread, linking to its page here.
+# Discord sends commands to an interactions endpoint, /integrations/discord,
+# which is set as the application's Interactions Endpoint URL in Discord's
+# developer portal. Each interaction is signed with the application's
+# Ed25519 key, and discord_public_key is its public half.
+#
+# The command itself has to be registered with Discord once, with the
+# application's bot token, by PUTting [COMMAND] to
+#
+#     https://discord.com/api/v10/applications/<application id>/commands
+#
+# Discord gives up on interactions that aren't answered within 3 seconds, so
+# threads that take longer than DEFER_AFTER to resolve are answered with a
+# deferral ("bobbin is thinking..."), and the embed is edited into the
+# original response once the thread is ready.
+#
+# This needs PyNaCl, for checking signatures, which is optional:
+#
+#     pip install bobbin[discord]
+
+import asyncio
+import json
+import logging
+
+from aiohttp import web
+import aiohttp
+
+from bobbin import permalinks, render, web_util
+from bobbin.optout import OptedOutError
+from bobbin.tweet_url import parse_tweet_id
+from bobbin.twitter import UnavailableTweetError
+
+try:
+	from nacl.exceptions import BadSignatureError
+	from nacl.signing import VerifyKey
+except ImportError:
+	VerifyKey = None
+
+logger = logging.getLogger(__name__)
+
+API_URL = "https://discord.com/api/v10"
+
+SIGNATURE_HEADER = "X-Signature-Ed25519"
+TIMESTAMP_HEADER = "X-Signature-Timestamp"
+
+# Interaction types
+PING = 1
+APPLICATION_COMMAND = 2
+
+# Interaction response types
+PONG = 1
+CHANNEL_MESSAGE = 4
+DEFERRED_CHANNEL_MESSAGE = 5
+
+# Message flag for replies only the person who used the command can see
+EPHEMERAL = 1 << 6
+
+COMMAND = {
+	"name": "unroll",
+	"description": "Unroll a twitter thread",
+	"options": [{
+		"type": 3,
+		"name": "url",
+		"description": "A link to the last tweet of the thread",
+		"required": True,
+	}],
+}
+
+# How long to wait for a thread before deferring the response
+DEFER_AFTER = 2
+
+# Twitter's blue, for the embed's sidebar
+EMBED_COLOR = 0x1DA1F2
+
+MAX_SUMMARY_LENGTH = 300
+
+
+def available():
+	return VerifyKey is not None
+
+
+def thread_embed(thread, *, site_url):
+	'''
+	The embed summarizing thread for a Discord message
+	'''
+	first_tweet = thread[0]
+	embed = {
+		"title": render.thread_title(thread),
+		"url": site_url + permalinks.thread_permalink(thread),
+		"description": render.thread_summary(thread, max_length=MAX_SUMMARY_LENGTH),
+		"color": EMBED_COLOR,
+		"timestamp": first_tweet.created_at.isoformat(),
+		"footer": {"text": "1 tweet" if len(thread) == 1 else f"{len(thread)} tweets"},
+	}
+
+	if thread.author is not None:
+		embed["author"] = {"name": f"{thread.author.name} (@{thread.author.handle})"}
+		if thread.author.avatar_url:
+			embed["author"]["icon_url"] = thread.author.avatar_url
+
+	image = next((media.media_url for tweet in thread for media in tweet.entities.media if media.media_url), None)
+	if image is not None:
+		embed["thumbnail"] = {"url": image}
+
+	return embed
+
+
+def error_message(text):
+	return {"content": text, "flags": EPHEMERAL}
+
+
+class DiscordIntegration:
+	'''
+	Answers Discord interactions signed with public_key (the application's
+	public key, in hex). session is used to edit deferred responses.
+	'''
+	def __init__(self, session, public_key):
+		self.session = session
+		self.verify_key = VerifyKey(bytes.fromhex(public_key))
+
+		# Deferred responses still being worked on
+		self.pending = set()
+
+	def is_valid(self, *, signature, timestamp, body):
+		try:
+			self.verify_key.verify(timestamp.encode() + body, bytes.fromhex(signature))
+		except (BadSignatureError, ValueError):
+			return False
+		return True
+
+	async def unroll_message(self, tweet_id, *, get_thread, site_url):
+		'''
+		Get the message answering an /unroll of tweet_id
+		'''
+		try:
+			thread = await get_thread(tail=tweet_id, head=None)
+		except asyncio.CancelledError:
+			raise
+		except UnavailableTweetError as e:
+			return error_message(f"That tweet is {e.reason}.")
+		except OptedOutError:
+			return error_message("That thread's author has opted out of being unrolled.")
+		except Exception:
+			logger.info("Couldn't unroll %s for Discord", tweet_id, exc_info=True)
+			return error_message("Sorry, that thread couldn't be unrolled. Try again later.")
+
+		return {"embeds": [thread_embed(thread, site_url=site_url)]}
+
+	async def edit_original(self, interaction, message):
+		url = f"{API_URL}/webhooks/{interaction['application_id']}/{interaction['token']}/messages/@original"
+		try:
+			async with self.session.patch(url, json=message) as response:
+				response.raise_for_status()
+		except (aiohttp.ClientError, asyncio.TimeoutError):
+			logger.warning("Couldn't edit Discord response", exc_info=True)
+
+	async def finish_deferred(self, interaction, unrolling):
+		await self.edit_original(interaction, await unrolling)
+
+	async def answer(self, interaction, *, get_thread, site_url):
+		'''
+		Get the response to a command interaction
+		'''
+		data = interaction.get("data", {})
+		if data.get("name") != COMMAND["name"]:
+			return {"type": CHANNEL_MESSAGE, "data": error_message("Unknown command.")}
+
+		options = {option.get("name"): option.get("value") for option in data.get("options", ())}
+		tweet_id = parse_tweet_id(str(options.get("url", "")))
+		if tweet_id is None:
+			return {"type": CHANNEL_MESSAGE, "data": error_message("That isn't a link to a tweet.")}
+
+		unrolling = asyncio.ensure_future(self.unroll_message(tweet_id, get_thread=get_thread, site_url=site_url))
+		try:
+			message = await asyncio.wait_for(asyncio.shield(unrolling), DEFER_AFTER)
+		except asyncio.TimeoutError:
+			task = asyncio.ensure_future(self.finish_deferred(interaction, unrolling))
+			self.pending.add(task)
+			task.add_done_callback(self.pending.discard)
+			return {"type": DEFERRED_CHANNEL_MESSAGE}
+		except asyncio.CancelledError:
+			unrolling.cancel()
+			raise
+
+		return {"type": CHANNEL_MESSAGE, "data": message}
+
+	async def close(self):
+		tasks = list(self.pending)
+		for task in tasks:
+			task.cancel()
+		await asyncio.gather(*tasks, return_exceptions=True)
+
+
+@web_util.method_handler('POST')
+async def handler(request, *, discord, get_thread):
+	'''
+	Answer a Discord interaction
+	'''
+	if discord is None:
+		raise web_util.not_found_json("Discord isn't enabled on this server")
+
+	body = await request.read()
+	if not discord.is_valid(
+		signature=request.headers.get(SIGNATURE_HEADER, ""),
+		timestamp=request.headers.get(TIMESTAMP_HEADER, ""),
+		body=body,
+	):
+		raise web_util.error_json(web.HTTPUnauthorized, "Invalid request signature")
+
+	try:
+		interaction = json.loads(body)
+	except ValueError:
+		raise web_util.bad_request_json("Invalid JSON body") from None
+
+	if not isinstance(interaction, dict):
+		raise web_util.bad_request_json("Body must be a JSON object")
+
+	if interaction.get("type") == PING:
+		response = {"type": PONG}
+	elif interaction.get("type") == APPLICATION_COMMAND:
+		response = await discord.answer(interaction, get_thread=get_thread, site_url=web_util.site_url(request))
+	else:
+		raise web_util.bad_request_json("Unsupported interaction type")
+
+	return web.Response(text=web_util.dump_json(**response), content_type="application/json")
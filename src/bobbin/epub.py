@@ -0,0 +1,100 @@
+# Threads as EPUB 3 books, for e-readers (see mailer, which sends them to
+# Kindles). The book is a single chapter with the thread's text, one section
+# per tweet; images aren't included, since an EPUB can't refer to images on
+# the web, and fetching them all would make sending a thread much slower.
+
+from datetime import timezone
+import html
+import io
+import zipfile
+
+from bobbin.render import expand_text, thread_title, tweet_url
+
+CONTAINER_XML = """<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>
+"""
+
+PACKAGE_OPF = """<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="id">{identifier}</dc:identifier>
+<dc:title>{title}</dc:title>
+<dc:creator>{creator}</dc:creator>
+<dc:language>en</dc:language>
+<dc:date>{date}</dc:date>
+<meta property="dcterms:modified">{modified}</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="thread" href="thread.xhtml" media-type="application/xhtml+xml"/>
+</manifest>
+<spine><itemref idref="thread"/></spine>
+</package>
+"""
+
+NAV_XHTML = """<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>{title}</title></head>
+<body><nav epub:type="toc"><ol><li><a href="thread.xhtml">{title}</a></li></ol></nav></body>
+</html>
+"""
+
+THREAD_XHTML = """<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head><title>{title}</title></head>
+<body>
+<h1>{title}</h1>
+{tweets}
+<p><a href="{url}">{url}</a></p>
+</body>
+</html>
+"""
+
+
+def tweet_xhtml(tweet):
+	paragraphs = "".join(
+		"<p>{}</p>".format(html.escape(paragraph).replace("\n", "<br/>"))
+		for paragraph in expand_text(tweet).strip().split("\n\n")
+		if paragraph.strip()
+	)
+	created_at = tweet.created_at.astimezone(timezone.utc)
+	return '<section>{}<p><small><a href="{}">{}</a></small></p></section><hr/>'.format(
+		paragraphs,
+		html.escape(tweet_url(tweet)),
+		created_at.strftime("%b %d, %Y, %H:%M UTC"),
+	)
+
+
+def thread_epub(thread, *, page_url):
+	'''
+	Render thread as an EPUB, returning its bytes. page_url is the thread's
+	page here, which the book links to and is identified by.
+	'''
+	title = html.escape(thread_title(thread))
+	author = thread.author
+	created_at = thread[0].created_at.astimezone(timezone.utc)
+
+	output = io.BytesIO()
+	with zipfile.ZipFile(output, "w") as book:
+		# The mimetype has to come first, and be stored uncompressed
+		book.writestr("mimetype", "application/epub+zip", compress_type=zipfile.ZIP_STORED)
+		book.writestr("META-INF/container.xml", CONTAINER_XML, compress_type=zipfile.ZIP_DEFLATED)
+		book.writestr("OEBPS/content.opf", PACKAGE_OPF.format(
+			identifier=html.escape(page_url),
+			title=title,
+			creator=html.escape(f"{author.name} (@{author.handle})" if author is not None else "Twitter"),
+			date=created_at.strftime("%Y-%m-%d"),
+			modified=thread.fetched_at.astimezone(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ"),
+		), compress_type=zipfile.ZIP_DEFLATED)
+		book.writestr("OEBPS/nav.xhtml", NAV_XHTML.format(title=title), compress_type=zipfile.ZIP_DEFLATED)
+		book.writestr("OEBPS/thread.xhtml", THREAD_XHTML.format(
+			title=title,
+			tweets="\n".join(tweet_xhtml(tweet) for tweet in thread),
+			url=html.escape(page_url),
+		), compress_type=zipfile.ZIP_DEFLATED)
+
+	return output.getvalue()
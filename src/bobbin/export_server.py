@@ -0,0 +1,507 @@
+# Serves threads in export formats, for people archiving them outside of the
+# browser, like /thread/<id>.md and /thread/<id>.txt, and feeds of the threads
+# we've resolved.
+
+from urllib.parse import urlparse
+import asyncio
+import html
+import logging
+import re
+
+from aiohttp import web
+
+from bobbin import mailer, permalinks, render, source, web_util
+from bobbin.i18n import request_language, translate
+from bobbin.preferences import request_preferences
+from bobbin.api_server import with_thread_errors
+from bobbin.image_proxy import WIDTHS, negotiate_format
+from bobbin.tweet_url import parse_tweet_id
+
+logger = logging.getLogger(__name__)
+
+
+@web_util.method_handler('GET')
+@with_thread_errors
+async def markdown_handler(request, *, get_thread, tail):
+	thread = await get_thread(tail=tail, head=None)
+
+	return web.Response(
+		text=render.thread_markdown(thread),
+		content_type="text/markdown",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def text_handler(
+	request, *,
+	get_thread,
+	tail,
+	separators: web_util.QueryParam ="1",
+):
+	'''
+	Serve a thread as plain text, for pasting into emails or feeding to text
+	to speech. With separators=0, the tweets are joined into plain paragraphs.
+	'''
+	if separators not in ("0", "1"):
+		raise web_util.bad_request_json("separators must be 0 or 1", param="separators")
+
+	thread = await get_thread(tail=tail, head=None)
+
+	return web.Response(
+		text=render.thread_text(thread, separator="\n\n---\n\n" if separators == "1" else "\n\n"),
+		content_type="text/plain",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET')
+@with_thread_errors
+async def pdf_handler(request, *, get_thread, thread_pdfs, tail):
+	'''
+	Serve a thread as a PDF, for archiving (see pdf_export)
+	'''
+	if thread_pdfs is None:
+		raise web.HTTPNotFound(text="PDF export isn't enabled on this server")
+
+	thread = await get_thread(tail=tail, head=None)
+	filename = permalinks.tweet_slug(thread[0]) or str(thread.tail_id)
+
+	return web.Response(
+		body=await thread_pdfs.render(
+			thread,
+			page_url=web_util.site_url(request) + permalinks.thread_permalink(thread),
+		),
+		content_type="application/pdf",
+		headers={"Content-Disposition": f'inline; filename="{filename}.pdf"'},
+	)
+
+
+handler = web_util.routes(
+	(r"(?P<tail>[0-9]{1,20})\.md$", markdown_handler, ['get_thread', 'tail']),
+	(r"(?P<tail>[0-9]{1,20})\.txt$", text_handler, ['get_thread', 'tail']),
+	(r"(?P<tail>[0-9]{1,20})\.pdf$", pdf_handler, ['get_thread', 'thread_pdfs', 'tail']),
+)
+
+
+@web_util.method_handler('GET')
+async def feed_handler(request, *, thread_store, handle):
+	'''
+	Serve an Atom feed of the threads by an author that have been resolved
+	recently. This only works if threads are being stored.
+	'''
+	if thread_store is None:
+		raise web.HTTPNotFound(text="Feeds aren't enabled on this server")
+
+	threads = await thread_store.get_author_threads(handle=handle)
+
+	return web.Response(
+		text=render.author_feed(
+			handle=handle,
+			threads=threads,
+			base_url=web_util.site_url(request),
+		),
+		content_type="application/atom+xml",
+		charset="utf-8",
+	)
+
+
+feed_routes = web_util.routes(
+	(r"(?P<handle>[a-zA-Z0-9_]{1,15})\.atom$", feed_handler, ['thread_store', 'handle']),
+)
+
+
+# Sitemaps are limited to 50,000 urls each, but smaller pages are cheaper to
+# generate
+SITEMAP_PAGE_SIZE = 10000
+
+
+@web_util.method_handler('GET')
+async def robots_handler(request, *, allow_indexing, thread_store):
+	'''
+	Serve robots.txt. Thread pages may be indexed, unless the operator has
+	turned indexing off, in which case crawlers are asked to stay away
+	entirely.
+	'''
+	sitemap_url = None
+	if allow_indexing and thread_store is not None:
+		sitemap_url = f"{web_util.site_url(request)}/sitemap.xml"
+
+	return web.Response(
+		text=render.robots_txt(allow_indexing=allow_indexing, sitemap_url=sitemap_url),
+		content_type="text/plain",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET')
+async def sitemap_index_handler(request, *, allow_indexing, thread_store):
+	'''
+	Serve the sitemap index, which lists one sitemap per page of stored
+	threads. This only works if threads are being stored.
+	'''
+	if not allow_indexing or thread_store is None:
+		raise web.HTTPNotFound()
+
+	count = await thread_store.count_threads()
+	site = web_util.site_url(request)
+	pages = max(1, -(-count // SITEMAP_PAGE_SIZE))
+
+	return web.Response(
+		text=render.sitemap_index(
+			(f"{site}/sitemap-{page}.xml", None)
+			for page in range(1, pages + 1)
+		),
+		content_type="application/xml",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET')
+async def sitemap_page_handler(request, *, allow_indexing, thread_store, page):
+	if not allow_indexing or thread_store is None:
+		raise web.HTTPNotFound()
+
+	page = int(page)
+	if page < 1:
+		raise web.HTTPNotFound()
+
+	threads = await thread_store.list_threads(
+		offset=(page - 1) * SITEMAP_PAGE_SIZE,
+		limit=SITEMAP_PAGE_SIZE,
+	)
+	if not threads and page > 1:
+		raise web.HTTPNotFound()
+
+	site = web_util.site_url(request)
+
+	return web.Response(
+		text=render.sitemap(
+			(f"{site}/thread/{tail}", resolved_at)
+			for tail, resolved_at in threads
+		),
+		content_type="application/xml",
+		charset="utf-8",
+	)
+
+
+# Thread pages may be under a base path
+THREAD_PATH_PATTERN = re.compile(r"(?:^|/)thread/([0-9]{1,20})/?$")
+
+OEMBED_DEFAULT_WIDTH = 550
+OEMBED_DEFAULT_HEIGHT = 600
+
+
+def parse_embed_url(url):
+	'''
+	Get the tail tweet id from the url of a thread page (either form), or of
+	a tweet
+	'''
+	path = urlparse(url).path
+	match = THREAD_PATH_PATTERN.search(path)
+	if match is not None:
+		return match.group(1)
+	return permalinks.parse_permalink(path) or parse_tweet_id(url)
+
+
+def parse_dimension(value, default):
+	if value is None:
+		return default
+	if not value.isdigit() or int(value) == 0:
+		raise web_util.bad_request_json("Invalid dimension", value=value)
+	return min(int(value), default)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+@with_thread_errors
+async def oembed_handler(
+	request, *,
+	get_thread,
+	url: web_util.QueryParam,
+	maxwidth: web_util.QueryParam =None,
+	maxheight: web_util.QueryParam =None,
+	format: web_util.QueryParam ="json",
+):
+	'''
+	oEmbed provider for thread pages (see https://oembed.com). The embed is a
+	short preview of the thread, linking to the full thread page.
+	'''
+	if format != "json":
+		raise web.HTTPNotImplemented()
+
+	tail = parse_embed_url(url)
+	if tail is None:
+		raise web_util.not_found_json("Not a thread url", url=url)
+
+	width = parse_dimension(maxwidth, OEMBED_DEFAULT_WIDTH)
+	height = parse_dimension(maxheight, OEMBED_DEFAULT_HEIGHT)
+
+	thread = await get_thread(tail=tail, head=None)
+	site = web_util.site_url(request)
+	page_url = site + permalinks.thread_permalink(thread)
+	language = request_language(request)
+	title = render.thread_title(thread, language=language)
+
+	embed_html = (
+		'<blockquote class="bobbin-thread" '
+		'style="max-width:{width}px;max-height:{height}px;overflow:hidden">'
+		'<p><strong>{title}</strong></p>'
+		'<p>{summary}</p>'
+		'<p><a href="{url}">{read}</a></p>'
+		'</blockquote>'
+	).format(
+		width=width,
+		height=height,
+		title=html.escape(title),
+		summary=html.escape(render.thread_summary(thread)),
+		url=html.escape(page_url),
+		read=html.escape(translate(language, "read_whole_thread", count=len(thread))),
+	)
+
+	author = thread.author
+
+	return web.Response(
+		text=web_util.dump_json(
+			version="1.0",
+			type="rich",
+			provider_name="Bobbin",
+			provider_url=site,
+			title=title,
+			author_name=f"@{author.handle}" if author is not None else None,
+			author_url=f"https://twitter.com/{author.handle}" if author is not None else None,
+			html=embed_html,
+			width=width,
+			height=height,
+		),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET')
+@with_thread_errors
+async def embed_handler(request, *, get_thread, show_metrics, tail):
+	'''
+	Serve a minimal, self-contained page of a thread for embedding in an
+	iframe on other sites. With ?code=1, code in the tweets is rendered as
+	code.
+	'''
+	thread = await get_thread(tail=tail, head=None)
+	page_url = web_util.site_url(request) + permalinks.thread_permalink(thread)
+
+	return web.Response(
+		text=render.thread_embed_html(
+			thread,
+			page_url=page_url,
+			preferences=request_preferences(request),
+			language=request_language(request),
+			code=request.query.get("code") == "1",
+			show_metrics=show_metrics,
+		),
+		content_type="text/html",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET')
+@with_thread_errors
+async def source_thread_handler(request, *, providers, show_metrics, provider, ref):
+	'''
+	Serve a thread from a source other than twitter (see source). These
+	aren't stored, and the frontend only knows how to show tweets, so
+	they're rendered here, the same way as embedded threads.
+	'''
+	found = source.get_provider(providers, provider)
+	if found is None:
+		raise web.HTTPNotFound()
+
+	if isinstance(found, source.TwitterProvider):
+		raise web.HTTPFound(f"{request.get('base_path', '')}/thread/{ref}")
+
+	thread = await found.get_thread(ref=ref)
+
+	return web.Response(
+		text=render.thread_embed_html(
+			thread,
+			page_url=str(request.url),
+			preferences=request_preferences(request),
+			language=request_language(request),
+			code=request.query.get("code") == "1",
+			show_metrics=show_metrics,
+		),
+		content_type="text/html",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET')
+async def embed_loader_handler(request):
+	return web.Response(
+		text=render.embed_loader_script(
+			origin=str(request.url.origin()),
+			base_url=web_util.site_url(request),
+		),
+		content_type="application/javascript",
+		charset="utf-8",
+	)
+
+
+@web_util.method_handler('GET', 'HEAD')
+@with_thread_errors
+async def share_image_handler(request, *, get_thread, share_images, tail):
+	'''
+	Serve a thread's share image, for og:image (see share_images)
+	'''
+	if share_images is None:
+		raise web.HTTPNotFound()
+
+	thread = await get_thread(tail=tail, head=None)
+
+	return web.Response(
+		body=await share_images.render(thread, language=request_language(request)),
+		content_type="image/png",
+		headers={"Cache-Control": "public, max-age=3600", "Vary": "Accept-Language"},
+	)
+
+
+@web_util.method_handler('GET')
+async def media_handler(request, *, media_mirror, key):
+	'''
+	Serve a mirrored copy of some media (see media_mirror). Copies are stored
+	by the hash of their original url, so they never change.
+	'''
+	if media_mirror is None:
+		raise web.HTTPNotFound()
+
+	blob = await media_mirror.get(key)
+	if blob is None:
+		raise web.HTTPNotFound()
+
+	body, content_type = blob
+	return web.Response(
+		body=body,
+		content_type=content_type,
+		headers={"Cache-Control": "public, max-age=31536000, immutable"},
+	)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+async def image_handler(
+	request, *,
+	image_proxy,
+	url: web_util.QueryParam,
+	s: web_util.QueryParam,
+	w: web_util.QueryParam =None,
+):
+	'''
+	Serve a thread image through the image proxy (see image_proxy), w pixels
+	wide, in the best format the browser accepts. Only urls signed by the
+	proxy are served.
+	'''
+	if image_proxy is None:
+		raise web.HTTPNotFound()
+
+	if w is None:
+		width = None
+	elif w.isdigit() and int(w) in WIDTHS:
+		width = int(w)
+	else:
+		raise web_util.bad_request_json("Invalid width", param="w", widths=sorted(WIDTHS))
+
+	if not image_proxy.is_valid(url, s):
+		raise web_util.error_json(web.HTTPForbidden, "Invalid signature")
+
+	image = await image_proxy.get(
+		url,
+		width=width,
+		image_format=negotiate_format(request.headers.get("Accept")),
+	)
+	if image is None:
+		raise web_util.bad_gateway_json("Couldn't fetch image")
+
+	body, content_type = image
+	return web.Response(
+		body=body,
+		content_type=content_type,
+		headers={
+			"Cache-Control": "public, max-age=31536000, immutable",
+			"Vary": "Accept",
+		},
+	)
+
+
+def confirm_page(title, message, *, status=200, action=None, token=None):
+	return web.Response(
+		text=render.email_confirm_html(title=title, message=message, action=action, token=token),
+		status=status,
+		content_type="text/html",
+		headers={"Cache-Control": "private, no-store", "Referrer-Policy": "no-referrer"},
+	)
+
+
+@web_util.method_handler('GET')
+@web_util.with_query(web_util.query_error_handler_json)
+async def email_confirm_page_handler(request, *, get_thread, thread_mailer, token: web_util.QueryParam):
+	'''
+	The page confirmation links from emailed threads open (see mailer). It
+	only shows a button; the thread is sent when that's pressed.
+	'''
+	if thread_mailer is None:
+		raise web.HTTPNotFound()
+
+	try:
+		thread_mailer.check_token(token)
+	except mailer.InvalidTokenError as e:
+		return confirm_page("Couldn't send thread", str(e), status=400)
+
+	return confirm_page(
+		"Send thread",
+		"Press the button to have the thread emailed to you.",
+		action=f"{web_util.site_url(request)}/email/confirm",
+		token=token,
+	)
+
+
+@web_util.method_handler('POST')
+async def email_confirm_handler(request, *, get_thread, thread_mailer):
+	'''
+	Send a thread whose confirmation link was followed
+	'''
+	if thread_mailer is None:
+		raise web.HTTPNotFound()
+
+	form = await request.post()
+	try:
+		email_request = thread_mailer.check_token(form.get("token", ""))
+	except mailer.InvalidTokenError as e:
+		return confirm_page("Couldn't send thread", str(e), status=400)
+
+	# Used up even if sending fails, so that a broken thread can't be
+	# retried into a flood
+	thread_mailer.use_token(form["token"])
+
+	try:
+		thread = await get_thread(tail=email_request.tail_id, head=None)
+		await thread_mailer.send_thread(thread, email_request, site_url=web_util.site_url(request))
+	except asyncio.CancelledError:
+		raise
+	except Exception:
+		logger.exception("Error emailing thread %s", email_request.tail_id)
+		return confirm_page("Couldn't send thread", "Something went wrong sending the thread. Try again later.", status=502)
+
+	return confirm_page("Thread sent", f"The thread is on its way to {email_request.address}.")
+
+
+email_confirm_routes = web_util.methods(
+	('GET', email_confirm_page_handler),
+	('POST', email_confirm_handler),
+)
+
+
+embed_routes = web_util.routes(
+	(r"thread/(?P<tail>[0-9]{1,20})/?$", embed_handler, ['get_thread', 'show_metrics', 'tail']),
+	(r"loader\.js$", embed_loader_handler, []),
+)
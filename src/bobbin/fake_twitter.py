@@ -0,0 +1,262 @@
+# An in-process fake of the parts of the twitter v1.1 API that bobbin uses,
+# for exercising the client, tweetbox, and the server without credentials or
+# network access. FakeTwitter stands in for the aiohttp ClientSession passed
+# to the api functions: it implements just enough of session.get and
+# session.post to serve tweets from canned fixtures.
+#
+#     fake = FakeTwitter()
+#     fake.add_tweet(make_tweet_json("1", user, "first"))
+#     fake.add_tweet(make_tweet_json("2", user, "second", parent_id="1"))
+#     thread = await tweetbox.get_thread(session=fake, token=token, ...)
+#
+# Rate limits can be programmed per endpoint, and errors can be injected for
+# any url.
+
+from collections import deque, namedtuple
+from datetime import datetime, timezone
+import json
+import time
+
+import aiohttp
+
+from bobbin import twitter
+
+
+def make_user_json(id, handle, name=None):
+	return {
+		"id_str": id,
+		"screen_name": handle,
+		"name": name if name is not None else handle,
+	}
+
+
+def make_tweet_json(id, user, text, *, parent_id=None, created_at=None, **extra):
+	'''
+	Create a v1.1 tweet object. user is a user object, as from make_user_json.
+	If parent_id is given, the tweet is a reply to it, by the same user.
+	'''
+	if created_at is None:
+		created_at = datetime.now(timezone.utc)
+
+	return {
+		"id_str": id,
+		"user": user,
+		"in_reply_to_status_id_str": parent_id,
+		"in_reply_to_user_id_str": user["id_str"] if parent_id is not None else None,
+		"full_text": text,
+		"created_at": created_at.strftime("%a %b %d %H:%M:%S %z %Y"),
+		"entities": {"urls": [], "user_mentions": [], "hashtags": []},
+		**extra,
+	}
+
+
+class FakeResponse:
+	def __init__(self, *, status=200, body=None, headers=None):
+		self.status = status
+		self.body = body
+		self.headers = headers or {}
+
+	async def __aenter__(self):
+		return self
+
+	async def __aexit__(self, *exc):
+		pass
+
+	async def read(self):
+		return json.dumps(self.body).encode() if self.body is not None else b""
+
+	async def json(self, *, content_type="application/json"):
+		if self.body is None:
+			raise ValueError("Response has no body")
+		return json.loads(json.dumps(self.body))
+
+	def raise_for_status(self):
+		if self.status >= 400:
+			raise aiohttp.ClientResponseError(
+				None, (),
+				status=self.status,
+				message=f"Fake error {self.status}",
+				headers=self.headers,
+			)
+
+
+class InjectedError(namedtuple("InjectedError", "status errors headers")):
+	'''
+	An error response to return instead of the real one. errors is a list of
+	(code, message) pairs, as in TwitterAPIError.
+	'''
+	__slots__ = ()
+
+	def response(self):
+		body = {"errors": [{"code": code, "message": message} for code, message in self.errors]}
+		return FakeResponse(status=self.status, body=body, headers=self.headers)
+
+
+class FakeRateLimit:
+	__slots__ = ('limit', 'remaining', 'window', 'reset')
+
+	def __init__(self, limit, window):
+		self.limit = limit
+		self.remaining = limit
+		self.window = window
+		self.reset = 0
+
+
+class FakeTwitter:
+	'''
+	A fake twitter API, usable anywhere a ClientSession is expected by the api
+	functions. Every request is recorded in requests, as (method, url,
+	params) triples.
+	'''
+	def __init__(self, *, clock=time.time):
+		self.clock = clock
+		self.tweets = {}
+		self.users = {}
+		self.token = "fake-token"
+		self.requests = []
+
+		# url -> FakeRateLimit
+		self.rate_limits = {}
+
+		# url -> deque of InjectedError, consumed in order
+		self.errors = {}
+
+	def add_tweet(self, blob):
+		self.tweets[blob["id_str"]] = blob
+		self.users[blob["user"]["id_str"]] = blob["user"]
+
+	def add_thread(self, user, texts, *, first_id=1):
+		'''
+		Add a simple thread of self replies, one per text, with sequential ids
+		starting at first_id. Returns the list of tweet ids, head first.
+		'''
+		ids = [str(first_id + index) for index in range(len(texts))]
+		for index, (tweet_id, text) in enumerate(zip(ids, texts)):
+			self.add_tweet(make_tweet_json(
+				tweet_id, user, text,
+				parent_id=ids[index - 1] if index > 0 else None,
+			))
+		return ids
+
+	def set_rate_limit(self, url, *, limit, window=900):
+		'''
+		Limit requests to url to limit per window seconds. Once they're used
+		up, requests get 429s until the window resets.
+		'''
+		self.rate_limits[url] = FakeRateLimit(limit, window)
+
+	def inject_error(self, url, status, errors=(), *, count=1, headers=None):
+		'''
+		Make the next count requests to url fail with the given status and
+		(code, message) errors
+		'''
+		queue = self.errors.setdefault(url, deque())
+		queue.extend([InjectedError(status, list(errors), headers or {})] * count)
+
+	def _rate_limit(self, url):
+		rate_limit = self.rate_limits.get(url)
+		if rate_limit is None:
+			return True, {}
+
+		now = self.clock()
+		if rate_limit.reset <= now:
+			rate_limit.remaining = rate_limit.limit
+			rate_limit.reset = int(now + rate_limit.window)
+
+		allowed = rate_limit.remaining > 0
+		if allowed:
+			rate_limit.remaining -= 1
+
+		return allowed, {
+			"x-rate-limit-limit": str(rate_limit.limit),
+			"x-rate-limit-remaining": str(rate_limit.remaining),
+			"x-rate-limit-reset": str(rate_limit.reset),
+		}
+
+	def _respond(self, method, url, params, handler):
+		self.requests.append((method, url, dict(params or {})))
+
+		queue = self.errors.get(url)
+		if queue:
+			return queue.popleft().response()
+
+		allowed, headers = self._rate_limit(url)
+		if not allowed:
+			return FakeResponse(
+				status=429,
+				body={"errors": [{"code": 88, "message": "Rate limit exceeded"}]},
+				headers=headers,
+			)
+
+		response = handler(params or {})
+		response.headers = {**headers, **response.headers}
+		return response
+
+	def get(self, url, *, params=None, headers=None):
+		if headers is None or headers.get("Authorization") != twitter.encode_bearer_token(self.token):
+			return FakeResponse(status=401, body={"errors": [{"code": 89, "message": "Invalid or expired token."}]})
+
+		handler = self.get_handlers.get(url)
+		if handler is None:
+			return FakeResponse(status=404, body={"errors": [{"code": 34, "message": "Sorry, that page does not exist."}]})
+
+		return self._respond("GET", url, params, lambda params: handler(self, params))
+
+	def post(self, url, *, headers=None, data=None):
+		handler = self.post_handlers.get(url)
+		if handler is None:
+			return FakeResponse(status=404)
+
+		return self._respond("POST", url, {}, lambda params: handler(self, data))
+
+	def _missing_tweet(self):
+		return FakeResponse(status=404, body={"errors": [{"code": 144, "message": "No status found with that ID."}]})
+
+	def _get_tweet(self, params):
+		tweet = self.tweets.get(str(params.get("id")))
+		return FakeResponse(body=tweet) if tweet is not None else self._missing_tweet()
+
+	def _lookup(self, params):
+		ids = str(params.get("id", "")).split(",")
+		return FakeResponse(body=[self.tweets[id] for id in ids if id in self.tweets])
+
+	def _user_timeline(self, params):
+		user_id = str(params.get("user_id"))
+		max_id = int(params["max_id"]) if "max_id" in params else None
+		since_id = int(params["since_id"]) if "since_id" in params else None
+
+		tweets = sorted(
+			(
+				tweet for tweet in self.tweets.values()
+				if tweet["user"]["id_str"] == user_id
+				and (max_id is None or int(tweet["id_str"]) <= max_id)
+				and (since_id is None or int(tweet["id_str"]) > since_id)
+			),
+			key=lambda tweet: int(tweet["id_str"]),
+			reverse=True,
+		)
+		return FakeResponse(body=tweets[:int(params.get("count", 20))])
+
+	def _get_user(self, params):
+		user = self.users.get(str(params.get("user_id")))
+		if user is None:
+			return FakeResponse(status=404, body={"errors": [{"code": 50, "message": "User not found."}]})
+		return FakeResponse(body=user)
+
+	def _generate_token(self, data):
+		return FakeResponse(body={"token_type": "bearer", "access_token": self.token})
+
+	def _invalidate_token(self, data):
+		return FakeResponse(body={"access_token": self.token})
+
+	get_handlers = {
+		twitter.TWEET_URL: _get_tweet,
+		twitter.LOOKUP_URL: _lookup,
+		twitter.USER_TIMELINE_URL: _user_timeline,
+		twitter.USER_URL: _get_user,
+	}
+
+	post_handlers = {
+		twitter.TOKEN_URL: _generate_token,
+		twitter.RELEASE_URL: _invalidate_token,
+	}
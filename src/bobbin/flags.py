@@ -0,0 +1,26 @@
+# Feature flags that can be toggled at runtime, through the admin API, without
+# restarting the server. Their initial values come from the config.
+
+
+class FeatureFlags:
+	'''
+	A fixed set of named boolean flags. Components that support runtime
+	toggling read their flag each time they need it, rather than once at
+	startup.
+	'''
+	def __init__(self, **defaults):
+		self.values = {name: bool(value) for name, value in defaults.items()}
+
+	def __getitem__(self, name):
+		return self.values[name]
+
+	def __contains__(self, name):
+		return name in self.values
+
+	def set(self, name, value):
+		if name not in self.values:
+			raise KeyError(name)
+		self.values[name] = bool(value)
+
+	def snapshot(self):
+		return dict(self.values)
@@ -0,0 +1,136 @@
+# Following threads, to pick up tweets their authors add later. Anyone can
+# follow a stored thread through the API, and is given a follow id, which is
+# the only way to unfollow it again; like API keys, only a hash of it is
+# stored. Followers can give a callback_url, to be sent a signed callback
+# (see callbacks) when the thread grows.
+#
+# A Recrawler periodically resolves each followed thread again, forwards
+# from its last known tail, so new tweets by the author are found. The new
+# copy is saved to the store as usual, where it shows up in the author's
+# feed, and the change is recorded as a revision (see revisions).
+
+from collections import namedtuple
+from datetime import datetime, timedelta, timezone
+import asyncio
+import hashlib
+import json
+import logging
+import secrets
+
+logger = logging.getLogger(__name__)
+
+FOLLOW_PREFIX = "flw_"
+
+
+class Follow(namedtuple("Follow", "id_hash head_id tail_id callback_url created_at")):
+	'''
+	A stored follow of the thread starting at head_id, which ended at tail_id
+	when it was followed. callback_url may be None.
+	'''
+	__slots__ = ()
+
+
+class FollowedThread(namedtuple("FollowedThread", "head_id tail_id checked_at callback_urls")):
+	'''
+	A thread with at least one follower: its head, its tail as of the last
+	check (checked_at, which is None if it hasn't been checked yet), and the
+	callback urls of its followers
+	'''
+	__slots__ = ()
+
+
+def hash_follow_id(follow_id):
+	return hashlib.sha256(follow_id.encode()).hexdigest()
+
+
+def generate_follow_id():
+	'''
+	Create a new follow id, which is given to the follower and never stored
+	'''
+	return FOLLOW_PREFIX + secrets.token_urlsafe(24)
+
+
+def update_callback_body(followed, thread):
+	return json.dumps({
+		"event": "thread_updated",
+		"head": followed.head_id,
+		"previous_tail": followed.tail_id,
+		"tail": thread.tail_id,
+		"tweet_count": len(thread),
+	})
+
+
+class Recrawler:
+	'''
+	Resolves followed threads in store again, so that their new tweets are
+	found. Each thread is checked about every interval seconds, up to
+	batch_size at a time, least recently checked first. get_thread should resolve forwards (see tweetbox's forward), and
+	save the threads to store. If callback_sender (a
+	callbacks.CallbackSender) is given, followers' callbacks are sent when
+	their threads grow.
+	'''
+	def __init__(self, store, get_thread, *, callback_sender=None, interval=3600, batch_size=50):
+		self.store = store
+		self.get_thread = get_thread
+		self.callback_sender = callback_sender
+		self.interval = interval
+		self.batch_size = batch_size
+		self.task = None
+
+	async def check(self, followed, *, now):
+		try:
+			thread = await self.get_thread(tail=followed.tail_id, head=None)
+		except asyncio.CancelledError:
+			raise
+		except Exception:
+			# The stored copy is still there, and it's tried again next time
+			logger.info("Couldn't recrawl thread %s", followed.tail_id, exc_info=True)
+			thread = None
+
+		grew = (
+			thread is not None and
+			thread.tail_id != followed.tail_id and
+			followed.tail_id in thread.ids
+		)
+		await self.store.set_followed_tail(
+			head=followed.head_id,
+			tail=thread.tail_id if grew else followed.tail_id,
+			checked_at=now,
+		)
+
+		if grew and self.callback_sender is not None:
+			body = update_callback_body(followed, thread)
+			for url in followed.callback_urls:
+				self.callback_sender.send(url, body)
+
+		return grew
+
+	async def refresh(self):
+		now = datetime.now(timezone.utc)
+		followed_threads = await self.store.get_followed_threads(
+			checked_before=now - timedelta(seconds=self.interval),
+			limit=self.batch_size,
+		)
+
+		for followed in followed_threads:
+			await self.check(followed, now=now)
+
+	async def run(self):
+		while True:
+			try:
+				await self.refresh()
+			except asyncio.CancelledError:
+				raise
+			except Exception:
+				logger.exception("Couldn't recrawl followed threads")
+
+			await asyncio.sleep(self.interval / 10)
+
+	def start(self):
+		self.task = asyncio.ensure_future(self.run())
+
+	async def close(self):
+		if self.task is not None:
+			self.task.cancel()
+			await asyncio.gather(self.task, return_exceptions=True)
+			self.task = None
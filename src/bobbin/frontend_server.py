@@ -1,14 +1,80 @@
 # This file serves javascript, html, etc.
 
+from urllib.parse import quote as url_encode
+import asyncio
+import html
+import json
+import logging
 import pathlib
 from aiohttp import web
-from bobbin import web_util
+import cachetools
+from bobbin import permalinks, render, source, web_util
+from bobbin.i18n import DEFAULT_LANGUAGE, request_language
+from bobbin.preferences import PREFERENCES_COOKIE, request_preferences
+
+logger = logging.getLogger(__name__)
+
+
+class Theme:
+	'''
+	Where index.html and the static files are served from. Files in
+	theme_dir, if there is one, are served in place of the ones at the same
+	paths in static_dir, so a theme only needs the files it changes: its own
+	index.html, say, or a stylesheet. Where each path was found is
+	remembered, so new theme files need a restart, unless reload is set (for
+	development), in which case paths are looked up on every request, and
+	browsers are told not to cache what's served.
+	'''
+	def __init__(self, static_dir, theme_dir=None, *, reload=False, cache_size=1024):
+		self.directories = tuple(
+			pathlib.Path(directory).resolve()
+			for directory in (theme_dir, static_dir)
+			if directory is not None
+		)
+		self.reload = reload
+		self.found = cachetools.LRUCache(cache_size)
+
+	def find_uncached(self, path):
+		for directory in self.directories:
+			complete_path = directory.joinpath(path).resolve()
+
+			try:
+				complete_path.relative_to(directory)
+			except ValueError:
+				continue
+
+			if complete_path.is_file():
+				return complete_path
+
+		return None
+
+	def find(self, path):
+		'''
+		Get the file to serve for path, relative to the theme, or None if
+		there isn't one
+		'''
+		if self.reload:
+			return self.find_uncached(path)
+
+		try:
+			return self.found[path]
+		except KeyError:
+			found = self.found[path] = self.find_uncached(path)
+			return found
+
+	@property
+	def index_path(self):
+		return self.find(pathlib.Path("index.html")) or self.directories[-1] / "index.html"
+
+	@property
+	def headers(self):
+		return {"Cache-Control": "no-cache"} if self.reload else {}
 
 
 @web_util.final_route
 @web_util.route(r"/(?P<path>[a-zA-Z0-9._-]+(/[a-zA-Z0-9._-]+)*)$")
 @web_util.method_handler('GET', 'HEAD')
-async def static_file_handler(request, *, base_directory: pathlib.Path, path, valid_paths):
+async def static_file_handler(request, *, theme, path, valid_paths):
 	path = pathlib.Path(path)
 
 	if '..' in path.parts:
@@ -17,20 +83,190 @@ async def static_file_handler(request, *, base_directory: pathlib.Path, path, va
 	if valid_paths is not None and path not in valid_paths:
 		raise web.HTTPNotFound(body=b'')
 
-	complete_path = base_directory.joinpath(path).resolve()
+	complete_path = theme.find(path)
+	if complete_path is None:
+		raise web.HTTPNotFound(body=b'')
+
+	# TODO: Pull request for FileResponse to serve brotli as well as gzip
+	return web.FileResponse(complete_path, chunk_size=1024 * 1024, headers=theme.headers)
+
+
+def index_html(request, theme):
+	'''
+	Get the text of the theme's index page for request. The viewer's
+	language and display preferences are applied to the <html> element, and
+	the frontend is told the language. Under a base path, the static urls in
+	it are adjusted, and the frontend is told the base path.
+	'''
+	language = request_language(request)
+	page = theme.index_path.read_text().replace(
+		'<html lang="en">',
+		'<html lang="{}" class="{}">'.format(
+			html.escape(language),
+			html.escape(request_preferences(request).html_classes()),
+		),
+		1,
+	)
+
+	settings = {"bobbinLanguage": language}
+	base_path = request.get("base_path", "")
+	if base_path:
+		settings["bobbinBasePath"] = base_path
+		page = page.replace('src="/static/', f'src="{base_path}/static/')
+
+	script = "<script>{}</script>\n".format("".join(
+		"window.{} = {};".format(name, json.dumps(value).replace("<", "\\u003c"))
+		for name, value in settings.items()
+	))
+
+	return page.replace("</head>", script + "</head>", 1)
+
+
+def index_response(request, theme):
+	# The index varies with Accept-Language, so caches need to know that
+	headers = {"Vary": "Accept-Language", **theme.headers}
+
+	# The plain file will do, unless there's something to customize
+	if (
+		not request.get("base_path") and
+		PREFERENCES_COOKIE not in request.cookies and
+		request_language(request) == DEFAULT_LANGUAGE
+	):
+		return web.FileResponse(theme.index_path, headers=headers)
+
+	return web.Response(
+		text=index_html(request, theme),
+		content_type="text/html",
+		charset="utf-8",
+		headers=headers,
+	)
 
+
+@web_util.method_handler('GET', 'HEAD')
+async def index_handler(request, theme):
+	return index_response(request, theme)
+
+
+def meta_tags_html(tags):
+	return "".join(
+		'<meta {}="{}" content="{}">\n'.format(attr, html.escape(name), html.escape(content))
+		for attr, name, content in tags
+	)
+
+
+async def record_view(view_counter, request, tail):
 	try:
-		complete_path.relative_to(base_directory)
-	except ValueError as e:
-		raise web.HTTPNotFound(body=b'') from e
+		await view_counter.record(remote=request.remote, tail=tail)
+	except asyncio.CancelledError:
+		raise
+	except Exception:
+		# Counting views isn't worth failing the page over
+		logger.exception("Couldn't record a view of %s", tail)
 
-	if not complete_path.is_file():
-		raise web.HTTPNotFound(body=b'')
 
-	# TODO: Pull request for FileResponse to serve brotli as well as gzip
-	return web.FileResponse(complete_path, chunk_size=1024 * 1024)
+@web_util.method_handler('GET', 'HEAD')
+async def thread_page_handler(
+	request, *,
+	theme,
+	get_thread,
+	tail,
+	view_counter=None,
+	share_images=None,
+	meta_timeout=2,
+):
+	'''
+	Serve the index page for a thread, with Open Graph and Twitter Card meta
+	tags describing the thread injected into the head. Link unfurlers don't
+	run javascript, so this is the only way they can see the thread. If the
+	thread can't be resolved quickly, the plain index page is served instead.
+	If it can, and the request isn't for the thread's current permalink (see
+	permalinks), it's redirected there. If there's a view_counter (an
+	analytics.ViewCounter), the view is counted, for popular and trending
+	threads. If there's share_images (a share_images.ShareImageRenderer),
+	the thread's share image is used for the page's preview.
+	'''
+	if view_counter is not None and request.method == "GET":
+		await record_view(view_counter, request, tail)
+
+	try:
+		thread = await asyncio.wait_for(get_thread(tail=tail, head=None), meta_timeout)
+	except asyncio.CancelledError:
+		raise
+	except Exception:
+		# The page itself will report the error, if there is one
+		return index_response(request, theme)
+
+	path = permalinks.thread_permalink(thread)
+	if request["site_path"].rstrip("/") != path:
+		location = request.get("base_path", "") + path
+		if request.query_string:
+			location += "?" + request.query_string
+		raise web.HTTPMovedPermanently(location)
+
+	site = web_util.site_url(request)
+	page_url = site + path
+	page = index_html(request, theme)
+	share_image_url = (
+		"{}/thread/{}/card.png".format(site, thread.tail_id)
+		if share_images is not None else None
+	)
+	tags = meta_tags_html(render.thread_meta_tags(
+		thread,
+		page_url=page_url,
+		share_image_url=share_image_url,
+	))
+	tags += '<link rel="canonical" href="{}">\n'.format(html.escape(page_url))
+
+	# oEmbed discovery
+	tags += '<link rel="alternate" type="application/json+oembed" href="{}">\n'.format(
+		html.escape("{}/oembed?url={}".format(site, url_encode(page_url, safe=""))),
+	)
+
+	return web.Response(
+		text=page.replace("</head>", tags + "</head>", 1),
+		content_type="text/html",
+		charset="utf-8",
+	)
 
 
 @web_util.method_handler('GET', 'HEAD')
-async def index_handler(request, index_path):
-	return web.FileResponse(index_path, )
+async def author_page_handler(request, *, theme, thread_store, handle):
+	'''
+	Serve the index page for an author's threads, with their Atom feed linked
+	from the head, so that feed readers can find it
+	'''
+	if thread_store is None:
+		return index_response(request, theme)
+
+	feed_url = "{}/feed/{}.atom".format(web_util.site_url(request), handle)
+	link = '<link rel="alternate" type="application/atom+xml" title="{}" href="{}">\n'.format(
+		html.escape(f"Threads by @{handle}"),
+		html.escape(feed_url),
+	)
+
+	return web.Response(
+		text=index_html(request, theme).replace("</head>", link + "</head>", 1),
+		content_type="text/html",
+		charset="utf-8",
+		headers={"Vary": "Accept-Language"},
+	)
+
+
+@web_util.method_handler('POST')
+async def unroll_handler(request, *, providers):
+	'''
+	Handle a submitted tweet url (from the homepage form) by redirecting to
+	the thread page for it. Links to other sources' posts (see source) go to
+	their source pages.
+	'''
+	form = await request.post()
+	found = source.find_provider(providers, form.get("url", ""))
+
+	if found is None:
+		raise web.HTTPBadRequest(text="That doesn't look like a link to a tweet")
+
+	provider, ref = found
+	if isinstance(provider, source.TwitterProvider):
+		raise web.HTTPSeeOther(f"{request.get('base_path', '')}/thread/{ref}")
+
+	raise web.HTTPSeeOther(f"{request.get('base_path', '')}/source/{provider.name}/{ref}")
@@ -0,0 +1,473 @@
+# A GraphQL endpoint, at /graphql, alongside the JSON API. It serves the same
+# data (threads, their tweets and authors, authors' stored threads, and
+# search), with the same field names, but lets clients pick which fields
+# they want, and ask for several things in one request. Queries are sent as
+# JSON, in a POST body ({"query", "variables", "operationName"}), or as
+# query parameters of a GET.
+#
+# This needs graphql-core, which is optional:
+#
+#     pip install bobbin[graphql]
+
+from datetime import date
+import asyncio
+import json
+import logging
+
+from aiohttp import web
+import aiohttp
+
+from bobbin import api_server, permalinks, web_util
+from bobbin.load_shedding import Overloaded
+from bobbin.optout import HANDLE_PATTERN, OptedOutError
+from bobbin.storage import SearchUnavailableError
+from bobbin.thread_stats import thread_stats
+from bobbin.tweet_url import parse_tweet_id
+from bobbin.tweetbox import InvalidThreadError
+from bobbin.twitter import TwitterError, UnavailableTweetError
+
+try:
+	import graphql
+except ImportError:
+	graphql = None
+
+logger = logging.getLogger(__name__)
+
+MAX_QUERY_LENGTH = 10000
+
+# Each thread in a query may need resolving, so a query can only ask for a
+# few, so that it costs about as much as a few API requests
+MAX_THREADS = 5
+
+SCHEMA = '''
+type Query {
+	thread(tail: ID!, head: ID): Thread
+	author(handle: String!, page: Int = 1): AuthorThreads
+	search(q: String!, author: String, since: String, until: String, page: Int = 1): SearchResults
+}
+
+type Thread {
+	thread: [ID!]!
+	tweets: [Tweet!]!
+	replies: [Replies!]!
+	unavailable: [Gap!]!
+	truncated: Boolean!
+	fetched_at: String!
+	author: User
+	permalink: String!
+	stats: Stats!
+}
+
+type Replies {
+	tweet_id: ID!
+	replies: [Tweet!]!
+}
+
+type Gap {
+	id: ID!
+	reason: String
+}
+
+type Stats {
+	tweets: Int!
+	words: Int!
+	reading_minutes: Int!
+	first_tweet_at: String
+	last_tweet_at: String
+	media: Int!
+	links: Int!
+	engagement: Metrics
+}
+
+type Metrics {
+	likes: Int
+	retweets: Int
+	replies: Int
+	quotes: Int
+}
+
+type Tweet {
+	id: ID!
+	user: User!
+	parent_id: ID
+	text: String!
+	created_at: String!
+	entities: Entities!
+	quoted_id: ID
+	quoted: Tweet
+	metrics: Metrics
+	poll: Poll
+	card: Card
+	url: String
+}
+
+type User {
+	id: ID!
+	handle: String!
+	name: String!
+	avatar_url: String
+	bio: String
+	verified: Boolean
+	followers: Int
+	url: String
+}
+
+type Entities {
+	urls: [Url!]!
+	mentions: [Mention!]!
+	hashtags: [Hashtag!]!
+	media: [Media!]!
+}
+
+type Url {
+	indices: [Int!]!
+	url: String!
+	expanded_url: String
+	display_url: String
+}
+
+type Mention {
+	indices: [Int!]!
+	user_id: ID
+	handle: String!
+}
+
+type Hashtag {
+	indices: [Int!]!
+	text: String!
+}
+
+type Media {
+	indices: [Int!]!
+	url: String
+	media_url: String
+	type: String!
+	width: Int
+	height: Int
+	alt_text: String
+	variants: [Variant!]!
+	video_url: String
+}
+
+type Variant {
+	content_type: String
+	bitrate: Int
+	url: String!
+}
+
+type Poll {
+	id: ID!
+	options: [PollOption!]!
+	total_votes: Int!
+	end_datetime: String
+	duration_minutes: Int
+	voting_status: String
+}
+
+type PollOption {
+	position: Int!
+	label: String!
+	votes: Int
+	percentage: Float
+}
+
+type Card {
+	url: String!
+	title: String
+	description: String
+	image_url: String
+	site_name: String
+}
+
+type AuthorThreads {
+	handle: String!
+	author: User
+	total: Int!
+	page: Int!
+	pages: Int!
+	threads: [ThreadSummary!]!
+}
+
+type ThreadSummary {
+	tail: ID!
+	head: ID!
+	author: User!
+	title: String!
+	created_at: String!
+	tweet_count: Int!
+	resolved_at: String!
+	views: Int
+	permalink: String!
+}
+
+type SearchResults {
+	query: String!
+	author: String
+	since: String
+	until: String
+	total: Int!
+	page: Int!
+	pages: Int!
+	results: [SearchResult!]!
+}
+
+type SearchResult {
+	tail: ID!
+	head: ID!
+	author: SearchAuthor
+	tweet_count: Int!
+	created_at: String!
+	resolved_at: String!
+	snippet: String
+}
+
+type SearchAuthor {
+	id: ID!
+	handle: String!
+	name: String!
+}
+'''
+
+
+def available():
+	return graphql is not None
+
+
+def make_schema():
+	return graphql.build_schema(SCHEMA)
+
+
+def query_error(message, **extensions):
+	return graphql.GraphQLError(message, extensions=extensions)
+
+
+def parse_page(page):
+	if page < 1:
+		raise query_error("Invalid page", code="bad_request", page=page)
+	return page
+
+
+def parse_date(value, *, param):
+	if value is None:
+		return None
+
+	try:
+		return date.fromisoformat(value)
+	except ValueError:
+		raise query_error("Invalid date; use YYYY-MM-DD", code="bad_request", param=param, date=value) from None
+
+
+def thread_result(thread, *, show_metrics):
+	'''
+	The JSON API's thread, in a shape that fits the schema: replies and
+	unavailable tweets are lists, rather than objects keyed by tweet id.
+	'''
+	stats = thread_stats(thread)
+	if not show_metrics:
+		stats = stats._replace(engagement=None)
+
+	return {
+		"thread": thread.ids,
+		"tweets": [api_server.tweet_json(tweet, show_metrics=show_metrics) for tweet in thread],
+		"replies": [
+			{
+				"tweet_id": tweet_id,
+				"replies": [api_server.tweet_json(reply, show_metrics=show_metrics) for reply in tweet_replies],
+			}
+			for tweet_id, tweet_replies in thread.replies.items()
+		],
+		"unavailable": [{"id": gap.id, "reason": gap.reason} for gap in thread.gaps],
+		"truncated": thread.truncated,
+		"fetched_at": thread.fetched_at.isoformat(),
+		"author": api_server.user_json(thread.author) if thread.author is not None else None,
+		"permalink": permalinks.thread_permalink(thread),
+		"stats": stats.json(),
+	}
+
+
+class Query:
+	'''
+	The root of a query. Each field of the Query type is a method here,
+	called with the field's arguments (see graphql.default_field_resolver).
+	'''
+	def __init__(self, *, get_thread, thread_store, opt_outs, show_metrics):
+		self.get_thread = get_thread
+		self.thread_store = thread_store
+		self.opt_outs = opt_outs
+		self.show_metrics = show_metrics
+		self.thread_count = 0
+
+	async def thread(self, info, *, tail, head=None):
+		# Like the JSON API, this takes whole tweet urls too
+		tail_id = parse_tweet_id(tail)
+		if tail_id is None or not api_server.is_valid_tweet_id(tail_id):
+			raise query_error("Invalid tweet id", code="bad_request", param="tail", tweet_id=tail)
+
+		head_id = parse_tweet_id(head) if head is not None else None
+		if head is not None and (head_id is None or not api_server.is_valid_tweet_id(head_id)):
+			raise query_error("Invalid tweet id", code="bad_request", param="head", tweet_id=head)
+
+		self.thread_count += 1
+		if self.thread_count > MAX_THREADS:
+			raise query_error("Too many threads in one query", code="bad_request", max_threads=MAX_THREADS)
+
+		try:
+			thread = await self.get_thread(tail=tail_id, head=head_id)
+		except UnavailableTweetError as e:
+			raise query_error("Tweet unavailable", code="not_found", reason=e.reason, tweet_id=e.tweet_id) from e
+		except InvalidThreadError as e:
+			raise query_error("Head isn't in the thread", code="not_found", tweet_id=e.args[0]) from e
+		except OptedOutError as e:
+			raise query_error("Author has opted out", code="opted_out", handle=e.user.handle) from e
+		except Overloaded as e:
+			raise query_error("Too many threads being resolved", code="unavailable", retry_after=e.retry_after) from e
+		except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError) as e:
+			logger.exception("Error resolving thread")
+			raise query_error("Error from twitter", code="bad_gateway") from e
+
+		return thread_result(thread, show_metrics=self.show_metrics)
+
+	async def author(self, info, *, handle, page):
+		if self.thread_store is None:
+			raise query_error("Threads aren't stored on this server", code="not_found")
+
+		handle = handle.strip().lstrip("@")
+		if not HANDLE_PATTERN.match(handle):
+			raise query_error("Invalid handle", code="bad_request", param="handle", handle=handle)
+
+		page = parse_page(page)
+		total, threads = await self.thread_store.list_author_threads(
+			handle=handle,
+			offset=(page - 1) * api_server.AUTHOR_PAGE_SIZE,
+			limit=api_server.AUTHOR_PAGE_SIZE,
+		)
+
+		author = threads[0].first_tweet.user if threads else None
+		if self.opt_outs is not None and (
+			f"@{handle.lower()}" in self.opt_outs or
+			(author is not None and self.opt_outs.is_opted_out(author))
+		):
+			raise query_error("Author has opted out", code="opted_out", handle=handle)
+
+		if total == 0:
+			return None
+
+		return {
+			"handle": handle,
+			"author": api_server.user_json(author) if author is not None else None,
+			"total": total,
+			"page": page,
+			"pages": max(1, -(-total // api_server.AUTHOR_PAGE_SIZE)),
+			"threads": [api_server.thread_summary_json(summary) for summary in threads],
+		}
+
+	async def search(self, info, *, q, page, author=None, since=None, until=None):
+		if self.thread_store is None:
+			raise query_error("Search isn't enabled on this server", code="not_found")
+
+		query = q.strip()
+		if not query or len(query) > api_server.MAX_SEARCH_LENGTH:
+			raise query_error("Invalid search", code="bad_request", param="q")
+
+		if author is not None:
+			author = author.strip().lstrip("@") or None
+
+		since_date = parse_date(since, param="since")
+		until_date = parse_date(until, param="until")
+		page = parse_page(page)
+
+		try:
+			total, results = await self.thread_store.search_threads(
+				query=query,
+				author=author,
+				since=since_date,
+				until=until_date,
+				exclude_ids=self.opt_outs.user_ids() if self.opt_outs is not None else (),
+				exclude_handles=self.opt_outs.handles() if self.opt_outs is not None else (),
+				offset=(page - 1) * api_server.SEARCH_PAGE_SIZE,
+				limit=api_server.SEARCH_PAGE_SIZE,
+			)
+		except SearchUnavailableError:
+			raise query_error("Search isn't enabled on this server", code="not_found") from None
+
+		return {
+			"query": query,
+			"author": author,
+			"since": since_date.isoformat() if since_date is not None else None,
+			"until": until_date.isoformat() if until_date is not None else None,
+			"total": total,
+			"page": page,
+			"pages": max(1, -(-total // api_server.SEARCH_PAGE_SIZE)),
+			"results": [result.json() for result in results],
+		}
+
+
+async def read_request(request):
+	'''
+	Get the (query, variables, operation name) of a GraphQL request
+	'''
+	if request.method == "POST":
+		try:
+			body = await request.json()
+		except ValueError:
+			raise web_util.bad_request_json("Invalid JSON body") from None
+
+		if not isinstance(body, dict):
+			raise web_util.bad_request_json("Body must be a JSON object")
+	else:
+		body = dict(request.query)
+		if "variables" in body:
+			try:
+				body["variables"] = json.loads(body["variables"])
+			except ValueError:
+				raise web_util.bad_request_json("Invalid JSON", param="variables") from None
+
+	query = body.get("query")
+	variables = body.get("variables")
+	operation_name = body.get("operationName")
+
+	if not isinstance(query, str) or not query.strip():
+		raise web_util.bad_request_json("A query is required", param="query")
+	if len(query) > MAX_QUERY_LENGTH:
+		raise web_util.bad_request_json("Query too long", param="query", max_length=MAX_QUERY_LENGTH)
+	if variables is not None and not isinstance(variables, dict):
+		raise web_util.bad_request_json("variables must be an object", param="variables")
+	if operation_name is not None and not isinstance(operation_name, str):
+		raise web_util.bad_request_json("operationName must be a string", param="operationName")
+
+	return query, variables, operation_name
+
+
+@web_util.method_handler('GET', 'POST')
+async def handler(request, *, graphql_schema, get_thread, thread_store, opt_outs, show_metrics=True):
+	'''
+	Run a GraphQL query. Errors in individual fields are reported in the
+	result's errors, with the rest of the data, like GraphQL servers do;
+	queries that can't run at all get a 400.
+	'''
+	if graphql_schema is None:
+		raise web_util.not_found_json("GraphQL isn't enabled on this server")
+
+	query, variables, operation_name = await read_request(request)
+
+	result = await graphql.graphql(
+		graphql_schema,
+		query,
+		root_value=Query(
+			get_thread=get_thread,
+			thread_store=thread_store,
+			opt_outs=opt_outs,
+			show_metrics=show_metrics,
+		),
+		variable_values=variables,
+		operation_name=operation_name,
+	)
+
+	response = {"data": result.data}
+	if result.errors:
+		response["errors"] = [error.formatted for error in result.errors]
+
+	if result.data is None:
+		raise web.HTTPBadRequest(text=web_util.dump_json(**response), content_type="application/json")
+
+	return web.Response(text=web_util.dump_json(**response), content_type="application/json")
@@ -0,0 +1,275 @@
+# A gRPC server (see proto/bobbin.proto), for services that want threads
+# without going through the JSON API. It runs alongside the web server, on
+# grpc_port, with the same thread getter and store, and the same API keys:
+# if they're required, calls need an x-api-key in their metadata.
+#
+# This needs grpcio and protobuf, which are optional, and the messages
+# generated from the .proto file:
+#
+#     pip install bobbin[grpc]
+#     make grpc
+#
+# Only the messages are generated (as bobbin_pb2); the service is put
+# together here, so there's no generated servicer to keep in sync.
+
+from datetime import date
+import asyncio
+import logging
+
+import aiohttp
+
+from bobbin import api_server, permalinks
+from bobbin.api_keys import KEY_HEADER, InvalidApiKey, QuotaExceeded
+from bobbin.load_shedding import Overloaded
+from bobbin.optout import OptedOutError
+from bobbin.storage import SearchUnavailableError
+from bobbin.tweet_url import parse_tweet_id
+from bobbin.tweetbox import InvalidThreadError
+from bobbin.twitter import TwitterError, UnavailableTweetError
+
+try:
+	import grpc
+	from bobbin import bobbin_pb2
+except ImportError:
+	grpc = None
+
+logger = logging.getLogger(__name__)
+
+SERVICE = "bobbin.Bobbin"
+
+API_KEY_METADATA = KEY_HEADER.lower()
+
+
+def available():
+	return grpc is not None
+
+
+def user_message(user):
+	return bobbin_pb2.User(
+		id=str(user.id),
+		handle=user.handle,
+		name=user.name,
+		avatar_url=user.avatar_url or "",
+		bio=user.bio or "",
+		verified=bool(user.verified),
+		followers=user.followers or 0,
+		url=user.url or "",
+	)
+
+
+def media_message(media):
+	best_variant = media.best_variant()
+	return bobbin_pb2.Media(
+		type=media.type,
+		url=media.url or "",
+		media_url=media.media_url or "",
+		width=media.width or 0,
+		height=media.height or 0,
+		alt_text=media.alt_text or "",
+		video_url=best_variant.url if best_variant is not None else "",
+	)
+
+
+def tweet_message(tweet, *, show_metrics=True):
+	message = bobbin_pb2.Tweet(
+		id=str(tweet.id),
+		user=user_message(tweet.user),
+		parent_id=str(tweet.parent_id or ""),
+		text=tweet.text,
+		created_at=tweet.created_at.isoformat(),
+		urls=[
+			bobbin_pb2.Url(url=url.url, expanded_url=url.expanded_url or "", display_url=url.display_url or "")
+			for url in tweet.entities.urls
+		],
+		media=[media_message(media) for media in tweet.entities.media],
+		quoted_id=str(tweet.quoted_id or ""),
+		url=tweet.url or "",
+	)
+
+	if tweet.quoted is not None:
+		message.quoted.CopyFrom(tweet_message(tweet.quoted, show_metrics=show_metrics))
+
+	if show_metrics and tweet.metrics is not None:
+		message.metrics.CopyFrom(bobbin_pb2.Metrics(
+			likes=tweet.metrics.likes or 0,
+			retweets=tweet.metrics.retweets or 0,
+			replies=tweet.metrics.replies or 0,
+			quotes=tweet.metrics.quotes or 0,
+		))
+
+	return message
+
+
+def thread_message(thread, *, show_metrics=True):
+	message = bobbin_pb2.Thread(
+		ids=[str(tweet_id) for tweet_id in thread.ids],
+		tweets=[tweet_message(tweet, show_metrics=show_metrics) for tweet in thread],
+		unavailable=[bobbin_pb2.Gap(id=str(gap.id), reason=gap.reason or "") for gap in thread.gaps],
+		truncated=bool(thread.truncated),
+		fetched_at=thread.fetched_at.isoformat(),
+		permalink=permalinks.thread_permalink(thread),
+	)
+
+	if thread.author is not None:
+		message.author.CopyFrom(user_message(thread.author))
+
+	return message
+
+
+def search_result_message(result):
+	return bobbin_pb2.SearchResult(
+		tail=str(result.tail_id),
+		head=str(result.head_id),
+		author_id=str(result.author_id or ""),
+		handle=result.handle or "",
+		name=result.name or "",
+		tweet_count=result.tweet_count,
+		created_at=result.created_at.isoformat(),
+		resolved_at=result.resolved_at.isoformat(),
+		snippet=result.snippet or "",
+	)
+
+
+class BobbinService:
+	'''
+	The Bobbin service's methods, which are like the JSON API's handlers,
+	but with errors reported as gRPC statuses
+	'''
+	def __init__(self, *, get_thread, thread_store=None, opt_outs=None, api_keys=None, show_metrics=True):
+		self.get_thread = get_thread
+		self.thread_store = thread_store
+		self.opt_outs = opt_outs
+		self.api_keys = api_keys
+		self.show_metrics = show_metrics
+
+	async def check_api_key(self, context):
+		if self.api_keys is None:
+			return
+
+		metadata = dict(context.invocation_metadata())
+		try:
+			key = self.api_keys.authenticate(metadata.get(API_KEY_METADATA))
+			self.api_keys.spend(key)
+		except InvalidApiKey:
+			await context.abort(grpc.StatusCode.UNAUTHENTICATED, f"A valid API key is required in {API_KEY_METADATA}")
+		except QuotaExceeded:
+			await context.abort(grpc.StatusCode.RESOURCE_EXHAUSTED, "Daily quota exceeded")
+
+	async def parse_tweet_id(self, context, value, *, param):
+		tweet_id = parse_tweet_id(value)
+		if tweet_id is None or not api_server.is_valid_tweet_id(tweet_id):
+			await context.abort(grpc.StatusCode.INVALID_ARGUMENT, f"Invalid tweet id in {param}")
+		return tweet_id
+
+	async def require_thread_store(self, context):
+		if self.thread_store is None:
+			await context.abort(grpc.StatusCode.UNIMPLEMENTED, "Threads aren't stored on this server")
+
+	async def ResolveThread(self, request, context):
+		await self.check_api_key(context)
+
+		tail_id = await self.parse_tweet_id(context, request.tail, param="tail")
+		head_id = await self.parse_tweet_id(context, request.head, param="head") if request.head else None
+
+		try:
+			thread = await self.get_thread(tail=tail_id, head=head_id)
+		except UnavailableTweetError as e:
+			await context.abort(grpc.StatusCode.NOT_FOUND, f"Tweet unavailable: {e.reason}")
+		except InvalidThreadError:
+			await context.abort(grpc.StatusCode.INVALID_ARGUMENT, "Head isn't in the thread")
+		except OptedOutError:
+			await context.abort(grpc.StatusCode.PERMISSION_DENIED, "Author has opted out")
+		except Overloaded:
+			await context.abort(grpc.StatusCode.UNAVAILABLE, "Too many threads being resolved")
+		except (TwitterError, aiohttp.ClientError, asyncio.TimeoutError):
+			logger.exception("Error resolving thread")
+			await context.abort(grpc.StatusCode.UNAVAILABLE, "Error from twitter")
+
+		return thread_message(thread, show_metrics=self.show_metrics)
+
+	async def GetThread(self, request, context):
+		await self.check_api_key(context)
+		await self.require_thread_store(context)
+
+		tail_id = await self.parse_tweet_id(context, request.tail, param="tail")
+		thread = await self.thread_store.get_thread(tail=tail_id)
+		if thread is None:
+			await context.abort(grpc.StatusCode.NOT_FOUND, "Thread isn't stored")
+
+		if self.opt_outs is not None and any(self.opt_outs.is_opted_out(tweet.user) for tweet in thread):
+			await context.abort(grpc.StatusCode.PERMISSION_DENIED, "Author has opted out")
+
+		return thread_message(thread, show_metrics=self.show_metrics)
+
+	async def SearchThreads(self, request, context):
+		await self.check_api_key(context)
+		await self.require_thread_store(context)
+
+		query = request.query.strip()
+		if not query or len(query) > api_server.MAX_SEARCH_LENGTH:
+			await context.abort(grpc.StatusCode.INVALID_ARGUMENT, "Invalid search")
+
+		dates = {}
+		for param in ("since", "until"):
+			value = getattr(request, param)
+			try:
+				dates[param] = date.fromisoformat(value) if value else None
+			except ValueError:
+				await context.abort(grpc.StatusCode.INVALID_ARGUMENT, f"Invalid date in {param}; use YYYY-MM-DD")
+
+		page = request.page or 1
+
+		try:
+			total, results = await self.thread_store.search_threads(
+				query=query,
+				author=request.author.strip().lstrip("@") or None,
+				since=dates["since"],
+				until=dates["until"],
+				exclude_ids=self.opt_outs.user_ids() if self.opt_outs is not None else (),
+				exclude_handles=self.opt_outs.handles() if self.opt_outs is not None else (),
+				offset=(page - 1) * api_server.SEARCH_PAGE_SIZE,
+				limit=api_server.SEARCH_PAGE_SIZE,
+			)
+		except SearchUnavailableError:
+			await context.abort(grpc.StatusCode.UNIMPLEMENTED, "Search isn't enabled on this server")
+
+		return bobbin_pb2.SearchThreadsResponse(
+			total=total,
+			page=page,
+			pages=max(1, -(-total // api_server.SEARCH_PAGE_SIZE)),
+			results=[search_result_message(result) for result in results],
+		)
+
+
+def make_handler(service):
+	'''
+	Make the generic handler that routes calls to service's methods
+	'''
+	methods = {
+		"ResolveThread": bobbin_pb2.ResolveThreadRequest,
+		"GetThread": bobbin_pb2.GetThreadRequest,
+		"SearchThreads": bobbin_pb2.SearchThreadsRequest,
+	}
+
+	return grpc.method_handlers_generic_handler(SERVICE, {
+		name: grpc.unary_unary_rpc_method_handler(
+			getattr(service, name),
+			request_deserializer=request_class.FromString,
+			response_serializer=lambda message: message.SerializeToString(),
+		)
+		for name, request_class in methods.items()
+	})
+
+
+async def start(service, *, host, port):
+	'''
+	Start serving service on host and port. Returns the grpc.aio.Server, for
+	stopping it later.
+	'''
+	server = grpc.aio.server()
+	server.add_generic_rpc_handlers((make_handler(service),))
+	server.add_insecure_port(f"{host}:{port}")
+	await server.start()
+
+	logger.info("gRPC server listening on %s:%d", host, port)
+	return server
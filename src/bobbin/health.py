@@ -0,0 +1,163 @@
+# Health checks, for load balancers and orchestrators. /healthz is a liveness
+# check: it only says that the server is up and handling requests. /readyz is
+# a readiness check: it checks each of the things bobbin depends on, and
+# reports on each of them, with a 503 if any of them failed.
+#
+# The twitter check makes a real (but cheap) API call, so readiness results
+# are reused for a little while, rather than spending API budget on every
+# probe.
+
+from collections import namedtuple
+import asyncio
+import logging
+import time
+
+from aiohttp import web
+
+from bobbin import web_util
+from bobbin.async_cache import KeyNotFound
+
+logger = logging.getLogger(__name__)
+
+# @Twitter's user id; looking it up is about the cheapest call there is
+PROBE_USER_ID = "783214"
+
+# A cache key that's never written, for checking the cache
+PROBE_CACHE_KEY = "bobbin-health-probe"
+
+
+class CheckResult(namedtuple("CheckResult", "ok duration error")):
+	__slots__ = ()
+
+	def json(self):
+		result = {"ok": self.ok, "duration": round(self.duration, 3)}
+		if self.error is not None:
+			result["error"] = self.error
+		return result
+
+
+class HealthChecks:
+	'''
+	The readiness checks. store may be None, in which case the database isn't
+	checked. Each check has timeout seconds to pass, and results are reused
+	for cache_ttl seconds.
+	'''
+	def __init__(self, *, session, token, api, cache, store=None, timeout=5, cache_ttl=30, clock=time.monotonic):
+		self.session = session
+		self.token = token
+		self.api = api
+		self.cache = cache
+		self.store = store
+		self.timeout = timeout
+		self.cache_ttl = cache_ttl
+		self.clock = clock
+
+		# (time, results) of the last run
+		self.last = None
+		self.running = None
+
+	async def check_token(self):
+		# A TokenPool is ready if any of its tokens is
+		tokens = self.token.active_tokens() if hasattr(self.token, "active_tokens") else [self.token]
+		errors = []
+
+		for token in tokens:
+			try:
+				await token.get_token()
+				return
+			except asyncio.CancelledError:
+				raise
+			except Exception as e:
+				errors.append(e)
+
+		raise errors[-1]
+
+	async def check_cache(self):
+		try:
+			await self.cache.get(PROBE_CACHE_KEY)
+		except KeyNotFound:
+			pass
+
+	async def check_database(self):
+		await self.store.count_threads()
+
+	async def check_twitter(self):
+		await self.api.get_user(session=self.session, token=self.token, user_id=PROBE_USER_ID)
+
+	def checks(self):
+		checks = {
+			"token": self.check_token,
+			"cache": self.check_cache,
+			"twitter": self.check_twitter,
+		}
+
+		if self.store is not None:
+			checks["database"] = self.check_database
+
+		return checks
+
+	async def run_check(self, name, check):
+		start = self.clock()
+
+		try:
+			await asyncio.wait_for(check(), self.timeout)
+		except asyncio.CancelledError:
+			raise
+		except asyncio.TimeoutError:
+			return CheckResult(False, self.clock() - start, "Timed out")
+		except Exception as e:
+			logger.warning("Readiness check %s failed", name, exc_info=True)
+			return CheckResult(False, self.clock() - start, f"{type(e).__name__}: {e}")
+
+		return CheckResult(True, self.clock() - start, None)
+
+	async def run_all(self):
+		checks = self.checks()
+		results = await asyncio.gather(*(
+			self.run_check(name, check)
+			for name, check in checks.items()
+		))
+		return dict(zip(checks, results))
+
+	async def results(self):
+		'''
+		Get the results of all the checks, as a dict of name to CheckResult.
+		Concurrent calls share a single run.
+		'''
+		if self.last is not None:
+			checked_at, results = self.last
+			if self.clock() - checked_at < self.cache_ttl:
+				return results
+
+		running = self.running
+		if running is None:
+			running = self.running = asyncio.ensure_future(self.run_all())
+			running.add_done_callback(lambda task: setattr(self, "running", None))
+
+		results = await asyncio.shield(running)
+		self.last = (self.clock(), results)
+		return results
+
+
+@web_util.method_handler('GET', 'HEAD')
+async def healthz_handler(request):
+	return web.Response(
+		text=web_util.dump_json(ok=True),
+		content_type="application/json",
+	)
+
+
+@web_util.method_handler('GET', 'HEAD')
+async def readyz_handler(request, *, health_checks):
+	results = await health_checks.results() if health_checks is not None else {}
+	ok = all(result.ok for result in results.values())
+
+	return web.Response(
+		status=200 if ok else 503,
+		text=web_util.dump_json(
+			ok=ok,
+			checks={name: result.json() for name, result in results.items()},
+		),
+		content_type="application/json",
+		headers={"Cache-Control": "no-store"},
+	)
@@ -0,0 +1,174 @@
+# An HTTP cache for twitter API requests, as middleware (see bobbin.middleware).
+# GET responses that carry an ETag or Last-Modified validator are kept, and
+# the next request for the same url and parameters is made conditional, with
+# If-None-Match or If-Modified-Since. A 304 Not Modified is answered from the
+# cache, so unchanged tweets and users aren't downloaded again.
+#
+# Responses that say how long they're fresh for, with Cache-Control: max-age
+# or Expires, are also kept, and are answered from the cache without asking
+# twitter at all until then; a 304 starts their freshness over. no-cache
+# responses are always revalidated, and no-store ones are never kept.
+#
+# Responses are keyed by url and query parameters only, not by token, so the
+# cache is shared by every endpoint and every token in the pool; everything
+# bobbin asks twitter for with app auth is public anyway. For the same
+# reason, it goes in front of all the client's middleware (see
+# twitter.Token), rather than with the rest: a fresh hit never waits on a
+# token's rate limits, and the stale rate limit headers it carries never
+# reach them, while a revalidation is rate limited like any other request.
+
+from datetime import datetime, timezone
+from email.utils import parsedate_to_datetime
+import json
+import time
+
+import cachetools
+
+from bobbin.middleware import ApiResponse
+
+
+def cache_key(url, params):
+	return url, tuple(sorted((str(key), str(value)) for key, value in (params or {}).items()))
+
+
+def cache_control(headers):
+	'''
+	Get the Cache-Control directives in headers, as a dict of name to value,
+	or None for directives without one
+	'''
+	directives = {}
+	for directive in headers.get("cache-control", "").split(","):
+		name, _, value = directive.partition("=")
+		if name.strip():
+			directives[name.strip().lower()] = value.strip().strip('"') if value else None
+	return directives
+
+
+def parse_http_date(value):
+	try:
+		parsed = parsedate_to_datetime(value)
+	except (TypeError, ValueError, IndexError):
+		return None
+
+	return parsed if parsed.tzinfo is not None else parsed.replace(tzinfo=timezone.utc)
+
+
+def freshness_lifetime(headers, *, now=None):
+	'''
+	How many more seconds a response with headers is fresh for, from
+	Cache-Control max-age, or else Expires, less its Age. 0 if it has to be
+	revalidated before it's used again.
+	'''
+	directives = cache_control(headers)
+	if "no-cache" in directives:
+		return 0
+
+	if directives.get("max-age") is not None:
+		try:
+			lifetime = int(directives["max-age"])
+		except ValueError:
+			return 0
+	elif "expires" in headers:
+		# An invalid Expires, like 0, means already expired
+		expires = parse_http_date(headers["expires"])
+		if expires is None:
+			return 0
+
+		date = parse_http_date(headers["date"]) if "date" in headers else None
+		if date is None:
+			date = now if now is not None else datetime.now(timezone.utc)
+
+		lifetime = (expires - date).total_seconds()
+	else:
+		return 0
+
+	try:
+		age = int(headers.get("age", 0))
+	except ValueError:
+		age = 0
+
+	return max(0, lifetime - age)
+
+
+def is_storable(headers):
+	if "no-store" in cache_control(headers):
+		return False
+
+	return "etag" in headers or "last-modified" in headers or freshness_lifetime(headers) > 0
+
+
+class CacheEntry:
+	'''
+	A cached response. The body is kept serialized, so that every hit gets
+	its own copy. It's served without a request until fresh_until.
+	'''
+	__slots__ = ("body", "headers", "fresh_until")
+
+	def __init__(self, body, headers, fresh_until):
+		self.body = body
+		self.headers = headers
+		self.fresh_until = fresh_until
+
+	def response(self):
+		return ApiResponse(200, self.headers, json.loads(self.body))
+
+
+class HTTPCache:
+	'''
+	Middleware caching responses with validators or a freshness lifetime, up
+	to max_size bytes of (serialized) response bodies in total. timer is a
+	monotonic clock, in seconds.
+	'''
+	def __init__(self, *, max_size, timer=time.monotonic):
+		self.max_size = max_size
+		self.timer = timer
+		self.entries = cachetools.LRUCache(max_size, getsizeof=lambda entry: len(entry.body))
+
+	def fresh_until(self, headers):
+		return self.timer() + freshness_lifetime(headers)
+
+	def store(self, key, body, headers):
+		entry = CacheEntry(json.dumps(body, separators=(",", ":")), headers, self.fresh_until(headers))
+		if len(entry.body) > self.max_size:
+			self.entries.pop(key, None)
+			return
+		self.entries[key] = entry
+
+	def __call__(self, send):
+		async def cache_handler(request):
+			key = cache_key(request.url, request.params)
+			entry = self.entries.get(key)
+
+			if entry is not None and self.timer() < entry.fresh_until:
+				return entry.response()
+
+			if entry is not None:
+				validators = {}
+				if "etag" in entry.headers:
+					validators["If-None-Match"] = entry.headers["etag"]
+				if "last-modified" in entry.headers:
+					validators["If-Modified-Since"] = entry.headers["last-modified"]
+				request = request.with_headers(validators)
+
+			response = await send(request)
+
+			if response.status == 304 and entry is not None:
+				# The 304's headers are newer, rate limit headers especially,
+				# and it may say how long the response is fresh for now. The
+				# cached response's Age no longer applies.
+				entry.headers = {
+					**{name: value for name, value in entry.headers.items() if name != "age"},
+					**response.headers,
+				}
+				entry.fresh_until = self.fresh_until(entry.headers)
+				return entry.response()
+
+			if response.status == 200:
+				if response.body is not None and is_storable(response.headers):
+					self.store(key, response.body, response.headers)
+				else:
+					self.entries.pop(key, None)
+
+			return response
+
+		return cache_handler
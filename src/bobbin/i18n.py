@@ -0,0 +1,109 @@
+# Localization of the strings that the server renders itself (the rest of the
+# UI is localized by the frontend; see frontend-src/i18n.jsx). The language
+# for a request is the ?lang query parameter, if there's a catalog for it, or
+# else the best match for the Accept-Language header.
+#
+# To add a language, add a catalog here and in frontend-src/messages, under
+# the same language code. Messages missing from a catalog fall back to
+# English.
+
+import re
+
+DEFAULT_LANGUAGE = "en"
+
+CATALOGS = {
+	"en": {
+		"conversation": "Conversation",
+		"thread_by": "Thread by {name} (@{handle})",
+		"view_on_bobbin": "View on Bobbin",
+		"read_whole_thread": "Read the whole thread ({count} tweets) on Bobbin",
+		"image_without_description": "Image without a description",
+		"video_without_description": "Video without a description",
+		"likes_one": "{count} like",
+		"likes_other": "{count} likes",
+		"retweets_one": "{count} retweet",
+		"retweets_other": "{count} retweets",
+		"replies_one": "{count} reply",
+		"replies_other": "{count} replies",
+		"thread_total": "Thread total: {metrics}",
+		"tweets_one": "{count} tweet",
+		"tweets_other": "{count} tweets",
+		"votes_one": "{count} vote",
+		"votes_other": "{count} votes",
+		"poll_final": "Final results",
+		"poll_ends": "Ends {time}",
+	},
+}
+
+LANGUAGE_RANGE_PATTERN = re.compile(r"^\s*([a-zA-Z]{1,8}(?:-[a-zA-Z0-9]{1,8})*|\*)\s*(?:;\s*q\s*=\s*([0-9.]+))?\s*$")
+
+
+def parse_accept_language(header):
+	'''
+	Get the language tags in an Accept-Language header, most preferred first.
+	Malformed entries, and ones with q=0, are ignored.
+	'''
+	ranges = []
+
+	for index, entry in enumerate((header or "").split(",")):
+		match = LANGUAGE_RANGE_PATTERN.match(entry)
+		if match is None:
+			continue
+
+		tag, quality = match.groups()
+		try:
+			quality = float(quality) if quality is not None else 1.0
+		except ValueError:
+			continue
+
+		if quality > 0:
+			# Sorting by index too keeps ties in their original order
+			ranges.append((-quality, index, tag.lower()))
+
+	return [tag for _, _, tag in sorted(ranges)]
+
+
+def negotiate_language(candidates, available=CATALOGS):
+	'''
+	Get the first of candidates that there's a catalog for, also trying just
+	the primary language of each (so "pt-BR" can be served "pt"), or the
+	default language if there are none
+	'''
+	for candidate in candidates:
+		candidate = candidate.lower()
+		if candidate in available:
+			return candidate
+
+		primary = candidate.split("-", 1)[0]
+		if primary in available:
+			return primary
+
+	return DEFAULT_LANGUAGE
+
+
+def request_language(request):
+	candidates = parse_accept_language(request.headers.get("Accept-Language"))
+
+	override = request.query.get("lang")
+	if override:
+		candidates.insert(0, override)
+
+	return negotiate_language(candidates)
+
+
+def translate(language, key, **params):
+	catalog = CATALOGS.get(language, CATALOGS[DEFAULT_LANGUAGE])
+	message = catalog.get(key)
+	if message is None:
+		message = CATALOGS[DEFAULT_LANGUAGE][key]
+
+	return message.format(**params)
+
+
+def translate_count(language, key, count):
+	'''
+	Translate a message about count things, from the key_one or key_other
+	message, depending on whether there's one of them
+	'''
+	suffix = "one" if count == 1 else "other"
+	return translate(language, f"{key}_{suffix}", count=f"{count:,}")
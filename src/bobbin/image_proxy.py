@@ -0,0 +1,327 @@
+# An image proxy for thread photos, at /img?url=...&s=...&w=..., which
+# fetches the image at url, shrinks it to w pixels wide, and re-encodes it as
+# AVIF or WebP if the browser accepts them (and the installed Pillow can
+# write them). The results are cached, in memory and, if there is one, under
+# img/ in the site's blob store, so each size of each image is only made once.
+#
+# So that the proxy can't be used to fetch arbitrary things, urls are signed:
+# s is an HMAC of url with the proxy's secret, and only the urls of images
+# in threads (see ImageProxy.proxy_thread) are ever signed. Widths are limited
+# to WIDTHS, so that one signed url can't fill the cache with every possible
+# size.
+#
+# Like share images, this needs Pillow, which is optional:
+#
+#     pip install bobbin[image-proxy]
+#
+# Pillow can write WebP if it was built with libwebp, which the wheels are.
+# AVIF needs a plugin, like pillow-avif-plugin; without one, browsers that
+# only accept AVIF get WebP or the original format instead.
+
+from io import BytesIO
+from urllib.parse import quote, urlsplit
+import asyncio
+import functools
+import hashlib
+import hmac
+import logging
+
+import aiohttp
+import cachetools
+
+from bobbin.link_cards import UnsafeUrlError, check_url, read_limited
+
+try:
+	from PIL import Image, ImageOps
+except ImportError:
+	Image = None
+
+# Registers an AVIF plugin with Pillow, if it's installed
+try:
+	import pillow_avif  # noqa: F401
+except ImportError:
+	pass
+
+logger = logging.getLogger(__name__)
+
+USER_AGENT = "Mozilla/5.0 (compatible; bobbin image proxy)"
+
+WIDTHS = frozenset({120, 240, 360, 480, 640, 800, 1080, 1200, 1600, 2048})
+
+# Images bigger than this (in pixels, not bytes) aren't decoded at all
+MAX_PIXELS = 64 * 1024 * 1024
+
+QUALITY = 80
+
+# Pillow format -> content type
+FORMATS = {
+	"AVIF": "image/avif",
+	"WEBP": "image/webp",
+	"JPEG": "image/jpeg",
+	"PNG": "image/png",
+	"GIF": "image/gif",
+}
+
+STORE_PREFIX = "img/"
+
+
+def available():
+	return Image is not None
+
+
+def can_save(image_format):
+	if Image is None:
+		return False
+
+	# Pillow loads its own plugins lazily
+	Image.init()
+	return image_format in Image.SAVE
+
+
+def negotiate_format(accept):
+	'''
+	Pick the best format for a response from its request's Accept header, or
+	None to keep the image's own format
+	'''
+	accept = accept or ""
+	for image_format in ("AVIF", "WEBP"):
+		if FORMATS[image_format] in accept and can_save(image_format):
+			return image_format
+
+	return None
+
+
+def sniff_type(data):
+	'''
+	Get the content type of an image from its first bytes, since not every
+	blob store keeps them
+	'''
+	if data.startswith(b"\xff\xd8\xff"):
+		return "image/jpeg"
+	elif data.startswith(b"\x89PNG"):
+		return "image/png"
+	elif data.startswith(b"GIF8"):
+		return "image/gif"
+	elif data[:4] == b"RIFF" and data[8:12] == b"WEBP":
+		return "image/webp"
+	elif data[4:12] in (b"ftypavif", b"ftypavis"):
+		return "image/avif"
+	else:
+		return None
+
+
+def sign(secret, url):
+	return hmac.new(secret.encode(), url.encode(), hashlib.sha256).hexdigest()[:32]
+
+
+def check_signature(secret, url, signature):
+	return hmac.compare_digest(sign(secret, url).encode(), signature.encode())
+
+
+def transform_image(data, *, width=None, image_format=None):
+	'''
+	Shrink the image in data to width, if it's wider, and re-encode it as
+	image_format. Returns (data, Pillow format). Animated images are left as
+	they are.
+	'''
+	image = Image.open(BytesIO(data))
+	if image.width * image.height > MAX_PIXELS:
+		raise ValueError(f"Image too large: {image.width}x{image.height}")
+
+	source_format = image.format
+	if getattr(image, "is_animated", False) or source_format not in FORMATS:
+		return data, source_format
+
+	# Photos from phones are often stored sideways, with a rotation tag
+	image = ImageOps.exif_transpose(image)
+
+	if width is not None and image.width > width:
+		height = max(1, round(image.height * width / image.width))
+		image = image.resize((width, height), Image.LANCZOS)
+
+	if image_format is None:
+		image_format = "PNG" if source_format in ("PNG", "GIF") or image.mode in ("RGBA", "LA", "P") else "JPEG"
+
+	if image_format == "JPEG" and image.mode not in ("RGB", "L"):
+		image = image.convert("RGB")
+
+	output = BytesIO()
+	if image_format == "PNG":
+		image.save(output, image_format, optimize=True)
+	else:
+		image.save(output, image_format, quality=QUALITY)
+	return output.getvalue(), image_format
+
+
+class ImageProxy:
+	'''
+	Fetches images with session, which should only connect to public
+	addresses (see link_cards.make_card_session), and resizes them. Images
+	larger than max_bytes, or that take longer than timeout seconds to fetch,
+	aren't proxied. The last cache_size results are kept in memory, and if
+	there's a store (a blob_store.BlobStore), every result is saved to it.
+	Signed urls point at url_prefix. Images already under url_prefix, or any
+	of local_prefixes (like mirrored media), are left alone.
+	'''
+	def __init__(
+		self,
+		session,
+		secret,
+		*,
+		url_prefix="/img",
+		local_prefixes=(),
+		store=None,
+		timeout=10,
+		max_bytes=20 * 1024 * 1024,
+		max_concurrent=4,
+		cache_size=256,
+	):
+		self.session = session
+		self.secret = secret
+		self.url_prefix = url_prefix
+		self.local_prefixes = (url_prefix, *(prefix.rstrip("/") + "/" for prefix in local_prefixes))
+		self.store = store
+		self.timeout = timeout
+		self.max_bytes = max_bytes
+		self.max_concurrent = max_concurrent
+		self.cache = cachetools.LRUCache(cache_size)
+
+		self.semaphore = None
+
+	def proxy_url(self, url):
+		'''
+		Get the signed proxy url for the image at url. Clients add &w= to
+		pick a size.
+		'''
+		return f"{self.url_prefix}?url={quote(url, safe='')}&s={sign(self.secret, url)}"
+
+	def is_proxyable(self, url):
+		return is_proxyable(url) and not url.startswith(self.local_prefixes)
+
+	def is_valid(self, url, signature):
+		return check_signature(self.secret, url, signature)
+
+	async def proxy_thread(self, thread):
+		'''
+		Serve the images in all the tweets in thread through the proxy (see
+		tweetbox.make_thread_getter's transforms)
+		'''
+		async def proxy(tweet):
+			return proxy_tweet(tweet, self)
+
+		return await thread.map_tweets(proxy)
+
+	async def fetch_uncached(self, url):
+		check_url(url)
+
+		async with self.session.get(url, allow_redirects=False, headers={"User-Agent": USER_AGENT}) as response:
+			if response.status != 200:
+				logger.info("Couldn't proxy %s: status %s", url, response.status)
+				return None
+
+			body = await read_limited(response, self.max_bytes)
+			if body is None:
+				logger.info("Couldn't proxy %s: larger than %d bytes", url, self.max_bytes)
+			return body
+
+	async def fetch(self, url):
+		if self.semaphore is None:
+			self.semaphore = asyncio.Semaphore(self.max_concurrent)
+
+		async with self.semaphore:
+			try:
+				return await asyncio.wait_for(self.fetch_uncached(url), self.timeout)
+			except asyncio.CancelledError:
+				raise
+			except (aiohttp.ClientError, asyncio.TimeoutError, OSError, UnsafeUrlError) as e:
+				logger.info("Couldn't proxy %s: %r", url, e)
+				return None
+
+	async def load(self, key):
+		if self.store is None:
+			return None
+
+		try:
+			blob = await self.store.get(STORE_PREFIX + key)
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, OSError) as e:
+			logger.warning("Couldn't load proxied image %s: %r", key, e)
+			return None
+
+		if blob is None:
+			return None
+
+		content_type = sniff_type(blob[0])
+		return (blob[0], content_type) if content_type is not None else None
+
+	async def save(self, key, content_type, data):
+		if self.store is None:
+			return
+
+		try:
+			await self.store.put(STORE_PREFIX + key, data, content_type)
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, OSError) as e:
+			logger.warning("Couldn't save proxied image %s: %r", key, e)
+
+	async def get(self, url, *, width=None, image_format=None):
+		'''
+		Get (body, content type) for the image at url, at most width pixels
+		wide, in image_format (see negotiate_format), or None if it couldn't
+		be fetched or isn't an image
+		'''
+		key = hashlib.sha256(f"{url}\n{width or ''}\n{image_format or ''}".encode()).hexdigest()
+		try:
+			return self.cache[key]
+		except KeyError:
+			pass
+
+		result = await self.load(key)
+		if result is not None:
+			self.cache[key] = result
+			return result
+
+		data = await self.fetch(url)
+		if data is None:
+			return None
+
+		try:
+			data, actual_format = await asyncio.get_event_loop().run_in_executor(None, functools.partial(
+				transform_image,
+				data,
+				width=width,
+				image_format=image_format,
+			))
+		except (OSError, ValueError, Image.DecompressionBombError) as e:
+			logger.info("Couldn't proxy %s: %r", url, e)
+			return None
+
+		if actual_format not in FORMATS:
+			logger.info("Couldn't proxy %s: unsupported format %s", url, actual_format)
+			return None
+
+		result = self.cache[key] = (data, FORMATS[actual_format])
+		await self.save(key, FORMATS[actual_format], data)
+		return result
+
+
+def is_proxyable(url):
+	return bool(url) and urlsplit(url).scheme in ("http", "https")
+
+
+def proxy_tweet(tweet, proxy):
+	# Only photos are proxied; videos keep their own urls, but their
+	# thumbnails (in media_url) are images too
+	media = tuple(
+		item._replace(media_url=proxy.proxy_url(item.media_url)) if proxy.is_proxyable(item.media_url) else item
+		for item in tweet.entities.media
+	)
+	quoted = proxy_tweet(tweet.quoted, proxy) if tweet.quoted is not None else None
+
+	if media == tweet.entities.media and quoted == tweet.quoted:
+		return tweet
+
+	return tweet._replace(entities=tweet.entities._replace(media=media), quoted=quoted)
+
@@ -0,0 +1,193 @@
+# A queue of thread resolution jobs. Rather than every API request resolving
+# its thread directly, threads are resolved by a fixed number of workers, so
+# that a burst of requests for long threads can't start an unbounded number
+# of resolutions at once. Requests wait a little while for their job; if it
+# isn't done by then, the client is told to come back later, and can poll the
+# job until it finishes.
+
+from collections import namedtuple
+import asyncio
+import time
+
+import cachetools
+
+
+PENDING = "pending"
+RUNNING = "running"
+DONE = "done"
+FAILED = "failed"
+
+
+class JobPending(Exception):
+	'''
+	The job didn't finish in the time we were willing to wait for it
+	'''
+	def __init__(self, job):
+		super().__init__(job.id)
+		self.job = job
+
+
+class JobQueueFull(Exception):
+	pass
+
+
+class JobKey(namedtuple("JobKey", "tail head")):
+	__slots__ = ()
+
+	@property
+	def id(self):
+		return self.tail if self.head is None else f"{self.tail}-{self.head}"
+
+
+class Job:
+	'''
+	A single thread resolution. result is a future for the resolved Thread.
+	'''
+	__slots__ = ('key', 'state', 'result', 'created_at', 'finished_at')
+
+	def __init__(self, key, *, loop):
+		self.key = key
+		self.state = PENDING
+		self.result = loop.create_future()
+		self.created_at = time.time()
+		self.finished_at = None
+
+	@property
+	def id(self):
+		return self.key.id
+
+	@property
+	def error(self):
+		if self.state != FAILED:
+			return None
+		return self.result.exception()
+
+
+class JobQueue:
+	'''
+	Resolves threads with resolve (a get_thread function, as from
+	tweetbox.make_thread_getter) using at most workers concurrent
+	resolutions. At most max_queued jobs may be waiting at once; finished
+	jobs are remembered for result_ttl seconds, so that clients can poll
+	them. wait is how long get_thread waits for a job by default.
+
+	Identical requests share a job, so a thread that's already being
+	resolved isn't queued again.
+	'''
+	def __init__(self, resolve, *, workers=4, max_queued=1000, result_ttl=300, wait=5, loop=None):
+		self.resolve = resolve
+		self.loop = loop if loop is not None else asyncio.get_event_loop()
+		self.queue = asyncio.Queue(max_queued)
+		self.worker_count = workers
+		self.wait = wait
+		self.workers = []
+
+		# JobKey -> Job, for pending and running jobs
+		self.active = {}
+
+		# job id -> Job, for recently finished jobs
+		self.finished = cachetools.TTLCache(max_queued, result_ttl)
+
+	def start(self):
+		self.workers = [
+			asyncio.ensure_future(self.worker(), loop=self.loop)
+			for _ in range(self.worker_count)
+		]
+
+	async def close(self):
+		for worker in self.workers:
+			worker.cancel()
+
+		await asyncio.gather(*self.workers, return_exceptions=True)
+		self.workers = []
+
+		for job in self.active.values():
+			job.result.cancel()
+
+	def submit(self, *, tail, head=None):
+		'''
+		Get the Job resolving the thread, queueing a new one if there isn't
+		one already. Raises JobQueueFull if there's no room for it.
+		'''
+		key = JobKey(tail, head)
+
+		job = self.active.get(key)
+		if job is not None:
+			return job
+
+		job = Job(key, loop=self.loop)
+
+		try:
+			self.queue.put_nowait(job)
+		except asyncio.QueueFull:
+			raise JobQueueFull() from None
+
+		self.active[key] = job
+		return job
+
+	def get_job(self, job_id):
+		'''
+		Get a pending, running, or recently finished job by id, or None
+		'''
+		for job in self.active.values():
+			if job.id == job_id:
+				return job
+
+		return self.finished.get(job_id)
+
+	def stats(self):
+		states = [job.state for job in self.active.values()]
+		return {
+			"workers": self.worker_count,
+			"pending": states.count(PENDING),
+			"running": states.count(RUNNING),
+			"finished": len(self.finished),
+		}
+
+	async def get_thread(self, *, tail, head=None, timeout=None):
+		'''
+		Resolve a thread through the queue, waiting at most timeout seconds
+		(default self.wait) for it. If it takes longer, JobPending is raised,
+		and the job keeps running in the background.
+		'''
+		job = self.submit(tail=tail, head=head)
+
+		try:
+			return await asyncio.wait_for(
+				asyncio.shield(job.result),
+				timeout if timeout is not None else self.wait,
+			)
+		except asyncio.TimeoutError:
+			raise JobPending(job) from None
+
+	async def worker(self):
+		while True:
+			job = await self.queue.get()
+
+			try:
+				await self.run(job)
+			finally:
+				self.queue.task_done()
+
+	async def run(self, job):
+		job.state = RUNNING
+
+		try:
+			thread = await self.resolve(tail=job.key.tail, head=job.key.head)
+		except asyncio.CancelledError:
+			job.result.cancel()
+			raise
+		except Exception as e:
+			job.state = FAILED
+			job.result.set_exception(e)
+			# Make sure nobody has to retrieve the exception
+			job.result.exception()
+		else:
+			job.state = DONE
+			job.result.set_result(thread)
+		finally:
+			job.finished_at = time.time()
+			self.active.pop(job.key, None)
+
+			if job.state in (DONE, FAILED):
+				self.finished[job.id] = job
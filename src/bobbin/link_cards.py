@@ -0,0 +1,340 @@
+# Link preview cards, like the ones twitter shows under tweets with links.
+# The first link in a tweet is fetched, and its Open Graph (or twitter card)
+# metadata made into a Card with a title, description, and image.
+#
+# Unlike shortened links (see unshorten), these links can go anywhere, so
+# fetching them is careful about where it goes: only http and https urls on
+# the default ports are fetched, and hostnames are only connected to if
+# every address they resolve to is public (see PublicResolver), so a tweet
+# can't make us request things on our own network. Redirects are followed
+# by hand, so that each hop is checked too. Only the first max_bytes of a
+# page are read, which is plenty for its <head>.
+
+from collections import namedtuple
+from html.parser import HTMLParser
+from urllib.parse import urljoin, urlsplit
+import asyncio
+import ipaddress
+import logging
+import socket
+import time
+
+import aiohttp
+from aiohttp.resolver import DefaultResolver
+import cachetools
+
+from bobbin import transport
+from bobbin.tweet_text import safe_url
+from bobbin.tweet_url import parse_tweet_id
+from bobbin.unshorten import url_host
+
+logger = logging.getLogger(__name__)
+
+USER_AGENT = "Mozilla/5.0 (compatible; bobbin link preview)"
+
+MAX_TITLE_LENGTH = 200
+MAX_DESCRIPTION_LENGTH = 300
+
+ALLOWED_PORTS = (None, 80, 443)
+
+
+class UnsafeUrlError(ValueError):
+	pass
+
+
+class PublicResolver(DefaultResolver):
+	'''
+	A resolver for aiohttp connectors that refuses to resolve hostnames to
+	anything but public addresses. Checking at connection time, rather than
+	resolving names ahead of time, means a name can't resolve to a public
+	address when it's checked and a private one when it's used.
+	'''
+	async def resolve(self, host, port=0, family=socket.AF_INET):
+		hosts = await super().resolve(host, port, family)
+
+		for resolved in hosts:
+			if not ipaddress.ip_address(resolved["host"]).is_global:
+				raise UnsafeUrlError(f"{host} resolves to a private address")
+
+		return hosts
+
+
+def check_url(url):
+	'''
+	Raise an UnsafeUrlError if url isn't one we're willing to fetch. Names
+	are checked when they're resolved (see PublicResolver); this catches
+	everything else, including addresses given directly, which aiohttp
+	doesn't resolve.
+	'''
+	try:
+		parsed = urlsplit(url)
+		port = parsed.port
+	except ValueError as e:
+		raise UnsafeUrlError("Malformed url") from e
+
+	if parsed.scheme not in ("http", "https"):
+		raise UnsafeUrlError("Only http and https urls are fetched")
+
+	if port not in ALLOWED_PORTS:
+		raise UnsafeUrlError("Only the default ports are fetched")
+
+	host = parsed.hostname
+	if not host:
+		raise UnsafeUrlError("Url has no host")
+
+	if host == "localhost" or host.endswith(".localhost"):
+		raise UnsafeUrlError("Url is local")
+
+	try:
+		address = ipaddress.ip_address(host)
+	except ValueError:
+		return
+
+	if not address.is_global:
+		raise UnsafeUrlError("Url is a private address")
+
+
+async def read_limited(response, max_bytes):
+	'''
+	Read the body of response, or return None if it's more than max_bytes
+	'''
+	if response.content_length is not None and response.content_length > max_bytes:
+		return None
+
+	body = bytearray()
+	async for chunk in response.content.iter_chunked(65536):
+		body.extend(chunk)
+		if len(body) > max_bytes:
+			return None
+
+	return bytes(body)
+
+
+def make_card_session(*, proxy=None, **kwargs):
+	'''
+	Create a ClientSession for fetching cards, which only connects to public
+	addresses. It ignores proxy settings from the environment, since a proxy
+	would do the resolving. If proxy is given (see transport), requests go
+	through it after all, and it's up to the proxy to refuse private
+	addresses; check_url still refuses local hosts and private addresses
+	given directly.
+	'''
+	if proxy is not None:
+		connector = transport.make_connector(proxy=proxy)
+	else:
+		connector = aiohttp.TCPConnector(resolver=PublicResolver())
+
+	return aiohttp.ClientSession(
+		connector=connector,
+		trust_env=False,
+		**kwargs,
+	)
+
+
+class Card(namedtuple("Card", "url title description image_url site_name")):
+	'''
+	A link preview. url is the page the card is for, after redirects.
+	description, image_url, and site_name may be None.
+	'''
+	__slots__ = ()
+
+	def json(self):
+		return self._asdict()
+
+
+class MetadataParser(HTMLParser):
+	'''
+	Collects a page's <meta> properties (like og:title) and its <title>
+	'''
+	def __init__(self):
+		super().__init__(convert_charrefs=True)
+		self.meta = {}
+		self.title_parts = []
+		self.in_title = False
+
+	def handle_starttag(self, tag, attrs):
+		if tag == "meta":
+			attrs = dict(attrs)
+			key = (attrs.get("property") or attrs.get("name") or "").strip().lower()
+			content = (attrs.get("content") or "").strip()
+			if key and content:
+				self.meta.setdefault(key, content)
+		elif tag == "title":
+			self.in_title = True
+
+	def handle_endtag(self, tag):
+		if tag == "title":
+			self.in_title = False
+
+	def handle_data(self, data):
+		if self.in_title:
+			self.title_parts.append(data)
+
+	@property
+	def title(self):
+		return " ".join("".join(self.title_parts).split()) or None
+
+	def first(self, *keys):
+		return next((self.meta[key] for key in keys if key in self.meta), None)
+
+
+def truncate(text, length):
+	if text is None or len(text) <= length:
+		return text
+	return text[:length - 1].rstrip() + "…"
+
+
+def card_from_html(url, page):
+	'''
+	Make a Card from the HTML of the page at url, or None if it doesn't have
+	a title
+	'''
+	parser = MetadataParser()
+	parser.feed(page)
+
+	title = parser.first("og:title", "twitter:title") or parser.title
+	if title is None:
+		return None
+
+	image_url = parser.first("og:image", "og:image:url", "og:image:secure_url", "twitter:image", "twitter:image:src")
+	if image_url is not None:
+		image_url = urljoin(url, image_url)
+		if not safe_url(image_url):
+			image_url = None
+
+	return Card(
+		url=url,
+		title=truncate(title, MAX_TITLE_LENGTH),
+		description=truncate(parser.first("og:description", "twitter:description", "description"), MAX_DESCRIPTION_LENGTH),
+		image_url=image_url,
+		site_name=parser.first("og:site_name") or url_host(url),
+	)
+
+
+def card_url(tweet):
+	'''
+	Get the url to make a card for in a tweet, or None. Like twitter, only
+	tweets without media or a quoted tweet get cards, and links to tweets
+	don't count.
+	'''
+	if tweet.entities.media or tweet.quoted_id is not None:
+		return None
+
+	for entity in tweet.entities.urls:
+		url = entity.expanded_url or entity.url
+		if safe_url(url) and parse_tweet_id(url) is None:
+			return url
+
+	return None
+
+
+class CardFetcher:
+	'''
+	Fetches link preview Cards, using a session from make_card_session. Each
+	page may take at most timeout seconds, max_redirects redirects, and
+	max_bytes of HTML; pages that take more, or that aren't HTML, get no
+	card. Results, including failures, are cached for cache_ttl seconds.
+	'''
+	def __init__(
+		self,
+		session,
+		*,
+		timeout=5,
+		max_bytes=512 * 1024,
+		max_redirects=5,
+		max_concurrent=8,
+		cache_size=10000,
+		cache_ttl=24 * 60 * 60,
+	):
+		self.session = session
+		self.timeout = timeout
+		self.max_bytes = max_bytes
+		self.max_redirects = max_redirects
+		self.max_concurrent = max_concurrent
+		self.cache = cachetools.TTLCache(cache_size, cache_ttl, timer=time.monotonic)
+		self.pending = {}
+		self.semaphore = None
+
+	async def read_page(self, response):
+		content_length = response.content_length
+		if content_length is not None and content_length > self.max_bytes:
+			# Pages this big are probably downloads, not articles
+			return None
+
+		body = bytearray()
+		async for chunk in response.content.iter_chunked(8192):
+			body.extend(chunk)
+			if len(body) >= self.max_bytes:
+				break
+
+		return bytes(body[:self.max_bytes]).decode(response.charset or "utf-8", errors="replace")
+
+	async def fetch_uncached(self, url):
+		for _ in range(self.max_redirects + 1):
+			check_url(url)
+
+			async with self.session.get(
+				url,
+				allow_redirects=False,
+				headers={"User-Agent": USER_AGENT, "Accept": "text/html"},
+			) as response:
+				location = response.headers.get("Location")
+				if response.status in (301, 302, 303, 307, 308) and location:
+					url = urljoin(url, location)
+					continue
+
+				if response.status != 200 or response.content_type not in ("text/html", "application/xhtml+xml"):
+					return None
+
+				page = await self.read_page(response)
+				return card_from_html(url, page) if page is not None else None
+
+		return None
+
+	async def fetch_limited(self, url):
+		if self.semaphore is None:
+			self.semaphore = asyncio.Semaphore(self.max_concurrent)
+
+		async with self.semaphore:
+			try:
+				return await asyncio.wait_for(self.fetch_uncached(url), self.timeout)
+			except asyncio.CancelledError:
+				raise
+			except (aiohttp.ClientError, asyncio.TimeoutError, ValueError, LookupError) as e:
+				# LookupError is for pages with charsets we don't know
+				logger.info("Couldn't make a card for %s: %s", url, e)
+				return None
+
+	async def fetch(self, url):
+		'''
+		Get the Card for url, or None. Concurrent requests for the same url
+		share a fetch.
+		'''
+		try:
+			return self.cache[url]
+		except KeyError:
+			pass
+
+		pending = self.pending.get(url)
+		if pending is None:
+			pending = self.pending[url] = asyncio.ensure_future(self.fetch_limited(url))
+			pending.add_done_callback(lambda task: self.pending.pop(url, None))
+
+		result = await asyncio.shield(pending)
+		self.cache[url] = result
+		return result
+
+	async def add_card(self, tweet):
+		url = card_url(tweet)
+		if url is None:
+			return tweet
+
+		card = await self.fetch(url)
+		return tweet._replace(card=card) if card is not None else tweet
+
+	async def add_cards(self, thread):
+		'''
+		Add cards to all the tweets in thread (see
+		tweetbox.make_thread_getter's transforms)
+		'''
+		return await thread.map_tweets(self.add_card)
@@ -0,0 +1,116 @@
+# Following threads live, while their authors are still writing them. Viewers
+# connect to /thread/<id>/live with a WebSocket, and are sent the thread, and
+# then each batch of tweets the author adds, as soon as they're found (see
+# api_server.thread_live_handler).
+#
+# New tweets are found by resolving the thread forwards again every interval
+# seconds, like followed threads are (see follows), but only while someone's
+# watching. All the viewers of a thread share one watcher, so a popular live
+# thread costs no more than a quiet one.
+
+import asyncio
+import contextlib
+import logging
+
+logger = logging.getLogger(__name__)
+
+
+class TooManyLiveThreads(Exception):
+	pass
+
+
+class Watcher:
+	'''
+	Polls one thread for new tweets, and sends them to each of its viewers'
+	queues, as a list of tweets
+	'''
+	def __init__(self, thread, get_thread, *, interval):
+		self.thread = thread
+		self.get_thread = get_thread
+		self.interval = interval
+		self.queues = set()
+		self.task = None
+
+	async def check(self):
+		try:
+			thread = await self.get_thread(tail=self.thread.tail_id, head=None)
+		except asyncio.CancelledError:
+			raise
+		except Exception:
+			# Try again next time
+			logger.info("Couldn't check live thread %s", self.thread.tail_id, exc_info=True)
+			return
+
+		if thread.tail_id == self.thread.tail_id or self.thread.tail_id not in thread.ids:
+			return
+
+		new_tweets = list(thread)[thread.index(self.thread.tail_id) + 1:]
+		self.thread = thread
+
+		for queue in self.queues:
+			queue.put_nowait(new_tweets)
+
+	async def run(self):
+		while True:
+			await asyncio.sleep(self.interval)
+			await self.check()
+
+	def start(self):
+		self.task = asyncio.ensure_future(self.run())
+
+	async def close(self):
+		if self.task is not None:
+			self.task.cancel()
+			await asyncio.gather(self.task, return_exceptions=True)
+			self.task = None
+
+
+class LiveThreads:
+	'''
+	The threads being watched live. get_thread should resolve forwards (see
+	tweetbox's forward). Each thread is checked every interval seconds while
+	it has viewers; at most max_threads are watched at once.
+	'''
+	def __init__(self, get_thread, *, interval=30, max_threads=100):
+		self.get_thread = get_thread
+		self.interval = interval
+		self.max_threads = max_threads
+
+		# tail id, as requested -> Watcher
+		self.watchers = {}
+
+	@contextlib.asynccontextmanager
+	async def watch(self, tail):
+		'''
+		Watch the thread ending at tail. Yields (thread, queue): the thread
+		as it is now, and a queue that gets each list of new tweets. Raises
+		TooManyLiveThreads if there are already max_threads being watched, or
+		whatever get_thread raises if the thread can't be resolved.
+		'''
+		watcher = self.watchers.get(tail)
+		if watcher is None:
+			if len(self.watchers) >= self.max_threads:
+				raise TooManyLiveThreads()
+
+			thread = await self.get_thread(tail=tail, head=None)
+
+			# Someone else may have started watching while we resolved
+			watcher = self.watchers.get(tail)
+			if watcher is None:
+				watcher = self.watchers[tail] = Watcher(thread, self.get_thread, interval=self.interval)
+				watcher.start()
+
+		queue = asyncio.Queue()
+		watcher.queues.add(queue)
+		try:
+			yield watcher.thread, queue
+		finally:
+			watcher.queues.discard(queue)
+			if not watcher.queues and self.watchers.get(tail) is watcher:
+				del self.watchers[tail]
+				await watcher.close()
+
+	async def close(self):
+		watchers = list(self.watchers.values())
+		self.watchers.clear()
+		await asyncio.gather(*(watcher.close() for watcher in watchers))
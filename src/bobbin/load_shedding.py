@@ -0,0 +1,73 @@
+# A limit on the number of thread resolutions running at once. Each
+# resolution holds tweets in memory and spends twitter API budget, so rather
+# than letting a traffic spike start an unbounded number of them, excess
+# resolutions are refused outright, and callers fall back to any copy of the
+# thread that doesn't need twitter, or tell the client to try again later.
+
+from contextlib import asynccontextmanager
+import asyncio
+
+
+class Overloaded(Exception):
+	'''
+	Too many threads are being resolved. retry_after is a suggestion, in
+	seconds, for when to try again.
+	'''
+	def __init__(self, retry_after):
+		super().__init__(retry_after)
+		self.retry_after = retry_after
+
+
+class ResolutionLimiter:
+	'''
+	Allows at most max_concurrent resolutions at once (or any number, if it's
+	None). Up to max_waiting more can wait for a slot; beyond that,
+	resolutions are refused with Overloaded, rather than queueing without
+	bound.
+	'''
+	def __init__(self, max_concurrent, *, max_waiting=0, retry_after=5):
+		self.max_concurrent = max_concurrent
+		self.max_waiting = max_waiting
+		self.retry_after = retry_after
+		self.active = 0
+		self.waiting = 0
+		self.shed = 0
+		self.semaphore = None
+
+	@asynccontextmanager
+	async def slot(self):
+		if self.max_concurrent is None:
+			yield
+			return
+
+		# Created lazily, so that it belongs to the running loop
+		if self.semaphore is None:
+			self.semaphore = asyncio.Semaphore(self.max_concurrent)
+
+		if self.active >= self.max_concurrent and self.waiting >= self.max_waiting:
+			self.shed += 1
+			raise Overloaded(self.retry_after)
+
+		self.waiting += 1
+		try:
+			await self.semaphore.acquire()
+		finally:
+			self.waiting -= 1
+
+		self.active += 1
+		try:
+			yield
+		finally:
+			self.active -= 1
+			self.semaphore.release()
+
+	def stats(self):
+		return {
+			"max_concurrent": self.max_concurrent,
+			"active": self.active,
+			"waiting": self.waiting,
+			"shed": self.shed,
+		}
+
+
+UNLIMITED = ResolutionLimiter(None)
@@ -0,0 +1,222 @@
+# Emailing threads: readers can have a thread sent to an email address, as
+# HTML, or as an EPUB attachment, which is what Send to Kindle addresses
+# want. Mail goes out through an SMTP server (smtp_host), from email_from.
+#
+# So that the site can't be used to fill strangers' inboxes, a thread is only
+# sent once the address confirms it: the first email just has a link to a
+# page that sends the thread. The link carries a signed token (signed with
+# email_secret), so nothing needs to be stored, and each token only works
+# once. Kindle addresses can't click links, but Amazon drops mail from
+# senders their owners haven't approved, so they're sent to directly.
+# Requests are also rate limited, both per client and per address.
+
+from collections import namedtuple
+from email.message import EmailMessage
+from email.utils import make_msgid
+import asyncio
+import base64
+import functools
+import hashlib
+import hmac
+import json
+import logging
+import re
+import smtplib
+import time
+
+import cachetools
+
+from bobbin import epub, permalinks, render
+from bobbin.client_limits import ClientRateLimiter
+
+logger = logging.getLogger(__name__)
+
+FORMATS = ("html", "epub")
+
+# Send to Kindle addresses, which get EPUBs without confirmation
+KINDLE_DOMAINS = ("kindle.com", "free.kindle.com")
+
+# Deliberately loose; the SMTP server has the final say
+ADDRESS_PATTERN = re.compile(r"[^@\s]{1,64}@[A-Za-z0-9-]{1,63}(?:\.[A-Za-z0-9-]{1,63})+")
+MAX_ADDRESS_LENGTH = 254
+
+# How long a confirmation link works, in seconds
+CONFIRM_TTL = 24 * 60 * 60
+
+# Each client can ask for a few emails in a row, and then one every 10
+# minutes; each address gets a few, and then one an hour
+CLIENT_RATE = 1 / (10 * 60)
+CLIENT_BURST = 5
+ADDRESS_RATE = 1 / (60 * 60)
+ADDRESS_BURST = 3
+
+
+class InvalidAddressError(ValueError):
+	pass
+
+
+class InvalidTokenError(ValueError):
+	pass
+
+
+class EmailRequest(namedtuple("EmailRequest", "tail_id address format")):
+	'''
+	A thread to email: its tail id, the address to send it to, and the format
+	(one of FORMATS)
+	'''
+	__slots__ = ()
+
+
+def is_kindle(address):
+	return address.rsplit("@", 1)[-1].lower() in KINDLE_DOMAINS
+
+
+def check_address(address):
+	'''
+	Normalize address, raising InvalidAddressError if it doesn't look like
+	an email address
+	'''
+	address = address.strip()
+	if len(address) > MAX_ADDRESS_LENGTH or not ADDRESS_PATTERN.fullmatch(address):
+		raise InvalidAddressError(address)
+	return address
+
+
+class Mailer:
+	'''
+	Sends email through an SMTP server at host and port, from sender. With
+	ssl, the connection is TLS from the start (usually port 465); otherwise
+	it's upgraded with STARTTLS, if the server offers it. smtplib blocks, so
+	mail is sent from the executor.
+	'''
+	def __init__(self, host, port, *, sender, username=None, password=None, ssl=False, timeout=30):
+		self.host = host
+		self.port = port
+		self.sender = sender
+		self.username = username
+		self.password = password
+		self.ssl = ssl
+		self.timeout = timeout
+
+	def send_sync(self, message):
+		smtp_class = smtplib.SMTP_SSL if self.ssl else smtplib.SMTP
+		with smtp_class(self.host, self.port, timeout=self.timeout) as smtp:
+			if not self.ssl:
+				smtp.ehlo()
+				if smtp.has_extn("starttls"):
+					smtp.starttls()
+					smtp.ehlo()
+			if self.username is not None:
+				smtp.login(self.username, self.password)
+			smtp.send_message(message)
+
+	async def send(self, message):
+		'''
+		Send message (an EmailMessage), filling in its From. Raises
+		smtplib.SMTPException or OSError if it can't be sent.
+		'''
+		message["From"] = self.sender
+		message["Message-ID"] = make_msgid(domain=self.sender.rsplit("@", 1)[-1].strip(">"))
+		await asyncio.get_event_loop().run_in_executor(None, functools.partial(self.send_sync, message))
+
+
+class ThreadMailer:
+	'''
+	Emails threads with mailer, after confirmation (see the top of this
+	module). Confirmation tokens are signed with secret.
+	'''
+	def __init__(self, mailer, secret, *, clock=time.time):
+		self.mailer = mailer
+		self.secret = secret
+		self.clock = clock
+		self.client_limiter = ClientRateLimiter(rate=CLIENT_RATE, burst=CLIENT_BURST)
+		self.address_limiter = ClientRateLimiter(rate=ADDRESS_RATE, burst=ADDRESS_BURST)
+
+		# Tokens that have been used, until they'd have expired anyway
+		self.used_tokens = cachetools.TTLCache(maxsize=100000, ttl=CONFIRM_TTL)
+
+	def signature(self, payload):
+		return hmac.new(self.secret.encode(), payload.encode(), hashlib.sha256).hexdigest()[:32]
+
+	def make_token(self, email_request):
+		payload = base64.urlsafe_b64encode(json.dumps([
+			email_request.tail_id,
+			email_request.address,
+			email_request.format,
+			int(self.clock()) + CONFIRM_TTL,
+		]).encode()).decode().rstrip("=")
+		return f"{payload}.{self.signature(payload)}"
+
+	def check_token(self, token):
+		'''
+		Get the EmailRequest a confirmation token is for, raising
+		InvalidTokenError if it's forged, expired, or already used
+		'''
+		payload, _, signature = token.partition(".")
+		if not hmac.compare_digest(self.signature(payload).encode(), signature.encode()):
+			raise InvalidTokenError("Invalid token")
+
+		try:
+			tail_id, address, email_format, expires = json.loads(base64.urlsafe_b64decode(payload + "=" * (-len(payload) % 4)))
+		except ValueError:
+			raise InvalidTokenError("Invalid token") from None
+
+		if expires < self.clock():
+			raise InvalidTokenError("This link has expired")
+		if token in self.used_tokens:
+			raise InvalidTokenError("This link has already been used")
+
+		return EmailRequest(tail_id, address, email_format)
+
+	def use_token(self, token):
+		self.used_tokens[token] = True
+
+	def acquire(self, *, client, address):
+		'''
+		Take a send from client's and address's rate limits. Returns None if
+		there were some left, or else the number of seconds until there will
+		be.
+		'''
+		retry_after = self.client_limiter.acquire(client)
+		if retry_after is not None:
+			return retry_after
+		return self.address_limiter.acquire(address.lower())
+
+	def needs_confirmation(self, email_request):
+		return not is_kindle(email_request.address)
+
+	async def send_confirmation(self, thread, email_request, *, confirm_url):
+		title = render.thread_title(thread)
+		message = EmailMessage()
+		message["To"] = email_request.address
+		message["Subject"] = f"Confirm: {title}"
+		message.set_content(
+			f"Someone (hopefully you) asked Bobbin to email you \"{title}\".\n\n"
+			f"To have it sent, open this link within a day:\n\n{confirm_url}\n\n"
+			"If you didn't ask for this, you can ignore this email; nothing "
+			"more will be sent.\n"
+		)
+		await self.mailer.send(message)
+
+	async def send_thread(self, thread, email_request, *, site_url):
+		title = render.thread_title(thread)
+		page_url = site_url + permalinks.thread_permalink(thread)
+
+		message = EmailMessage()
+		message["To"] = email_request.address
+		message["Subject"] = title
+		message.set_content(f"{render.thread_text(thread)}\n{page_url}\n")
+
+		if email_request.format == "epub":
+			filename = permalinks.tweet_slug(thread[0]) or str(thread.tail_id)
+			message.add_attachment(
+				epub.thread_epub(thread, page_url=page_url),
+				maintype="application",
+				subtype="epub+zip",
+				filename=f"{filename}.epub",
+			)
+		else:
+			message.add_alternative(render.thread_email_html(thread, page_url=page_url), subtype="html")
+
+		await self.mailer.send(message)
+		logger.info("Emailed thread %s as %s", thread.tail_id, email_request.format)
@@ -1,17 +1,19 @@
 import os
 import pathlib
 
-from aiohttp import web
 from autocommand import autocommand
-import aiohttp
 import cachetools
 
-from bobbin import twitter, tweetbox, async_cache, api_server, web_util, frontend_server
+from bobbin import accounts as bobbin_accounts, analytics, blob_store, bot, follows, media_mirror as bobbin_media_mirror, nitter, pdf_export as bobbin_pdf_export, twitter, twitter_v2, tweetbox, tweet_loader, async_cache, api_keys, callbacks, client_limits, discord_integration, flags as feature_flags, graphql_server, grpc_server, health, http_cache, image_proxy as bobbin_image_proxy, jobs, link_cards, live, load_shedding, mailer, middleware as bobbin_middleware, optout, posting, read_later as bobbin_read_later, recording, server, storage, token_store, tracing, transport, response_cache, slack_integration, unshorten, config as bobbin_config, share_images as bobbin_share_images, source, stream, user_store
 
 
 class AsyncLRUCache(async_cache.Cache):
-	def __init__(self, max_size):
-		self.cache = cachetools.LRUCache(max_size, getsizeof=async_cache.get_size_of)
+	def __init__(self, max_size, ttl=None):
+		# TTLCache is also an LRU cache; it just additionally expires entries
+		if ttl is None:
+			self.cache = cachetools.LRUCache(max_size, getsizeof=async_cache.get_size_of)
+		else:
+			self.cache = cachetools.TTLCache(max_size, ttl, getsizeof=async_cache.get_size_of)
 
 	async def get(self, key):
 		with self.convert_keyerror():
@@ -20,14 +22,58 @@ class AsyncLRUCache(async_cache.Cache):
 	async def write(self, key, value):
 		self.cache[key] = value
 
+	async def delete(self, key):
+		self.cache.pop(key, None)
 
-main_handler = web_util.routes(
-	(r'/$', frontend_server.index_handler, 'index_path'),
-	(r'/thread/[0-9]{1,21}/?$', frontend_server.index_handler, 'index_path'),
-	(r'/faq/?$', frontend_server.index_handler, 'index_path'),
-	(r'/api/', api_server.handler, 'get_thread'),
-	(r'/static/', frontend_server.static_file_handler, ['base_directory', 'valid_paths']),
-)
+
+api_modules = {
+	1: twitter,
+	2: twitter_v2,
+}
+
+
+def make_api(config, session, *, tokens=None, middleware=(), cache=None):
+	'''
+	Get the (api, token) to resolve threads with. The official API is always
+	used if there are credentials, with requests going through cache and
+	middleware (see twitter.Token); without them, tweets are scraped from
+	the nitter_url instance, on a best-effort basis (see nitter).
+	'''
+	if not config.credentials:
+		return nitter, nitter.Instance(config.nitter_url, timeout=config.nitter_timeout)
+
+	retry_policy = twitter.DEFAULT_RETRY_POLICY._replace(max_attempts=config.max_attempts)
+	token = twitter.TokenPool(
+		twitter.Token(session, key, secret, retry_policy=retry_policy, store=tokens, middleware=middleware, cache=cache)
+		for key, secret in config.credentials
+	)
+
+	return api_modules[config.api_version], token
+
+
+def make_session(config):
+	'''
+	Create the ClientSession for API requests, with the connection pool,
+	timeouts, and proxy from config (see transport)
+	'''
+	return transport.make_api_session(
+		max_connections=config.api_max_connections,
+		max_connections_per_host=config.api_max_connections_per_host,
+		keepalive_timeout=config.api_keepalive,
+		connect_timeout=config.api_connect_timeout,
+		read_timeout=config.api_read_timeout,
+		proxy=config.proxy,
+	)
+
+
+def backend_proxy(config, setting):
+	'''
+	Get the proxy for a provider, from its own proxy setting, which defaults
+	to the proxy setting, and can be "direct" to skip it
+	'''
+	if setting == bobbin_config.DIRECT:
+		return None
+	return setting if setting is not None else config.proxy
 
 
 def walk_dir(path):
@@ -38,59 +84,865 @@ def walk_dir(path):
 			yield from walk_dir(child)
 
 
-def parse_size(size):
-	if size.endswith("KB"):
-		return int(size[:-2]) * 1024
-	elif size.endswith("MB"):
-		return int(size[:-2]) * 1024 * 1024
-	elif size.endswith("GB"):
-		return int(size[:-2]) * 1024 * 1024 * 1024
-	elif size.endswith("B"):
-		return int(size[:-1])
-	else:
-		return int(size)
-
-
 @autocommand(__name__, loop=True, pass_loop=True)
 async def main(
-	key: str =os.environ.get("CONSUMER_KEY", None),
-	secret: str =os.environ.get("CONSUMER_SECRET", None),
-	host="0.0.0.0",
-	port=8080,
-	static_dir=pathlib.Path('./static'),
-	cache_size="256MB",
+	key: str =None,
+	secret: str =None,
+	host: str =None,
+	port: int =None,
+	tls_cert: str =None,
+	tls_key: str =None,
+	tls_port: int =None,
+	grpc_port: int =None,
+	acme_dir: str =None,
+	static_dir: pathlib.Path =None,
+	theme_dir: str =None,
+	reload_theme=False,
+	cache_size: str =None,
+	cache_ttl: float =None,
+	user_cache_ttl: float =None,
+	response_cache_size: str =None,
+	http_cache_size: str =None,
+	response_cache_ttl: float =None,
+	revalidate=False,
+	api_version: int =None,
+	max_attempts: int =None,
+	api_max_connections: int =None,
+	api_max_connections_per_host: int =None,
+	api_keepalive: float =None,
+	api_connect_timeout: float =None,
+	api_read_timeout: float =None,
+	proxy: str =None,
+	resolve_quotes=False,
+	forward=False,
+	conversation_search=False,
+	stream_authors: str =None,
+	stream_conversations: str =None,
+	bot_token: str =None,
+	bot_token_secret: str =None,
+	bot_site_url: str =None,
+	bot_interval: float =None,
+	bot_direct_messages=False,
+	batch_window: float =None,
+	max_resolve_time: float =None,
+	max_api_calls: int =None,
+	job_workers: int =None,
+	job_wait: float =None,
+	max_queued_jobs: int =None,
+	max_resolutions: int =None,
+	max_waiting_resolutions: int =None,
+	callback_secret: str =None,
+	no_indexing=False,
+	hide_metrics=False,
+	static_homepage=False,
+	view_dedup_window: float =None,
+	trending_interval: float =None,
+	recrawl_interval: float =None,
+	live_interval: float =None,
+	live_max_threads: int =None,
+	opt_out_file: str =None,
+	admin_token: str =None,
+	client_rate_limit: float =None,
+	client_burst: int =None,
+	trusted_proxies: int =None,
+	base_path: str =None,
+	require_api_keys=False,
+	accounts=False,
+	twitter_client_id: str =None,
+	twitter_client_secret: str =None,
+	max_replies: int =None,
+	expand_links=False,
+	shortener_hosts: str =None,
+	link_timeout: float =None,
+	link_cards=False,
+	card_timeout: float =None,
+	card_max_bytes: str =None,
+	share_images=False,
+	graphql=False,
+	tracing=False,
+	discord_public_key: str =None,
+	slack_signing_secret: str =None,
+	slack_bot_token: str =None,
+	smtp_host: str =None,
+	smtp_port: int =None,
+	smtp_username: str =None,
+	smtp_password: str =None,
+	smtp_ssl=False,
+	email_from: str =None,
+	email_secret: str =None,
+	pocket_consumer_key: str =None,
+	instapaper_key: str =None,
+	instapaper_secret: str =None,
+	readwise=False,
+	share_image_font: str =None,
+	pdf_export=False,
+	pdf_font: str =None,
+	mirror_media=False,
+	media_url: str =None,
+	media_max_bytes: str =None,
+	media_timeout: float =None,
+	image_proxy_secret: str =None,
+	image_url: str =None,
+	image_max_bytes: str =None,
+	image_timeout: float =None,
+	mastodon=False,
+	mastodon_timeout: float =None,
+	bluesky=False,
+	bluesky_appview: str =None,
+	bluesky_timeout: float =None,
+	mastodon_proxy: str =None,
+	bluesky_proxy: str =None,
+	nitter_url: str =None,
+	nitter_timeout: float =None,
+	database: str =None,
+	blob_store: str =None,
+	s3_endpoint: str =None,
+	s3_region: str =None,
+	s3_access_key: str =None,
+	s3_secret_key: str =None,
+	token_file: str =None,
+	invalidate_tokens=False,
+	request_timeout: float =None,
+	grace_period: float =None,
+	record_dir: str =None,
+	replay_dir: str =None,
+	config_file: str =os.environ.get("BOBBIN_CONFIG", None),
 	loop=None,
 ):
-	if key is None:
-		return "Missing CONSUMER_KEY or --key"
+	# Flags override the config file and environment, but only if they were
+	# actually given. Switches can only change settings from their defaults.
+	try:
+		config = bobbin_config.load(path=config_file, overrides=dict(
+			key=key,
+			secret=secret,
+			host=host,
+			port=port,
+			tls_cert=tls_cert,
+			tls_key=tls_key,
+			tls_port=tls_port,
+			grpc_port=grpc_port,
+			acme_dir=acme_dir,
+			static_dir=static_dir,
+			theme_dir=theme_dir,
+			reload_theme=reload_theme or None,
+			cache_size=cache_size,
+			cache_ttl=cache_ttl,
+			user_cache_ttl=user_cache_ttl,
+			response_cache_size=response_cache_size,
+			http_cache_size=http_cache_size,
+			response_cache_ttl=response_cache_ttl,
+			revalidate=revalidate or None,
+			api_version=api_version,
+			max_attempts=max_attempts,
+			api_max_connections=api_max_connections,
+			api_max_connections_per_host=api_max_connections_per_host,
+			api_keepalive=api_keepalive,
+			api_connect_timeout=api_connect_timeout,
+			api_read_timeout=api_read_timeout,
+			proxy=proxy,
+			resolve_quotes=resolve_quotes or None,
+			forward=forward or None,
+			conversation_search=conversation_search or None,
+			stream_authors=stream_authors,
+			stream_conversations=stream_conversations,
+			bot_token=bot_token,
+			bot_token_secret=bot_token_secret,
+			bot_site_url=bot_site_url,
+			bot_interval=bot_interval,
+			bot_direct_messages=bot_direct_messages or None,
+			batch_window=batch_window,
+			max_resolve_time=max_resolve_time,
+			max_api_calls=max_api_calls,
+			job_workers=job_workers,
+			job_wait=job_wait,
+			max_queued_jobs=max_queued_jobs,
+			max_resolutions=max_resolutions,
+			max_waiting_resolutions=max_waiting_resolutions,
+			callback_secret=callback_secret,
+			allow_indexing=False if no_indexing else None,
+			show_metrics=False if hide_metrics else None,
+			static_homepage=static_homepage or None,
+			view_dedup_window=view_dedup_window,
+			trending_interval=trending_interval,
+			recrawl_interval=recrawl_interval,
+			live_interval=live_interval,
+			live_max_threads=live_max_threads,
+			opt_out_file=opt_out_file,
+			admin_token=admin_token,
+			client_rate_limit=client_rate_limit,
+			client_burst=client_burst,
+			trusted_proxies=trusted_proxies,
+			base_path=base_path,
+			require_api_keys=require_api_keys or None,
+			accounts=accounts or None,
+			twitter_client_id=twitter_client_id,
+			twitter_client_secret=twitter_client_secret,
+			max_replies=max_replies,
+			expand_links=expand_links or None,
+			shortener_hosts=shortener_hosts,
+			link_timeout=link_timeout,
+			link_cards=link_cards or None,
+			card_timeout=card_timeout,
+			card_max_bytes=card_max_bytes,
+			share_images=share_images or None,
+			graphql=graphql or None,
+			tracing=tracing or None,
+			discord_public_key=discord_public_key,
+			slack_signing_secret=slack_signing_secret,
+			slack_bot_token=slack_bot_token,
+			smtp_host=smtp_host,
+			smtp_port=smtp_port,
+			smtp_username=smtp_username,
+			smtp_password=smtp_password,
+			smtp_ssl=smtp_ssl or None,
+			email_from=email_from,
+			email_secret=email_secret,
+			pocket_consumer_key=pocket_consumer_key,
+			instapaper_key=instapaper_key,
+			instapaper_secret=instapaper_secret,
+			readwise=readwise or None,
+			share_image_font=share_image_font,
+			pdf_export=pdf_export or None,
+			pdf_font=pdf_font,
+			mirror_media=mirror_media or None,
+			media_url=media_url,
+			media_max_bytes=media_max_bytes,
+			media_timeout=media_timeout,
+			image_proxy_secret=image_proxy_secret,
+			image_url=image_url,
+			image_max_bytes=image_max_bytes,
+			image_timeout=image_timeout,
+			mastodon=mastodon or None,
+			mastodon_timeout=mastodon_timeout,
+			bluesky=bluesky or None,
+			bluesky_appview=bluesky_appview,
+			bluesky_timeout=bluesky_timeout,
+			mastodon_proxy=mastodon_proxy,
+			bluesky_proxy=bluesky_proxy,
+			nitter_url=nitter_url,
+			nitter_timeout=nitter_timeout,
+			database=database,
+			blob_store=blob_store,
+			s3_endpoint=s3_endpoint,
+			s3_region=s3_region,
+			s3_access_key=s3_access_key,
+			s3_secret_key=s3_secret_key,
+			token_file=token_file,
+			invalidate_tokens=invalidate_tokens or None,
+			request_timeout=request_timeout,
+			grace_period=grace_period,
+			record_dir=record_dir,
+			replay_dir=replay_dir,
+		))
+	except bobbin_config.ConfigError as e:
+		return str(e)
+
+	if config.share_images and not bobbin_share_images.available():
+		return "share_images requires Pillow (pip install bobbin[share-images])"
+
+	if config.pdf_export and not bobbin_pdf_export.available():
+		return "pdf_export requires reportlab (pip install bobbin[pdf])"
 
-	if secret is None:
-		return "Missing CONSUMER_SECRET or --secret"
+	if config.grpc_port and not grpc_server.available():
+		return "grpc_port requires grpcio and the generated messages (pip install bobbin[grpc]; make grpc)"
 
-	static_dir = static_dir.resolve()
+	if config.graphql and not graphql_server.available():
+		return "graphql requires graphql-core (pip install bobbin[graphql])"
+
+	if config.tracing and not tracing.available():
+		return "tracing requires the OpenTelemetry SDK (pip install bobbin[tracing])"
+
+	if config.discord_public_key is not None and not discord_integration.available():
+		return "discord_public_key requires PyNaCl (pip install bobbin[discord])"
+
+	if config.image_proxy_secret is not None and not bobbin_image_proxy.available():
+		return "image_proxy_secret requires Pillow (pip install bobbin[image-proxy])"
+
+	proxies = [config.proxy]
+	if config.mastodon:
+		proxies.append(backend_proxy(config, config.mastodon_proxy))
+	if config.bluesky:
+		proxies.append(backend_proxy(config, config.bluesky_proxy))
+	if any(proxy is not None for proxy in proxies) and not transport.available():
+		return "proxy settings require aiohttp-socks (pip install bobbin[proxy])"
+
+	static_dir = config.static_dir.resolve()
 	if not static_dir.is_dir():
-		return "--static_dir must be a directory"
+		return "static_dir must be a directory"
+
+	if config.theme_dir is not None and not pathlib.Path(config.theme_dir).is_dir():
+		return "theme_dir must be a directory"
+
+	# Spans are exported as configured by the OTEL_* environment variables
+	try:
+		tracer_provider = tracing.configure() if config.tracing else None
+	except tracing.TracingError as e:
+		return str(e)
+
+	# The cache is shared between all threads, and is always consulted before
+	# making any API calls.
+	cache = async_cache.MeteredCache(AsyncLRUCache(
+		max_size=config.cache_size,
+		ttl=config.cache_ttl if config.cache_ttl > 0 else None,
+	))
+
+	# Author profiles are kept for a shorter time than tweets, since they
+	# change more often
+	user_cache = AsyncLRUCache(
+		max_size=bobbin_config.parse_size("8MB"),
+		ttl=config.user_cache_ttl,
+	) if config.user_cache_ttl > 0 else None
+
+	# Rendered thread responses are cached separately from tweets, if enabled
+	responses = response_cache.ResponseCache(
+		config.response_cache_size,
+		ttl=config.response_cache_ttl,
+		revalidate=config.revalidate,
+	) if config.response_cache_ttl > 0 else None
+
+	# Resolved threads are archived to the database, if there is one
+	store = storage.SqliteThreadStore(config.database, loop=loop) if config.database else None
+
+	# Authors who have opted out come from the opt-out file, and from the
+	# database, where the admin endpoints save them
+	opt_outs = optout.OptOutList(path=config.opt_out_file, store=store)
+	try:
+		await opt_outs.load()
+	except (OSError, ValueError) as e:
+		if store is not None:
+			store.close()
+		return f"Couldn't load opt-outs: {e}"
+
+	# API keys, if they're required, are issued through the admin endpoints
+	# and saved in the database
+	keys = api_keys.ApiKeys(store) if config.require_api_keys else None
+	if keys is not None:
+		await keys.load()
 
-	cache = AsyncLRUCache(max_size=parse_size(cache_size))
+	# Signed in users' accounts, bookmarks and reading history are kept in
+	# the database too
+	users = user_store.SqliteUserStore(config.database, loop=loop) if config.accounts else None
 
-	async with aiohttp.ClientSession() as session:
-		token = twitter.Token(session, key, secret)
+	# Bearer tokens are kept in the token file or the database, so that they
+	# survive restarts
+	if config.token_file:
+		tokens = token_store.FileTokenStore(config.token_file)
+	elif config.database:
+		tokens = token_store.SqliteTokenStore(config.database, loop=loop)
+	else:
+		tokens = None
+
+	async with make_session(config) as client_session:
+		# For tests and offline demos, API traffic can be recorded to (or
+		# replayed from) fixture files
+		session = recording.wrap_session(
+			client_session,
+			record_dir=config.record_dir,
+			replay_dir=config.replay_dir,
+		)
+
+		# Besides the client's own middleware, twitter requests are counted
+		# (for the admin stats) and logged at debug level. Responses can be
+		# cached, and revalidated with conditional requests, which don't
+		# download unchanged bodies; the cache goes in front of the rate
+		# limits, so that fresh hits don't touch them. With tracing, requests
+		# that aren't answered from the cache get a span.
+		api_cache = http_cache.HTTPCache(max_size=config.http_cache_size) if config.http_cache_size > 0 else None
+		api_middleware = [bobbin_middleware.logged, bobbin_middleware.RequestMetrics()]
+		if config.tracing:
+			api_middleware.append(tracing.traced)
+
+		api, token = make_api(config, session, tokens=tokens, middleware=api_middleware, cache=api_cache)
+
+		# Mirrored media and share images are kept in the blob store, if
+		# there is one
+		blobs = blob_store.make_blob_store(
+			config.blob_store,
+			session=client_session,
+			loop=loop,
+			endpoint=config.s3_endpoint,
+			region=config.s3_region,
+			access_key=config.s3_access_key,
+			secret_key=config.s3_secret_key,
+		) if config.blob_store is not None else None
+
+		# Coalesce concurrent tweet lookups from different threads into
+		# batches. Scraped tweets can only be fetched one at a time.
+		if config.batch_window > 0 and api is not nitter:
+			api = tweet_loader.TweetLoader(api, window=config.batch_window)
+
+		budget = tweetbox.ResolutionBudget(
+			max_time=config.max_resolve_time if config.max_resolve_time > 0 else None,
+			max_calls=config.max_api_calls if config.max_api_calls > 0 else None,
+		)
+
+		# Thread resolutions beyond max_resolutions at once are refused, and
+		# served from the store or cache if possible
+		limiter = load_shedding.ResolutionLimiter(
+			config.max_resolutions,
+			max_waiting=config.max_waiting_resolutions,
+		) if config.max_resolutions > 0 else load_shedding.UNLIMITED
+
+		# These can be toggled at runtime through the admin API
+		flags = feature_flags.FeatureFlags(
+			resolve_quotes=config.resolve_quotes,
+			forward=config.forward,
+			conversation_search=config.conversation_search,
+		)
+
+		# Resolved threads are transformed by each of these in turn
+		thread_transforms = []
+
+		# Shortened links in threads are followed to where they really go.
+		# Like callbacks, these requests go to the real network.
+		if config.expand_links:
+			thread_transforms.append(unshorten.LinkResolver(
+				client_session,
+				hosts=config.shortener_hosts,
+				timeout=config.link_timeout,
+			).expand_thread)
+
+		# Link preview cards are fetched from anywhere, so they get their own
+		# session, which refuses to connect to private addresses
+		card_session = link_cards.make_card_session() if config.link_cards else None
+		if card_session is not None:
+			thread_transforms.append(link_cards.CardFetcher(
+				card_session,
+				timeout=config.card_timeout,
+				max_bytes=config.card_max_bytes,
+			).add_cards)
+
+		# Media is copied from wherever it's hosted, which for links in other
+		# sources could be anywhere, so, like cards, it's downloaded with a
+		# session that only connects to public addresses. The store itself
+		# may well be on a private network.
+		media_session = link_cards.make_card_session() if config.mirror_media else None
+		if media_session is not None:
+			mirror = bobbin_media_mirror.MediaMirror(
+				media_session,
+				blobs,
+				url_prefix=config.media_url,
+				timeout=config.media_timeout,
+				max_bytes=config.media_max_bytes,
+			)
+			thread_transforms.append(mirror.mirror_thread)
+		else:
+			mirror = None
+
+		# Images are proxied after they're mirrored; mirrored copies are
+		# already on our own site, so they're left alone
+		image_session = link_cards.make_card_session() if config.image_proxy_secret is not None else None
+		if image_session is not None:
+			image_proxy = bobbin_image_proxy.ImageProxy(
+				image_session,
+				config.image_proxy_secret,
+				url_prefix=config.image_url,
+				local_prefixes=(config.media_url,) if mirror is not None else (),
+				store=blobs,
+				timeout=config.image_timeout,
+				max_bytes=config.image_max_bytes,
+			)
+			thread_transforms.append(image_proxy.proxy_thread)
+		else:
+			image_proxy = None
 
 		get_thread = tweetbox.make_thread_getter(
 			session=session,
 			cache=cache,
-			token=token
+			token=token,
+			api=api,
+			resolve_quotes=config.resolve_quotes,
+			forward=config.forward,
+			conversation_search=config.conversation_search,
+			store=store,
+			user_cache=user_cache,
+			budget=budget,
+			opt_outs=opt_outs,
+			flags=flags,
+			limiter=limiter,
+			transforms=thread_transforms,
 		)
 
-		handler = web_util.with_context(
-			web_util.shitty_logging(main_handler),
+		# Threads can be unrolled from Mastodon too. Instances can be
+		# anywhere, so, like cards, they get a session that only connects to
+		# public addresses.
+		providers = [source.TwitterProvider(get_thread)]
+		mastodon_session = link_cards.make_card_session(
+			proxy=backend_proxy(config, config.mastodon_proxy),
+		) if config.mastodon else None
+		if mastodon_session is not None:
+			providers.append(source.MastodonProvider(mastodon_session, timeout=config.mastodon_timeout))
+
+		# and from Bluesky, whose public AppView is at a known address. It
+		# only needs a session of its own if it's proxied differently.
+		bluesky_session = None
+		if config.bluesky:
+			if backend_proxy(config, config.bluesky_proxy) != config.proxy:
+				bluesky_session = make_session(config._replace(proxy=backend_proxy(config, config.bluesky_proxy)))
+			providers.append(source.BlueskyProvider(
+				bluesky_session or client_session,
+				appview=config.bluesky_appview.rstrip("/"),
+				timeout=config.bluesky_timeout,
+			))
+
+		# Avatars for share images come from twitter's CDN, on the real network
+		share_image_renderer = bobbin_share_images.ShareImageRenderer(
+			client_session,
+			font=config.share_image_font,
+			store=blobs,
+		) if config.share_images else None
+
+		# As do the images in PDFs
+		thread_pdfs = bobbin_pdf_export.ThreadPdfRenderer(
+			client_session,
+			font=config.pdf_font,
+		) if config.pdf_export else None
+
+		stream_thread = tweetbox.make_thread_streamer(
+			session=session,
+			cache=cache,
+			token=token,
+			api=api,
+			resolve_quotes=config.resolve_quotes,
+			budget=budget,
+			opt_outs=opt_outs,
+			flags=flags,
+			limiter=limiter,
+		)
+
+		get_thread_tree = tweetbox.make_tree_getter(
+			session=session,
+			cache=cache,
+			token=token,
+			api=api,
+			opt_outs=opt_outs,
+			limiter=limiter,
+		)
+
+		# Replies from other users are only available from the v2 search api
+		get_thread_replies = tweetbox.make_replies_getter(
+			session=session,
+			token=token,
+			api=api,
+			max_replies=config.max_replies,
+		) if config.max_replies > 0 else None
+
+		# API requests for threads can be resolved by a fixed pool of workers,
+		# rather than all at once
+		job_queue = jobs.JobQueue(
+			get_thread,
+			workers=config.job_workers,
+			max_queued=config.max_queued_jobs,
+			wait=config.job_wait,
+			loop=loop,
+		) if config.job_workers > 0 else None
+
+		# Clients of the job queue can have threads sent to them when they're
+		# done, if there's a secret to sign them with. These go to the real
+		# network, even when twitter traffic is being recorded or replayed.
+		callback_sender = callbacks.CallbackSender(
+			client_session,
+			config.callback_secret,
+		) if config.callback_secret is not None else None
+
+		# client_rate_limit is in requests per minute, per client address
+		client_limiter = client_limits.ClientRateLimiter(
+			rate=config.client_rate_limit / 60,
+			burst=config.client_burst,
+		) if config.client_rate_limit > 0 else None
+
+		health_checks = health.HealthChecks(
+			session=session,
+			token=token,
+			api=api,
+			cache=cache,
+			store=store,
+		)
+
+		# Views of stored threads are counted for the popular and trending
+		# lists, unless the operator would rather not know what people read
+		if store is not None and not config.static_homepage:
+			view_counter = analytics.ViewCounter(store, dedup_window=config.view_dedup_window)
+			trending = analytics.TrendingTracker(store, interval=config.trending_interval)
+		else:
+			view_counter = None
+			trending = None
+
+		# Followed threads, and threads being watched live, are checked for
+		# new tweets from time to time. This always resolves forwards,
+		# whatever the forward flag says.
+		get_thread_forward = tweetbox.make_thread_getter(
+			session=session,
+			cache=cache,
+			token=token,
+			api=api,
+			resolve_quotes=config.resolve_quotes,
+			forward=True,
+			store=store,
+			budget=budget,
+			opt_outs=opt_outs,
+			limiter=limiter,
+		)
+
+		recrawler = follows.Recrawler(
+			store,
+			get_thread_forward,
+			callback_sender=callback_sender,
+			interval=config.recrawl_interval,
+		) if config.recrawl_interval > 0 else None
+
+		live_threads = live.LiveThreads(
+			get_thread_forward,
+			interval=config.live_interval,
+			max_threads=config.live_max_threads,
+		) if config.live_interval > 0 else None
+
+		discord = discord_integration.DiscordIntegration(
+			client_session,
+			config.discord_public_key,
+		) if config.discord_public_key is not None else None
+
+		slack = slack_integration.SlackIntegration(
+			client_session,
+			signing_secret=config.slack_signing_secret,
+			bot_token=config.slack_bot_token,
+		) if config.slack_signing_secret is not None else None
+
+		thread_mailer = mailer.ThreadMailer(
+			mailer.Mailer(
+				config.smtp_host,
+				config.smtp_port,
+				sender=config.email_from,
+				username=config.smtp_username,
+				password=config.smtp_password,
+				ssl=config.smtp_ssl,
+			),
+			config.email_secret,
+		) if config.smtp_host is not None else None
+
+		# Users sign in with twitter, with OAuth 2.0 if there's a client id,
+		# which lets them see protected threads with their own token, or else
+		# through the first configured app
+		if users is None:
+			user_accounts = None
+		elif config.twitter_client_id is not None:
+			user_accounts = bobbin_accounts.Accounts(users, bobbin_accounts.TwitterOAuth2SignIn(
+				client_session,
+				client_id=config.twitter_client_id,
+				client_secret=config.twitter_client_secret,
+			))
+		else:
+			user_accounts = bobbin_accounts.Accounts(users, bobbin_accounts.TwitterSignIn(
+				client_session,
+				consumer_key=config.credentials[0][0],
+				consumer_secret=config.credentials[0][1],
+			))
+
+		# User tokens only work with v2. Protected threads are resolved without
+		# the shared caches, so that nobody else is ever shown them.
+		get_private_thread = tweetbox.make_private_thread_getter(
+			session=session,
+			api=twitter_v2,
+			resolve_quotes=config.resolve_quotes,
+			budget=budget,
+			opt_outs=opt_outs,
+		) if user_accounts is not None and config.twitter_client_id is not None else None
+
+		read_later_services = []
+		if config.pocket_consumer_key is not None:
+			read_later_services.append(bobbin_read_later.Pocket(client_session, consumer_key=config.pocket_consumer_key))
+		if config.instapaper_key is not None:
+			read_later_services.append(bobbin_read_later.Instapaper(
+				client_session,
+				consumer_key=config.instapaper_key,
+				consumer_secret=config.instapaper_secret,
+			))
+		if config.readwise:
+			read_later_services.append(bobbin_read_later.Readwise(client_session))
+		read_later = bobbin_read_later.ReadLater(users, read_later_services) if read_later_services else None
+
+		handler = server.make_handler(server.ServerConfig(
 			get_thread=get_thread,
-			base_directory=static_dir,
-			valid_paths=None,
-			index_path=static_dir / 'index.html'
+			get_thread_replies=get_thread_replies,
+			get_thread_tree=get_thread_tree,
+			tweet_cache=cache,
+			response_cache=responses,
+			thread_store=store,
+			stream_thread=stream_thread,
+			job_queue=job_queue,
+			callback_sender=callback_sender,
+			allow_indexing=config.allow_indexing,
+			show_metrics=config.show_metrics,
+			homepage_threads=not config.static_homepage,
+			view_counter=view_counter,
+			trending=trending,
+			share_images=share_image_renderer,
+			media_mirror=mirror,
+			image_proxy=image_proxy,
+			graphql_schema=graphql_server.make_schema() if config.graphql else None,
+			recrawler=recrawler,
+			live_threads=live_threads,
+			discord=discord,
+			slack=slack,
+			thread_mailer=thread_mailer,
+			read_later=read_later,
+			thread_pdfs=thread_pdfs,
+			get_private_thread=get_private_thread,
+			accounts=user_accounts,
+			providers=providers,
+			opt_outs=opt_outs,
+			admin_token=config.admin_token,
+			token_pool=token if isinstance(token, twitter.TokenPool) else None,
+			flags=flags,
+			client_limiter=client_limiter,
+			api_keys=keys,
+			trusted_proxies=config.trusted_proxies,
+			base_path=config.base_path,
+			health_checks=health_checks,
+			resolution_limiter=limiter,
+			static_dir=static_dir,
+			theme_dir=config.theme_dir,
+			reload_theme=config.reload_theme,
+		))
+
+		if config.tracing:
+			handler = tracing.with_tracing(handler)
+
+		if job_queue is not None:
+			job_queue.start()
+
+		if trending is not None:
+			trending.start()
+
+		if recrawler is not None:
+			recrawler.start()
+
+		# New tweets in watched threads are ingested as they're posted. The
+		# stream is a long-lived connection, so it can't be recorded.
+		stream_rules = stream.make_rules(
+			authors=config.stream_authors,
+			conversations=config.stream_conversations,
 		)
+		ingester = stream.StreamIngester(
+			client_session,
+			token,
+			get_thread,
+			cache,
+			rules=stream_rules,
+		) if stream_rules else None
+
+		if ingester is not None:
+			ingester.start()
+
+		# The bot posts as its own account, with the first app's credentials
+		unroll_bot = bot.UnrollBot(
+			client_session,
+			get_thread,
+			posting.UserAuth(
+				consumer_key=config.credentials[0][0],
+				consumer_secret=config.credentials[0][1],
+				token=config.bot_token,
+				token_secret=config.bot_token_secret,
+			),
+			site_url=config.bot_site_url,
+			interval=config.bot_interval,
+			direct_messages=config.bot_direct_messages,
+		) if config.bot_token is not None else None
+
+		if unroll_bot is not None:
+			unroll_bot.start()
+
+		# The gRPC server shares everything with the web server, but has its
+		# own port
+		rpc_server = await grpc_server.start(
+			grpc_server.BobbinService(
+				get_thread=get_thread,
+				thread_store=store,
+				opt_outs=opt_outs,
+				api_keys=keys,
+				show_metrics=config.show_metrics,
+			),
+			host=config.host,
+			port=config.grpc_port,
+		) if config.grpc_port else None
+
+		try:
+			await server.run(
+				handler,
+				host=config.host,
+				port=config.port,
+				loop=loop,
+				request_timeout=config.request_timeout,
+				grace_period=config.grace_period,
+				tls=server.TLSConfig(
+					cert=config.tls_cert,
+					key=config.tls_key,
+					port=config.tls_port,
+					acme_dir=config.acme_dir,
+				) if config.tls_cert is not None else None,
+			)
+		finally:
+			if rpc_server is not None:
+				await rpc_server.stop(config.grace_period)
+
+			if job_queue is not None:
+				await job_queue.close()
+
+			if trending is not None:
+				await trending.close()
+
+			if recrawler is not None:
+				await recrawler.close()
+
+			if ingester is not None:
+				await ingester.close()
+
+			if unroll_bot is not None:
+				await unroll_bot.close()
+
+			if live_threads is not None:
+				await live_threads.close()
+
+			if discord is not None:
+				await discord.close()
+
+			if slack is not None:
+				await slack.close()
+
+			if callback_sender is not None:
+				await callback_sender.close()
+
+			if card_session is not None:
+				await card_session.close()
+
+			if mastodon_session is not None:
+				await mastodon_session.close()
+
+			if bluesky_session is not None:
+				await bluesky_session.close()
+
+			if mirror is not None:
+				await mirror.close()
+
+			if media_session is not None:
+				await media_session.close()
+
+			if image_session is not None:
+				await image_session.close()
+
+			# For operators who rotate credentials, don't leave usable tokens
+			# lying around after the server is gone
+			if config.invalidate_tokens:
+				await token.invalidate()
+
+			if store is not None:
+				store.close()
+
+			if tokens is not None:
+				tokens.close()
 
-		http_server = web.Server(handler, loop=loop)
-		server = await loop.create_server(http_server, host, port)
+			if users is not None:
+				users.close()
 
-		await server.wait_closed()
+			if tracer_provider is not None:
+				tracer_provider.shutdown()
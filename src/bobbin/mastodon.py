@@ -0,0 +1,380 @@
+# Low level async interface for Mastodon (and other servers with Mastodon's
+# API). Statuses are made into the same Tweet and TwitterUser types that
+# bobbin.twitter returns, so that Mastodon threads can be rendered by the
+# same code as twitter threads; see source for how the two are chosen
+# between.
+#
+# Statuses are identified by their instance's host and their id there,
+# which only means anything on that instance. A status from another instance
+# still has an id on every instance that has seen it, so a link to it on any
+# instance can be followed.
+#
+# Any instance can be linked to, so requests should be made with a session
+# that only connects to public addresses (see link_cards.make_card_session),
+# and hosts are checked with link_cards.check_url before anything is fetched.
+
+from datetime import datetime
+from html.parser import HTMLParser
+import asyncio
+import html
+import re
+
+import aiohttp
+
+from bobbin.link_cards import UnsafeUrlError, check_url
+from bobbin.tweet_text import safe_url
+from bobbin.tweetbox import Thread, ThreadGap
+from bobbin.twitter import (
+	Entities,
+	Media,
+	NoSuchTweetError,
+	Poll,
+	PollOption,
+	ProtectedTweetError,
+	PublicMetrics,
+	Tweet,
+	TwitterError,
+	TwitterUser,
+	UrlEntity,
+	VideoVariant,
+)
+
+STATUS_URL = "https://{instance}/api/v1/statuses/{status_id}"
+CONTEXT_URL = "https://{instance}/api/v1/statuses/{status_id}/context"
+
+# Links to statuses, as shown in the address bar on the status's own
+# instance (https://mastodon.social/@user/123), on another instance
+# (https://mastodon.social/@user@example.com/123), in the web app, or as
+# ActivityPub ids (https://mastodon.social/users/user/statuses/123)
+STATUS_URL_PATTERN = re.compile(
+	r"^\s*https?://(?P<instance>[a-zA-Z0-9.-]+\.[a-zA-Z]{2,})"
+	r"/(?:@[\w.-]+(?:@[a-zA-Z0-9.-]+)?|web/@[\w.-]+(?:@[a-zA-Z0-9.-]+)?|web/statuses|users/[\w.-]+/statuses)"
+	r"/(?P<status_id>[0-9]{1,20})"
+	r"/?(?:[?#]\S*)?\s*$"
+)
+
+# Longer threads than this are cut short, as if they'd run out of budget
+MAX_THREAD_LENGTH = 1000
+
+MEDIA_TYPES = {
+	"image": "photo",
+	"video": "video",
+	"gifv": "animated_gif",
+}
+
+
+class MastodonError(TwitterError):
+	'''
+	An error from a Mastodon instance. This is a TwitterError, so that it's
+	handled the same way as errors from twitter.
+	'''
+
+
+def parse_status_url(text):
+	'''
+	Get the (instance, status id) from a link to a Mastodon status, or None
+	if text isn't one
+	'''
+	match = STATUS_URL_PATTERN.match(text)
+	if match is None:
+		return None
+
+	return match.group("instance").lower(), match.group("status_id")
+
+
+class ContentParser(HTMLParser):
+	'''
+	Turns the HTML content of a status into plain text. Links are replaced
+	with their full urls, which are collected as UrlEntities, except for
+	mentions and hashtags, which keep their text. Paragraphs are separated by
+	blank lines. Mastodon shortens the text of links by hiding parts of it in
+	invisible spans, which are left out of their display urls.
+	'''
+	def __init__(self):
+		super().__init__(convert_charrefs=True)
+		self.parts = []
+		self.urls = []
+		# The href of the link we're in, if it's one to be replaced
+		self.link = None
+		self.display = []
+		self.paragraphs = 0
+		# Whether each span we're in is invisible
+		self.spans = []
+
+	def handle_starttag(self, tag, attrs):
+		attrs = dict(attrs)
+
+		if tag == "br":
+			self.parts.append("\n")
+		elif tag == "p":
+			if self.paragraphs:
+				self.parts.append("\n\n")
+			self.paragraphs += 1
+		elif tag == "span":
+			self.spans.append("invisible" in (attrs.get("class") or "").split())
+		elif tag == "a":
+			classes = (attrs.get("class") or "").split()
+			href = attrs.get("href")
+			if href and "mention" not in classes and "hashtag" not in classes:
+				self.link = href
+				self.display = []
+
+	def handle_endtag(self, tag):
+		if tag == "span" and self.spans:
+			self.spans.pop()
+		elif tag == "a" and self.link is not None:
+			self.parts.append(self.link)
+			self.urls.append((self.link, "".join(self.display).strip()))
+			self.link = None
+
+	def handle_data(self, data):
+		if self.link is not None:
+			if not any(self.spans):
+				self.display.append(data)
+		else:
+			self.parts.append(data)
+
+	def text(self):
+		return "".join(self.parts).strip()
+
+
+def content_text(content):
+	'''
+	Get the text and UrlEntities of a status from its HTML content. Like
+	tweet text, the text is HTML escaped.
+	'''
+	parser = ContentParser()
+	parser.feed(content or "")
+	parser.close()
+
+	return html.escape(parser.text(), quote=False), tuple(
+		UrlEntity(None, html.escape(url, quote=False), url, display or url)
+		for url, display in parser.urls
+	)
+
+
+def parse_created_at(created_at):
+	# Like 2019-12-08T03:48:33.901Z, though not every server includes the
+	# milliseconds
+	created_at = created_at.replace("Z", "+00:00")
+	try:
+		return datetime.strptime(created_at, "%Y-%m-%dT%H:%M:%S.%f%z")
+	except ValueError:
+		return datetime.strptime(created_at, "%Y-%m-%dT%H:%M:%S%z")
+
+
+def user_from_json(blob, *, instance):
+	'''
+	Create a TwitterUser from a Mastodon account. Accounts on the instance
+	itself only have a username for an acct, so the instance is added, so
+	that the handle is the same whichever instance it's seen from. The id is
+	the full handle, since account ids are only meaningful on one instance.
+	'''
+	handle = blob["acct"] if "@" in blob["acct"] else f"{blob['acct']}@{instance}"
+
+	# Instances can say anything here, so only http links are kept; the rest
+	# are linked to on the instance the status came from
+	url = blob.get("url")
+	if not safe_url(url):
+		url = f"https://{instance}/@{handle}"
+
+	return TwitterUser(
+		handle,
+		handle,
+		blob.get("display_name") or blob["username"],
+		blob.get("avatar_static") or blob.get("avatar"),
+		None,
+		False,
+		blob.get("followers_count"),
+		url,
+	)
+
+
+def media_from_json(blob):
+	meta = (blob.get("meta") or {}).get("original") or {}
+	media_type = MEDIA_TYPES.get(blob["type"])
+	is_video = media_type in ("video", "animated_gif")
+
+	return Media(
+		None,
+		None,
+		blob["preview_url"] if is_video else blob["url"],
+		media_type,
+		meta.get("width"),
+		meta.get("height"),
+		blob.get("description"),
+		# There's just the one encoding, so its bitrate doesn't matter, but
+		# best_variant skips variants without one
+		(VideoVariant("video/mp4", 0, blob["url"]),) if is_video else (),
+	)
+
+
+def poll_from_json(blob):
+	expires_at = blob.get("expires_at")
+
+	return Poll(
+		blob["id"],
+		tuple(
+			PollOption(position, option["title"], option.get("votes_count") or 0)
+			for position, option in enumerate(blob["options"], 1)
+		),
+		parse_created_at(expires_at) if expires_at else None,
+		None,
+		"closed" if blob.get("expired") else "open",
+	)
+
+
+def tweet_from_json(blob, *, instance):
+	'''
+	Create a Tweet from a Mastodon status. Boosts are made into the status
+	they boosted. Audio and other media types we can't show are left out.
+	'''
+	if blob.get("reblog"):
+		blob = blob["reblog"]
+
+	text, urls = content_text(blob.get("content"))
+	user = user_from_json(blob["account"], instance=instance)
+	url = next((url for url in (blob.get("url"), blob.get("uri")) if safe_url(url)), None)
+
+	# Content warnings hide the text behind a summary; here it's just shown
+	# first
+	if blob.get("spoiler_text"):
+		text = f"{html.escape(blob['spoiler_text'], quote=False)}\n\n{text}"
+
+	return Tweet(
+		blob["id"],
+		user,
+		blob.get("in_reply_to_id"),
+		None,
+		text,
+		parse_created_at(blob["created_at"]),
+		Entities(
+			urls,
+			(),
+			(),
+			tuple(
+				media_from_json(media)
+				for media in blob.get("media_attachments", ())
+				if media.get("type") in MEDIA_TYPES
+			),
+		),
+		None,
+		None,
+		None,
+		PublicMetrics(
+			blob.get("favourites_count", 0),
+			blob.get("reblogs_count", 0),
+			blob.get("replies_count", 0),
+			None,
+		),
+		poll_from_json(blob["poll"]) if blob.get("poll") else None,
+		url=url if url is not None else f"https://{instance}/@{user.handle}/{blob['id']}",
+	)
+
+
+async def request_json(*, session, url, status_id, timeout):
+	try:
+		check_url(url)
+	except UnsafeUrlError as e:
+		raise MastodonError(str(e)) from e
+
+	try:
+		async with session.get(
+			url,
+			headers={"Accept": "application/json"},
+			timeout=aiohttp.ClientTimeout(total=timeout),
+		) as response:
+			if response.status == 404:
+				raise NoSuchTweetError(status_id)
+			elif response.status in (401, 403):
+				# Private statuses, and instances that don't allow
+				# unauthenticated reads
+				raise ProtectedTweetError(status_id)
+			elif response.status != 200:
+				raise MastodonError(f"Instance responded with {response.status}")
+
+			return await response.json(content_type=None)
+	except (aiohttp.ClientError, ValueError) as e:
+		# Including UnsafeUrlErrors from the session's resolver, and invalid
+		# JSON
+		raise MastodonError(f"Couldn't reach the instance: {e}") from e
+
+
+async def get_status(*, session, instance, status_id, timeout=10):
+	blob = await request_json(
+		session=session,
+		url=STATUS_URL.format(instance=instance, status_id=status_id),
+		status_id=status_id,
+		timeout=timeout,
+	)
+	return tweet_from_json(blob, instance=instance)
+
+
+async def get_ancestors(*, session, instance, status_id, timeout=10):
+	'''
+	Get the statuses that status_id is in reply to, as far as the instance
+	knows them, as a dict by id. Failures just mean an empty dict, since each
+	status can still be fetched on its own.
+	'''
+	try:
+		blob = await request_json(
+			session=session,
+			url=CONTEXT_URL.format(instance=instance, status_id=status_id),
+			status_id=status_id,
+			timeout=timeout,
+		)
+	except (MastodonError, asyncio.TimeoutError):
+		return {}
+
+	statuses = {}
+	for ancestor in blob.get("ancestors", ()):
+		try:
+			tweet = tweet_from_json(ancestor, instance=instance)
+		except (KeyError, TypeError, ValueError):
+			continue
+		statuses[tweet.id] = tweet
+
+	return statuses
+
+
+async def get_thread(*, session, instance, tail, timeout=10, max_length=MAX_THREAD_LENGTH):
+	'''
+	Get the Thread ending at the status tail on instance, by walking
+	in_reply_to_id back to the start. The instance's context for the tail
+	usually has the whole chain, so it's only a couple of requests; anything
+	missing from it is fetched one status at a time. As with twitter threads,
+	statuses that can't be seen become a ThreadGap at the start of the
+	thread.
+	'''
+	try:
+		tweet = await get_status(session=session, instance=instance, status_id=tail, timeout=timeout)
+	except (KeyError, TypeError) as e:
+		raise MastodonError("Invalid status from the instance") from e
+
+	ancestors = await get_ancestors(session=session, instance=instance, status_id=tail, timeout=timeout) if tweet.parent_id is not None else {}
+
+	tweets = [tweet]
+	gaps = []
+	truncated = None
+
+	while tweet.parent_id is not None:
+		if len(tweets) >= max_length:
+			truncated = tweet.parent_id
+			break
+
+		parent_id = tweet.parent_id
+		try:
+			tweet = ancestors[parent_id]
+		except KeyError:
+			try:
+				tweet = await get_status(session=session, instance=instance, status_id=parent_id, timeout=timeout)
+			except (NoSuchTweetError, ProtectedTweetError) as e:
+				gaps.append(ThreadGap(parent_id, e.reason))
+				break
+			except (KeyError, TypeError) as e:
+				raise MastodonError("Invalid status from the instance") from e
+
+		tweets.append(tweet)
+
+	tweets.reverse()
+	return Thread(tweets, gaps=gaps, truncated=truncated)
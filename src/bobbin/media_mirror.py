@@ -0,0 +1,191 @@
+# Mirroring of the photos and videos in threads, so that threads still look
+# right after their media is deleted from twitter's CDN (or wherever else it
+# was hosted). Media is copied to a BlobStore in the background the first
+# time a thread with it is seen, and once a copy is there, the thread's media
+# urls point at it instead, under /media/ (see export_server.media_handler).
+# Until then, the original urls are used.
+#
+# Copies are stored under a hash of their original url, so each is only
+# downloaded once, however many threads it's in. They're kept under media/
+# in the site's blob store (see blob_store).
+
+from urllib.parse import urlsplit
+import asyncio
+import hashlib
+import logging
+import os
+import time
+
+import aiohttp
+import cachetools
+
+from bobbin.link_cards import UnsafeUrlError, check_url, read_limited
+
+logger = logging.getLogger(__name__)
+
+USER_AGENT = "Mozilla/5.0 (compatible; bobbin media mirror)"
+
+# Copies keep the extension of the original, if it's one of these, so that
+# they're served with the right type
+EXTENSIONS = frozenset({".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp4"})
+
+STORE_PREFIX = "media/"
+
+
+def media_key(url):
+	'''
+	Get the key a copy of the media at url is stored under
+	'''
+	extension = os.path.splitext(urlsplit(url).path)[1].lower()
+	digest = hashlib.sha256(url.encode()).hexdigest()
+	return digest + extension if extension in EXTENSIONS else digest
+
+
+class MediaMirror:
+	'''
+	Copies media to store, downloading it with session, which should only
+	connect to public addresses (see link_cards.make_card_session). Copies
+	are served from url_prefix. Media larger than max_bytes, or that takes
+	longer than timeout seconds to download, isn't copied; failed downloads
+	are retried after retry_after seconds.
+	'''
+	def __init__(
+		self,
+		session,
+		store,
+		*,
+		url_prefix="/media",
+		timeout=60,
+		max_bytes=50 * 1024 * 1024,
+		max_concurrent=4,
+		cache_size=100000,
+		retry_after=60 * 60,
+	):
+		self.session = session
+		self.store = store
+		self.url_prefix = url_prefix.rstrip("/")
+		self.timeout = timeout
+		self.max_bytes = max_bytes
+		self.max_concurrent = max_concurrent
+
+		# Keys known to be in the store, and keys that recently failed
+		self.mirrored = cachetools.LRUCache(cache_size)
+		self.failed = cachetools.TTLCache(cache_size, retry_after, timer=time.monotonic)
+
+		# key -> download task
+		self.pending = {}
+		self.semaphore = None
+
+	async def download_uncached(self, url, key):
+		check_url(url)
+
+		async with self.session.get(url, allow_redirects=False, headers={"User-Agent": USER_AGENT}) as response:
+			if response.status != 200:
+				logger.info("Couldn't mirror %s: status %s", url, response.status)
+				return False
+
+			body = await read_limited(response, self.max_bytes)
+			if body is None:
+				logger.info("Couldn't mirror %s: larger than %d bytes", url, self.max_bytes)
+				return False
+
+			content_type = response.content_type
+
+		await self.store.put(STORE_PREFIX + key, body, content_type)
+		return True
+
+	async def download(self, url, key):
+		if self.semaphore is None:
+			self.semaphore = asyncio.Semaphore(self.max_concurrent)
+
+		async with self.semaphore:
+			try:
+				mirrored = await asyncio.wait_for(self.download_uncached(url, key), self.timeout)
+			except asyncio.CancelledError:
+				raise
+			except (aiohttp.ClientError, asyncio.TimeoutError, OSError, UnsafeUrlError) as e:
+				logger.info("Couldn't mirror %s: %r", url, e)
+				mirrored = False
+
+		if mirrored:
+			self.mirrored[key] = True
+		else:
+			self.failed[key] = True
+
+	def schedule(self, url, key):
+		if key in self.pending or key in self.failed:
+			return
+
+		task = self.pending[key] = asyncio.ensure_future(self.download(url, key))
+		task.add_done_callback(lambda task: self.pending.pop(key, None))
+
+	async def is_mirrored(self, key):
+		if key in self.mirrored:
+			return True
+		elif key in self.pending or key in self.failed:
+			return False
+
+		try:
+			exists = await self.store.exists(STORE_PREFIX + key)
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, OSError) as e:
+			logger.warning("Couldn't check the media store for %s: %r", key, e)
+			return False
+
+		if exists:
+			self.mirrored[key] = True
+		return exists
+
+	async def get(self, key):
+		'''
+		Get the (body, content type) of the copy stored under key, or None
+		'''
+		return await self.store.get(STORE_PREFIX + key)
+
+	async def mirror_url(self, url):
+		'''
+		Get the url of the copy of the media at url, if there is one, or else
+		start copying it and return url itself
+		'''
+		if not url or url.startswith(self.url_prefix + "/"):
+			return url
+
+		key = media_key(url)
+		if await self.is_mirrored(key):
+			return f"{self.url_prefix}/{key}"
+
+		self.schedule(url, key)
+		return url
+
+	async def mirror_media(self, media):
+		# Only the variant that would be played is copied
+		best = media.best_variant()
+		variants = media.variants
+		if best is not None:
+			mirrored = best._replace(url=await self.mirror_url(best.url))
+			variants = tuple(mirrored if variant == best else variant for variant in variants)
+
+		return media._replace(media_url=await self.mirror_url(media.media_url), variants=variants)
+
+	async def mirror_tweet(self, tweet):
+		media = tuple(await asyncio.gather(*map(self.mirror_media, tweet.entities.media)))
+		quoted = await self.mirror_tweet(tweet.quoted) if tweet.quoted is not None else None
+
+		if media == tweet.entities.media and quoted == tweet.quoted:
+			return tweet
+
+		return tweet._replace(entities=tweet.entities._replace(media=media), quoted=quoted)
+
+	async def mirror_thread(self, thread):
+		'''
+		Mirror the media in all the tweets in thread (see
+		tweetbox.make_thread_getter's transforms)
+		'''
+		return await thread.map_tweets(self.mirror_tweet)
+
+	async def close(self):
+		for task in self.pending.values():
+			task.cancel()
+
+		await asyncio.gather(*self.pending.values(), return_exceptions=True)
@@ -0,0 +1,129 @@
+# Twitter API requests are made through a chain of middleware, each of which
+# handles one concern: retries, auth, error checking, rate limiting, caching,
+# logging, metrics. A handler is an async function taking an ApiRequest and
+# returning an ApiResponse; a middleware takes the next handler and returns
+# a new one, which can change the request on its way in, the response on its
+# way out, or not call the next handler at all. At the bottom of the chain,
+# send makes the actual request with the request's session.
+#
+#     def noisy(send):
+#         async def noisy_handler(request):
+#             response = await send(request)
+#             print(request.url, response.status)
+#             return response
+#         return noisy_handler
+#
+# The twitter client's own middleware is in twitter (see
+# twitter.request_json); extra middleware can be given to a Token.
+
+from collections import defaultdict, namedtuple
+import functools
+import json
+import logging
+import time
+
+logger = logging.getLogger(__name__)
+
+
+class ApiRequest(namedtuple("ApiRequest", "session token url params headers endpoint")):
+	'''
+	A GET request to url with params and headers, through session. token is
+	what the request is authorized with (a twitter.Token, TokenPool, or a
+	bearer token string), and endpoint is what it's rate limited as.
+	'''
+	__slots__ = ()
+
+	def with_headers(self, headers):
+		return self._replace(headers={**self.headers, **headers})
+
+
+class ApiResponse(namedtuple("ApiResponse", "status headers body")):
+	'''
+	A response, with its headers (names lowercased) and its parsed json body,
+	or None if it didn't have one
+	'''
+	__slots__ = ()
+
+	def json(self):
+		if self.body is None:
+			raise ValueError("Response has no json body")
+		return self.body
+
+
+async def send(request):
+	'''
+	The handler at the bottom of every chain, which actually makes the
+	request
+	'''
+	async with request.session.get(url=request.url, params=request.params, headers=request.headers) as response:
+		raw = await response.read()
+		headers = {name.lower(): value for name, value in response.headers.items()}
+
+	try:
+		body = json.loads(raw.decode()) if raw else None
+	except ValueError:
+		body = None
+
+	return ApiResponse(response.status, headers, body)
+
+
+def chain(*middleware, handler=send):
+	'''
+	Wrap handler in middleware. The first middleware is the outermost: it
+	sees requests first and responses last.
+	'''
+	return functools.reduce(lambda handler, wrap: wrap(handler), reversed(middleware), handler)
+
+
+def logged(send):
+	'''
+	Middleware that logs every request at debug level, with its status and
+	how long it took
+	'''
+	async def logged_handler(request):
+		start = time.monotonic()
+		try:
+			response = await send(request)
+		except Exception as e:
+			logger.debug("GET %s failed after %.3fs: %r", request.url, time.monotonic() - start, e)
+			raise
+
+		logger.debug("GET %s %d in %.3fs", request.url, response.status, time.monotonic() - start)
+		return response
+
+	return logged_handler
+
+
+class RequestMetrics:
+	'''
+	Middleware that counts requests per endpoint, by response status (or
+	"error", if there wasn't a response), and their total time
+	'''
+	def __init__(self):
+		# endpoint -> status -> count
+		self.counts = defaultdict(lambda: defaultdict(int))
+		self.seconds = defaultdict(float)
+
+	def __call__(self, send):
+		async def metrics_handler(request):
+			start = time.monotonic()
+			status = "error"
+			try:
+				response = await send(request)
+				status = str(response.status)
+				return response
+			finally:
+				self.counts[request.endpoint][status] += 1
+				self.seconds[request.endpoint] += time.monotonic() - start
+
+		return metrics_handler
+
+	def stats(self):
+		return {
+			endpoint: {
+				"requests": sum(counts.values()),
+				"statuses": dict(counts),
+				"average_seconds": self.seconds[endpoint] / sum(counts.values()),
+			}
+			for endpoint, counts in self.counts.items()
+		}
@@ -0,0 +1,529 @@
+# Best-effort scraping of tweets from a Nitter instance, for self-hosters
+# without twitter API credentials. This has the same interface as the other
+# api modules (twitter and twitter_v2), so tweetbox can resolve threads with
+# it, but it's only ever used when no credentials are configured; see
+# main.make_api.
+#
+# Everything here depends on the HTML of Nitter's status pages, which isn't
+# an API and can change (or be blocked by twitter) at any time. In
+# particular:
+#
+# - Users are identified by their handle, since Nitter pages don't show
+#   users' ids. Opt-outs by handle still work; opt-outs by id don't.
+# - A tweet's parent is only known if it's shown above the tweet on its
+#   page. If it isn't (because Nitter cut the conversation short, or the
+#   parent is unavailable), the tweet is treated as the start of its thread.
+# - Timelines don't show what each tweet replies to, so get_user_tweets and
+#   user_timeline return nothing, and threads can't be resolved forwards.
+# - There's no conversation search, replies lookup, or batched lookups.
+#
+# Each status page also shows the tweet's ancestors, so those are kept in
+# the Instance, and later lookups for them don't make a request at all.
+
+from datetime import datetime, timezone
+from html.parser import HTMLParser
+from urllib.parse import unquote, urljoin
+import asyncio
+import html
+import re
+
+import aiohttp
+import cachetools
+
+from bobbin.twitter import (
+	Entities,
+	Media,
+	NoSuchTweetError,
+	NoSuchUserError,
+	PublicMetrics,
+	TimelinePager,
+	Tweet,
+	TwitterError,
+	TwitterUser,
+	UrlEntity,
+	VideoVariant,
+)
+
+USER_AGENT = "Mozilla/5.0 (compatible; bobbin)"
+
+IMAGE_URL = "https://pbs.twimg.com"
+
+STATUS_ID_PATTERN = re.compile(r"/status/([0-9]{1,20})")
+
+# Nitter proxies images through /pic/ (with the full size ones under
+# /pic/orig/), and videos through /video/<signature>/, with the original
+# url escaped after that
+PROXIED_IMAGE_PATTERN = re.compile(r"^/pic/(?:orig/)?(?P<path>[^/?]+)$")
+PROXIED_VIDEO_PATTERN = re.compile(r"^/video/[^/]+/(?P<url>[^/]+)$")
+
+# Like "Aug 7, 2023 · 5:31 AM UTC"
+DATE_FORMAT = "%b %d, %Y · %I:%M %p UTC"
+
+# Elements that never have an end tag
+VOID_TAGS = frozenset({"area", "br", "hr", "img", "input", "link", "meta", "source", "wbr"})
+
+STAT_ICONS = {
+	"icon-comment": "replies",
+	"icon-retweet": "retweets",
+	"icon-quote": "quotes",
+	"icon-heart": "likes",
+}
+
+
+class NitterError(TwitterError):
+	'''
+	An error from the Nitter instance, or a page we couldn't make sense of.
+	This is a TwitterError, so that it's handled the same way as errors from
+	twitter.
+	'''
+
+
+class Instance:
+	'''
+	The token for the nitter api: the instance at url to scrape, and the
+	tweets recently seen on its pages. Unlike twitter tokens, there's nothing
+	to generate or invalidate.
+	'''
+	def __init__(self, url, *, timeout=10, max_seen=10000):
+		self.url = url.rstrip("/")
+		self.timeout = timeout
+
+		# tweet id -> Tweet, for ancestors shown on status pages
+		self.seen = cachetools.LRUCache(maxsize=max_seen)
+
+	async def get_token(self):
+		# For the health checks, which make sure tokens are usable
+		return None
+
+	async def invalidate(self):
+		pass
+
+
+def media_url(instance, path):
+	'''
+	Get the real url of some proxied media, so that it's loaded from
+	twitter's CDN like any other tweet's, or the proxied url if it isn't
+	recognized (for instance, if the instance encodes its media urls).
+	'''
+	if path.startswith("/pic/enc/") or path.startswith("/video/enc/"):
+		return urljoin(instance + "/", path)
+
+	match = PROXIED_IMAGE_PATTERN.match(path)
+	if match is not None:
+		real = unquote(match.group("path")).split("?")[0]
+		if real.startswith(("pbs.twimg.com/", "video.twimg.com/")):
+			return f"https://{real}"
+		return f"{IMAGE_URL}/{real}"
+
+	match = PROXIED_VIDEO_PATTERN.match(path)
+	if match is not None:
+		return unquote(match.group("url"))
+
+	return urljoin(instance + "/", path)
+
+
+def parse_status_id(href):
+	match = STATUS_ID_PATTERN.search(href or "")
+	return match.group(1) if match is not None else None
+
+
+def parse_count(text):
+	digits = re.sub(r"[^0-9]", "", text)
+	return int(digits) if digits else 0
+
+
+class ScrapedTweet:
+	'''
+	Everything found about a single tweet (or a placeholder for one that's
+	unavailable, or for hidden replies) on a page, before it's made into a
+	Tweet
+	'''
+	def __init__(self, section, classes):
+		self.section = section
+		self.unavailable = "unavailable" in classes
+		self.more = "more-replies" in classes
+		self.id = None
+		self.name = []
+		self.handle = None
+		self.avatar = None
+		self.date = None
+		self.reply = False
+		self.text = []
+		self.urls = []
+		self.media = []
+		self.quoted_id = None
+		self.stats = {}
+
+
+class PageParser(HTMLParser):
+	'''
+	Collects the tweets on a Nitter page as ScrapedTweets, in page order.
+	Each one's section is where it was found: "before" for the ancestors on a
+	status page, "main" for the status itself, "after" for replies to it, or
+	"timeline" for anything else. Quoted tweets are only collected as ids.
+	'''
+	def __init__(self, instance):
+		super().__init__(convert_charrefs=True)
+		self.instance = instance
+		self.tweets = []
+
+		# The classes of every open element
+		self.stack = []
+
+		self.tweet = None
+		# The depth of the current tweet's element in the stack
+		self.tweet_depth = None
+
+		# The href of the link in the tweet text we're in, and its text
+		self.link = None
+		self.display = []
+
+		# The metric whose count is the next text in the tweet's stats
+		self.stat = None
+
+	def inside(self, name):
+		return any(name in classes for classes in self.stack)
+
+	def section(self):
+		if self.inside("before-tweet"):
+			return "before"
+		elif self.inside("main-tweet"):
+			return "main"
+		elif self.inside("after-tweet") or self.inside("replies"):
+			return "after"
+		else:
+			return "timeline"
+
+	def handle_starttag(self, tag, attrs):
+		attrs = dict(attrs)
+		classes = frozenset((attrs.get("class") or "").split())
+
+		if tag not in VOID_TAGS:
+			self.stack.append(classes)
+
+		if tag == "div" and "timeline-item" in classes and self.tweet is None:
+			self.tweet = ScrapedTweet(self.section(), classes)
+			self.tweet_depth = len(self.stack)
+			return
+
+		tweet = self.tweet
+		if tweet is None:
+			return
+
+		if self.inside("quote"):
+			if tag == "a" and "quote-link" in classes:
+				tweet.quoted_id = parse_status_id(attrs.get("href"))
+			return
+
+		if tag == "div" and "replying-to" in classes:
+			tweet.reply = True
+		elif tag == "a" and "fullname" in classes:
+			if attrs.get("title"):
+				tweet.name = [attrs["title"]]
+		elif tag == "a" and "username" in classes:
+			tweet.handle = (attrs.get("title") or "").lstrip("@") or tweet.handle
+		elif tag == "img" and "avatar" in classes and tweet.avatar is None:
+			tweet.avatar = media_url(self.instance, attrs.get("src") or "")
+		elif tag == "a" and self.inside("tweet-date"):
+			tweet.id = parse_status_id(attrs.get("href"))
+			tweet.date = attrs.get("title")
+		elif tag == "a" and self.inside("tweet-content"):
+			href = attrs.get("href") or ""
+			# Mentions and hashtags link to the instance, and keep their text
+			if href.startswith(("http://", "https://")):
+				self.link = href
+				self.display = []
+		elif tag == "br" and self.inside("tweet-content"):
+			tweet.text.append("\n")
+		elif self.inside("attachments"):
+			self.start_attachment(tag, attrs, classes)
+		elif tag == "span" and self.inside("tweet-stat"):
+			for name, stat in STAT_ICONS.items():
+				if name in classes:
+					self.stat = stat
+
+	def start_attachment(self, tag, attrs, classes):
+		media = self.tweet.media
+
+		if tag == "a" and "still-image" in classes:
+			media.append(["photo", media_url(self.instance, attrs.get("href") or ""), None, []])
+		elif tag == "img" and media and media[-1][0] == "photo" and attrs.get("alt"):
+			media[-1][2] = attrs["alt"]
+		elif tag == "video":
+			media.append([
+				"animated_gif" if "gif" in classes else "video",
+				media_url(self.instance, attrs.get("poster") or ""),
+				None,
+				[],
+			])
+			if attrs.get("data-url"):
+				media[-1][3].append(VideoVariant(
+					"application/x-mpegURL",
+					None,
+					media_url(self.instance, attrs["data-url"]),
+				))
+		elif tag == "source" and media and media[-1][0] != "photo" and attrs.get("src"):
+			# There's just the one encoding, so its bitrate doesn't matter,
+			# but best_variant skips variants without one
+			media[-1][3].append(VideoVariant(
+				attrs.get("type") or "video/mp4",
+				0,
+				media_url(self.instance, attrs["src"]),
+			))
+
+	def handle_endtag(self, tag):
+		if tag in VOID_TAGS or not self.stack:
+			return
+
+		if self.tweet is not None and not self.inside("quote"):
+			if tag == "a" and self.link is not None:
+				self.tweet.text.append(self.link)
+				self.tweet.urls.append((self.link, "".join(self.display).strip()))
+				self.link = None
+
+		self.stack.pop()
+
+		if self.tweet is not None and len(self.stack) < self.tweet_depth:
+			self.tweets.append(self.tweet)
+			self.tweet = None
+			self.tweet_depth = None
+
+		if self.tweet is not None and not self.inside("tweet-stat"):
+			self.stat = None
+
+	def handle_data(self, data):
+		tweet = self.tweet
+		if tweet is None or self.inside("quote"):
+			return
+
+		if self.link is not None:
+			self.display.append(data)
+		elif self.inside("tweet-content"):
+			tweet.text.append(data)
+		elif self.stat is not None and data.strip():
+			tweet.stats[self.stat] = parse_count(data)
+			self.stat = None
+		elif self.inside("fullname") and not tweet.name:
+			tweet.name.append(data)
+
+
+def parse_page(instance, page):
+	parser = PageParser(instance)
+	parser.feed(page)
+	parser.close()
+	return parser.tweets
+
+
+def parse_date(date):
+	return datetime.strptime(date, DATE_FORMAT).replace(tzinfo=timezone.utc)
+
+
+def make_tweet(scraped, *, parent=None):
+	'''
+	Create a Tweet from a ScrapedTweet. parent is the Tweet it replies to,
+	if that's known. Like tweet text, the text is HTML escaped.
+	'''
+	if scraped.id is None or scraped.handle is None or scraped.date is None:
+		raise NitterError("Tweet is missing from the page")
+
+	handle = scraped.handle
+	user = TwitterUser(
+		handle,
+		handle,
+		"".join(scraped.name).strip() or handle,
+		scraped.avatar,
+	)
+
+	return Tweet(
+		scraped.id,
+		user,
+		parent.id if parent is not None else None,
+		parent.user.id if parent is not None else None,
+		html.escape("".join(scraped.text).strip(), quote=False),
+		parse_date(scraped.date),
+		Entities(
+			tuple(
+				UrlEntity(None, html.escape(url, quote=False), url, display or url)
+				for url, display in scraped.urls
+			),
+			(),
+			(),
+			tuple(
+				Media(None, None, url, media_type, None, None, alt_text, tuple(variants))
+				for media_type, url, alt_text, variants in scraped.media
+			),
+		),
+		scraped.quoted_id,
+		None,
+		None,
+		PublicMetrics(
+			scraped.stats.get("likes", 0),
+			scraped.stats.get("retweets", 0),
+			scraped.stats.get("replies", 0),
+			scraped.stats.get("quotes"),
+		) if scraped.stats else None,
+	)
+
+
+def status_tweets(scraped_tweets):
+	'''
+	Make Tweets from the ancestors and main tweet on a status page. Each
+	ancestor replies to the one before it, unless there's a gap between
+	them; ancestors whose parents aren't known are left out. Returns
+	(main tweet, {id: ancestor}).
+	'''
+	ancestors = {}
+	parent = None
+	# Whether the previous item is the parent of the next one
+	known = True
+
+	for scraped in scraped_tweets:
+		if scraped.section == "before":
+			if scraped.unavailable or scraped.more:
+				parent = None
+				known = False
+				continue
+
+			if not scraped.reply:
+				tweet = make_tweet(scraped)
+				ancestors[tweet.id] = tweet
+			elif known and parent is not None:
+				tweet = make_tweet(scraped, parent=parent)
+				ancestors[tweet.id] = tweet
+			else:
+				tweet = make_tweet(scraped)
+
+			parent = tweet
+			known = True
+		elif scraped.section == "main":
+			if scraped.unavailable:
+				return None, ancestors
+
+			return make_tweet(scraped, parent=parent if scraped.reply and known else None), ancestors
+
+	return None, ancestors
+
+
+async def get_page(*, session, token, path, not_found):
+	'''
+	Get a page from the instance. not_found is the error to raise if it
+	doesn't exist.
+	'''
+	try:
+		async with session.get(
+			token.url + path,
+			headers={"User-Agent": USER_AGENT, "Accept": "text/html"},
+			timeout=aiohttp.ClientTimeout(total=token.timeout),
+		) as response:
+			if response.status == 404:
+				raise not_found
+			elif response.status != 200:
+				raise NitterError(f"Nitter responded with {response.status}")
+
+			return await response.text()
+	except (aiohttp.ClientError, asyncio.TimeoutError, UnicodeDecodeError) as e:
+		raise NitterError(f"Couldn't reach Nitter: {e}") from e
+
+
+async def get_tweet(*, session, token, tweet_id):
+	try:
+		return token.seen[tweet_id]
+	except KeyError:
+		pass
+
+	page = await get_page(
+		session=session,
+		token=token,
+		path=f"/i/status/{tweet_id}",
+		not_found=NoSuchTweetError(tweet_id),
+	)
+
+	try:
+		tweet, ancestors = status_tweets(parse_page(token.url, page))
+	except ValueError as e:
+		raise NitterError("Invalid tweet from Nitter") from e
+
+	if tweet is None:
+		raise NoSuchTweetError(tweet_id)
+
+	token.seen.update(ancestors)
+	return tweet
+
+
+async def get_user_tweets(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200):
+	# Nitter's timelines don't say which tweets replies are replying to, so
+	# they're no use for finding threads
+	return []
+
+
+def user_timeline(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200):
+	async def fetch_page(cursor):
+		return [], None
+
+	return TimelinePager(fetch_page)
+
+
+class ProfileParser(HTMLParser):
+	'''
+	Collects the fields of the profile card on a Nitter profile page
+	'''
+	def __init__(self, instance):
+		super().__init__(convert_charrefs=True)
+		self.instance = instance
+		self.stack = []
+		self.fields = {}
+
+	def inside(self, name):
+		return any(name in classes for classes in self.stack)
+
+	def handle_starttag(self, tag, attrs):
+		attrs = dict(attrs)
+		classes = frozenset((attrs.get("class") or "").split())
+
+		if tag not in VOID_TAGS:
+			self.stack.append(classes)
+
+		if tag == "a" and "profile-card-fullname" in classes:
+			self.fields["name"] = attrs.get("title")
+		elif tag == "a" and "profile-card-username" in classes:
+			self.fields["handle"] = (attrs.get("title") or "").lstrip("@")
+		elif tag == "a" and "profile-card-avatar" in classes:
+			self.fields["avatar"] = media_url(self.instance, attrs.get("href") or "")
+
+	def handle_endtag(self, tag):
+		if tag not in VOID_TAGS and self.stack:
+			self.stack.pop()
+
+	def handle_data(self, data):
+		if self.inside("profile-bio"):
+			self.fields.setdefault("bio", []).append(data)
+		elif self.inside("followers") and self.inside("profile-stat-num"):
+			self.fields["followers"] = parse_count(data)
+
+
+async def get_user(*, session, token, user_id):
+	'''
+	Get a user by handle, or by numeric id (which Nitter can look up, though
+	the user's id is still their handle)
+	'''
+	path = f"/i/user/{user_id}" if user_id.isdigit() else f"/{user_id}"
+	page = await get_page(session=session, token=token, path=path, not_found=NoSuchUserError(user_id))
+
+	parser = ProfileParser(token.url)
+	parser.feed(page)
+	parser.close()
+	fields = parser.fields
+
+	if not fields.get("handle"):
+		raise NoSuchUserError(user_id)
+
+	handle = fields["handle"]
+	return TwitterUser(
+		handle,
+		handle,
+		fields.get("name") or handle,
+		fields.get("avatar"),
+		"".join(fields.get("bio", ())).strip() or None,
+		False,
+		fields.get("followers"),
+	)
@@ -0,0 +1,128 @@
+# Authors who have asked not to have their threads shown on bobbin. Threads
+# containing tweets by any of them are refused, whether they're resolved
+# from twitter or loaded from the thread store.
+#
+# Authors are identified by handle or by user id. In the opt-out file, each
+# line is one author: "@handle" or "handle" for a handle, and "id:1234" (or
+# just the digits) for a user id. Blank lines and lines starting with # are
+# ignored. Handles are matched case insensitively. Because handles can be
+# changed, ids are the more reliable way to opt out.
+
+import re
+
+HANDLE_PATTERN = re.compile(r"^@?([A-Za-z0-9_]{1,15})$")
+ID_PATTERN = re.compile(r"^(?:id:)?([0-9]{1,20})$")
+
+
+class OptedOutError(Exception):
+	'''
+	A thread includes tweets by an author who has opted out. user is the
+	author.
+	'''
+	def __init__(self, user):
+		super().__init__(user.handle)
+		self.user = user
+
+
+def normalize_entry(text):
+	'''
+	Get the canonical form of an opt-out entry: "id:<id>" for user ids, and
+	"@<handle>" (lowercased) for handles. Raises ValueError if text isn't
+	either.
+	'''
+	text = text.strip()
+
+	match = ID_PATTERN.match(text)
+	if match is not None:
+		return f"id:{match.group(1)}"
+
+	match = HANDLE_PATTERN.match(text)
+	if match is not None:
+		return f"@{match.group(1).lower()}"
+
+	raise ValueError(f"Not a handle or user id: {text!r}")
+
+
+def read_opt_out_file(path):
+	with open(path) as f:
+		return {
+			normalize_entry(line)
+			for line in f
+			if line.strip() and not line.lstrip().startswith("#")
+		}
+
+
+class OptOutList:
+	'''
+	The set of opted out authors. Entries come from an optional file, which
+	is read once by load(), and from the thread store, if there is one, where
+	entries added at runtime are persisted. Without a store, entries added at
+	runtime only last until the server restarts. Entries from the file can't
+	be removed at runtime.
+	'''
+	def __init__(self, *, path=None, store=None):
+		self.path = path
+		self.store = store
+		self.file_entries = frozenset()
+		self.added_entries = set()
+
+	async def load(self):
+		if self.path is not None:
+			self.file_entries = frozenset(read_opt_out_file(self.path))
+
+		if self.store is not None:
+			self.added_entries = set(await self.store.get_opt_outs())
+
+	def entries(self):
+		return sorted(self.file_entries | self.added_entries)
+
+	def __contains__(self, entry):
+		return entry in self.file_entries or entry in self.added_entries
+
+	def user_ids(self):
+		return [entry[3:] for entry in self.entries() if entry.startswith("id:")]
+
+	def handles(self):
+		return [entry[1:] for entry in self.entries() if entry.startswith("@")]
+
+	def is_opted_out(self, user):
+		return f"id:{user.id}" in self or f"@{user.handle.lower()}" in self
+
+	def check_user(self, user):
+		if self.is_opted_out(user):
+			raise OptedOutError(user)
+
+	def check_thread(self, tweets):
+		'''
+		Raise OptedOutError if any of the tweets are by an opted out author
+		'''
+		for user in {tweet.user for tweet in tweets}:
+			self.check_user(user)
+
+	async def add(self, text):
+		'''
+		Opt out an author, given as a handle or id. Returns the normalized
+		entry.
+		'''
+		entry = normalize_entry(text)
+
+		if self.store is not None:
+			await self.store.add_opt_out(entry)
+
+		self.added_entries.add(entry)
+		return entry
+
+	async def remove(self, text):
+		'''
+		Remove an author added with add. Returns False if they weren't opted
+		out, or were opted out by the file.
+		'''
+		entry = normalize_entry(text)
+		if entry not in self.added_entries:
+			return False
+
+		if self.store is not None:
+			await self.store.remove_opt_out(entry)
+
+		self.added_entries.discard(entry)
+		return True
@@ -0,0 +1,237 @@
+# Threads as paginated PDFs, for archiving them offline, at
+# /thread/<id>.pdf and with unroll --format pdf. The first page starts with
+# the author's avatar, name and handle; each tweet follows with its text,
+# its images, and a timestamp linking back to it. Every page has the
+# thread's link and the page number at the bottom.
+#
+# Laying out the pages needs reportlab (which brings Pillow along), which is
+# optional:
+#
+#     pip install bobbin[pdf]
+#
+# Text is set in font, a TrueType font file, so that more than Latin text
+# can be shown; bare file names are looked for in reportlab's font search
+# path. If it can't be found, the built-in Helvetica is used.
+
+from io import BytesIO
+from xml.sax.saxutils import escape
+import asyncio
+import functools
+import logging
+import pathlib
+
+import aiohttp
+import cachetools
+
+from bobbin.link_cards import read_limited
+from bobbin.render import expand_text, thread_title, tweet_url, user_url
+from bobbin.share_images import large_avatar_url
+
+try:
+	from PIL import Image as PILImage
+	from reportlab.lib.pagesizes import A4
+	from reportlab.lib.styles import ParagraphStyle
+	from reportlab.lib.units import mm
+	from reportlab.pdfbase import pdfmetrics
+	from reportlab.pdfbase.ttfonts import TTFError, TTFont
+	from reportlab.platypus import HRFlowable, Image, KeepTogether, Paragraph, SimpleDocTemplate, Spacer, Table
+except ImportError:
+	SimpleDocTemplate = None
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_FONT = "DejaVuSans.ttf"
+FALLBACK_FONT = "Helvetica"
+
+MARGIN = 20
+AVATAR_SIZE = 16
+
+# Images are scaled down to fit the page width, and to no more than this
+# share of its height, so that a tweet's images don't each take a page
+MAX_IMAGE_HEIGHT = 0.4
+
+TEXT = "#14171a"
+SECONDARY_TEXT = "#657786"
+RULE = "#e1e8ed"
+
+
+def available():
+	return SimpleDocTemplate is not None
+
+
+@functools.lru_cache()
+def load_font(font):
+	'''
+	Register font with reportlab, and get the name to use it by
+	'''
+	name = pathlib.Path(font).stem
+	try:
+		pdfmetrics.registerFont(TTFont(name, font))
+	except TTFError:
+		logger.info("Couldn't load font %s for PDFs; falling back to %s", font, FALLBACK_FONT)
+		return FALLBACK_FONT
+
+	return name
+
+
+def image_flowable(data, *, max_width, max_height):
+	'''
+	Get image data as a flowable, scaled down to fit max_width and
+	max_height, or None if it isn't an image Pillow can read
+	'''
+	try:
+		with PILImage.open(BytesIO(data)) as image:
+			width, height = image.size
+	except (OSError, ValueError):
+		return None
+
+	scale = min(1, max_width / width, max_height / height)
+	return Image(BytesIO(data), width=width * scale, height=height * scale, hAlign="LEFT")
+
+
+def paragraph_markup(text):
+	return escape(text).replace("\n", "<br/>")
+
+
+def link_markup(url, text=None):
+	return '<a href="{}">{}</a>'.format(escape(url, {'"': "&quot;"}), escape(text if text is not None else url))
+
+
+def render_thread_pdf(thread, *, page_url, images, avatar=None, font=DEFAULT_FONT):
+	'''
+	Lay out a thread as a PDF, and return its data. images is a dict of media
+	url to image data, for the images that could be fetched; the rest are
+	left out, as is the author's avatar, if it's None. This is slow enough
+	that it shouldn't be run on the event loop.
+	'''
+	font_name = load_font(font)
+	title = thread_title(thread)
+	author = thread.author if thread.author is not None else thread[0].user
+
+	body = ParagraphStyle("body", fontName=font_name, fontSize=11, leading=15, textColor=TEXT, spaceAfter=4 * mm)
+	name = ParagraphStyle("name", parent=body, fontSize=16, leading=20, spaceAfter=0)
+	secondary = ParagraphStyle("secondary", parent=body, fontSize=9, leading=12, textColor=SECONDARY_TEXT)
+
+	output = BytesIO()
+	document = SimpleDocTemplate(
+		output,
+		pagesize=A4,
+		leftMargin=MARGIN * mm,
+		rightMargin=MARGIN * mm,
+		topMargin=MARGIN * mm,
+		bottomMargin=MARGIN * mm,
+		title=title,
+		author=f"{author.name} (@{author.handle})",
+	)
+	max_width = document.width
+	max_height = document.height * MAX_IMAGE_HEIGHT
+
+	header = [
+		Paragraph(paragraph_markup(author.name), name),
+		Paragraph(link_markup(user_url(author), f"@{author.handle}"), secondary),
+	]
+	avatar_image = image_flowable(avatar, max_width=AVATAR_SIZE * mm, max_height=AVATAR_SIZE * mm) if avatar is not None else None
+	story = [
+		Table([[avatar_image, header]], colWidths=[(AVATAR_SIZE + 4) * mm, None], hAlign="LEFT", style=[("VALIGN", (0, 0), (-1, -1), "MIDDLE")])
+		if avatar_image is not None else KeepTogether(header),
+		Spacer(0, 6 * mm),
+	]
+
+	for index, tweet in enumerate(thread):
+		if index > 0:
+			story.append(HRFlowable(width="100%", color=RULE, spaceBefore=2 * mm, spaceAfter=6 * mm))
+
+		text = expand_text(tweet)
+		if text:
+			story.append(Paragraph(paragraph_markup(text), body))
+
+		for media in tweet.entities.media:
+			data = images.get(media.media_url)
+			flowable = image_flowable(data, max_width=max_width, max_height=max_height) if data is not None else None
+			if flowable is not None:
+				story.extend((flowable, Spacer(0, 4 * mm)))
+
+		story.append(Paragraph(
+			link_markup(tweet_url(tweet), tweet.created_at.strftime("%Y-%m-%d %H:%M UTC")),
+			secondary,
+		))
+
+	def draw_footer(canvas, document):
+		canvas.saveState()
+		canvas.setFont(font_name, 8)
+		canvas.setFillColor(SECONDARY_TEXT)
+		canvas.drawString(document.leftMargin, MARGIN * mm / 2, page_url)
+		canvas.drawRightString(document.leftMargin + document.width, MARGIN * mm / 2, str(document.page))
+		canvas.restoreState()
+
+	document.build(story, onFirstPage=draw_footer, onLaterPages=draw_footer)
+	return output.getvalue()
+
+
+class ThreadPdfRenderer:
+	'''
+	Makes PDFs of threads, fetching their images and the author's avatar with
+	session. Images bigger than max_image_bytes, or that take longer than
+	timeout seconds, are left out, as are any past the first max_images. The
+	last cache_size PDFs are kept.
+	'''
+	def __init__(self, session, *, font=DEFAULT_FONT, timeout=10, max_image_bytes=5 * 1024 * 1024, max_images=50, cache_size=16):
+		self.session = session
+		self.font = font
+		self.timeout = timeout
+		self.max_image_bytes = max_image_bytes
+		self.max_images = max_images
+		self.cache = cachetools.LRUCache(cache_size)
+
+	async def fetch_image(self, url):
+		try:
+			async with self.session.get(
+				url,
+				timeout=aiohttp.ClientTimeout(total=self.timeout),
+			) as response:
+				if response.status != 200:
+					return None
+
+				return await read_limited(response, self.max_image_bytes)
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, ValueError):
+			logger.info("Couldn't fetch image %s", url)
+			return None
+
+	async def render(self, thread, *, page_url):
+		'''
+		Get the PDF of a thread, as bytes
+		'''
+		key = (thread.tail_id, thread.fetched_at, page_url)
+		try:
+			return self.cache[key]
+		except KeyError:
+			pass
+
+		author = thread.author if thread.author is not None else thread[0].user
+
+		# Videos and gifs are shown as their preview images
+		urls = list(dict.fromkeys(
+			media.media_url
+			for tweet in thread
+			for media in tweet.entities.media
+			if media.media_url
+		))[:self.max_images]
+
+		avatar, *fetched = await asyncio.gather(
+			self.fetch_image(large_avatar_url(author.avatar_url)) if author.avatar_url else asyncio.sleep(0),
+			*map(self.fetch_image, urls),
+		)
+
+		pdf = await asyncio.get_event_loop().run_in_executor(None, functools.partial(
+			render_thread_pdf,
+			thread,
+			page_url=page_url,
+			images={url: data for url, data in zip(urls, fetched) if data is not None},
+			avatar=avatar,
+			font=self.font,
+		))
+
+		self.cache[key] = pdf
+		return pdf
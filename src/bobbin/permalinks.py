@@ -0,0 +1,74 @@
+# Human readable permalinks for threads, like
+#
+#     /t/<handle>/<slug>-<tail id>
+#
+# where the slug is made from the first few words of the first tweet. Only
+# the tail id matters when reading a permalink; the handle and slug are for
+# people, and if they're out of date (say, the author changed their handle),
+# the thread page redirects to the current permalink. Conversations, which
+# have no single author, keep their /thread/<tail id> urls.
+
+from urllib.parse import quote as url_quote
+import html
+import re
+import unicodedata
+
+MAX_SLUG_LENGTH = 60
+
+URL_PATTERN = re.compile(r"https?://\S+")
+SLUG_SEPARATOR_PATTERN = re.compile(r"[^a-z0-9]+")
+
+PERMALINK_PATTERN = re.compile(r"(?:^|/)t/[A-Za-z0-9_]{1,15}/(?:[a-z0-9-]*-)?([0-9]{1,20})/?$")
+
+
+def slugify(text, *, max_length=MAX_SLUG_LENGTH):
+	'''
+	Make a url slug from some text: lowercase ascii words joined by hyphens,
+	cut at a word boundary to at most max_length characters. Accents are
+	dropped; text in other scripts is dropped entirely, so the slug may be
+	empty.
+	'''
+	text = unicodedata.normalize("NFKD", text).encode("ascii", "ignore").decode("ascii")
+	slug = SLUG_SEPARATOR_PATTERN.sub("-", text.lower()).strip("-")
+
+	if len(slug) > max_length:
+		# Include the next character, so that a word ending right at
+		# max_length isn't cut
+		cut = slug[:max_length + 1]
+		slug = cut.rsplit("-", 1)[0] if "-" in cut else slug[:max_length]
+
+	return slug
+
+
+def tweet_slug(tweet):
+	'''
+	Make a slug from a tweet's text, without its links
+	'''
+	return slugify(URL_PATTERN.sub(" ", html.unescape(tweet.text)))
+
+
+def permalink(*, author, first_tweet, tail_id):
+	'''
+	Get the path of the permalink for a thread by author (a TwitterUser, or
+	None for conversations), starting at first_tweet and ending at tail_id
+	'''
+	if author is None:
+		return f"/thread/{tail_id}"
+
+	slug = tweet_slug(first_tweet)
+	return "/t/{}/{}".format(
+		url_quote(author.handle),
+		f"{slug}-{tail_id}" if slug else tail_id,
+	)
+
+
+def thread_permalink(thread):
+	return permalink(author=thread.author, first_tweet=thread[0], tail_id=thread.tail_id)
+
+
+def parse_permalink(path):
+	'''
+	Get the tail id from a permalink path, or None if it isn't one
+	'''
+	match = PERMALINK_PATTERN.search(path)
+	return match.group(1) if match is not None else None
@@ -0,0 +1,258 @@
+# Posting tweets, as a user rather than as the app. Everything else bobbin
+# asks twitter for is public, and uses app-auth bearer tokens (see twitter),
+# but tweets have to come from an account, so these requests are signed with
+# OAuth 1.0a (see accounts.oauth_header) using the app's key and secret and
+# the account's access token and secret, together a UserAuth.
+#
+# Media is uploaded with the chunked upload endpoint, which works for images,
+# gifs, and videos alike: INIT with the size and type, APPEND each chunk,
+# FINALIZE, and then, for media twitter has to process (gifs and videos),
+# check its STATUS until it's ready. The resulting media id can be attached
+# to a tweet within a day or so.
+
+from collections import namedtuple
+import asyncio
+import logging
+
+import aiohttp
+
+from bobbin.accounts import oauth_header
+from bobbin.twitter import (
+	API_URL,
+	RateLimitError,
+	Tweet,
+	TwitterAPIError,
+	TwitterError,
+	get_errors,
+	get_retry_after,
+)
+
+logger = logging.getLogger(__name__)
+
+UPDATE_URL = f"{API_URL}/statuses/update.json"
+DIRECT_MESSAGE_URL = f"{API_URL}/direct_messages/events/new.json"
+UPLOAD_URL = "https://upload.twitter.com/1.1/media/upload.json"
+METADATA_URL = "https://upload.twitter.com/1.1/media/metadata/create.json"
+
+# Twitter accepts chunks of up to 5MB
+CHUNK_SIZE = 4 * 1024 * 1024
+
+MAX_MEDIA = 4
+MAX_ALT_TEXT_LENGTH = 1000
+
+# How long to wait for twitter to process uploaded media, in total
+PROCESSING_TIMEOUT = 5 * 60
+
+
+class MediaProcessingError(TwitterError):
+	'''
+	Twitter couldn't process uploaded media. media_id is the upload's id.
+	'''
+	def __init__(self, media_id, message):
+		super().__init__(media_id, message)
+		self.media_id = media_id
+
+
+class UserAuth(namedtuple("UserAuth", "consumer_key consumer_secret token token_secret")):
+	'''
+	User context credentials: the app's consumer key and secret, and the
+	access token and secret of the account to act as
+	'''
+	__slots__ = ()
+
+	@property
+	def user_id(self):
+		# Access tokens start with the id of the account they belong to
+		return self.token.split("-", 1)[0]
+
+	def header(self, method, url, params=None):
+		return oauth_header(
+			method,
+			url,
+			consumer_key=self.consumer_key,
+			consumer_secret=self.consumer_secret,
+			token=self.token,
+			token_secret=self.token_secret,
+			params=params,
+		)
+
+
+def media_category(content_type):
+	if content_type == "image/gif":
+		return "tweet_gif"
+	elif content_type.startswith("video/"):
+		return "tweet_video"
+	else:
+		return "tweet_image"
+
+
+async def request_json(*, session, auth, method, url, params=None, data=None, json=None):
+	'''
+	Make a request as auth's account, returning the parsed json body, or
+	None if there isn't one. params are form parameters for a POST and query
+	parameters otherwise; they're signed. data (a FormData, for uploads) and
+	json bodies aren't, as OAuth only signs form encoded bodies, so anything
+	else a request needs goes in params.
+	'''
+	if method == "POST" and data is None and json is None:
+		kwargs = {"data": params}
+	else:
+		kwargs = {"params": params, "data": data, "json": json}
+
+	async with session.request(
+		method,
+		url,
+		headers={
+			"Authorization": auth.header(method, url, params),
+			"Accept": "application/json",
+		},
+		**kwargs,
+	) as response:
+		if response.status == 429:
+			raise RateLimitError(url, get_retry_after(response.headers))
+
+		if response.status >= 400:
+			errors = await get_errors(response)
+			if errors:
+				raise TwitterAPIError(response.status, errors)
+
+		response.raise_for_status()
+
+		if response.status == 204:
+			return None
+		return await response.json(content_type=None)
+
+
+async def wait_for_processing(*, session, auth, media_id, processing_info):
+	loop = asyncio.get_event_loop()
+	deadline = loop.time() + PROCESSING_TIMEOUT
+
+	while processing_info is not None:
+		state = processing_info.get("state")
+		if state == "succeeded":
+			return
+		elif state == "failed":
+			error = processing_info.get("error", {})
+			raise MediaProcessingError(media_id, error.get("message") or error.get("name"))
+
+		delay = processing_info.get("check_after_secs", 1)
+		if loop.time() + delay > deadline:
+			raise MediaProcessingError(media_id, "Timed out waiting for processing")
+		await asyncio.sleep(delay)
+
+		result = await request_json(
+			session=session,
+			auth=auth,
+			method="GET",
+			url=UPLOAD_URL,
+			params={"command": "STATUS", "media_id": media_id},
+		)
+		processing_info = result.get("processing_info")
+
+
+async def upload_media(*, session, auth, data, content_type, alt_text=None):
+	'''
+	Upload data (bytes) as media of content_type, as auth's account, and
+	return its media id, for post_tweet. Returns once twitter has finished
+	processing it; raises MediaProcessingError if it couldn't.
+	'''
+	result = await request_json(
+		session=session,
+		auth=auth,
+		method="POST",
+		url=UPLOAD_URL,
+		params={
+			"command": "INIT",
+			"total_bytes": str(len(data)),
+			"media_type": content_type,
+			"media_category": media_category(content_type),
+		},
+	)
+	media_id = result["media_id_string"]
+
+	for index, offset in enumerate(range(0, len(data), CHUNK_SIZE)):
+		form = aiohttp.FormData()
+		form.add_field("media", data[offset:offset + CHUNK_SIZE], content_type="application/octet-stream")
+		await request_json(
+			session=session,
+			auth=auth,
+			method="POST",
+			url=UPLOAD_URL,
+			params={"command": "APPEND", "media_id": media_id, "segment_index": str(index)},
+			data=form,
+		)
+
+	result = await request_json(
+		session=session,
+		auth=auth,
+		method="POST",
+		url=UPLOAD_URL,
+		params={"command": "FINALIZE", "media_id": media_id},
+	)
+	await wait_for_processing(
+		session=session,
+		auth=auth,
+		media_id=media_id,
+		processing_info=result.get("processing_info"),
+	)
+
+	if alt_text:
+		await request_json(
+			session=session,
+			auth=auth,
+			method="POST",
+			url=METADATA_URL,
+			json={"media_id": media_id, "alt_text": {"text": alt_text[:MAX_ALT_TEXT_LENGTH]}},
+		)
+
+	logger.info("Uploaded %s media %s (%d bytes)", content_type, media_id, len(data))
+	return media_id
+
+
+async def post_tweet(*, session, auth, text, media_ids=(), reply_to=None):
+	'''
+	Tweet text as auth's account, with up to MAX_MEDIA media_ids from
+	upload_media. If reply_to is given, the tweet is a reply to that tweet id,
+	mentioning whoever's in the conversation. Returns the new Tweet.
+	'''
+	if len(media_ids) > MAX_MEDIA:
+		raise ValueError(f"A tweet can have at most {MAX_MEDIA} media")
+
+	params = {"status": text, "tweet_mode": "extended"}
+	if media_ids:
+		params["media_ids"] = ",".join(media_ids)
+	if reply_to is not None:
+		params["in_reply_to_status_id"] = str(reply_to)
+		params["auto_populate_reply_metadata"] = "true"
+
+	result = await request_json(session=session, auth=auth, method="POST", url=UPDATE_URL, params=params)
+	return Tweet.from_tweet_json(result)
+
+
+async def reply_to(*, session, auth, tweet_id, text, media_ids=()):
+	'''
+	Reply to tweet_id with text as auth's account; see post_tweet
+	'''
+	return await post_tweet(session=session, auth=auth, text=text, media_ids=media_ids, reply_to=tweet_id)
+
+
+async def send_direct_message(*, session, auth, recipient_id, text):
+	'''
+	Send a direct message with text to the user recipient_id, as auth's
+	account, which needs twitter's direct message permission. Returns the id
+	of the new message.
+	'''
+	result = await request_json(
+		session=session,
+		auth=auth,
+		method="POST",
+		url=DIRECT_MESSAGE_URL,
+		json={"event": {
+			"type": "message_create",
+			"message_create": {
+				"target": {"recipient_id": str(recipient_id)},
+				"message_data": {"text": text},
+			},
+		}},
+	)
+	return result["event"]["id"]
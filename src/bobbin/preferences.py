@@ -0,0 +1,57 @@
+# Display preferences, kept in a cookie so that they don't need accounts or
+# storage. The frontend's settings page writes the cookie; the server reads it
+# when rendering HTML, so that pages come out right the first time, rather
+# than flashing the wrong theme until the javascript loads.
+#
+# The cookie is a query string, like "theme=dark&font_size=large&media=0".
+# Anything missing or invalid in it gets the default.
+
+from collections import namedtuple
+from urllib.parse import parse_qsl
+
+PREFERENCES_COOKIE = "bobbin_prefs"
+
+THEMES = ("system", "light", "dark")
+FONT_SIZES = ("small", "medium", "large")
+
+
+def parse_flag(value, default):
+	return {"1": True, "0": False}.get(value, default)
+
+
+class Preferences(namedtuple("Preferences", "theme font_size show_media show_timestamps")):
+	__slots__ = ()
+
+	def __new__(cls, theme="system", font_size="medium", show_media=True, show_timestamps=True):
+		return super().__new__(cls, theme, font_size, show_media, show_timestamps)
+
+	@classmethod
+	def from_cookie(cls, value):
+		fields = dict(parse_qsl(value or ""))
+		theme = fields.get("theme")
+		font_size = fields.get("font_size")
+
+		return cls(
+			theme=theme if theme in THEMES else "system",
+			font_size=font_size if font_size in FONT_SIZES else "medium",
+			show_media=parse_flag(fields.get("media"), True),
+			show_timestamps=parse_flag(fields.get("timestamps"), True),
+		)
+
+	def html_classes(self):
+		'''
+		Classes for the <html> element, which the stylesheets key off of
+		'''
+		classes = [f"theme-{self.theme}", f"font-{self.font_size}"]
+		if not self.show_media:
+			classes.append("hide-media")
+		if not self.show_timestamps:
+			classes.append("hide-timestamps")
+		return " ".join(classes)
+
+
+DEFAULT_PREFERENCES = Preferences()
+
+
+def request_preferences(request):
+	return Preferences.from_cookie(request.cookies.get(PREFERENCES_COOKIE))
@@ -0,0 +1,103 @@
+# Support for running behind reverse proxies. Proxies hide the client's
+# address, and the scheme and host that the client asked for, and pass them
+# along in X-Forwarded-For, X-Forwarded-Proto, and X-Forwarded-Host instead.
+# Those headers are only believed if the operator says how many proxies there
+# are (trusted_proxies); otherwise, clients could send them themselves.
+#
+# The site can also be mounted under a base path, like /bobbin, for proxies
+# that serve several apps on one host. Requests outside of it are 404s; for
+# the rest, the base path is removed before routing, and web_util.site_url
+# puts it back into generated urls. A few root_paths, like health checks,
+# which are requested directly rather than through the proxy, are also
+# served outside of the base path.
+#
+# Routing (see web_util.route) strips each matched prefix from the request's
+# path, so handlers can't see the whole path in request.path. It's kept as
+# request["site_path"] instead: the path within the site, without the base
+# path.
+
+import functools
+
+from aiohttp import web
+import yarl
+
+
+def forwarded_values(headers, name):
+	'''
+	Get all the comma separated values of a header, from every copy of it,
+	in order
+	'''
+	return [
+		value.strip()
+		for header in headers.getall(name, ())
+		for value in header.split(",")
+		if value.strip()
+	]
+
+
+def trusted_value(values, trusted_proxies):
+	'''
+	Each proxy appends to the forwarded headers, so only the last
+	trusted_proxies values were added by our proxies; anything earlier came
+	from the client. Of those, the earliest is the one describing the client.
+	'''
+	if not values:
+		return None
+	elif len(values) >= trusted_proxies:
+		return values[-trusted_proxies]
+	else:
+		return values[0]
+
+
+def normalize_base_path(base_path):
+	'''
+	Base paths are stored with a leading slash and without a trailing one,
+	or as "" for the root
+	'''
+	base_path = base_path.strip("/")
+	return f"/{base_path}" if base_path else ""
+
+
+def with_proxy(handler, *, trusted_proxies=0, base_path="", root_paths=()):
+	'''
+	Wrap the top level handler so that the requests it gets have the
+	client's scheme, host, and address, and have the base path removed
+	'''
+	base_path = normalize_base_path(base_path)
+	root_paths = frozenset(root_paths)
+
+	@functools.wraps(handler)
+	async def proxy_handler(request, **kwargs):
+		changes = {}
+
+		if trusted_proxies > 0:
+			remote = trusted_value(forwarded_values(request.headers, "X-Forwarded-For"), trusted_proxies)
+			scheme = trusted_value(forwarded_values(request.headers, "X-Forwarded-Proto"), trusted_proxies)
+			host = trusted_value(forwarded_values(request.headers, "X-Forwarded-Host"), trusted_proxies)
+
+			if remote is not None:
+				changes["remote"] = remote
+			if scheme in ("http", "https"):
+				changes["scheme"] = scheme
+			if host is not None:
+				changes["host"] = host
+
+		raw_path = request.rel_url.raw_path
+		if base_path and raw_path not in root_paths:
+			if raw_path != base_path and not raw_path.startswith(base_path + "/"):
+				raise web.HTTPNotFound()
+
+			changes["rel_url"] = yarl.URL.build(
+				path=raw_path[len(base_path):] or "/",
+				query_string=request.rel_url.raw_query_string,
+				encoded=True,
+			)
+
+		if changes:
+			request = request.clone(**changes)
+
+		request["base_path"] = base_path
+		request["site_path"] = request.rel_url.path
+		return await handler(request, **kwargs)
+
+	return proxy_handler
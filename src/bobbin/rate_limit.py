@@ -0,0 +1,87 @@
+# Tracking for twitter's rate limits. Every response from the API includes
+# headers describing the remaining request budget for that endpoint, and when
+# it will be reset. RateLimiter records these and delays requests that would
+# otherwise be rejected with a 429.
+
+import asyncio
+import time
+
+
+class Budget:
+	__slots__ = ('remaining', 'reset')
+
+	def __init__(self, remaining, reset):
+		self.remaining = remaining
+		self.reset = reset
+
+	def __repr__(self):
+		return f"Budget(remaining={self.remaining}, reset={self.reset})"
+
+
+class RateLimiter:
+	def __init__(self, *, clock=time.time):
+		self.clock = clock
+		self.budgets = {}
+
+	async def acquire(self, endpoint):
+		'''
+		Wait until there is budget available for a request to endpoint, then
+		claim it. Endpoints we haven't seen a response from yet are assumed to
+		have budget available. If the wait is cancelled, nothing is claimed.
+		'''
+		while True:
+			budget = self.budgets.get(endpoint)
+			if budget is None:
+				return
+
+			now = self.clock()
+			if budget.reset <= now:
+				# The window has reset; we won't know the new budget until the
+				# next response arrives.
+				del self.budgets[endpoint]
+				return
+
+			if budget.remaining > 0:
+				budget.remaining -= 1
+				return
+
+			await asyncio.sleep(budget.reset - now)
+
+	def has_budget(self, endpoint):
+		'''
+		Check if a request to endpoint could be made right now, without
+		claiming any budget
+		'''
+		budget = self.budgets.get(endpoint)
+		return budget is None or budget.reset <= self.clock() or budget.remaining > 0
+
+	def reset_time(self, endpoint):
+		'''
+		Get the time at which the budget for endpoint resets, or 0 if it's
+		unknown
+		'''
+		budget = self.budgets.get(endpoint)
+		return budget.reset if budget is not None else 0
+
+	def update(self, endpoint, headers):
+		'''
+		Update the budget for endpoint from the headers of a response. Responses
+		without rate limit headers are ignored.
+		'''
+		try:
+			remaining = int(headers["x-rate-limit-remaining"])
+			reset = int(headers["x-rate-limit-reset"])
+		except (KeyError, ValueError):
+			return
+
+		self.budgets[endpoint] = Budget(remaining, reset)
+
+	def snapshot(self):
+		'''
+		Get a dict of endpoint to (remaining, reset) for all the endpoints we
+		currently know about.
+		'''
+		return {
+			endpoint: (budget.remaining, budget.reset)
+			for endpoint, budget in self.budgets.items()
+		}
@@ -0,0 +1,291 @@
+# Saving threads to read later services, for signed in accounts (see
+# accounts). An account connects each service once, and its credentials are
+# kept in the UserStore; after that, saving a thread is one click.
+#
+# Each service connects differently:
+#
+# - Pocket uses its own OAuth flavor: a request token, a redirect to Pocket to
+#   approve it, and then an access token. Pocket only takes links, so saved
+#   threads are just their permalinks. (pocket_consumer_key)
+# - Instapaper uses xAuth: the user's username and password are exchanged for
+#   an OAuth 1.0a token once, and only the token is kept. Instapaper takes the
+#   page's content along with its url, so the whole thread is saved, even if
+#   Instapaper can't fetch the page itself. (instapaper_key and
+#   instapaper_secret)
+# - Readwise has no app credentials; users paste an access token from
+#   readwise.io/access_token. Readwise Reader also takes the page's content.
+#   (readwise)
+
+from datetime import datetime, timezone
+from urllib.parse import parse_qsl, urlencode
+import asyncio
+import secrets
+import time
+
+import aiohttp
+import cachetools
+
+from bobbin import permalinks, render
+from bobbin.accounts import oauth_header
+
+# How long a Pocket authorization can take, in seconds
+CONNECT_TTL = 10 * 60
+
+# How each service is connected: by sending the user to the service, with
+# their username and password, or with an access token they paste in
+REDIRECT = "redirect"
+PASSWORD = "password"
+TOKEN = "token"
+
+
+class ServiceError(Exception):
+	'''
+	A read later service failed, or refused a request. The message is shown
+	to the user.
+	'''
+
+
+class RejectedTokenError(ServiceError):
+	'''
+	The service no longer accepts an account's credentials (the user revoked
+	them, say), so it needs to be connected again
+	'''
+
+
+def check_status(response, *, service):
+	if response.status in (401, 403):
+		raise RejectedTokenError(f"{service} rejected this account's credentials")
+	if response.status == 429:
+		raise ServiceError(f"{service} is rate limiting us; try again later")
+	if response.status >= 400:
+		raise ServiceError(f"{service} refused the request ({response.status})")
+
+
+class Pocket:
+	name = "pocket"
+	title = "Pocket"
+	connect_with = REDIRECT
+
+	REQUEST_URL = "https://getpocket.com/v3/oauth/request"
+	AUTHORIZE_URL = "https://getpocket.com/auth/authorize"
+	ACCESS_URL = "https://getpocket.com/v3/oauth/authorize"
+	ADD_URL = "https://getpocket.com/v3/add"
+
+	def __init__(self, session, *, consumer_key, timeout=10):
+		self.session = session
+		self.consumer_key = consumer_key
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+
+		# state -> (account id, request token)
+		self.pending = cachetools.TTLCache(10000, CONNECT_TTL, timer=time.monotonic)
+
+	async def post(self, url, body):
+		try:
+			async with self.session.post(
+				url,
+				json=dict(body, consumer_key=self.consumer_key),
+				headers={"X-Accept": "application/json"},
+				timeout=self.timeout,
+			) as response:
+				check_status(response, service=self.title)
+				return await response.json(content_type=None)
+		except (aiohttp.ClientError, asyncio.TimeoutError, ValueError) as e:
+			raise ServiceError(f"Couldn't reach {self.title}") from e
+
+	async def start(self, *, account_id, callback_url):
+		'''
+		Begin connecting account_id. Returns the url to send the user to;
+		Pocket sends them back to callback_url, with a state parameter added,
+		once they've approved it.
+		'''
+		state = secrets.token_urlsafe(16)
+		redirect_uri = f"{callback_url}?{urlencode({'state': state})}"
+		result = await self.post(self.REQUEST_URL, {"redirect_uri": redirect_uri})
+		if "code" not in result:
+			raise ServiceError("Pocket didn't give us a request token")
+
+		self.pending[state] = (account_id, result["code"])
+		return f"{self.AUTHORIZE_URL}?{urlencode({'request_token': result['code'], 'redirect_uri': redirect_uri})}"
+
+	async def finish(self, *, account_id, state):
+		'''
+		Finish connecting account_id, once Pocket has sent them back with
+		state. Returns the (token, secret) to store.
+		'''
+		pending_account_id, code = self.pending.pop(state, (None, None))
+		if pending_account_id != account_id:
+			raise ServiceError("Unknown or expired Pocket authorization")
+
+		try:
+			result = await self.post(self.ACCESS_URL, {"code": code})
+		except RejectedTokenError:
+			# Pocket answers this way if the user declined
+			raise ServiceError("Pocket wasn't connected") from None
+
+		if "access_token" not in result:
+			raise ServiceError("Pocket didn't give us an access token")
+		return result["access_token"], None
+
+	async def save(self, credentials, *, url, title, html, author):
+		await self.post(self.ADD_URL, {"access_token": credentials.token, "url": url, "title": title})
+
+
+class Instapaper:
+	name = "instapaper"
+	title = "Instapaper"
+	connect_with = PASSWORD
+
+	ACCESS_URL = "https://www.instapaper.com/api/1/oauth/access_token"
+	ADD_URL = "https://www.instapaper.com/api/1/bookmarks/add"
+
+	def __init__(self, session, *, consumer_key, consumer_secret, timeout=10):
+		self.session = session
+		self.consumer_key = consumer_key
+		self.consumer_secret = consumer_secret
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+
+	async def post(self, url, params, *, token=None, token_secret=""):
+		headers = {"Authorization": oauth_header(
+			"POST",
+			url,
+			consumer_key=self.consumer_key,
+			consumer_secret=self.consumer_secret,
+			token=token,
+			token_secret=token_secret,
+			params=params,
+		)}
+
+		try:
+			async with self.session.post(url, data=params, headers=headers, timeout=self.timeout) as response:
+				check_status(response, service=self.title)
+				return await response.text()
+		except (aiohttp.ClientError, asyncio.TimeoutError) as e:
+			raise ServiceError(f"Couldn't reach {self.title}") from e
+
+	async def connect(self, *, username, password):
+		'''
+		Exchange a user's username and password for the (token, secret) to
+		store
+		'''
+		try:
+			body = await self.post(self.ACCESS_URL, {
+				"x_auth_username": username,
+				"x_auth_password": password,
+				"x_auth_mode": "client_auth",
+			})
+		except RejectedTokenError:
+			raise ServiceError("Instapaper didn't accept that username and password") from None
+
+		result = dict(parse_qsl(body))
+		if "oauth_token" not in result or "oauth_token_secret" not in result:
+			raise ServiceError("Instapaper didn't give us an access token")
+		return result["oauth_token"], result["oauth_token_secret"]
+
+	async def save(self, credentials, *, url, title, html, author):
+		await self.post(
+			self.ADD_URL,
+			{"url": url, "title": title, "content": html},
+			token=credentials.token,
+			token_secret=credentials.secret,
+		)
+
+
+class Readwise:
+	name = "readwise"
+	title = "Readwise"
+	connect_with = TOKEN
+
+	AUTH_URL = "https://readwise.io/api/v2/auth/"
+	SAVE_URL = "https://readwise.io/api/v3/save/"
+
+	def __init__(self, session, *, timeout=10):
+		self.session = session
+		self.timeout = aiohttp.ClientTimeout(total=timeout)
+
+	async def request(self, method, url, *, token, json=None):
+		try:
+			async with self.session.request(
+				method,
+				url,
+				json=json,
+				headers={"Authorization": f"Token {token}"},
+				timeout=self.timeout,
+			) as response:
+				check_status(response, service=self.title)
+		except (aiohttp.ClientError, asyncio.TimeoutError) as e:
+			raise ServiceError(f"Couldn't reach {self.title}") from e
+
+	async def connect(self, *, token):
+		'''
+		Check that a pasted access token works, returning the (token, secret)
+		to store
+		'''
+		token = token.strip()
+		try:
+			await self.request("GET", self.AUTH_URL, token=token)
+		except RejectedTokenError:
+			raise ServiceError("Readwise didn't accept that access token") from None
+		return token, None
+
+	async def save(self, credentials, *, url, title, html, author):
+		body = {"url": url, "title": title, "html": html, "saved_using": "bobbin"}
+		if author is not None:
+			body["author"] = author
+		await self.request("POST", self.SAVE_URL, token=credentials.token, json=body)
+
+
+class ReadLater:
+	'''
+	The read later services enabled on this server, with accounts'
+	credentials kept in store (a user_store.UserStore)
+	'''
+	def __init__(self, store, services):
+		self.store = store
+		self.services = {service.name: service for service in services}
+
+	async def connections(self, account):
+		'''
+		Get a list of (service, connected) for account
+		'''
+		tokens = await self.store.get_service_tokens(account_id=account.id)
+		return [(service, service.name in tokens) for service in self.services.values()]
+
+	async def save_credentials(self, account, service, credentials):
+		token, secret = credentials
+		await self.store.save_service_token(
+			account_id=account.id,
+			service=service.name,
+			token=token,
+			secret=secret,
+			created_at=datetime.now(timezone.utc),
+		)
+
+	async def disconnect(self, account, service):
+		return await self.store.delete_service_token(account_id=account.id, service=service.name)
+
+	async def save_thread(self, account, service, thread, *, site_url):
+		'''
+		Save thread to account's service. Raises ServiceError if it can't be,
+		and RejectedTokenError, after forgetting the credentials, if the
+		service needs to be connected again.
+		'''
+		credentials = (await self.store.get_service_tokens(account_id=account.id)).get(service.name)
+		if credentials is None:
+			raise RejectedTokenError(f"{service.title} isn't connected")
+
+		page_url = site_url + permalinks.thread_permalink(thread)
+		author = thread.author
+
+		try:
+			await service.save(
+				credentials,
+				url=page_url,
+				title=render.thread_title(thread),
+				html=render.thread_email_html(thread, page_url=page_url),
+				author=f"{author.name} (@{author.handle})" if author is not None else None,
+			)
+		except RejectedTokenError:
+			await self.disconnect(account, service)
+			raise
+
+		return page_url
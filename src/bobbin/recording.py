@@ -0,0 +1,169 @@
+# Record and replay twitter API traffic. RecordingSession wraps a real
+# aiohttp ClientSession, and saves every response it gets as a json fixture
+# file; ReplaySession serves those same responses back without touching the
+# network. Together they allow resolving real threads deterministically, for
+# testing the whole unroll pipeline or for running an offline demo.
+#
+# Fixtures never contain credentials: request headers aren't recorded at all,
+# and bearer tokens in token responses are replaced with a placeholder.
+
+import hashlib
+import json
+import logging
+import pathlib
+
+from bobbin import twitter
+from bobbin.fake_twitter import FakeResponse
+
+logger = logging.getLogger(__name__)
+
+# The placeholder for bearer tokens in fixtures. Replayed requests are
+# never checked for authorization.
+RECORDED_TOKEN = "recorded-token"
+
+# Response headers worth keeping, for replaying rate limit behavior
+RECORDED_HEADERS = frozenset({
+	"content-type",
+	"retry-after",
+	"x-rate-limit-limit",
+	"x-rate-limit-remaining",
+	"x-rate-limit-reset",
+})
+
+
+class MissingFixtureError(twitter.TwitterError):
+	'''
+	A replayed request has no recorded response
+	'''
+	def __init__(self, method, url, params):
+		super().__init__(method, url, params)
+		self.method = method
+		self.url = url
+		self.params = params
+
+
+def fixture_key(method, url, params):
+	'''
+	Get the name of the fixture file for a request. Requests are identified
+	by their method, url, and query parameters, but not their headers.
+	'''
+	canonical = json.dumps(
+		[method, url, sorted((str(key), str(value)) for key, value in (params or {}).items())],
+		separators=(",", ":"),
+	)
+	return hashlib.sha1(canonical.encode()).hexdigest()[:20] + ".json"
+
+
+def scrub(url, body):
+	if url in (twitter.TOKEN_URL, twitter.RELEASE_URL) and isinstance(body, dict) and "access_token" in body:
+		return {**body, "access_token": RECORDED_TOKEN}
+	return body
+
+
+class RecordedRequest:
+	def __init__(self, recorder, method, url, params, request):
+		self.recorder = recorder
+		self.method = method
+		self.url = url
+		self.params = params
+		self.request = request
+
+	async def __aenter__(self):
+		async with self.request as response:
+			raw = await response.read()
+
+			try:
+				body = json.loads(raw.decode()) if raw else None
+			except ValueError:
+				body = None
+
+			headers = {
+				name.lower(): value
+				for name, value in response.headers.items()
+				if name.lower() in RECORDED_HEADERS
+			}
+
+			self.recorder.save(self.method, self.url, self.params, response.status, headers, body)
+			return FakeResponse(status=response.status, body=body, headers=headers)
+
+	async def __aexit__(self, *exc):
+		pass
+
+
+class RecordingSession:
+	'''
+	Wraps a ClientSession, saving a fixture file in directory for every
+	response. Rerecording a request overwrites its fixture.
+	'''
+	def __init__(self, session, directory):
+		self.session = session
+		self.directory = pathlib.Path(directory)
+		self.directory.mkdir(parents=True, exist_ok=True)
+
+	def save(self, method, url, params, status, headers, body):
+		path = self.directory / fixture_key(method, url, params)
+		fixture = {
+			"method": method,
+			"url": url,
+			"params": {str(key): str(value) for key, value in (params or {}).items()},
+			"status": status,
+			"headers": headers,
+			"body": scrub(url, body),
+		}
+
+		try:
+			path.write_text(json.dumps(fixture, indent="\t", sort_keys=True))
+		except OSError:
+			logger.exception("Failed to record fixture for %s %s", method, url)
+
+	def get(self, url, *, params=None, headers=None):
+		return RecordedRequest(self, "GET", url, params, self.session.get(
+			url=url, params=params, headers=headers,
+		))
+
+	def post(self, url, *, headers=None, data=None):
+		return RecordedRequest(self, "POST", url, None, self.session.post(
+			url=url, headers=headers, data=data,
+		))
+
+
+class ReplaySession:
+	'''
+	Serves the responses recorded by a RecordingSession in directory. Requests
+	without a fixture raise MissingFixtureError.
+	'''
+	def __init__(self, directory):
+		self.directory = pathlib.Path(directory)
+
+	def replay(self, method, url, params):
+		path = self.directory / fixture_key(method, url, params)
+
+		try:
+			fixture = json.loads(path.read_text())
+		except FileNotFoundError:
+			raise MissingFixtureError(method, url, params) from None
+
+		return FakeResponse(
+			status=fixture["status"],
+			body=fixture["body"],
+			headers=fixture["headers"],
+		)
+
+	def get(self, url, *, params=None, headers=None):
+		return self.replay("GET", url, params)
+
+	def post(self, url, *, headers=None, data=None):
+		return self.replay("POST", url, None)
+
+
+def wrap_session(session, *, record_dir=None, replay_dir=None):
+	'''
+	Get the session to make twitter API requests with: session itself,
+	recording into record_dir, or replaying from replay_dir
+	'''
+	if replay_dir is not None:
+		return ReplaySession(replay_dir)
+	elif record_dir is not None:
+		return RecordingSession(session, record_dir)
+	else:
+		return session
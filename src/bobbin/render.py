@@ -0,0 +1,656 @@
+# Renderers for exporting threads outside of the web frontend. Each renderer
+# takes a tweetbox.Thread and returns a string.
+
+from datetime import datetime, timezone
+from xml.etree import ElementTree
+import html
+import json
+import re
+
+from bobbin.i18n import DEFAULT_LANGUAGE, translate, translate_count
+from bobbin.permalinks import thread_permalink
+from bobbin.preferences import DEFAULT_PREFERENCES
+from bobbin.share_images import HEIGHT as SHARE_IMAGE_HEIGHT, WIDTH as SHARE_IMAGE_WIDTH
+from bobbin.tweet_text import safe_url, tweet_text_html
+from bobbin.twitter import PublicMetrics
+
+
+def expand_text(tweet):
+	'''
+	Get the text of a tweet as it should be read: twitter's HTML escaping is
+	undone, t.co links are replaced with the urls they point to, and links to
+	attached media are removed, since the media is rendered separately.
+	'''
+	text = tweet.text
+
+	for url in tweet.entities.urls:
+		if url.expanded_url:
+			text = text.replace(url.url, url.expanded_url)
+
+	for media in tweet.entities.media:
+		if media.url:
+			text = text.replace(media.url, "")
+
+	return html.unescape(text).strip()
+
+
+def tweet_title(tweet, *, length=100):
+	'''
+	Get a title for a thread from its first tweet: the first line of its text
+	'''
+	return expand_text(tweet).strip().split("\n", 1)[0][:length]
+
+
+def thread_title(thread, *, language=DEFAULT_LANGUAGE):
+	author = thread.author
+	if author is None:
+		return translate(language, "conversation")
+
+	return translate(language, "thread_by", name=author.name, handle=author.handle)
+
+
+def thread_text(thread, *, separator="\n\n---\n\n"):
+	'''
+	Render a thread as plain text: a title line, followed by the text of each
+	tweet, joined by separator
+	'''
+	return "{title}\n\n{body}\n".format(
+		title=thread_title(thread),
+		body=separator.join(expand_text(tweet) for tweet in thread),
+	)
+
+
+def thread_summary(thread, *, max_length=200):
+	'''
+	A short plain text summary of a thread: the text of its first tweet,
+	truncated to max_length characters
+	'''
+	text = " ".join(expand_text(thread[0]).split())
+	if len(text) > max_length:
+		text = text[:max_length - 1].rstrip() + "…"
+	return text
+
+
+def thread_meta_tags(thread, *, page_url, share_image_url=None):
+	'''
+	Get the Open Graph and Twitter Card meta tags for a thread's page, as a
+	list of (attribute, name, content) triples, so that links to the page
+	unfurl nicely in chat apps and social media. share_image_url, if given,
+	is the url of the thread's share image (see share_images), which is
+	used instead of its media or avatar.
+	'''
+	title = thread_title(thread)
+	description = thread_summary(thread)
+
+	media_image = next((
+		media.media_url
+		for tweet in thread
+		for media in tweet.entities.media
+		if media.media_url
+	), None)
+
+	# Fall back to the author's avatar, but only show that as a thumbnail
+	image = media_image
+	if image is None and thread.author is not None:
+		image = thread.author.avatar_url
+
+	if share_image_url is not None:
+		media_image = image = share_image_url
+
+	tags = [
+		("property", "og:type", "article"),
+		("property", "og:site_name", "Bobbin"),
+		("property", "og:url", page_url),
+		("property", "og:title", title),
+		("property", "og:description", description),
+		("name", "twitter:card", "summary_large_image" if media_image else "summary"),
+		("name", "twitter:title", title),
+		("name", "twitter:description", description),
+	]
+
+	if image is not None:
+		tags.append(("property", "og:image", image))
+		tags.append(("name", "twitter:image", image))
+
+	if share_image_url is not None:
+		tags.append(("property", "og:image:width", str(SHARE_IMAGE_WIDTH)))
+		tags.append(("property", "og:image:height", str(SHARE_IMAGE_HEIGHT)))
+
+	if thread.author is not None:
+		tags.append(("name", "twitter:creator", f"@{thread.author.handle}"))
+
+	return tags
+
+
+MARKDOWN_SPECIAL = re.compile(r"([\\`*\[\]<>])")
+MARKDOWN_LINE_START = re.compile(r"^(\s*)([#>+-]|\d+\.)", re.MULTILINE)
+
+
+def escape_markdown(text):
+	'''
+	Escape text so that it renders literally in markdown. Underscores are
+	left alone, since they're common in urls and handles, and don't create
+	emphasis in the middle of words.
+	'''
+	text = MARKDOWN_SPECIAL.sub(r"\\\1", text)
+	return MARKDOWN_LINE_START.sub(r"\1\\\2", text)
+
+
+def tweet_url(tweet):
+	# Tweets from other sources link to wherever they came from, which is
+	# only trusted if it's an http link
+	if safe_url(tweet.url):
+		return tweet.url
+	return f"https://twitter.com/{tweet.user.handle}/status/{tweet.id}"
+
+
+def user_url(user):
+	if safe_url(user.url):
+		return user.url
+	return f"https://twitter.com/{user.handle}"
+
+
+def media_markdown(media):
+	label = "Video" if media.type in ("video", "animated_gif") else "Image"
+	if media.alt_text:
+		label = f"{label}: {escape_markdown(media.alt_text)}"
+
+	best_variant = media.best_variant()
+	url = best_variant.url if best_variant is not None else media.media_url
+	return f"[{label}]({url})"
+
+
+def tweet_markdown(tweet):
+	'''
+	Render the body of a single tweet as markdown: the text, links to any
+	media, and the quoted tweet, if any, as a blockquote
+	'''
+	parts = [escape_markdown(expand_text(tweet))]
+	parts.extend(media_markdown(media) for media in tweet.entities.media)
+
+	quoted = tweet.quoted
+	if quoted is not None:
+		quote = "**{name}** (@{handle})\n\n{body}\n\n[View quoted tweet]({url})".format(
+			name=escape_markdown(quoted.user.name),
+			handle=quoted.user.handle,
+			body=tweet_markdown(quoted),
+			url=tweet_url(quoted),
+		)
+		parts.append("\n".join(
+			f"> {line}" if line else ">" for line in quote.split("\n")
+		))
+
+	return "\n\n".join(part for part in parts if part)
+
+
+def thread_markdown(thread):
+	'''
+	Render a thread as markdown, with the title as a heading and one section
+	per tweet, each linking back to the original tweet
+	'''
+	sections = [
+		"{body}\n\n[{date}]({url})".format(
+			body=tweet_markdown(tweet),
+			date=tweet.created_at.strftime("%Y-%m-%d %H:%M UTC"),
+			url=tweet_url(tweet),
+		)
+		for tweet in thread
+	]
+
+	return "# {title}\n\n{body}\n".format(
+		title=escape_markdown(thread_title(thread)),
+		body="\n\n---\n\n".join(sections),
+	)
+
+
+ATOM_NAMESPACE = "http://www.w3.org/2005/Atom"
+
+
+def atom_timestamp(dt):
+	return dt.isoformat().replace("+00:00", "Z")
+
+
+def author_feed(*, handle, threads, base_url):
+	'''
+	Render an Atom feed of threads by the author with the given handle, with
+	one entry per thread linking to its page under base_url. threads should
+	be newest first.
+	'''
+	ElementTree.register_namespace("", ATOM_NAMESPACE)
+
+	def element(parent, tag, text=None, **attrs):
+		child = ElementTree.SubElement(parent, f"{{{ATOM_NAMESPACE}}}{tag}", attrs)
+		child.text = text
+		return child
+
+	feed_url = f"{base_url}/feed/{handle}.atom"
+
+	feed = ElementTree.Element(f"{{{ATOM_NAMESPACE}}}feed")
+	element(feed, "id", feed_url)
+	element(feed, "title", f"Threads by @{handle}")
+	element(feed, "link", rel="self", href=feed_url)
+	element(feed, "updated", atom_timestamp(max(
+		(thread.fetched_at for thread in threads),
+		default=datetime.now(timezone.utc),
+	)))
+
+	author = element(feed, "author")
+	element(author, "name", f"@{handle}")
+	element(author, "uri", f"https://twitter.com/{handle}")
+
+	for thread in threads:
+		# The id stays the same even if the permalink changes
+		entry = element(feed, "entry")
+		element(entry, "id", f"{base_url}/thread/{thread.tail_id}")
+		element(entry, "title", tweet_title(thread[0]))
+		element(entry, "link", href=base_url + thread_permalink(thread))
+		element(entry, "published", atom_timestamp(thread[0].created_at))
+		element(entry, "updated", atom_timestamp(thread.fetched_at))
+		element(entry, "content", thread_text(thread), type="text")
+
+	return '<?xml version="1.0" encoding="utf-8"?>\n' + ElementTree.tostring(feed, encoding="unicode")
+
+
+SITEMAP_NAMESPACE = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+
+def sitemap_xml(root_tag, entry_tag, entries):
+	ElementTree.register_namespace("", SITEMAP_NAMESPACE)
+
+	root = ElementTree.Element(f"{{{SITEMAP_NAMESPACE}}}{root_tag}")
+	for url, lastmod in entries:
+		entry = ElementTree.SubElement(root, f"{{{SITEMAP_NAMESPACE}}}{entry_tag}")
+		ElementTree.SubElement(entry, f"{{{SITEMAP_NAMESPACE}}}loc").text = url
+		if lastmod is not None:
+			ElementTree.SubElement(entry, f"{{{SITEMAP_NAMESPACE}}}lastmod").text = atom_timestamp(lastmod)
+
+	return '<?xml version="1.0" encoding="utf-8"?>\n' + ElementTree.tostring(root, encoding="unicode")
+
+
+def sitemap(entries):
+	'''
+	Render a sitemap (see https://www.sitemaps.org) of (url, last modified)
+	pairs. last modified may be None.
+	'''
+	return sitemap_xml("urlset", "url", entries)
+
+
+def sitemap_index(entries):
+	'''
+	Render a sitemap index, listing (sitemap url, last modified) pairs
+	'''
+	return sitemap_xml("sitemapindex", "sitemap", entries)
+
+
+def robots_txt(*, allow_indexing, sitemap_url=None):
+	if not allow_indexing:
+		return "User-agent: *\nDisallow: /\n"
+
+	lines = [
+		"User-agent: *",
+		"Disallow: /api/",
+		"Disallow: /embed/",
+		"Disallow: /unroll",
+	]
+
+	if sitemap_url is not None:
+		lines.extend(["", f"Sitemap: {sitemap_url}"])
+
+	return "\n".join(lines) + "\n"
+
+
+EMBED_STYLE = """
+body { margin: 0; font: 15px/1.4 -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; color: #14171a; background: #fff; }
+.font-small body { font-size: 13px; }
+.font-large body { font-size: 18px; }
+.theme-dark body { color: #d9d9d9; background: #15202b; }
+.theme-dark .thread, .theme-dark .quoted { border-color: #38444d; }
+.theme-dark .tweet { border-top-color: #22303c; }
+@media (prefers-color-scheme: dark) {
+	.theme-system body { color: #d9d9d9; background: #15202b; }
+	.theme-system .thread, .theme-system .quoted { border-color: #38444d; }
+	.theme-system .tweet { border-top-color: #22303c; }
+}
+.text a { color: #1b95e0; text-decoration: none; }
+.text a:hover { text-decoration: underline; }
+.text code { font: 0.9em/1.4 SFMono-Regular, Consolas, "Liberation Mono", Menlo, monospace; background: rgba(0, 0, 0, 0.05); border-radius: 3px; padding: 1px 3px; }
+.text pre { margin: 6px 0; padding: 8px; background: rgba(0, 0, 0, 0.05); border-radius: 6px; overflow-x: auto; white-space: pre; }
+.text pre code { background: none; padding: 0; }
+.theme-dark .text code, .theme-dark .text pre { background: rgba(255, 255, 255, 0.08); }
+.highlight [class^="hl-k"], .highlight .hl-ow { color: #a626a4; }
+.highlight [class^="hl-s"] { color: #50a14f; }
+.highlight [class^="hl-c"] { color: #a0a1a7; font-style: italic; }
+.highlight [class^="hl-m"] { color: #986801; }
+.highlight .hl-nf, .highlight .hl-fm { color: #4078f2; }
+.highlight .hl-nc, .highlight .hl-nb, .highlight .hl-bp { color: #c18401; }
+.theme-dark .highlight [class^="hl-k"], .theme-dark .highlight .hl-ow { color: #c678dd; }
+.theme-dark .highlight [class^="hl-s"] { color: #98c379; }
+.theme-dark .highlight [class^="hl-c"] { color: #7f848e; }
+.theme-dark .highlight [class^="hl-m"] { color: #d19a66; }
+.theme-dark .highlight .hl-nf, .theme-dark .highlight .hl-fm { color: #61afef; }
+.theme-dark .highlight .hl-nc, .theme-dark .highlight .hl-nb, .theme-dark .highlight .hl-bp { color: #e5c07b; }
+.metrics { margin-top: 4px; font-size: 0.85em; color: #697882; }
+.poll ol { list-style: none; margin: 8px 0 0; padding: 0; white-space: normal; }
+.poll li { position: relative; display: flex; justify-content: space-between; margin-bottom: 4px; padding: 4px 8px; border-radius: 4px; overflow: hidden; }
+.poll-bar { position: absolute; top: 0; left: 0; bottom: 0; background: rgba(29, 161, 242, 0.2); }
+.poll-label, .poll-percentage { position: relative; }
+.poll-percentage { margin-left: 8px; font-weight: bold; }
+.poll-status { font-size: 0.85em; color: #697882; white-space: normal; }
+.card { display: block; margin-top: 8px; border: 1px solid #e1e8ed; border-radius: 6px; overflow: hidden; color: inherit; text-decoration: none; white-space: normal; }
+.card:hover { background: rgba(0, 0, 0, 0.02); }
+.tweet .card img { margin: 0; border-radius: 0; width: 100%; max-height: 260px; object-fit: cover; }
+.card-body { display: block; padding: 8px 12px; }
+.card-site, .card-description { display: block; font-size: 0.85em; color: #697882; }
+.card-title { display: block; font-weight: bold; }
+.theme-dark .card { border-color: #38444d; }
+.totals { margin-bottom: 4px; color: #697882; }
+.time { display: block; margin-top: 4px; font-size: 0.85em; color: #697882; text-decoration: none; }
+.thread { display: block; border: 1px solid #e1e8ed; border-radius: 8px; padding: 12px 16px; }
+.header { display: block; font-weight: bold; margin-bottom: 8px; }
+.header a { color: inherit; text-decoration: none; }
+.tweet { display: block; padding: 8px 0; border-top: 1px solid #f0f3f5; white-space: pre-wrap; word-wrap: break-word; }
+.tweet img { display: block; max-width: 100%; margin-top: 8px; border-radius: 6px; }
+.quoted { margin: 8px 0 0; padding: 8px 12px; border: 1px solid #e1e8ed; border-radius: 6px; }
+.footer { display: block; margin-top: 8px; font-size: 13px; }
+.footer a { color: #1da1f2; }
+"""
+
+# Tells the embedding page (via embed.js) how tall the embed is, so that the
+# iframe can be sized to fit
+EMBED_RESIZE_SCRIPT = """
+function bobbinResize() {
+	parent.postMessage({bobbin: "resize", height: document.documentElement.scrollHeight}, "*");
+}
+window.addEventListener("load", bobbinResize);
+window.addEventListener("resize", bobbinResize);
+"""
+
+
+def media_alt_text(media, *, language=DEFAULT_LANGUAGE):
+	'''
+	The alt text for an image, or for a video's preview image. Media without
+	alt text still gets some, so that screen readers say that there's an
+	image, rather than skipping it as decoration.
+	'''
+	if media.alt_text and media.alt_text.strip():
+		return media.alt_text
+
+	key = "video_without_description" if media.type in ("video", "animated_gif") else "image_without_description"
+	return translate(language, key)
+
+
+def metrics_text(metrics, *, language=DEFAULT_LANGUAGE):
+	'''
+	Describe PublicMetrics, like "12 likes · 3 retweets". Counts we don't
+	have (like replies, from v1.1) are left out.
+	'''
+	counts = (
+		("likes", metrics.likes),
+		("retweets", metrics.retweets),
+		("replies", metrics.replies),
+	)
+
+	return " · ".join(
+		translate_count(language, key, count)
+		for key, count in counts
+		if count is not None
+	)
+
+
+def poll_html(poll, *, language=DEFAULT_LANGUAGE):
+	'''
+	Render a poll's options, each with its share of the votes, followed by
+	the total votes and when voting ends (or that it has ended)
+	'''
+	options = "".join(
+		'<li><span class="poll-bar" style="width: {percentage}%"></span>'
+		'<span class="poll-label">{label}</span><span class="poll-percentage">{percentage}%</span></li>'.format(
+			percentage=percentage,
+			label=html.escape(option.label),
+		)
+		for option, percentage in zip(poll.options, poll.percentages())
+	)
+
+	status = [translate_count(language, "votes", poll.total_votes)]
+	if poll.closed:
+		status.append(translate(language, "poll_final"))
+	elif poll.end_datetime is not None:
+		end = poll.end_datetime.astimezone(timezone.utc)
+		status.append('<time datetime="{}">{}</time>'.format(
+			end.isoformat(),
+			html.escape(translate(language, "poll_ends", time=end.strftime("%b %d, %Y, %H:%M UTC"))),
+		))
+
+	return '<div class="poll"><ol>{}</ol><div class="poll-status">{}</div></div>'.format(
+		options, " · ".join(status),
+	)
+
+
+def card_html(card):
+	'''
+	Render a link preview card, which links to the page it's for. Cards
+	that don't link to an http page aren't rendered at all.
+	'''
+	if not safe_url(card.url):
+		return ""
+
+	image = ""
+	if card.image_url is not None:
+		image = '<img src="{}" alt="" loading="lazy" referrerpolicy="no-referrer">'.format(html.escape(card.image_url))
+
+	description = ""
+	if card.description is not None:
+		description = '<span class="card-description">{}</span>'.format(html.escape(card.description))
+
+	return (
+		'<a class="card" href="{url}" target="_blank" rel="noopener nofollow">{image}<span class="card-body">'
+		'<span class="card-site">{site}</span><span class="card-title">{title}</span>{description}'
+		'</span></a>'
+	).format(
+		url=html.escape(card.url),
+		image=image,
+		site=html.escape(card.site_name or ""),
+		title=html.escape(card.title),
+		description=description,
+	)
+
+
+def thread_totals_html(thread, *, language=DEFAULT_LANGUAGE):
+	totals = PublicMetrics.total(tweet.metrics for tweet in thread)
+	if totals is None:
+		return ""
+
+	return '<div class="totals">{}</div>'.format(html.escape(translate(
+		language, "thread_total", metrics=metrics_text(totals, language=language),
+	)))
+
+
+def tweet_html(tweet, *, preferences=DEFAULT_PREFERENCES, language=DEFAULT_LANGUAGE, code=False, show_metrics=False):
+	parts = ['<div class="text">{}</div>'.format(tweet_text_html(tweet, code=code))]
+
+	if preferences.show_media:
+		parts.extend(
+			'<img src="{}" alt="{}" loading="lazy">'.format(
+				html.escape(media.media_url),
+				html.escape(media_alt_text(media, language=language)),
+			)
+			for media in tweet.entities.media
+			if media.media_url
+		)
+
+	if tweet.poll is not None:
+		parts.append(poll_html(tweet.poll, language=language))
+
+	# Cards are media too, as far as the preferences are concerned, like in
+	# twitter's own embeds
+	if preferences.show_media and tweet.card is not None:
+		parts.append(card_html(tweet.card))
+
+	if tweet.quoted is not None:
+		parts.append('<blockquote class="quoted"><strong>@{}</strong> {}</blockquote>'.format(
+			html.escape(tweet.quoted.user.handle),
+			tweet_html(tweet.quoted, preferences=preferences, language=language, code=code),
+		))
+
+	if show_metrics and tweet.metrics is not None:
+		parts.append('<div class="metrics">{}</div>'.format(
+			html.escape(metrics_text(tweet.metrics, language=language)),
+		))
+
+	if preferences.show_timestamps:
+		created_at = tweet.created_at.astimezone(timezone.utc)
+		parts.append('<a class="time" href="{}" target="_blank" rel="noopener"><time datetime="{}">{}</time></a>'.format(
+			html.escape(tweet_url(tweet)),
+			created_at.isoformat(),
+			created_at.strftime("%b %d, %Y, %H:%M UTC"),
+		))
+
+	return "".join(parts)
+
+
+def thread_embed_html(
+	thread, *,
+	page_url,
+	preferences=DEFAULT_PREFERENCES,
+	language=DEFAULT_LANGUAGE,
+	code=False,
+	show_metrics=False,
+):
+	'''
+	Render a thread as a minimal standalone HTML page, suitable for iframing
+	into other sites. All the styles are inline, so the embed looks the same
+	anywhere, apart from the viewer's display preferences. If code is true,
+	code in the tweets is rendered as code (see tweet_text). If show_metrics
+	is true, each tweet's likes, retweets, and replies are shown, along with
+	the thread's totals.
+	'''
+	author = thread.author
+	title = html.escape(thread_title(thread, language=language))
+	header = title
+	if author is not None:
+		header = '<a href="{}" target="_blank" rel="noopener">{}</a>'.format(
+			html.escape(user_url(author)), header,
+		)
+
+	return (
+		"<!DOCTYPE html>\n"
+		'<html lang="{language}" class="{classes}"><head><meta charset="utf-8">'
+		'<meta name="viewport" content="width=device-width, initial-scale=1">'
+		"<title>{title}</title><style>{style}</style></head>"
+		'<body><main class="thread" aria-label="{title}"><header class="header">{header}</header>{tweets}'
+		'<footer class="footer">{totals}<a href="{url}" target="_blank" rel="noopener">{view}</a></footer>'
+		"</main><script>{script}</script></body></html>\n"
+	).format(
+		language=html.escape(language),
+		classes=html.escape(preferences.html_classes()),
+		title=title,
+		style=EMBED_STYLE,
+		header=header,
+		tweets="".join(
+			'<article class="tweet">{}</article>'.format(tweet_html(
+				tweet,
+				preferences=preferences,
+				language=language,
+				code=code,
+				show_metrics=show_metrics,
+			))
+			for tweet in thread
+		),
+		url=html.escape(page_url),
+		totals=thread_totals_html(thread, language=language) if show_metrics else "",
+		view=html.escape(translate(language, "view_on_bobbin")),
+		script=EMBED_RESIZE_SCRIPT,
+	)
+
+
+def thread_email_html(thread, *, page_url):
+	'''
+	Render a thread as the HTML body of an email (see mailer): like an embed,
+	but without the script, which mail clients won't run anyway
+	'''
+	return "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><style>{style}</style></head><body>{body}</body></html>\n".format(
+		style=EMBED_STYLE,
+		body=(
+			'<main class="thread"><header class="header"><a href="{url}">{title}</a></header>{tweets}'
+			'<footer class="footer"><a href="{url}">{view}</a></footer></main>'
+		).format(
+			url=html.escape(page_url),
+			title=html.escape(thread_title(thread)),
+			tweets="".join('<article class="tweet">{}</article>'.format(tweet_html(tweet)) for tweet in thread),
+			view=html.escape(translate(DEFAULT_LANGUAGE, "view_on_bobbin")),
+		),
+	)
+
+
+def email_confirm_html(*, title, message, action=None, token=None):
+	'''
+	The page that confirmation links from emailed threads land on. With an
+	action and token, it has a button that POSTs the token to action, so
+	that link scanners fetching the page don't send anything.
+	'''
+	form = ""
+	if action is not None:
+		form = (
+			'<form method="post" action="{action}"><input type="hidden" name="token" value="{token}">'
+			'<button type="submit">Send it</button></form>'
+		).format(action=html.escape(action), token=html.escape(token))
+
+	return (
+		"<!DOCTYPE html>\n"
+		'<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">'
+		'<meta name="robots" content="noindex"><title>{title}</title><style>{style}</style></head>'
+		'<body><main class="thread"><header class="header">{title}</header><p>{message}</p>{form}</main></body></html>\n'
+	).format(
+		title=html.escape(title),
+		style=EMBED_STYLE,
+		message=html.escape(message),
+		form=form,
+	)
+
+
+# Loader (served at /embed/loader.js) for embedding threads on other sites.
+# Any element like
+#
+#     <div class="bobbin-embed" data-thread="1234"></div>
+#
+# is replaced by an iframe of that thread, which resizes to fit its content.
+# With data-code="1", code in the thread is rendered as code.
+EMBED_LOADER_SCRIPT = """(function() {
+	var origin = %(origin)s;
+	var baseUrl = %(base_url)s;
+	var frames = [];
+
+	window.addEventListener("message", function(event) {
+		if(event.origin !== origin || !event.data || event.data.bobbin !== "resize") return;
+		frames.forEach(function(frame) {
+			if(frame.contentWindow === event.source) frame.style.height = event.data.height + "px";
+		});
+	});
+
+	function load() {
+		var targets = document.querySelectorAll(".bobbin-embed[data-thread]");
+		Array.prototype.forEach.call(targets, function(target) {
+			var frame = document.createElement("iframe");
+			frame.src = baseUrl + "/embed/thread/" + encodeURIComponent(target.getAttribute("data-thread")) +
+				(target.getAttribute("data-code") === "1" ? "?code=1" : "");
+			frame.style.width = "100%%";
+			frame.style.maxWidth = "550px";
+			frame.style.border = "none";
+			frame.setAttribute("loading", "lazy");
+			frame.setAttribute("title", "Twitter thread");
+			frames.push(frame);
+			target.parentNode.replaceChild(frame, target);
+		});
+	}
+
+	if(document.readyState === "loading") {
+		document.addEventListener("DOMContentLoaded", load);
+	} else {
+		load();
+	}
+})();
+"""
+
+
+def embed_loader_script(*, origin, base_url):
+	return EMBED_LOADER_SCRIPT % {"origin": json.dumps(origin), "base_url": json.dumps(base_url)}
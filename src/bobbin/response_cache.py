@@ -0,0 +1,156 @@
+# A cache of rendered API responses. Resolving a thread, even with every
+# tweet in the tweet cache, means walking the whole reply chain and
+# re-serializing every tweet; popular threads get requested far more often
+# than they change, so we keep the rendered body around for a while. Each
+# cached response has an ETag and Last-Modified, so that clients can
+# revalidate them cheaply.
+
+from collections import namedtuple
+from email.utils import format_datetime
+import asyncio
+import hashlib
+import logging
+import time
+
+from aiohttp import web
+import cachetools
+
+logger = logging.getLogger(__name__)
+
+
+class CachedResponse(namedtuple("CachedResponse", "body etag last_modified expires_at")):
+	'''
+	A rendered response body, along with its validators. last_modified is an
+	aware datetime; expires_at is a time.monotonic() timestamp.
+	'''
+	__slots__ = ()
+
+	@property
+	def last_modified_header(self):
+		return format_datetime(self.last_modified.replace(microsecond=0), usegmt=True)
+
+	def is_fresh(self, now):
+		return now < self.expires_at
+
+	def matches(self, request):
+		'''
+		Check if the request's conditional headers show that the client already
+		has this response
+		'''
+		if_none_match = request.headers.get("If-None-Match")
+		if if_none_match is not None:
+			return if_none_match.strip() == "*" or self.etag in (
+				tag.strip() for tag in if_none_match.split(",")
+			)
+
+		if_modified_since = request.if_modified_since
+		if if_modified_since is not None:
+			return self.last_modified.replace(microsecond=0) <= if_modified_since
+
+		return False
+
+
+def make_etag(body):
+	return '"{}"'.format(hashlib.sha1(body.encode()).hexdigest())
+
+
+class ResponseCache:
+	'''
+	An in-memory LRU cache of rendered responses, bounded by the total size of
+	the response bodies. Responses are fresh for ttl seconds. If revalidate is
+	set, a stale response is served immediately while a fresh copy is rendered
+	in the background; otherwise, stale responses are re-rendered before
+	being served.
+	'''
+	def __init__(self, max_size, *, ttl, revalidate=False, clock=time.monotonic):
+		self.cache = cachetools.LRUCache(max_size, getsizeof=lambda response: len(response.body))
+		self.ttl = ttl
+		self.revalidate = revalidate
+		self.clock = clock
+
+		# key -> task rendering a fresh copy of that response
+		self.rendering = {}
+
+	async def _render(self, key, render):
+		body, last_modified = await render()
+		response = CachedResponse(body, make_etag(body), last_modified, self.clock() + self.ttl)
+
+		# Responses too large for the cache are simply not cached
+		try:
+			self.cache[key] = response
+		except ValueError:
+			pass
+
+		return response
+
+	def _start_render(self, key, render):
+		task = self.rendering.get(key)
+		if task is None:
+			task = self.rendering[key] = asyncio.ensure_future(self._render(key, render))
+			task.add_done_callback(lambda task: self.rendering.pop(key, None))
+		return task
+
+	def clear(self):
+		'''
+		Drop every cached response, for when something has changed that makes
+		them all suspect
+		'''
+		self.cache.clear()
+
+	def purge(self, predicate):
+		'''
+		Drop the cached responses whose keys match predicate. Returns the
+		number dropped.
+		'''
+		keys = [key for key in list(self.cache.keys()) if predicate(key)]
+		for key in keys:
+			self.cache.pop(key, None)
+		return len(keys)
+
+	def stats(self):
+		return {
+			"entries": len(self.cache),
+			"size": self.cache.currsize,
+			"max_size": self.cache.maxsize,
+		}
+
+	async def get(self, key, render, *, refresh=False):
+		'''
+		Get the CachedResponse for key. render is an async function returning a
+		(body, last_modified) pair, called when there's no usable response in
+		the cache. If refresh is given, the cache is bypassed, and the
+		response is always rendered anew.
+		'''
+		response = None if refresh else self.cache.get(key)
+
+		if response is not None:
+			if response.is_fresh(self.clock()):
+				return response
+
+			if self.revalidate:
+				if key not in self.rendering:
+					self._start_render(key, render).add_done_callback(log_revalidation_error)
+				return response
+
+		return (await asyncio.shield(self._start_render(key, render)))
+
+
+def log_revalidation_error(task):
+	if not task.cancelled() and task.exception() is not None:
+		logger.error("Failed to revalidate response", exc_info=task.exception())
+
+
+def make_response(request, response, *, content_type="application/json"):
+	'''
+	Create the web.Response for a CachedResponse, or a 304 if the client
+	already has it
+	'''
+	headers = {
+		"ETag": response.etag,
+		"Last-Modified": response.last_modified_header,
+	}
+
+	if response.matches(request):
+		return web.Response(status=304, headers=headers)
+
+	return web.Response(text=response.body, content_type=content_type, headers=headers)
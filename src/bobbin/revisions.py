@@ -0,0 +1,81 @@
+# Changes to threads between resolutions. When a stored thread is resolved
+# again, the new copy is compared to the old one, and if anything changed,
+# the store records a Revision (see storage.ThreadStore.get_revisions).
+#
+# Threads are matched up by their head, since appending tweets to a thread
+# (which we see with forward resolution) gives it a new tail. A tweet is
+# edited if a newer version of it exists: either the thread now has the new
+# version in its place, or the old version's edit history has grown.
+# Deleted tweets are ones that are simply gone.
+
+from collections import namedtuple
+
+
+class ThreadChanges(namedtuple("ThreadChanges", "added deleted edited")):
+	'''
+	The differences between two copies of a thread. added and deleted are
+	tuples of tweet ids; edited is a tuple of (id, latest version id) pairs.
+	'''
+	__slots__ = ()
+
+	@property
+	def empty(self):
+		return not (self.added or self.deleted or self.edited)
+
+
+def diff_threads(old, new):
+	'''
+	Get the ThreadChanges from the old copy of a thread to the new one
+	'''
+	new_ids = {tweet.id for tweet in new}
+	old_ids = {tweet.id for tweet in old}
+
+	# Earlier versions of the tweets in the new thread, by their ids
+	replaced = {
+		version_id: tweet
+		for tweet in new
+		for version_id in (tweet.edit_history or ())
+		if version_id != tweet.id
+	}
+
+	new_tweets = {tweet.id: tweet for tweet in new}
+	edited = []
+	deleted = []
+
+	for tweet in old:
+		if tweet.id in new_ids:
+			latest = new_tweets[tweet.id].latest_version_id
+			if latest != tweet.latest_version_id:
+				edited.append((tweet.id, latest))
+		elif tweet.id in replaced:
+			edited.append((tweet.id, replaced[tweet.id].id))
+		else:
+			deleted.append(tweet.id)
+
+	replacements = {latest for (_, latest) in edited}
+	added = [
+		tweet.id for tweet in new
+		if tweet.id not in old_ids and tweet.id not in replacements
+	]
+
+	return ThreadChanges(tuple(added), tuple(deleted), tuple(edited))
+
+
+class Revision(namedtuple("Revision", "tail_id recorded_at changes")):
+	'''
+	A recorded change to a thread: the tail of the new copy, when it was
+	resolved, and the ThreadChanges from the copy before it
+	'''
+	__slots__ = ()
+
+	def json(self):
+		return {
+			"tail": self.tail_id,
+			"recorded_at": self.recorded_at.isoformat(),
+			"added": list(self.changes.added),
+			"deleted": list(self.changes.deleted),
+			"edited": [
+				{"id": tweet_id, "latest_id": latest_id}
+				for tweet_id, latest_id in self.changes.edited
+			],
+		}
@@ -0,0 +1,363 @@
+# The top level request handler for the whole site. Everything the handlers
+# depend on (the thread getters, the cache, the static files) is supplied
+# through a ServerConfig, rather than constructed here, so that the server can
+# be run against fakes.
+
+from collections import namedtuple
+import asyncio
+import functools
+import logging
+import pathlib
+import re
+import signal
+import ssl
+
+from aiohttp import web
+
+from bobbin import account_server, admin_server, api_keys, api_server, client_limits, discord_integration, export_server, frontend_server, graphql_server, health, proxy, slack_integration, source, web_util
+
+logger = logging.getLogger(__name__)
+
+
+# Routes that can cause twitter API calls are rate limited per client
+rate_limited = client_limits.rate_limited
+
+# Frontend pages let the browser use the API without a key
+site_page = api_keys.with_site_cookie
+
+routes = web_util.routes(
+	(r'/healthz$', health.healthz_handler, []),
+	(r'/readyz$', health.readyz_handler, ['health_checks']),
+	(r'/$', site_page(frontend_server.index_handler), ['api_keys', 'theme']),
+	(r'/thread/(?P<tail>[0-9]{1,20})/?$', site_page(rate_limited(frontend_server.thread_page_handler)), ['api_keys', 'client_limiter', 'theme', 'get_thread', 'view_counter', 'share_images', 'tail']),
+	(r'/t/[a-zA-Z0-9_]{1,15}/(?:[a-z0-9-]*-)?(?P<tail>[0-9]{1,20})/?$', site_page(rate_limited(frontend_server.thread_page_handler)), ['api_keys', 'client_limiter', 'theme', 'get_thread', 'view_counter', 'share_images', 'tail']),
+	(r'/thread/(?P<tail>[0-9]{1,20})/card\.png$', rate_limited(export_server.share_image_handler), ['client_limiter', 'get_thread', 'share_images', 'tail']),
+	(r'/media/(?P<key>[0-9a-f]{64}(?:\.[a-z0-9]{1,4})?)$', export_server.media_handler, ['media_mirror', 'key']),
+	(r'/img$', rate_limited(export_server.image_handler), ['client_limiter', 'image_proxy']),
+	(r'/thread/[0-9]{1,21}/tree/?$', site_page(frontend_server.index_handler), ['api_keys', 'theme']),
+	(r'/thread/(?P<tail>[0-9]{1,20})/events/?$', rate_limited(api_server.thread_events_handler), ['client_limiter', 'stream_thread', 'show_metrics', 'tail']),
+	(r'/thread/(?P<tail>[0-9]{1,20})/live/?$', rate_limited(api_server.thread_live_handler), ['client_limiter', 'live_threads', 'show_metrics', 'tail']),
+	(r'/thread/(?=[0-9]+\.)', rate_limited(export_server.handler), ['client_limiter', 'get_thread', 'thread_pdfs']),
+	(r'/feed/', export_server.feed_routes, 'thread_store'),
+	(r'/oembed/?$', rate_limited(export_server.oembed_handler), ['client_limiter', 'get_thread']),
+	(r'/embed/', rate_limited(export_server.embed_routes), ['client_limiter', 'get_thread', 'show_metrics']),
+	(r'/faq/?$', site_page(frontend_server.index_handler), ['api_keys', 'theme']),
+	(r'/settings/?$', site_page(frontend_server.index_handler), ['api_keys', 'theme']),
+	(r'/search/?$', site_page(frontend_server.index_handler), ['api_keys', 'theme']),
+	(r'/me/?$', site_page(frontend_server.index_handler), ['api_keys', 'theme']),
+	(r'/login/?$', account_server.login_handler, ['accounts']),
+	(r'/login/callback/?$', account_server.login_callback_handler, ['accounts']),
+	(r'/logout/?$', account_server.logout_handler, ['accounts']),
+	(r'/read-later/(?P<service>[a-z]{1,20})/connect/?$', account_server.read_later_connect_handler, ['accounts', 'read_later', 'service']),
+	(r'/read-later/(?P<service>[a-z]{1,20})/callback/?$', account_server.read_later_callback_handler, ['accounts', 'read_later', 'service']),
+	(r'/author/(?P<handle>[a-zA-Z0-9_]{1,15})/?$', site_page(frontend_server.author_page_handler), ['api_keys', 'theme', 'thread_store', 'handle']),
+	(r'/robots\.txt$', export_server.robots_handler, ['allow_indexing', 'thread_store']),
+	(r'/sitemap\.xml$', export_server.sitemap_index_handler, ['allow_indexing', 'thread_store']),
+	(r'/sitemap-(?P<page>[0-9]{1,6})\.xml$', export_server.sitemap_page_handler, ['allow_indexing', 'thread_store', 'page']),
+	(r'/unroll/?$', frontend_server.unroll_handler, ['providers']),
+	(r'/email/confirm/?$', export_server.email_confirm_routes, ['get_thread', 'thread_mailer']),
+	(r'/source/(?P<provider>[a-z]{1,20})/(?P<ref>[a-zA-Z0-9.:-]{1,253}/[a-zA-Z0-9]{1,20})/?$', rate_limited(export_server.source_thread_handler), ['client_limiter', 'providers', 'show_metrics', 'provider', 'ref']),
+	(r'/api/', api_keys.with_api_key(rate_limited(api_server.handler)), ['api_keys', 'client_limiter', 'get_thread', 'get_thread_replies', 'get_private_thread', 'get_thread_tree', 'tweet_cache', 'response_cache', 'job_queue', 'callback_sender', 'show_metrics', 'thread_store', 'opt_outs', 'homepage_threads', 'trending', 'recrawler', 'accounts', 'providers', 'thread_mailer', 'read_later']),
+	(r'/graphql/?$', api_keys.with_api_key(rate_limited(graphql_server.handler)), ['api_keys', 'client_limiter', 'graphql_schema', 'get_thread', 'thread_store', 'opt_outs', 'show_metrics']),
+	(r'/integrations/discord/?$', discord_integration.handler, ['discord', 'get_thread']),
+	(r'/integrations/slack/?$', slack_integration.handler, ['slack', 'get_thread']),
+	(r'/admin/', admin_server.handler, [
+		'admin_token', 'opt_outs', 'response_cache', 'tweet_cache',
+		'thread_store', 'job_queue', 'token_pool', 'flags', 'api_keys',
+		'resolution_limiter',
+	]),
+	(r'/static/', frontend_server.static_file_handler, ['theme', 'valid_paths']),
+)
+
+
+class ServerConfig(namedtuple("ServerConfig", (
+	"get_thread",
+	"get_thread_tree",
+	"tweet_cache",
+	"static_dir",
+	"get_thread_replies",
+	"response_cache",
+	"thread_store",
+	"valid_paths",
+	"log_requests",
+	"stream_thread",
+	"job_queue",
+	"callback_sender",
+	"allow_indexing",
+	"opt_outs",
+	"admin_token",
+	"token_pool",
+	"flags",
+	"client_limiter",
+	"api_keys",
+	"trusted_proxies",
+	"base_path",
+	"health_checks",
+	"resolution_limiter",
+	"show_metrics",
+	"homepage_threads",
+	"view_counter",
+	"trending",
+	"share_images",
+	"recrawler",
+	"accounts",
+	"providers",
+	"media_mirror",
+	"image_proxy",
+	"graphql_schema",
+	"live_threads",
+	"discord",
+	"slack",
+	"thread_mailer",
+	"read_later",
+	"thread_pdfs",
+	"get_private_thread",
+	"theme_dir",
+	"reload_theme",
+), defaults=(None, None, None, None, True, None, None, None, True, None, None, None, None, None, None, 0, "", None, None, True, True, None, None, None, None, None, None, None, None, None, None, None, None, None, None, None, None, None, False))):
+	'''
+	The dependencies of the server. get_thread, get_thread_tree and
+	get_thread_replies are the functions created by tweetbox's make_*_getter
+	functions; get_thread_replies may be None to disable replies.
+	response_cache, if given, is a ResponseCache for thread responses.
+	thread_store, if given, is the ThreadStore used for author feeds, the
+	sitemap, and search. If allow_indexing is false, robots.txt asks search
+	engines not to index anything. opt_outs is the optout.OptOutList managed
+	through the admin endpoints, which are only enabled if there's an
+	admin_token. Threads by opted out authors are left out of search.
+	token_pool (the twitter.TokenPool, or None without credentials) and flags
+	(a flags.FeatureFlags) are only used by the admin endpoints, to report
+	token state and toggle flags.
+	client_limiter, if given, is a client_limits.ClientRateLimiter applied to
+	the thread pages, embeds and the API. api_keys, if given, is an api_keys.ApiKeys,
+	and makes API keys required for the API. trusted_proxies is the number of
+	reverse proxies in front of the server, whose X-Forwarded headers are
+	believed, and base_path is the path the site is mounted under, if any.
+	health_checks, if given, is a health.HealthChecks for /readyz.
+	resolution_limiter, if given, is the load_shedding.ResolutionLimiter the
+	thread getters use, for the admin stats. If show_metrics is false, likes,
+	retweets, and replies are left out of the API and embeds. If
+	homepage_threads is true and there's a thread_store, the homepage lists
+	recent and popular threads. view_counter, if given, is the
+	analytics.ViewCounter that counts thread page views, and trending, if
+	given, is the analytics.TrendingTracker for /api/trending. share_images,
+	if given, is a share_images.ShareImageRenderer for thread preview images.
+	recrawler, if given, is the follows.Recrawler for followed threads, and
+	enables following threads through the API. accounts, if given, is an
+	accounts.Accounts, and enables signing in, bookmarks, and reading
+	history. providers are the source.Providers that threads can be
+	unrolled from; if not given, it's just twitter, through get_thread.
+	media_mirror, if given, is the media_mirror.MediaMirror whose copies of
+	thread media are served from /media/. image_proxy, if given, is the
+	image_proxy.ImageProxy that serves resized thread images from /img.
+	graphql_schema, if given, is the schema from graphql_server.make_schema,
+	and enables /graphql. live_threads, if given, is the live.LiveThreads
+	that viewers following threads live are sent new tweets from. discord,
+	if given, is the discord_integration.DiscordIntegration that answers
+	/integrations/discord, and slack, if given, is the
+	slack_integration.SlackIntegration that unfurls links in Slack, through
+	/integrations/slack. thread_mailer, if given, is the mailer.ThreadMailer
+	that emails threads to readers. read_later, if given, is the
+	read_later.ReadLater that signed in readers save threads to Pocket,
+	Instapaper, and Readwise with; it needs accounts. thread_pdfs, if given,
+	is the pdf_export.ThreadPdfRenderer that serves /thread/<id>.pdf.
+	get_private_thread, if given, is from
+	tweetbox.make_private_thread_getter, and lets signed in users with an
+	access token see protected threads through the API; it needs accounts.
+	stream_thread, if given, is from tweetbox.make_thread_streamer, and
+	enables streaming thread events. job_queue, if given, is a
+	jobs.JobQueue that API thread requests are resolved through, and
+	callback_sender, if given, is a callbacks.CallbackSender for notifying
+	clients when their jobs finish.
+	static_dir is the directory containing index.html and the static files.
+	If valid_paths is given, only those paths under static_dir are served.
+	theme_dir, if given, is a directory of files served in place of
+	static_dir's, and reload_theme makes changes to it show up without a
+	restart (see frontend_server.Theme).
+	'''
+	__slots__ = ()
+
+
+def make_handler(config):
+	'''
+	Create the request handler for the server, with all of the context from
+	config filled in
+	'''
+	theme = frontend_server.Theme(config.static_dir, config.theme_dir, reload=config.reload_theme)
+	handler = web_util.shitty_logging(routes) if config.log_requests else routes
+
+	handler = web_util.with_context(
+		handler,
+		get_thread=config.get_thread,
+		get_thread_replies=config.get_thread_replies,
+		response_cache=config.response_cache,
+		thread_store=config.thread_store,
+		stream_thread=config.stream_thread,
+		job_queue=config.job_queue,
+		callback_sender=config.callback_sender,
+		allow_indexing=config.allow_indexing,
+		opt_outs=config.opt_outs,
+		admin_token=config.admin_token,
+		token_pool=config.token_pool,
+		flags=config.flags,
+		client_limiter=config.client_limiter,
+		api_keys=config.api_keys,
+		health_checks=config.health_checks,
+		resolution_limiter=config.resolution_limiter,
+		show_metrics=config.show_metrics,
+		homepage_threads=config.homepage_threads,
+		view_counter=config.view_counter,
+		trending=config.trending,
+		share_images=config.share_images,
+		recrawler=config.recrawler,
+		accounts=config.accounts,
+		providers=config.providers if config.providers is not None else (source.TwitterProvider(config.get_thread),),
+		media_mirror=config.media_mirror,
+		image_proxy=config.image_proxy,
+		graphql_schema=config.graphql_schema,
+		live_threads=config.live_threads,
+		discord=config.discord,
+		slack=config.slack,
+		thread_mailer=config.thread_mailer,
+		read_later=config.read_later,
+		thread_pdfs=config.thread_pdfs,
+		get_private_thread=config.get_private_thread,
+		get_thread_tree=config.get_thread_tree,
+		tweet_cache=config.tweet_cache,
+		theme=theme,
+		valid_paths=config.valid_paths,
+	)
+
+	return proxy.with_proxy(
+		handler,
+		trusted_proxies=config.trusted_proxies,
+		base_path=config.base_path,
+		root_paths=("/healthz", "/readyz"),
+	)
+
+
+def with_timeout(handler, timeout):
+	'''
+	Abort requests that take longer than timeout seconds with a 504
+	'''
+	@functools.wraps(handler)
+	async def timeout_handler(request, **kwargs):
+		try:
+			return await asyncio.wait_for(handler(request, **kwargs), timeout)
+		except asyncio.TimeoutError as e:
+			raise web.HTTPGatewayTimeout() from e
+	return timeout_handler
+
+
+class TLSConfig(namedtuple("TLSConfig", "cert key port acme_dir")):
+	'''
+	Settings for serving HTTPS directly, without a reverse proxy. cert and
+	key are the paths of the certificate chain and private key, which are
+	reloaded when the process gets SIGHUP. The site is served over HTTPS on
+	port; the plain HTTP port only redirects to it, except for ACME HTTP-01
+	challenges, which are served from .well-known/acme-challenge/ in
+	acme_dir (if given). That's where certbot's webroot mode writes them, to
+	issue and renew Let's Encrypt certificates:
+
+	    certbot certonly --webroot -w <acme_dir> -d <domain> \\
+	        --deploy-hook "pkill -HUP -f bobbin"
+	'''
+	__slots__ = ()
+
+
+ACME_CHALLENGE_PATH = re.compile(r"^/\.well-known/acme-challenge/([A-Za-z0-9_-]+)$")
+
+
+def make_redirect_handler(tls):
+	'''
+	Create the handler for plain HTTP when serving HTTPS
+	'''
+	async def redirect_handler(request):
+		challenge = ACME_CHALLENGE_PATH.match(request.path)
+		if challenge is not None and tls.acme_dir is not None:
+			path = pathlib.Path(tls.acme_dir, ".well-known", "acme-challenge", challenge.group(1))
+			if not path.is_file():
+				raise web.HTTPNotFound()
+			return web.FileResponse(path)
+
+		url = request.url.with_scheme("https").with_port(tls.port if tls.port != 443 else None)
+		raise web.HTTPPermanentRedirect(url)
+
+	return redirect_handler
+
+
+def make_tls_context(tls):
+	context = ssl.create_default_context(ssl.Purpose.CLIENT_AUTH)
+	context.load_cert_chain(tls.cert, tls.key)
+	return context
+
+
+def reload_tls_context(context, tls):
+	# Existing connections keep their certificate; new ones get the new one
+	try:
+		context.load_cert_chain(tls.cert, tls.key)
+	except (OSError, ssl.SSLError):
+		logger.exception("Couldn't reload the TLS certificate")
+	else:
+		logger.info("Reloaded the TLS certificate")
+
+
+async def run(
+	handler, *,
+	host,
+	port,
+	loop,
+	request_timeout=60,
+	keepalive_timeout=75,
+	grace_period=10,
+	tls=None,
+):
+	'''
+	Serve handler on host:port until the process gets SIGINT or SIGTERM. At
+	that point, the server stops accepting connections, and in-flight
+	requests are given grace_period seconds to finish before they're
+	cancelled. Individual requests are limited to request_timeout seconds,
+	and idle keep-alive connections are closed after keepalive_timeout
+	seconds. If tls (a TLSConfig) is given, handler is served over HTTPS on
+	tls.port instead, and port redirects to it.
+	'''
+	if request_timeout:
+		handler = with_timeout(handler, request_timeout)
+
+	http_server = web.Server(handler, loop=loop, keepalive_timeout=keepalive_timeout)
+	http_servers = [http_server]
+
+	if tls is None:
+		tcp_servers = [await loop.create_server(http_server, host, port)]
+	else:
+		context = make_tls_context(tls)
+		redirect_server = web.Server(make_redirect_handler(tls), loop=loop, keepalive_timeout=keepalive_timeout)
+		http_servers.append(redirect_server)
+
+		tcp_servers = [
+			await loop.create_server(http_server, host, tls.port, ssl=context),
+			await loop.create_server(redirect_server, host, port),
+		]
+
+		loop.add_signal_handler(signal.SIGHUP, reload_tls_context, context, tls)
+
+	stop = asyncio.Event()
+	for signum in (signal.SIGINT, signal.SIGTERM):
+		loop.add_signal_handler(signum, stop.set)
+
+	try:
+		await stop.wait()
+		logger.info("Shutting down")
+	finally:
+		for signum in (signal.SIGINT, signal.SIGTERM):
+			loop.remove_signal_handler(signum)
+
+		if tls is not None:
+			loop.remove_signal_handler(signal.SIGHUP)
+
+		for tcp_server in tcp_servers:
+			tcp_server.close()
+			await tcp_server.wait_closed()
+
+		for server in http_servers:
+			await server.shutdown(grace_period)
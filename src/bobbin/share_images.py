@@ -0,0 +1,263 @@
+# Preview images for sharing threads: a 1200x630 PNG with the author's
+# avatar, name and handle, the start of the first tweet, and how many tweets
+# there are, for og:image and twitter:image. Sites that unfurl links show
+# these much larger than a bare avatar.
+#
+# Drawing them needs Pillow, which is optional:
+#
+#     pip install bobbin[share-images]
+#
+# Without it, available() is false and thread pages keep using the thread's
+# first image (or the author's avatar) instead. Text is drawn with font, a
+# TrueType font file; Pillow also looks for bare file names in the system's
+# font directories. If it can't be found, Pillow's small built-in bitmap
+# font is used.
+
+from io import BytesIO
+import asyncio
+import functools
+import html
+import logging
+
+import aiohttp
+import cachetools
+
+from bobbin.i18n import DEFAULT_LANGUAGE, translate_count
+from bobbin.link_cards import read_limited
+from bobbin.permalinks import URL_PATTERN
+
+try:
+	from PIL import Image, ImageDraw, ImageFont, ImageOps
+except ImportError:
+	Image = None
+
+logger = logging.getLogger(__name__)
+
+WIDTH = 1200
+HEIGHT = 630
+
+MARGIN = 80
+AVATAR_SIZE = 160
+EXCERPT_LINES = 5
+
+BACKGROUND = "#ffffff"
+ACCENT = "#1b95e0"
+TEXT = "#14171a"
+SECONDARY_TEXT = "#657786"
+PLACEHOLDER = "#ccd6dd"
+
+DEFAULT_FONT = "DejaVuSans.ttf"
+
+# Where images are kept in the blob store
+STORE_PREFIX = "share-images/"
+
+
+def available():
+	return Image is not None
+
+
+def load_font(font, size):
+	try:
+		return ImageFont.truetype(font, size)
+	except OSError:
+		return ImageFont.load_default()
+
+
+def text_width(font, text):
+	return font.getsize(text)[0]
+
+
+def wrap_text(text, font, *, width, max_lines):
+	'''
+	Break text into lines no wider than width, at spaces where possible.
+	Text past max_lines is cut, with an ellipsis.
+	'''
+	lines = []
+	line = ""
+
+	for word in text.split():
+		candidate = f"{line} {word}" if line else word
+		if text_width(font, candidate) <= width:
+			line = candidate
+			continue
+
+		if line:
+			lines.append(line)
+
+		# Words too long for a line of their own are split anywhere
+		while text_width(font, word) > width:
+			cut = len(word) - 1
+			while cut > 1 and text_width(font, word[:cut]) > width:
+				cut -= 1
+			lines.append(word[:cut])
+			word = word[cut:]
+
+		line = word
+
+	if line:
+		lines.append(line)
+
+	if len(lines) > max_lines:
+		lines = lines[:max_lines]
+		last = lines[-1]
+		while last and text_width(font, last + "…") > width:
+			last = last[:-1]
+		lines[-1] = last.rstrip() + "…"
+
+	return lines
+
+
+def round_avatar(data):
+	'''
+	Crop avatar image data to a circle of AVATAR_SIZE. Returns the image and
+	its mask, or None if the data isn't an image Pillow can read.
+	'''
+	try:
+		avatar = Image.open(BytesIO(data)).convert("RGB")
+	except (OSError, ValueError):
+		return None
+
+	avatar = ImageOps.fit(avatar, (AVATAR_SIZE, AVATAR_SIZE), Image.LANCZOS)
+
+	mask = Image.new("L", (AVATAR_SIZE, AVATAR_SIZE), 0)
+	ImageDraw.Draw(mask).ellipse((0, 0, AVATAR_SIZE - 1, AVATAR_SIZE - 1), fill=255)
+	return avatar, mask
+
+
+def render_share_image(*, name, handle, excerpt, tweet_count, avatar=None, font=DEFAULT_FONT, language=DEFAULT_LANGUAGE):
+	'''
+	Draw a share image, and return it as PNG data. avatar is the author's
+	avatar image data, if we have it. This is slow enough that it shouldn't
+	be run on the event loop.
+	'''
+	image = Image.new("RGB", (WIDTH, HEIGHT), BACKGROUND)
+	draw = ImageDraw.Draw(image)
+
+	name_font = load_font(font, 52)
+	handle_font = load_font(font, 36)
+	excerpt_font = load_font(font, 44)
+	footer_font = load_font(font, 32)
+
+	draw.rectangle((0, 0, WIDTH, 12), fill=ACCENT)
+
+	rounded = round_avatar(avatar) if avatar is not None else None
+	if rounded is not None:
+		image.paste(rounded[0], (MARGIN, MARGIN), rounded[1])
+	else:
+		draw.ellipse((MARGIN, MARGIN, MARGIN + AVATAR_SIZE, MARGIN + AVATAR_SIZE), fill=PLACEHOLDER)
+
+	text_left = MARGIN + AVATAR_SIZE + 40
+	text_width_limit = WIDTH - text_left - MARGIN
+	name = "".join(wrap_text(name, name_font, width=text_width_limit, max_lines=1))
+	draw.text((text_left, MARGIN + 20), name, font=name_font, fill=TEXT)
+	draw.text((text_left, MARGIN + 90), f"@{handle}", font=handle_font, fill=SECONDARY_TEXT)
+
+	top = MARGIN + AVATAR_SIZE + 50
+	for line in wrap_text(excerpt, excerpt_font, width=WIDTH - 2 * MARGIN, max_lines=EXCERPT_LINES):
+		draw.text((MARGIN, top), line, font=excerpt_font, fill=TEXT)
+		top += 56
+
+	footer_top = HEIGHT - MARGIN
+	draw.text((MARGIN, footer_top), translate_count(language, "tweets", tweet_count), font=footer_font, fill=SECONDARY_TEXT)
+	draw.text((WIDTH - MARGIN - text_width(footer_font, "Bobbin"), footer_top), "Bobbin", font=footer_font, fill=ACCENT)
+
+	output = BytesIO()
+	image.save(output, "PNG", optimize=True)
+	return output.getvalue()
+
+
+def large_avatar_url(url):
+	# Twitter's avatar urls are for 48x48 images; there are bigger ones too
+	return url.replace("_normal.", "_400x400.")
+
+
+class ShareImageRenderer:
+	'''
+	Draws share images for threads, fetching avatars with session. Avatars
+	bigger than max_avatar_bytes, or that take longer than timeout seconds,
+	are left out. The last cache_size images are kept, and if there's a
+	store (a blob_store.BlobStore), every image is saved to it, so that it's
+	only drawn once.
+	'''
+	def __init__(self, session, *, font=DEFAULT_FONT, timeout=5, max_avatar_bytes=1024 * 1024, cache_size=256, store=None):
+		self.session = session
+		self.font = font
+		self.timeout = timeout
+		self.max_avatar_bytes = max_avatar_bytes
+		self.cache = cachetools.LRUCache(cache_size)
+		self.store = store
+
+	async def fetch_avatar(self, url):
+		try:
+			async with self.session.get(
+				large_avatar_url(url),
+				timeout=aiohttp.ClientTimeout(total=self.timeout),
+			) as response:
+				if response.status != 200:
+					return None
+
+				return await read_limited(response, self.max_avatar_bytes)
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, ValueError):
+			logger.info("Couldn't fetch avatar %s", url)
+			return None
+
+	async def render(self, thread, *, language=DEFAULT_LANGUAGE):
+		'''
+		Get the share image for a thread, as PNG data
+		'''
+		key = (thread.tail_id, thread.fetched_at, language)
+		try:
+			return self.cache[key]
+		except KeyError:
+			pass
+
+		store_key = f"{STORE_PREFIX}{thread.tail_id}-{int(thread.fetched_at.timestamp())}-{language}.png"
+		stored = await self.load(store_key)
+		if stored is not None:
+			self.cache[key] = stored
+			return stored
+
+		author = thread.author if thread.author is not None else thread[0].user
+		avatar = await self.fetch_avatar(author.avatar_url) if author.avatar_url else None
+
+		image = await asyncio.get_event_loop().run_in_executor(None, functools.partial(
+			render_share_image,
+			name=author.name,
+			handle=author.handle,
+			excerpt=URL_PATTERN.sub("", html.unescape(thread[0].text)),
+			tweet_count=len(thread),
+			avatar=avatar,
+			font=self.font,
+			language=language,
+		))
+
+		self.cache[key] = image
+		await self.save(store_key, image)
+		return image
+
+	async def load(self, store_key):
+		if self.store is None:
+			return None
+
+		try:
+			blob = await self.store.get(store_key)
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, OSError, ValueError) as e:
+			logger.warning("Couldn't load share image %s: %r", store_key, e)
+			return None
+
+		return blob[0] if blob is not None else None
+
+	async def save(self, store_key, image):
+		if self.store is None:
+			return
+
+		try:
+			await self.store.put(store_key, image, "image/png")
+		except asyncio.CancelledError:
+			raise
+		except (aiohttp.ClientError, asyncio.TimeoutError, OSError, ValueError) as e:
+			logger.warning("Couldn't save share image %s: %r", store_key, e)
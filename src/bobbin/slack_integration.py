@@ -0,0 +1,214 @@
+# A Slack integration, so that links to threads here unfurl in Slack with a
+# useful preview: the title and author, the first few tweets, and how long
+# the thread is. The Slack app subscribes to the link_shared event for the
+# site's domain (as an App Unfurl Domain), with /integrations/slack as its
+# Events API request url, and needs the links:write scope.
+#
+# Requests from Slack are signed with the app's signing secret
+# (slack_signing_secret); unfurls are posted with its bot token
+# (slack_bot_token). Slack wants events acknowledged within 3 seconds, so
+# they're acknowledged right away, and the unfurls posted once the threads
+# are resolved.
+
+from urllib.parse import urlsplit
+import asyncio
+import hashlib
+import hmac
+import json
+import logging
+import re
+import time
+
+from aiohttp import web
+import aiohttp
+
+from bobbin import permalinks, render, web_util
+from bobbin.thread_stats import thread_stats
+
+logger = logging.getLogger(__name__)
+
+UNFURL_URL = "https://slack.com/api/chat.unfurl"
+
+SIGNATURE_HEADER = "X-Slack-Signature"
+TIMESTAMP_HEADER = "X-Slack-Request-Timestamp"
+SIGNATURE_VERSION = "v0"
+
+# How old a signed request can be, in seconds, so that they can't be replayed
+MAX_REQUEST_AGE = 5 * 60
+
+THREAD_PATH_PATTERN = re.compile(r"/thread/([0-9]{1,20})/?$")
+
+# The most links in one message to unfurl
+MAX_LINKS = 5
+
+PREVIEW_TWEETS = 3
+MAX_TWEET_LENGTH = 280
+
+
+def thread_tail(url):
+	'''
+	Get the tail id of the thread a link to this site is for, or None if it
+	isn't a link to a thread
+	'''
+	path = urlsplit(url).path
+	match = THREAD_PATH_PATTERN.search(path)
+	if match is not None:
+		return match.group(1)
+	return permalinks.parse_permalink(path)
+
+
+def escape(text):
+	# Slack's mrkdwn only needs these escaped
+	return text.replace("&", "&amp;").replace("<", "&lt;").replace(">", "&gt;")
+
+
+def thread_unfurl(thread, *, url):
+	'''
+	The unfurl for a link to thread at url, as Block Kit blocks
+	'''
+	lines = [f"*<{url}|{escape(render.thread_title(thread))}>*"]
+	for tweet in thread[:PREVIEW_TWEETS]:
+		text = " ".join(render.expand_text(tweet).split())
+		if len(text) > MAX_TWEET_LENGTH:
+			text = text[:MAX_TWEET_LENGTH - 1].rstrip() + "…"
+		lines.append(f">{escape(text)}")
+
+	stats = thread_stats(thread)
+	details = [
+		"1 tweet" if stats.tweets == 1 else f"{stats.tweets} tweets",
+		f"{stats.reading_minutes} min read",
+	]
+	if stats.first_tweet_at is not None:
+		written = stats.first_tweet_at
+		details.append(f"{written:%b} {written.day}, {written.year}")
+
+	context = []
+	author = thread.author
+	if author is not None:
+		if author.avatar_url:
+			context.append({"type": "image", "image_url": author.avatar_url, "alt_text": author.handle})
+		context.append({"type": "mrkdwn", "text": escape(f"{author.name} (@{author.handle})")})
+	context.append({"type": "mrkdwn", "text": " · ".join(details)})
+
+	return {"blocks": [
+		{"type": "section", "text": {"type": "mrkdwn", "text": "\n".join(lines)}},
+		{"type": "context", "elements": context},
+	]}
+
+
+class SlackIntegration:
+	'''
+	Unfurls links to threads in Slack. Requests are checked against
+	signing_secret, and unfurls are posted with session and bot_token.
+	'''
+	def __init__(self, session, *, signing_secret, bot_token):
+		self.session = session
+		self.signing_secret = signing_secret
+		self.bot_token = bot_token
+
+		# Unfurls still being worked on
+		self.pending = set()
+
+	def is_valid(self, *, signature, timestamp, body, now=None):
+		try:
+			age = (time.time() if now is None else now) - int(timestamp)
+		except ValueError:
+			return False
+		if abs(age) > MAX_REQUEST_AGE:
+			return False
+
+		base = f"{SIGNATURE_VERSION}:{timestamp}:".encode() + body
+		expected = hmac.new(self.signing_secret.encode(), base, hashlib.sha256).hexdigest()
+		return hmac.compare_digest(f"{SIGNATURE_VERSION}={expected}".encode(), signature.encode())
+
+	async def resolve(self, url, *, get_thread):
+		tail = thread_tail(url)
+		if tail is None:
+			return None
+
+		try:
+			thread = await get_thread(tail=tail, head=None)
+		except asyncio.CancelledError:
+			raise
+		except Exception:
+			# Opted out, deleted, or just unavailable right now; Slack shows
+			# the link as it is
+			logger.info("Couldn't unfurl %s", url, exc_info=True)
+			return None
+
+		return thread_unfurl(thread, url=url)
+
+	async def unfurl(self, event, *, get_thread):
+		urls = list(dict.fromkeys(link["url"] for link in event.get("links", ())))[:MAX_LINKS]
+		results = await asyncio.gather(*(self.resolve(url, get_thread=get_thread) for url in urls))
+		unfurls = {url: result for url, result in zip(urls, results) if result is not None}
+		if not unfurls:
+			return
+
+		body = {"unfurls": unfurls}
+		if "unfurl_id" in event:
+			body.update(unfurl_id=event["unfurl_id"], source=event.get("source", "conversations_history"))
+		else:
+			body.update(channel=event["channel"], ts=event["message_ts"])
+
+		try:
+			async with self.session.post(
+				UNFURL_URL,
+				json=body,
+				headers={"Authorization": f"Bearer {self.bot_token}"},
+			) as response:
+				response.raise_for_status()
+				result = await response.json(content_type=None)
+		except (aiohttp.ClientError, asyncio.TimeoutError, ValueError):
+			logger.warning("Couldn't post Slack unfurls", exc_info=True)
+			return
+
+		if not result.get("ok"):
+			logger.warning("Slack refused unfurls: %s", result.get("error"))
+
+	def handle_event(self, event, *, get_thread):
+		if event.get("type") != "link_shared":
+			return
+
+		task = asyncio.ensure_future(self.unfurl(event, get_thread=get_thread))
+		self.pending.add(task)
+		task.add_done_callback(self.pending.discard)
+
+	async def close(self):
+		tasks = list(self.pending)
+		for task in tasks:
+			task.cancel()
+		await asyncio.gather(*tasks, return_exceptions=True)
+
+
+@web_util.method_handler('POST')
+async def handler(request, *, slack, get_thread):
+	'''
+	Handle a request from Slack's Events API
+	'''
+	if slack is None:
+		raise web_util.not_found_json("Slack isn't enabled on this server")
+
+	body = await request.read()
+	if not slack.is_valid(
+		signature=request.headers.get(SIGNATURE_HEADER, ""),
+		timestamp=request.headers.get(TIMESTAMP_HEADER, ""),
+		body=body,
+	):
+		raise web_util.error_json(web.HTTPUnauthorized, "Invalid request signature")
+
+	try:
+		payload = json.loads(body)
+	except ValueError:
+		raise web_util.bad_request_json("Invalid JSON body") from None
+
+	if not isinstance(payload, dict):
+		raise web_util.bad_request_json("Body must be a JSON object")
+
+	if payload.get("type") == "url_verification":
+		return web.Response(text=web_util.dump_json(challenge=payload.get("challenge")), content_type="application/json")
+
+	if payload.get("type") == "event_callback":
+		slack.handle_event(payload.get("event", {}), get_thread=get_thread)
+
+	return web.Response(status=200)
@@ -0,0 +1,129 @@
+# Where threads come from. Each Provider recognizes links to posts on its
+# service, and resolves the thread ending at one into a tweetbox.Thread, so
+# that threads from any source are rendered the same way (see render and
+# api_server). Twitter is the original source, and the only one that's
+# stored, searched, and streamed; the others are resolved on demand.
+#
+# A thread's ref is a provider's own name for its tail: a tweet id for
+# twitter, instance/status id for Mastodon, or actor/record key for Bluesky.
+
+import abc
+
+from bobbin import bluesky, mastodon, permalinks
+from bobbin.tweet_url import parse_tweet_id
+
+
+class Provider(abc.ABC):
+	# A short name for the provider, for urls and the API
+	name = None
+
+	@abc.abstractmethod
+	def parse_url(self, text):
+		'''
+		Get the ref of the post text links to, or None if it isn't a link to
+		one of this provider's posts
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_thread(self, *, ref):
+		'''
+		Get the Thread ending at the post ref
+		'''
+		raise NotImplementedError()
+
+
+class TwitterProvider(Provider):
+	'''
+	Twitter threads, resolved with get_thread (from
+	tweetbox.make_thread_getter)
+	'''
+	name = "twitter"
+
+	def __init__(self, get_thread):
+		self._get_thread = get_thread
+
+	def parse_url(self, text):
+		return parse_tweet_id(text)
+
+	async def get_thread(self, *, ref):
+		return await self._get_thread(tail=ref, head=None)
+
+
+class MastodonProvider(Provider):
+	'''
+	Threads on any Mastodon instance, fetched with session, which should only
+	connect to public addresses (see mastodon)
+	'''
+	name = "mastodon"
+
+	def __init__(self, session, *, timeout=10):
+		self.session = session
+		self.timeout = timeout
+
+	def parse_url(self, text):
+		status = mastodon.parse_status_url(text)
+		return "/".join(status) if status is not None else None
+
+	async def get_thread(self, *, ref):
+		instance, status_id = ref.split("/")
+		return await mastodon.get_thread(
+			session=self.session,
+			instance=instance,
+			tail=status_id,
+			timeout=self.timeout,
+		)
+
+
+class BlueskyProvider(Provider):
+	'''
+	Bluesky threads, read from the public AppView at appview with session
+	'''
+	name = "bluesky"
+
+	def __init__(self, session, *, appview=bluesky.DEFAULT_APPVIEW, timeout=10):
+		self.session = session
+		self.appview = appview
+		self.timeout = timeout
+
+	def parse_url(self, text):
+		post = bluesky.parse_post_url(text)
+		return "/".join(post) if post is not None else None
+
+	async def get_thread(self, *, ref):
+		actor, rkey = ref.split("/")
+		return await bluesky.get_thread(
+			session=self.session,
+			actor=actor,
+			rkey=rkey,
+			appview=self.appview,
+			timeout=self.timeout,
+		)
+
+
+def find_provider(providers, text):
+	'''
+	Find the provider that text links to a post of. Returns (provider, ref),
+	or None if none of them recognize it.
+	'''
+	for provider in providers:
+		ref = provider.parse_url(text)
+		if ref is not None:
+			return provider, ref
+
+	return None
+
+
+def get_provider(providers, name):
+	return next((provider for provider in providers if provider.name == name), None)
+
+
+def thread_path(provider, ref, thread):
+	'''
+	Get the path of a thread's page on the site. Twitter threads have their
+	permalinks; others are served at /source/<provider>/<ref>.
+	'''
+	if isinstance(provider, TwitterProvider):
+		return permalinks.thread_permalink(thread)
+
+	return f"/source/{provider.name}/{ref}"
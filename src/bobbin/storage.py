@@ -0,0 +1,1156 @@
+# Persistent storage for resolved threads. Unlike the tweet cache, which is
+# volatile and only stores individual tweets, a ThreadStore keeps whole
+# threads around indefinitely, so that they survive restarts and remain
+# viewable after their tweets are deleted.
+
+from collections import namedtuple
+from datetime import datetime, timedelta, timezone
+from pickle import loads as pickle_load
+import abc
+import asyncio
+import html
+import json
+import logging
+import re
+import sqlite3
+import threading
+
+from bobbin.api_keys import ApiKey
+from bobbin.follows import FollowedThread
+from bobbin.revisions import Revision, ThreadChanges, diff_threads
+from bobbin.tweet_json import tweet_from_json, tweet_to_json
+from bobbin.tweetbox import Thread
+
+logger = logging.getLogger(__name__)
+
+
+class SearchUnavailableError(Exception):
+	pass
+
+
+class SearchResult(namedtuple("SearchResult", "tail_id head_id author_id handle name tweet_count created_at resolved_at snippet")):
+	'''
+	A stored thread matching a search. created_at is when the thread's first
+	tweet was posted, and snippet is an excerpt of the thread's text around
+	the match. The author fields are None for conversations.
+	'''
+	__slots__ = ()
+
+	def json(self):
+		return {
+			"tail": self.tail_id,
+			"head": self.head_id,
+			"author": {
+				"id": self.author_id,
+				"handle": self.handle,
+				"name": self.name,
+			} if self.author_id is not None else None,
+			"tweet_count": self.tweet_count,
+			"created_at": self.created_at.isoformat(),
+			"resolved_at": self.resolved_at.isoformat(),
+			"snippet": self.snippet,
+		}
+
+
+class ThreadSummary(namedtuple("ThreadSummary", "tail_id first_tweet tweet_count resolved_at views")):
+	'''
+	A stored thread, without all of its tweets: just the first, for a title
+	and date, and how many there are. views is how many times its page has
+	been viewed (see record_view).
+	'''
+	__slots__ = ()
+
+	@property
+	def head_id(self):
+		return self.first_tweet.id
+
+
+class ThreadStore(abc.ABC):
+	@abc.abstractmethod
+	async def save_thread(self, thread, *, resolved_at=None):
+		'''
+		Save a Thread. Any existing thread with the same tail is replaced.
+		resolved_at defaults to the time the thread was fetched. Gaps in the
+		thread aren't stored. If there's an earlier copy of the thread (with
+		the same tail or head), and the thread has changed since, a Revision
+		is recorded.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_thread(self, *, tail, head=None):
+		'''
+		Get the stored Thread ending at tail. If head is given, the thread is
+		cut to start at head. Returns None if there is no such thread.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_resolved_at(self, *, tail):
+		'''
+		Get the time the thread ending at tail was last saved, or None
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_author_threads(self, *, handle, limit=20):
+		'''
+		Get the most recently resolved Threads by the author with the given
+		handle (case insensitive), newest first
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def list_author_threads(self, *, handle, offset=0, limit=20):
+		'''
+		List the stored threads by the author with the given handle (case
+		insensitive), most recently started first. Returns the total number
+		of threads by the author, and the ThreadSummaries for the ones from
+		offset to offset + limit.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def record_view(self, *, tail, viewed_at=None):
+		'''
+		Count a view of the stored thread ending at tail, at viewed_at (which
+		defaults to now). Views are counted in total, and by the hour. Views
+		of threads that aren't stored are ignored.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_view_counts(self, *, since):
+		'''
+		Get the views of each thread in each hour since since, as a list of
+		(tail id, start of the hour, views)
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def prune_view_counts(self, *, before):
+		'''
+		Forget the hourly view counts from before before. Total views are
+		kept.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def set_thread_views(self, *, tail, views, hours):
+		'''
+		Replace the view counts of the stored thread ending at tail: views in
+		total, and hours, a list of (start of the hour, views). This is for
+		restoring them from an archive; see archive.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_revisions(self, *, tail, limit=50):
+		'''
+		Get the most recent Revisions of the thread ending at tail, newest
+		first, including ones recorded under its earlier tails
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def add_follow(self, follow):
+		'''
+		Save a follows.Follow, and start tracking its thread if it isn't
+		already
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def remove_follow(self, id_hash):
+		'''
+		Remove the follow with the given id hash. Threads with no followers
+		left stop being tracked. Returns whether there was such a follow.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_followed_threads(self, *, checked_before, limit):
+		'''
+		Get up to limit FollowedThreads that haven't been checked since
+		checked_before, least recently checked (or never checked) first
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def set_followed_tail(self, *, head, tail, checked_at):
+		'''
+		Record that the followed thread starting at head was checked at
+		checked_at, and ends at tail
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_thread_summaries(self, *, tails):
+		'''
+		Get the ThreadSummaries of the stored threads ending at tails, in the
+		same order. Threads that aren't stored are left out.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def list_recent_threads(self, *, limit=10, exclude_ids=(), exclude_handles=()):
+		'''
+		List the ThreadSummaries of the most recently resolved threads, newest
+		first, except those by the authors in exclude_ids or exclude_handles
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def list_popular_threads(self, *, limit=10, exclude_ids=(), exclude_handles=()):
+		'''
+		List the ThreadSummaries of the most viewed threads, most viewed
+		first, like list_recent_threads
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def search_threads(
+		self, *,
+		query,
+		author=None,
+		since=None,
+		until=None,
+		exclude_ids=(),
+		exclude_handles=(),
+		offset=0,
+		limit=20,
+	):
+		'''
+		Search the text of the stored threads, for threads with all the words
+		in query, best matches first. author is a handle (case insensitive),
+		and since and until are dates (inclusive) that the thread must have
+		started between. Threads by the authors in exclude_ids or
+		exclude_handles are left out. Returns the total number of matches and
+		a list of SearchResults for the ones from offset to offset + limit.
+		Raises SearchUnavailableError if the store can't search.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def delete_thread(self, *, tail):
+		'''
+		Delete the stored thread ending at tail, along with any of its tweets
+		that aren't part of other stored threads. Returns the ids of the
+		deleted thread's tweets, which are empty if there was no such thread.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def delete_author_threads(self, *, handle):
+		'''
+		Delete all the stored threads by the author with the given handle (case
+		insensitive). Returns a dict of the deleted threads' tail ids to the
+		ids of their tweets.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def count_threads(self):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def list_threads(self, *, offset=0, limit=1000):
+		'''
+		List the stored threads, as (tail id, resolved at) pairs, in a stable
+		order, for paging through all of them
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_opt_outs(self):
+		'''
+		Get the opt-out entries (see bobbin.optout) saved with add_opt_out
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def add_opt_out(self, entry):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def remove_opt_out(self, entry):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_api_keys(self):
+		'''
+		Get all the api_keys.ApiKeys, including revoked ones
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def add_api_key(self, key):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def revoke_api_key(self, key_id, *, revoked_at):
+		raise NotImplementedError()
+
+	def close(self):
+		pass
+
+
+SCHEMA = '''
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY,
+	handle TEXT NOT NULL,
+	name TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tweets (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	parent_id TEXT,
+	created_at TEXT NOT NULL,
+	text TEXT NOT NULL,
+	media_count INTEGER NOT NULL,
+	json TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS media (
+	tweet_id TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	media_url TEXT,
+	width INTEGER,
+	height INTEGER,
+	alt_text TEXT,
+	PRIMARY KEY (tweet_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS threads (
+	tail_id TEXT PRIMARY KEY,
+	head_id TEXT NOT NULL,
+	author_id TEXT,
+	tweet_count INTEGER NOT NULL,
+	resolved_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS thread_tweets (
+	tail_id TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	tweet_id TEXT NOT NULL,
+	PRIMARY KEY (tail_id, position)
+);
+
+CREATE INDEX IF NOT EXISTS threads_by_author ON threads(author_id, resolved_at);
+
+CREATE INDEX IF NOT EXISTS threads_by_resolved_at ON threads(resolved_at);
+
+CREATE TABLE IF NOT EXISTS thread_views (
+	tail_id TEXT PRIMARY KEY,
+	views INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS thread_views_by_views ON thread_views(views);
+
+CREATE TABLE IF NOT EXISTS thread_view_hours (
+	tail_id TEXT NOT NULL,
+	hour TEXT NOT NULL,
+	views INTEGER NOT NULL,
+	PRIMARY KEY (tail_id, hour)
+);
+
+CREATE INDEX IF NOT EXISTS thread_view_hours_by_hour ON thread_view_hours(hour);
+
+CREATE TABLE IF NOT EXISTS thread_revisions (
+	head_id TEXT NOT NULL,
+	tail_id TEXT NOT NULL,
+	recorded_at TEXT NOT NULL,
+	changes TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS thread_revisions_by_head ON thread_revisions(head_id, recorded_at);
+
+CREATE INDEX IF NOT EXISTS thread_revisions_by_tail ON thread_revisions(tail_id, recorded_at);
+
+CREATE TABLE IF NOT EXISTS thread_follows (
+	id_hash TEXT PRIMARY KEY,
+	head_id TEXT NOT NULL,
+	callback_url TEXT,
+	created_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS thread_follows_by_head ON thread_follows(head_id);
+
+CREATE TABLE IF NOT EXISTS followed_threads (
+	head_id TEXT PRIMARY KEY,
+	tail_id TEXT NOT NULL,
+	checked_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS followed_threads_by_checked_at ON followed_threads(checked_at);
+
+CREATE TABLE IF NOT EXISTS opt_outs (
+	entry TEXT PRIMARY KEY,
+	added_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	key_hash TEXT NOT NULL UNIQUE,
+	name TEXT NOT NULL,
+	daily_quota INTEGER,
+	created_at TEXT NOT NULL,
+	revoked_at TEXT
+);
+'''
+
+# The search index is separate, since not every sqlite is built with FTS5.
+# Each row is the (unescaped) text of a whole thread.
+SEARCH_SCHEMA = '''
+CREATE VIRTUAL TABLE IF NOT EXISTS thread_search USING fts5(
+	tail_id UNINDEXED,
+	text,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+'''
+
+SEARCH_WORD_PATTERN = re.compile(r"\w+")
+
+
+def search_terms(query):
+	'''
+	Turn a user's search into an FTS5 query for all of its words. Each word
+	is quoted, so that nothing the user types is taken as FTS5 syntax.
+	'''
+	return " ".join(f'"{word}"' for word in SEARCH_WORD_PATTERN.findall(query))
+
+
+def thread_text(tweets):
+	return "\n".join(html.unescape(tweet.text) for tweet in tweets)
+
+
+def exclusion_conditions(exclude_ids, exclude_handles):
+	'''
+	Get the SQL conditions, and their parameters, for leaving out threads by
+	the given authors. They need threads and users (left) joined.
+	'''
+	conditions = []
+	params = []
+
+	if exclude_ids:
+		conditions.append("coalesce(threads.author_id, '') NOT IN ({})".format(", ".join("?" * len(exclude_ids))))
+		params.extend(exclude_ids)
+
+	if exclude_handles:
+		conditions.append("lower(coalesce(users.handle, '')) NOT IN ({})".format(", ".join("?" * len(exclude_handles))))
+		params.extend(handle.lower() for handle in exclude_handles)
+
+	return conditions, params
+
+
+# The columns for a ThreadSummary, from threads, tweets (the head tweet), and
+# thread_views (left) joined
+SUMMARY_COLUMNS = "threads.tail_id, tweets.json, threads.tweet_count, threads.resolved_at, coalesce(thread_views.views, 0)"
+
+
+def summary_from_row(row):
+	tail_id, tweet_json, tweet_count, resolved_at, views = row
+	return ThreadSummary(
+		tail_id=tail_id,
+		first_tweet=tweet_from_json(json.loads(tweet_json)),
+		tweet_count=tweet_count,
+		resolved_at=datetime.fromisoformat(resolved_at),
+		views=views,
+	)
+
+
+def changes_from_json(text):
+	blob = json.loads(text)
+	return ThreadChanges(
+		tuple(blob["added"]),
+		tuple(blob["deleted"]),
+		tuple(tuple(pair) for pair in blob["edited"]),
+	)
+
+
+class SqliteThreadStore(ThreadStore):
+	'''
+	ThreadStore backed by a sqlite database. sqlite is blocking, so all
+	operations run in the loop's default executor, serialized by a lock.
+	Tweets are stored as JSON (see tweet_json), alongside the columns needed
+	to query them, and their media's in the media table.
+	'''
+	def __init__(self, path, *, loop=None):
+		self.loop = loop
+		self.lock = threading.Lock()
+		self.db = sqlite3.connect(str(path), check_same_thread=False)
+		self._create_schema()
+
+		try:
+			self.db.executescript(SEARCH_SCHEMA)
+		except sqlite3.OperationalError as e:
+			logger.warning("Thread search is disabled: %s", e)
+			self.searchable = False
+		else:
+			self.searchable = True
+			self._index_unindexed_threads()
+
+	def _create_schema(self):
+		'''
+		Create the tables, converting tweets stored by older versions, which
+		pickled them, to JSON. Their table is renamed out of the way first, so
+		that a conversion that's interrupted is finished the next time.
+		'''
+		columns = [column for (_, column, *_) in self.db.execute("PRAGMA table_info(tweets)")]
+		if "data" in columns:
+			self.db.execute("ALTER TABLE tweets RENAME TO pickled_tweets")
+
+		self.db.executescript(SCHEMA)
+
+		pickled = self.db.execute(
+			"SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'pickled_tweets'"
+		).fetchone()
+		if pickled is None:
+			return
+
+		tweets = [pickle_load(data) for (data,) in self.db.execute("SELECT data FROM pickled_tweets")]
+		logger.info("Converting %d stored tweets to JSON", len(tweets))
+
+		with self.db:
+			self._insert_tweets(tweets)
+			self.db.execute("DROP TABLE pickled_tweets")
+
+	def _index_unindexed_threads(self):
+		'''
+		Add any threads saved before there was a search index to it
+		'''
+		tails = [tail for (tail,) in self.db.execute(
+			"SELECT tail_id FROM threads "
+			"WHERE tail_id NOT IN (SELECT tail_id FROM thread_search)"
+		)]
+
+		if tails:
+			logger.info("Indexing %d threads for search", len(tails))
+
+		with self.db:
+			for tail in tails:
+				self.db.execute(
+					"INSERT INTO thread_search (tail_id, text) VALUES (?, ?)",
+					(tail, thread_text(self._get_thread(tail))),
+				)
+
+	def _run(self, func, *args):
+		def locked():
+			with self.lock:
+				return func(*args)
+
+		loop = self.loop if self.loop is not None else asyncio.get_event_loop()
+		return loop.run_in_executor(None, locked)
+
+	def _get_previous_copy(self, thread):
+		'''
+		Get the most recently resolved stored copy of thread: the one with the
+		same tail, if there is one, or else the same head
+		'''
+		row = self.db.execute(
+			"SELECT tail_id FROM threads WHERE tail_id = ? OR head_id = ? "
+			"ORDER BY tail_id = ? DESC, resolved_at DESC LIMIT 1",
+			(thread[-1].id, thread[0].id, thread[-1].id),
+		).fetchone()
+
+		return self._get_thread(row[0]) if row is not None else None
+
+	def _record_revision(self, thread, previous, resolved_at):
+		if previous is None or previous.fetched_at >= resolved_at:
+			return
+
+		changes = diff_threads(previous, thread)
+		if changes.empty:
+			return
+
+		self.db.execute(
+			"INSERT INTO thread_revisions (head_id, tail_id, recorded_at, changes) "
+			"VALUES (?, ?, ?, ?)",
+			(thread[0].id, thread[-1].id, resolved_at.isoformat(), json.dumps(changes._asdict())),
+		)
+
+	def _insert_tweets(self, tweets):
+		self.db.executemany(
+			"INSERT OR REPLACE INTO tweets "
+			"(id, user_id, parent_id, created_at, text, media_count, json) "
+			"VALUES (?, ?, ?, ?, ?, ?, ?)",
+			[(
+				tweet.id,
+				tweet.user.id,
+				tweet.parent_id,
+				tweet.created_at.isoformat(),
+				tweet.text,
+				len(tweet.entities.media),
+				json.dumps(tweet_to_json(tweet), separators=(",", ":")),
+			) for tweet in tweets],
+		)
+		self.db.executemany("DELETE FROM media WHERE tweet_id = ?", [(tweet.id,) for tweet in tweets])
+		self.db.executemany(
+			"INSERT INTO media (tweet_id, position, type, media_url, width, height, alt_text) "
+			"VALUES (?, ?, ?, ?, ?, ?, ?)",
+			[
+				(tweet.id, position, media.type, media.media_url, media.width, media.height, media.alt_text)
+				for tweet in tweets
+				for position, media in enumerate(tweet.entities.media)
+			],
+		)
+
+	def _save_thread(self, thread, resolved_at):
+		author = thread.author
+		previous = self._get_previous_copy(thread)
+
+		with self.db:
+			self._record_revision(thread, previous, resolved_at)
+			self.db.executemany(
+				"INSERT OR REPLACE INTO users (id, handle, name) VALUES (?, ?, ?)",
+				{(tweet.user.id, tweet.user.handle, tweet.user.name) for tweet in thread},
+			)
+			self._insert_tweets(thread)
+			self.db.execute("DELETE FROM threads WHERE tail_id = ?", (thread[-1].id,))
+			self.db.execute("DELETE FROM thread_tweets WHERE tail_id = ?", (thread[-1].id,))
+			self.db.execute(
+				"INSERT INTO threads (tail_id, head_id, author_id, tweet_count, resolved_at) "
+				"VALUES (?, ?, ?, ?, ?)",
+				(
+					thread[-1].id,
+					thread[0].id,
+					author.id if author is not None else None,
+					len(thread),
+					resolved_at.isoformat(),
+				),
+			)
+			self.db.executemany(
+				"INSERT INTO thread_tweets (tail_id, position, tweet_id) VALUES (?, ?, ?)",
+				[(thread[-1].id, position, tweet.id) for position, tweet in enumerate(thread)],
+			)
+
+			if self.searchable:
+				self.db.execute("DELETE FROM thread_search WHERE tail_id = ?", (thread[-1].id,))
+				self.db.execute(
+					"INSERT INTO thread_search (tail_id, text) VALUES (?, ?)",
+					(thread[-1].id, thread_text(thread)),
+				)
+
+	async def save_thread(self, thread, *, resolved_at=None):
+		if not thread:
+			return
+
+		if resolved_at is None:
+			resolved_at = thread.fetched_at
+
+		await self._run(self._save_thread, thread, resolved_at)
+
+	def _get_thread(self, tail):
+		resolved_at = self._get_resolved_at(tail)
+		if resolved_at is None:
+			return None
+
+		return Thread([tweet_from_json(json.loads(tweet_json)) for (tweet_json,) in self.db.execute(
+			"SELECT tweets.json FROM thread_tweets "
+			"JOIN tweets ON tweets.id = thread_tweets.tweet_id "
+			"WHERE thread_tweets.tail_id = ? "
+			"ORDER BY thread_tweets.position",
+			(tail,),
+		)], fetched_at=resolved_at)
+
+	async def get_thread(self, *, tail, head=None):
+		thread = await self._run(self._get_thread, tail)
+
+		if thread is None:
+			return None
+
+		if head is not None:
+			try:
+				return thread.slice(thread.index(head))
+			except ValueError:
+				return None
+
+		return thread
+
+	def _get_resolved_at(self, tail):
+		row = self.db.execute(
+			"SELECT resolved_at FROM threads WHERE tail_id = ?",
+			(tail,),
+		).fetchone()
+
+		return datetime.fromisoformat(row[0]) if row is not None else None
+
+	async def get_resolved_at(self, *, tail):
+		return await self._run(self._get_resolved_at, tail)
+
+	def _get_author_threads(self, handle, limit):
+		tails = [tail for (tail,) in self.db.execute(
+			"SELECT threads.tail_id FROM threads "
+			"JOIN users ON users.id = threads.author_id "
+			"WHERE users.handle = ? COLLATE NOCASE "
+			# Threads that have grown since are left out, for the newer copy
+			"AND NOT EXISTS (SELECT 1 FROM threads AS newer "
+			"JOIN thread_tweets ON thread_tweets.tail_id = newer.tail_id "
+			"WHERE newer.head_id = threads.head_id AND newer.tail_id != threads.tail_id "
+			"AND thread_tweets.tweet_id = threads.tail_id) "
+			"ORDER BY threads.resolved_at DESC "
+			"LIMIT ?",
+			(handle, limit),
+		)]
+
+		threads = (self._get_thread(tail) for tail in tails)
+		return [thread for thread in threads if thread is not None]
+
+	async def get_author_threads(self, *, handle, limit=20):
+		return await self._run(self._get_author_threads, handle, limit)
+
+	def _list_author_threads(self, handle, offset, limit):
+		total = self.db.execute(
+			"SELECT COUNT(*) FROM threads "
+			"JOIN users ON users.id = threads.author_id "
+			"WHERE users.handle = ? COLLATE NOCASE",
+			(handle,),
+		).fetchone()[0]
+
+		rows = self.db.execute(
+			"SELECT " + SUMMARY_COLUMNS + " FROM threads "
+			"JOIN users ON users.id = threads.author_id "
+			"JOIN tweets ON tweets.id = threads.head_id "
+			"LEFT JOIN thread_views ON thread_views.tail_id = threads.tail_id "
+			"WHERE users.handle = ? COLLATE NOCASE "
+			"ORDER BY tweets.created_at DESC, threads.tail_id DESC "
+			"LIMIT ? OFFSET ?",
+			(handle, limit, offset),
+		)
+
+		return total, [summary_from_row(row) for row in rows]
+
+	async def list_author_threads(self, *, handle, offset=0, limit=20):
+		return await self._run(self._list_author_threads, handle, offset, limit)
+
+	def _record_view(self, tail, viewed_at):
+		hour = viewed_at.astimezone(timezone.utc).replace(minute=0, second=0, microsecond=0).isoformat()
+
+		with self.db:
+			self.db.execute(
+				"INSERT OR IGNORE INTO thread_views (tail_id, views) "
+				"SELECT tail_id, 0 FROM threads WHERE tail_id = ?",
+				(tail,),
+			)
+			self.db.execute("UPDATE thread_views SET views = views + 1 WHERE tail_id = ?", (tail,))
+
+			self.db.execute(
+				"INSERT OR IGNORE INTO thread_view_hours (tail_id, hour, views) "
+				"SELECT tail_id, ?, 0 FROM threads WHERE tail_id = ?",
+				(hour, tail),
+			)
+			self.db.execute(
+				"UPDATE thread_view_hours SET views = views + 1 WHERE tail_id = ? AND hour = ?",
+				(tail, hour),
+			)
+
+	async def record_view(self, *, tail, viewed_at=None):
+		if viewed_at is None:
+			viewed_at = datetime.now(timezone.utc)
+
+		await self._run(self._record_view, tail, viewed_at)
+
+	def _get_view_counts(self, since):
+		return [(tail, datetime.fromisoformat(hour), views) for tail, hour, views in self.db.execute(
+			"SELECT tail_id, hour, views FROM thread_view_hours WHERE hour >= ?",
+			(since.astimezone(timezone.utc).isoformat(),),
+		)]
+
+	async def get_view_counts(self, *, since):
+		return await self._run(self._get_view_counts, since)
+
+	def _prune_view_counts(self, before):
+		with self.db:
+			self.db.execute(
+				"DELETE FROM thread_view_hours WHERE hour < ?",
+				(before.astimezone(timezone.utc).isoformat(),),
+			)
+
+	async def prune_view_counts(self, *, before):
+		await self._run(self._prune_view_counts, before)
+
+	def _set_thread_views(self, tail, views, hours):
+		with self.db:
+			self.db.execute("DELETE FROM thread_views WHERE tail_id = ?", (tail,))
+			self.db.execute("DELETE FROM thread_view_hours WHERE tail_id = ?", (tail,))
+
+			self.db.execute(
+				"INSERT INTO thread_views (tail_id, views) "
+				"SELECT tail_id, ? FROM threads WHERE tail_id = ?",
+				(views, tail),
+			)
+			self.db.executemany(
+				"INSERT INTO thread_view_hours (tail_id, hour, views) "
+				"SELECT tail_id, ?, ? FROM threads WHERE tail_id = ?",
+				[(
+					hour.astimezone(timezone.utc).isoformat(),
+					hour_views,
+					tail,
+				) for hour, hour_views in hours],
+			)
+
+	async def set_thread_views(self, *, tail, views, hours):
+		await self._run(self._set_thread_views, tail, views, hours)
+
+	def _get_revisions(self, tail, limit):
+		# Revisions recorded under earlier tails share the thread's head
+		row = self.db.execute("SELECT head_id FROM threads WHERE tail_id = ?", (tail,)).fetchone()
+		head = row[0] if row is not None else None
+
+		return [
+			Revision(
+				revision_tail,
+				datetime.fromisoformat(recorded_at),
+				changes_from_json(changes),
+			)
+			for revision_tail, recorded_at, changes in self.db.execute(
+				"SELECT tail_id, recorded_at, changes FROM thread_revisions "
+				"WHERE tail_id = ? OR head_id = ? "
+				"ORDER BY recorded_at DESC LIMIT ?",
+				(tail, head, limit),
+			)
+		]
+
+	async def get_revisions(self, *, tail, limit=50):
+		return await self._run(self._get_revisions, tail, limit)
+
+	def _add_follow(self, follow):
+		with self.db:
+			self.db.execute(
+				"INSERT INTO thread_follows (id_hash, head_id, callback_url, created_at) "
+				"VALUES (?, ?, ?, ?)",
+				(follow.id_hash, follow.head_id, follow.callback_url, follow.created_at.isoformat()),
+			)
+			self.db.execute(
+				"INSERT OR IGNORE INTO followed_threads (head_id, tail_id) VALUES (?, ?)",
+				(follow.head_id, follow.tail_id),
+			)
+
+	async def add_follow(self, follow):
+		await self._run(self._add_follow, follow)
+
+	def _remove_follow(self, id_hash):
+		with self.db:
+			removed = self.db.execute(
+				"DELETE FROM thread_follows WHERE id_hash = ?",
+				(id_hash,),
+			).rowcount
+			self.db.execute(
+				"DELETE FROM followed_threads "
+				"WHERE head_id NOT IN (SELECT head_id FROM thread_follows)"
+			)
+
+		return removed > 0
+
+	async def remove_follow(self, id_hash):
+		return await self._run(self._remove_follow, id_hash)
+
+	def _get_followed_threads(self, checked_before, limit):
+		rows = self.db.execute(
+			"SELECT head_id, tail_id, checked_at FROM followed_threads "
+			"WHERE checked_at IS NULL OR checked_at < ? "
+			"ORDER BY checked_at IS NOT NULL, checked_at LIMIT ?",
+			(checked_before.isoformat(), limit),
+		).fetchall()
+
+		return [
+			FollowedThread(
+				head,
+				tail,
+				datetime.fromisoformat(checked_at) if checked_at is not None else None,
+				tuple(url for (url,) in self.db.execute(
+					"SELECT callback_url FROM thread_follows "
+					"WHERE head_id = ? AND callback_url IS NOT NULL",
+					(head,),
+				)),
+			)
+			for head, tail, checked_at in rows
+		]
+
+	async def get_followed_threads(self, *, checked_before, limit):
+		return await self._run(self._get_followed_threads, checked_before, limit)
+
+	def _set_followed_tail(self, head, tail, checked_at):
+		with self.db:
+			self.db.execute(
+				"UPDATE followed_threads SET tail_id = ?, checked_at = ? WHERE head_id = ?",
+				(tail, checked_at.isoformat(), head),
+			)
+
+	async def set_followed_tail(self, *, head, tail, checked_at):
+		await self._run(self._set_followed_tail, head, tail, checked_at)
+
+	def _get_thread_summaries(self, tails):
+		summaries = []
+
+		for tail in tails:
+			row = self.db.execute(
+				"SELECT " + SUMMARY_COLUMNS + " FROM threads "
+				"JOIN tweets ON tweets.id = threads.head_id "
+				"LEFT JOIN thread_views ON thread_views.tail_id = threads.tail_id "
+				"WHERE threads.tail_id = ?",
+				(tail,),
+			).fetchone()
+
+			if row is not None:
+				summaries.append(summary_from_row(row))
+
+		return summaries
+
+	async def get_thread_summaries(self, *, tails):
+		return await self._run(self._get_thread_summaries, list(tails))
+
+	def _list_summaries(self, order, extra_join, limit, exclude_ids, exclude_handles):
+		conditions, params = exclusion_conditions(exclude_ids, exclude_handles)
+
+		rows = self.db.execute(
+			"SELECT " + SUMMARY_COLUMNS + " FROM threads "
+			"JOIN tweets ON tweets.id = threads.head_id "
+			"LEFT JOIN users ON users.id = threads.author_id " +
+			extra_join +
+			("WHERE " + " AND ".join(conditions) + " " if conditions else "") +
+			"ORDER BY " + order + " "
+			"LIMIT ?",
+			params + [limit],
+		)
+
+		return [summary_from_row(row) for row in rows]
+
+	async def list_recent_threads(self, *, limit=10, exclude_ids=(), exclude_handles=()):
+		return await self._run(
+			self._list_summaries,
+			"threads.resolved_at DESC",
+			"LEFT JOIN thread_views ON thread_views.tail_id = threads.tail_id ",
+			limit, exclude_ids, exclude_handles,
+		)
+
+	async def list_popular_threads(self, *, limit=10, exclude_ids=(), exclude_handles=()):
+		# Threads without views don't count as popular
+		return await self._run(
+			self._list_summaries,
+			"thread_views.views DESC, threads.resolved_at DESC",
+			"JOIN thread_views ON thread_views.tail_id = threads.tail_id ",
+			limit, exclude_ids, exclude_handles,
+		)
+
+	def _search_threads(self, query, author, since, until, exclude_ids, exclude_handles, offset, limit):
+		if not self.searchable:
+			raise SearchUnavailableError()
+
+		terms = search_terms(query)
+		if not terms:
+			return 0, []
+
+		conditions = ["thread_search MATCH ?"]
+		params = [terms]
+
+		if author is not None:
+			conditions.append("users.handle = ? COLLATE NOCASE")
+			params.append(author)
+
+		# created_at is an ISO timestamp in UTC, so it sorts with dates
+		if since is not None:
+			conditions.append("tweets.created_at >= ?")
+			params.append(since.isoformat())
+
+		if until is not None:
+			conditions.append("tweets.created_at < ?")
+			params.append((until + timedelta(days=1)).isoformat())
+
+		excluded, excluded_params = exclusion_conditions(exclude_ids, exclude_handles)
+		conditions.extend(excluded)
+		params.extend(excluded_params)
+
+		tables = (
+			"FROM thread_search "
+			"JOIN threads ON threads.tail_id = thread_search.tail_id "
+			"JOIN tweets ON tweets.id = threads.head_id "
+			"LEFT JOIN users ON users.id = threads.author_id "
+		)
+		where = "WHERE " + " AND ".join(conditions) + " "
+
+		total = self.db.execute("SELECT COUNT(*) " + tables + where, params).fetchone()[0]
+
+		rows = self.db.execute(
+			"SELECT threads.tail_id, threads.head_id, threads.author_id, users.handle, users.name, "
+			"threads.tweet_count, tweets.created_at, threads.resolved_at, "
+			"snippet(thread_search, 1, '', '', '…', 24) " +
+			tables + where +
+			"ORDER BY rank "
+			"LIMIT ? OFFSET ?",
+			params + [limit, offset],
+		)
+
+		return total, [
+			SearchResult(
+				tail_id=tail_id,
+				head_id=head_id,
+				author_id=author_id,
+				handle=handle,
+				name=name,
+				tweet_count=tweet_count,
+				created_at=datetime.fromisoformat(created_at),
+				resolved_at=datetime.fromisoformat(resolved_at),
+				snippet=snippet,
+			)
+			for tail_id, head_id, author_id, handle, name, tweet_count, created_at, resolved_at, snippet in rows
+		]
+
+	async def search_threads(
+		self, *,
+		query,
+		author=None,
+		since=None,
+		until=None,
+		exclude_ids=(),
+		exclude_handles=(),
+		offset=0,
+		limit=20,
+	):
+		return await self._run(
+			self._search_threads,
+			query, author, since, until, exclude_ids, exclude_handles, offset, limit,
+		)
+
+	def _delete_threads(self, tails):
+		deleted = {}
+
+		with self.db:
+			for tail in tails:
+				deleted[tail] = [tweet_id for (tweet_id,) in self.db.execute(
+					"SELECT tweet_id FROM thread_tweets WHERE tail_id = ? ORDER BY position",
+					(tail,),
+				)]
+				self.db.execute(
+					"DELETE FROM thread_revisions WHERE tail_id = ? "
+					"OR head_id IN (SELECT head_id FROM threads WHERE tail_id = ?)",
+					(tail, tail),
+				)
+				for table in ("thread_follows", "followed_threads"):
+					self.db.execute(
+						f"DELETE FROM {table} WHERE head_id IN (SELECT head_id FROM threads WHERE tail_id = ?)",
+						(tail,),
+					)
+				self.db.execute("DELETE FROM thread_tweets WHERE tail_id = ?", (tail,))
+				self.db.execute("DELETE FROM threads WHERE tail_id = ?", (tail,))
+				self.db.execute("DELETE FROM thread_views WHERE tail_id = ?", (tail,))
+				self.db.execute("DELETE FROM thread_view_hours WHERE tail_id = ?", (tail,))
+				if self.searchable:
+					self.db.execute("DELETE FROM thread_search WHERE tail_id = ?", (tail,))
+
+			self.db.execute(
+				"DELETE FROM tweets WHERE id NOT IN (SELECT tweet_id FROM thread_tweets)"
+			)
+			self.db.execute(
+				"DELETE FROM media WHERE tweet_id NOT IN (SELECT id FROM tweets)"
+			)
+
+		return deleted
+
+	async def delete_thread(self, *, tail):
+		deleted = await self._run(self._delete_threads, [tail])
+		return deleted[tail]
+
+	def _delete_author_threads(self, handle):
+		tails = [tail for (tail,) in self.db.execute(
+			"SELECT threads.tail_id FROM threads "
+			"JOIN users ON users.id = threads.author_id "
+			"WHERE users.handle = ? COLLATE NOCASE",
+			(handle,),
+		)]
+		return self._delete_threads(tails)
+
+	async def delete_author_threads(self, *, handle):
+		return await self._run(self._delete_author_threads, handle)
+
+	def _count_threads(self):
+		return self.db.execute("SELECT COUNT(*) FROM threads").fetchone()[0]
+
+	async def count_threads(self):
+		return await self._run(self._count_threads)
+
+	def _list_threads(self, offset, limit):
+		return [(tail, datetime.fromisoformat(resolved_at)) for tail, resolved_at in self.db.execute(
+			"SELECT tail_id, resolved_at FROM threads "
+			"ORDER BY tail_id "
+			"LIMIT ? OFFSET ?",
+			(limit, offset),
+		)]
+
+	async def list_threads(self, *, offset=0, limit=1000):
+		return await self._run(self._list_threads, offset, limit)
+
+	def _get_opt_outs(self):
+		return [entry for (entry,) in self.db.execute("SELECT entry FROM opt_outs ORDER BY entry")]
+
+	async def get_opt_outs(self):
+		return await self._run(self._get_opt_outs)
+
+	def _add_opt_out(self, entry):
+		with self.db:
+			self.db.execute(
+				"INSERT OR IGNORE INTO opt_outs (entry, added_at) VALUES (?, ?)",
+				(entry, datetime.now(timezone.utc).isoformat()),
+			)
+
+	async def add_opt_out(self, entry):
+		await self._run(self._add_opt_out, entry)
+
+	def _remove_opt_out(self, entry):
+		with self.db:
+			self.db.execute("DELETE FROM opt_outs WHERE entry = ?", (entry,))
+
+	async def remove_opt_out(self, entry):
+		await self._run(self._remove_opt_out, entry)
+
+	def _get_api_keys(self):
+		return [
+			ApiKey(
+				id=key_id,
+				key_hash=key_hash,
+				name=name,
+				daily_quota=daily_quota,
+				created_at=datetime.fromisoformat(created_at),
+				revoked_at=datetime.fromisoformat(revoked_at) if revoked_at is not None else None,
+			)
+			for key_id, key_hash, name, daily_quota, created_at, revoked_at in self.db.execute(
+				"SELECT id, key_hash, name, daily_quota, created_at, revoked_at FROM api_keys"
+			)
+		]
+
+	async def get_api_keys(self):
+		return await self._run(self._get_api_keys)
+
+	def _add_api_key(self, key):
+		with self.db:
+			self.db.execute(
+				"INSERT INTO api_keys (id, key_hash, name, daily_quota, created_at, revoked_at) "
+				"VALUES (?, ?, ?, ?, ?, ?)",
+				(
+					key.id,
+					key.key_hash,
+					key.name,
+					key.daily_quota,
+					key.created_at.isoformat(),
+					key.revoked_at.isoformat() if key.revoked_at is not None else None,
+				),
+			)
+
+	async def add_api_key(self, key):
+		await self._run(self._add_api_key, key)
+
+	def _revoke_api_key(self, key_id, revoked_at):
+		with self.db:
+			self.db.execute(
+				"UPDATE api_keys SET revoked_at = ? WHERE id = ?",
+				(revoked_at.isoformat(), key_id),
+			)
+
+	async def revoke_api_key(self, key_id, *, revoked_at):
+		await self._run(self._revoke_api_key, key_id, revoked_at)
+
+	def close(self):
+		with self.lock:
+			self.db.close()
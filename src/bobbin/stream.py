@@ -0,0 +1,251 @@
+# Ingesting threads as they're written, from the twitter v2 filtered stream.
+# The operator lists authors (stream_authors) and conversations
+# (stream_conversations) to watch; they're turned into stream rules, and each
+# tweet that continues a thread (a reply by its author to themselves) is put
+# in the tweet cache, and its thread resolved and stored right away. By the
+# time readers arrive, the thread is already there.
+#
+# The stream's rules belong to the app, not the connection, so they're synced
+# with the configured ones when the stream starts: rules tagged with RULE_TAG
+# that aren't configured any more are deleted, and any other rules are left
+# alone. Twitter only allows one connection to the stream per app, so with
+# several apps, only the first is used.
+#
+# Dropped connections are retried, with exponential backoff, as twitter asks.
+
+from pickle import dumps as pickle_dump
+import asyncio
+import json
+import logging
+
+import aiohttp
+
+from bobbin import twitter, twitter_v2
+
+logger = logging.getLogger(__name__)
+
+STREAM_URL = f"{twitter_v2.API_URL}/tweets/search/stream"
+RULES_URL = f"{STREAM_URL}/rules"
+
+RULE_TAG = "bobbin"
+
+# Twitter's limit on the length of a rule, for the standard product track
+MAX_RULE_LENGTH = 512
+
+# Twitter sends a blank line every 20 seconds to keep the connection alive;
+# if nothing arrives for this long, the connection is assumed dead
+STALL_TIMEOUT = 60
+
+MIN_BACKOFF = 1
+MAX_BACKOFF = 5 * 60
+
+# Rate limited reconnections start waiting from here
+RATE_LIMIT_BACKOFF = 60
+
+
+class StreamError(Exception):
+	'''
+	Twitter refused a stream request. status is the HTTP status.
+	'''
+	def __init__(self, status, message):
+		super().__init__(f"{status}: {message}")
+		self.status = status
+
+
+def make_rules(*, authors=(), conversations=()):
+	'''
+	Build the rule values that match the tweets of authors (handles or user
+	ids) and of conversations (conversation ids). Clauses are joined into as
+	few rules as fit in MAX_RULE_LENGTH.
+	'''
+	clauses = [f"from:{author.lstrip('@')}" for author in authors]
+	clauses.extend(f"conversation_id:{conversation}" for conversation in conversations)
+
+	rules = []
+	rule = ""
+	for clause in clauses:
+		candidate = f"{rule} OR {clause}" if rule else clause
+		if len(candidate) <= MAX_RULE_LENGTH:
+			rule = candidate
+		else:
+			rules.append(rule)
+			rule = clause
+
+	if rule:
+		rules.append(rule)
+
+	return rules
+
+
+def continues_thread(tweet):
+	return tweet.parent_id is not None and tweet.parent_user_id == tweet.user.id
+
+
+async def authorization(token):
+	'''
+	Get the Authorization header for token, which may be a Token, a
+	TokenPool, or a raw bearer token string
+	'''
+	if isinstance(token, twitter.TokenPool):
+		token = token.tokens[0]
+	if isinstance(token, twitter.Token):
+		return await token.get_token()
+	return token
+
+
+async def request_rules(*, session, token, method="GET", body=None):
+	async with session.request(
+		method,
+		RULES_URL,
+		json=body,
+		headers={"Authorization": await authorization(token)},
+	) as response:
+		result = await response.json(content_type=None)
+		if response.status >= 400:
+			raise StreamError(response.status, result.get("title") or result.get("detail"))
+
+		for error in result.get("errors", ()):
+			logger.warning("Stream rule error: %s", error)
+
+		return result
+
+
+async def sync_rules(*, session, token, rules):
+	'''
+	Make our rules on the stream (those tagged RULE_TAG) the given rule
+	values. Returns the number of rules (added, deleted).
+	'''
+	result = await request_rules(session=session, token=token)
+	existing = {rule["value"]: rule["id"] for rule in result.get("data", ()) if rule.get("tag") == RULE_TAG}
+
+	stale = [rule_id for value, rule_id in existing.items() if value not in rules]
+	missing = [value for value in rules if value not in existing]
+
+	if stale:
+		await request_rules(session=session, token=token, method="POST", body={"delete": {"ids": stale}})
+	if missing:
+		await request_rules(session=session, token=token, method="POST", body={
+			"add": [{"value": value, "tag": RULE_TAG} for value in missing],
+		})
+
+	return len(missing), len(stale)
+
+
+class StreamIngester:
+	'''
+	Follows the filtered stream with session and token, and ingests the
+	tweets matching rules (see make_rules): each is written to cache (the
+	tweet cache, as used by tweetbox), and its thread resolved with
+	get_thread, which should save threads to the store.
+	'''
+	def __init__(self, session, token, get_thread, cache, *, rules):
+		self.session = session
+		self.token = token
+		self.get_thread = get_thread
+		self.cache = cache
+		self.rules = rules
+		self.task = None
+		self.backoff = 0
+
+		# Threads being resolved; a busy author's tweets can arrive faster
+		# than their threads resolve
+		self.pending = set()
+
+	async def ingest(self, tweet):
+		await self.cache.write(tweet.id, pickle_dump(tweet, protocol=4))
+
+		try:
+			thread = await self.get_thread(tail=tweet.id, head=None)
+		except asyncio.CancelledError:
+			raise
+		except Exception:
+			logger.info("Couldn't resolve streamed thread %s", tweet.id, exc_info=True)
+			return
+
+		logger.info("Ingested thread %s (%d tweets) from the stream", thread.tail_id, len(thread))
+
+	def handle_message(self, message):
+		if "data" not in message:
+			for error in message.get("errors", ()):
+				logger.warning("Stream error: %s", error)
+			return
+
+		tweet = twitter_v2.tweet_from_json(message["data"], twitter_v2.Includes.from_result_json(message))
+		if not continues_thread(tweet):
+			return
+
+		task = asyncio.ensure_future(self.ingest(tweet))
+		self.pending.add(task)
+		task.add_done_callback(self.pending.discard)
+
+	async def connect(self):
+		'''
+		Read the stream until the connection drops
+		'''
+		async with self.session.get(
+			STREAM_URL,
+			params=twitter_v2.fields_params(),
+			headers={"Authorization": await authorization(self.token)},
+			timeout=aiohttp.ClientTimeout(total=None, sock_read=STALL_TIMEOUT),
+		) as response:
+			if response.status != 200:
+				try:
+					result = await response.json(content_type=None)
+					message = result.get("title") or result.get("detail")
+				except ValueError:
+					message = response.reason
+				raise StreamError(response.status, message)
+
+			logger.info("Connected to the filtered stream")
+			self.backoff = 0
+			async for line in response.content:
+				# Blank lines just keep the connection alive
+				line = line.strip()
+				if not line:
+					continue
+
+				try:
+					self.handle_message(json.loads(line))
+				except (ValueError, KeyError, TypeError):
+					logger.warning("Couldn't parse stream message: %r", line[:200], exc_info=True)
+
+	async def run(self):
+		try:
+			added, deleted = await sync_rules(session=self.session, token=self.token, rules=self.rules)
+		except asyncio.CancelledError:
+			raise
+		except (StreamError, aiohttp.ClientError, asyncio.TimeoutError, ValueError):
+			# Whatever rules the app already has still apply
+			logger.exception("Couldn't update the stream rules")
+		else:
+			logger.info("Stream rules updated: %d added, %d deleted", added, deleted)
+
+		while True:
+			try:
+				await self.connect()
+			except asyncio.CancelledError:
+				raise
+			except StreamError as e:
+				logger.warning("Filtered stream refused: %s", e)
+				self.backoff = max(self.backoff * 2, RATE_LIMIT_BACKOFF if e.status == 429 else MIN_BACKOFF)
+			except (aiohttp.ClientError, asyncio.TimeoutError) as e:
+				logger.info("Filtered stream disconnected: %r", e)
+				self.backoff = max(self.backoff * 2, MIN_BACKOFF)
+			else:
+				self.backoff = MIN_BACKOFF
+
+			# Backoff is reset once a connection succeeds
+			await asyncio.sleep(min(self.backoff, MAX_BACKOFF))
+
+	def start(self):
+		self.task = asyncio.ensure_future(self.run())
+
+	async def close(self):
+		tasks = list(self.pending)
+		if self.task is not None:
+			tasks.append(self.task)
+			self.task = None
+
+		for task in tasks:
+			task.cancel()
+		await asyncio.gather(*tasks, return_exceptions=True)
@@ -0,0 +1,56 @@
+# Summary statistics about a thread, for showing readers what they're getting
+# into before they start: how long it is, how long it'll take to read, when
+# it was written, how much media and how many links it has, and how much
+# engagement it got.
+
+from collections import namedtuple
+import math
+
+from bobbin.render import expand_text
+from bobbin.twitter import PublicMetrics
+
+# A typical adult's silent reading speed, in words per minute
+READING_SPEED = 238
+
+
+class ThreadStats(namedtuple("ThreadStats", "tweets words reading_minutes first_tweet_at last_tweet_at media links engagement")):
+	'''
+	first_tweet_at and last_tweet_at are the creation times of the earliest
+	and latest tweets, or None for an empty thread. Quoted tweets' media and
+	links aren't counted, since they aren't part of the thread. engagement is
+	the PublicMetrics summed over the thread, or None if there are no
+	metrics for its tweets.
+	'''
+	__slots__ = ()
+
+	def json(self):
+		return {
+			"tweets": self.tweets,
+			"words": self.words,
+			"reading_minutes": self.reading_minutes,
+			"first_tweet_at": self.first_tweet_at.isoformat() if self.first_tweet_at is not None else None,
+			"last_tweet_at": self.last_tweet_at.isoformat() if self.last_tweet_at is not None else None,
+			"media": self.media,
+			"links": self.links,
+			"engagement": metrics_json(self.engagement),
+		}
+
+
+def metrics_json(metrics):
+	return metrics._asdict() if metrics is not None else None
+
+
+def thread_stats(thread):
+	words = sum(len(expand_text(tweet).split()) for tweet in thread)
+	created = [tweet.created_at for tweet in thread]
+
+	return ThreadStats(
+		tweets=len(thread),
+		words=words,
+		reading_minutes=max(1, math.ceil(words / READING_SPEED)) if words else 0,
+		first_tweet_at=min(created, default=None),
+		last_tweet_at=max(created, default=None),
+		media=sum(len(tweet.entities.media) for tweet in thread),
+		links=sum(len(tweet.entities.urls) for tweet in thread),
+		engagement=PublicMetrics.total(tweet.metrics for tweet in thread),
+	)
@@ -0,0 +1,138 @@
+# Persistent storage for bearer tokens. Generating a token is an extra round
+# trip, and twitter only ever hands out one token per app anyway, so storing
+# it lets restarts skip straight to making requests. Tokens are stored by
+# consumer key, so one store can hold the tokens for several apps.
+
+import abc
+import asyncio
+import json
+import os
+import pathlib
+import sqlite3
+import threading
+
+
+class TokenStore(abc.ABC):
+	@abc.abstractmethod
+	async def load_token(self, consumer_key):
+		'''
+		Get the stored bearer token for consumer_key, or None
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def save_token(self, consumer_key, token):
+		'''
+		Save the bearer token for consumer_key, replacing any existing token
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def delete_token(self, consumer_key):
+		'''
+		Remove the stored token for consumer_key, if there is one
+		'''
+		raise NotImplementedError()
+
+	def close(self):
+		pass
+
+
+class FileTokenStore(TokenStore):
+	'''
+	TokenStore backed by a json file of consumer key to token. The file is
+	rewritten on every save, and is only readable by the owner, since the
+	tokens are credentials.
+	'''
+	def __init__(self, path):
+		self.path = pathlib.Path(path)
+		self.lock = asyncio.Lock()
+
+	def _load(self):
+		try:
+			with self.path.open() as f:
+				return json.load(f)
+		except FileNotFoundError:
+			return {}
+
+	def _save(self, tokens):
+		tmp_path = self.path.with_name(self.path.name + ".tmp")
+		fd = os.open(str(tmp_path), os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+		with open(fd, "w") as f:
+			json.dump(tokens, f)
+		os.replace(str(tmp_path), str(self.path))
+
+	async def load_token(self, consumer_key):
+		return self._load().get(consumer_key)
+
+	async def save_token(self, consumer_key, token):
+		async with self.lock:
+			tokens = self._load()
+			tokens[consumer_key] = token
+			self._save(tokens)
+
+	async def delete_token(self, consumer_key):
+		async with self.lock:
+			tokens = self._load()
+			if tokens.pop(consumer_key, None) is not None:
+				self._save(tokens)
+
+
+TOKEN_SCHEMA = '''
+CREATE TABLE IF NOT EXISTS tokens (
+	consumer_key TEXT PRIMARY KEY,
+	token TEXT NOT NULL
+);
+'''
+
+
+class SqliteTokenStore(TokenStore):
+	'''
+	TokenStore backed by a sqlite database. This can share a database with
+	SqliteThreadStore.
+	'''
+	def __init__(self, path, *, loop=None):
+		self.loop = loop
+		self.lock = threading.Lock()
+		self.db = sqlite3.connect(str(path), check_same_thread=False)
+		self.db.executescript(TOKEN_SCHEMA)
+
+	def _run(self, func, *args):
+		def locked():
+			with self.lock:
+				return func(*args)
+
+		loop = self.loop if self.loop is not None else asyncio.get_event_loop()
+		return loop.run_in_executor(None, locked)
+
+	def _load_token(self, consumer_key):
+		row = self.db.execute(
+			"SELECT token FROM tokens WHERE consumer_key = ?",
+			(consumer_key,),
+		).fetchone()
+
+		return row[0] if row is not None else None
+
+	async def load_token(self, consumer_key):
+		return await self._run(self._load_token, consumer_key)
+
+	def _save_token(self, consumer_key, token):
+		with self.db:
+			self.db.execute(
+				"INSERT OR REPLACE INTO tokens (consumer_key, token) VALUES (?, ?)",
+				(consumer_key, token),
+			)
+
+	async def save_token(self, consumer_key, token):
+		await self._run(self._save_token, consumer_key, token)
+
+	def _delete_token(self, consumer_key):
+		with self.db:
+			self.db.execute("DELETE FROM tokens WHERE consumer_key = ?", (consumer_key,))
+
+	async def delete_token(self, consumer_key):
+		await self._run(self._delete_token, consumer_key)
+
+	def close(self):
+		with self.lock:
+			self.db.close()
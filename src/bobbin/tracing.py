@@ -0,0 +1,178 @@
+# OpenTelemetry tracing. When it's enabled, every HTTP request to the server
+# gets a span (continuing the trace of the caller, if it sent a traceparent
+# header), as does every thread resolution, every tweet fetched while
+# resolving it, and every twitter API call, which is tagged with its endpoint
+# and the tweet id, if it's for a single tweet. Retried calls get a span per
+# attempt; responses served from the HTTP cache don't get one at all.
+#
+# Spans are exported according to the standard OTEL_* environment
+# variables: OTEL_TRACES_EXPORTER picks the exporter ("otlp", the default,
+# "console", or "none"), OTEL_EXPORTER_OTLP_ENDPOINT and friends configure
+# OTLP, and OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES describe the
+# service, which is called bobbin unless they say otherwise.
+#
+# This needs the OpenTelemetry SDK and OTLP exporter, which are optional:
+#
+#     pip install bobbin[tracing]
+#
+# Without them, or until configure is called, span does nothing.
+
+import asyncio
+import contextlib
+import os
+
+from aiohttp import web
+
+try:
+	from opentelemetry import propagate, trace
+	from opentelemetry.exporter.otlp.proto.http.trace_exporter import OTLPSpanExporter
+	from opentelemetry.sdk.resources import SERVICE_NAME, Resource
+	from opentelemetry.sdk.trace import TracerProvider
+	from opentelemetry.sdk.trace.export import BatchSpanProcessor, ConsoleSpanExporter
+except ImportError:
+	trace = None
+
+SERVICE = "bobbin"
+
+# OTEL_TRACES_EXPORTER name -> function making the exporter
+EXPORTERS = {
+	"otlp": lambda: OTLPSpanExporter(),
+	"console": lambda: ConsoleSpanExporter(),
+}
+
+
+class TracingError(Exception):
+	pass
+
+
+def available():
+	return trace is not None
+
+
+def get_tracer():
+	return trace.get_tracer(__name__)
+
+
+def configure():
+	'''
+	Start exporting spans, as configured by the environment. Returns the
+	TracerProvider, which should be shut down when the server exits, so that
+	the last spans are flushed.
+	'''
+	names = [
+		name.strip()
+		for name in os.environ.get("OTEL_TRACES_EXPORTER", "otlp").split(",")
+		if name.strip() and name.strip() != "none"
+	]
+	unknown = [name for name in names if name not in EXPORTERS]
+	if unknown:
+		raise TracingError(f"Unsupported OTEL_TRACES_EXPORTER: {', '.join(unknown)}")
+
+	resource = Resource.create()
+	if resource.attributes.get(SERVICE_NAME, "").startswith("unknown_service"):
+		resource = resource.merge(Resource({SERVICE_NAME: SERVICE}))
+
+	provider = TracerProvider(resource=resource)
+	for name in names:
+		provider.add_span_processor(BatchSpanProcessor(EXPORTERS[name]()))
+
+	trace.set_tracer_provider(provider)
+	return provider
+
+
+def span(name, **attributes):
+	'''
+	Get a context manager for a span called name, as a child of the current
+	span. Attributes that are None are left out.
+	'''
+	if trace is None:
+		return contextlib.nullcontext()
+
+	return get_tracer().start_as_current_span(name, attributes={
+		key: value for key, value in attributes.items()
+		if value is not None
+	})
+
+
+def request_tweet_id(request):
+	'''
+	Get the id of the tweet a twitter API request is for, or None if it's
+	not for a single tweet. v1.1 passes it as a parameter, and v2 in the url.
+	'''
+	if "id" in request.params:
+		return str(request.params["id"])
+
+	if request.endpoint.endswith("/:id"):
+		return request.url.rsplit("/", 1)[-1]
+
+	return None
+
+
+def traced(send):
+	'''
+	Middleware that makes a span for every twitter API request (see
+	bobbin.middleware)
+	'''
+	async def traced_handler(request):
+		with get_tracer().start_as_current_span(
+			f"GET {request.endpoint}",
+			kind=trace.SpanKind.CLIENT,
+			attributes={
+				"http.method": "GET",
+				"http.url": request.url,
+				"twitter.endpoint": request.endpoint,
+			},
+		) as current:
+			tweet_id = request_tweet_id(request)
+			if tweet_id is not None:
+				current.set_attribute("twitter.tweet_id", tweet_id)
+
+			response = await send(request)
+
+			current.set_attribute("http.status_code", response.status)
+			if response.status >= 400:
+				current.set_status(trace.Status(trace.StatusCode.ERROR))
+
+			return response
+
+	return traced_handler
+
+
+def set_server_status(current, status):
+	current.set_attribute("http.status_code", status)
+	if status >= 500:
+		current.set_status(trace.Status(trace.StatusCode.ERROR))
+
+
+def with_tracing(handler):
+	'''
+	Wrap a server request handler, so that it makes a span for every request.
+	Spans are named after the method, since paths include ids. Only server errors mark the span as failed; raised HTTPExceptions are
+	responses like any other.
+	'''
+	async def tracing_handler(request):
+		with get_tracer().start_as_current_span(
+			request.method,
+			context=propagate.extract(request.headers),
+			kind=trace.SpanKind.SERVER,
+			attributes={
+				"http.method": request.method,
+				"http.target": request.path_qs,
+			},
+			set_status_on_exception=False,
+		) as current:
+			try:
+				response = await handler(request)
+			except web.HTTPException as e:
+				set_server_status(current, e.status)
+				raise
+			except asyncio.CancelledError:
+				raise
+			except Exception:
+				current.set_status(trace.Status(trace.StatusCode.ERROR))
+				raise
+
+			set_server_status(current, response.status)
+			return response
+
+	return tracing_handler
@@ -0,0 +1,102 @@
+# Command line tool to measure the API session's throughput (see transport)
+# under concurrent thread resolution, with different connection limits.
+# Resolving a thread is a chain of requests, each waiting for the last, so
+# this resolves many fake threads at once, each a chain of depth requests to
+# a local server that answers after latency seconds, and reports how many
+# threads and requests per second each per-host limit manages, and how many
+# connections it opened.
+#
+#     python -m bobbin.transport_benchmark --threads 500 --limits 8,32,64,0
+
+import asyncio
+import time
+
+from aiohttp import web
+from autocommand import autocommand
+
+from bobbin import transport, web_util
+
+
+def parse_limits(limits):
+	return [int(limit) for limit in limits.split(",") if limit.strip()]
+
+
+async def start_server(*, latency, peers):
+	'''
+	Start a server on localhost that answers every request with a tweet-like
+	json body after latency seconds, adding each client address it sees to
+	peers. Returns (runner, url).
+	'''
+	async def handler(request):
+		peers.add(request.transport.get_extra_info("peername"))
+		await asyncio.sleep(latency)
+		return web.Response(
+			text=web_util.dump_json(id_str=request.query.get("id", "0"), full_text="benchmark"),
+			content_type="application/json",
+		)
+
+	app = web.Application()
+	app.router.add_get("/tweet", handler)
+	runner = web.AppRunner(app)
+	await runner.setup()
+	site = web.TCPSite(runner, "127.0.0.1", 0)
+	await site.start()
+
+	port = runner.addresses[0][1]
+	return runner, f"http://127.0.0.1:{port}/tweet"
+
+
+async def resolve_thread(session, url, *, thread, depth):
+	for index in range(depth):
+		async with session.get(url, params={"id": f"{thread}-{index}"}) as response:
+			response.raise_for_status()
+			await response.json()
+
+
+async def run(*, url, limit, max_connections, threads, depth, peers):
+	peers.clear()
+	async with transport.make_api_session(
+		max_connections=max_connections,
+		max_connections_per_host=limit,
+	) as session:
+		start = time.monotonic()
+		await asyncio.gather(*(
+			resolve_thread(session, url, thread=thread, depth=depth)
+			for thread in range(threads)
+		))
+		elapsed = time.monotonic() - start
+
+	return elapsed, len(peers)
+
+
+@autocommand(__name__, loop=True)
+async def main(
+	threads: int =200,
+	depth: int =10,
+	latency: float =0.02,
+	limits="1,8,32,0",
+	max_connections: int =transport.MAX_CONNECTIONS,
+):
+	'''
+	Resolve threads fake threads of depth tweets each, all at once, against
+	a local server that takes latency seconds per request, once for each of
+	the comma separated per-host connection limits (0 for no limit).
+	'''
+	peers = set()
+	runner, url = await start_server(latency=latency, peers=peers)
+
+	try:
+		print(f"{threads} threads of {depth} tweets, {latency * 1000:g}ms per request")
+		print(f"{'per host':>10} {'seconds':>10} {'threads/s':>10} {'requests/s':>11} {'connections':>12}")
+		for limit in parse_limits(limits):
+			elapsed, connections = await run(
+				url=url,
+				limit=limit,
+				max_connections=max_connections,
+				threads=threads,
+				depth=depth,
+				peers=peers,
+			)
+			print(f"{limit or 'none':>10} {elapsed:>10.2f} {threads / elapsed:>10.1f} {threads * depth / elapsed:>11.1f} {connections:>12}")
+	finally:
+		await runner.cleanup()
@@ -0,0 +1,116 @@
+# Tweets as JSON, for keeping them outside of the process: in the thread
+# store (see storage) and in archives (see archive). Tweets are objects with
+# all of the fields of twitter.Tweet, with user as an object of the fields of
+# twitter.TwitterUser, and entities as {"urls", "mentions", "hashtags",
+# "media"}, each a list of objects of the fields of the corresponding twitter
+# entity. quoted is another tweet, or null; poll and card are objects of the
+# fields of twitter.Poll (with options) and link_cards.Card, or null. Times
+# are ISO 8601 strings.
+
+from datetime import datetime
+
+from bobbin.link_cards import Card
+from bobbin.twitter import (
+	Entities,
+	HashtagEntity,
+	Media,
+	MentionEntity,
+	Poll,
+	PollOption,
+	PublicMetrics,
+	Tweet,
+	TwitterUser,
+	UrlEntity,
+	VideoVariant,
+)
+
+
+def parse_time(text):
+	return datetime.fromisoformat(text) if text is not None else None
+
+
+def format_time(time):
+	return time.isoformat() if time is not None else None
+
+
+def listify(indices):
+	return list(indices) if indices is not None else None
+
+
+def tupleify(indices):
+	return tuple(indices) if indices is not None else None
+
+
+def tweet_to_json(tweet):
+	entities = tweet.entities
+
+	return {
+		"id": tweet.id,
+		"user": tweet.user._asdict(),
+		"parent_id": tweet.parent_id,
+		"parent_user_id": tweet.parent_user_id,
+		"text": tweet.text,
+		"created_at": format_time(tweet.created_at),
+		"entities": {
+			"urls": [{**url._asdict(), "indices": listify(url.indices)} for url in entities.urls],
+			"mentions": [{**mention._asdict(), "indices": listify(mention.indices)} for mention in entities.mentions],
+			"hashtags": [{**hashtag._asdict(), "indices": listify(hashtag.indices)} for hashtag in entities.hashtags],
+			"media": [{
+				**media._asdict(),
+				"indices": listify(media.indices),
+				"variants": [variant._asdict() for variant in media.variants],
+			} for media in entities.media],
+		},
+		"quoted_id": tweet.quoted_id,
+		"quoted": tweet_to_json(tweet.quoted) if tweet.quoted is not None else None,
+		"conversation_id": tweet.conversation_id,
+		"metrics": tweet.metrics._asdict() if tweet.metrics is not None else None,
+		"poll": {
+			**tweet.poll._asdict(),
+			"options": [option._asdict() for option in tweet.poll.options],
+			"end_datetime": format_time(tweet.poll.end_datetime),
+		} if tweet.poll is not None else None,
+		"card": tweet.card._asdict() if tweet.card is not None else None,
+		"edit_history": list(tweet.edit_history) if tweet.edit_history is not None else None,
+		"url": tweet.url,
+	}
+
+
+def tweet_from_json(blob):
+	'''
+	Create a Tweet from its JSON. Lists become tuples, since Tweets
+	must be hashable.
+	'''
+	entities = blob["entities"]
+	poll = blob.get("poll")
+
+	return Tweet(
+		blob["id"],
+		TwitterUser(**blob["user"]),
+		blob.get("parent_id"),
+		blob.get("parent_user_id"),
+		blob["text"],
+		parse_time(blob["created_at"]),
+		Entities(
+			tuple(UrlEntity(**{**url, "indices": tupleify(url["indices"])}) for url in entities["urls"]),
+			tuple(MentionEntity(**{**mention, "indices": tupleify(mention["indices"])}) for mention in entities["mentions"]),
+			tuple(HashtagEntity(**{**hashtag, "indices": tupleify(hashtag["indices"])}) for hashtag in entities["hashtags"]),
+			tuple(Media(**{
+				**media,
+				"indices": tupleify(media["indices"]),
+				"variants": tuple(VideoVariant(**variant) for variant in media["variants"]),
+			}) for media in entities["media"]),
+		),
+		blob.get("quoted_id"),
+		tweet_from_json(blob["quoted"]) if blob.get("quoted") is not None else None,
+		blob.get("conversation_id"),
+		PublicMetrics(**blob["metrics"]) if blob.get("metrics") is not None else None,
+		Poll(**{
+			**poll,
+			"options": tuple(PollOption(**option) for option in poll["options"]),
+			"end_datetime": parse_time(poll["end_datetime"]),
+		}) if poll is not None else None,
+		Card(**blob["card"]) if blob.get("card") is not None else None,
+		tupleify(blob.get("edit_history")),
+		blob.get("url"),
+	)
@@ -0,0 +1,81 @@
+import asyncio
+
+from bobbin.twitter import MAX_LOOKUP_COUNT, NoSuchTweetError
+
+
+class TweetLoader:
+	'''
+	Wraps an api module (bobbin.twitter or bobbin.twitter_v2) such that
+	concurrent get_tweet calls made within a short window are coalesced into a
+	single get_tweets lookup, in the style of a data loader. Concurrent calls
+	for the same tweet share a single result. Because it has the same interface
+	as the api modules, a loader can be used as the api in tweetbox.
+
+	Calls are only batched together if they use the same session and token.
+	'''
+	def __init__(self, api, *, window=0.005, max_batch=MAX_LOOKUP_COUNT):
+		self.api = api
+		self.window = window
+		self.max_batch = max_batch
+
+		# (session, token) -> list of tweet ids waiting to be dispatched
+		self.pending = {}
+
+		# (session, token) -> timer handle for the next dispatch
+		self.timers = {}
+
+		# (session, token, tweet_id) -> future for that tweet, either pending or
+		# in flight
+		self.futures = {}
+
+	def __getattr__(self, name):
+		# Everything other than get_tweet goes straight to the api
+		return getattr(self.api, name)
+
+	async def get_tweet(self, *, session, token, tweet_id):
+		key = (session, token)
+
+		try:
+			future = self.futures[session, token, tweet_id]
+		except KeyError:
+			loop = asyncio.get_event_loop()
+			future = self.futures[session, token, tweet_id] = loop.create_future()
+
+			pending = self.pending.setdefault(key, [])
+			pending.append(tweet_id)
+
+			if len(pending) >= self.max_batch:
+				self.dispatch(key)
+			elif key not in self.timers:
+				self.timers[key] = loop.call_later(self.window, self.dispatch, key)
+
+		return (await asyncio.shield(future))
+
+	def dispatch(self, key):
+		timer = self.timers.pop(key, None)
+		if timer is not None:
+			timer.cancel()
+
+		tweet_ids = self.pending.pop(key, None)
+		if tweet_ids:
+			asyncio.ensure_future(self.load(key, tweet_ids))
+
+	async def load(self, key, tweet_ids):
+		session, token = key
+
+		try:
+			tweets = await self.api.get_tweets(session=session, token=token, tweet_ids=tweet_ids)
+		except Exception as e:
+			for tweet_id in tweet_ids:
+				future = self.futures.pop((session, token, tweet_id))
+				if not future.done():
+					future.set_exception(e)
+		else:
+			for tweet_id in tweet_ids:
+				future = self.futures.pop((session, token, tweet_id))
+				if future.done():
+					continue
+				elif tweet_id in tweets:
+					future.set_result(tweets[tweet_id])
+				else:
+					future.set_exception(NoSuchTweetError(tweet_id))
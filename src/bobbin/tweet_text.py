@@ -0,0 +1,292 @@
+# Rendering of tweet text as HTML, with @mentions, #hashtags, and urls linked.
+#
+# Entities say where they are in the text by (start, end) indices, which
+# twitter documents as code point offsets into the html-escaped text. They
+# aren't always right: some clients report UTF-16 offsets, which differ after
+# any emoji outside the BMP, and edited or truncated tweets can have indices
+# that point past the text. So each entity's indices are checked against the
+# text it should cover; failing that, UTF-16 offsets are tried, and then a
+# search for the entity's text. Entities that can't be found, or that overlap
+# an earlier one, are left as plain text.
+#
+# Code can optionally be picked out too: ```fenced``` blocks, blocks of lines
+# indented by four spaces or a tab, and `inline` code are rendered in <pre>
+# and <code> elements, with any entities in them left alone. Fenced blocks
+# with a language (```python) get a language-python class, for any client
+# side highlighter.
+#
+# Blocks are also highlighted on the server, as spans with hl- prefixed
+# Pygments token classes (see render.EMBED_STYLE), if Pygments is
+# installed, which is optional:
+#
+#     pip install bobbin[highlight]
+#
+# Fenced blocks are highlighted as their language, and the rest as whatever
+# Pygments guesses they are; blocks in languages it doesn't know are left
+# as they are.
+
+from collections import namedtuple
+from urllib.parse import quote as url_quote, urlparse
+import html
+import re
+import textwrap
+
+try:
+	from pygments import highlight
+	from pygments.formatters import HtmlFormatter
+	from pygments.lexers import get_lexer_by_name, guess_lexer
+	from pygments.util import ClassNotFound
+except ImportError:
+	highlight = None
+
+MENTION_SIGILS = "@＠"
+HASHTAG_SIGILS = "#＃"
+
+
+def utf16_offsets(text):
+	'''
+	Map each UTF-16 offset in text to the code point offset at the same place
+	'''
+	offsets = {}
+	utf16_offset = 0
+
+	for index, char in enumerate(text):
+		offsets[utf16_offset] = index
+		utf16_offset += 2 if ord(char) > 0xFFFF else 1
+
+	offsets[utf16_offset] = len(text)
+	return offsets
+
+
+class TextSpan(namedtuple("TextSpan", "kind entity matches search")):
+	'''
+	A span of the tweet text covered by an entity. matches(text) says whether
+	some text is what the entity should cover; search is a string to look for
+	if the indices are wrong.
+	'''
+	__slots__ = ()
+
+	@property
+	def indices(self):
+		return self.entity.indices
+
+
+def sigil_matcher(sigils, name):
+	name = name.lower()
+	return lambda text: text[:1] in sigils and text[1:].lower() == name
+
+
+def entity_spans(entities):
+	for url in entities.urls:
+		yield TextSpan("url", url, url.url.__eq__, url.url)
+
+	for mention in entities.mentions:
+		yield TextSpan("mention", mention, sigil_matcher(MENTION_SIGILS, mention.handle), f"@{mention.handle}")
+
+	for hashtag in entities.hashtags:
+		yield TextSpan("hashtag", hashtag, sigil_matcher(HASHTAG_SIGILS, hashtag.text), f"#{hashtag.text}")
+
+	for media in entities.media:
+		if media.url:
+			yield TextSpan("media", media, media.url.__eq__, media.url)
+
+
+def locate(text, span, offsets):
+	'''
+	Find the (start, end) of span in text, or None if it can't be found
+	'''
+	if span.indices is not None:
+		start, end = span.indices
+		if span.matches(text[start:end]):
+			return start, end
+
+		if start in offsets and end in offsets:
+			start, end = offsets[start], offsets[end]
+			if span.matches(text[start:end]):
+				return start, end
+
+	lowered = text.lower()
+	search = span.search.lower()
+	start = lowered.find(search)
+	while start != -1:
+		end = start + len(search)
+
+		# Don't match a prefix of a longer handle or hashtag
+		if end >= len(text) or not (text[end].isalnum() or text[end] == "_"):
+			if span.matches(text[start:end]):
+				return start, end
+
+		start = lowered.find(search, start + 1)
+
+	return None
+
+
+def locate_spans(text, entities):
+	'''
+	Get the (start, end, span) of each entity that can be found in text, in
+	order, without overlaps
+	'''
+	offsets = utf16_offsets(text)
+	located = []
+
+	for span in entity_spans(entities):
+		position = locate(text, span, offsets)
+		if position is not None:
+			located.append((position[0], position[1], span))
+
+	# Earliest first, and the longest of any that start together
+	located.sort(key=lambda item: (item[0], -item[1]))
+
+	result = []
+	last_end = 0
+	for start, end, span in located:
+		if start >= last_end:
+			result.append((start, end, span))
+			last_end = end
+
+	return result
+
+
+class CodeRegion(namedtuple("CodeRegion", "block language content")):
+	__slots__ = ()
+
+
+CODE_PATTERN = re.compile(
+	r"```(?:(?P<language>[a-zA-Z0-9+#-]+)[ \t]*\n|\n)?(?P<fenced>.+?)\n?```\n?"
+	r"|(?P<indented>(?:^(?: {4}|\t)[^\n]*(?:\n|$)){2,})"
+	r"|`(?P<inline>[^`\n]+)`",
+	re.DOTALL | re.MULTILINE,
+)
+
+
+def code_regions(text):
+	'''
+	Get the (start, end, CodeRegion) of each bit of code in text, in order
+	'''
+	regions = []
+
+	for match in CODE_PATTERN.finditer(text):
+		if match.group("fenced") is not None:
+			region = CodeRegion(True, match.group("language") or None, match.group("fenced"))
+		elif match.group("indented") is not None:
+			region = CodeRegion(True, None, textwrap.dedent(match.group("indented")).rstrip("\n"))
+		else:
+			region = CodeRegion(False, None, match.group("inline"))
+
+		regions.append((match.start(), match.end(), region))
+
+	return regions
+
+
+def highlight_available():
+	return highlight is not None
+
+
+def block_lexer(region):
+	'''
+	Get the Pygments lexer for a block of code, or None if it can't be
+	highlighted
+	'''
+	if highlight is None:
+		return None
+
+	try:
+		if region.language is not None:
+			return get_lexer_by_name(region.language.lower())
+		return guess_lexer(html.unescape(region.content))
+	except ClassNotFound:
+		return None
+
+
+def highlighted_html(content, lexer):
+	formatter = HtmlFormatter(nowrap=True, classprefix="hl-")
+	return highlight(html.unescape(content), lexer, formatter).rstrip("\n")
+
+
+def code_html(region):
+	lexer = block_lexer(region) if region.block else None
+	if lexer is not None:
+		code = highlighted_html(region.content, lexer)
+	else:
+		code = html.escape(html.unescape(region.content))
+
+	# Newlines are encoded, so that they aren't turned into <br>s
+	code = code.replace("\n", "&#10;")
+
+	classes = []
+	if lexer is not None:
+		classes.append("highlight")
+	if region.language is not None:
+		classes.append(f"language-{html.escape(region.language.lower())}")
+	class_attribute = ' class="{}"'.format(" ".join(classes)) if classes else ""
+
+	if not region.block:
+		return f"<code>{code}</code>"
+	else:
+		return f"<pre><code{class_attribute}>{code}</code></pre>"
+
+
+def safe_url(url):
+	'''
+	Only link to http and https urls; anything else (like javascript:) could
+	do more than navigate
+	'''
+	return url is not None and urlparse(url).scheme in ("http", "https")
+
+
+def link(href, text, *, title=None):
+	return '<a href="{}"{} target="_blank" rel="noopener nofollow">{}</a>'.format(
+		html.escape(href),
+		' title="{}"'.format(html.escape(title)) if title else "",
+		html.escape(text),
+	)
+
+
+def span_html(span, text):
+	'''
+	Render an entity, given the (unescaped) text that it covered
+	'''
+	entity = span.entity
+
+	if span.kind == "url":
+		href = next((url for url in (entity.expanded_url, entity.url) if safe_url(url)), None)
+		if href is None:
+			return html.escape(text)
+		return link(href, entity.display_url or href, title=href)
+	elif span.kind == "mention":
+		return link(f"https://twitter.com/{url_quote(entity.handle)}", text)
+	elif span.kind == "hashtag":
+		return link(f"https://twitter.com/hashtag/{url_quote(entity.text)}", text)
+	else:
+		# Attached media is rendered separately, so its link is dropped
+		return ""
+
+
+def tweet_text_html(tweet, *, code=False):
+	'''
+	Render the text of a tweet as HTML, with entities linked, t.co urls
+	replaced by the urls they point to, and line breaks kept. If code is
+	true, code in the tweet is rendered as code.
+	'''
+	text = tweet.text
+	parts = []
+	position = 0
+
+	regions = code_regions(text) if code else []
+	spans = [
+		(start, end, span)
+		for start, end, span in locate_spans(text, tweet.entities)
+		if not any(start < region_end and region_start < end for region_start, region_end, _ in regions)
+	]
+
+	for start, end, item in sorted(regions + spans, key=lambda item: item[0]):
+		parts.append(html.escape(html.unescape(text[position:start])))
+		if isinstance(item, CodeRegion):
+			parts.append(code_html(item))
+		else:
+			parts.append(span_html(item, html.unescape(text[start:end])))
+		position = end
+
+	parts.append(html.escape(html.unescape(text[position:])))
+
+	return "<br>".join("".join(parts).strip().split("\n"))
@@ -0,0 +1,22 @@
+# Users paste all sorts of things when they mean a tweet: bare ids, links
+# from the website or the mobile site, links with tracking parameters, and
+# links to x.com. This module reduces all of them to a tweet id.
+
+import re
+
+TWEET_URL_PATTERN = re.compile(
+	r"^\s*"
+	r"(?:(?:https?://)?(?:(?:www|mobile)\.)?(?:twitter|x)\.com/(?:[a-zA-Z0-9_]{1,15}|i/web)/status(?:es)?/)?"
+	r"([0-9]{1,20})"
+	r"/?(?:[?#]\S*)?"
+	r"\s*$"
+)
+
+
+def parse_tweet_id(text):
+	'''
+	Get the tweet id from a tweet url or a bare tweet id, or None if text is
+	neither
+	'''
+	match = TWEET_URL_PATTERN.match(text)
+	return match.group(1) if match is not None else None
@@ -1,23 +1,216 @@
+from collections import Counter, namedtuple
+from datetime import datetime, timezone
 from pickle import dumps as pickle_dump, loads as pickle_load
+import asyncio
+import logging
 
-from bobbin.async_cache import KeyNotFound, Cache as TweetCache
+import aiohttp
+
+from bobbin.async_cache import DictCache, KeyNotFound, Cache as TweetCache
 from bobbin.async_util import shared_concurrent
-from bobbin.twitter import get_tweet, get_user_tweets, Tweet
-from bobbin.task_manager import TaskWaiter
+from bobbin import tracing, twitter
+from bobbin.load_shedding import Overloaded, UNLIMITED as UNLIMITED_RESOLUTIONS
+from bobbin.twitter import Tweet, TwitterError, UnavailableTweetError
+from bobbin.task_manager import TaskLimiter, TaskWaiter
 
 # This is the primary interface where the logic lives. It handles caching and
 # the algorithmic decisions of which APIs to use
 
+logger = logging.getLogger(__name__)
+
+# The most pages of search results a conversation search fetches
+MAX_CONVERSATION_PAGES = 10
+
 
 class InvalidThreadError(Exception):
 	pass
 
 
+class BudgetExhausted(Exception):
+	pass
+
+
 class MismatchedHeadError(InvalidThreadError):
 	pass
 
 
-async def generate_thread(*, session, cache: TweetCache, token, tail, head=None):
+class ThreadGap(namedtuple("ThreadGap", "id reason")):
+	'''
+	Marks a tweet in a thread that couldn't be retrieved, because it was
+	deleted, protected, or its author was suspended. Because we can't know
+	what the missing tweet was replying to, a gap is always the first item in
+	a thread.
+	'''
+	__slots__ = ()
+
+
+class ThreadTruncated(namedtuple("ThreadTruncated", "id")):
+	'''
+	Marks where resolving a thread stopped because it ran out of budget. id is
+	the next tweet that would have been fetched, so the rest of the thread
+	can be resolved separately, starting from it.
+	'''
+	__slots__ = ()
+
+
+class ResolutionBudget(namedtuple("ResolutionBudget", "max_time max_calls")):
+	'''
+	Limits on how much work resolving a single thread may do: max_time is a
+	wall time in seconds, and max_calls is a number of twitter API calls.
+	Either may be None, for no limit. Cache hits are free.
+	'''
+	__slots__ = ()
+
+	def __new__(cls, max_time=None, max_calls=None):
+		return super().__new__(cls, max_time, max_calls)
+
+
+UNLIMITED_BUDGET = ResolutionBudget()
+
+
+def get_thread_author(tweets):
+	'''
+	Find the author of a thread: the user who wrote most of the tweets, if
+	there is a clear majority. Returns None for conversations.
+	'''
+	user_counts = Counter(tweet.user for tweet in tweets)
+
+	if len(user_counts) == 0:
+		return None
+	elif len(user_counts) == 1:
+		return user_counts.popitem()[0]
+
+	top_users = user_counts.most_common(2)
+
+	if top_users[0][1] > top_users[1][1] and top_users[0][1] * 2 >= len(user_counts):
+		return top_users[0][0]
+	else:
+		return None
+
+
+class Thread:
+	'''
+	A resolved thread. tweets is a tuple of Tweets, in order from head to
+	tail. gaps is a tuple of ThreadGaps for the unavailable tweets preceding
+	the head, if any. fetched_at is when the thread was resolved. replies is a
+	dict of tweet id to top replies from other users, if they were requested.
+	If resolution ran out of budget before reaching the head, truncated is
+	the id of the tweet preceding the first one we have; otherwise it's None.
+	Iterating, indexing, and len() all operate on the tweets.
+	'''
+	__slots__ = ('tweets', 'gaps', 'author', 'fetched_at', 'replies', 'truncated')
+
+	def __init__(self, tweets, *, gaps=(), fetched_at=None, replies=None, truncated=None):
+		self.tweets = tuple(tweets)
+		self.gaps = tuple(gaps)
+		self.author = get_thread_author(self.tweets)
+		self.fetched_at = fetched_at if fetched_at is not None else datetime.now(timezone.utc)
+		self.replies = replies if replies is not None else {}
+		self.truncated = truncated
+
+	def __repr__(self):
+		return f"Thread(head={self.head_id}, tail={self.tail_id}, len={len(self)})"
+
+	def __len__(self):
+		return len(self.tweets)
+
+	def __iter__(self):
+		return iter(self.tweets)
+
+	def __getitem__(self, index):
+		return self.tweets[index]
+
+	def root(self):
+		return self.tweets[0] if self.tweets else None
+
+	@property
+	def head_id(self):
+		return self.tweets[0].id if self.tweets else None
+
+	@property
+	def tail_id(self):
+		return self.tweets[-1].id if self.tweets else None
+
+	@property
+	def ids(self):
+		'''
+		The ids of the whole thread, including gaps
+		'''
+		return [gap.id for gap in self.gaps] + [tweet.id for tweet in self.tweets]
+
+	def index(self, tweet_id):
+		for index, tweet in enumerate(self.tweets):
+			if tweet.id == tweet_id:
+				return index
+		raise ValueError(tweet_id)
+
+	def slice(self, start=None, stop=None):
+		'''
+		Get a Thread with just the tweets in [start:stop]. The gaps and
+		truncation are only kept if the slice includes the head. The author is
+		always that of the whole thread.
+		'''
+		start, stop, _ = slice(start, stop).indices(len(self.tweets))
+		tweets = self.tweets[start:stop]
+		return self._derive(
+			tweets,
+			gaps=self.gaps if start == 0 else (),
+			fetched_at=self.fetched_at,
+			truncated=self.truncated if start == 0 else None,
+			replies={
+				tweet.id: self.replies[tweet.id] for tweet in tweets
+				if tweet.id in self.replies
+			},
+		)
+
+	def with_replies(self, replies):
+		return self._derive(
+			self.tweets,
+			gaps=self.gaps,
+			fetched_at=self.fetched_at,
+			replies=replies,
+			truncated=self.truncated,
+		)
+
+	async def map_tweets(self, fn):
+		'''
+		Get a copy of the thread with fn, an async function taking and
+		returning a Tweet, applied to all of its tweets and replies at once
+		'''
+		tweets, *replies = await asyncio.gather(
+			asyncio.gather(*map(fn, self.tweets)),
+			*(asyncio.gather(*map(fn, tweet_replies)) for tweet_replies in self.replies.values()),
+		)
+
+		return self._derive(
+			tweets,
+			gaps=self.gaps,
+			fetched_at=self.fetched_at,
+			replies=dict(zip(self.replies, map(tuple, replies))),
+			truncated=self.truncated,
+		)
+
+	def _derive(self, tweets, **kwargs):
+		# The author may have been replaced with a fresher profile, so it's
+		# carried over rather than recomputed
+		thread = Thread(tweets, **kwargs)
+		thread.author = self.author
+		return thread
+
+
+async def generate_thread(
+	*,
+	session,
+	cache: TweetCache,
+	token,
+	tail,
+	head=None,
+	api=twitter,
+	resolve_quotes=False,
+	conversation_search=False,
+	prefetch=True,
+	budget=UNLIMITED_BUDGET,
+):
 	'''
 	Get a list a tweet IDs comprising a thread, in order from tail to
 	head.
@@ -30,10 +223,60 @@ async def generate_thread(*, session, cache: TweetCache, token, tail, head=None)
 	because timelines only go back 3,200 tweets). Once the full thread is
 	found, insert tweets into the cache. Tweets are yielded in reverse order.
 	Threads are yielded, but if the head tweet is never found, an exception is
-	rasied.
+	rasied. If a tweet other than the tail is unavailable, a ThreadGap is
+	yielded in its place, and the thread ends there.
+
+	Cache should have async "get" and "write" methods. api is the module used
+	to talk to twitter; it should be either bobbin.twitter (v1.1) or
+	bobbin.twitter_v2. If resolve_quotes is true, tweets quoted by tweets in
+	the thread are looked up and attached, if the api didn't already include
+	them.
+
+	If conversation_search is true and the api supports it (v2 only), the
+	whole conversation is first fetched in a single search by conversation_id,
+	which is much cheaper than walking it one tweet at a time. Search only
+	covers recent tweets, so for older threads, this falls back to the usual
+	walk. Each page of search results is an API call like any other, and
+	counts against the budget.
+
+	If prefetch is true, each tweet's parent is fetched as soon as its id is
+	known, rather than when the next tweet is requested.
 
-	Cache should have async "get" and "write" methods.
+	budget is a ResolutionBudget. If it runs out after at least the tail was
+	found, a ThreadTruncated is yielded in place of the rest of the thread.
+	If it runs out while fetching the tail, asyncio.TimeoutError is raised.
 	'''
+	loop = asyncio.get_event_loop()
+	deadline = loop.time() + budget.max_time if budget.max_time is not None else None
+	api_calls = 0
+
+	def spend_call():
+		nonlocal api_calls
+		api_calls += 1
+
+	def out_of_calls():
+		return budget.max_calls is not None and api_calls >= budget.max_calls
+
+	async def wait_within_budget(fetch):
+		if deadline is None or fetch.done():
+			return await fetch
+
+		remaining = deadline - loop.time()
+		if remaining <= 0:
+			raise asyncio.TimeoutError()
+
+		return await asyncio.wait_for(asyncio.shield(fetch), remaining)
+
+	async def call_within_budget(call):
+		if deadline is None:
+			return await call
+
+		remaining = deadline - loop.time()
+		if remaining <= 0:
+			call.close()
+			raise asyncio.TimeoutError()
+
+		return await asyncio.wait_for(call, remaining)
 
 	# local_store is where tweets pulled from the API live. Tweets retreived
 	# from this store (via get_cached_tweet) are stored in the cache
@@ -79,14 +322,17 @@ async def generate_thread(*, session, cache: TweetCache, token, tail, head=None)
 		'''
 
 		# TODO: HANDLE ALL THE ERRORS
-		tweet = await get_tweet(session=session, token=token, tweet_id=tweet_id)
+		spend_call()
+		tweet = await api.get_tweet(session=session, token=token, tweet_id=tweet_id)
 		store_tweet_bg(tweet_id, tweet)
 
-		if tweet.parent_user_id is None:
+		if tweet.parent_user_id is None or out_of_calls():
 			return tweet
 
+		spend_call()
+
 		# TODO: ignore most errors here
-		user_tweets = await get_user_tweets(
+		user_tweets = await api.get_user_tweets(
 			session=session,
 			token=token,
 			user_id=tweet.parent_user_id,
@@ -99,40 +345,659 @@ async def generate_thread(*, session, cache: TweetCache, token, tail, head=None)
 
 		return tweet
 
-	tweet_id = tail
+	async def attach_quoted_tweet(tweet):
+		'''
+		Look up the tweet quoted by tweet and attach it. Failing to find the
+		quoted tweet (for instance, because it's been deleted) isn't an error;
+		the quote is simply left unresolved.
+		'''
+		try:
+			quoted = await get_cached_tweet(tweet.quoted_id)
+		except KeyNotFound:
+			if out_of_calls():
+				return tweet
 
-	with writers:
-		while tweet_id is not None:
+			spend_call()
+			try:
+				quoted = await api.get_tweet(session=session, token=token, tweet_id=tweet.quoted_id)
+			except (TwitterError, aiohttp.ClientResponseError):
+				return tweet
+
+			store_tweet_bg(quoted.id, quoted)
+
+		return tweet._replace(quoted=quoted)
+
+	async def search_conversation():
+		'''
+		Populate the local_store with the tail's author's tweets in its
+		conversation, a page at a time, for as long as the budget allows.
+		Failures are ignored, since the usual walk will pick up the slack.
+		'''
+		try:
+			await get_cached_tweet(tail)
+		except KeyNotFound:
+			pass
+		else:
+			# It's cached, so the thread probably is too
+			return
+
+		# As in the walk, the tail is fetched even with no calls left
+		spend_call()
+		try:
+			tweet = await call_within_budget(api.get_tweet(session=session, token=token, tweet_id=tail))
+		except (TwitterError, aiohttp.ClientResponseError, asyncio.TimeoutError):
+			return
+
+		local_store[tweet.id] = tweet
+
+		if tweet.conversation_id is None or tweet.conversation_id == tweet.id:
+			return
+
+		pages = api.conversation_pager(
+			session=session,
+			token=token,
+			conversation_id=tweet.conversation_id,
+			author_id=tweet.user.id,
+		)
+
+		for _ in range(MAX_CONVERSATION_PAGES):
+			if pages.done or out_of_calls():
+				return
+
+			spend_call()
 			try:
-				tweet = await get_cached_tweet(tweet_id)
+				page = await call_within_budget(pages.next())
+			except (TwitterError, aiohttp.ClientResponseError, asyncio.TimeoutError):
+				return
+
+			for conversation_tweet in page:
+				local_store[conversation_tweet.id] = conversation_tweet
+
+	async def fetch_tweet(tweet_id):
+		with tracing.span("fetch_tweet", **{"twitter.tweet_id": tweet_id}):
+			try:
+				return await get_cached_tweet(tweet_id)
 			except KeyNotFound:
-				tweet = await load_tweets(tweet_id)
+				# The tail is always fetched, even with no budget, so that
+				# there's something to show
+				if out_of_calls() and tweet_id != tail:
+					raise BudgetExhausted()
+				return await load_tweets(tweet_id)
+
+	tweet_id = tail
+	fetch = None
+
+	with writers:
+		if conversation_search and hasattr(api, "conversation_pager"):
+			await search_conversation()
+
+		try:
+			while tweet_id is not None:
+				if fetch is None:
+					fetch = asyncio.ensure_future(fetch_tweet(tweet_id))
+
+				try:
+					tweet = await wait_within_budget(fetch)
+				except UnavailableTweetError as e:
+					# If we can't even get the tail, there's no thread at all
+					if tweet_id == tail:
+						raise
 
-			yield tweet
+					yield ThreadGap(tweet_id, e.reason)
+					break
+				except (BudgetExhausted, asyncio.TimeoutError):
+					if tweet_id == tail:
+						raise asyncio.TimeoutError() from None
 
-			if head is not None:
-				if tweet_id == head:
+					yield ThreadTruncated(tweet_id)
 					break
-				elif tweet.parent_id is None:
-					raise InvalidThreadError(head)
+				finally:
+					if fetch.done():
+						fetch = None
+
+				# Start fetching the parent right away, so that it happens
+				# concurrently with quote resolution and with whatever the
+				# consumer is doing with this tweet.
+				if prefetch and tweet.parent_id is not None and tweet_id != head:
+					fetch = asyncio.ensure_future(fetch_tweet(tweet.parent_id))
+
+				if (
+					resolve_quotes and
+					tweet.quoted_id is not None and
+					tweet.quoted is None and
+					(deadline is None or loop.time() < deadline)
+				):
+					tweet = await attach_quoted_tweet(tweet)
+
+				yield tweet
 
-			tweet_id = tweet.parent_id
+				if head is not None:
+					if tweet_id == head:
+						break
+					elif tweet.parent_id is None:
+						raise InvalidThreadError(head)
+
+				tweet_id = tweet.parent_id
+		finally:
+			if fetch is not None:
+				fetch.cancel()
 
 		await writers.wait(instant=True)
 
 
-async def get_thread(*, session, cache, token, tail, head=None):
-	return list(reversed([tweet async for tweet in generate_thread(
+async def find_self_replies(*, session, token, author_id, since_tweet, api=twitter, max_pages=4):
+	'''
+	Search the author's timeline after since_tweet for replies to themselves.
+	Returns a dict of parent tweet id to a list of the author's replies to it.
+	Only the max_pages most recent pages of the timeline are searched.
+	'''
+	replies = {}
+	timeline = api.user_timeline(
+		session=session,
+		token=token,
+		user_id=author_id,
+		since_tweet=since_tweet,
+	)
+
+	for _ in range(max_pages):
+		page = await timeline.next()
+		if not page:
+			break
+
+		for user_tweet in page:
+			if user_tweet.parent_user_id == author_id:
+				replies.setdefault(user_tweet.parent_id, []).append(user_tweet)
+
+	return replies
+
+
+async def find_tail(*, session, token, tweet_id, api=twitter, max_pages=4):
+	'''
+	Find the last tweet in the thread containing tweet_id, by searching the
+	author's timeline after tweet_id for self-replies. If the author branched
+	the thread, the earliest reply is followed. Only the max_pages most recent
+	pages of the timeline are searched, so threads continued long ago may be
+	cut short.
+	'''
+	tweet = await api.get_tweet(session=session, token=token, tweet_id=tweet_id)
+
+	replies = await find_self_replies(
+		session=session,
+		token=token,
+		author_id=tweet.user.id,
+		since_tweet=tweet_id,
+		api=api,
+		max_pages=max_pages,
+	)
+
+	while tweet_id in replies:
+		tweet_id = min(replies[tweet_id], key=lambda reply: int(reply.id)).id
+
+	return tweet_id
+
+
+async def get_thread(
+	*,
+	session,
+	cache,
+	token,
+	tail,
+	head=None,
+	api=twitter,
+	resolve_quotes=False,
+	forward=False,
+	conversation_search=False,
+	budget=UNLIMITED_BUDGET,
+):
+	'''
+	Get a whole Thread. If forward is true, tail can be any tweet in the
+	thread; the author's replies to it are searched to find the real tail.
+	If the thread can't be resolved within budget, the part nearest the tail
+	is returned, marked as truncated.
+	'''
+	if forward:
+		tail = await find_tail(session=session, token=token, tweet_id=tail, api=api)
+
+	items = [item async for item in generate_thread(
 		session=session,
 		cache=cache,
 		token=token,
 		tail=tail,
-		head=head
-	)]))
+		head=head,
+		api=api,
+		resolve_quotes=resolve_quotes,
+		conversation_search=conversation_search,
+		budget=budget,
+	)]
+	items.reverse()
+
+	truncated = items.pop(0).id if items and isinstance(items[0], ThreadTruncated) else None
+
+	return Thread(
+		[item for item in items if not isinstance(item, ThreadGap)],
+		gaps=[item for item in items if isinstance(item, ThreadGap)],
+		truncated=truncated,
+	)
+
+
+def reply_likes(reply):
+	return reply.metrics.likes if reply.metrics is not None else 0
+
+
+async def get_thread_replies(*, session, token, thread, max_replies, api=twitter, max_concurrent=4):
+	'''
+	Find the top replies from other users to each tweet in thread. Returns a
+	dict of tweet id to a list of at most max_replies replies, most liked
+	first. This is only supported by the v2 api; otherwise, no replies are
+	found. Failures to find replies are ignored.
+	'''
+	if max_replies <= 0 or not hasattr(api, "get_replies"):
+		return {}
+
+	def fetch_replies(tweet):
+		return api.get_replies(
+			session=session,
+			token=token,
+			tweet_id=tweet.id,
+			exclude_user_id=tweet.user.id,
+		)
+
+	limiter = TaskLimiter(max_concurrent)
+	tasks = {tweet.id: limiter.schedule(fetch_replies, tweet) for tweet in thread}
+
+	results = {}
+
+	try:
+		for tweet_id, task in tasks.items():
+			try:
+				replies = await task
+			except (TwitterError, aiohttp.ClientResponseError):
+				continue
+
+			if replies:
+				results[tweet_id] = sorted(replies, key=reply_likes, reverse=True)[:max_replies]
+	finally:
+		for task in tasks.values():
+			task.cancel()
+
+	return results
+
+
+async def get_thread_with_replies(*, session, cache, token, tail, head=None, api=twitter, max_replies=3):
+	'''
+	Get a Thread, along with the top replies from other users to each of its
+	tweets.
+	'''
+	thread = await get_thread(session=session, cache=cache, token=token, tail=tail, head=head, api=api)
+	return thread.with_replies(await get_thread_replies(
+		session=session,
+		token=token,
+		thread=thread,
+		max_replies=max_replies,
+		api=api,
+	))
+
+
+class ThreadTree:
+	'''
+	A thread that may branch, because the author replied to some of their
+	tweets more than once. root is the first tweet, and replies is a dict of
+	tweet id to a tuple of the author's replies to that tweet, in order. The
+	tree is stored flat, rather than as nested nodes, because threads can be
+	far deeper than they are wide.
+	'''
+	__slots__ = ('root', 'replies', 'fetched_at')
+
+	def __init__(self, root, replies, *, fetched_at=None):
+		self.root = root
+		self.replies = replies
+		self.fetched_at = fetched_at if fetched_at is not None else datetime.now(timezone.utc)
+
+	def __len__(self):
+		return 1 + sum(map(len, self.replies.values()))
+
+	def walk(self):
+		'''
+		Iterate over (tweet, depth) pairs, depth first. The first reply to a
+		tweet continues at the same depth; subsequent replies are branches, one
+		level deeper.
+		'''
+		stack = [(self.root, 0)]
+
+		while stack:
+			tweet, depth = stack.pop()
+			yield tweet, depth
+
+			replies = self.replies.get(tweet.id, ())
+			stack.extend((reply, depth + 1) for reply in reversed(replies[1:]))
+			if replies:
+				stack.append((replies[0], depth))
+
+	def is_branched(self):
+		return any(len(replies) > 1 for replies in self.replies.values())
+
+
+async def get_thread_tree(*, session, cache, token, tail, api=twitter, max_pages=4):
+	'''
+	Get a ThreadTree containing the thread ending at tail, as well as every
+	other branch of self-replies from the same root. Branches are found by
+	searching the author's timeline, so, as with find_tail, branches posted
+	long after the root may be missed.
+	'''
+	thread = await get_thread(session=session, cache=cache, token=token, tail=tail, api=api)
+	root = thread.root()
+
+	found_replies = await find_self_replies(
+		session=session,
+		token=token,
+		author_id=root.user.id,
+		since_tweet=root.id,
+		api=api,
+		max_pages=max_pages,
+	)
+
+	# The thread itself might be too old to be found in the timeline, so make
+	# sure it's included.
+	children = {}
+	for reply in thread.tweets[1:]:
+		children.setdefault(reply.parent_id, {})[reply.id] = reply
+	for parent_id, replies in found_replies.items():
+		for reply in replies:
+			children.setdefault(parent_id, {})[reply.id] = reply
+
+	# Only keep the replies that are actually connected to the root
+	replies = {}
+	pending = [root.id]
+	while pending:
+		tweet_id = pending.pop()
+		if tweet_id in children:
+			replies[tweet_id] = tuple(sorted(children[tweet_id].values(), key=lambda reply: int(reply.id)))
+			pending.extend(children[tweet_id])
+
+	return ThreadTree(root, replies, fetched_at=thread.fetched_at)
+
+
+async def cached_thread_ids(cache, tail, *, limit=5000):
+	'''
+	Get the ids of the thread ending at tail, tail first, as far back as its
+	tweets are in the cache. No API calls are made.
+	'''
+	ids = []
+	tweet_id = tail
+
+	while tweet_id is not None and len(ids) < limit:
+		try:
+			tweet = pickle_load(await cache.get(tweet_id))
+		except KeyNotFound:
+			break
+
+		ids.append(tweet_id)
+		tweet_id = tweet.parent_id
+
+	return ids
+
+
+async def cached_thread(cache, tail, *, head=None, limit=5000):
+	'''
+	Get the thread ending at tail entirely from the cache, or None if any of
+	its tweets aren't there. No API calls are made.
+	'''
+	tweets = []
+	tweet_id = tail
 
+	while tweet_id is not None and len(tweets) < limit:
+		try:
+			tweet = pickle_load(await cache.get(tweet_id))
+		except KeyNotFound:
+			return None
+
+		tweets.append(tweet)
+		if tweet_id == head:
+			break
+
+		tweet_id = tweet.parent_id
+	else:
+		if tweet_id is not None or head is not None:
+			return None
+
+	tweets.reverse()
+	return Thread(tweets)
+
+
+def flag_value(flags, name, default):
+	'''
+	Get the current value of a runtime feature flag, or default if there are
+	no flags, or no such flag
+	'''
+	return flags[name] if flags is not None and name in flags else default
+
+
+def make_thread_getter(
+	*,
+	session,
+	cache,
+	token,
+	api=twitter,
+	resolve_quotes=False,
+	forward=False,
+	conversation_search=False,
+	store=None,
+	user_cache=None,
+	budget=UNLIMITED_BUDGET,
+	opt_outs=None,
+	flags=None,
+	limiter=UNLIMITED_RESOLUTIONS,
+	transforms=(),
+):
+	'''
+	Create a get_thread function with all the dependencies filled in. If a
+	ThreadStore is given, resolved threads are saved to it, and if a thread
+	can't be resolved from twitter (for instance, because some of its tweets
+	have been deleted), the stored copy is used instead. If a user_cache is
+	given, the thread's author is replaced with an up to date profile from
+	the cache, which is filled from the api as needed. Each resolution is
+	limited by budget; truncated threads aren't stored. If an OptOutList is
+	given, threads including tweets by opted out authors raise
+	OptedOutError, and aren't stored. If FeatureFlags are given, the
+	resolve_quotes, forward, and conversation_search flags override the
+	arguments of the same names. Resolutions are limited by limiter (a
+	load_shedding.ResolutionLimiter); when it refuses one, the stored copy of
+	the thread is used, or a copy made entirely from the tweet cache, and if
+	there's neither, Overloaded is raised. transforms are async functions
+	taking and returning a Thread, like unshorten.LinkResolver.expand_thread,
+	which are applied in order to every thread gotten; like resolution, they
+	run once for any number of concurrent requests for a thread.
+	'''
+	async def refresh_author(thread):
+		author = thread.author
+		if author is None or user_cache is None or not hasattr(api, "get_user"):
+			return
+
+		try:
+			thread.author = await user_cache.get(author.id)
+			return
+		except KeyNotFound:
+			pass
+
+		try:
+			author = await api.get_user(session=session, token=token, user_id=author.id)
+		except (TwitterError, aiohttp.ClientResponseError):
+			# Fall back to the profile from the tweets, but don't cache it, so
+			# that we try again next time
+			return
+
+		thread.author = author
+		await user_cache.write(author.id, author)
 
-def make_thread_getter(*, session, cache, token):
 	@shared_concurrent
-	def local_get_thread(*, tail, head=None):
-		return get_thread(session=session, cache=cache, token=token, tail=tail, head=head)
+	async def local_get_thread(*, tail, head=None):
+		with tracing.span("get_thread", **{"bobbin.tail": tail, "bobbin.head": head}):
+			thread = await resolve_thread(tail=tail, head=head)
+			await refresh_author(thread)
+
+			for transform in transforms:
+				thread = await transform(thread)
+
+			return thread
+
+	async def resolve_thread(*, tail, head):
+		try:
+			async with limiter.slot():
+				thread = await get_thread(
+					session=session,
+					cache=cache,
+					token=token,
+					tail=tail,
+					head=head,
+					api=api,
+					resolve_quotes=flag_value(flags, "resolve_quotes", resolve_quotes),
+					forward=flag_value(flags, "forward", forward),
+					conversation_search=flag_value(flags, "conversation_search", conversation_search),
+					budget=budget,
+				)
+		except Overloaded:
+			thread = await store.get_thread(tail=tail, head=head) if store is not None else None
+			if thread is None:
+				thread = await cached_thread(cache, tail, head=head)
+			if thread is None:
+				raise
+
+			if opt_outs is not None:
+				opt_outs.check_thread(thread)
+
+			return thread
+		except (TwitterError, aiohttp.ClientResponseError):
+			if store is None:
+				raise
+
+			thread = await store.get_thread(tail=tail, head=head)
+			if thread is None:
+				raise
+
+			if opt_outs is not None:
+				opt_outs.check_thread(thread)
+
+			return thread
+
+		if opt_outs is not None:
+			opt_outs.check_thread(thread)
+
+		if store is not None and thread.truncated is None:
+			try:
+				await store.save_thread(thread)
+			except Exception:
+				# Failing to archive a thread shouldn't prevent serving it
+				logger.exception("Failed to store thread %s", tail)
+
+		return thread
+
 	return local_get_thread
+
+
+def make_private_thread_getter(
+	*,
+	session,
+	api=twitter,
+	resolve_quotes=False,
+	budget=UNLIMITED_BUDGET,
+	opt_outs=None,
+):
+	'''
+	Create a get_private_thread function, which resolves threads with a
+	signed in user's own access token (see accounts.TwitterOAuth2SignIn),
+	so that it can see protected tweets the app can't. Nothing is shared
+	with anyone else: every thread is resolved with its own empty cache,
+	concurrent requests are only combined with the same token's, and nothing
+	is stored. The user token only works with v2, so api should be
+	twitter_v2.
+	'''
+	async def get_private_thread(*, user_token, tail, head=None):
+		thread = await get_thread(
+			session=session,
+			cache=DictCache(),
+			token=f"Bearer {user_token}",
+			tail=tail,
+			head=head,
+			api=api,
+			resolve_quotes=resolve_quotes,
+			budget=budget,
+		)
+
+		if opt_outs is not None:
+			opt_outs.check_thread(thread)
+
+		return thread
+
+	return get_private_thread
+
+
+def make_thread_streamer(
+	*,
+	session,
+	cache,
+	token,
+	api=twitter,
+	resolve_quotes=False,
+	budget=UNLIMITED_BUDGET,
+	opt_outs=None,
+	flags=None,
+	limiter=UNLIMITED_RESOLUTIONS,
+):
+	'''
+	Create a stream_thread function, which iterates over the items of a
+	thread as they're resolved, from the tail backwards, as generate_thread
+	does. This is for showing progress on long threads; the tweets are
+	cached as usual, so a get_thread afterwards is cheap. If an OptOutList is
+	given, the stream stops with OptedOutError at the first tweet by an
+	opted out author. Streams count against limiter for as long as they run.
+	'''
+	async def local_stream_thread(*, tail):
+		items = generate_thread(
+			session=session,
+			cache=cache,
+			token=token,
+			tail=tail,
+			api=api,
+			resolve_quotes=flag_value(flags, "resolve_quotes", resolve_quotes),
+			budget=budget,
+		)
+
+		try:
+			async with limiter.slot():
+				async for item in items:
+					if opt_outs is not None and isinstance(item, Tweet):
+						opt_outs.check_user(item.user)
+					yield item
+		finally:
+			await items.aclose()
+
+	return local_stream_thread
+
+
+def make_tree_getter(*, session, cache, token, api=twitter, opt_outs=None, limiter=UNLIMITED_RESOLUTIONS):
+	@shared_concurrent
+	async def local_get_thread_tree(*, tail):
+		async with limiter.slot():
+			tree = await get_thread_tree(session=session, cache=cache, token=token, tail=tail, api=api)
+
+		if opt_outs is not None:
+			opt_outs.check_thread(tweet for tweet, depth in tree.walk())
+
+		return tree
+	return local_get_thread_tree
+
+
+def make_replies_getter(*, session, token, api=twitter, max_replies=3):
+	'''
+	Create a get_thread_replies function with all the dependencies filled in.
+	The number of replies per tweet is capped at max_replies.
+	'''
+	async def local_get_thread_replies(*, thread, count):
+		return await get_thread_replies(
+			session=session,
+			token=token,
+			thread=thread,
+			max_replies=min(count, max_replies),
+			api=api,
+		)
+	return local_get_thread_replies
@@ -2,10 +2,21 @@
 
 from base64 import b64encode
 from collections import namedtuple
+from datetime import datetime
 from functools import lru_cache
 from urllib.parse import quote as url_encode
+import asyncio
+import logging
+import random
+import time
 
-from bobbin import async_util
+import aiohttp
+
+from bobbin import async_util, middleware
+from bobbin.rate_limit import RateLimiter
+from bobbin.task_manager import TaskLimiter
+
+logger = logging.getLogger(__name__)
 
 BASE_API_URL = "https://api.twitter.com"
 
@@ -16,6 +27,14 @@ RELEASE_URL = f"{BASE_OAUTH_URL}/invalidate_token"
 API_URL = f"{BASE_API_URL}/1.1"
 USER_TIMELINE_URL = f"{API_URL}/statuses/user_timeline"
 TWEET_URL = f"{API_URL}/statuses/show.json"
+LOOKUP_URL = f"{API_URL}/statuses/lookup.json"
+USER_URL = f"{API_URL}/users/show.json"
+
+# Twitter refuses lookups of more than this many tweets in a single request
+MAX_LOOKUP_COUNT = 100
+
+# The maximum number of lookup requests get_tweets will have in flight at once
+MAX_LOOKUP_WORKERS = 4
 
 
 class TwitterError(Exception):
@@ -23,21 +42,84 @@ class TwitterError(Exception):
 
 
 class RateLimitError(TwitterError):
-	pass
+	def __init__(self, endpoint, retry_after=None):
+		super().__init__(endpoint, retry_after)
+		self.endpoint = endpoint
+		self.retry_after = retry_after
+
+
+class TwitterAPIError(TwitterError):
+	'''
+	An error response from twitter that includes error codes, as a list of
+	(code, message) pairs
+	'''
+	def __init__(self, status, errors):
+		super().__init__(status, errors)
+		self.status = status
+		self.errors = errors
+
+	@property
+	def codes(self):
+		return {code for code, message in self.errors}
+
+
+class InvalidTokenError(TwitterError):
+	'''
+	Twitter rejected the bearer token, usually because it was invalidated.
+	token is the rejected token.
+	'''
+	def __init__(self, token):
+		super().__init__(token)
+		self.token = token
+
+
+# Error code for "Invalid or expired token"
+INVALID_TOKEN_CODE = 89
 
 
 class TwitterIDError(TwitterError):
 	pass
 
 
-class NoSuchTweetError(TwitterIDError):
-	pass
+class UnavailableTweetError(TwitterIDError):
+	'''
+	The tweet exists (or existed), but can't be retrieved. reason is a short
+	string describing why, suitable for showing to users.
+	'''
+	reason = "unavailable"
+
+	@property
+	def tweet_id(self):
+		return self.args[0]
+
+
+class NoSuchTweetError(UnavailableTweetError):
+	reason = "deleted"
+
+
+class ProtectedTweetError(UnavailableTweetError):
+	reason = "protected"
+
+
+class SuspendedUserError(UnavailableTweetError):
+	reason = "suspended"
 
 
 class NoSuchUserError(TwitterIDError):
 	pass
 
 
+# Map of v1.1 error code to the UnavailableTweetError it indicates, when
+# looking up a tweet
+UNAVAILABLE_TWEET_CODES = {
+	8: NoSuchTweetError,
+	34: NoSuchTweetError,
+	144: NoSuchTweetError,
+	179: ProtectedTweetError,
+	63: SuspendedUserError,
+}
+
+
 @lru_cache()
 def encode_twitter_key(*, consumer_key: str, consumer_secret: str):
 	return "Basic {code}".format(code=b64encode(
@@ -79,109 +161,931 @@ async def generate_bearer_token(*, session, consumer_key, consumer_secret):
 	return encode_bearer_token(result["access_token"])
 
 
+async def invalidate_bearer_token(*, session, consumer_key, consumer_secret, token):
+	'''
+	Invalidate a bearer token (as returned by generate_bearer_token), so that
+	it can no longer be used. The next generate_bearer_token call for the app
+	will produce a new token.
+	'''
+	headers = {
+		"Authorization": encode_twitter_key(
+			consumer_key=consumer_key,
+			consumer_secret=consumer_secret,
+		),
+		"Content-Type": "application/x-www-form-urlencoded;charset=UTF-8",
+		"Accept": "application/json",
+	}
+
+	access_token = token[len("Bearer "):] if token.startswith("Bearer ") else token
+
+	async with session.post(
+		url=RELEASE_URL,
+		headers=headers,
+		data=f"access_token={url_encode(access_token)}".encode(),
+	) as response:
+		response.raise_for_status()
+
+
+class RetryPolicy(namedtuple("RetryPolicy", "max_attempts base_delay max_delay")):
+	'''
+	Describes how requests are retried after transient failures (server
+	errors, network errors, and rate limiting). Delays grow exponentially from
+	base_delay, capped at max_delay, with full jitter. Rate limited requests
+	wait as long as twitter tells us to, but only if that's no longer than
+	max_delay.
+	'''
+	__slots__ = ()
+
+	def backoff(self, attempt):
+		return random.uniform(0, min(self.max_delay, self.base_delay * 2 ** attempt))
+
+	def retry_delay(self, error, attempt):
+		'''
+		Get the number of seconds to wait before retrying a request that failed
+		with error, or None if it shouldn't be retried.
+		'''
+		if attempt + 1 >= self.max_attempts:
+			return None
+
+		if isinstance(error, RateLimitError):
+			if error.retry_after is None:
+				return self.backoff(attempt)
+			elif error.retry_after <= self.max_delay:
+				return max(error.retry_after, 0)
+			else:
+				return None
+
+		elif isinstance(error, aiohttp.ClientResponseError):
+			# Never retry client errors; a missing tweet isn't going to appear
+			return self.backoff(attempt) if error.status >= 500 else None
+
+		elif isinstance(error, (
+			aiohttp.ClientConnectionError,
+			aiohttp.ClientPayloadError,
+			asyncio.TimeoutError,
+		)):
+			return self.backoff(attempt)
+
+		else:
+			return None
+
+
+DEFAULT_RETRY_POLICY = RetryPolicy(max_attempts=3, base_delay=0.5, max_delay=30)
+
+
 class Token:
-	def __init__(self, session, consumer_key, consumer_secret):
+	'''
+	An app-auth bearer token, generated on demand from the consumer
+	credentials. If a TokenStore is given, the token is loaded from it rather
+	than generated, if possible, and new tokens are saved to it. Requests
+	made with the token go through its middleware (see bobbin.middleware),
+	after the client's own. If there's a cache (an http_cache.HTTPCache),
+	requests go through it before anything else, so that the responses it
+	answers by itself neither spend nor wait for rate limit budget.
+	'''
+	def __init__(
+		self, session, consumer_key, consumer_secret, *,
+		retry_policy=DEFAULT_RETRY_POLICY,
+		store=None,
+		middleware=(),
+		cache=None,
+	):
 		self.session = session
 		self.consumer_key = consumer_key
 		self.consumer_secret = consumer_secret
+		self.retry_policy = retry_policy
+		self.store = store
+		self.middleware = tuple(middleware)
+		self.cache = cache
 		self.token = None
 
+		# The in-flight regeneration, if any, shared by all the requests
+		# waiting on a new token
+		self.regenerating = None
+
+		# App-auth rate limits are tracked per token
+		self.rate_limiter = RateLimiter()
+
 	async def regenerate(self):
 		token = self.token = await generate_bearer_token(
 			session=self.session,
 			consumer_key=self.consumer_key,
 			consumer_secret=self.consumer_secret,
 		)
+
+		if self.store is not None:
+			try:
+				await self.store.save_token(self.consumer_key, token)
+			except Exception:
+				# We have a perfectly good token; it just won't survive a restart
+				logger.exception("Failed to store token")
+
 		return token
 
+	async def refresh(self, stale=None):
+		'''
+		Replace the stale token with a new one. If the token has already been
+		replaced since stale was handed out, the current token is returned
+		as-is, and concurrent refreshes share a single regeneration, so that a
+		burst of rejected requests doesn't mint a burst of tokens.
+		'''
+		token = self.token
+		if token is not None and token != stale:
+			return token
+
+		regenerating = self.regenerating
+		if regenerating is None:
+			regenerating = self.regenerating = asyncio.ensure_future(self.regenerate())
+			regenerating.add_done_callback(lambda task: setattr(self, "regenerating", None))
+
+		return (await asyncio.shield(regenerating))
+
+	async def invalidate(self):
+		'''
+		Invalidate the current token, if there is one, and remove it from the
+		store.
+		'''
+		token = self.token
+		if token is None:
+			return
+
+		self.token = None
+		await invalidate_bearer_token(
+			session=self.session,
+			consumer_key=self.consumer_key,
+			consumer_secret=self.consumer_secret,
+			token=token,
+		)
+
+		if self.store is not None:
+			await self.store.delete_token(self.consumer_key)
+
 	async def get_token(self):
 		token = self.token
+		if token is None and self.store is not None:
+			token = self.token = await self.store.load_token(self.consumer_key)
 		if token is None:
-			token = await self.regenerate()
+			token = await self.refresh()
 		return token
 
 
-class TwitterUser(namedtuple("TwitterUser", "id handle name")):
+class TokenPool:
+	'''
+	A set of Tokens for different apps, used in rotation to spread requests
+	across their rate limits. Tokens that are out of budget for an endpoint
+	are skipped, and tokens whose credentials have been revoked are dropped
+	from the pool entirely. A TokenPool can be used anywhere a Token can.
+	'''
+	def __init__(self, tokens):
+		self.tokens = tuple(tokens)
+		if not self.tokens:
+			raise ValueError("TokenPool requires at least one token")
+
+		self.revoked = set()
+
+		# endpoint -> index of the next token to try for that endpoint
+		self.next_index = {}
+
+	def __len__(self):
+		return len(self.tokens)
+
+	@property
+	def retry_policy(self):
+		return self.tokens[0].retry_policy
+
+	@property
+	def middleware(self):
+		return self.tokens[0].middleware
+
+	@property
+	def cache(self):
+		return self.tokens[0].cache
+
+	def active_tokens(self):
+		return [token for token in self.tokens if token not in self.revoked]
+
+	def has_budget(self, endpoint):
+		return any(token.rate_limiter.has_budget(endpoint) for token in self.active_tokens())
+
+	def next_token(self, endpoint):
+		'''
+		Pick the token to use for the next request to endpoint. Tokens are used
+		round robin, per endpoint, skipping any that are out of budget; if they
+		all are, the one whose budget resets soonest is used.
+		'''
+		tokens = self.active_tokens()
+		start = self.next_index.get(endpoint, 0)
+
+		for offset in range(len(tokens)):
+			index = (start + offset) % len(tokens)
+			token = tokens[index]
+			if token.rate_limiter.has_budget(endpoint):
+				self.next_index[endpoint] = (index + 1) % len(tokens)
+				return token
+
+		return min(tokens, key=lambda token: token.rate_limiter.reset_time(endpoint))
+
+	async def invalidate(self):
+		'''
+		Invalidate all the tokens in the pool. Failures are logged, rather than
+		raised, so that one failure doesn't prevent invalidating the rest.
+		'''
+		results = await asyncio.gather(
+			*(token.invalidate() for token in self.tokens),
+			return_exceptions=True,
+		)
+
+		for token, result in zip(self.tokens, results):
+			if isinstance(result, Exception):
+				logger.error(
+					"Failed to invalidate token for %s", token.consumer_key,
+					exc_info=result,
+				)
+
+	def revoke(self, token):
+		'''
+		Stop using token, because its credentials have been rejected. The last
+		token is never revoked, so that errors are still reported somewhere.
+		Returns True if token is no longer in use.
+		'''
+		if token in self.revoked:
+			return True
+
+		if len(self.active_tokens()) <= 1:
+			return False
+
+		logger.warning("Credentials for %s rejected; removing from pool", token.consumer_key)
+		self.revoked.add(token)
+		return True
+
+
+# The profile fields (avatar_url onwards) are as of when the user was fetched,
+# and may be missing for users embedded in older cached tweets. url is the
+# profile's page, for users from other sources (see source); for twitter
+# users it's None, and the page is found from the handle.
+
+class TwitterUser(namedtuple("TwitterUser", "id handle name avatar_url bio verified followers url")):
 	__slots__ = ()
 
 	@lru_cache()
-	def __new__(cls, id, handle, name):
-		return super().__new__(cls, id, handle, name)
+	def __new__(cls, id, handle, name, avatar_url=None, bio=None, verified=False, followers=None, url=None):
+		return super().__new__(cls, id, handle, name, avatar_url, bio, verified, followers, url)
 
 	@classmethod
 	def from_user_json(cls, blob):
 		return cls(
 			blob["id_str"],
 			blob["screen_name"],
-			blob["name"]
+			blob["name"],
+			blob.get("profile_image_url_https"),
+			blob.get("description"),
+			blob.get("verified", False),
+			blob.get("followers_count"),
+		)
+
+
+# Entity indices are (start, end) pairs of code point offsets into the tweet
+# text. v2 doesn't report indices for media, so they may be None.
+
+class UrlEntity(namedtuple("UrlEntity", "indices url expanded_url display_url")):
+	__slots__ = ()
+
+	@classmethod
+	def from_entity_json(cls, blob):
+		return cls(
+			tuple(blob["indices"]),
+			blob["url"],
+			blob.get("expanded_url"),
+			blob.get("display_url"),
+		)
+
+
+class MentionEntity(namedtuple("MentionEntity", "indices user_id handle")):
+	__slots__ = ()
+
+	@classmethod
+	def from_entity_json(cls, blob):
+		return cls(
+			tuple(blob["indices"]),
+			blob["id_str"],
+			blob["screen_name"],
+		)
+
+
+class HashtagEntity(namedtuple("HashtagEntity", "indices text")):
+	__slots__ = ()
+
+	@classmethod
+	def from_entity_json(cls, blob):
+		return cls(
+			tuple(blob["indices"]),
+			blob["text"],
+		)
+
+
+class VideoVariant(namedtuple("VideoVariant", "content_type bitrate url")):
+	__slots__ = ()
+
+	@classmethod
+	def from_variant_json(cls, blob):
+		# v1.1 calls it bitrate, v2 calls it bit_rate. HLS playlists have
+		# neither.
+		return cls(
+			blob["content_type"],
+			blob.get("bitrate", blob.get("bit_rate")),
+			blob["url"],
+		)
+
+
+class Media(namedtuple("Media", "indices url media_url type width height alt_text variants")):
+	'''
+	A photo, video, or animated_gif attached to a tweet. For videos and gifs,
+	media_url is the preview image, and variants are the available encodings
+	of the video itself.
+	'''
+	__slots__ = ()
+
+	@classmethod
+	def from_entity_json(cls, blob):
+		size = blob.get("original_info") or blob.get("sizes", {}).get("large", {})
+		return cls(
+			tuple(blob["indices"]),
+			blob["url"],
+			blob["media_url_https"],
+			blob["type"],
+			size.get("width", size.get("w")),
+			size.get("height", size.get("h")),
+			blob.get("ext_alt_text"),
+			tuple(map(VideoVariant.from_variant_json, blob.get("video_info", {}).get("variants", ()))),
+		)
+
+	def best_variant(self, max_bitrate=None):
+		'''
+		Get the highest bitrate mp4 variant of this video, optionally limited
+		to at most max_bitrate, or None if there are no suitable variants.
+		'''
+		candidates = [
+			variant for variant in self.variants
+			if variant.content_type == "video/mp4"
+			and variant.bitrate is not None
+			and (max_bitrate is None or variant.bitrate <= max_bitrate)
+		]
+
+		return max(candidates, key=lambda variant: variant.bitrate, default=None)
+
+
+class Entities(namedtuple("Entities", "urls mentions hashtags media")):
+	__slots__ = ()
+
+	@classmethod
+	def from_tweet_json(cls, blob):
+		'''
+		Collect the entities from a v1.1 tweet. Media is taken from
+		extended_entities, which (unlike entities) includes every attached
+		photo.
+		'''
+		entities = blob.get("entities", {})
+		extended_entities = blob.get("extended_entities", {})
+
+		return cls(
+			tuple(map(UrlEntity.from_entity_json, entities.get("urls", ()))),
+			tuple(map(MentionEntity.from_entity_json, entities.get("user_mentions", ()))),
+			tuple(map(HashtagEntity.from_entity_json, entities.get("hashtags", ()))),
+			tuple(map(Media.from_entity_json, extended_entities.get("media", ()))),
+		)
+
+
+class PublicMetrics(namedtuple("PublicMetrics", "likes retweets replies quotes")):
+	'''
+	Engagement counts for a tweet. v1.1 doesn't report replies or quotes, so
+	those may be None.
+	'''
+	__slots__ = ()
+
+	@classmethod
+	def from_tweet_json(cls, blob):
+		return cls(
+			blob.get("favorite_count", 0),
+			blob.get("retweet_count", 0),
+			blob.get("reply_count"),
+			blob.get("quote_count"),
 		)
 
+	@classmethod
+	def total(cls, all_metrics):
+		'''
+		Add up some PublicMetrics, skipping any Nones, or return None if there
+		are none. replies and quotes are only totalled if they're known for
+		every tweet.
+		'''
+		all_metrics = [metrics for metrics in all_metrics if metrics is not None]
+		if not all_metrics:
+			return None
+
+		def total(field):
+			values = [getattr(metrics, field) for metrics in all_metrics]
+			return sum(values) if None not in values else None
+
+		return cls(*map(total, cls._fields))
+
+
+class PollOption(namedtuple("PollOption", "position label votes")):
+	__slots__ = ()
+
 
-class Tweet(namedtuple("Tweet", "id user parent_id parent_user_id")):
+class Poll(namedtuple("Poll", "id options end_datetime duration_minutes voting_status")):
+	'''
+	A poll attached to a tweet. options are PollOptions, in position order.
+	voting_status is "open" or "closed". Only v2 reports polls.
+	'''
+	__slots__ = ()
+
+	@property
+	def total_votes(self):
+		return sum(option.votes for option in self.options)
+
+	@property
+	def closed(self):
+		return self.voting_status == "closed"
+
+	def percentages(self):
+		'''
+		Get each option's share of the votes, as a whole percentage, in order
+		'''
+		total = self.total_votes
+		return [round(option.votes * 100 / total) if total else 0 for option in self.options]
+
+
+def parse_created_at(created_at):
+	return datetime.strptime(created_at, "%a %b %d %H:%M:%S %z %Y")
+
+
+# Note that twitter html-escapes &, <, and > in tweet text, and that entity
+# indices refer to the escaped text. Consumers are responsible for unescaping.
+
+# If a tweet quotes another tweet, quoted_id is its id. quoted is the quoted
+# Tweet itself, if it's been resolved; v1.1 includes it in the response, but
+# otherwise it's only resolved if the thread was requested with quotes.
+#
+# conversation_id is the id of the tweet at the root of the reply tree; it's
+# only available from v2. metrics are the PublicMetrics as of when the tweet
+# was fetched. poll is the tweet's Poll, if it has one (v2 only). card is a
+# link_cards.Card for the tweet's first link, which is only ever added after
+# the tweet is fetched (see link_cards.CardFetcher.add_cards).
+#
+# edit_history is the ids of every version of the tweet, oldest first, if
+# it's known (v2 only). An old version of an edited tweet is still served
+# under its own id, so if the last id isn't the tweet's own, the tweet has
+# been edited since.
+#
+# url is the tweet's page, for posts from other sources (see source), which
+# are made into Tweets so that they can be rendered the same way. It's None
+# for tweets, whose pages are found from their ids.
+
+class Tweet(namedtuple("Tweet", "id user parent_id parent_user_id text created_at entities quoted_id quoted conversation_id metrics poll card edit_history url")):
 	__slots__ = ()
 
 	@lru_cache()
-	def __new__(cls, id, user, parent, parent_user_id):
-		return super().__new__(cls, id, user, parent, parent_user_id)
+	def __new__(
+		cls, id, user, parent, parent_user_id, text, created_at, entities,
+		quoted_id=None, quoted=None, conversation_id=None, metrics=None, poll=None,
+		card=None, edit_history=None, url=None,
+	):
+		return super().__new__(
+			cls, id, user, parent, parent_user_id, text, created_at, entities,
+			quoted_id, quoted, conversation_id, metrics, poll, card, edit_history, url,
+		)
+
+	@property
+	def latest_version_id(self):
+		return self.edit_history[-1] if self.edit_history else self.id
 
 	@classmethod
 	def from_tweet_json(cls, blob):
+		'''
+		Create a Tweet from a v1.1 tweet object. The tweet should have been
+		requested with tweet_mode=extended, so that the text isn't truncated.
+		Tweets in compatibility mode (like those from the streaming API) have
+		their full text and entities in extended_tweet instead, if they're
+		long, which is used if it's there.
+		'''
+		quoted = blob.get("quoted_status")
+		extended = blob.get("extended_tweet")
+
 		return cls(
 			blob["id_str"],
 			TwitterUser.from_user_json(blob["user"]),
 			blob["in_reply_to_status_id_str"],
 			blob["in_reply_to_user_id_str"],
+			extended["full_text"] if extended is not None else blob.get("full_text", blob.get("text")),
+			parse_created_at(blob["created_at"]),
+			Entities.from_tweet_json(extended if extended is not None else blob),
+			blob.get("quoted_status_id_str"),
+			cls.from_tweet_json(quoted) if quoted is not None else None,
+			None,
+			PublicMetrics.from_tweet_json(blob),
 		)
 
 
-# TODO: find a better way to report errors related to rate limiting
+def get_retry_after(headers):
+	'''
+	Get the number of seconds until a rate limited request can be retried,
+	from either the Retry-After header or the rate limit reset time.
+	'''
+	try:
+		return int(headers["retry-after"])
+	except (KeyError, ValueError):
+		pass
+
+	try:
+		return int(headers["x-rate-limit-reset"]) - time.time()
+	except (KeyError, ValueError):
+		return None
+
+
+def errors_from_json(result):
+	'''
+	Get the list of (code, message) errors from a v1.1 error response body,
+	if it has any
+	'''
+	try:
+		return [(error["code"], error["message"]) for error in result["errors"]]
+	except (KeyError, TypeError):
+		return []
+
+
+async def get_errors(response):
+	'''
+	Get the list of (code, message) errors from a v1.1 error response, if it
+	has any
+	'''
+	try:
+		result = await response.json(content_type=None)
+	except ValueError:
+		return []
+	return errors_from_json(result)
+
+
+def retried(send):
+	'''
+	Middleware that retries failed requests according to the token's retry
+	policy, picking the token for each attempt. If a token is rejected, it's
+	regenerated and the request is retried once; with a TokenPool, rate
+	limited and revoked tokens fail over to the next token in the pool.
+	'''
+	async def retried_handler(request):
+		token = request.token
+		retry_policy = token.retry_policy if isinstance(token, (Token, TokenPool)) else DEFAULT_RETRY_POLICY
+		pool = token if isinstance(token, TokenPool) else None
+		attempt = 0
+		failovers = 0
+		refreshed = set()
+
+		while True:
+			# Each attempt may use a different token from a pool
+			current = pool.next_token(request.endpoint) if pool is not None else token
+
+			try:
+				return await send(request._replace(token=current))
+			except InvalidTokenError as e:
+				if not isinstance(current, Token):
+					raise
+
+				if current not in refreshed:
+					refreshed.add(current)
+					try:
+						await current.refresh(e.token)
+					except aiohttp.ClientResponseError:
+						# The app's credentials themselves have been rejected
+						if pool is None or not pool.revoke(current):
+							raise
+					continue
+
+				if pool is not None and pool.revoke(current):
+					continue
+
+				raise
+			except Exception as e:
+				# If another token in the pool still has budget, fail over to
+				# it immediately, rather than waiting out the rate limit
+				if (
+					isinstance(e, RateLimitError) and
+					pool is not None and
+					failovers < len(pool) - 1 and
+					pool.has_budget(request.endpoint)
+				):
+					failovers += 1
+					continue
+
+				delay = retry_policy.retry_delay(e, attempt)
+				if delay is None:
+					raise
+
+			await asyncio.sleep(delay)
+			attempt += 1
+
+	return retried_handler
+
+
+def authorized(send):
+	'''
+	Middleware that adds the bearer token to requests. request.token may be a
+	Token, or a raw bearer token string.
+	'''
+	async def authorized_handler(request):
+		token = request.token
+		if isinstance(token, Token):
+			token = await token.get_token()
+
+		return await send(request.with_headers({"Authorization": token, "Accept": "application/json"}))
+
+	return authorized_handler
+
+
+def checked(send):
+	'''
+	Middleware that turns error responses into exceptions: RateLimitError,
+	InvalidTokenError, TwitterAPIError for errors with codes, or else
+	aiohttp.ClientResponseError
+	'''
+	async def checked_handler(request):
+		response = await send(request)
+
+		if response.status == 429:
+			raise RateLimitError(request.endpoint, get_retry_after(response.headers))
+
+		if response.status == 401:
+			raise InvalidTokenError(request.headers["Authorization"])
+
+		if response.status in (403, 404):
+			errors = errors_from_json(response.body)
+			if any(code == INVALID_TOKEN_CODE for code, message in errors):
+				raise InvalidTokenError(request.headers["Authorization"])
+			if errors:
+				raise TwitterAPIError(response.status, errors)
+
+		if response.status >= 400:
+			raise aiohttp.ClientResponseError(
+				None, (),
+				status=response.status,
+				message=f"Error response from {request.endpoint}",
+				headers=response.headers,
+			)
+
+		return response
+
+	return checked_handler
+
+
+def rate_limited(send):
+	'''
+	Middleware that delays requests made with a Token as necessary to stay
+	within the token's rate limits for the request's endpoint, and updates
+	them from every response
+	'''
+	async def rate_limited_handler(request):
+		rate_limiter = request.token.rate_limiter if isinstance(request.token, Token) else None
+		if rate_limiter is not None:
+			await rate_limiter.acquire(request.endpoint)
+
+		response = await send(request)
+
+		if rate_limiter is not None:
+			rate_limiter.update(request.endpoint, response.headers)
+		return response
+
+	return rate_limited_handler
+
+
+# The middleware every request goes through, outermost first. A token's own
+# middleware (see Token) goes inside these, next to the network.
+CLIENT_MIDDLEWARE = (retried, authorized, checked, rate_limited)
+
+
+async def request_json(*, session, token, url, params, endpoint=None):
+	'''
+	Make an authorized GET request to the twitter API, returning the parsed
+	json body. token may be a Token, a TokenPool, or a raw bearer token
+	string. For Tokens, requests are delayed as necessary to stay within the
+	rate limits for endpoint, which defaults to the url; pass it explicitly
+	for urls that include ids. Transient failures are retried according to
+	the token's retry policy. See CLIENT_MIDDLEWARE for everything a request
+	goes through.
+	'''
+	if isinstance(token, (Token, TokenPool)):
+		outer = (token.cache,) if token.cache is not None else ()
+		extra = token.middleware
+	else:
+		outer = extra = ()
+	handler = middleware.chain(*outer, *CLIENT_MIDDLEWARE, *extra)
+
+	response = await handler(middleware.ApiRequest(
+		session=session,
+		token=token,
+		url=url,
+		params=params,
+		headers={},
+		endpoint=endpoint if endpoint is not None else url,
+	))
+	return response.json()
+
 
 @async_util.shared_concurrent
 async def get_tweet(*, session, token, tweet_id):
-	if isinstance(token, Token):
-		token = await token.get_token()
-
-	async with session.get(
-		url=TWEET_URL,
-		params={
-			"id": tweet_id,
-			"include_entities": "false",
-			"include_ext_alt_text": "false",
-		},
-		headers={
-			"Authorization": token,
-			"Accept": "application/json",
-		}
-	) as response:
-		response.raise_for_status()
-		result = await response.json()
+	try:
+		result = await request_json(
+			session=session,
+			token=token,
+			url=TWEET_URL,
+			params={
+				"id": tweet_id,
+				"tweet_mode": "extended",
+				"include_entities": "true",
+				"include_ext_alt_text": "true",
+			},
+		)
+	except TwitterAPIError as e:
+		for code in e.codes:
+			if code in UNAVAILABLE_TWEET_CODES:
+				raise UNAVAILABLE_TWEET_CODES[code](tweet_id) from e
+		raise
 
 	return Tweet.from_tweet_json(result)
 
 
 @async_util.shared_concurrent
-async def get_user_tweets(*, session, token, user_id, max_tweet, count=200):
-	if isinstance(token, Token):
-		token = await token.get_token()
+async def get_user_tweets(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200):
+	'''
+	Get a page of a user's timeline, newest first. max_tweet is inclusive and
+	since_tweet is exclusive; either can be None to leave that end open.
+	'''
+	params = {
+		"user_id": user_id,
+		"count": count,
+		"exclude_replies": "false",
+		"include_rts": "true",
+		"tweet_mode": "extended",
+		"include_ext_alt_text": "true",
+	}
+
+	if max_tweet is not None:
+		params["max_id"] = max_tweet
 
-	async with session.get(
+	if since_tweet is not None:
+		params["since_id"] = since_tweet
+
+	# TODO: handle errors better
+	result = await request_json(
+		session=session,
+		token=token,
 		url=USER_TIMELINE_URL,
-		params={
-			"user_id": user_id,
-			"count": count,
-			"max_id": max_tweet,
-			"exclude_replies": "false",
-			"include_rts": "true",
-		},
-		headers={
-			"Authorization": token,
-			"Accept": "application/json"
-		},
-	) as response:
-		# TODO: handle errors better
-		response.raise_for_status()
-		result = await response.json()
+		params=params,
+	)
 
 	# Ordinarily I dislike pre-emptively unrolling iterators like this, but in
 	# this case we don't want to carry around the immense json value.
 	return list(map(Tweet.from_tweet_json, result))
+
+
+class TimelinePager:
+	'''
+	Walks a user's timeline backwards, a page at a time, newest first.
+	fetch_page is an async function taking a cursor (None for the first page)
+	and returning (tweets, cursor), where cursor is None if there are no more
+	pages. Get each page with next(), or iterate over the pages with async
+	for. If a page fails, calling next() again retries it.
+	'''
+	def __init__(self, fetch_page):
+		self.fetch_page = fetch_page
+		self.cursor = None
+		self.done = False
+
+	async def next(self):
+		'''
+		Get the next page of tweets, or an empty list once the timeline is
+		exhausted
+		'''
+		if self.done:
+			return []
+
+		tweets, self.cursor = await self.fetch_page(self.cursor)
+		if not tweets or self.cursor is None:
+			self.done = True
+
+		return tweets
+
+	def __aiter__(self):
+		return self
+
+	async def __anext__(self):
+		page = await self.next()
+		if not page:
+			raise StopAsyncIteration
+		return page
+
+
+def user_timeline(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200):
+	'''
+	Get a TimelinePager over a user's timeline, from max_tweet (inclusive)
+	back to since_tweet (exclusive); either can be None to leave that end
+	open.
+	'''
+	async def fetch_page(cursor):
+		tweets = await get_user_tweets(
+			session=session,
+			token=token,
+			user_id=user_id,
+			max_tweet=max_tweet if cursor is None else cursor,
+			since_tweet=since_tweet,
+			count=count,
+		)
+
+		if not tweets:
+			return tweets, None
+
+		# max_id is inclusive, so the next page has to end just before the
+		# oldest tweet in this one, or that tweet would be fetched again
+		next_max = min(int(tweet.id) for tweet in tweets) - 1
+		if next_max < 1 or (since_tweet is not None and next_max <= int(since_tweet)):
+			return tweets, None
+
+		return tweets, str(next_max)
+
+	return TimelinePager(fetch_page)
+
+
+@async_util.shared_concurrent
+async def get_user(*, session, token, user_id):
+	try:
+		result = await request_json(
+			session=session,
+			token=token,
+			url=USER_URL,
+			params={"user_id": user_id},
+		)
+	except TwitterAPIError as e:
+		# User not found, or suspended
+		if e.codes & {50, 63}:
+			raise NoSuchUserError(user_id) from e
+		raise
+
+	return TwitterUser.from_user_json(result)
+
+
+async def lookup_chunked(lookup, tweet_ids, *, chunk_size=MAX_LOOKUP_COUNT, max_workers=MAX_LOOKUP_WORKERS):
+	'''
+	Split tweet_ids into chunks of at most chunk_size, and call lookup with
+	each chunk (as a tuple). At most max_workers lookups are run concurrently.
+	lookup should return an iterable of Tweets; these are all merged into a
+	single dict of tweet id to Tweet. If any lookup fails, the others are
+	cancelled.
+	'''
+	# Deduplicate while preserving order, so that chunks are stable
+	tweet_ids = list(dict.fromkeys(tweet_ids))
+	limiter = TaskLimiter(max_workers)
+
+	tasks = [
+		limiter.schedule(lookup, tuple(tweet_ids[index:index + chunk_size]))
+		for index in range(0, len(tweet_ids), chunk_size)
+	]
+
+	try:
+		results = await asyncio.gather(*tasks)
+	finally:
+		for task in tasks:
+			task.cancel()
+
+	return {tweet.id: tweet for chunk in results for tweet in chunk}
+
+
+@async_util.shared_concurrent
+async def lookup_tweets(*, session, token, tweet_ids):
+	'''
+	Look up a single chunk of tweets. Tweets that don't exist (or aren't
+	visible) are silently omitted by twitter. Generally you want get_tweets
+	instead, which handles chunking.
+	'''
+	result = await request_json(
+		session=session,
+		token=token,
+		url=LOOKUP_URL,
+		params={
+			"id": ",".join(tweet_ids),
+			"tweet_mode": "extended",
+			"include_entities": "true",
+			"include_ext_alt_text": "true",
+		},
+	)
+
+	return list(map(Tweet.from_tweet_json, result))
+
+
+async def get_tweets(*, session, token, tweet_ids):
+	'''
+	Look up any number of tweets, returning a dict of tweet id to Tweet.
+	Missing tweets are omitted from the result.
+	'''
+	return await lookup_chunked(
+		lambda chunk: lookup_tweets(session=session, token=token, tweet_ids=chunk),
+		tweet_ids,
+	)
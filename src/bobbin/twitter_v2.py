@@ -0,0 +1,464 @@
+# Low level async interface for the twitter v2 API. This module exposes the
+# same functions as bobbin.twitter, returning the same Tweet and TwitterUser
+# types, so that either module can be used as the api in tweetbox.
+
+from collections import namedtuple
+from datetime import datetime
+
+from bobbin import async_util
+from bobbin.twitter import (
+	BASE_API_URL,
+	Entities,
+	HashtagEntity,
+	Media,
+	MentionEntity,
+	NoSuchTweetError,
+	NoSuchUserError,
+	Poll,
+	PollOption,
+	ProtectedTweetError,
+	PublicMetrics,
+	TimelinePager,
+	Tweet,
+	TwitterUser,
+	UrlEntity,
+	VideoVariant,
+	lookup_chunked,
+	request_json,
+)
+
+API_URL = f"{BASE_API_URL}/2"
+TWEETS_URL = f"{API_URL}/tweets"
+USER_URL = f"{API_URL}/users"
+USER_TWEETS_URL = f"{API_URL}/users/{{user_id}}/tweets"
+SEARCH_RECENT_URL = f"{API_URL}/tweets/search/recent"
+
+# v2 returns only the id and text of a tweet by default. Everything else has
+# to be explicitly requested, either as a field on the object itself or as an
+# expansion, which includes related objects in the "includes" section of the
+# response.
+EXPANSIONS = (
+	"author_id",
+	"attachments.media_keys",
+	"attachments.poll_ids",
+	"referenced_tweets.id",
+	"referenced_tweets.id.author_id",
+)
+TWEET_FIELDS = (
+	"author_id",
+	"in_reply_to_user_id",
+	"referenced_tweets",
+	"conversation_id",
+	"created_at",
+	"entities",
+	"attachments",
+	"public_metrics",
+	"edit_history_tweet_ids",
+)
+USER_FIELDS = ("username", "name", "profile_image_url", "description", "verified", "public_metrics")
+MEDIA_FIELDS = ("url", "type", "preview_image_url", "width", "height", "alt_text", "variants")
+POLL_FIELDS = ("options", "end_datetime", "duration_minutes", "voting_status")
+
+# The v2 timeline and search endpoints refuse to return more than this many
+# tweets per page.
+MAX_TIMELINE_COUNT = 100
+MAX_SEARCH_COUNT = 100
+
+
+def fields_params(
+	*,
+	expansions=EXPANSIONS,
+	tweet_fields=TWEET_FIELDS,
+	user_fields=USER_FIELDS,
+	media_fields=MEDIA_FIELDS,
+	poll_fields=POLL_FIELDS,
+):
+	'''
+	Build the expansions and fields query parameters for a request. Empty
+	groups are omitted entirely, since twitter rejects empty values.
+	'''
+	params = {
+		"expansions": ",".join(expansions),
+		"tweet.fields": ",".join(tweet_fields),
+		"user.fields": ",".join(user_fields),
+		"media.fields": ",".join(media_fields),
+		"poll.fields": ",".join(poll_fields),
+	}
+	return {key: value for key, value in params.items() if value}
+
+
+def user_from_json(blob):
+	return TwitterUser(
+		blob["id"],
+		blob["username"],
+		blob["name"],
+		blob.get("profile_image_url"),
+		blob.get("description"),
+		blob.get("verified", False),
+		blob.get("public_metrics", {}).get("followers_count"),
+	)
+
+
+def media_from_json(blob):
+	# Videos and gifs don't have a url, only a preview image
+	return Media(
+		None,
+		None,
+		blob.get("url", blob.get("preview_image_url")),
+		blob["type"],
+		blob.get("width"),
+		blob.get("height"),
+		blob.get("alt_text"),
+		tuple(map(VideoVariant.from_variant_json, blob.get("variants", ()))),
+	)
+
+
+def poll_from_json(blob):
+	end_datetime = blob.get("end_datetime")
+
+	return Poll(
+		blob["id"],
+		tuple(
+			PollOption(option["position"], option["label"], option.get("votes", 0))
+			for option in sorted(blob.get("options", ()), key=lambda option: option["position"])
+		),
+		parse_created_at(end_datetime) if end_datetime is not None else None,
+		blob.get("duration_minutes"),
+		blob.get("voting_status"),
+	)
+
+
+class Includes(namedtuple("Includes", "users media tweets polls")):
+	'''
+	The objects from the "includes" section of a response, as dicts of id to
+	TwitterUser, media key to Media, id to (unparsed) referenced tweet, and
+	id to Poll
+	'''
+	__slots__ = ()
+
+	@classmethod
+	def from_result_json(cls, result):
+		includes = result.get("includes", {})
+		return cls(
+			{user["id"]: user_from_json(user) for user in includes.get("users", ())},
+			{media["media_key"]: media_from_json(media) for media in includes.get("media", ())},
+			{tweet["id"]: tweet for tweet in includes.get("tweets", ())},
+			{poll["id"]: poll_from_json(poll) for poll in includes.get("polls", ())},
+		)
+
+
+def entity_indices(blob):
+	return (blob["start"], blob["end"])
+
+
+def entities_from_json(blob, includes):
+	entities = blob.get("entities", {})
+	media_keys = blob.get("attachments", {}).get("media_keys", ())
+
+	# v2 doesn't attach the t.co url to the media object itself; instead, it
+	# appears as a url entity with a media_key.
+	media_urls = {
+		url["media_key"]: url for url in entities.get("urls", ())
+		if "media_key" in url
+	}
+
+	return Entities(
+		tuple(
+			UrlEntity(entity_indices(url), url["url"], url.get("expanded_url"), url.get("display_url"))
+			for url in entities.get("urls", ())
+			if "media_key" not in url
+		),
+		tuple(
+			MentionEntity(entity_indices(mention), mention.get("id"), mention["username"])
+			for mention in entities.get("mentions", ())
+		),
+		tuple(
+			HashtagEntity(entity_indices(hashtag), hashtag["tag"])
+			for hashtag in entities.get("hashtags", ())
+		),
+		tuple(
+			includes.media[key]._replace(
+				indices=entity_indices(media_urls[key]) if key in media_urls else None,
+				url=media_urls[key]["url"] if key in media_urls else None,
+			)
+			for key in media_keys
+			if key in includes.media
+		),
+	)
+
+
+def parse_created_at(created_at):
+	# Twitter always uses UTC with millisecond precision, like
+	# 2018-10-10T20:19:24.000Z
+	return datetime.strptime(created_at.replace("Z", "+0000"), "%Y-%m-%dT%H:%M:%S.%f%z")
+
+
+def metrics_from_json(blob):
+	metrics = blob.get("public_metrics")
+	if metrics is None:
+		return None
+
+	return PublicMetrics(
+		metrics.get("like_count", 0),
+		metrics.get("retweet_count", 0),
+		metrics.get("reply_count", 0),
+		metrics.get("quote_count", 0),
+	)
+
+
+def referenced_id(blob, ref_type):
+	return next((
+		ref["id"] for ref in blob.get("referenced_tweets", ())
+		if ref["type"] == ref_type
+	), None)
+
+
+def tweet_from_json(blob, includes, *, resolve_quoted=True):
+	'''
+	Create a Tweet from a v2 tweet object. includes is the Includes from the
+	response, which must include the author of the tweet. If the quoted tweet
+	(if any) is also in includes, it's attached to the tweet.
+	'''
+	parent_id = referenced_id(blob, "replied_to")
+	quoted_id = referenced_id(blob, "quoted")
+
+	quoted = None
+	if resolve_quoted and quoted_id in includes.tweets:
+		quoted_blob = includes.tweets[quoted_id]
+		# The quoted tweet's author might be missing if it's been deleted or
+		# suspended; in that case, just skip the quote.
+		if quoted_blob.get("author_id") in includes.users:
+			quoted = tweet_from_json(quoted_blob, includes, resolve_quoted=False)
+
+	return Tweet(
+		blob["id"],
+		includes.users[blob["author_id"]],
+		parent_id,
+		blob.get("in_reply_to_user_id"),
+		blob["text"],
+		parse_created_at(blob["created_at"]),
+		entities_from_json(blob, includes),
+		quoted_id,
+		quoted,
+		blob.get("conversation_id"),
+		metrics_from_json(blob),
+		next((
+			includes.polls[poll_id]
+			for poll_id in blob.get("attachments", {}).get("poll_ids", ())
+			if poll_id in includes.polls
+		), None),
+		edit_history=tuple(blob["edit_history_tweet_ids"]) if "edit_history_tweet_ids" in blob else None,
+	)
+
+
+def unavailable_error(tweet_id, errors):
+	'''
+	Create the appropriate UnavailableTweetError from the errors in a response
+	that didn't include the requested tweet. v2 errors are identified by a
+	problem type url, rather than a code.
+	'''
+	for error in errors:
+		if error.get("type", "").endswith("/not-authorized-for-resource"):
+			return ProtectedTweetError(tweet_id)
+
+	return NoSuchTweetError(tweet_id)
+
+
+@async_util.shared_concurrent
+async def get_tweet(*, session, token, tweet_id):
+	result = await request_json(
+		session=session,
+		token=token,
+		url=f"{TWEETS_URL}/{tweet_id}",
+		params=fields_params(),
+		endpoint=f"{TWEETS_URL}/:id",
+	)
+
+	# Unlike v1.1, a missing tweet is reported with a successful response
+	# containing only an "errors" section.
+	if "data" not in result:
+		raise unavailable_error(tweet_id, result.get("errors", ()))
+
+	return tweet_from_json(result["data"], Includes.from_result_json(result))
+
+
+@async_util.shared_concurrent
+async def get_user(*, session, token, user_id):
+	result = await request_json(
+		session=session,
+		token=token,
+		url=f"{USER_URL}/{user_id}",
+		params={"user.fields": ",".join(USER_FIELDS)},
+		endpoint=f"{USER_URL}/:id",
+	)
+
+	if "data" not in result:
+		raise NoSuchUserError(user_id)
+
+	return user_from_json(result["data"])
+
+
+@async_util.shared_concurrent
+async def get_user_tweets_page(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200, pagination_token=None):
+	'''
+	Get a page of a user's timeline, and the pagination token for the next
+	page (None if this was the last one). The bounds have the same meaning
+	as in twitter.get_user_tweets, and have to be the same for every page.
+	'''
+	params = {
+		"max_results": max(5, min(count, MAX_TIMELINE_COUNT)),
+		**fields_params(),
+	}
+
+	# until_id is exclusive, while max_tweet (like the v1.1 max_id) is
+	# inclusive
+	if max_tweet is not None:
+		params["until_id"] = str(int(max_tweet) + 1)
+
+	if since_tweet is not None:
+		params["since_id"] = since_tweet
+
+	if pagination_token is not None:
+		params["pagination_token"] = pagination_token
+
+	# TODO: handle errors better
+	result = await request_json(
+		session=session,
+		token=token,
+		url=USER_TWEETS_URL.format(user_id=user_id),
+		params=params,
+		endpoint=USER_TWEETS_URL,
+	)
+
+	includes = Includes.from_result_json(result)
+	tweets = [tweet_from_json(blob, includes) for blob in result.get("data", ())]
+	return tweets, result.get("meta", {}).get("next_token")
+
+
+async def get_user_tweets(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200):
+	tweets, _ = await get_user_tweets_page(
+		session=session,
+		token=token,
+		user_id=user_id,
+		max_tweet=max_tweet,
+		since_tweet=since_tweet,
+		count=count,
+	)
+	return tweets
+
+
+def user_timeline(*, session, token, user_id, max_tweet=None, since_tweet=None, count=200):
+	async def fetch_page(cursor):
+		return await get_user_tweets_page(
+			session=session,
+			token=token,
+			user_id=user_id,
+			max_tweet=max_tweet,
+			since_tweet=since_tweet,
+			count=count,
+			pagination_token=cursor,
+		)
+
+	return TimelinePager(fetch_page)
+
+
+@async_util.shared_concurrent
+async def lookup_tweets(*, session, token, tweet_ids):
+	result = await request_json(
+		session=session,
+		token=token,
+		url=TWEETS_URL,
+		params={
+			"ids": ",".join(tweet_ids),
+			**fields_params(),
+		},
+	)
+
+	# Missing tweets are reported in "errors"; like v1.1, we simply omit them
+	includes = Includes.from_result_json(result)
+	return [tweet_from_json(blob, includes) for blob in result.get("data", ())]
+
+
+async def get_tweets(*, session, token, tweet_ids):
+	return await lookup_chunked(
+		lambda chunk: lookup_tweets(session=session, token=token, tweet_ids=chunk),
+		tweet_ids,
+	)
+
+
+def conversation_pager(*, session, token, conversation_id, author_id):
+	'''
+	Get a TimelinePager over the tweets by author_id in the conversation
+	rooted at conversation_id, newest first, using the recent search
+	endpoint. Recent search only covers the last 7 days, so older tweets are
+	silently missing.
+	'''
+	params = {
+		"query": f"conversation_id:{conversation_id} from:{author_id}",
+		"max_results": MAX_SEARCH_COUNT,
+		**fields_params(),
+	}
+
+	async def fetch_page(cursor):
+		result = await request_json(
+			session=session,
+			token=token,
+			url=SEARCH_RECENT_URL,
+			params=params if cursor is None else {**params, "next_token": cursor},
+		)
+
+		includes = Includes.from_result_json(result)
+		tweets = [tweet_from_json(blob, includes) for blob in result.get("data", ())]
+		return tweets, result.get("meta", {}).get("next_token")
+
+	return TimelinePager(fetch_page)
+
+
+async def search_conversation(*, session, token, conversation_id, author_id, max_pages=10):
+	'''
+	Find all the tweets by author_id in the conversation rooted at
+	conversation_id (see conversation_pager), from at most max_pages pages.
+	Returns a list of Tweets, newest first.
+	'''
+	pager = conversation_pager(
+		session=session,
+		token=token,
+		conversation_id=conversation_id,
+		author_id=author_id,
+	)
+
+	tweets = []
+
+	for _ in range(max_pages):
+		page = await pager.next()
+		if not page:
+			break
+
+		tweets.extend(page)
+
+	return tweets
+
+
+async def get_replies(*, session, token, tweet_id, exclude_user_id=None):
+	'''
+	Find recent replies to tweet_id, optionally excluding those from
+	exclude_user_id (usually the author of the tweet). Like all recent search,
+	this only covers the last 7 days. Only one page of replies is fetched.
+	'''
+	query = f"in_reply_to_tweet_id:{tweet_id}"
+	if exclude_user_id is not None:
+		query = f"{query} -from:{exclude_user_id}"
+
+	result = await request_json(
+		session=session,
+		token=token,
+		url=SEARCH_RECENT_URL,
+		params={
+			"query": query,
+			"max_results": MAX_SEARCH_COUNT,
+			**fields_params(),
+		},
+	)
+
+	includes = Includes.from_result_json(result)
+	return [tweet_from_json(blob, includes) for blob in result.get("data", ())]
@@ -0,0 +1,101 @@
+# Command line tool to resolve a single thread and print it, using the same
+# configuration as the server.
+
+import os
+import sys
+
+from autocommand import autocommand
+
+from bobbin import api_server, async_cache, config as bobbin_config, pdf_export, recording, render, tweetbox, twitter
+from bobbin.main import make_api, make_session
+from bobbin.tweet_url import parse_tweet_id
+
+formats = {
+	"text": render.thread_text,
+	"markdown": render.thread_markdown,
+	"json": api_server.thread_json,
+}
+
+# PDFs are binary, and need their images fetched, so they're made separately
+PDF_FORMAT = "pdf"
+
+
+@autocommand(__name__, loop=True, pass_loop=True)
+async def main(
+	tweet,
+	format="text",
+	key: str =None,
+	secret: str =None,
+	nitter_url: str =None,
+	api_version: int =None,
+	resolve_quotes=False,
+	record_dir: str =None,
+	replay_dir: str =None,
+	config_file: str =os.environ.get("BOBBIN_CONFIG", None),
+	loop=None,
+):
+	'''
+	Resolve the thread ending at tweet (an id or a link to a tweet), and print
+	it to stdout in the given format. PDFs (--format pdf) are written to
+	stdout as they are, so redirect it to a file.
+	'''
+	tweet_id = parse_tweet_id(tweet)
+	if tweet_id is None:
+		return f"Not a tweet id or link: {tweet}"
+
+	if format == PDF_FORMAT:
+		if not pdf_export.available():
+			return "--format pdf requires reportlab (pip install bobbin[pdf])"
+		renderer = None
+	else:
+		try:
+			renderer = formats[format]
+		except KeyError:
+			return "--format must be one of: {}".format(", ".join([*formats, PDF_FORMAT]))
+
+	try:
+		config = bobbin_config.load(path=config_file, overrides=dict(
+			key=key,
+			secret=secret,
+			nitter_url=nitter_url,
+			api_version=api_version,
+			resolve_quotes=resolve_quotes or None,
+			record_dir=record_dir,
+			replay_dir=replay_dir,
+		))
+	except bobbin_config.ConfigError as e:
+		return str(e)
+
+	async with make_session(config) as client_session:
+		session = recording.wrap_session(
+			client_session,
+			record_dir=config.record_dir,
+			replay_dir=config.replay_dir,
+		)
+
+		api, token = make_api(config, session)
+
+		try:
+			thread = await tweetbox.get_thread(
+				session=session,
+				cache=async_cache.DictCache(),
+				token=token,
+				tail=tweet_id,
+				api=api,
+				resolve_quotes=config.resolve_quotes,
+			)
+		except twitter.UnavailableTweetError as e:
+			return f"Tweet {e.tweet_id} is {e.reason}"
+		except twitter.TwitterError as e:
+			return f"Error from twitter: {e!r}"
+
+		# Without a site to link to, PDFs link to the last tweet instead
+		if renderer is None:
+			pdf = await pdf_export.ThreadPdfRenderer(client_session, font=config.pdf_font).render(
+				thread,
+				page_url=render.tweet_url(thread[-1]),
+			)
+			sys.stdout.buffer.write(pdf)
+			return
+
+	print(renderer(thread))
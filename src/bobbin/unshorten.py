@@ -0,0 +1,163 @@
+# Expansion of shortened links in tweets. Twitter wraps every link in a t.co
+# url, and usually tells us where it goes, but not always (v2 sometimes
+# leaves out expanded_url), and often where it goes is just another
+# shortener, like bit.ly. The LinkResolver follows redirects from these, so
+# that rendered threads show where links really go.
+#
+# Only hosts known to be shorteners are ever requested, and redirects are
+# only followed while they stay on them, so a tweet can't make us request
+# arbitrary urls (like ones on our own network).
+
+from urllib.parse import urlparse, urljoin
+import asyncio
+import logging
+import time
+
+import aiohttp
+import cachetools
+
+
+logger = logging.getLogger(__name__)
+
+TWITTER_SHORTENER = "t.co"
+
+# The longest display url twitter shows before truncating it
+MAX_DISPLAY_LENGTH = 26
+
+
+def url_host(url):
+	try:
+		host = urlparse(url).hostname
+	except ValueError:
+		return None
+	return host.lower() if host else None
+
+
+def display_url(url):
+	'''
+	Shorten a url for display the way twitter does: without the scheme or
+	www., and truncated with an ellipsis
+	'''
+	display = url.split("://", 1)[-1]
+	if display.startswith("www."):
+		display = display[4:]
+	if len(display) > MAX_DISPLAY_LENGTH:
+		display = display[:MAX_DISPLAY_LENGTH - 1] + "…"
+	return display
+
+
+class LinkResolver:
+	'''
+	Follows redirects from shortened urls, on t.co and the other given
+	hosts. Each url may take at most timeout seconds to resolve, and at most
+	max_redirects redirects; if it takes more, or anything goes wrong, it's
+	left as it is. Results, including failures, are cached for cache_ttl
+	seconds.
+	'''
+	def __init__(
+		self,
+		session,
+		*,
+		hosts=(),
+		timeout=5,
+		max_redirects=5,
+		max_concurrent=8,
+		cache_size=10000,
+		cache_ttl=24 * 60 * 60,
+	):
+		self.session = session
+		self.hosts = frozenset(host.lower() for host in hosts) | {TWITTER_SHORTENER}
+		self.timeout = timeout
+		self.max_redirects = max_redirects
+		self.max_concurrent = max_concurrent
+		self.cache = cachetools.TTLCache(cache_size, cache_ttl, timer=time.monotonic)
+		self.pending = {}
+		self.semaphore = None
+
+	def is_shortened(self, url):
+		return url is not None and url_host(url) in self.hosts
+
+	async def follow(self, url):
+		'''
+		Follow redirects from url for as long as they're on shortener hosts
+		'''
+		for _ in range(self.max_redirects):
+			if not self.is_shortened(url):
+				break
+
+			async with self.session.get(url, allow_redirects=False) as response:
+				location = response.headers.get("Location")
+				if response.status not in (301, 302, 303, 307, 308) or not location:
+					break
+
+			target = urljoin(url, location)
+			if urlparse(target).scheme not in ("http", "https"):
+				break
+			url = target
+
+		return url
+
+	async def resolve_uncached(self, url):
+		if self.semaphore is None:
+			self.semaphore = asyncio.Semaphore(self.max_concurrent)
+
+		async with self.semaphore:
+			try:
+				return await asyncio.wait_for(self.follow(url), self.timeout)
+			except asyncio.CancelledError:
+				raise
+			except (aiohttp.ClientError, asyncio.TimeoutError, ValueError) as e:
+				logger.info("Couldn't expand %s: %s", url, e)
+				return url
+
+	async def resolve(self, url):
+		'''
+		Get where url really goes, or url itself, if it isn't shortened or
+		can't be resolved. Concurrent requests for the same url share a lookup.
+		'''
+		if not self.is_shortened(url):
+			return url
+
+		try:
+			return self.cache[url]
+		except KeyError:
+			pass
+
+		pending = self.pending.get(url)
+		if pending is None:
+			pending = self.pending[url] = asyncio.ensure_future(self.resolve_uncached(url))
+			pending.add_done_callback(lambda task: self.pending.pop(url, None))
+
+		result = await asyncio.shield(pending)
+		self.cache[url] = result
+		return result
+
+	async def expand_url_entity(self, entity):
+		target = entity.expanded_url or entity.url
+		if not self.is_shortened(target):
+			return entity
+
+		resolved = await self.resolve(target)
+		if resolved == target and entity.expanded_url is not None:
+			return entity
+
+		return entity._replace(expanded_url=resolved, display_url=display_url(resolved))
+
+	async def expand_tweet(self, tweet):
+		'''
+		Get tweet, with its shortened links, and its quoted tweet's, expanded
+		'''
+		urls = await asyncio.gather(*map(self.expand_url_entity, tweet.entities.urls))
+		quoted = await self.expand_tweet(tweet.quoted) if tweet.quoted is not None else None
+
+		return tweet._replace(
+			entities=tweet.entities._replace(urls=tuple(urls)),
+			quoted=quoted,
+		)
+
+	async def expand_thread(self, thread):
+		'''
+		Expand the links in all the tweets in thread (see
+		tweetbox.make_thread_getter's transforms)
+		'''
+		return await thread.map_tweets(self.expand_tweet)
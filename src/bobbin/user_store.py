@@ -0,0 +1,374 @@
+# Persistent storage for user accounts (see accounts): who's signed in, the
+# threads they've bookmarked and read, and the read later services they've
+# connected (see read_later). Threads are referred to by their tail id; their
+# contents are in the ThreadStore.
+
+from collections import namedtuple
+from datetime import datetime, timezone
+import abc
+import asyncio
+import sqlite3
+import threading
+
+
+class Account(namedtuple("Account", "id twitter_id handle created_at")):
+	'''
+	A user account, made by signing in with the twitter account twitter_id.
+	handle is their handle as of the last time they signed in.
+	'''
+	__slots__ = ()
+
+
+class Bookmark(namedtuple("Bookmark", "tail_id created_at")):
+	__slots__ = ()
+
+
+class ReadingEntry(namedtuple("ReadingEntry", "tail_id position read_at")):
+	'''
+	A thread in someone's reading history. position is the id of the last
+	tweet they read, if the frontend has told us.
+	'''
+	__slots__ = ()
+
+
+class ServiceToken(namedtuple("ServiceToken", "service token secret created_at")):
+	'''
+	The credentials an account has connected a read later service with.
+	secret is None for services that only use a token.
+	'''
+	__slots__ = ()
+
+
+class UserStore(abc.ABC):
+	@abc.abstractmethod
+	async def save_account(self, *, twitter_id, handle, now):
+		'''
+		Get the Account for twitter_id, creating it if there isn't one, and
+		updating its handle if there is
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def create_session(self, *, token_hash, account_id, expires_at):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_session_account(self, *, token_hash, now):
+		'''
+		Get the Account signed in with the session whose token has the given
+		hash, or None if there's no such session, or it's expired
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def delete_session(self, *, token_hash):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def add_bookmark(self, *, account_id, tail, created_at):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def remove_bookmark(self, *, account_id, tail):
+		'''
+		Remove a bookmark. Returns whether there was one.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def is_bookmarked(self, *, account_id, tail):
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_bookmarks(self, *, account_id, limit=100):
+		'''
+		Get an account's Bookmarks, most recent first
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def record_reading(self, *, account_id, tail, read_at, position=None):
+		'''
+		Add a thread to an account's reading history, or move it to the top.
+		If position is None, the thread's last position is kept.
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_reading_history(self, *, account_id, limit=50):
+		'''
+		Get an account's ReadingEntries, most recently read first
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_reading_position(self, *, account_id, tail):
+		'''
+		Get the id of the last tweet of a thread an account has read, or None
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def save_service_token(self, *, account_id, service, token, secret, created_at):
+		'''
+		Save an account's credentials for a read later service, replacing
+		any it had
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def get_service_tokens(self, *, account_id):
+		'''
+		Get the ServiceTokens of an account, as a dict of service name ->
+		ServiceToken
+		'''
+		raise NotImplementedError()
+
+	@abc.abstractmethod
+	async def delete_service_token(self, *, account_id, service):
+		'''
+		Forget an account's credentials for a service. Returns whether it
+		had any.
+		'''
+		raise NotImplementedError()
+
+	def close(self):
+		pass
+
+
+USER_SCHEMA = '''
+CREATE TABLE IF NOT EXISTS accounts (
+	id INTEGER PRIMARY KEY,
+	twitter_id TEXT NOT NULL UNIQUE,
+	handle TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	token_hash TEXT PRIMARY KEY,
+	account_id INTEGER NOT NULL,
+	expires_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bookmarks (
+	account_id INTEGER NOT NULL,
+	tail_id TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (account_id, tail_id)
+);
+
+CREATE TABLE IF NOT EXISTS reading_history (
+	account_id INTEGER NOT NULL,
+	tail_id TEXT NOT NULL,
+	position TEXT,
+	read_at TEXT NOT NULL,
+	PRIMARY KEY (account_id, tail_id)
+);
+
+CREATE INDEX IF NOT EXISTS reading_history_by_read_at ON reading_history(account_id, read_at);
+
+CREATE TABLE IF NOT EXISTS service_tokens (
+	account_id INTEGER NOT NULL,
+	service TEXT NOT NULL,
+	token TEXT NOT NULL,
+	secret TEXT,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (account_id, service)
+);
+'''
+
+
+def account_from_row(row):
+	account_id, twitter_id, handle, created_at = row
+	return Account(account_id, twitter_id, handle, datetime.fromisoformat(created_at))
+
+
+class SqliteUserStore(UserStore):
+	'''
+	UserStore backed by a sqlite database. This can share a database with
+	SqliteThreadStore.
+	'''
+	def __init__(self, path, *, loop=None):
+		self.loop = loop
+		self.lock = threading.Lock()
+		self.db = sqlite3.connect(str(path), check_same_thread=False)
+		self.db.executescript(USER_SCHEMA)
+
+	def _run(self, func, *args):
+		def locked():
+			with self.lock:
+				return func(*args)
+
+		loop = self.loop if self.loop is not None else asyncio.get_event_loop()
+		return loop.run_in_executor(None, locked)
+
+	def _save_account(self, twitter_id, handle, now):
+		with self.db:
+			self.db.execute(
+				"INSERT OR IGNORE INTO accounts (twitter_id, handle, created_at) VALUES (?, ?, ?)",
+				(twitter_id, handle, now.isoformat()),
+			)
+			self.db.execute(
+				"UPDATE accounts SET handle = ? WHERE twitter_id = ?",
+				(handle, twitter_id),
+			)
+
+		return account_from_row(self.db.execute(
+			"SELECT id, twitter_id, handle, created_at FROM accounts WHERE twitter_id = ?",
+			(twitter_id,),
+		).fetchone())
+
+	async def save_account(self, *, twitter_id, handle, now):
+		return await self._run(self._save_account, twitter_id, handle, now)
+
+	def _create_session(self, token_hash, account_id, expires_at):
+		with self.db:
+			self.db.execute(
+				"INSERT INTO sessions (token_hash, account_id, expires_at) VALUES (?, ?, ?)",
+				(token_hash, account_id, expires_at.isoformat()),
+			)
+
+	async def create_session(self, *, token_hash, account_id, expires_at):
+		await self._run(self._create_session, token_hash, account_id, expires_at)
+
+	def _get_session_account(self, token_hash, now):
+		row = self.db.execute(
+			"SELECT accounts.id, accounts.twitter_id, accounts.handle, accounts.created_at "
+			"FROM sessions JOIN accounts ON accounts.id = sessions.account_id "
+			"WHERE sessions.token_hash = ? AND sessions.expires_at > ?",
+			(token_hash, now.isoformat()),
+		).fetchone()
+
+		return account_from_row(row) if row is not None else None
+
+	async def get_session_account(self, *, token_hash, now):
+		return await self._run(self._get_session_account, token_hash, now)
+
+	def _delete_session(self, token_hash, now):
+		# Expired sessions are cleaned up at the same time
+		with self.db:
+			self.db.execute(
+				"DELETE FROM sessions WHERE token_hash = ? OR expires_at <= ?",
+				(token_hash, now.isoformat()),
+			)
+
+	async def delete_session(self, *, token_hash):
+		await self._run(self._delete_session, token_hash, datetime.now(timezone.utc))
+
+	def _add_bookmark(self, account_id, tail, created_at):
+		with self.db:
+			self.db.execute(
+				"INSERT OR IGNORE INTO bookmarks (account_id, tail_id, created_at) VALUES (?, ?, ?)",
+				(account_id, tail, created_at.isoformat()),
+			)
+
+	async def add_bookmark(self, *, account_id, tail, created_at):
+		await self._run(self._add_bookmark, account_id, tail, created_at)
+
+	def _remove_bookmark(self, account_id, tail):
+		with self.db:
+			return self.db.execute(
+				"DELETE FROM bookmarks WHERE account_id = ? AND tail_id = ?",
+				(account_id, tail),
+			).rowcount > 0
+
+	async def remove_bookmark(self, *, account_id, tail):
+		return await self._run(self._remove_bookmark, account_id, tail)
+
+	def _is_bookmarked(self, account_id, tail):
+		return self.db.execute(
+			"SELECT 1 FROM bookmarks WHERE account_id = ? AND tail_id = ?",
+			(account_id, tail),
+		).fetchone() is not None
+
+	async def is_bookmarked(self, *, account_id, tail):
+		return await self._run(self._is_bookmarked, account_id, tail)
+
+	def _get_bookmarks(self, account_id, limit):
+		return [
+			Bookmark(tail, datetime.fromisoformat(created_at))
+			for tail, created_at in self.db.execute(
+				"SELECT tail_id, created_at FROM bookmarks WHERE account_id = ? "
+				"ORDER BY created_at DESC LIMIT ?",
+				(account_id, limit),
+			)
+		]
+
+	async def get_bookmarks(self, *, account_id, limit=100):
+		return await self._run(self._get_bookmarks, account_id, limit)
+
+	def _record_reading(self, account_id, tail, read_at, position):
+		with self.db:
+			self.db.execute(
+				"INSERT OR IGNORE INTO reading_history (account_id, tail_id, read_at) VALUES (?, ?, ?)",
+				(account_id, tail, read_at.isoformat()),
+			)
+			self.db.execute(
+				"UPDATE reading_history SET read_at = ?, position = COALESCE(?, position) "
+				"WHERE account_id = ? AND tail_id = ?",
+				(read_at.isoformat(), position, account_id, tail),
+			)
+
+	async def record_reading(self, *, account_id, tail, read_at, position=None):
+		await self._run(self._record_reading, account_id, tail, read_at, position)
+
+	def _get_reading_history(self, account_id, limit):
+		return [
+			ReadingEntry(tail, position, datetime.fromisoformat(read_at))
+			for tail, position, read_at in self.db.execute(
+				"SELECT tail_id, position, read_at FROM reading_history WHERE account_id = ? "
+				"ORDER BY read_at DESC LIMIT ?",
+				(account_id, limit),
+			)
+		]
+
+	async def get_reading_history(self, *, account_id, limit=50):
+		return await self._run(self._get_reading_history, account_id, limit)
+
+	def _get_reading_position(self, account_id, tail):
+		row = self.db.execute(
+			"SELECT position FROM reading_history WHERE account_id = ? AND tail_id = ?",
+			(account_id, tail),
+		).fetchone()
+
+		return row[0] if row is not None else None
+
+	async def get_reading_position(self, *, account_id, tail):
+		return await self._run(self._get_reading_position, account_id, tail)
+
+	def _save_service_token(self, account_id, service, token, secret, created_at):
+		with self.db:
+			self.db.execute(
+				"INSERT OR REPLACE INTO service_tokens (account_id, service, token, secret, created_at) "
+				"VALUES (?, ?, ?, ?, ?)",
+				(account_id, service, token, secret, created_at.isoformat()),
+			)
+
+	async def save_service_token(self, *, account_id, service, token, secret, created_at):
+		await self._run(self._save_service_token, account_id, service, token, secret, created_at)
+
+	def _get_service_tokens(self, account_id):
+		return {
+			service: ServiceToken(service, token, secret, datetime.fromisoformat(created_at))
+			for service, token, secret, created_at in self.db.execute(
+				"SELECT service, token, secret, created_at FROM service_tokens WHERE account_id = ?",
+				(account_id,),
+			)
+		}
+
+	async def get_service_tokens(self, *, account_id):
+		return await self._run(self._get_service_tokens, account_id)
+
+	def _delete_service_token(self, account_id, service):
+		with self.db:
+			return self.db.execute(
+				"DELETE FROM service_tokens WHERE account_id = ? AND service = ?",
+				(account_id, service),
+			).rowcount > 0
+
+	async def delete_service_token(self, *, account_id, service):
+		return await self._run(self._delete_service_token, account_id, service)
+
+	def close(self):
+		with self.lock:
+			self.db.close()
@@ -11,13 +11,34 @@ def dump_json(**kwargs):
 	return dumps(kwargs, check_circular=False, separators=(',', ':'))
 
 
-def bad_request_json(error, **kwargs):
-	return web.HTTPBadRequest(
+def error_json(error_class, error, **kwargs):
+	return error_class(
 		text=dump_json(error=error, **kwargs),
 		content_type='application/json'
 	)
 
 
+def bad_request_json(error, **kwargs):
+	return error_json(web.HTTPBadRequest, error, **kwargs)
+
+
+def not_found_json(error, **kwargs):
+	return error_json(web.HTTPNotFound, error, **kwargs)
+
+
+def bad_gateway_json(error, **kwargs):
+	return error_json(web.HTTPBadGateway, error, **kwargs)
+
+
+def site_url(request):
+	'''
+	The public url of the root of the site, without a trailing slash. This
+	includes the base path, if the site is mounted under one (see
+	bobbin.proxy).
+	'''
+	return str(request.url.origin()) + request.get("base_path", "")
+
+
 def with_context(handler=None, **context):
 	if handler is None:
 		return lambda handler: with_context(handler, **context)
@@ -0,0 +1,31 @@
+# Running the whole site (see bobbin.server) in tests, with an aiohttp test
+# client to make requests to it
+
+from contextlib import asynccontextmanager
+import pathlib
+import tempfile
+
+from aiohttp.test_utils import RawTestServer, TestClient
+
+from bobbin import server
+
+INDEX_HTML = '<!DOCTYPE html>\n<html lang="en"><head></head><body></body></html>\n'
+
+
+@asynccontextmanager
+async def serve(**config):
+	'''
+	Serve the site, with a ServerConfig made from config, and yield a client
+	for it. get_thread_tree and tweet_cache default to None, and a static_dir
+	with a blank index.html is made if one isn't given.
+	'''
+	config.setdefault("get_thread_tree", None)
+	config.setdefault("tweet_cache", None)
+
+	with tempfile.TemporaryDirectory() as static_dir:
+		pathlib.Path(static_dir, "index.html").write_text(INDEX_HTML)
+		config.setdefault("static_dir", static_dir)
+
+		handler = server.make_handler(server.ServerConfig(**config))
+		async with TestClient(RawTestServer(handler)) as client:
+			yield client
@@ -0,0 +1,42 @@
+import unittest
+
+from bobbin import api_keys
+
+
+class FakeClock:
+	def __init__(self):
+		self.now = 1600000000
+
+	def __call__(self):
+		return self.now
+
+
+class SiteCookieTest(unittest.TestCase):
+	def setUp(self):
+		self.clock = FakeClock()
+		self.api_keys = api_keys.ApiKeys(None, clock=self.clock)
+
+	def test_valid(self):
+		cookie = self.api_keys.site_cookie("203.0.113.7")
+		self.assertTrue(self.api_keys.valid_site_cookie(cookie, "203.0.113.7"))
+
+	def test_other_client(self):
+		# A cookie fetched by one client can't be handed to another
+		cookie = self.api_keys.site_cookie("203.0.113.7")
+		self.assertFalse(self.api_keys.valid_site_cookie(cookie, "198.51.100.1"))
+
+	def test_expired(self):
+		cookie = self.api_keys.site_cookie("203.0.113.7")
+		self.clock.now += api_keys.SITE_COOKIE_TTL
+
+		self.assertFalse(self.api_keys.valid_site_cookie(cookie, "203.0.113.7"))
+
+	def test_forged(self):
+		issued = str(self.clock.now)
+		self.assertFalse(self.api_keys.valid_site_cookie(f"{issued}.{'0' * 64}", "203.0.113.7"))
+		self.assertFalse(self.api_keys.valid_site_cookie("", "203.0.113.7"))
+
+	def test_non_ascii(self):
+		cookie = self.api_keys.site_cookie("203.0.113.7")
+		self.assertFalse(self.api_keys.valid_site_cookie(cookie + "é", "203.0.113.7"))
+		self.assertFalse(self.api_keys.valid_site_cookie("١٦٠٠٠٠٠٠٠٠." + cookie.partition(".")[2], "203.0.113.7"))
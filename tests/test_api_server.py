@@ -0,0 +1,148 @@
+import json
+import unittest
+
+from bobbin.accounts import SESSION_COOKIE
+from bobbin.twitter import ProtectedTweetError, PublicMetrics
+from bobbin.tweetbox import ThreadTruncated
+from tests.serving import serve
+from tests.util import make_thread, make_tweets, run
+
+METRICS = PublicMetrics(likes=10, retweets=2, replies=3, quotes=1)
+
+
+def parse_events(body):
+	'''
+	Parse a text/event-stream body into a list of (event, data) pairs
+	'''
+	events = []
+	for message in body.strip().split("\n\n"):
+		fields = dict(line.split(": ", 1) for line in message.split("\n"))
+		events.append((fields["event"], json.loads(fields["data"])))
+	return events
+
+
+class ThreadEventsTest(unittest.TestCase):
+	def setUp(self):
+		self.tweets = [tweet._replace(metrics=METRICS) for tweet in make_tweets(["one", "two"])]
+
+	async def stream_thread(self, *, tail):
+		yield self.tweets[1]
+		yield self.tweets[0]._replace(quoted=self.tweets[1])
+		yield ThreadTruncated("0")
+
+	def get_events(self, **config):
+		async def get():
+			async with serve(get_thread=None, stream_thread=self.stream_thread, **config) as client:
+				async with client.get("/thread/2/events") as response:
+					self.assertEqual(response.status, 200)
+					self.assertEqual(response.headers["Content-Type"], "text/event-stream")
+					return parse_events(await response.text())
+
+		return run(get())
+
+	def test_events(self):
+		events = self.get_events()
+
+		self.assertEqual([event for event, _ in events], ["tweet", "tweet", "truncated", "done"])
+		self.assertEqual([data.get("id") for _, data in events], ["2", "1", "0", None])
+		self.assertEqual(events[0][1]["metrics"]["likes"], 10)
+
+	def test_hide_metrics(self):
+		events = self.get_events(show_metrics=False)
+
+		tweets = [data for event, data in events if event == "tweet"]
+		self.assertEqual(len(tweets), 2)
+		for tweet in tweets:
+			self.assertIsNone(tweet["metrics"])
+		self.assertIsNone(tweets[1]["quoted"]["metrics"])
+
+
+class ThreadPagesTest(unittest.TestCase):
+	def setUp(self):
+		self.thread = make_thread([f"tweet {index}" for index in range(5)])
+
+	async def get_thread(self, *, tail, head):
+		return self.thread
+
+	def get(self, path):
+		async def get():
+			async with serve(get_thread=self.get_thread) as client:
+				async with client.get(path) as response:
+					return response.status, await response.json()
+
+		return run(get())
+
+	def test_path(self):
+		status, body = self.get("/api/thread/5?page=2&page_size=2")
+
+		self.assertEqual(status, 200)
+		self.assertEqual(body["thread"], ["3", "4"])
+		self.assertEqual((body["page"], body["pages"], body["total"]), (2, 3, 5))
+
+	def test_query(self):
+		# The original form is kept as an alias
+		self.assertEqual(
+			self.get("/api/thread?tail=5&page=2&page_size=2"),
+			self.get("/api/thread/5?page=2&page_size=2"),
+		)
+
+	def test_both_tails(self):
+		status, body = self.get("/api/thread/5?tail=4")
+
+		self.assertEqual(status, 400)
+		self.assertEqual(body["param"], "tail")
+
+
+class FakeAccounts:
+	async def request_user_token(self, request):
+		return "user-token" if request.cookies.get(SESSION_COOKIE) == "session" else None
+
+
+class ProtectedThreadTest(unittest.TestCase):
+	def setUp(self):
+		self.thread = make_thread(["Just for followers", "Still just for them"])
+		self.private_requests = []
+
+	async def get_thread(self, *, tail, head):
+		raise ProtectedTweetError(tail)
+
+	async def get_private_thread(self, *, user_token, tail, head):
+		self.private_requests.append((user_token, tail, head))
+		return self.thread
+
+	def get(self, *, cookies=None, **config):
+		async def get():
+			async with serve(get_thread=self.get_thread, **config) as client:
+				async with client.get("/api/thread?tail=2", cookies=cookies) as response:
+					return response.status, response.headers, await response.json()
+
+		return run(get())
+
+	def test_signed_in(self):
+		status, headers, body = self.get(
+			cookies={SESSION_COOKIE: "session"},
+			accounts=FakeAccounts(),
+			get_private_thread=self.get_private_thread,
+		)
+
+		self.assertEqual(status, 200)
+		self.assertEqual(headers["Cache-Control"], "private, no-store")
+		self.assertEqual(body["thread"], ["1", "2"])
+		self.assertEqual(self.private_requests, [("user-token", "2", None)])
+
+	def test_signed_out(self):
+		status, _, body = self.get(accounts=FakeAccounts(), get_private_thread=self.get_private_thread)
+
+		self.assertEqual(status, 404)
+		self.assertEqual(body["reason"], "protected")
+		self.assertEqual(self.private_requests, [])
+
+	def test_disabled(self):
+		status, _, body = self.get(cookies={SESSION_COOKIE: "session"}, accounts=FakeAccounts())
+
+		self.assertEqual(status, 404)
+		self.assertEqual(body["reason"], "protected")
+
+
+if __name__ == "__main__":
+	unittest.main()
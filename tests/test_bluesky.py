@@ -0,0 +1,32 @@
+import unittest
+
+from bobbin import bluesky, render
+from bobbin.link_cards import Card
+
+
+def external(uri, thumb=None):
+	return {
+		"$type": "app.bsky.embed.external#view",
+		"external": {"uri": uri, "title": "A page", "description": "About it", "thumb": thumb},
+	}
+
+
+class CardTest(unittest.TestCase):
+	def test_card(self):
+		card = bluesky.card_from_embed(external("https://example.com/page", "https://cdn.bsky.app/thumb.jpg"))
+
+		self.assertEqual(card, Card("https://example.com/page", "A page", "About it", "https://cdn.bsky.app/thumb.jpg", None))
+
+	def test_unsafe_link(self):
+		# The link is whatever the post's author wrote
+		self.assertIsNone(bluesky.card_from_embed(external("javascript:alert(1)")))
+		self.assertIsNone(bluesky.card_from_embed(external({"not": "a url"})))
+
+	def test_unsafe_thumb(self):
+		card = bluesky.card_from_embed(external("https://example.com/page", "javascript:alert(1)"))
+
+		self.assertIsNone(card.image_url)
+
+	def test_render_unsafe_link(self):
+		self.assertEqual(render.card_html(Card("javascript:alert(1)", "A page", None, None, None)), "")
+		self.assertIn('href="https://example.com/page"', render.card_html(Card("https://example.com/page", "A page", None, None, None)))
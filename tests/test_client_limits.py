@@ -0,0 +1,57 @@
+from types import SimpleNamespace
+import unittest
+
+from aiohttp import web
+
+from bobbin import client_limits
+from tests.util import run
+
+
+def client_key(remote):
+	return client_limits.client_key(SimpleNamespace(remote=remote))
+
+
+class ClientKeyTest(unittest.TestCase):
+	def test_ipv4(self):
+		self.assertEqual(client_key("203.0.113.7"), "203.0.113.7")
+		self.assertNotEqual(client_key("203.0.113.7"), client_key("203.0.113.8"))
+
+	def test_ipv6(self):
+		# Every address in a /64 is the same client
+		self.assertEqual(client_key("2001:db8:1:2::1"), "2001:db8:1:2::/64")
+		self.assertEqual(client_key("2001:db8:1:2:ffff::1"), client_key("2001:db8:1:2::1"))
+		self.assertNotEqual(client_key("2001:db8:1:3::1"), client_key("2001:db8:1:2::1"))
+
+	def test_ipv4_mapped(self):
+		self.assertEqual(client_key("::ffff:203.0.113.7"), "203.0.113.7")
+
+	def test_not_an_address(self):
+		self.assertIsNone(client_key(None))
+		self.assertEqual(client_key("unix"), "unix")
+
+
+class RateLimitedTest(unittest.TestCase):
+	def setUp(self):
+		self.client_limiter = client_limits.ClientRateLimiter(rate=1, burst=2, clock=lambda: 0)
+
+		async def handler(request):
+			return "ok"
+
+		self.handler = client_limits.rate_limited(handler)
+
+	def get(self, remote):
+		return run(self.handler(SimpleNamespace(remote=remote), client_limiter=self.client_limiter))
+
+	def test_burst(self):
+		self.assertEqual(self.get("2001:db8::1"), "ok")
+		self.assertEqual(self.get("2001:db8::2"), "ok")
+
+		with self.assertRaises(web.HTTPTooManyRequests):
+			self.get("2001:db8::3")
+
+		self.assertEqual(self.get("2001:db8:0:1::1"), "ok")
+
+	def test_no_limiter(self):
+		self.client_limiter = None
+		for _ in range(3):
+			self.assertEqual(self.get("203.0.113.7"), "ok")
@@ -0,0 +1,94 @@
+import pathlib
+import shutil
+import tempfile
+import unittest
+
+from bobbin import config
+
+INI = '''\
+[bobbin]
+key = a,b
+secret = c,d
+cache_size = 512MB
+accounts = true
+'''
+
+TOML = '''\
+[bobbin]
+key = ["a", "b"]
+secret = "c,d"
+cache_size = "512MB"
+accounts = true
+'''
+
+
+class FileTest(unittest.TestCase):
+	def setUp(self):
+		self.directory = pathlib.Path(tempfile.mkdtemp())
+		self.addCleanup(shutil.rmtree, self.directory)
+
+	def load(self, name, text):
+		path = self.directory / name
+		path.write_text(text)
+		return config.load(path=str(path), environ={}, check=False)
+
+
+class IniFileTest(FileTest):
+	def test_ini(self):
+		loaded = self.load("bobbin.ini", INI)
+
+		self.assertEqual(loaded.credentials, [("a", "c"), ("b", "d")])
+		self.assertEqual(loaded.cache_size, 512 * 1024 * 1024)
+		self.assertTrue(loaded.accounts)
+
+	def test_unknown_setting(self):
+		with self.assertRaises(config.ConfigError):
+			self.load("bobbin.ini", INI + "colour = blue\n")
+
+
+@unittest.skipUnless(config.toml_available(), "needs python 3.11, or tomli")
+class TomlFileTest(FileTest):
+	def test_toml(self):
+		# Lists, numbers and booleans are read the same as they'd be written
+		# in the INI file
+		self.assertEqual(self.load("bobbin.toml", TOML), self.load("bobbin.ini", INI))
+
+	def test_number(self):
+		loaded = self.load("bobbin.toml", TOML + "cache_ttl = 60\n")
+		self.assertEqual(loaded.cache_ttl, 60)
+
+	def test_unknown_setting(self):
+		with self.assertRaises(config.ConfigError):
+			self.load("bobbin.toml", TOML + 'colour = "blue"\n')
+
+	def test_table_value(self):
+		with self.assertRaises(config.ConfigError):
+			self.load("bobbin.toml", TOML + "cache_ttl = {seconds = 60}\n")
+
+	def test_invalid(self):
+		with self.assertRaises(config.ConfigError):
+			self.load("bobbin.toml", "[bobbin\n")
+
+
+class ValidateTest(unittest.TestCase):
+	def load(self, **overrides):
+		return config.load(environ={}, overrides=dict(key="a", secret="b", **overrides))
+
+	def test_media_url(self):
+		# Media urls end up off the site, in share cards, embeds and PDFs
+		with self.assertRaises(config.ConfigError):
+			self.load(mirror_media=True, blob_store="file:///tmp/blobs")
+		with self.assertRaises(config.ConfigError):
+			self.load(mirror_media=True, blob_store="file:///tmp/blobs", media_url="/media")
+
+		loaded = self.load(mirror_media=True, blob_store="file:///tmp/blobs", media_url="https://example.com/media")
+		self.assertEqual(loaded.media_url, "https://example.com/media")
+
+	def test_image_url(self):
+		with self.assertRaises(config.ConfigError):
+			self.load(image_proxy_secret="secret")
+		with self.assertRaises(config.ConfigError):
+			self.load(image_proxy_secret="secret", image_url="/img")
+
+		loaded = self.load(image_proxy_secret="secret", image_url="https://example.com/img")
+		self.assertEqual(loaded.image_url, "https://example.com/img")
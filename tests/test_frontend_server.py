@@ -0,0 +1,142 @@
+import pathlib
+import shutil
+import tempfile
+import unittest
+
+from bobbin import fake_twitter, frontend_server, permalinks, tweetbox
+from tests.serving import serve
+from tests.util import make_thread, make_tweets, run
+
+
+class ThreadPageTest(unittest.TestCase):
+	def setUp(self):
+		self.thread = make_thread(["Hello there, world", "And another thing"])
+		self.permalink = permalinks.thread_permalink(self.thread)
+
+	async def get_thread(self, *, tail, head):
+		return self.thread
+
+	def get(self, path, **config):
+		'''
+		Request path without following redirects, returning the status, the
+		Location header, and the body
+		'''
+		async def get():
+			async with serve(get_thread=self.get_thread, **config) as client:
+				async with client.get(path, allow_redirects=False) as response:
+					return response.status, response.headers.get("Location"), await response.text()
+
+		return run(get())
+
+	def test_permalink(self):
+		self.assertEqual(self.permalink, "/t/someone/hello-there-world-2")
+
+		status, location, body = self.get(self.permalink)
+		self.assertEqual(status, 200)
+		self.assertIsNone(location)
+		self.assertIn('<link rel="canonical" href="', body)
+		self.assertIn(self.permalink + '"', body)
+
+	def test_permalink_trailing_slash(self):
+		status, _, _ = self.get(self.permalink + "/")
+		self.assertEqual(status, 200)
+
+	def test_stale_slug_redirects_once(self):
+		status, location, _ = self.get("/t/someone/an-old-title-2")
+		self.assertEqual(status, 301)
+		self.assertEqual(location, self.permalink)
+
+		status, location, _ = self.get(location)
+		self.assertEqual(status, 200)
+		self.assertIsNone(location)
+
+	def test_thread_url_redirects_with_query(self):
+		status, location, _ = self.get("/thread/2?head=1")
+		self.assertEqual(status, 301)
+		self.assertEqual(location, self.permalink + "?head=1")
+
+	def test_base_path(self):
+		status, _, _ = self.get("/bobbin" + self.permalink, base_path="/bobbin")
+		self.assertEqual(status, 200)
+
+		status, location, _ = self.get("/bobbin/thread/2", base_path="/bobbin")
+		self.assertEqual(status, 301)
+		self.assertEqual(location, "/bobbin" + self.permalink)
+
+	def test_conversation_keeps_thread_url(self):
+		other = fake_twitter.make_user_json("8", "other")
+		self.thread = tweetbox.Thread([
+			*make_tweets(["Hello"]),
+			*make_tweets(["Hi"], user=other, first_id=2),
+		])
+
+		status, _, _ = self.get("/thread/2")
+		self.assertEqual(status, 200)
+
+
+class ThemeTest(unittest.TestCase):
+	def setUp(self):
+		self.static_dir = self.make_dir({"index.html": "plain", "style.css": "plain", "app.js": "plain"})
+		self.theme_dir = self.make_dir({"index.html": "themed", "style.css": "themed"})
+
+	def make_dir(self, files):
+		directory = pathlib.Path(tempfile.mkdtemp())
+		self.addCleanup(shutil.rmtree, directory)
+
+		for name, text in files.items():
+			(directory / name).write_text(text)
+
+		return directory
+
+	def read(self, theme, path):
+		return theme.find(pathlib.Path(path)).read_text()
+
+	def test_no_theme(self):
+		theme = frontend_server.Theme(self.static_dir)
+
+		self.assertEqual(theme.index_path.read_text(), "plain")
+		self.assertEqual(self.read(theme, "style.css"), "plain")
+		self.assertEqual(theme.headers, {})
+
+	def test_theme(self):
+		theme = frontend_server.Theme(self.static_dir, self.theme_dir)
+
+		self.assertEqual(theme.index_path.read_text(), "themed")
+		self.assertEqual(self.read(theme, "style.css"), "themed")
+		self.assertEqual(self.read(theme, "app.js"), "plain")
+		self.assertIsNone(theme.find(pathlib.Path("missing.js")))
+
+	def test_outside_theme(self):
+		(self.theme_dir / "escape.js").symlink_to(self.make_dir({"secret.js": "secret"}) / "secret.js")
+		theme = frontend_server.Theme(self.static_dir, self.theme_dir)
+
+		self.assertIsNone(theme.find(pathlib.Path("escape.js")))
+
+	def test_found_once(self):
+		theme = frontend_server.Theme(self.static_dir, self.theme_dir)
+		self.assertEqual(self.read(theme, "app.js"), "plain")
+
+		# Found where it was the first time, until a restart
+		(self.theme_dir / "app.js").write_text("themed")
+		self.assertEqual(self.read(theme, "app.js"), "plain")
+
+	def test_reload(self):
+		theme = frontend_server.Theme(self.static_dir, self.theme_dir, reload=True)
+		self.assertEqual(self.read(theme, "app.js"), "plain")
+
+		(self.theme_dir / "app.js").write_text("themed")
+		self.assertEqual(self.read(theme, "app.js"), "themed")
+		self.assertEqual(theme.headers, {"Cache-Control": "no-cache"})
+
+	def test_served(self):
+		async def get(path):
+			async with serve(get_thread=None, theme_dir=str(self.theme_dir)) as client:
+				async with client.get(path) as response:
+					return response.status, await response.text()
+
+		self.assertEqual(run(get("/static/style.css")), (200, "themed"))
+		self.assertEqual(run(get("/")), (200, "themed"))
+
+
+if __name__ == "__main__":
+	unittest.main()
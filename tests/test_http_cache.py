@@ -0,0 +1,184 @@
+import unittest
+
+from bobbin import http_cache, middleware, twitter
+from tests.util import run
+
+URL = "https://api.twitter.com/1.1/statuses/show.json"
+BODY = {"id_str": "20", "full_text": "just setting up my twttr"}
+
+
+class FakeTimer:
+	def __init__(self):
+		self.now = 0
+
+	def __call__(self):
+		return self.now
+
+
+class FakeTwitter:
+	'''
+	Answers requests with the queued responses, in order, and remembers the
+	requests it got
+	'''
+	def __init__(self, *responses):
+		self.responses = list(responses)
+		self.requests = []
+
+	async def __call__(self, request):
+		self.requests.append(request)
+		return self.responses.pop(0)
+
+
+def api_request(token="Bearer token"):
+	return middleware.ApiRequest(
+		session=None,
+		token=token,
+		url=URL,
+		params={"id": "20"},
+		headers={},
+		endpoint=URL,
+	)
+
+
+class HTTPCacheTest(unittest.TestCase):
+	def setUp(self):
+		self.timer = FakeTimer()
+
+	def fetch(self, twitter, times=2):
+		'''
+		Make the same request times times through an HTTPCache, returning the
+		responses
+		'''
+		handler = http_cache.HTTPCache(max_size=1024, timer=self.timer)(twitter)
+		responses = []
+		for _ in range(times):
+			responses.append(run(handler(api_request())))
+			self.timer.now += 10
+		return responses
+
+	def test_not_modified(self):
+		twitter = FakeTwitter(
+			middleware.ApiResponse(200, {"etag": '"v1"', "x-rate-limit-remaining": "899"}, BODY),
+			middleware.ApiResponse(304, {"etag": '"v1"', "x-rate-limit-remaining": "898"}, None),
+		)
+		first, second = self.fetch(twitter)
+
+		self.assertEqual(twitter.requests[1].headers["If-None-Match"], '"v1"')
+
+		# The 304 is answered from the cache, with the newer rate limit
+		self.assertEqual(second.status, 200)
+		self.assertEqual(second.body, BODY)
+		self.assertEqual(second.headers["x-rate-limit-remaining"], "898")
+		self.assertEqual(second.headers["etag"], '"v1"')
+
+	def test_max_age(self):
+		twitter = FakeTwitter(
+			middleware.ApiResponse(200, {"cache-control": "public, max-age=15"}, BODY),
+			middleware.ApiResponse(200, {"cache-control": "public, max-age=15"}, {**BODY, "full_text": "edited"}),
+		)
+		first, second, third = self.fetch(twitter, times=3)
+
+		# Fresh for 15 seconds, so only the third request, 20 seconds later,
+		# goes to twitter
+		self.assertEqual(len(twitter.requests), 2)
+		self.assertEqual(second.body, BODY)
+		self.assertEqual(third.body["full_text"], "edited")
+
+	def test_age(self):
+		twitter = FakeTwitter(
+			middleware.ApiResponse(200, {"cache-control": "max-age=15", "age": "10"}, BODY),
+			middleware.ApiResponse(200, {"cache-control": "max-age=15"}, BODY),
+		)
+		self.fetch(twitter)
+
+		self.assertEqual(len(twitter.requests), 2)
+
+	def test_expires(self):
+		twitter = FakeTwitter(middleware.ApiResponse(200, {
+			"date": "Thu, 13 Oct 2022 17:04:45 GMT",
+			"expires": "Thu, 13 Oct 2022 17:05:45 GMT",
+		}, BODY))
+		self.fetch(twitter)
+
+		self.assertEqual(len(twitter.requests), 1)
+
+	def test_not_modified_refreshes(self):
+		twitter = FakeTwitter(
+			middleware.ApiResponse(200, {"etag": '"v1"', "cache-control": "max-age=5"}, BODY),
+			middleware.ApiResponse(304, {"etag": '"v1"', "cache-control": "max-age=60"}, None),
+		)
+		self.fetch(twitter, times=4)
+
+		# Stale after 5 seconds, revalidated, and then fresh for another 60
+		self.assertEqual(len(twitter.requests), 2)
+
+	def test_no_cache(self):
+		twitter = FakeTwitter(
+			middleware.ApiResponse(200, {"etag": '"v1"', "cache-control": "no-cache, max-age=60"}, BODY),
+			middleware.ApiResponse(304, {"etag": '"v1"'}, None),
+		)
+		first, second = self.fetch(twitter)
+
+		self.assertEqual(len(twitter.requests), 2)
+		self.assertEqual(second.body, BODY)
+
+	def test_no_store(self):
+		twitter = FakeTwitter(
+			middleware.ApiResponse(200, {"etag": '"v1"', "cache-control": "no-store, max-age=60"}, BODY),
+			middleware.ApiResponse(200, {}, BODY),
+		)
+		self.fetch(twitter)
+
+		self.assertEqual(len(twitter.requests), 2)
+		self.assertNotIn("If-None-Match", twitter.requests[1].headers)
+
+
+class RateLimitTest(unittest.TestCase):
+	def test_hit_leaves_rate_limits(self):
+		# The cache goes in front of the rate limits (see twitter.Token), so
+		# a hit's old rate limit headers don't overwrite the live ones
+		token = twitter.Token(None, "key", "secret")
+		twitter_api = FakeTwitter(
+			middleware.ApiResponse(200, {
+				"cache-control": "max-age=60",
+				"x-rate-limit-remaining": "899",
+				"x-rate-limit-reset": "2000000000",
+			}, BODY),
+			middleware.ApiResponse(200, {
+				"x-rate-limit-remaining": "850",
+				"x-rate-limit-reset": "2000000000",
+			}, BODY),
+		)
+		handler = middleware.chain(
+			http_cache.HTTPCache(max_size=1024, timer=FakeTimer()),
+			twitter.rate_limited,
+			handler=twitter_api,
+		)
+
+		run(handler(api_request(token)))
+		token.rate_limiter.update(URL, twitter_api.responses.pop(0).headers)
+		before = token.rate_limiter.snapshot()
+
+		response = run(handler(api_request(token)))
+
+		self.assertEqual(response.body, BODY)
+		self.assertEqual(len(twitter_api.requests), 1)
+		self.assertEqual(token.rate_limiter.snapshot(), before)
+		self.assertEqual(before, {URL: (850, 2000000000)})
+
+
+class FreshnessTest(unittest.TestCase):
+	def test_lifetime(self):
+		self.assertEqual(http_cache.freshness_lifetime({"cache-control": "max-age=60"}), 60)
+		self.assertEqual(http_cache.freshness_lifetime({"cache-control": 'max-age="60"'}), 60)
+		self.assertEqual(http_cache.freshness_lifetime({"cache-control": "max-age=60", "age": "100"}), 0)
+		self.assertEqual(http_cache.freshness_lifetime({"cache-control": "max-age=soon"}), 0)
+		self.assertEqual(http_cache.freshness_lifetime({"expires": "0"}), 0)
+		self.assertEqual(http_cache.freshness_lifetime({}), 0)
+
+	def test_max_age_over_expires(self):
+		self.assertEqual(http_cache.freshness_lifetime({
+			"cache-control": "max-age=5",
+			"date": "Thu, 13 Oct 2022 17:04:45 GMT",
+			"expires": "Thu, 13 Oct 2022 17:05:45 GMT",
+		}), 5)
@@ -0,0 +1,52 @@
+import unittest
+
+from bobbin import image_proxy, tweetbox
+from bobbin.twitter import Entities, Media
+from tests.util import make_tweets, run
+
+IMAGE_URL = "https://pbs.twimg.com/media/example.jpg"
+MIRRORED_URL = "https://example.com/media/0123456789abcdef.jpg"
+
+
+def thread_with_images(*urls):
+	tweet, = make_tweets(["Look"])
+	return tweetbox.Thread([tweet._replace(entities=Entities((), (), (), tuple(
+		Media(None, None, url, "photo", 100, 100, None, ())
+		for url in urls
+	)))])
+
+
+class ProxyThreadTest(unittest.TestCase):
+	def setUp(self):
+		self.proxy = image_proxy.ImageProxy(
+			None,
+			"secret",
+			url_prefix="https://example.com/img",
+			local_prefixes=("https://example.com/media",),
+		)
+
+	def media_urls(self, thread):
+		thread = run(self.proxy.proxy_thread(thread))
+		return [media.media_url for media in thread[0].entities.media]
+
+	def test_proxied(self):
+		proxied, = self.media_urls(thread_with_images(IMAGE_URL))
+
+		self.assertTrue(proxied.startswith("https://example.com/img?url="))
+		self.assertEqual(proxied, self.proxy.proxy_url(IMAGE_URL))
+
+	def test_local(self):
+		# Mirrored copies, and images that are already proxied, are on our
+		# own site already
+		urls = [MIRRORED_URL, self.proxy.proxy_url(IMAGE_URL)]
+		self.assertEqual(self.media_urls(thread_with_images(*urls)), urls)
+
+
+class SignatureTest(unittest.TestCase):
+	def test_valid(self):
+		signature = image_proxy.sign("secret", IMAGE_URL)
+		self.assertTrue(image_proxy.check_signature("secret", IMAGE_URL, signature))
+		self.assertFalse(image_proxy.check_signature("other", IMAGE_URL, signature))
+
+	def test_non_ascii(self):
+		self.assertFalse(image_proxy.check_signature("secret", IMAGE_URL, "é"))
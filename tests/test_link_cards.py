@@ -0,0 +1,31 @@
+import unittest
+
+from bobbin import link_cards
+from tests.util import run
+
+
+class FakeContent:
+	def __init__(self, body):
+		self.body = body
+
+	async def iter_chunked(self, size):
+		for start in range(0, len(self.body), size):
+			yield self.body[start:start + size]
+
+
+class FakeResponse:
+	def __init__(self, body, content_length=None):
+		self.content = FakeContent(body)
+		self.content_length = content_length
+
+
+class ReadLimitedTest(unittest.TestCase):
+	def test_small(self):
+		self.assertEqual(run(link_cards.read_limited(FakeResponse(b"x" * 100), 100)), b"x" * 100)
+
+	def test_too_large(self):
+		self.assertIsNone(run(link_cards.read_limited(FakeResponse(b"x" * 200000), 100000)))
+
+	def test_content_length(self):
+		# Refused without reading anything
+		self.assertIsNone(run(link_cards.read_limited(FakeResponse(b"", content_length=101), 100)))
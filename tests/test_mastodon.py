@@ -0,0 +1,60 @@
+import unittest
+
+from bobbin import mastodon, render
+
+INSTANCE = "mastodon.example"
+
+
+def account(**fields):
+	return {
+		"id": "1",
+		"acct": "someone",
+		"username": "someone",
+		"display_name": "Someone",
+		"url": "https://mastodon.example/@someone",
+		**fields,
+	}
+
+
+def status(**fields):
+	return {
+		"id": "100",
+		"account": account(),
+		"content": "<p>Hello there</p>",
+		"created_at": "2022-11-01T12:00:00.000Z",
+		"url": "https://mastodon.example/@someone/100",
+		"uri": "https://mastodon.example/users/someone/statuses/100",
+		**fields,
+	}
+
+
+class UrlTest(unittest.TestCase):
+	def test_urls(self):
+		tweet = mastodon.tweet_from_json(status(), instance=INSTANCE)
+
+		self.assertEqual(tweet.url, "https://mastodon.example/@someone/100")
+		self.assertEqual(tweet.user.url, "https://mastodon.example/@someone")
+
+	def test_unsafe_urls(self):
+		# Instances can say anything, and these end up as links on our own
+		# origin
+		tweet = mastodon.tweet_from_json(status(
+			url="javascript:alert(1)",
+			uri="javascript:alert(2)",
+			account=account(url="javascript:alert(3)"),
+		), instance=INSTANCE)
+
+		self.assertEqual(tweet.url, "https://mastodon.example/@someone@mastodon.example/100")
+		self.assertEqual(tweet.user.url, "https://mastodon.example/@someone@mastodon.example")
+
+	def test_uri(self):
+		tweet = mastodon.tweet_from_json(status(url=None), instance=INSTANCE)
+
+		self.assertEqual(tweet.url, "https://mastodon.example/users/someone/statuses/100")
+
+	def test_render_unsafe_urls(self):
+		tweet = mastodon.tweet_from_json(status(), instance=INSTANCE)
+		tweet = tweet._replace(url="javascript:alert(1)", user=tweet.user._replace(url="javascript:alert(2)"))
+
+		self.assertTrue(render.tweet_url(tweet).startswith("https://"))
+		self.assertTrue(render.user_url(tweet.user).startswith("https://"))
@@ -0,0 +1,101 @@
+from io import BytesIO
+import unittest
+
+from bobbin import pdf_export, permalinks, tweetbox
+from bobbin.twitter import Entities, Media
+from tests.serving import serve
+from tests.util import make_thread, make_tweets, run
+
+try:
+	from PIL import Image
+except ImportError:
+	Image = None
+
+IMAGE_URL = "https://pbs.twimg.com/media/example.jpg"
+
+
+class FakeRenderer:
+	def __init__(self):
+		self.rendered = []
+
+	async def render(self, thread, *, page_url):
+		self.rendered.append((thread, page_url))
+		return b"%PDF-1.4 fake"
+
+
+class PdfHandlerTest(unittest.TestCase):
+	def setUp(self):
+		self.thread = make_thread(["Hello there, world", "And another thing"])
+
+	async def get_thread(self, *, tail, head):
+		return self.thread
+
+	def get(self, path, **config):
+		async def get():
+			async with serve(get_thread=self.get_thread, **config) as client:
+				async with client.get(path) as response:
+					return response.status, response.headers, await response.read()
+
+		return run(get())
+
+	def test_disabled(self):
+		status, _, _ = self.get("/thread/2.pdf")
+		self.assertEqual(status, 404)
+
+	def test_pdf(self):
+		renderer = FakeRenderer()
+		status, headers, body = self.get("/thread/2.pdf", thread_pdfs=renderer)
+
+		self.assertEqual(status, 200)
+		self.assertEqual(headers["Content-Type"], "application/pdf")
+		self.assertEqual(headers["Content-Disposition"], 'inline; filename="hello-there-world.pdf"')
+		self.assertEqual(body, b"%PDF-1.4 fake")
+
+		(thread, page_url), = renderer.rendered
+		self.assertIs(thread, self.thread)
+		self.assertTrue(page_url.endswith(permalinks.thread_permalink(self.thread)))
+
+
+def png(width, height):
+	output = BytesIO()
+	Image.new("RGB", (width, height), "#1b95e0").save(output, "PNG")
+	return output.getvalue()
+
+
+@unittest.skipUnless(pdf_export.available(), "needs reportlab")
+class RenderTest(unittest.TestCase):
+	def thread_with_image(self):
+		first, second = make_tweets(["Look at this https://t.co/abc", "And that's all"])
+		first = first._replace(entities=Entities((), (), (), (
+			Media((13, 29), "https://t.co/abc", IMAGE_URL, "photo", 2000, 1000, None, ()),
+		)))
+		return tweetbox.Thread([first, second])
+
+	def test_render(self):
+		pdf = pdf_export.render_thread_pdf(
+			self.thread_with_image(),
+			page_url="https://example.com/t/someone/look-at-this-2",
+			images={IMAGE_URL: png(2000, 1000)},
+			avatar=png(400, 400),
+		)
+		self.assertTrue(pdf.startswith(b"%PDF"))
+
+	def test_bad_images(self):
+		# Images that can't be read are left out, rather than failing the
+		# whole PDF
+		pdf = pdf_export.render_thread_pdf(
+			self.thread_with_image(),
+			page_url="https://example.com/t/someone/look-at-this-2",
+			images={IMAGE_URL: b"not an image"},
+			avatar=b"not an image either",
+		)
+		self.assertTrue(pdf.startswith(b"%PDF"))
+
+	def test_missing_font(self):
+		pdf = pdf_export.render_thread_pdf(
+			make_thread(["Just text"]),
+			page_url="https://example.com/t/someone/just-text-1",
+			images={},
+			font="no-such-font.ttf",
+		)
+		self.assertTrue(pdf.startswith(b"%PDF"))
@@ -0,0 +1,37 @@
+from types import SimpleNamespace
+import pathlib
+import shutil
+import tempfile
+import unittest
+
+from aiohttp import web
+
+from bobbin import server
+from tests.util import run
+
+
+class AcmeChallengeTest(unittest.TestCase):
+	def setUp(self):
+		self.acme_dir = pathlib.Path(tempfile.mkdtemp())
+		self.addCleanup(shutil.rmtree, self.acme_dir)
+
+		self.handler = server.make_redirect_handler(server.TLSConfig("cert.pem", "key.pem", 443, str(self.acme_dir)))
+
+	def get(self, path):
+		return run(self.handler(SimpleNamespace(path=path)))
+
+	def test_challenge(self):
+		# Where certbot certonly --webroot -w <acme_dir> puts them
+		challenges = self.acme_dir / ".well-known" / "acme-challenge"
+		challenges.mkdir(parents=True)
+		(challenges / "some-token_1").write_text("some-token_1.thumbprint")
+
+		response = self.get("/.well-known/acme-challenge/some-token_1")
+
+		self.assertIsInstance(response, web.FileResponse)
+
+	def test_missing_challenge(self):
+		(self.acme_dir / "some-token").write_text("not where certbot puts it")
+
+		with self.assertRaises(web.HTTPNotFound):
+			self.get("/.well-known/acme-challenge/some-token")
@@ -0,0 +1,123 @@
+from datetime import datetime, timezone
+import pathlib
+import pickle
+import shutil
+import sqlite3
+import tempfile
+import unittest
+
+from bobbin import storage, tweetbox
+from bobbin.twitter import Entities, Media, VideoVariant
+from tests.util import make_tweets, run
+
+RESOLVED_AT = datetime(2022, 10, 13, 17, 4, 45, tzinfo=timezone.utc)
+
+# The tweets table from before tweets were stored as JSON
+PICKLED_TWEETS = '''
+CREATE TABLE tweets (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	parent_id TEXT,
+	created_at TEXT NOT NULL,
+	text TEXT NOT NULL,
+	media_count INTEGER NOT NULL,
+	data BLOB NOT NULL
+);
+'''
+
+
+def make_thread():
+	first, second = make_tweets(["Look at this", "And this"])
+	media = (
+		Media((13, 36), "https://t.co/a", "https://pbs.twimg.com/media/a.jpg", "photo", 1200, 800, "A cat", ()),
+		Media((13, 36), "https://t.co/a", "https://pbs.twimg.com/media/b.jpg", "video", 1920, 1080, None, (
+			VideoVariant("video/mp4", 832000, "https://video.twimg.com/b.mp4"),
+		)),
+	)
+	return tweetbox.Thread([
+		first._replace(entities=Entities((), (), (), media)),
+		second,
+	], fetched_at=RESOLVED_AT)
+
+
+class SqliteThreadStoreTest(unittest.TestCase):
+	def setUp(self):
+		directory = pathlib.Path(tempfile.mkdtemp())
+		self.addCleanup(shutil.rmtree, directory)
+		self.path = directory / "bobbin.db"
+
+	def open(self):
+		store = storage.SqliteThreadStore(self.path)
+		self.addCleanup(store.close)
+		return store
+
+	def test_round_trip(self):
+		thread = make_thread()
+		store = self.open()
+		run(store.save_thread(thread))
+
+		stored = run(store.get_thread(tail=thread[-1].id))
+
+		self.assertEqual(list(stored), list(thread))
+		self.assertEqual(stored.fetched_at, RESOLVED_AT)
+
+	def test_json(self):
+		thread = make_thread()
+		store = self.open()
+		run(store.save_thread(thread))
+
+		self.assertEqual(
+			store.db.execute("SELECT json_extract(json, '$.text') FROM tweets WHERE id = ?", (thread[0].id,)).fetchone(),
+			(thread[0].text,),
+		)
+		self.assertEqual(store.db.execute(
+			"SELECT tweet_id, position, type, media_url, width, height, alt_text FROM media ORDER BY position"
+		).fetchall(), [
+			(thread[0].id, 0, "photo", "https://pbs.twimg.com/media/a.jpg", 1200, 800, "A cat"),
+			(thread[0].id, 1, "video", "https://pbs.twimg.com/media/b.jpg", 1920, 1080, None),
+		])
+
+	def test_delete(self):
+		thread = make_thread()
+		store = self.open()
+		run(store.save_thread(thread))
+		run(store.delete_thread(tail=thread[-1].id))
+
+		self.assertEqual(store.db.execute("SELECT count(*) FROM media").fetchone(), (0,))
+
+	def test_pickled(self):
+		# Databases from older versions are converted when they're opened
+		thread = make_thread()
+		db = sqlite3.connect(str(self.path))
+		db.executescript(PICKLED_TWEETS)
+		db.executescript(storage.SCHEMA)
+		with db:
+			db.executemany(
+				"INSERT INTO tweets (id, user_id, parent_id, created_at, text, media_count, data) "
+				"VALUES (?, ?, ?, ?, ?, ?, ?)",
+				[(
+					tweet.id, tweet.user.id, tweet.parent_id, tweet.created_at.isoformat(),
+					tweet.text, len(tweet.entities.media), pickle.dumps(tweet, protocol=4),
+				) for tweet in thread],
+			)
+			db.execute(
+				"INSERT INTO threads (tail_id, head_id, author_id, tweet_count, resolved_at) VALUES (?, ?, ?, ?, ?)",
+				(thread[-1].id, thread[0].id, thread.author.id, len(thread), RESOLVED_AT.isoformat()),
+			)
+			db.executemany(
+				"INSERT INTO thread_tweets (tail_id, position, tweet_id) VALUES (?, ?, ?)",
+				[(thread[-1].id, position, tweet.id) for position, tweet in enumerate(thread)],
+			)
+		db.close()
+
+		store = self.open()
+
+		self.assertEqual(list(run(store.get_thread(tail=thread[-1].id))), list(thread))
+		self.assertEqual(store.db.execute("SELECT count(*) FROM media").fetchone(), (2,))
+		self.assertIsNone(store.db.execute(
+			"SELECT 1 FROM sqlite_master WHERE name = 'pickled_tweets'"
+		).fetchone())
+
+
+if __name__ == "__main__":
+	unittest.main()
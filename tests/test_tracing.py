@@ -0,0 +1,95 @@
+import unittest
+from unittest import mock
+
+from bobbin import middleware, tracing, twitter, twitter_v2
+from tests.util import run
+
+try:
+	from opentelemetry.sdk.trace import TracerProvider
+	from opentelemetry.sdk.trace.export import SimpleSpanProcessor
+	from opentelemetry.sdk.trace.export.in_memory_span_exporter import InMemorySpanExporter
+	from opentelemetry.trace import SpanKind, StatusCode
+except ImportError:
+	TracerProvider = None
+
+
+def api_request(url, params=None, endpoint=None):
+	return middleware.ApiRequest(
+		session=None,
+		token="Bearer token",
+		url=url,
+		params=params or {},
+		headers={},
+		endpoint=endpoint if endpoint is not None else url,
+	)
+
+
+class RequestTweetIdTest(unittest.TestCase):
+	def test_v1(self):
+		request = api_request(twitter.TWEET_URL, {"id": "20", "tweet_mode": "extended"})
+		self.assertEqual(tracing.request_tweet_id(request), "20")
+
+	def test_v2(self):
+		request = api_request(f"{twitter_v2.TWEETS_URL}/20", endpoint=f"{twitter_v2.TWEETS_URL}/:id")
+		self.assertEqual(tracing.request_tweet_id(request), "20")
+
+	def test_not_a_tweet(self):
+		request = api_request(twitter.USER_TIMELINE_URL, {"user_id": "7"})
+		self.assertIsNone(tracing.request_tweet_id(request))
+
+
+class SpanTest(unittest.TestCase):
+	def test_unconfigured(self):
+		# Without a provider (or without opentelemetry at all), spans do
+		# nothing
+		with tracing.span("nothing", **{"twitter.tweet_id": "20", "bobbin.head": None}):
+			pass
+
+
+@unittest.skipUnless(TracerProvider is not None, "needs opentelemetry-sdk")
+class TracedTest(unittest.TestCase):
+	def setUp(self):
+		self.exporter = InMemorySpanExporter()
+		provider = TracerProvider()
+		provider.add_span_processor(SimpleSpanProcessor(self.exporter))
+
+		patcher = mock.patch.object(tracing, "get_tracer", lambda: provider.get_tracer(__name__))
+		patcher.start()
+		self.addCleanup(patcher.stop)
+
+	def send(self, status):
+		async def send(request):
+			return middleware.ApiResponse(status, {}, {})
+		return send
+
+	def test_api_span(self):
+		handler = tracing.traced(self.send(200))
+		run(handler(api_request(f"{twitter_v2.TWEETS_URL}/20", endpoint=f"{twitter_v2.TWEETS_URL}/:id")))
+
+		span, = self.exporter.get_finished_spans()
+		self.assertEqual(span.name, f"GET {twitter_v2.TWEETS_URL}/:id")
+		self.assertEqual(span.kind, SpanKind.CLIENT)
+		self.assertEqual(span.attributes["twitter.endpoint"], f"{twitter_v2.TWEETS_URL}/:id")
+		self.assertEqual(span.attributes["twitter.tweet_id"], "20")
+		self.assertEqual(span.attributes["http.status_code"], 200)
+		self.assertNotEqual(span.status.status_code, StatusCode.ERROR)
+
+	def test_api_error(self):
+		handler = tracing.traced(self.send(404))
+		run(handler(api_request(twitter.TWEET_URL, {"id": "20"})))
+
+		span, = self.exporter.get_finished_spans()
+		self.assertEqual(span.attributes["http.status_code"], 404)
+		self.assertEqual(span.status.status_code, StatusCode.ERROR)
+
+	def test_nested_spans(self):
+		async def traced_fetch():
+			with tracing.span("fetch_tweet", **{"twitter.tweet_id": "20", "bobbin.head": None}):
+				await tracing.traced(self.send(200))(api_request(twitter.TWEET_URL, {"id": "20"}))
+
+		run(traced_fetch())
+
+		api_span, fetch_span = self.exporter.get_finished_spans()
+		self.assertEqual(fetch_span.name, "fetch_tweet")
+		self.assertEqual(dict(fetch_span.attributes), {"twitter.tweet_id": "20"})
+		self.assertEqual(api_span.parent.span_id, fetch_span.context.span_id)
@@ -0,0 +1,299 @@
+from unittest import mock
+import re
+import unittest
+
+from bobbin import tweet_text
+from bobbin.tweet_text import tweet_text_html, utf16_offsets
+from bobbin.twitter import Entities, HashtagEntity, Media, MentionEntity, UrlEntity
+from tests.util import make_tweets
+
+EMOJI = "\U0001F600"
+# A CJK letter outside the BMP, which (unlike emoji) can be part of a hashtag
+ASTRAL_LETTER = "\U0002000B"
+
+
+def render(text, *, urls=(), mentions=(), hashtags=(), media=(), code=False):
+	tweet = make_tweets([text])[0]._replace(entities=Entities(
+		tuple(urls),
+		tuple(mentions),
+		tuple(hashtags),
+		tuple(media),
+	))
+	return tweet_text_html(tweet, code=code)
+
+
+def mention(handle, indices):
+	return MentionEntity(indices, "1", handle)
+
+
+def hashtag(text, indices):
+	return HashtagEntity(indices, text)
+
+
+def url(indices, short="https://t.co/abc", expanded="https://example.com/page", display="example.com/page"):
+	return UrlEntity(indices, short, expanded, display)
+
+
+def mention_link(handle, text=None):
+	return f'<a href="https://twitter.com/{handle}" target="_blank" rel="noopener nofollow">{text or "@" + handle}</a>'
+
+
+def hashtag_link(tag, text=None, href_tag=None):
+	return f'<a href="https://twitter.com/hashtag/{href_tag or tag}" target="_blank" rel="noopener nofollow">{text or "#" + tag}</a>'
+
+
+URL_LINK = '<a href="https://example.com/page" title="https://example.com/page" target="_blank" rel="noopener nofollow">example.com/page</a>'
+
+
+class Utf16OffsetsTest(unittest.TestCase):
+	def test_bmp(self):
+		self.assertEqual(utf16_offsets("ab"), {0: 0, 1: 1, 2: 2})
+
+	def test_astral(self):
+		self.assertEqual(utf16_offsets(f"a{EMOJI}b"), {0: 0, 1: 1, 3: 2, 4: 3})
+
+
+class PlainTextTest(unittest.TestCase):
+	def test_escaping(self):
+		# Twitter escapes &, <, and > itself; those shouldn't be escaped twice
+		self.assertEqual(
+			render('a &lt; b &amp;&amp; "c" > <d>'),
+			"a &lt; b &amp;&amp; &quot;c&quot; &gt; &lt;d&gt;",
+		)
+
+	def test_newlines(self):
+		self.assertEqual(render("one\ntwo\n\nthree"), "one<br>two<br><br>three")
+
+	def test_surrounding_whitespace_stripped(self):
+		self.assertEqual(render("  hello  "), "hello")
+
+
+class EntitiesTest(unittest.TestCase):
+	def test_mention(self):
+		self.assertEqual(
+			render("hi @someone!", mentions=[mention("someone", (3, 11))]),
+			f"hi {mention_link('someone')}!",
+		)
+
+	def test_fullwidth_sigils(self):
+		self.assertEqual(
+			render("＠someone ＃tag", mentions=[mention("someone", (0, 8))], hashtags=[hashtag("tag", (9, 13))]),
+			f"{mention_link('someone', '＠someone')} {hashtag_link('tag', '＃tag')}",
+		)
+
+	def test_hashtag(self):
+		self.assertEqual(
+			render("so #blessed", hashtags=[hashtag("blessed", (3, 11))]),
+			f"so {hashtag_link('blessed')}",
+		)
+
+	def test_url_expanded(self):
+		self.assertEqual(
+			render("look https://t.co/abc", urls=[url((5, 21))]),
+			f"look {URL_LINK}",
+		)
+
+	def test_unsafe_url(self):
+		entity = url((5, 21), expanded="javascript:alert(1)", display="javascript:alert(1)")
+		self.assertEqual(
+			render("look https://t.co/abc", urls=[entity._replace(url="javascript:x")]),
+			"look https://t.co/abc",
+		)
+
+	def test_unsafe_expansion_falls_back_to_short_url(self):
+		entity = url((5, 21), expanded="javascript:alert(1)")
+		self.assertEqual(
+			render("look https://t.co/abc", urls=[entity]),
+			'look <a href="https://t.co/abc" title="https://t.co/abc" target="_blank" rel="noopener nofollow">example.com/page</a>',
+		)
+
+	def test_media_link_dropped(self):
+		media = Media((6, 26), "https://t.co/pic", "https://pbs.twimg.com/media/x.jpg", "photo", 1, 1, None, ())
+		self.assertEqual(render("photo https://t.co/pic", media=[media]), "photo")
+
+	def test_entity_text_escaped(self):
+		entity = url((0, 16), display='<script>"x"</script>')
+		self.assertEqual(
+			render("https://t.co/abc", urls=[entity]),
+			'<a href="https://example.com/page" title="https://example.com/page" target="_blank" rel="noopener nofollow">'
+			'&lt;script&gt;&quot;x&quot;&lt;/script&gt;</a>',
+		)
+
+
+class AstralTextTest(unittest.TestCase):
+	'''
+	Characters outside the BMP are one code point, but two UTF-16 code
+	units, so code point and UTF-16 indices differ after them
+	'''
+	def test_emoji_before_entity_code_point_indices(self):
+		self.assertEqual(
+			render(f"{EMOJI} @someone", mentions=[mention("someone", (2, 10))]),
+			f"{EMOJI} {mention_link('someone')}",
+		)
+
+	def test_emoji_before_entity_utf16_indices(self):
+		self.assertEqual(
+			render(f"{EMOJI} @someone", mentions=[mention("someone", (3, 11))]),
+			f"{EMOJI} {mention_link('someone')}",
+		)
+
+	def test_several_emoji_before_several_entities(self):
+		text = f"{EMOJI}{EMOJI} #one {EMOJI} @someone https://t.co/abc {EMOJI}"
+		expected = f"{EMOJI}{EMOJI} {hashtag_link('one')} {EMOJI} {mention_link('someone')} {URL_LINK} {EMOJI}"
+
+		code_points = dict(hashtags=[hashtag("one", (3, 7))], mentions=[mention("someone", (10, 18))], urls=[url((19, 35))])
+		utf16 = dict(hashtags=[hashtag("one", (5, 9))], mentions=[mention("someone", (13, 21))], urls=[url((22, 38))])
+
+		self.assertEqual(render(text, **code_points), expected)
+		self.assertEqual(render(text, **utf16), expected)
+
+	def test_utf16_indices_pick_the_right_occurrence(self):
+		# Searching would find the first @someone; only the indices say it's
+		# the second
+		text = f"@someone {EMOJI} @someone"
+		expected = f"@someone {EMOJI} {mention_link('someone')}"
+
+		self.assertEqual(render(text, mentions=[mention("someone", (11, 19))]), expected)
+		self.assertEqual(render(text, mentions=[mention("someone", (12, 20))]), expected)
+
+	def test_astral_inside_entity(self):
+		text = f"#{ASTRAL_LETTER}tag done"
+		expected = f"{hashtag_link(ASTRAL_LETTER + 'tag', href_tag='%F0%A0%80%8Btag')} done"
+
+		self.assertEqual(render(text, hashtags=[hashtag(f"{ASTRAL_LETTER}tag", (0, 5))]), expected)
+		self.assertEqual(render(text, hashtags=[hashtag(f"{ASTRAL_LETTER}tag", (0, 6))]), expected)
+
+	def test_astral_inside_and_after_entity(self):
+		text = f"#{ASTRAL_LETTER} {EMOJI} @someone"
+		expected = f"{hashtag_link(ASTRAL_LETTER, href_tag='%F0%A0%80%8B')} {EMOJI} {mention_link('someone')}"
+
+		self.assertEqual(
+			render(text, hashtags=[hashtag(ASTRAL_LETTER, (0, 3))], mentions=[mention("someone", (6, 14))]),
+			expected,
+		)
+
+
+class OverlappingEntitiesTest(unittest.TestCase):
+	def test_adjacent(self):
+		self.assertEqual(
+			render("#one#two", hashtags=[hashtag("one", (0, 4)), hashtag("two", (4, 8))]),
+			hashtag_link("one") + hashtag_link("two"),
+		)
+
+	def test_adjacent_different_kinds(self):
+		self.assertEqual(
+			render("@someone#tag", mentions=[mention("someone", (0, 8))], hashtags=[hashtag("tag", (8, 12))]),
+			mention_link("someone") + hashtag_link("tag"),
+		)
+
+	def test_overlap_keeps_earliest(self):
+		# A hashtag reported inside a url is left as part of the url
+		self.assertEqual(
+			render("https://t.co/abc", urls=[url((0, 16))], hashtags=[hashtag("abc", (13, 16))]),
+			URL_LINK,
+		)
+
+	def test_same_start_keeps_longest(self):
+		self.assertEqual(
+			render(
+				"@someone_else hi",
+				mentions=[mention("someone", (0, 8)), mention("someone_else", (0, 13))],
+			),
+			f"{mention_link('someone_else')} hi",
+		)
+
+	def test_duplicate_entities(self):
+		self.assertEqual(
+			render("@someone", mentions=[mention("someone", (0, 8)), mention("someone", (0, 8))]),
+			mention_link("someone"),
+		)
+
+
+class BadIndicesTest(unittest.TestCase):
+	def test_out_of_range_found_by_search(self):
+		self.assertEqual(
+			render("hi @someone", mentions=[mention("someone", (40, 48))]),
+			f"hi {mention_link('someone')}",
+		)
+
+	def test_wrong_indices_found_by_search(self):
+		self.assertEqual(
+			render("hi @someone", mentions=[mention("someone", (0, 8))]),
+			f"hi {mention_link('someone')}",
+		)
+
+	def test_search_skips_longer_handles(self):
+		self.assertEqual(
+			render("@someone_else @someone", mentions=[mention("someone", (100, 108))]),
+			f"@someone_else {mention_link('someone')}",
+		)
+
+	def test_out_of_range_and_missing(self):
+		self.assertEqual(
+			render("hi there", mentions=[mention("someone", (40, 48))], urls=[url((-5, 200))]),
+			"hi there",
+		)
+
+	def test_truncated_entity(self):
+		# The entity runs past the end of the text, which was cut short
+		self.assertEqual(
+			render("read https://t.co/a", urls=[url((5, 21))]),
+			"read https://t.co/a",
+		)
+
+	def test_missing_indices(self):
+		self.assertEqual(
+			render("hi @someone", mentions=[mention("someone", None)]),
+			f"hi {mention_link('someone')}",
+		)
+
+
+class CodeTest(unittest.TestCase):
+	def test_entities_in_code_left_alone(self):
+		self.assertEqual(
+			render("run `@someone #tag` now", mentions=[mention("someone", (5, 13))], hashtags=[hashtag("tag", (14, 18))], code=True),
+			"run <code>@someone #tag</code> now",
+		)
+
+	@mock.patch.object(tweet_text, "highlight", None)
+	def test_fenced_block_with_language(self):
+		self.assertEqual(
+			render("```python\nx = 1 &lt; 2\n```", code=True),
+			'<pre><code class="language-python">x = 1 &lt; 2</code></pre>',
+		)
+
+	def test_code_off(self):
+		self.assertEqual(render("`x`"), "`x`")
+
+
+@unittest.skipUnless(tweet_text.highlight_available(), "needs Pygments")
+class HighlightTest(unittest.TestCase):
+	def test_fenced_block(self):
+		self.assertEqual(
+			render("```python\nif x &lt; 2:\n    pass\n```", code=True),
+			'<pre><code class="highlight language-python">'
+			'<span class="hl-k">if</span> <span class="hl-n">x</span> <span class="hl-o">&lt;</span> '
+			'<span class="hl-mi">2</span><span class="hl-p">:</span>&#10;'
+			'    <span class="hl-k">pass</span></code></pre>',
+		)
+
+	def test_unknown_language(self):
+		self.assertEqual(
+			render("```nosuchlanguage\nx = 1\n```", code=True),
+			'<pre><code class="language-nosuchlanguage">x = 1</code></pre>',
+		)
+
+	def test_indented_block(self):
+		# The language is only guessed, so just the text is checked
+		html = render("Like this:\n    def f():\n        return 1", code=True)
+
+		self.assertTrue(html.startswith('Like this:<br><pre><code class="highlight">'))
+		self.assertTrue(html.endswith("</code></pre>"))
+		self.assertEqual(re.sub("<[^>]+>", "", html), "Like this:def f():&#10;    return 1")
+
+	def test_inline_code_not_highlighted(self):
+		self.assertEqual(render("run `print(1)` now", code=True), "run <code>print(1)</code> now")
+
+
+if __name__ == "__main__":
+	unittest.main()
@@ -0,0 +1,152 @@
+import asyncio
+import unittest
+
+from bobbin import async_cache, fake_twitter, tweetbox, twitter
+from bobbin.twitter import Tweet
+from tests.util import USER, make_tweets, run
+
+
+async def shout(tweet):
+	await asyncio.sleep(0)
+	return tweet._replace(text=tweet.text.upper())
+
+
+class MapTweetsTest(unittest.TestCase):
+	def test_tweets_and_replies(self):
+		thread = tweetbox.Thread(
+			make_tweets(["one", "two"]),
+			replies={"1": tuple(make_tweets(["reply"], first_id=10))},
+		)
+		mapped = run(thread.map_tweets(shout))
+
+		self.assertEqual([tweet.text for tweet in mapped], ["ONE", "TWO"])
+		self.assertEqual([reply.text for reply in mapped.replies["1"]], ["REPLY"])
+		self.assertEqual(mapped.fetched_at, thread.fetched_at)
+
+	def test_keeps_author(self):
+		thread = tweetbox.Thread(make_tweets(["one"]))
+		thread.author = thread.author._replace(name="Refreshed")
+
+		self.assertEqual(run(thread.map_tweets(shout)).author.name, "Refreshed")
+
+
+class ConversationSearchApi:
+	'''
+	The v1.1 api, against a FakeTwitter, with a v2 style conversation search
+	that serves the fake's tweets in pages of the given ids
+	'''
+	def __init__(self, fake, pages, *, page_delay=0):
+		self.fake = fake
+		self.pages = pages
+		self.page_delay = page_delay
+		self.pages_fetched = 0
+
+	def __getattr__(self, name):
+		return getattr(twitter, name)
+
+	async def get_tweet(self, **kwargs):
+		tweet = await twitter.get_tweet(**kwargs)
+		return tweet._replace(conversation_id="1")
+
+	def conversation_pager(self, *, session, token, conversation_id, author_id):
+		async def fetch_page(cursor):
+			index = cursor or 0
+			await asyncio.sleep(self.page_delay)
+			self.pages_fetched += 1
+
+			tweets = [Tweet.from_tweet_json(self.fake.tweets[tweet_id]) for tweet_id in self.pages[index]]
+			return tweets, index + 1 if index + 1 < len(self.pages) else None
+
+		return twitter.TimelinePager(fetch_page)
+
+
+class ConversationSearchBudgetTest(unittest.TestCase):
+	def setUp(self):
+		self.fake = fake_twitter.FakeTwitter()
+		self.ids = self.fake.add_thread(USER, ["one", "two", "three", "four", "five"])
+
+	async def resolve(self, api, budget):
+		return [item async for item in tweetbox.generate_thread(
+			session=self.fake,
+			cache=async_cache.DictCache(),
+			token=twitter.Token(self.fake, "key", "secret"),
+			tail=self.ids[-1],
+			api=api,
+			conversation_search=True,
+			budget=budget,
+		)]
+
+	def api_calls(self, api):
+		return api.pages_fetched + sum(1 for method, _, _ in self.fake.requests if method == "GET")
+
+	def test_search_unlimited(self):
+		api = ConversationSearchApi(self.fake, [["4", "3"], ["2", "1"]])
+		items = run(self.resolve(api, tweetbox.UNLIMITED_BUDGET))
+
+		self.assertEqual([item.id for item in items], ["5", "4", "3", "2", "1"])
+		self.assertEqual(self.api_calls(api), 3)
+
+	def test_search_pages_count_against_max_calls(self):
+		api = ConversationSearchApi(self.fake, [["4", "3"], ["2", "1"]])
+		items = run(self.resolve(api, tweetbox.ResolutionBudget(max_calls=2)))
+
+		self.assertEqual([item.id for item in items[:-1]], ["5", "4", "3"])
+		self.assertEqual(items[-1], tweetbox.ThreadTruncated("2"))
+		self.assertEqual(self.api_calls(api), 2)
+
+	def test_search_stops_at_deadline(self):
+		api = ConversationSearchApi(self.fake, [["4", "3"]], page_delay=1)
+
+		async def resolve():
+			start = asyncio.get_event_loop().time()
+			try:
+				await self.resolve(api, tweetbox.ResolutionBudget(max_time=0.05))
+			finally:
+				self.elapsed = asyncio.get_event_loop().time() - start
+
+		# The whole budget went on the search, so there's no time left even
+		# for the tail
+		with self.assertRaises(asyncio.TimeoutError):
+			run(resolve())
+
+		self.assertLess(self.elapsed, 0.5)
+		self.assertEqual(api.pages_fetched, 0)
+
+
+class ThreadGetterTest(unittest.TestCase):
+	def setUp(self):
+		self.fake = fake_twitter.FakeTwitter()
+		self.ids = self.fake.add_thread(USER, ["one", "two", "three"])
+
+	def make_getter(self, **kwargs):
+		return tweetbox.make_thread_getter(
+			session=self.fake,
+			cache=async_cache.DictCache(),
+			token=twitter.Token(self.fake, "key", "secret"),
+			**kwargs,
+		)
+
+	def test_transforms_shared_by_concurrent_requests(self):
+		calls = []
+
+		async def transform(thread):
+			calls.append(thread.tail_id)
+			await asyncio.sleep(0.01)
+			return await thread.map_tweets(shout)
+
+		get_thread = self.make_getter(transforms=[transform])
+
+		async def get_twice():
+			return await asyncio.gather(
+				get_thread(tail=self.ids[-1]),
+				get_thread(tail=self.ids[-1]),
+			)
+
+		first, second = run(get_twice())
+		self.assertEqual([tweet.text for tweet in first], ["ONE", "TWO", "THREE"])
+		self.assertIs(first, second)
+		self.assertEqual(calls, [self.ids[-1]])
+
+
+if __name__ == "__main__":
+	unittest.main()
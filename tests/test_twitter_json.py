@@ -0,0 +1,261 @@
+import json
+import pathlib
+import shutil
+import tempfile
+import unittest
+from datetime import datetime, timezone
+
+from bobbin import recording, twitter, twitter_v2
+from bobbin.twitter import Tweet
+from tests.util import run
+
+# API responses, in the format saved by recording.RecordingSession
+FIXTURES = pathlib.Path(__file__).parent / "fixtures" / "twitter"
+
+
+def load_fixture(name):
+	return json.loads((FIXTURES / f"{name}.json").read_text())
+
+
+def v1_tweet(name):
+	return Tweet.from_tweet_json(load_fixture(name)["body"])
+
+
+def v2_tweet(name):
+	result = load_fixture(name)["body"]
+	return twitter_v2.tweet_from_json(result["data"], twitter_v2.Includes.from_result_json(result))
+
+
+def entity_text(tweet, entity):
+	start, end = entity.indices
+	return tweet.text[start:end]
+
+
+class V1TweetTest(unittest.TestCase):
+	def test_tweet(self):
+		tweet = v1_tweet("v1_tweet")
+
+		self.assertEqual(tweet.id, "1580661436132757506")
+		self.assertEqual(tweet.parent_id, "1580661433989185536")
+		self.assertEqual(tweet.parent_user_id, "33813347")
+		self.assertTrue(tweet.text.startswith("Part 2: the @Twitter API"))
+		self.assertEqual(tweet.created_at, datetime(2022, 10, 13, 17, 4, 45, tzinfo=timezone.utc))
+		self.assertIsNone(tweet.quoted_id)
+		self.assertIsNone(tweet.quoted)
+		self.assertIsNone(tweet.conversation_id)
+		self.assertIsNone(tweet.poll)
+		self.assertIsNone(tweet.edit_history)
+		self.assertEqual(tweet.metrics, twitter.PublicMetrics(31, 4, None, None))
+
+	def test_user(self):
+		user = v1_tweet("v1_tweet").user
+
+		self.assertEqual(user, twitter.TwitterUser(
+			"33813347",
+			"Lucretiel",
+			"Nathan West",
+			"https://pbs.twimg.com/profile_images/1/Lucretiel_normal.jpg",
+			"Rust, Python, & puzzles",
+			False,
+			2841,
+		))
+
+	def test_entities(self):
+		tweet = v1_tweet("v1_tweet")
+		entities = tweet.entities
+
+		self.assertEqual(len(entities.urls), 1)
+		self.assertEqual(entity_text(tweet, entities.urls[0]), "https://t.co/2lKuZ4XvTf")
+		self.assertEqual(entities.urls[0].expanded_url, "https://developer.twitter.com/en/docs")
+		self.assertEqual(entities.urls[0].display_url, "developer.twitter.com/en/docs")
+
+		self.assertEqual(entities.mentions, (twitter.MentionEntity((12, 20), "783214", "Twitter"),))
+		self.assertEqual(entity_text(tweet, entities.mentions[0]), "@Twitter")
+
+		self.assertEqual(len(entities.hashtags), 1)
+		self.assertEqual(entity_text(tweet, entities.hashtags[0]), "#python")
+
+	def test_media(self):
+		tweet = v1_tweet("v1_tweet")
+		media, = tweet.entities.media
+
+		# Taken from extended_entities, so it has the alt text
+		self.assertEqual(media.type, "photo")
+		self.assertEqual(media.url, "https://t.co/PhOtO12345")
+		self.assertEqual(entity_text(tweet, media), media.url)
+		self.assertEqual(media.media_url, "https://pbs.twimg.com/media/FfABCDEXkAEa1b2.jpg")
+		self.assertEqual((media.width, media.height), (2048, 1152))
+		self.assertEqual(media.alt_text, "A diagram of a thread")
+		self.assertEqual(media.variants, ())
+
+	def test_quote(self):
+		tweet = v1_tweet("v1_quote")
+
+		self.assertEqual(tweet.quoted_id, "1580600000000000000")
+		self.assertEqual(tweet.quoted.id, "1580600000000000000")
+		self.assertEqual(tweet.quoted.text, "Entities are hard")
+		self.assertEqual(tweet.quoted.user.handle, "Twitter")
+		self.assertTrue(tweet.quoted.user.verified)
+		self.assertEqual(tweet.quoted.metrics.likes, 1200)
+		self.assertIsNone(tweet.parent_id)
+
+	def test_deleted_quote(self):
+		tweet = v1_tweet("v1_quote_deleted")
+
+		self.assertEqual(tweet.quoted_id, "1570000000000000000")
+		self.assertIsNone(tweet.quoted)
+
+	def test_extended_tweet(self):
+		blob = load_fixture("v1_extended_tweet")["body"]
+		tweet = Tweet.from_tweet_json(blob)
+
+		self.assertEqual(tweet.text, blob["extended_tweet"]["full_text"])
+		self.assertTrue(tweet.text.endswith("#long"))
+
+		# The truncated text's "read more" link isn't an entity of the full
+		# text
+		self.assertEqual(tweet.entities.urls, ())
+		self.assertEqual(entity_text(tweet, tweet.entities.mentions[0]), "@Twitter")
+		self.assertEqual(entity_text(tweet, tweet.entities.hashtags[0]), "#long")
+		self.assertEqual(tweet.metrics, twitter.PublicMetrics(7, 0, 2, 0))
+
+	def test_short_compat_tweet(self):
+		blob = load_fixture("v1_extended_tweet")["body"]
+		del blob["extended_tweet"]
+		blob["text"] = "short"
+		blob["entities"] = {}
+
+		tweet = Tweet.from_tweet_json(blob)
+
+		self.assertEqual(tweet.text, "short")
+		self.assertEqual(tweet.entities, twitter.Entities((), (), (), ()))
+
+	def test_sparse_user(self):
+		tweet = v1_tweet("v1_sparse_user")
+
+		self.assertEqual(tweet.user, twitter.TwitterUser("1500000000000000000", "new_account", "New Account", followers=0))
+		self.assertIsNone(tweet.user.avatar_url)
+		self.assertIsNone(tweet.user.bio)
+		self.assertFalse(tweet.user.verified)
+		self.assertEqual(tweet.metrics, twitter.PublicMetrics(0, 0, None, None))
+		self.assertEqual(tweet.entities, twitter.Entities((), (), (), ()))
+
+
+class V2TweetTest(unittest.TestCase):
+	def test_tweet(self):
+		tweet = v2_tweet("v2_tweet")
+
+		self.assertEqual(tweet.id, "1580661436132757506")
+		self.assertEqual(tweet.parent_id, "1580661433989185536")
+		self.assertEqual(tweet.parent_user_id, "33813347")
+		self.assertEqual(tweet.conversation_id, "1580661431000000000")
+		self.assertEqual(tweet.created_at, datetime(2022, 10, 13, 17, 4, 45, tzinfo=timezone.utc))
+		self.assertEqual(tweet.metrics, twitter.PublicMetrics(31, 4, 2, 1))
+		self.assertEqual(tweet.edit_history, ("1580661434000000000", "1580661436132757506"))
+		self.assertEqual(tweet.latest_version_id, tweet.id)
+		self.assertIsNone(tweet.quoted_id)
+
+	def test_matches_v1(self):
+		v1 = v1_tweet("v1_tweet")
+		v2 = v2_tweet("v2_tweet")
+
+		self.assertEqual(v2.text, v1.text)
+		self.assertEqual(v2.user, v1.user)
+		self.assertEqual(v2.entities.urls, v1.entities.urls)
+		self.assertEqual(v2.entities.mentions, v1.entities.mentions)
+		self.assertEqual(v2.entities.hashtags, v1.entities.hashtags)
+
+	def test_media(self):
+		tweet = v2_tweet("v2_tweet")
+		media, = tweet.entities.media
+
+		# The t.co url comes from the url entity with the media_key, which
+		# isn't also reported as a url
+		self.assertEqual(media.url, "https://t.co/PhOtO12345")
+		self.assertEqual(entity_text(tweet, media), media.url)
+		self.assertEqual(media.media_url, "https://pbs.twimg.com/media/FfABCDEXkAEa1b2.jpg")
+		self.assertEqual((media.width, media.height), (2048, 1152))
+		self.assertEqual(media.alt_text, "A diagram of a thread")
+		self.assertNotIn(media.url, [url.url for url in tweet.entities.urls])
+
+	def test_poll(self):
+		poll = v2_tweet("v2_tweet").poll
+
+		self.assertEqual(poll.id, "1580661430000000002")
+		self.assertEqual(poll.options, (
+			twitter.PollOption(1, "Yes", 9),
+			twitter.PollOption(2, "No", 3),
+		))
+		self.assertTrue(poll.closed)
+		self.assertEqual(poll.duration_minutes, 1440)
+		self.assertEqual(poll.end_datetime, datetime(2022, 10, 14, 17, 4, 45, tzinfo=timezone.utc))
+
+	def test_quote(self):
+		tweet = v2_tweet("v2_quote")
+
+		self.assertEqual(tweet.quoted_id, "1580600000000000000")
+		self.assertEqual(tweet.quoted.text, "Entities are hard")
+		self.assertEqual(tweet.quoted.user.handle, "Twitter")
+		self.assertEqual(tweet.quoted.metrics, twitter.PublicMetrics(1200, 300, 80, 12))
+		self.assertIsNone(tweet.parent_id)
+
+	def test_quote_missing_author(self):
+		tweet = v2_tweet("v2_quote_missing_author")
+
+		self.assertEqual(tweet.quoted_id, "1580600000000000000")
+		self.assertIsNone(tweet.quoted)
+
+	def test_quote_missing(self):
+		result = load_fixture("v2_quote")["body"]
+		del result["includes"]["tweets"]
+		tweet = twitter_v2.tweet_from_json(result["data"], twitter_v2.Includes.from_result_json(result))
+
+		self.assertEqual(tweet.quoted_id, "1580600000000000000")
+		self.assertIsNone(tweet.quoted)
+
+	def test_sparse_user(self):
+		tweet = v2_tweet("v2_sparse_user")
+
+		self.assertEqual(tweet.user, twitter.TwitterUser("1500000000000000000", "new_account", "New Account"))
+		self.assertIsNone(tweet.metrics)
+		self.assertIsNone(tweet.conversation_id)
+		self.assertIsNone(tweet.poll)
+		self.assertEqual(tweet.entities, twitter.Entities((), (), (), ()))
+
+
+class ReplayTest(unittest.TestCase):
+	'''
+	Fetch the fixtures through the API functions, the way they'd be replayed
+	by recording.ReplaySession
+	'''
+	def setUp(self):
+		self.directory = pathlib.Path(tempfile.mkdtemp())
+		self.addCleanup(shutil.rmtree, self.directory)
+
+	def install(self, name):
+		fixture = load_fixture(name)
+		key = recording.fixture_key(fixture["method"], fixture["url"], fixture["params"])
+		shutil.copy(FIXTURES / f"{name}.json", self.directory / key)
+
+	def get_tweet(self, api, tweet_id):
+		return run(api.get_tweet(
+			session=recording.ReplaySession(self.directory),
+			token=f"Bearer {recording.RECORDED_TOKEN}",
+			tweet_id=tweet_id,
+		))
+
+	def test_v1(self):
+		self.install("v1_quote")
+		tweet = self.get_tweet(twitter, "1580661500000000000")
+
+		self.assertEqual(tweet, v1_tweet("v1_quote"))
+
+	def test_v2(self):
+		self.install("v2_tweet")
+		tweet = self.get_tweet(twitter_v2, "1580661436132757506")
+
+		self.assertEqual(tweet, v2_tweet("v2_tweet"))
+
+	def test_missing(self):
+		with self.assertRaises(recording.MissingFixtureError):
+			self.get_tweet(twitter, "1")
@@ -0,0 +1,35 @@
+# Helpers shared by the tests. The tests use only unittest, and are run from
+# the root of the repository, with src on the path:
+#
+#     make test
+
+import asyncio
+
+from bobbin import fake_twitter, tweetbox
+from bobbin.twitter import Tweet
+
+USER = fake_twitter.make_user_json("7", "someone", "Someone")
+
+
+def run(coro):
+	return asyncio.run(coro)
+
+
+def make_tweets(texts, *, user=USER, first_id=1):
+	'''
+	Make a chain of Tweets by user, each replying to the last, with ids
+	counting up from first_id
+	'''
+	return [
+		Tweet.from_tweet_json(fake_twitter.make_tweet_json(
+			str(first_id + index),
+			user,
+			text,
+			parent_id=str(first_id + index - 1) if index > 0 else None,
+		))
+		for index, text in enumerate(texts)
+	]
+
+
+def make_thread(texts, **kwargs):
+	return tweetbox.Thread(make_tweets(texts, **kwargs))